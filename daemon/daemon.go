@@ -9,6 +9,7 @@ import (
 
 	"github.com/hyperhq/hyperd/daemon/daemondb"
 	"github.com/hyperhq/hyperd/daemon/pod"
+	"github.com/hyperhq/hyperd/daemon/storagemetrics"
 	apitypes "github.com/hyperhq/hyperd/types"
 
 	docker "github.com/docker/docker/daemon"
@@ -22,6 +23,9 @@ import (
 	"github.com/hyperhq/runv/driverloader"
 	"github.com/hyperhq/runv/factory"
 	"github.com/hyperhq/runv/hypervisor"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -38,6 +42,14 @@ type Daemon struct {
 	Storage    Storage
 	Hypervisor string
 	DefaultLog *pod.GlobalLogConfig
+
+	// StorageEvents receives the volume lifecycle events of Storage.
+	StorageEvents *StorageEventBus
+
+	storageStats *storageStatsCache
+	storageUsage *storageUsageCache
+	// gcRunning is set while TriggerGC runs.
+	gcRunning int32
 }
 
 func (daemon *Daemon) Restore() error {
@@ -49,10 +61,17 @@ func (daemon *Daemon) Restore() error {
 		return err
 	}
 
-	if daemon.GetPodNum() == 0 {
-		return nil
+	if daemon.GetPodNum() != 0 {
+		if err := daemon.restorePods(); err != nil {
+			return err
+		}
 	}
 
+	daemon.collectVolumes()
+	return nil
+}
+
+func (daemon *Daemon) restorePods() error {
 	ch := pod.LoadAllPods(daemon.db)
 	if ch == nil {
 		estr := "Cannot list pods in leveldb"
@@ -126,12 +145,61 @@ func NewDaemon(cfg *apitypes.HyperConfig) (*Daemon, error) {
 	if err != nil {
 		return nil, err
 	}
-	stor, err := StorageFactory(sysinfo, daemon.db)
+	if cfg.StoragePlugins != "" {
+		if err := LoadStoragePlugins(cfg.StoragePlugins); err != nil {
+			return nil, err
+		}
+	}
+	storageCfg, err := NewStorageConfig(cfg.StorageOpt)
+	if err != nil {
+		return nil, err
+	}
+	storageCfg.Root = cfg.StorageRoot
+	storageCfg.DriverConfigFile = cfg.StorageDriverConfig
+	storageCfg.HealthCheckInterval = cfg.StorageHealthCheckInterval
+	storageCfg.FallbackDrivers = cfg.StorageFallbackDrivers
+	storageCfg.VerifyChecksum = cfg.StorageVerifyChecksum
+	storageCfg.ReadOnly = cfg.StorageReadOnly
+	storageCfg.Fsck = cfg.StorageFsck
+	storageCfg.AsyncDriverInit = cfg.StorageAsyncDriverInit
+	storageCfg.PrepareConcurrency = cfg.StoragePrepareConcurrency
+	storageCfg.InjectBytesPerSec = cfg.StorageInjectBytesPerSec
+	storageCfg.CircuitBreaker = CircuitBreakerConfig{
+		FailureThreshold: cfg.StorageCircuitBreakerThreshold,
+		Window:           cfg.StorageCircuitBreakerWindow,
+		HalfOpenTimeout:  cfg.StorageCircuitBreakerTimeout,
+	}
+	if cfg.StorageMetrics {
+		metrics, err := storagemetrics.NewPrometheusStorageMetrics(prometheus.DefaultRegisterer)
+		if err != nil {
+			return nil, err
+		}
+		storageCfg.Metrics = metrics
+	}
+	if cfg.StorageTracing {
+		storageCfg.Tracer = otel.Tracer("github.com/hyperhq/hyperd/daemon/storage")
+	}
+	if cfg.StoragePodDriverLabel != "" {
+		storageCfg.PodStorageSelector = PodLabelStorageSelector(cfg.StoragePodDriverLabel)
+	}
+	if cfg.StorageAuditLog != "" {
+		audit, err := NewFileAuditLog(cfg.StorageAuditLog)
+		if err != nil {
+			return nil, err
+		}
+		storageCfg.AuditLog = audit
+	}
+	stor, err := StorageFactory(context.Background(), sysinfo, daemon.db, storageCfg)
 	if err != nil {
 		return nil, err
 	}
 	daemon.Storage = stor
-	daemon.Storage.Init()
+	daemon.StorageEvents = storageCfg.Events
+	daemon.storageStats = newStorageStatsCache(cfg.StorageStatsTTL)
+	daemon.storageUsage = newStorageUsageCache(cfg.StorageUsageTTL)
+	if cfg.StorageCompactFileCount > 0 && !cfg.StorageReadOnly {
+		go daemon.autoCompact(cfg.StorageCompactFileCount, cfg.StorageCompactInterval)
+	}
 
 	err = daemon.initRunV(cfg)
 	if err != nil {
@@ -286,7 +354,7 @@ func (daemon *Daemon) DeleteVolumeId(podId string) error {
 		return err
 	}
 	for _, vol := range vols {
-		daemon.Storage.RemoveVolume(podId, vol)
+		daemon.Storage.RemoveVolume(context.Background(), podId, vol)
 	}
 	return daemon.db.DeletePodVolumes(podId)
 }
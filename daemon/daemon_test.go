@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestStorageFactoryUnhealthy(t *testing.T) {
+	mock := NewMockStorage()
+	mock.SetError("HealthCheck", errors.New("pool is gone"))
+	RegisterDriver("test-mock", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return mock, nil
+	})
+	defer unregisterDriver("test-mock")
+
+	if _, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "test-mock"}, nil, nil); err == nil {
+		t.Fatal("an unhealthy driver should be refused")
+	}
+	calls := mock.Calls("")
+	if len(calls) != 3 || calls[0].Method != "Init" || calls[1].Method != "HealthCheck" || calls[2].Method != "CleanUp" {
+		t.Fatalf("the unhealthy driver should be cleaned up, got %v", calls)
+	}
+
+	mock.SetError("HealthCheck", nil)
+	metrics := &fakeStorageMetrics{}
+	s, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "test-mock"}, nil, &StorageConfig{Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.SetPrepareContainerError(errors.New("no space"))
+	if _, err := s.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); err == nil {
+		t.Fatal("the error of the driver should be returned")
+	}
+	if len(metrics.records) != 1 || metrics.records[0].driver != "mock" || metrics.records[0].err == nil {
+		t.Fatalf("the failed PrepareContainer should be recorded, got %v", metrics.records)
+	}
+}
+
+func TestStorageFactoryFallback(t *testing.T) {
+	root, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// the work dir of overlay can not be made under a file
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewStorageConfig(map[string]string{
+		"overlay.workdir": filepath.Join(file, "work"),
+		"rawblock.fs":     "ext4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Root = root
+
+	if _, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "overlay"}, nil, config); err == nil {
+		t.Fatal("overlay should fail to initialize")
+	}
+	config.FallbackDrivers = []string{"missing", "rawblock"}
+	s, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "overlay"}, nil, config)
+	if err != nil {
+		t.Fatalf("the fallback driver should be returned, got %v", err)
+	}
+	defer s.CleanUp(context.Background())
+	if s.Type() != "rawblock" {
+		t.Fatalf("expected the rawblock fallback, got %s", s.Type())
+	}
+	if s.RootPath() != filepath.Join(root, "rawblock") {
+		t.Fatalf("the fallback should keep the storage root, got %s", s.RootPath())
+	}
+}
+
+func TestDeleteVolumeId(t *testing.T) {
+	root, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock := NewMockStorage()
+	daemon := &Daemon{db: db, Storage: mock}
+	podId := testPodId(t)
+	for _, name := range []string{"vol1", "vol2"} {
+		spec := &apitypes.UserVolume{Name: name}
+		if err := mock.CreateVolume(context.Background(), podId, spec); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveVolumeRecord(context.Background(), db, podId, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := daemon.DeleteVolumeId(podId); err != nil {
+		t.Fatal(err)
+	}
+	if calls := mock.Calls("RemoveVolume"); len(calls) != 2 {
+		t.Fatalf("expected both volumes removed from the storage, got %v", calls)
+	}
+	if vols, _ := mock.ListVolumes(context.Background(), podId); len(vols) != 0 {
+		t.Fatalf("unexpected volumes left %v", vols)
+	}
+	if records, err := db.ListPodVolumes(podId); err != nil || len(records) != 0 {
+		t.Fatalf("the records should be deleted, got %v, %v", records, err)
+	}
+}
@@ -1,6 +1,7 @@
 package daemondb
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
@@ -85,6 +86,120 @@ func (d *DaemonDB) DeletePodVolumes(podId string) error {
 	return d.PrefixDelete(prefixVolume(podId))
 }
 
+// ListAllVolumes returns the volumes of all the pods, keyed by
+// vol-<podId>-<volname>.
+func (d *DaemonDB) ListAllVolumes() chan *KVPair {
+	return d.PrefixList2Chan(prefixVolume(""), nil)
+}
+
+// Keys of the encrypted volumes, sealed by the storage driver
+func (d *DaemonDB) UpdateVolumeKey(uuid string, data []byte) error {
+	return d.Update(keyVolumeLuks(uuid), data)
+}
+
+func (d *DaemonDB) GetVolumeKey(uuid string) ([]byte, error) {
+	return d.db.Get(keyVolumeLuks(uuid), nil)
+}
+
+func (d *DaemonDB) DeleteVolumeKey(uuid string) error {
+	return d.db.Delete(keyVolumeLuks(uuid), nil)
+}
+
+// Storage drivers of the pods, when the driver is chosen by pod
+func (d *DaemonDB) UpdatePodStorageDriver(podId, driver string) error {
+	return d.Update(keyPodStorage(podId), []byte(driver))
+}
+
+func (d *DaemonDB) GetPodStorageDriver(podId string) (string, error) {
+	return d.GetString(keyPodStorage(podId))
+}
+
+func (d *DaemonDB) DeletePodStorageDriver(podId string) error {
+	return d.db.Delete(keyPodStorage(podId), nil)
+}
+
+// ListPodStorageDrivers returns the drivers of all the pods, keyed by
+// storage-pod-<podId>.
+func (d *DaemonDB) ListPodStorageDrivers() chan *KVPair {
+	return d.PrefixList2Chan([]byte(POD_STORAGE_PREFIX), nil)
+}
+
+// Pods of the containers, whose storage driver the containers use
+func (d *DaemonDB) UpdateContainerStoragePod(mountId, podId string) error {
+	return d.Update(keyContainerStorage(mountId), []byte(podId))
+}
+
+func (d *DaemonDB) GetContainerStoragePod(mountId string) (string, error) {
+	return d.GetString(keyContainerStorage(mountId))
+}
+
+func (d *DaemonDB) DeleteContainerStoragePod(mountId string) error {
+	return d.db.Delete(keyContainerStorage(mountId), nil)
+}
+
+// ListContainerStoragePods returns the pods of all the containers, keyed by
+// storage-container-<mountId>.
+func (d *DaemonDB) ListContainerStoragePods() chan *KVPair {
+	return d.PrefixList2Chan([]byte(CTR_STORAGE_PREFIX), nil)
+}
+
+// Blocks of the containers by fingerprint, see the dedup of the rawblock
+// storage
+func (d *DaemonDB) UpdateBlockFingerprint(fp, mountId string) error {
+	return d.Update(keyBlockFingerprint(fp), []byte(mountId))
+}
+
+func (d *DaemonDB) GetBlockFingerprint(fp string) (string, error) {
+	return d.GetString(keyBlockFingerprint(fp))
+}
+
+func (d *DaemonDB) DeleteBlockFingerprint(fp string) error {
+	return d.db.Delete(keyBlockFingerprint(fp), nil)
+}
+
+// Bytes saved by the deduplicated blocks of the containers
+func (d *DaemonDB) UpdateDedupedBlock(mountId string, saved int64) error {
+	return d.Update(keyBlockDedup(mountId), []byte(strconv.FormatInt(saved, 10)))
+}
+
+func (d *DaemonDB) GetDedupedBlock(mountId string) (int64, error) {
+	v, err := d.GetString(keyBlockDedup(mountId))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (d *DaemonDB) DeleteDedupedBlock(mountId string) error {
+	return d.db.Delete(keyBlockDedup(mountId), nil)
+}
+
+// ListDedupedBlocks returns the bytes saved by the deduplicated blocks, keyed
+// by block-dedup-<mountId>.
+func (d *DaemonDB) ListDedupedBlocks() chan *KVPair {
+	return d.PrefixList2Chan([]byte(BLOCK_DEDUP_PREFIX), nil)
+}
+
+// Containers mounting the shared volumes, see the shared vfs volumes of the
+// overlay storage
+func (d *DaemonDB) AddSharedVolumeRef(name, podId, mountId string) error {
+	return d.Update(keySharedVolume(name, podId, mountId), nil)
+}
+
+func (d *DaemonDB) DeleteSharedVolumeRef(name, podId, mountId string) error {
+	return d.db.Delete(keySharedVolume(name, podId, mountId), nil)
+}
+
+// ListSharedVolumeRefs returns the containers mounting the shared volume,
+// keyed by shared-volume-<name>/<podId>/<mountId>; all of them when name is
+// empty.
+func (d *DaemonDB) ListSharedVolumeRefs(name string) chan *KVPair {
+	if name == "" {
+		return d.PrefixList2Chan([]byte(SHARED_VOLUME_PREFIX), nil)
+	}
+	return d.PrefixList2Chan(prefixSharedVolume(name), nil)
+}
+
 // POD to Containers (string to string list)
 func (d *DaemonDB) LagecyGetP2C(id string) ([]string, error) {
 	glog.V(3).Info("try get container list for pod ", id)
@@ -10,11 +10,21 @@ const (
 	POD_VM_KEY        = "vm-%s"
 	POD_CONTAINER_KEY = "pod-container-%s"
 	POD_VOLUME_KEY    = "vol-%s-%s"
+	VOLUME_LUKS_KEY   = "luks-%s"
+	POD_STORAGE_KEY   = "storage-pod-%s"
+	CTR_STORAGE_KEY   = "storage-container-%s"
+	BLOCK_FP_KEY      = "block-fingerprint-%s"
+	BLOCK_DEDUP_KEY   = "block-dedup-%s"
+	SHARED_VOLUME_KEY = "shared-volume-%s/%s/%s"
 
 	POD_PREFIX           = "pod-"
 	POD_CONTAINER_PREFIX = "pod-container-"
 	POD_VOLUME_PREFIX    = "vol-%s"
 	POD_VM_PREFIX        = "vm-"
+	POD_STORAGE_PREFIX   = "storage-pod-"
+	CTR_STORAGE_PREFIX   = "storage-container-"
+	BLOCK_DEDUP_PREFIX   = "block-dedup-"
+	SHARED_VOLUME_PREFIX = "shared-volume-"
 )
 
 //the id is a vm id
@@ -43,6 +53,43 @@ func keyVolume(pod string, volume string) []byte {
 	return []byte(fmt.Sprintf(POD_VOLUME_KEY, pod, volume))
 }
 
+// the id is the uuid of a luks volume
+// and the db content is its sealed key
+func keyVolumeLuks(uuid string) []byte {
+	return []byte(fmt.Sprintf(VOLUME_LUKS_KEY, uuid))
+}
+
+// the id is a pod id
+// and the db content is the storage driver of the pod
+func keyPodStorage(id string) []byte {
+	return []byte(fmt.Sprintf(POD_STORAGE_KEY, id))
+}
+
+// the id is the mount id of a container
+// and the db content is the pod id, whose storage driver the container uses
+func keyContainerStorage(id string) []byte {
+	return []byte(fmt.Sprintf(CTR_STORAGE_KEY, id))
+}
+
+// the id is the fingerprint of a block
+// and the db content is the mount id of the container owning the block
+func keyBlockFingerprint(fp string) []byte {
+	return []byte(fmt.Sprintf(BLOCK_FP_KEY, fp))
+}
+
+// the id is the mount id of a container
+// and the db content is the bytes its block saved by sharing the extents of
+// another one
+func keyBlockDedup(id string) []byte {
+	return []byte(fmt.Sprintf(BLOCK_DEDUP_KEY, id))
+}
+
+// the ids are the name of a shared volume, and the pod and the mount id of a
+// container mounting it, the db content is empty
+func keySharedVolume(name, podId, mountId string) []byte {
+	return []byte(fmt.Sprintf(SHARED_VOLUME_KEY, name, podId, mountId))
+}
+
 func prefixPod() []byte {
 	return []byte(POD_PREFIX)
 }
@@ -55,3 +102,8 @@ func prefixP2V() []byte {
 func prefixVolume(podId string) []byte {
 	return []byte(fmt.Sprintf(POD_VOLUME_PREFIX, podId))
 }
+
+// the name is of a shared volume, the names of the volumes can not hold a /
+func prefixSharedVolume(name string) []byte {
+	return []byte(SHARED_VOLUME_PREFIX + name + "/")
+}
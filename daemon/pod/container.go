@@ -21,11 +21,13 @@ import (
 
 	"github.com/hyperhq/hypercontainer-utils/hlog"
 	"github.com/hyperhq/hyperd/errors"
+	"github.com/hyperhq/hyperd/storage"
 	apitypes "github.com/hyperhq/hyperd/types"
 	"github.com/hyperhq/hyperd/utils"
 	runv "github.com/hyperhq/runv/api"
 	"github.com/hyperhq/runv/hypervisor"
 	"github.com/hyperhq/runv/lib/term"
+	"golang.org/x/net/context"
 )
 
 var epocZero = time.Time{}
@@ -715,18 +717,39 @@ func (c *Container) createVolumes() error {
 	defer func() {
 		if err != nil {
 			for _, v := range created {
-				c.p.factory.sd.RemoveVolume(c.p.Id(), []byte(v))
+				c.p.factory.sd.RemoveVolume(context.Background(), c.p.Id(), []byte(v))
 			}
 		}
 	}()
 
+	// the specs are all checked before any volume is created
+	for _, v := range c.spec.Volumes {
+		if v.Detail == nil || v.Detail.Source != "" {
+			continue
+		}
+		if errs := c.p.factory.sd.ValidateVolumeSpec(v.Detail); len(errs) > 0 {
+			err = fmt.Errorf("invalid volume %s: %s", v.Volume, storage.JoinValidationErrors(errs))
+			c.Log(ERROR, err)
+			return err
+		}
+	}
+
 	for _, v := range c.spec.Volumes {
 		if v.Detail == nil || v.Detail.Source != "" {
 			continue
 		}
 		c.Log(INFO, "create volume %s", v.Volume)
 
-		err = c.p.factory.sd.CreateVolume(c.p.Id(), v.Detail)
+		caps := c.p.factory.sd.Capabilities()
+		if v.Detail.Encrypted && !caps.SupportsEncryption {
+			err = fmt.Errorf("volume %s asks for encryption, which the %s storage does not support", v.Volume, c.p.factory.sd.Type())
+			c.Log(ERROR, err)
+			return err
+		}
+		if v.Detail.SizeBytes > 0 && !caps.SupportsQuota {
+			c.Log(WARNING, "the %s storage does not bound the size of volume %s", c.p.factory.sd.Type(), v.Volume)
+		}
+		err = c.p.factory.sd.CreateVolume(context.Background(), c.p.Id(), v.Detail)
 		if err != nil {
 			c.Log(ERROR, "failed to create volume %s: %v", v.Volume, err)
 			return err
@@ -816,7 +839,10 @@ func (c *Container) injectFiles(mountId string) error {
 		}
 
 		file := f.Detail
-		var src io.Reader
+		var (
+			src    io.Reader
+			xattrs map[string][]byte
+		)
 
 		if file.Uri != "" {
 			urisrc, err := utils.UriReader(file.Uri)
@@ -825,6 +851,13 @@ func (c *Container) injectFiles(mountId string) error {
 			}
 			defer urisrc.Close()
 			src = urisrc
+			// the ACLs of a file of the host are kept
+			if strings.HasPrefix(file.Uri, "file://") {
+				xattrs, err = storage.PosixACLs(strings.TrimPrefix(file.Uri, "file://"))
+				if err != nil {
+					c.Log(WARNING, "failed to get the ACLs of %s: %v", file.Uri, err)
+				}
+			}
 		} else {
 			src = strings.NewReader(file.Content)
 		}
@@ -835,8 +868,8 @@ func (c *Container) injectFiles(mountId string) error {
 		default:
 		}
 
-		err := c.p.factory.sd.InjectFile(src, mountId, targetPath, sharedDir,
-			utils.PermInt(f.Perm), utils.UidInt(f.User), utils.UidInt(f.Group))
+		err := c.p.factory.sd.InjectFile(context.Background(), src, mountId, targetPath, sharedDir,
+			utils.PermInt(f.Perm), utils.UidInt(f.User), utils.UidInt(f.Group), xattrs)
 		if err != nil {
 			c.Log(ERROR, "got error when inject files: %v", err)
 			return err
@@ -870,12 +903,14 @@ func (c *Container) addToSandbox() error {
 	)
 	c.Log(DEBUG, "begin add to sandbox")
 	c.status.Create()
+	var volumes []string
 	for _, v := range c.spec.Volumes {
 		if volmap[v.Volume] {
 			continue
 		}
 		if vol, ok := c.p.volumes[v.Volume]; ok {
 			volmap[v.Volume] = true
+			volumes = append(volumes, v.Volume)
 			if err := vol.subscribeInsert(wg); err != nil {
 				c.Log(ERROR, "container depends on an impossible volume: %v", err)
 				return err
@@ -883,7 +918,13 @@ func (c *Container) addToSandbox() error {
 		}
 	}
 
-	root, err := c.p.factory.sd.PrepareContainer(c.descript.MountId, c.p.sandboxShareDir(), c.spec.ReadOnly)
+	root, err := c.p.factory.sd.PrepareContainer(context.Background(), c.descript.MountId, c.p.sandboxShareDir(), storage.ContainerOptions{
+		ReadOnly:       c.spec.ReadOnly,
+		SELinuxLabel:   c.p.globalSpec.SelinuxLabel,
+		PodID:          c.p.Id(),
+		PodAnnotations: c.p.labels,
+		Volumes:        volumes,
+	})
 	if err != nil {
 		c.Log(ERROR, "failed to prepare rootfs: %v", err)
 		return err
@@ -1134,7 +1175,7 @@ func (c *Container) umountRootVol() error {
 		c.Log(DEBUG, "no root volume to umount")
 		return nil
 	}
-	err := c.p.factory.sd.CleanupContainer(c.descript.MountId, c.p.sandboxShareDir())
+	err := c.p.factory.sd.CleanupContainer(context.Background(), c.descript.MountId, c.p.sandboxShareDir())
 	if err != nil {
 		c.Log(ERROR, "failed to umount root volume: %v", err)
 		return err
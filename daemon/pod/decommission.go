@@ -11,6 +11,7 @@ import (
 
 	"github.com/hyperhq/hyperd/utils"
 	"github.com/hyperhq/runv/hypervisor"
+	"golang.org/x/net/context"
 )
 
 type sandboxOp func(sb *hypervisor.Vm) error
@@ -605,3 +606,52 @@ func (p *XPod) decommissionResources() (err error) {
 
 	return err
 }
+
+// HotUnplugVolume removes a volume from the sandbox of the running pod, and
+// removes it with its content. No container of the pod may use it.
+func (p *XPod) HotUnplugVolume(name string) error {
+	if !p.IsRunning() {
+		err := fmt.Errorf("pod is not running")
+		p.Log(ERROR, err)
+		return err
+	}
+
+	p.resourceLock.Lock()
+	defer p.resourceLock.Unlock()
+
+	v, ok := p.volumes[name]
+	if !ok {
+		err := fmt.Errorf("volume %s not found", name)
+		p.Log(ERROR, err)
+		return err
+	}
+	for _, c := range p.containers {
+		for _, cv := range c.volumes() {
+			if cv.Name == name {
+				err := fmt.Errorf("volume %s is used by container %s", name, c.Id())
+				p.Log(ERROR, err)
+				return err
+			}
+		}
+	}
+
+	if err := v.removeFromSandbox(); err != nil {
+		return err
+	}
+	if err := v.umount(); err != nil {
+		v.Log(ERROR, "failed to umount volume: %v", err)
+		return err
+	}
+	delete(p.volumes, name)
+
+	if err := v.removeFromDB(); err != nil {
+		return err
+	}
+	if err := p.saveLayout(); err != nil {
+		return err
+	}
+	if err := p.saveSandbox(); err != nil {
+		return err
+	}
+	return p.factory.sd.HotUnplugVolume(context.Background(), p.Id(), name)
+}
@@ -9,10 +9,12 @@ import (
 
 	"github.com/hyperhq/hypercontainer-utils/hlog"
 	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
 	apitypes "github.com/hyperhq/hyperd/types"
 	"github.com/hyperhq/hyperd/utils"
 	runv "github.com/hyperhq/runv/api"
 	"github.com/hyperhq/runv/factory"
+	"golang.org/x/net/context"
 )
 
 type ContainerEngine interface {
@@ -24,12 +26,25 @@ type ContainerEngine interface {
 
 type PodStorage interface {
 	Type() string
+	Capabilities() storage.Capabilities
 
-	PrepareContainer(mountId, sharedDir string, readonly bool) (*runv.VolumeDescription, error)
-	CleanupContainer(id, sharedDir string) error
-	InjectFile(src io.Reader, containerId, target, baseDir string, perm, uid, gid int) error
-	CreateVolume(podId string, spec *apitypes.UserVolume) error
-	RemoveVolume(podId string, record []byte) error
+	PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error)
+	PrewarmContainer(ctx context.Context, mountId, sharedDir string) error
+	CleanupContainer(ctx context.Context, id, sharedDir string) error
+	InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error
+	ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError
+	CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error
+	RemoveVolume(ctx context.Context, podId string, record []byte) error
+	WarmVolume(ctx context.Context, podId, volName string) error
+	HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error)
+	HotUnplugVolume(ctx context.Context, podId, volName string) error
+}
+
+// PodStorageSelector is implemented by the PodStorage which choose the
+// storage driver of each pod from its labels, it is called when the pod is
+// created, before any of its volumes.
+type PodStorageSelector interface {
+	SelectPodStorage(podId string, labels map[string]string) (string, error)
 }
 
 type GlobalLogConfig struct {
@@ -71,6 +71,10 @@ func UmountExistingVolume(fstype, target, sharedDir string) error {
 	if fstype == "dir" {
 		return storage.UmountVFSVolume(target, sharedDir)
 	}
+	// the host directory of a 9p volume is exported as it is
+	if fstype == "9p" {
+		return nil
+	}
 	if !path.IsAbs(target) {
 		return nil
 	}
@@ -31,6 +31,7 @@ const (
 	SB_KEY_FMT        = "SB-%s"
 	PS_KEY_FMT        = "PS-%s"
 	PM_KEY_FMT        = "PM-%s"
+	CX_KEY_PREFIX     = "CX-"
 	CX_KEY_FMT        = "CX-%s"
 	VX_KEY_FMT        = "VX-%s-%s"
 	IF_KEY_FMT        = "IF-%s-%s"
@@ -40,6 +41,33 @@ func ListAllPods(db *daemondb.DaemonDB) ([][]byte, error) {
 	return db.PrefixListKey([]byte(LAYOUT_KEY_PREFIX), nil)
 }
 
+// ListContainerMountIds returns the mount ids of all the containers in the db.
+func ListContainerMountIds(db *daemondb.DaemonDB) ([]string, error) {
+	var (
+		ids []string
+		err error
+	)
+	// the channel is drained to the end, its producer would block otherwise
+	for kv := range db.PrefixList2Chan([]byte(CX_KEY_PREFIX), nil) {
+		if kv == nil {
+			err = fmt.Errorf("failed to list the containers")
+			continue
+		}
+		var cx types.PersistContainer
+		if e := proto.Unmarshal(kv.V, &cx); e != nil {
+			err = fmt.Errorf("failed to decode %s: %v", kv.K, e)
+			continue
+		}
+		if cx.Descript != nil && cx.Descript.MountId != "" {
+			ids = append(ids, cx.Descript.MountId)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func LoadAllPods(db *daemondb.DaemonDB) chan *types.PersistPodLayout {
 	kvchan := db.PrefixList2Chan([]byte(LAYOUT_KEY_PREFIX), nil)
 	if kvchan == nil {
@@ -12,6 +12,7 @@ import (
 	"github.com/hyperhq/hyperd/utils"
 	runv "github.com/hyperhq/runv/api"
 	"github.com/hyperhq/runv/hypervisor"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -24,6 +25,14 @@ func CreateXPod(factory *PodFactory, spec *apitypes.UserPod) (*XPod, error) {
 	if err != nil {
 		return nil, err
 	}
+	if selector, ok := factory.sd.(PodStorageSelector); ok {
+		driver, err := selector.SelectPodStorage(spec.Id, spec.Labels)
+		if err != nil {
+			p.Log(ERROR, "failed to select the storage driver: %v", err)
+			return nil, err
+		}
+		p.Log(INFO, "storage driver: %s", driver)
+	}
 	err = p.reserveNames(spec.Containers)
 	if err != nil {
 		return nil, err
@@ -183,6 +192,46 @@ func (p *XPod) doContainerCreate(c *apitypes.UserContainer) (string, error) {
 	return pc.Id(), nil
 }
 
+// HotPlugVolume creates a volume and inserts it into the sandbox of the
+// running pod, where its containers created from then on may mount it.
+func (p *XPod) HotPlugVolume(spec *apitypes.UserVolume) error {
+	if !p.IsRunning() {
+		err := fmt.Errorf("pod is not running")
+		p.Log(ERROR, err)
+		return err
+	}
+
+	p.resourceLock.Lock()
+	defer p.resourceLock.Unlock()
+
+	if _, ok := p.volumes[spec.Name]; ok {
+		err := fmt.Errorf("volume %s already exists", spec.Name)
+		p.Log(ERROR, err)
+		return err
+	}
+	vol, err := p.factory.sd.HotPlugVolume(context.Background(), p.Id(), spec)
+	if err != nil {
+		p.Log(ERROR, "failed to create volume %s: %v", spec.Name, err)
+		return err
+	}
+	p.Log(DEBUG, "volume %s created on %s", spec.Name, vol.Source)
+
+	v := newVolume(p, spec)
+	if err = v.add(); err != nil {
+		p.factory.sd.HotUnplugVolume(context.Background(), p.Id(), spec.Name)
+		return err
+	}
+	p.volumes[spec.Name] = v
+
+	if err = v.saveVolume(); err != nil {
+		return err
+	}
+	if err = p.saveLayout(); err != nil {
+		return err
+	}
+	return p.saveSandbox()
+}
+
 func (p *XPod) ContainerStart(cid string) error {
 	var err error
 	c, ok := p.containers[cid]
@@ -215,6 +264,8 @@ func (p *XPod) ContainerStart(cid string) error {
 func (p *XPod) Start() error {
 
 	if p.IsStopped() {
+		// the volumes and the containers are read while the sandbox boots
+		warmed := p.warmUp()
 		if err := p.createSandbox(p.globalSpec); err != nil {
 			p.Log(ERROR, "failed to create sandbox for the stopped pod: %v", err)
 			return err
@@ -224,6 +275,7 @@ func (p *XPod) Start() error {
 			return err
 		}
 
+		<-warmed
 		if err := p.addResourcesToSandbox(); err != nil {
 			return err
 		}
@@ -241,6 +293,41 @@ func (p *XPod) Start() error {
 	return p.saveSandbox()
 }
 
+// warmUp warms the volumes and the containers of the pod up in the
+// background, the channel is closed once they all are. They work cold as
+// well, so the failures are only logged.
+func (p *XPod) warmUp() <-chan struct{} {
+	var wg sync.WaitGroup
+	for name := range p.volumes {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := p.factory.sd.WarmVolume(context.Background(), p.Id(), name); err != nil {
+				p.Log(DEBUG, "volume %s not warmed up: %v", name, err)
+			}
+		}(name)
+	}
+	for _, c := range p.containers {
+		if c.descript == nil || c.descript.MountId == "" {
+			continue
+		}
+		wg.Add(1)
+		// the share dir of the sandbox is not known before it is created
+		go func(mountId string) {
+			defer wg.Done()
+			if err := p.factory.sd.PrewarmContainer(context.Background(), mountId, ""); err != nil {
+				p.Log(DEBUG, "container %s not prewarmed: %v", mountId, err)
+			}
+		}(c.descript.MountId)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
 func (p *XPod) createSandbox(spec *apitypes.UserPod) error {
 	//in the future, here
 	sandbox, err := startSandbox(p.factory.vmFactory, int(spec.Resource.Vcpu), int(spec.Resource.Memory), "", "")
@@ -2,12 +2,14 @@ package daemon
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/golang/glog"
 
 	"github.com/hyperhq/hyperd/daemon/pod"
 	apitypes "github.com/hyperhq/hyperd/types"
 	"github.com/hyperhq/hyperd/utils"
+	"golang.org/x/net/context"
 )
 
 func (daemon *Daemon) CreatePod(podId string, podSpec *apitypes.UserPod) (*pod.XPod, error) {
@@ -94,3 +96,67 @@ func (daemon *Daemon) SetPodLabels(pn string, override bool, labels map[string]s
 
 	return nil
 }
+
+func (daemon *Daemon) ResizeVolume(pn, volName string, size uint64) error {
+	p, ok := daemon.PodList.Get(pn)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", pn)
+	}
+
+	if !daemon.Storage.Capabilities().SupportsResize {
+		return unsupportedFeature(daemon.Storage, "resizing volumes")
+	}
+	return daemon.Storage.ResizeVolume(context.Background(), p.Id(), volName, size)
+}
+
+// DefragVolume defragments the volume of a pod which is not alive, its
+// sandbox would keep the volume attached.
+func (daemon *Daemon) DefragVolume(pn, volName string) error {
+	p, ok := daemon.PodList.Get(pn)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", pn)
+	}
+	if p.IsAlive() {
+		return fmt.Errorf("can not defragment volume %s of running pod %s: %w", volName, pn, ErrVolumeInUse)
+	}
+	return daemon.Storage.DefragVolume(context.Background(), p.Id(), volName)
+}
+
+// ExportIncrementalVolume writes to dst the changes of the volume of the pod
+// since its snapshot, the driver refuses a volume in use which is not frozen.
+func (daemon *Daemon) ExportIncrementalVolume(pn, volName, sinceSnapshot string, dst io.Writer) error {
+	p, ok := daemon.PodList.Get(pn)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", pn)
+	}
+	return daemon.Storage.ExportIncrementalVolume(context.Background(), p.Id(), volName, sinceSnapshot, dst)
+}
+
+// ImportIncrementalVolume applies the changes of src, as written by
+// ExportIncrementalVolume, to the volume of the pod, which must not run.
+func (daemon *Daemon) ImportIncrementalVolume(pn, volName string, src io.Reader) error {
+	p, ok := daemon.PodList.Get(pn)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", pn)
+	}
+	if p.IsAlive() {
+		return fmt.Errorf("can not import into volume %s of running pod %s: %w", volName, pn, ErrVolumeInUse)
+	}
+	return daemon.Storage.ImportIncrementalVolume(context.Background(), p.Id(), volName, src)
+}
+
+func (daemon *Daemon) HotPlugVolume(pn string, spec *apitypes.UserVolume) error {
+	p, ok := daemon.PodList.Get(pn)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", pn)
+	}
+	return p.HotPlugVolume(spec)
+}
+
+func (daemon *Daemon) HotUnplugVolume(pn, volName string) error {
+	p, ok := daemon.PodList.Get(pn)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", pn)
+	}
+	return p.HotUnplugVolume(volName)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution/digest"
 	"github.com/docker/docker/reference"
@@ -16,6 +17,7 @@ import (
 	"github.com/hyperhq/hyperd/libmoby/distribution"
 	apitypes "github.com/hyperhq/hyperd/types"
 	"github.com/hyperhq/hyperd/utils"
+	"golang.org/x/net/context"
 )
 
 func (daemon *Daemon) CmdImages(args, filter string, all bool) (*engine.Env, error) {
@@ -194,6 +196,22 @@ func (daemon *Daemon) CmdSystemVersion() *engine.Env {
 	return v
 }
 
+func (daemon *Daemon) CmdStorageHealthCheck(ctx context.Context) error {
+	return daemon.Storage.HealthCheck(ctx)
+}
+
+func (daemon *Daemon) CmdStorageGC(ctx context.Context) (interface{}, error) {
+	return daemon.TriggerGC(ctx)
+}
+
+func (daemon *Daemon) CmdStorageUsage(ctx context.Context) (interface{}, error) {
+	return daemon.StorageUsage(ctx)
+}
+
+func (daemon *Daemon) CmdStorageDumpState(w io.Writer) error {
+	return daemon.DumpStorageState(w)
+}
+
 func (daemon *Daemon) CmdGetPodInfo(podName string) (interface{}, error) {
 	return daemon.GetPodInfo(podName)
 }
@@ -206,6 +224,27 @@ func (daemon *Daemon) CmdGetContainerInfo(name string) (interface{}, error) {
 	return daemon.GetContainerInfo(name)
 }
 
+func (daemon *Daemon) CmdContainerStorageStats(ctx context.Context, container string) (*StorageStats, error) {
+	return daemon.ContainerStorageStats(ctx, container)
+}
+
+func (daemon *Daemon) CmdContainerVolumeIOStats(ctx context.Context, container string) (map[string]*VolumeIOStats, error) {
+	return daemon.ContainerVolumeIOStats(ctx, container)
+}
+
+func (daemon *Daemon) CmdCompactContainerLayer(ctx context.Context, container string) (*engine.Env, error) {
+	if err := daemon.CompactContainerLayer(ctx, container); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", container)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
 func (daemon *Daemon) CmdList(item, podId, vmId string) (*engine.Env, error) {
 	list, err := daemon.List(item, podId, vmId)
 	if err != nil {
@@ -239,6 +278,105 @@ func (daemon *Daemon) CmdSetPodLabels(podId string, override bool, labels map[st
 	return v, nil
 }
 
+func (daemon *Daemon) CmdResizeVolume(podId, volName string, size uint64) (*engine.Env, error) {
+	if err := daemon.ResizeVolume(podId, volName, size); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdDefragVolume(podId, volName string) (*engine.Env, error) {
+	if err := daemon.DefragVolume(podId, volName); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdExportIncrementalVolume(podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return daemon.ExportIncrementalVolume(podId, volName, sinceSnapshot, dst)
+}
+
+func (daemon *Daemon) CmdImportIncrementalVolume(podId, volName string, src io.Reader) (*engine.Env, error) {
+	if err := daemon.ImportIncrementalVolume(podId, volName, src); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdHotPlugVolume(podId string, spec *apitypes.UserVolume) (*engine.Env, error) {
+	if err := daemon.HotPlugVolume(podId, spec); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdHotUnplugVolume(podId, volName string) (*engine.Env, error) {
+	if err := daemon.HotUnplugVolume(podId, volName); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdSetVolumeExpiry(podId, volName string, expiresAt time.Time) (*engine.Env, error) {
+	if err := daemon.SetVolumeExpiry(podId, volName, expiresAt); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdSetVolumeLabels(podId, volName string, labels map[string]string) (*engine.Env, error) {
+	if err := daemon.SetVolumeLabels(podId, volName, labels); err != nil {
+		return nil, err
+	}
+
+	v := &engine.Env{}
+	v.Set("ID", podId)
+	v.SetInt("Code", 0)
+	v.Set("Cause", "")
+
+	return v, nil
+}
+
+func (daemon *Daemon) CmdListVolumes(podId string, labels map[string]string) (interface{}, error) {
+	return daemon.ListVolumes(podId, labels)
+}
+
 func (daemon *Daemon) CmdStartPod(podId string) (*engine.Env, error) {
 	err := daemon.StartPod(podId)
 	if err != nil {
@@ -4,267 +4,662 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"io/fs"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/docker/docker/pkg/locker"
+	"github.com/docker/docker/pkg/mount"
 	dockertypes "github.com/docker/engine-api/types"
+	"github.com/docker/go-units"
 	"github.com/golang/glog"
 	"github.com/hyperhq/hyperd/daemon/daemondb"
 	"github.com/hyperhq/hyperd/storage"
 	"github.com/hyperhq/hyperd/storage/aufs"
-	dm "github.com/hyperhq/hyperd/storage/devicemapper"
 	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
 	"github.com/hyperhq/hyperd/storage/overlay"
 	"github.com/hyperhq/hyperd/storage/vbox"
 	apitypes "github.com/hyperhq/hyperd/types"
 	"github.com/hyperhq/hyperd/utils"
 	runv "github.com/hyperhq/runv/api"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
 )
 
+var (
+	ErrVolumeInUse  = errors.New("volume is in use")
+	ErrNotSupported = errors.New("operation not supported by the storage driver")
+	ErrReadOnly     = errors.New("storage is read-only")
+	// ErrInsufficientStorage is the error of creating a volume larger than
+	// the free space of the driver.
+	ErrInsufficientStorage = errors.New("insufficient storage for the volume")
+)
+
+// execCommand runs the external storage tools, tests replace it with a stub.
+var execCommand = exec.CommandContext
+
 type Storage interface {
 	Type() string
 	RootPath() string
 
-	Init() error
-	CleanUp() error
+	Init(ctx context.Context) error
+	CleanUp(ctx context.Context) error
+	// HealthCheck reports whether the driver is able to serve requests.
+	HealthCheck(ctx context.Context) error
+	// WaitReady blocks until the driver is initialized, or ctx is done. Init
+	// may return before the driver is ready when it runs in the background;
+	// the drivers initialized by Init itself are ready once it returns.
+	WaitReady(ctx context.Context) error
+	// Capabilities tells which optional features the driver supports.
+	Capabilities() storage.Capabilities
+	// KernelCapabilities lists the kernel features the driver depends on, in
+	// the format of storage_kernel.go, so that they are checked up front.
+	KernelCapabilities() []string
+
+	PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error)
+	// PrewarmContainer does the work of PrepareContainer which does not
+	// need the container to be mounted, ahead of it, e.g. while the pod is
+	// being scheduled; sharedDir may be empty when its sandbox is not known
+	// yet. PrepareContainer works without it.
+	PrewarmContainer(ctx context.Context, mountId, sharedDir string) error
+	CleanupContainer(ctx context.Context, id, sharedDir string) error
+	InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error
+	InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error
+	// ValidateVolumeSpec checks the spec of a volume before it is created,
+	// without side effects: CreateVolume would fail on a spec with errors.
+	ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError
+	CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error
+	RemoveVolume(ctx context.Context, podId string, record []byte) error
+	ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error)
+	ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error
+	VolumeExists(ctx context.Context, podId, volName string) (bool, error)
+	// DefragVolume defragments the filesystem of the volume, which must not
+	// be used by a container.
+	DefragVolume(ctx context.Context, podId, volName string) error
+	// WarmVolume reads the metadata of the filesystem of the volume ahead
+	// of the first containers using it, as a hint which may do nothing.
+	WarmVolume(ctx context.Context, podId, volName string) error
+	// VolumeRefCount returns the number of prepared containers using the
+	// volume, which can not be removed until they are cleaned up.
+	VolumeRefCount(podId, volName string) int
+	// GetVolumeLabels returns the labels of the volume, kept with its record
+	// in the DaemonDB.
+	GetVolumeLabels(podId, volName string) (map[string]string, error)
+	// SetVolumeLabels replaces the labels of the volume.
+	SetVolumeLabels(podId, volName string, labels map[string]string) error
+	SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error
+	RollbackVolume(ctx context.Context, podId, volName, snapshot string) error
+	// FreezeVolume suspends the writes to the filesystem of the volume and
+	// flushes it, so that a snapshot taken meanwhile is consistent, until
+	// ThawVolume; see SnapshotConsistentVolume.
+	FreezeVolume(ctx context.Context, podId, volName string) error
+	ThawVolume(ctx context.Context, podId, volName string) error
+	// CloneVolume creates the volume dstVolName of dstPodId with a copy of
+	// the content of srcVolName of srcPodId, independent of it once created.
+	CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error
+	// ExportVolume writes the content of the volume to dst as a tar archive,
+	// the pod may keep running.
+	ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error
+	// ImportVolume replaces the content of the volume with the tar archive
+	// of src, as written by ExportVolume.
+	ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error
+	// ExportIncrementalVolume writes to dst the changes of the volume since
+	// its snapshot sinceSnapshot, see storage.DeltaWriter for the format.
+	ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error
+	// ImportIncrementalVolume applies the changes of src, as written by
+	// ExportIncrementalVolume, to the volume, which must be as the snapshot
+	// they were made since.
+	ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error
+	// HotPlugVolume creates a volume of a running pod and describes it, the
+	// pod then inserts it into its sandbox.
+	HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error)
+	// HotUnplugVolume removes a volume the pod took out of its sandbox,
+	// with its content.
+	HotUnplugVolume(ctx context.Context, podId, volName string) error
+	// ContainerStats returns the disk usage of the writable layer of the
+	// container.
+	ContainerStats(ctx context.Context, containerId string) (*StorageStats, error)
+	// GetVolumeIOStats returns the I/O of the container to one of its
+	// volumes since the container was prepared.
+	GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error)
+	// AvailableBytes returns the free space of the filesystem the driver
+	// makes its volumes on.
+	AvailableBytes() (int64, error)
+	// CompactContainerLayer rewrites the writable layer of the container,
+	// which must be stopped, so that it takes less space and fewer inodes.
+	CompactContainerLayer(ctx context.Context, mountId string) error
+	// UsageReport returns the disk usage of the volumes, the snapshots and
+	// the writable layers of the prepared containers, by pod.
+	UsageReport(ctx context.Context) (*StorageUsageReport, error)
+	// GarbageCollect removes the volumes of the pods which are not active,
+	// and returns them as "<podId>-<name>".
+	GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error)
+	// DumpState writes the state the driver keeps, on disk and in memory, as
+	// json for debugging.
+	DumpState(w io.Writer) error
+}
+
+// DriverFactory creates the Storage matching the graph driver of docker.
+type DriverFactory func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error)
 
-	PrepareContainer(mountId, sharedDir string, readonly bool) (*runv.VolumeDescription, error)
-	CleanupContainer(id, sharedDir string) error
-	InjectFile(src io.Reader, containerId, target, baseDir string, perm, uid, gid int) error
-	CreateVolume(podId string, spec *apitypes.UserVolume) error
-	RemoveVolume(podId string, record []byte) error
+// driverRegistry holds the storage drivers by the name of the docker graph
+// driver they work with, drivers may be registered at any time.
+type driverRegistry struct {
+	sync.RWMutex
+	drivers map[string]DriverFactory
 }
 
-var StorageDrivers map[string]func(*dockertypes.Info, *daemondb.DaemonDB) (Storage, error) = map[string]func(*dockertypes.Info, *daemondb.DaemonDB) (Storage, error){
-	"devicemapper": DMFactory,
-	"aufs":         AufsFactory,
-	"overlay":      OverlayFsFactory,
-	"btrfs":        BtrfsFactory,
-	"rawblock":     RawBlockFactory,
-	"vbox":         VBoxStorageFactory,
+var storageDrivers = &driverRegistry{
+	drivers: map[string]DriverFactory{
+		"devicemapper":  DMFactory,
+		"aufs":          AufsFactory,
+		"overlay":       OverlayFsFactory,
+		"btrfs":         BtrfsFactory,
+		"rawblock":      RawBlockFactory,
+		"vbox":          VBoxStorageFactory,
+		"zfs":           ZFSFactory,
+		"nfs":           NFSFactory,
+		"iscsi":         ISCSIFactory,
+		"rbd":           CephRBDFactory,
+		"tmpfs":         TmpfsFactory,
+		"glusterfs":     GlusterFSFactory,
+		"lvm":           LVMFactory,
+		"csi":           CSIFactory,
+		"squashfs":      SquashfsFactory,
+		"virtiofs":      VirtiofsFactory,
+		"docker-plugin": DockerVolumePluginFactory,
+		"9p":            VirtIO9pFactory,
+	},
 }
 
-func StorageFactory(sysinfo *dockertypes.Info, db *daemondb.DaemonDB) (Storage, error) {
-	if factory, ok := StorageDrivers[sysinfo.Driver]; ok {
-		return factory(sysinfo, db)
-	}
-	return nil, fmt.Errorf("hyperd can not support docker's backing storage: %s", sysinfo.Driver)
+// RegisterDriver makes a storage driver available for the docker graph driver
+// name, a driver registered under the same name before is replaced.
+func RegisterDriver(name string, factory DriverFactory) {
+	storageDrivers.Lock()
+	defer storageDrivers.Unlock()
+	storageDrivers.drivers[name] = factory
 }
 
-type DevMapperStorage struct {
-	db          *daemondb.DaemonDB
-	CtnPoolName string
-	VolPoolName string
-	DevPrefix   string
-	FsType      string
-	rootPath    string
-	DmPoolData  *dm.DeviceMapper
+func lookupDriver(name string) (DriverFactory, bool) {
+	storageDrivers.RLock()
+	defer storageDrivers.RUnlock()
+	factory, ok := storageDrivers.drivers[name]
+	return factory, ok
 }
 
-func DMFactory(sysinfo *dockertypes.Info, db *daemondb.DaemonDB) (Storage, error) {
-	driver := &DevMapperStorage{
-		db: db,
-	}
+// StorageTracer wraps a driver in a Storage tracing its operations with
+// tracer. The daemon has none until one is registered, as
+// daemon/storagetelemetry does, which imports the daemon.
+type StorageTracer func(s Storage, tracer trace.Tracer) Storage
 
-	driver.VolPoolName = storage.DEFAULT_DM_POOL
+var storageTracer struct {
+	sync.RWMutex
+	wrap StorageTracer
+}
 
-	for _, pair := range sysinfo.DriverStatus {
-		if pair[0] == "Pool Name" {
-			driver.CtnPoolName = pair[1]
-		}
-		if pair[0] == "Backing Filesystem" {
-			if strings.Contains(pair[1], "ext") {
-				driver.FsType = "ext4"
-			} else if strings.Contains(pair[1], "xfs") {
-				driver.FsType = "xfs"
-			} else {
-				driver.FsType = "dir"
-			}
-			break
-		}
-	}
-	driver.DevPrefix = driver.CtnPoolName[:strings.Index(driver.CtnPoolName, "-pool")]
-	driver.rootPath = filepath.Join(utils.HYPER_ROOT, "devicemapper")
-	return driver, nil
+// RegisterStorageTracer makes the drivers configured with a Tracer traced by
+// wrap.
+func RegisterStorageTracer(wrap StorageTracer) {
+	storageTracer.Lock()
+	defer storageTracer.Unlock()
+	storageTracer.wrap = wrap
 }
 
-func (dms *DevMapperStorage) Type() string {
-	return "devicemapper"
+func lookupStorageTracer() StorageTracer {
+	storageTracer.RLock()
+	defer storageTracer.RUnlock()
+	return storageTracer.wrap
 }
 
-func (dms *DevMapperStorage) RootPath() string {
-	return dms.rootPath
+// StorageConfig holds the settings of the daemon for the storage driver, a
+// nil *StorageConfig stands for the defaults.
+type StorageConfig struct {
+	// Root holds the directories of the drivers, <Root>/<driver>, it is the
+	// root of hyperd when empty.
+	Root string
+	// Metrics receives the operations of the driver when set.
+	Metrics StorageMetrics
+	// Events receives the volume lifecycle events of the driver, a bus is
+	// made by StorageFactory when nil.
+	Events *StorageEventBus
+	// Timeouts bounds the time the operations of the driver may take.
+	Timeouts StorageTimeouts
+	// LogVerbosity is the glog verbosity the operations of the driver are
+	// logged at.
+	LogVerbosity glog.Level
+	// DriverOptions holds the options of each driver by the driver name.
+	DriverOptions map[string]map[string]string
+	// DriverConfigFile is the StorageDriverConfig the options of the
+	// drivers not in DriverOptions are loaded from, DefaultStorageDriverConfig
+	// when empty.
+	DriverConfigFile string
+	// HealthCheckInterval is the interval the health of the driver is
+	// checked at in the background, zero disables the checks.
+	HealthCheckInterval time.Duration
+	// FallbackDrivers are tried in turn when the driver of docker can not
+	// be initialized.
+	FallbackDrivers []string
+	// AuditLog receives the volume and container operations when set.
+	AuditLog AuditLog
+	// VerifyChecksum makes the drivers read the injected files back and
+	// compare them with their source, see storage.FsInjectFile.
+	VerifyChecksum bool
+	// ReadOnly freezes the driver with a ReadOnlyStorage, the volumes then
+	// never expire either.
+	ReadOnly bool
+	// PodStorageSelector chooses a driver for each pod when set, the driver
+	// of docker, or its fallback, is the default one; see MultiDriverStorage.
+	PodStorageSelector PerPodStorageSelector
+	// Fsck makes the drivers repair the filesystems of their volumes at
+	// Init, only the rawblock driver does.
+	Fsck bool
+	// AsyncDriverInit runs the Init of the driver in the background, see
+	// AsyncInitStorage.
+	AsyncDriverInit bool
+	// PrepareConcurrency bounds the containers prepared at once, 0 is the
+	// default of ConcurrencyLimitedStorage.
+	PrepareConcurrency int
+	// InjectBytesPerSec limits the bandwidth of the injected files, see
+	// ThrottledStorage. 0 is unlimited.
+	InjectBytesPerSec int64
+	// CircuitBreaker stops calling a failing driver, see
+	// CircuitBreakerStorage. A FailureThreshold of 0 disables it.
+	CircuitBreaker CircuitBreakerConfig
+	// Tracer traces the operations of the driver when set, with the
+	// registered StorageTracer.
+	Tracer trace.Tracer
 }
 
-func (dms *DevMapperStorage) Init() error {
-	dmPool := dm.DeviceMapper{
-		Datafile:         filepath.Join(utils.HYPER_ROOT, "lib") + "/data",
-		Metadatafile:     filepath.Join(utils.HYPER_ROOT, "lib") + "/metadata",
-		DataLoopFile:     storage.DEFAULT_DM_DATA_LOOP,
-		MetadataLoopFile: storage.DEFAULT_DM_META_LOOP,
-		PoolName:         dms.VolPoolName,
-		Size:             storage.DEFAULT_DM_POOL_SIZE,
+// NewStorageConfig builds a StorageConfig from the [Storage] section of the
+// hyperd config, whose keys are "<driver>.<option>", e.g.
+// "rawblock.volumesize=10G".
+func NewStorageConfig(opts map[string]string) (*StorageConfig, error) {
+	config := &StorageConfig{
+		LogVerbosity:  defaultStorageLogVerbosity,
+		DriverOptions: make(map[string]map[string]string),
+	}
+	for key, val := range opts {
+		fields := strings.SplitN(key, ".", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("invalid storage option %s, should be <driver>.<option>", key)
+		}
+		driver, opt := strings.ToLower(fields[0]), strings.ToLower(fields[1])
+		if config.DriverOptions[driver] == nil {
+			config.DriverOptions[driver] = make(map[string]string)
+		}
+		config.DriverOptions[driver][opt] = strings.TrimSpace(val)
 	}
-	dms.DmPoolData = &dmPool
-	rand.Seed(time.Now().UnixNano())
+	return config, nil
+}
 
-	// Prepare the DeviceMapper storage
-	return dm.CreatePool(&dmPool)
+// DriverOption returns the option of the driver, or "" if it is not set.
+func (c *StorageConfig) DriverOption(driver, opt string) string {
+	if c == nil {
+		return ""
+	}
+	return c.DriverOptions[driver][opt]
 }
 
-func (dms *DevMapperStorage) CleanUp() error {
-	return dm.DMCleanup(dms.DmPoolData)
+// DriverRoot returns the directory of the files of the driver, its rootpath
+// option overrides it.
+func (c *StorageConfig) DriverRoot(driver string) string {
+	if root := c.DriverOption(driver, "rootpath"); root != "" {
+		return root
+	}
+	if c == nil || c.Root == "" {
+		return filepath.Join(utils.HYPER_ROOT, driver)
+	}
+	return filepath.Join(c.Root, driver)
 }
 
-func (dms *DevMapperStorage) PrepareContainer(mountId, sharedDir string, readonly bool) (*runv.VolumeDescription, error) {
-	if err := dm.CreateNewDevice(mountId, dms.DevPrefix, dms.RootPath()); err != nil {
+// StorageFactory creates and initializes the Storage of the graph driver of
+// docker, a driver which is not healthy once initialized is refused. When it
+// fails, the FallbackDrivers of the config are tried in turn and the first
+// one initialized is returned. With a PodStorageSelector, the driver is the
+// default one of a MultiDriverStorage.
+func StorageFactory(ctx context.Context, sysinfo *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	if config == nil {
+		config, _ = NewStorageConfig(nil)
+	}
+	if config.Events == nil {
+		config.Events = NewStorageEventBus()
+	}
+	if err := config.loadDriverConfig(); err != nil {
 		return nil, err
 	}
-	devFullName, err := dm.MountContainerToSharedDir(mountId, sharedDir, dms.DevPrefix)
+	driver := sysinfo.Driver
+	s, err := newStorage(ctx, driver, sysinfo, db, config)
+	for _, fallback := range config.FallbackDrivers {
+		if err == nil {
+			break
+		}
+		fallbackStorage, ferr := newStorage(ctx, fallback, sysinfo, db, config)
+		if ferr != nil {
+			glog.Warningf("fallback storage driver %s failed too: %v", fallback, ferr)
+			continue
+		}
+		glog.Warningf("storage driver %s failed, running the fallback driver %s instead: %v", sysinfo.Driver, fallback, err)
+		driver, s, err = fallback, fallbackStorage, nil
+	}
 	if err != nil {
-		glog.Error("got error when mount container to share dir ", err.Error())
 		return nil, err
 	}
-	fstype, err := dm.ProbeFsType(devFullName)
-	if err != nil {
-		fstype = storage.DEFAULT_VOL_FS
+	if config.PodStorageSelector != nil {
+		s = NewMultiDriverStorage(s, driver, db, config.PodStorageSelector, func(ctx context.Context, name string) (Storage, error) {
+			return newStorage(ctx, name, sysinfo, db, config)
+		})
 	}
+	return s, nil
+}
 
-	vol := &runv.VolumeDescription{
-		Name:     devFullName,
-		Source:   devFullName,
-		Fstype:   fstype,
-		Format:   "raw",
-		ReadOnly: readonly,
+func newStorage(ctx context.Context, driver string, sysinfo *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	factory, ok := lookupDriver(driver)
+	if !ok {
+		return nil, fmt.Errorf("hyperd can not support docker's backing storage: %s", driver)
 	}
-
-	return vol, nil
+	s, err := factory(sysinfo, db, config)
+	if err != nil {
+		return nil, err
+	}
+	attachEventBus(s, config.Events)
+	configureInjection(s, config)
+	if config.AsyncDriverInit {
+		s = NewAsyncInitStorage(s)
+	}
+	s = NewOrderedStorage(s)
+	if config.ReadOnly {
+		s = NewReadOnlyStorage(s)
+	} else if db != nil {
+		s = NewExpiringStorage(s, db, config.AuditLog)
+	}
+	// within the timeouts, the wait for a turn counts
+	s = NewConcurrencyLimitedStorage(s, config.PrepareConcurrency, config.Metrics)
+	if config.InjectBytesPerSec > 0 {
+		s = NewThrottledStorage(s, config.InjectBytesPerSec, config.Metrics)
+	}
+	if config.Timeouts != (StorageTimeouts{}) {
+		s = NewTimeoutStorage(s, config.Timeouts)
+	}
+	// the operations timing out count as failures
+	if config.CircuitBreaker.FailureThreshold > 0 {
+		s = NewCircuitBreakerStorage(s, config.CircuitBreaker, config.Metrics)
+	}
+	s = NewLoggingStorage(s, config.LogVerbosity)
+	if config.Tracer != nil {
+		if wrap := lookupStorageTracer(); wrap != nil {
+			s = wrap(s, config.Tracer)
+		} else {
+			glog.Warningf("no storage tracer is registered, the operations of %s are not traced", s.Type())
+		}
+	}
+	if config.HealthCheckInterval > 0 {
+		s = NewMonitoredStorage(s, config.Events, config.HealthCheckInterval)
+	}
+	if err := s.Init(ctx); err != nil {
+		return nil, err
+	}
+	if config.AsyncDriverInit {
+		// the driver checks its health once initialized, and can not
+		// fall back to another one from then on
+		go logStorageReady(s)
+	} else if err := s.HealthCheck(ctx); err != nil {
+		s.CleanUp(ctx)
+		return nil, fmt.Errorf("storage driver %s is not healthy: %v", s.Type(), err)
+	}
+	if config.Metrics != nil {
+		s = NewMetricedStorage(s, config.Metrics)
+	}
+	if config.AuditLog != nil {
+		s = NewAuditedStorage(s, config.AuditLog)
+	}
+	return s, nil
 }
 
-func (dms *DevMapperStorage) CleanupContainer(id, sharedDir string) error {
-	devFullName, err := dm.MountContainerToSharedDir(id, sharedDir, dms.DevPrefix)
+// listPodVolumes returns the names of the volumes of podId, which are kept as
+// "<podId>-<name>" entries in dir. The entry "pod-a-x" is the volume x of the
+// pod pod-a as well as a-x of pod, the entries db records for another pod are
+// left out.
+func listPodVolumes(db *daemondb.DaemonDB, dir, podId string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
-		glog.Error("got error when mount container to share dir ", err.Error())
-		return err
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-
-	return dm.UnmapVolume(devFullName)
+	var (
+		names  []string
+		prefix = podId + "-"
+	)
+	others, err := otherPodVolumes(db, podId)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), prefix) && !others[e.Name()] {
+			names = append(names, strings.TrimPrefix(e.Name(), prefix))
+		}
+	}
+	return names, nil
 }
 
-func (dms *DevMapperStorage) InjectFile(src io.Reader, mountId, target, baseDir string, perm, uid, gid int) error {
-	if err := dm.CreateNewDevice(mountId, dms.DevPrefix, dms.RootPath()); err != nil {
-		return err
+// orphanedVolume tells whether the "<podId>-<name>" entry of a volume belongs
+// to none of the active pods, the quarantined volumes are kept.
+func orphanedVolume(entry string, activePodIDs []string) bool {
+	if strings.HasPrefix(entry, ".") || entry == quarantineDir {
+		return false
+	}
+	for _, podId := range activePodIDs {
+		if strings.HasPrefix(entry, podId+"-") {
+			return false
+		}
 	}
-	return dm.InjectFile(src, mountId, dms.DevPrefix, target, baseDir, perm, uid, gid)
+	return true
 }
 
-func (dms *DevMapperStorage) getPersistedId(podId, volName string) (int, error) {
-	vols, err := dms.db.ListPodVolumes(podId)
+// orphanedVolumes returns the "<podId>-<name>" entries of dir which belong to
+// none of the active pods.
+func orphanedVolumes(dir string, activePodIDs []string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return -1, err
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-
-	dev_id := 0
-	for _, vol := range vols {
-		fields := strings.Split(string(vol), ":")
-		if fields[0] == volName {
-			dev_id, _ = strconv.Atoi(fields[1])
+	var orphans []string
+	for _, e := range entries {
+		if orphanedVolume(e.Name(), activePodIDs) {
+			orphans = append(orphans, e.Name())
 		}
 	}
-	return dev_id, nil
+	return orphans, nil
 }
 
-func (dms *DevMapperStorage) CreateVolume(podId string, spec *apitypes.UserVolume) error {
-	var err error
-
-	deviceName := fmt.Sprintf("%s-%s-%s", dms.VolPoolName, podId, spec.Name)
-	dev_id, _ := dms.getPersistedId(podId, deviceName)
-	glog.Infof("DeviceID is %d", dev_id)
-
-	restore := dev_id > 0
-
-	for {
-		if !restore {
-			dev_id = dms.randDevId()
+// pathExists tells whether p exists, an error is returned when it can not be
+// told, e.g. when a parent of p is not a directory.
+func pathExists(p string) (bool, error) {
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
 		}
-		dev_id_str := strconv.Itoa(dev_id)
+		return false, err
+	}
+	return true, nil
+}
 
-		err = dm.CreateVolume(dms.VolPoolName, deviceName, dev_id_str, storage.DEFAULT_VOL_MKFS, storage.DEFAULT_DM_VOL_SIZE, restore)
-		if err != nil && !restore && strings.Contains(err.Error(), "failed: File exists") {
-			glog.V(1).Infof("retry for dev_id #%d creating collision: %v", dev_id, err)
-			continue
-		} else if err != nil {
-			glog.V(1).Infof("failed to create dev_id #%d: %v", dev_id, err)
+// retryMount calls fn up to maxAttempts times while it fails with EBUSY or
+// EAGAIN, which the kernel returns while e.g. udev settles or another unmount
+// is in progress. The delay before a retry starts at base and doubles.
+func retryMount(fn func() error, maxAttempts int, base time.Duration) error {
+	delay := base
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxAttempts || !(errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN)) {
 			return err
 		}
+		glog.V(1).Infof("mount attempt %d/%d failed: %v, retry in %v", attempt, maxAttempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
 
-		glog.V(3).Infof("device (%d) created (restore:%v) for %s: %s", dev_id, restore, podId, deviceName)
-		dms.db.UpdatePodVolume(podId, deviceName, []byte(fmt.Sprintf("%s:%s", deviceName, dev_id_str)))
-		break
+// ensureDir creates dir with perm, and fixes the permissions of a directory
+// which exists already with other ones, e.g. from a previous installation.
+// The mount points are still created with os.MkdirAll, a chmod there would
+// change the root of what is mounted on them.
+func ensureDir(dir string, perm os.FileMode) error {
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
 	}
+	if fi.Mode().Perm() != perm {
+		return os.Chmod(dir, perm)
+	}
+	return nil
+}
 
-	fstype := storage.DEFAULT_VOL_FS
-	if !restore {
-		if spec.Fstype == "" {
-			fstype, err = dm.ProbeFsType("/dev/mapper/" + deviceName)
-			if err != nil {
-				fstype = storage.DEFAULT_VOL_FS
-			}
-		} else {
-			fstype = spec.Fstype
-		}
+// checkWritable returns an error if dir is not a directory the daemon can
+// create files in.
+func checkWritable(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
 	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".health-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
 
-	glog.V(1).Infof("volume %s created with dm as %s", spec.Name, deviceName)
+func validateSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/@:") {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
 
-	spec.Source = filepath.Join("/dev/mapper/", deviceName)
-	spec.Format = "raw"
-	spec.Fstype = fstype
+func snapshotVFSVolume(root, podId, volName, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	if storage.PathInUse(storage.VFSVolumePath(root, podId, volName)) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to snapshot it", volName, podId)
+		return ErrVolumeInUse
+	}
+	return storage.SnapshotVFSVolume(root, podId, volName, snapshot)
+}
 
-	return nil
+func rollbackVFSVolume(root, podId, volName, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	if storage.PathInUse(storage.VFSVolumePath(root, podId, volName)) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to roll it back", volName, podId)
+		return ErrVolumeInUse
+	}
+	return storage.RollbackVFSVolume(root, podId, volName, snapshot)
 }
 
-func (dms *DevMapperStorage) RemoveVolume(podId string, record []byte) error {
-	fields := strings.SplitN(string(record), ":", 2)
-	if len(fields) == 1 {
-		record, err := dms.db.GetPodVolume(podId, fields[0])
-		if err != nil {
-			glog.Error(err)
-			return err
+// listVFSVolumes lists the volumes created with storage.CreateVFSVolume.
+func listVFSVolumes(root, podId string) ([]*apitypes.UserVolume, error) {
+	entries, err := ioutil.ReadDir(storage.VFSVolumePath(root, podId, ""))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-		fields = strings.SplitN(string(record), ":", 2)
-		if len(fields) == 1 {
-			err = fmt.Errorf("cannot get valid volume %s/%s from db", podId, record)
-			glog.Error(err)
-			return err
+		return nil, err
+	}
+	var vols []*apitypes.UserVolume
+	for _, e := range entries {
+		// dot entries hold the snapshots and the volumes being rolled back
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
 		}
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   e.Name(),
+			Source: storage.VFSVolumePath(root, podId, e.Name()),
+			Format: "vfs",
+			Fstype: "dir",
+		})
 	}
-	dev_id, _ := strconv.Atoi(fields[1])
-	if err := dm.DeleteVolume(dms.DmPoolData, dev_id); err != nil {
-		glog.Error(err.Error())
-		return err
+	return vols, nil
+}
+
+// collectVFSVolumes removes the vfs volumes, kept in a directory per pod under
+// root, of the pods which are not active. The volumes are returned as
+// "<podId>-<name>".
+func collectVFSVolumes(root string, activePodIDs []string) ([]string, error) {
+	pods, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	if err := dms.db.DeletePodVolume(podId, fields[0]); err != nil {
-		glog.Error(err.Error())
-		return err
+	active := make(map[string]bool, len(activePodIDs))
+	for _, podId := range activePodIDs {
+		active[podId] = true
 	}
-	return nil
-}
 
-func (dms *DevMapperStorage) randDevId() int {
-	return rand.Intn(1<<24-1) + 1 // 0 reserved for pool device
+	var collected []string
+	for _, pod := range pods {
+		if !pod.IsDir() || active[pod.Name()] {
+			continue
+		}
+		podDir := filepath.Join(root, pod.Name())
+		vols, err := ioutil.ReadDir(podDir)
+		if err != nil {
+			glog.Errorf("failed to list the orphaned volumes in %s: %v", podDir, err)
+			continue
+		}
+		var names []string
+		busy := false
+		for _, vol := range vols {
+			if storage.PathInUse(filepath.Join(podDir, vol.Name())) {
+				busy = true
+				break
+			}
+			if vol.IsDir() && !strings.HasPrefix(vol.Name(), ".") {
+				names = append(names, fmt.Sprintf("%s-%s", pod.Name(), vol.Name()))
+			}
+		}
+		if busy {
+			glog.Warningf("orphaned volumes in %s are still in use, leave them", podDir)
+			continue
+		}
+		if err := os.RemoveAll(podDir); err != nil {
+			glog.Errorf("failed to remove the orphaned volumes in %s: %v", podDir, err)
+			continue
+		}
+		collected = append(collected, names...)
+	}
+	return collected, nil
 }
 
 type AufsStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
 	rootPath string
 }
 
-func AufsFactory(sysinfo *dockertypes.Info, _ *daemondb.DaemonDB) (Storage, error) {
+func AufsFactory(sysinfo *dockertypes.Info, _ *daemondb.DaemonDB, _ *StorageConfig) (Storage, error) {
 	driver := &AufsStorage{}
 	for _, pair := range sysinfo.DriverStatus {
 		if pair[0] == "Root Dir" {
@@ -282,12 +677,41 @@ func (a *AufsStorage) RootPath() string {
 	return a.rootPath
 }
 
-func (*AufsStorage) Init() error { return nil }
+// Init checks the kernel supports aufs, which mainline never merged: it
+// comes with the kernels of some distributions only, as the Ubuntu ones.
+func (a *AufsStorage) Init(ctx context.Context) (err error) {
+	defer wrapStorageError(&err, a.Type(), "Init", "")
+	return checkKernelCapabilities(ctx, a.Type(), a.KernelCapabilities())
+}
+
+func (*AufsStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (a *AufsStorage) HealthCheck(ctx context.Context) error {
+	return checkWritable(a.RootPath())
+}
+
+func (a *AufsStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (a *AufsStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots: true,
+		SupportsClone:     true,
+	}
+}
 
-func (*AufsStorage) CleanUp() error { return nil }
+func (a *AufsStorage) KernelCapabilities() []string {
+	return []string{"fs:aufs"}
+}
 
-func (a *AufsStorage) PrepareContainer(mountId, sharedDir string, readonly bool) (*runv.VolumeDescription, error) {
-	_, err := aufs.MountContainerToSharedDir(mountId, a.RootPath(), sharedDir, "", readonly)
+func (a *AufsStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer a.emit(ContainerPrepared, "", mountId, &err)
+	defer a.takeVolumes(mountId, opts, &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, err = aufs.MountContainerToSharedDir(mountId, a.RootPath(), sharedDir, "", opts.ReadOnly)
 	if err != nil {
 		glog.Error("got error when mount container to share dir ", err.Error())
 		return nil, err
@@ -299,17 +723,36 @@ func (a *AufsStorage) PrepareContainer(mountId, sharedDir string, readonly bool)
 		Source:   containerPath,
 		Fstype:   "dir",
 		Format:   "vfs",
-		ReadOnly: readonly,
+		ReadOnly: opts.ReadOnly,
 	}
 
 	return vol, nil
 }
 
-func (a *AufsStorage) CleanupContainer(id, sharedDir string) error {
+func (a *AufsStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer a.emit(ContainerCleanedUp, "", id, &err)
+	defer a.releaseVolumes(id, &err)
 	return aufs.Unmount(filepath.Join(sharedDir, id, "rootfs"))
 }
 
-func (a *AufsStorage) InjectFile(src io.Reader, containerId, target, baseDir string, perm, uid, gid int) error {
+func (a *AufsStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := aufs.MountContainerToSharedDir(containerId, a.RootPath(), baseDir, "", false)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return err
+	}
+	defer aufs.Unmount(filepath.Join(baseDir, containerId, "rootfs"))
+
+	return storage.FsInjectFile(src, containerId, target, baseDir, perm, uid, gid, xattrs, a.verifyChecksum)
+}
+
+func (a *AufsStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	_, err := aufs.MountContainerToSharedDir(containerId, a.RootPath(), baseDir, "", false)
 	if err != nil {
 		glog.Error("got error when mount container to share dir ", err.Error())
@@ -317,11 +760,12 @@ func (a *AufsStorage) InjectFile(src io.Reader, containerId, target, baseDir str
 	}
 	defer aufs.Unmount(filepath.Join(baseDir, containerId, "rootfs"))
 
-	return storage.FsInjectFile(src, containerId, target, baseDir, perm, uid, gid)
+	return storage.FsInjectDir(src, containerId, targetDir, baseDir, uid, gid, a.verifyChecksum)
 }
 
-func (a *AufsStorage) CreateVolume(podId string, spec *apitypes.UserVolume) error {
-	volName, err := storage.CreateVFSVolume(podId, spec.Name)
+func (a *AufsStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer a.emit(VolumeCreated, podId, spec.Name, &err)
+	volName, err := storage.CreateVFSVolume(storage.VFSVolumeRoot, podId, spec.Name)
 	if err != nil {
 		return err
 	}
@@ -331,237 +775,1629 @@ func (a *AufsStorage) CreateVolume(podId string, spec *apitypes.UserVolume) erro
 	return nil
 }
 
-func (a *AufsStorage) RemoveVolume(podId string, record []byte) error {
+func (a *AufsStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer a.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if a.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	defer wrapStorageError(&err, a.Type(), "RemoveVolume", volumeID(podId, parseVolumeRecord(record).Name))
+	name := parseVolumeRecord(record).Name
+	volName := storage.VFSVolumePath(storage.VFSVolumeRoot, podId, name)
+	if storage.PathInUse(volName) {
+		return ErrVolumeInUse
+	}
+	if err := os.RemoveAll(volName); err != nil {
+		return err
+	}
+	if err := storage.RemoveVFSSnapshots(storage.VFSVolumeRoot, podId, name); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(volName))
 	return nil
 }
 
-type OverlayFsStorage struct {
-	rootPath string
+func (a *AufsStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	return listVFSVolumes(storage.VFSVolumeRoot, podId)
 }
 
-func OverlayFsFactory(_ *dockertypes.Info, _ *daemondb.DaemonDB) (Storage, error) {
-	driver := &OverlayFsStorage{
-		rootPath: filepath.Join(utils.HYPER_ROOT, "overlay"),
-	}
-	return driver, nil
+func (a *AufsStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
 }
 
-func (o *OverlayFsStorage) Type() string {
-	return "overlay"
+func (a *AufsStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
 }
 
-func (o *OverlayFsStorage) RootPath() string {
-	return o.rootPath
+func (a *AufsStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
 }
 
-func (*OverlayFsStorage) Init() error { return nil }
-
-func (*OverlayFsStorage) CleanUp() error { return nil }
-
-func (o *OverlayFsStorage) PrepareContainer(mountId, sharedDir string, readonly bool) (*runv.VolumeDescription, error) {
-	_, err := overlay.MountContainerToSharedDir(mountId, o.RootPath(), sharedDir, "", readonly)
-	if err != nil {
-		glog.Error("got error when mount container to share dir ", err.Error())
-		return nil, err
-	}
-
-	containerPath := "/" + mountId
-	vol := &runv.VolumeDescription{
-		Name:     containerPath,
-		Source:   containerPath,
-		Fstype:   "dir",
-		Format:   "vfs",
-		ReadOnly: readonly,
-	}
+func (a *AufsStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
 
-	return vol, nil
+func (a *AufsStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
 }
 
-func (o *OverlayFsStorage) CleanupContainer(id, sharedDir string) error {
-	return syscall.Unmount(filepath.Join(sharedDir, id, "rootfs"), 0)
+func (a *AufsStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
 }
 
-func (o *OverlayFsStorage) InjectFile(src io.Reader, mountId, target, baseDir string, perm, uid, gid int) error {
-	_, err := overlay.MountContainerToSharedDir(mountId, o.RootPath(), baseDir, "", false)
-	if err != nil {
-		glog.Error("got error when mount container to share dir ", err.Error())
-		return err
-	}
-	defer syscall.Unmount(filepath.Join(baseDir, mountId, "rootfs"), 0)
+func (a *AufsStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
 
-	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid)
+func (a *AufsStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
 }
 
-func (o *OverlayFsStorage) CreateVolume(podId string, spec *apitypes.UserVolume) error {
-	volName, err := storage.CreateVFSVolume(podId, spec.Name)
-	if err != nil {
-		return err
-	}
-	spec.Source = volName
-	spec.Format = "vfs"
-	spec.Fstype = "dir"
-	return nil
+func (a *AufsStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(storage.VFSVolumePath(storage.VFSVolumeRoot, podId, volName))
 }
 
-func (o *OverlayFsStorage) RemoveVolume(podId string, record []byte) error {
-	return nil
+func (a *AufsStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return nil, ErrNotSupported
 }
 
-type BtrfsStorage struct {
-	rootPath string
+func (a *AufsStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return ErrNotSupported
 }
 
-func BtrfsFactory(_ *dockertypes.Info, _ *daemondb.DaemonDB) (Storage, error) {
-	driver := &BtrfsStorage{
-		rootPath: filepath.Join(utils.HYPER_ROOT, "btrfs"),
-	}
-	return driver, nil
+func (a *AufsStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return snapshotVFSVolume(storage.VFSVolumeRoot, podId, volName, snapshot)
 }
 
-func (s *BtrfsStorage) Type() string {
-	return "btrfs"
+func (a *AufsStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return rollbackVFSVolume(storage.VFSVolumeRoot, podId, volName, snapshot)
 }
 
-func (s *BtrfsStorage) RootPath() string {
-	return s.rootPath
+func (a *AufsStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	_, err := storage.CloneVFSVolume(storage.VFSVolumeRoot, srcPodId, srcVolName, dstPodId, dstVolName)
+	return err
 }
 
-func (s *BtrfsStorage) subvolumesDirID(id string) string {
-	return filepath.Join(s.RootPath(), "subvolumes", id)
+func (a *AufsStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return exportVFSVolume(ctx, storage.VFSVolumeRoot, podId, volName, dst)
 }
 
-func (*BtrfsStorage) Init() error { return nil }
+func (a *AufsStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return importVFSVolume(ctx, storage.VFSVolumeRoot, podId, volName, src)
+}
 
-func (*BtrfsStorage) CleanUp() error { return nil }
+func (a *AufsStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
 
-func (s *BtrfsStorage) PrepareContainer(containerId, sharedDir string, readonly bool) (*runv.VolumeDescription, error) {
-	btrfsRootfs := s.subvolumesDirID(containerId)
-	mountPoint := filepath.Join(sharedDir, containerId, "rootfs")
+func (a *AufsStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
 
-	if _, err := os.Stat(mountPoint); err != nil {
-		if err = os.MkdirAll(mountPoint, 0755); err != nil {
-			return nil, err
-		}
+// ContainerStats walks the diff of the container, on top of the diffs of the
+// layers of its image.
+func (a *AufsStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	stats, err := dirStats(ctx, filepath.Join(a.RootPath(), "diff", containerId))
+	if err != nil {
+		return nil, err
 	}
-	if err := syscall.Mount(btrfsRootfs, mountPoint, "bind", syscall.MS_BIND, ""); err != nil {
-		return nil, fmt.Errorf("failed to mount %s to %s: %v", btrfsRootfs, mountPoint, err)
+	data, err := ioutil.ReadFile(filepath.Join(a.RootPath(), "layers", containerId))
+	if err != nil {
+		return nil, err
 	}
-	if readonly {
-		if err := syscall.Mount(btrfsRootfs, mountPoint, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
-			syscall.Unmount(mountPoint, syscall.MNT_DETACH)
-			return nil, fmt.Errorf("failed to mount %s to %s readonly: %v", btrfsRootfs, mountPoint, err)
+	stats.LayerCount = 1
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			stats.LayerCount++
 		}
 	}
-
-	containerPath := "/" + containerId
-	vol := &runv.VolumeDescription{
-		Name:     containerPath,
-		Source:   containerPath,
-		Fstype:   "dir",
-		Format:   "vfs",
-		ReadOnly: readonly,
-	}
-
-	return vol, nil
-}
-
-func (s *BtrfsStorage) CleanupContainer(id, sharedDir string) error {
-	return syscall.Unmount(filepath.Join(sharedDir, id, "rootfs"), 0)
+	return stats, nil
 }
 
-func (s *BtrfsStorage) InjectFile(src io.Reader, mountId, target, baseDir string, perm, uid, gid int) error {
-	return storage.FsInjectFile(src, mountId, target, filepath.Dir(s.subvolumesDirID(mountId)), perm, uid, gid)
+func (a *AufsStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
 }
 
-func (s *BtrfsStorage) CreateVolume(podId string, spec *apitypes.UserVolume) error {
-	volName, err := storage.CreateVFSVolume(podId, spec.Name)
-	if err != nil {
-		return err
-	}
-	spec.Source = volName
-	spec.Format = "vfs"
-	spec.Fstype = "dir"
-	return nil
+func (a *AufsStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
 }
 
-func (s *BtrfsStorage) RemoveVolume(podId string, record []byte) error {
-	return nil
+func (a *AufsStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
 }
 
-type RawBlockStorage struct {
-	rootPath string
+func (a *AufsStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
 }
 
-func RawBlockFactory(_ *dockertypes.Info, _ *daemondb.DaemonDB) (Storage, error) {
-	driver := &RawBlockStorage{
-		rootPath: filepath.Join(utils.HYPER_ROOT, "rawblock"),
-	}
-	return driver, nil
+func (a *AufsStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
 }
 
-func (s *RawBlockStorage) Type() string {
-	return "rawblock"
+func (a *AufsStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	return collectVFSVolumes(storage.VFSVolumeRoot, activePodIDs)
 }
 
-func (s *RawBlockStorage) RootPath() string {
-	return s.rootPath
+type OverlayFsStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	// locks serializes the mount operations on the same container, and the
+	// operations on the same shared volume, see storage_shared.go. A lock is
+	// dropped once nothing holds or waits for it.
+	locks locker.Locker
+	// MountAttempts and MountRetryDelay control the retries of the mounts
+	// failing with a transient error, see retryMount.
+	MountAttempts   int
+	MountRetryDelay time.Duration
+	// SecureRemove shreds the files of the volumes before removing them.
+	SecureRemove bool
+	// UseLazyUnmount unmounts the rootfs of a container lazily when it is
+	// busy, rather than failing to clean the container up.
+	UseLazyUnmount bool
+	// WorkDir holds the work dirs of the overlay mounts, one per container,
+	// instead of the container dirs. The kernel needs it on the filesystem
+	// of the upper dirs, which Init checks.
+	WorkDir string
+	// MountOptions are added to the overlay mounts of the containers, as
+	// noatime, among the ones storage.MountFlags allows.
+	MountOptions []string
+	// Filesystem is the filesystem the root path must be on, as "xfs",
+	// which Init checks; any filesystem is accepted when empty.
+	Filesystem string
+	// RenameWorkaround works around the renames of the directories of the
+	// lower layers failing on the kernels before 4.10, see storage_rename.go.
+	RenameWorkaround RenameMode
+	// namespaces are the mount namespaces of the containers prepared with
+	// ContainerOptions.MountNamespace, see storage_mntns.go.
+	namespaces mountNamespaces
+	// ioWatches account the I/O of the containers to their volumes, see
+	// storage_iostats.go.
+	ioWatches volumeIOWatches
 }
 
-func (s *RawBlockStorage) Init() error {
-	if err := os.MkdirAll(filepath.Join(s.RootPath(), "volumes"), 0700); err != nil {
+func OverlayFsFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &OverlayFsStorage{
+		db:              db,
+		rootPath:        config.DriverRoot("overlay"),
+		MountAttempts:   3,
+		MountRetryDelay: 100 * time.Millisecond,
+		UseLazyUnmount:  true,
+		Filesystem:      config.DriverOption("overlay", "filesystem"),
+	}
+	if root := config.DriverOption("overlay", "rootpath"); root != "" && !filepath.IsAbs(root) {
+		return nil, fmt.Errorf("invalid overlay.rootpath %q, it must be absolute", root)
+	}
+	if attempts := config.DriverOption("overlay", "mountattempts"); attempts != "" {
+		n, err := strconv.Atoi(attempts)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid overlay.mountattempts %q", attempts)
+		}
+		driver.MountAttempts = n
+	}
+	if delay := config.DriverOption("overlay", "mountretrydelay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid overlay.mountretrydelay %q", delay)
+		}
+		driver.MountRetryDelay = d
+	}
+	if secure := config.DriverOption("overlay", "secureremove"); secure != "" {
+		b, err := strconv.ParseBool(secure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlay.secureremove %q", secure)
+		}
+		driver.SecureRemove = b
+	}
+	if lazy := config.DriverOption("overlay", "lazyunmount"); lazy != "" {
+		b, err := strconv.ParseBool(lazy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlay.lazyunmount %q", lazy)
+		}
+		driver.UseLazyUnmount = b
+	}
+	if workdir := config.DriverOption("overlay", "workdir"); workdir != "" {
+		if !filepath.IsAbs(workdir) {
+			return nil, fmt.Errorf("invalid overlay.workdir %q, it must be absolute", workdir)
+		}
+		driver.WorkDir = workdir
+	}
+	for _, opt := range strings.Split(config.DriverOption("overlay", "mountoptions"), ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			driver.MountOptions = append(driver.MountOptions, opt)
+		}
+	}
+	if _, err := storage.MountFlags(driver.MountOptions); err != nil {
+		return nil, fmt.Errorf("invalid overlay.mountoptions: %v", err)
+	}
+	mode, err := parseRenameMode(config.DriverOption("overlay", "renameworkaround"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid overlay.renameworkaround: %v", err)
+	}
+	driver.RenameWorkaround = mode
+	return driver, nil
+}
+
+// mountContainer mounts the rootfs of the container into sharedDir, retrying
+// while the kernel reports the mount as busy.
+func (o *OverlayFsStorage) mountContainer(mountId, sharedDir string, lowerIds []string, readonly bool) error {
+	flags, err := storage.MountFlags(o.MountOptions)
+	if err != nil {
+		return err
+	}
+	return retryMount(func() error {
+		_, err := overlay.MountContainer(overlay.MountOptions{
+			ContainerId: mountId,
+			RootDir:     o.RootPath(),
+			SharedDir:   sharedDir,
+			LowerIds:    lowerIds,
+			ReadOnly:    readonly,
+			WorkRoot:    o.WorkDir,
+			Flags:       flags,
+			Data:        o.renameMountData(),
+		})
+		return err
+	}, o.MountAttempts, o.MountRetryDelay)
+}
+
+// overlayMounted tells whether the rootfs of a container is mounted on
+// mountPoint, and whether it is mounted read-only, i.e. without an upper dir.
+func overlayMounted(mountPoint string) (mounted, readonly bool) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return false, false
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == mountPoint {
+			return true, !strings.Contains(m.VfsOpts, "upperdir=")
+		}
+	}
+	return false, false
+}
+
+// checkOverlayWritable fails when the container is prepared read-only: the
+// injection would mount it writable over the read-only mount, and change the
+// upper dir under it.
+func checkOverlayWritable(mountId, baseDir string) error {
+	if mounted, ro := overlayMounted(filepath.Join(baseDir, mountId, "rootfs")); mounted && ro {
+		return fmt.Errorf("container %s is prepared read-only, nothing can be injected into it", mountId)
+	}
+	return nil
+}
+
+func (o *OverlayFsStorage) Type() string {
+	return "overlay"
+}
+
+func (o *OverlayFsStorage) RootPath() string {
+	return o.rootPath
+}
+
+// vfsVolumeRoot holds the vfs volumes of the pods, the shared volumes are
+// apart, see storage_shared.go.
+func (o *OverlayFsStorage) vfsVolumeRoot() string {
+	return filepath.Join(o.RootPath(), "volumes")
+}
+
+// volumeRoot returns the root holding the vfs volume volName of podId. The
+// volumes created before they moved under the root path are still in
+// storage.VFSVolumeRoot, they are used from there until removed.
+func (o *OverlayFsStorage) volumeRoot(podId, volName string) string {
+	if _, err := os.Stat(storage.VFSVolumePath(o.vfsVolumeRoot(), podId, volName)); os.IsNotExist(err) {
+		if _, err := os.Stat(storage.VFSVolumePath(storage.VFSVolumeRoot, podId, volName)); err == nil {
+			return storage.VFSVolumeRoot
+		}
+	}
+	return o.vfsVolumeRoot()
+}
+
+// Init checks the kernel supports overlay and the RenameWorkaround, and the
+// root path is on the Filesystem configured. Then it makes the work dir, when
+// one is configured, and checks it is on the filesystem of the upper dirs, as
+// overlay refuses to mount otherwise.
+func (o *OverlayFsStorage) Init(ctx context.Context) (err error) {
+	defer wrapStorageError(&err, o.Type(), "Init", "")
+	if err := checkKernelCapabilities(ctx, o.Type(), o.KernelCapabilities()); err != nil {
+		return err
+	}
+	if err := o.checkRenameWorkaround(); err != nil {
+		return err
+	}
+	if o.Filesystem != "" {
+		if err := ensureDir(o.RootPath(), 0755); err != nil {
+			return err
+		}
+		fs, err := filesystemOf(o.RootPath())
+		if err != nil {
+			return err
+		}
+		if !sameFilesystemName(o.Filesystem, fs) {
+			return fmt.Errorf("overlay root %s is on %s, not on %s", o.RootPath(), fs, o.Filesystem)
+		}
+	}
+	if o.WorkDir == "" {
+		return nil
+	}
+	if err := ensureDir(o.WorkDir, 0700); err != nil {
+		return err
+	}
+	if err := ensureDir(o.RootPath(), 0755); err != nil {
+		return err
+	}
+	var work, root syscall.Stat_t
+	if err := syscall.Stat(o.WorkDir, &work); err != nil {
+		return err
+	}
+	if err := syscall.Stat(o.RootPath(), &root); err != nil {
+		return err
+	}
+	if work.Dev != root.Dev {
+		return fmt.Errorf("overlay work dir %s is not on the filesystem of %s", o.WorkDir, o.RootPath())
+	}
+	return nil
+}
+
+func (*OverlayFsStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (o *OverlayFsStorage) HealthCheck(ctx context.Context) (err error) {
+	defer wrapStorageError(&err, o.Type(), "HealthCheck", "")
+	return checkWritable(o.RootPath())
+}
+
+func (o *OverlayFsStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (o *OverlayFsStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots:      true,
+		SupportsClone:          true,
+		SupportsMountNamespace: true,
+	}
+}
+
+// KernelCapabilities are overlay, and the kernel it was merged in as
+// "overlay", the "overlayfs" of the older ones mounts differently.
+func (o *OverlayFsStorage) KernelCapabilities() []string {
+	return []string{"kernel>=3.18", "fs:overlay"}
+}
+
+func (o *OverlayFsStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (vol *runv.VolumeDescription, err error) {
+	defer o.emit(ContainerPrepared, "", mountId, &err)
+	defer o.takeVolumes(mountId, opts, &err)
+	defer o.refSharedVolumes(mountId, opts, &err)
+	defer o.watchVolumeIO(mountId, opts, &err)
+	defer wrapStorageError(&err, o.Type(), "PrepareContainer", mountId)
+	o.locks.Lock(mountId)
+	defer o.locks.Unlock(mountId)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// the container may have been prepared already, by a concurrent caller or
+	// by an earlier attempt of the caller; its mount is then described as is
+	readonly := opts.ReadOnly
+	if opts.MountNamespace {
+		if err := o.prepareInNamespace(mountId, sharedDir, opts); err != nil {
+			glog.Errorf("failed to mount container %s in its mount namespace: %v", mountId, err)
+			return nil, err
+		}
+	} else if mounted, ro := overlayMounted(filepath.Join(sharedDir, mountId, "rootfs")); !mounted {
+		err := o.mountContainer(mountId, sharedDir, opts.LowerLayers, opts.ReadOnly)
+		if err != nil {
+			glog.Error("got error when mount container to share dir ", err.Error())
+			return nil, err
+		}
+		// the VolumeDescription of runv has no room for the lower dirs, nor
+		// for the mount options
+		if glog.V(1) {
+			lowerDirs, _ := overlay.LowerDirs(mountId, o.RootPath(), opts.LowerLayers)
+			glog.Infof("container %s mounted on the lower dirs %v with the options %v", mountId, lowerDirs, o.MountOptions)
+		}
+	} else if ro != opts.ReadOnly {
+		glog.Warningf("container %s is already prepared with readonly=%v, ignoring readonly=%v", mountId, ro, opts.ReadOnly)
+		readonly = ro
+	}
+	// the rootfs mounted in a namespace is labelled there, the mount point
+	// is all the host sees
+	if !opts.MountNamespace {
+		if err := storage.SetSELinuxLabel(filepath.Join(sharedDir, mountId, "rootfs"), opts.SELinuxLabel); err != nil {
+			return nil, err
+		}
+	}
+
+	containerPath := "/" + mountId
+	vol = &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: readonly,
+	}
+
+	return vol, nil
+}
+
+// PrewarmContainer makes the mount point and the work dir of the container,
+// and walks its lower dirs so that their inodes are cached when
+// PrepareContainer mounts the overlay. The mount point is left to
+// PrepareContainer while the sandbox is not known.
+func (o *OverlayFsStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "PrewarmContainer", mountId)
+	o.locks.Lock(mountId)
+	defer o.locks.Unlock(mountId)
+
+	if sharedDir != "" {
+		if err := os.MkdirAll(filepath.Join(sharedDir, mountId, "rootfs"), 0755); err != nil {
+			return err
+		}
+	}
+	if o.WorkDir != "" {
+		if err := os.MkdirAll(filepath.Join(o.WorkDir, mountId), 0755); err != nil {
+			return err
+		}
+	}
+	lowerDirs, err := overlay.LowerDirs(mountId, o.RootPath(), nil)
+	if err != nil {
+		return err
+	}
+	for _, dir := range lowerDirs {
+		if err := warmTree(ctx, dir, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *OverlayFsStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer o.emit(ContainerCleanedUp, "", id, &err)
+	defer o.releaseVolumes(id, &err)
+	defer o.unrefSharedVolumes(id, &err)
+	defer o.ioWatches.stop(id, &err)
+	defer wrapStorageError(&err, o.Type(), "CleanupContainer", id)
+	o.locks.Lock(id)
+	defer o.locks.Unlock(id)
+
+	// the container may have been cleaned up already, e.g. while recovering
+	// from an error, which is not one
+	mountPoint := filepath.Join(sharedDir, id, "rootfs")
+	if ns := o.namespaces.get(id); ns != nil {
+		if err := inMountNamespace(ns, func() error {
+			return syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+		}); err != nil && err != syscall.EINVAL {
+			return err
+		}
+		if err := o.namespaces.remove(id); err != nil {
+			return err
+		}
+	} else if mounted, _ := overlayMounted(mountPoint); mounted {
+		lazy, err := o.unmountContainer(mountPoint)
+		if err != nil {
+			return err
+		}
+		// the overlay still uses its work dir until lazily unmounted
+		if lazy {
+			return nil
+		}
+	}
+	if o.WorkDir != "" {
+		return os.RemoveAll(filepath.Join(o.WorkDir, id))
+	}
+	return nil
+}
+
+// unmountContainer unmounts the rootfs of a container. While something still
+// holds a file of the rootfs open, the rootfs is lazily unmounted instead if
+// UseLazyUnmount is set: it is detached at once and unmounted by the kernel
+// once the last file is closed, which is watched in the background.
+func (o *OverlayFsStorage) unmountContainer(mountPoint string) (lazy bool, err error) {
+	err = syscall.Unmount(mountPoint, 0)
+	if err != syscall.EBUSY || !o.UseLazyUnmount {
+		return false, err
+	}
+	// the detached overlay is only known by its device from now on
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountPoint, &st); err != nil {
+		return false, err
+	}
+	glog.Warningf("rootfs %s is busy, unmount it lazily", mountPoint)
+	if err := syscall.Unmount(mountPoint, syscall.MNT_DETACH); err != nil {
+		return false, err
+	}
+	go func() {
+		if !waitReleased(uint64(st.Dev), lazyUnmountInterval, lazyUnmountTimeout) {
+			glog.Errorf("rootfs %s is still held open %v after its lazy unmount", mountPoint, lazyUnmountTimeout)
+		}
+	}()
+	return true, nil
+}
+
+var (
+	// lazyUnmountInterval and lazyUnmountTimeout control the watch of the
+	// lazy unmounts.
+	lazyUnmountInterval = time.Second
+	lazyUnmountTimeout  = time.Minute
+)
+
+// waitReleased polls every interval until no process holds a file of the
+// device dev open, and tells whether it happened within timeout.
+func waitReleased(dev uint64, interval, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for storage.DeviceOpened(dev) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(interval)
+	}
+	return true
+}
+
+func (o *OverlayFsStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) (err error) {
+	defer wrapStorageError(&err, o.Type(), "InjectFile", mountId)
+	o.locks.Lock(mountId)
+	defer o.locks.Unlock(mountId)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkOverlayWritable(mountId, baseDir); err != nil {
+		return err
+	}
+
+	err = o.mountContainer(mountId, baseDir, nil, false)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return err
+	}
+	defer syscall.Unmount(filepath.Join(baseDir, mountId, "rootfs"), 0)
+
+	return storage.FsInjectFileAtomic(src, mountId, target, baseDir, perm, uid, gid, xattrs, o.verifyChecksum)
+}
+
+func (o *OverlayFsStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) (err error) {
+	defer wrapStorageError(&err, o.Type(), "InjectDir", mountId)
+	o.locks.Lock(mountId)
+	defer o.locks.Unlock(mountId)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkOverlayWritable(mountId, baseDir); err != nil {
+		return err
+	}
+
+	err = o.mountContainer(mountId, baseDir, nil, false)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return err
+	}
+	defer syscall.Unmount(filepath.Join(baseDir, mountId, "rootfs"), 0)
+
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, o.verifyChecksum)
+}
+
+// AvailableBytes returns the free space of the filesystem of the writable
+// layers of the containers.
+func (o *OverlayFsStorage) AvailableBytes() (n int64, err error) {
+	defer wrapStorageError(&err, o.Type(), "AvailableBytes", "")
+	return availableBytes(o.RootPath())
+}
+
+func (o *OverlayFsStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer o.emit(VolumeCreated, podId, spec.Name, &err)
+	defer wrapStorageError(&err, o.Type(), "CreateVolume", volumeID(podId, spec.Name))
+	if spec.Shared {
+		return o.createSharedVolume(ctx, podId, spec)
+	}
+	volName, err := storage.CreateVFSVolume(o.vfsVolumeRoot(), podId, spec.Name)
+	if err != nil {
+		return err
+	}
+	spec.Source = volName
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, o.db, podId, spec)
+}
+
+func (o *OverlayFsStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer o.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if o.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	defer wrapStorageError(&err, o.Type(), "RemoveVolume", volumeID(podId, parseVolumeRecord(record).Name))
+	name := parseVolumeRecord(record).Name
+	if parseVolumeRecord(record).Shared {
+		return o.removeSharedVolume(ctx, podId, name)
+	}
+	root := o.volumeRoot(podId, name)
+	if strings.HasPrefix(parseVolumeRecord(record).Source, storage.VFSVolumeRoot+"/") {
+		root = storage.VFSVolumeRoot
+	}
+	volName := storage.VFSVolumePath(root, podId, name)
+	if storage.PathInUse(volName) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volName, podId)
+		return ErrVolumeInUse
+	}
+	if o.SecureRemove {
+		err := secureErase(ctx, volName, func(ctx context.Context) error {
+			if err := shredTree(ctx, volName); err != nil {
+				return err
+			}
+			return shredTree(ctx, storage.VFSSnapshotPath(root, podId, name, ""))
+		})
+		if err != nil {
+			glog.Errorf("failed to erase volume %s: %v", volName, err)
+			return err
+		}
+	}
+	if err := os.RemoveAll(volName); err != nil {
+		glog.Errorf("failed to remove volume %s: %v", volName, err)
+		return err
+	}
+	if err := storage.RemoveVFSSnapshots(root, podId, name); err != nil {
+		glog.Errorf("failed to remove the snapshots of volume %s: %v", volName, err)
+		return err
+	}
+	// remove the pod directory as well once its last volume is gone
+	os.Remove(filepath.Dir(volName))
+	return deleteVolumeRecord(ctx, o.db, podId, name)
+}
+
+func (o *OverlayFsStorage) ListVolumes(ctx context.Context, podId string) (vols []*apitypes.UserVolume, err error) {
+	defer wrapStorageError(&err, o.Type(), "ListVolumes", podId)
+	vols, err = listVFSVolumes(o.vfsVolumeRoot(), podId)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := listVFSVolumes(storage.VFSVolumeRoot, podId)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(vols))
+	for _, vol := range vols {
+		listed[vol.Name] = true
+	}
+	for _, vol := range legacy {
+		if !listed[vol.Name] {
+			vols = append(vols, vol)
+		}
+	}
+	return vols, nil
+}
+
+// ResizeVolume is not supported as the vfs volumes are plain directories
+// without a project quota.
+func (o *OverlayFsStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) (err error) {
+	defer wrapStorageError(&err, o.Type(), "ResizeVolume", volumeID(podId, volName))
+	return ErrNotSupported
+}
+
+func (o *OverlayFsStorage) DefragVolume(ctx context.Context, podId, volName string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "DefragVolume", volumeID(podId, volName))
+	return ErrNotSupported
+}
+
+// WarmVolume walks the directory of the volume, so that its dentries and
+// inodes, and the content of its files, are in the cache of the host.
+func (o *OverlayFsStorage) WarmVolume(ctx context.Context, podId, volName string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "WarmVolume", volumeID(podId, volName))
+	return warmTree(ctx, storage.VFSVolumePath(o.volumeRoot(podId, volName), podId, volName), true)
+}
+
+func (o *OverlayFsStorage) VolumeExists(ctx context.Context, podId, volName string) (exists bool, err error) {
+	defer wrapStorageError(&err, o.Type(), "VolumeExists", volumeID(podId, volName))
+	return pathExists(storage.VFSVolumePath(o.volumeRoot(podId, volName), podId, volName))
+}
+
+func (o *OverlayFsStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(o.db, podId, volName)
+}
+
+func (o *OverlayFsStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), o.db, podId, volName, labels)
+}
+
+func (o *OverlayFsStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "SnapshotVolume", volumeID(podId, volName))
+	return snapshotVFSVolume(o.volumeRoot(podId, volName), podId, volName, snapshot)
+}
+
+func (o *OverlayFsStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "RollbackVolume", volumeID(podId, volName))
+	return rollbackVFSVolume(o.volumeRoot(podId, volName), podId, volName, snapshot)
+}
+
+func (o *OverlayFsStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "CloneVolume", volumeID(dstPodId, dstVolName))
+	// the clone of a volume of the legacy root is made next to it
+	volName, err := storage.CloneVFSVolume(o.volumeRoot(srcPodId, srcVolName), srcPodId, srcVolName, dstPodId, dstVolName)
+	if err != nil {
+		return err
+	}
+	spec := &apitypes.UserVolume{
+		Name:   dstVolName,
+		Source: volName,
+		Format: "vfs",
+		Fstype: "dir",
+	}
+	return saveVolumeRecord(ctx, o.db, dstPodId, spec)
+}
+
+func (o *OverlayFsStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) (err error) {
+	defer wrapStorageError(&err, o.Type(), "ExportVolume", volumeID(podId, volName))
+	return exportVFSVolume(ctx, o.volumeRoot(podId, volName), podId, volName, dst)
+}
+
+func (o *OverlayFsStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer wrapStorageError(&err, o.Type(), "ImportVolume", volumeID(podId, volName))
+	return importVFSVolume(ctx, o.volumeRoot(podId, volName), podId, volName, src)
+}
+
+func (o *OverlayFsStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) (err error) {
+	defer wrapStorageError(&err, o.Type(), "ExportIncrementalVolume", volumeID(podId, volName))
+	return ErrNotSupported
+}
+
+func (o *OverlayFsStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer wrapStorageError(&err, o.Type(), "ImportIncrementalVolume", volumeID(podId, volName))
+	return ErrNotSupported
+}
+
+// ContainerStats walks the upper directory of the container, the lower one is
+// the root of its image.
+func (o *OverlayFsStorage) ContainerStats(ctx context.Context, containerId string) (stats *StorageStats, err error) {
+	defer wrapStorageError(&err, o.Type(), "ContainerStats", containerId)
+	stats, err = dirStats(ctx, filepath.Join(o.RootPath(), containerId, "upper"))
+	if err != nil {
+		return nil, err
+	}
+	stats.LayerCount = 2
+	return stats, nil
+}
+
+func (o *OverlayFsStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (collected []string, err error) {
+	defer wrapStorageError(&err, o.Type(), "GarbageCollect", "")
+	collected, err = collectVFSVolumes(o.vfsVolumeRoot(), activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := collectVFSVolumes(storage.VFSVolumeRoot, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	collected = append(collected, legacy...)
+	shared, err := o.collectSharedVolumes(activePodIDs)
+	return append(collected, shared...), err
+}
+
+type RawBlockStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	// VolumeSize is the size of the volumes which do not ask for one.
+	VolumeSize uint64
+	// Filesystem is made on the volumes and expected on the blocks of the
+	// containers, one of supportedRawBlockFs.
+	Filesystem string
+	// locks is keyed on the path of the block file an operation works on.
+	// Callers may hold their pod or container locks when calling in, so a
+	// block lock is only ever taken after those and is released before
+	// returning, the driver never calls back into the pod while holding it.
+	locks locker.Locker
+	// MasterKeyPath is the file of the key sealing the keys of the encrypted
+	// volumes, <root>/master.key by default.
+	MasterKeyPath string
+	masterLock    sync.Mutex
+	master        []byte
+	// SecureRemove overwrites the blocks of the volumes, and their
+	// snapshots, with zeros before removing them.
+	SecureRemove bool
+	// ProjectQuota limits the disk space of each block to the size of its
+	// volume with an XFS project quota, see storage_quota.go.
+	ProjectQuota bool
+	// quotaMount is the XFS of the root, found by Init.
+	quotaMount string
+	// reflink is set by Init when the root can share the extents of the
+	// blocks, see storage_reflink.go.
+	reflink bool
+	// Preallocate allocates all the space of the blocks of the volumes when
+	// they are created, they are sparse files otherwise. Sparsify makes
+	// Init punch the dense blocks back to sparse files, see
+	// storage_sparse.go.
+	Preallocate bool
+	Sparsify    bool
+	// FsckCheck makes Init check the filesystems of the volumes, and
+	// FsckRepair repair them, see storage_fsck.go.
+	FsckCheck  bool
+	FsckRepair bool
+	// frozen are the mount points of the blocks frozen by FreezeVolume.
+	frozenLock sync.Mutex
+	frozen     map[string]string
+	// ioBaselines are the counters of the devices of the volumes of the
+	// containers when prepared, see storage_iostats.go.
+	ioBaselines volumeIOBaselines
+}
+
+var supportedRawBlockFs = []string{"xfs", "ext4"}
+
+func RawBlockFactory(sysinfo *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &RawBlockStorage{
+		db:         db,
+		rootPath:   config.DriverRoot("rawblock"),
+		VolumeSize: uint64(storage.DEFAULT_DM_VOL_SIZE),
+		Filesystem: "xfs",
+	}
+	// follow the filesystem docker makes on the blocks of the containers
+	if sysinfo != nil {
+		for _, pair := range sysinfo.DriverStatus {
+			if pair[0] == "Block Filesystem" {
+				driver.Filesystem = pair[1]
+			}
+		}
+	}
+	if root := config.DriverOption("rawblock", "rootpath"); root != "" && !filepath.IsAbs(root) {
+		return nil, fmt.Errorf("invalid rawblock.rootpath %q, it must be absolute", root)
+	}
+	// fs is the former name of the filesystem option
+	if fs := config.DriverOption("rawblock", "fs"); fs != "" {
+		driver.Filesystem = fs
+	}
+	if fs := config.DriverOption("rawblock", "filesystem"); fs != "" {
+		driver.Filesystem = fs
+	}
+	if size := config.DriverOption("rawblock", "volumesize"); size != "" {
+		bytes, err := units.RAMInBytes(size)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid rawblock.volumesize %q", size)
+		}
+		driver.VolumeSize = uint64(bytes)
+	}
+	driver.MasterKeyPath = config.DriverOption("rawblock", "masterkey")
+	if secure := config.DriverOption("rawblock", "secureremove"); secure != "" {
+		b, err := strconv.ParseBool(secure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rawblock.secureremove %q", secure)
+		}
+		driver.SecureRemove = b
+	}
+	if quota := config.DriverOption("rawblock", "projectquota"); quota != "" {
+		b, err := strconv.ParseBool(quota)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rawblock.projectquota %q", quota)
+		}
+		driver.ProjectQuota = b
+	}
+	if sparse := config.DriverOption("rawblock", "sparse"); sparse != "" {
+		b, err := strconv.ParseBool(sparse)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rawblock.sparse %q", sparse)
+		}
+		driver.Preallocate = !b
+	}
+	if sparsify := config.DriverOption("rawblock", "sparsify"); sparsify != "" {
+		b, err := strconv.ParseBool(sparsify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rawblock.sparsify %q", sparsify)
+		}
+		driver.Sparsify = b
+	}
+	if fsck := config.DriverOption("rawblock", "fsck"); fsck != "" {
+		b, err := strconv.ParseBool(fsck)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rawblock.fsck %q", fsck)
+		}
+		driver.FsckCheck = b
+	}
+	driver.FsckRepair = config != nil && config.Fsck
+	return driver, nil
+}
+
+func (s *RawBlockStorage) Type() string {
+	return "rawblock"
+}
+
+func (s *RawBlockStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *RawBlockStorage) Init(ctx context.Context) (err error) {
+	defer wrapStorageError(&err, s.Type(), "Init", "")
+	if s.Filesystem == "" {
+		s.Filesystem = "xfs"
+	}
+	supported := false
+	for _, fs := range supportedRawBlockFs {
+		if s.Filesystem == fs {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("unsupported filesystem %s for rawblock, should be one of %v", s.Filesystem, supportedRawBlockFs)
+	}
+	if err := checkKernelCapabilities(ctx, s.Type(), s.KernelCapabilities()); err != nil {
+		return err
+	}
+	if err := s.checkTools(); err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700); err != nil {
+		return err
+	}
+	if err := s.pruneVolumeMetas(); err != nil {
+		return err
+	}
+	s.reflink = probeReflink(filepath.Join(s.RootPath(), "volumes"))
+	glog.V(1).Infof("reflinks supported by the rawblock root %s: %v", s.RootPath(), s.reflink)
+	if s.ProjectQuota {
+		mnt, err := xfsQuotaMount(s.RootPath())
+		if err != nil {
+			return err
+		}
+		s.quotaMount = mnt
+	}
+	if s.Sparsify {
+		if err := s.sparsifyVolumes(ctx); err != nil {
+			return err
+		}
+	}
+	if err := s.openEncryptedBlocks(ctx); err != nil {
+		return err
+	}
+	if err := s.checkVolumes(ctx); err != nil {
+		return err
+	}
+	// which containers are active is only known from the db
+	if s.db != nil {
+		if _, err := s.unmountLeakedBlocks(ctx); err != nil {
+			glog.Errorf("failed to unmount the leaked container blocks: %v", err)
+		}
+	}
+	return s.restoreThrottles(ctx)
+}
+
+func (*RawBlockStorage) CleanUp(ctx context.Context) error { return nil }
+
+// rawBlockToolPackages are the packages providing the tools of the driver.
+var rawBlockToolPackages = map[string]string{
+	"mkfs.xfs":   "xfsprogs",
+	"xfs_growfs": "xfsprogs",
+	"xfs_quota":  "xfsprogs",
+	"mkfs.ext4":  "e2fsprogs",
+	"resize2fs":  "e2fsprogs",
+	"xfs_repair": "xfsprogs",
+	"e2fsck":     "e2fsprogs",
+}
+
+// checkTools checks that the tools formatting, growing, limiting and
+// checking the volumes are installed.
+func (s *RawBlockStorage) checkTools() error {
+	tools := []string{"mkfs." + s.Filesystem}
+	if s.Capabilities().SupportsResize {
+		if s.Filesystem == "ext4" {
+			tools = append(tools, "resize2fs")
+		} else {
+			tools = append(tools, "xfs_growfs")
+		}
+	}
+	if s.ProjectQuota {
+		tools = append(tools, "xfs_quota")
+	}
+	if s.FsckCheck || s.FsckRepair {
+		tools = append(tools, s.fsckTool())
+	}
+	for _, tool := range tools {
+		if err := lookTool(s, tool, rawBlockToolPackages[tool]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HealthCheck checks that the volumes can be formatted and created.
+func (s *RawBlockStorage) HealthCheck(ctx context.Context) (err error) {
+	defer wrapStorageError(&err, s.Type(), "HealthCheck", "")
+	if err := s.checkTools(); err != nil {
+		return err
+	}
+	return checkWritable(s.RootPath())
+}
+
+func (s *RawBlockStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *RawBlockStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots:  true,
+		SupportsResize:     true,
+		SupportsEncryption: true,
+		SupportsQuota:      true,
+		SupportsClone:      true,
+	}
+}
+
+// KernelCapabilities are the filesystem of the blocks, mounted through loop
+// devices; xfs needs 3.16 for the crc and finobt mkfs.xfs enables by
+// default.
+func (s *RawBlockStorage) KernelCapabilities() []string {
+	if s.Filesystem == "xfs" || s.Filesystem == "" {
+		return []string{"kernel>=3.16", "fs:xfs"}
+	}
+	return []string{"fs:" + s.Filesystem}
+}
+
+// PrepareContainer describes the block of the container. The block is handed
+// to the hypervisor as is, nothing is mapped on the host, so preparing the
+// container again describes the same block.
+func (s *RawBlockStorage) PrepareContainer(ctx context.Context, containerId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", containerId, &err)
+	devFullName := filepath.Join(s.RootPath(), "blocks", containerId)
+	s.locks.Lock(devFullName)
+	defer s.locks.Unlock(devFullName)
+	// the volumes are taken under the lock, as CleanupContainer releases them
+	defer s.takeVolumes(containerId, opts, &err)
+	defer s.takeIOBaselines(containerId, opts, &err)
+
+	// before the label, the clone replacing a deduplicated block has none
+	s.dedupBlock(ctx, containerId, devFullName)
+
+	// the block is handed to the hypervisor as is, so it carries the label
+	if err := storage.SetSELinuxLabel(devFullName, opts.SELinuxLabel); err != nil {
+		return nil, err
+	}
+
+	vol := &runv.VolumeDescription{
+		Name:     devFullName,
+		Source:   devFullName,
+		Fstype:   s.Filesystem,
+		Format:   "raw",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+// CleanupContainer has nothing to undo on the host, like PrepareContainer; a
+// detach step added here must keep cleaning up twice a success. It takes the
+// lock of the block all the same, so that it is serialized with the
+// PrepareContainer calls of the container.
+func (s *RawBlockStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	devFullName := filepath.Join(s.RootPath(), "blocks", id)
+	s.locks.Lock(devFullName)
+	defer s.locks.Unlock(devFullName)
+	defer s.releaseVolumes(id, &err)
+	defer s.ioBaselines.remove(id, &err)
+	return nil
+}
+
+func (s *RawBlockStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) (err error) {
+	defer wrapStorageError(&err, s.Type(), "InjectFile", mountId)
+	devFullName := filepath.Join(s.RootPath(), "blocks", mountId)
+	s.locks.Lock(devFullName)
+	defer s.locks.Unlock(devFullName)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := rawblock.GetImage(filepath.Join(s.RootPath(), "blocks"), baseDir, mountId, s.Filesystem, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectFileAtomic(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *RawBlockStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) (err error) {
+	defer wrapStorageError(&err, s.Type(), "InjectDir", mountId)
+	devFullName := filepath.Join(s.RootPath(), "blocks", mountId)
+	s.locks.Lock(devFullName)
+	defer s.locks.Unlock(devFullName)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := rawblock.GetImage(filepath.Join(s.RootPath(), "blocks"), baseDir, mountId, s.Filesystem, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *RawBlockStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+// AvailableBytes returns the free space of the filesystem of the volumes.
+func (s *RawBlockStorage) AvailableBytes() (n int64, err error) {
+	defer wrapStorageError(&err, s.Type(), "AvailableBytes", "")
+	return availableBytes(filepath.Join(s.RootPath(), "volumes"))
+}
+
+// checkAvailable fails with ErrInsufficientStorage when a volume of size bytes
+// does not fit in the free space, sparse or not: the space of a sparse block
+// is taken as it is written to.
+func (s *RawBlockStorage) checkAvailable(size uint64) error {
+	available, err := s.AvailableBytes()
+	if err != nil {
 		return err
 	}
+	if available < 0 || size > uint64(available) {
+		return fmt.Errorf("%w: %s asked, %s available", ErrInsufficientStorage,
+			units.BytesSize(float64(size)), units.BytesSize(float64(available)))
+	}
 	return nil
 }
 
-func (*RawBlockStorage) CleanUp() error { return nil }
+func (s *RawBlockStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	defer wrapStorageError(&err, s.Type(), "CreateVolume", volumeID(podId, spec.Name))
+	block := s.volumePath(podId, spec.Name)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
 
-func (s *RawBlockStorage) PrepareContainer(containerId, sharedDir string, readonly bool) (*runv.VolumeDescription, error) {
-	devFullName := filepath.Join(s.RootPath(), "blocks", containerId)
+	size := spec.SizeBytes
+	if size == 0 {
+		size = s.VolumeSize
+	}
+	// mkfs would fail midway, leaving a partial block behind
+	if err := s.checkAvailable(size); err != nil {
+		return err
+	}
+	if spec.Encrypted {
+		device, err := s.createEncryptedBlock(ctx, block, size)
+		if err != nil {
+			return err
+		}
+		spec.Source = device
+	} else {
+		if err := rawblock.CreateBlock(block, s.Filesystem, "", size); err != nil {
+			return err
+		}
+		spec.Source = block
+	}
+	if s.Preallocate {
+		if err := preallocateBlock(block, size); err != nil {
+			s.closeEncryptedBlock(ctx, block)
+			os.Remove(block)
+			return err
+		}
+	}
+	spec.Sparse = !s.Preallocate
+	if err := s.limitBlock(ctx, block, size); err != nil {
+		s.closeEncryptedBlock(ctx, block)
+		os.Remove(block)
+		return err
+	}
+	if limits := throttleOptions(spec.Throttle); limits != (rawblock.ThrottleOptions{}) {
+		device, err := s.throttleBlock(ctx, block, limits)
+		if err != nil {
+			s.unthrottleBlock(ctx, block)
+			s.closeEncryptedBlock(ctx, block)
+			os.Remove(block)
+			return err
+		}
+		spec.Source = device
+	}
+	if err := writeVolumeMeta(block, s.newVolumeMeta(podId, spec, size)); err != nil {
+		s.unthrottleBlock(ctx, block)
+		s.closeEncryptedBlock(ctx, block)
+		os.Remove(block)
+		return err
+	}
+	spec.Fstype = s.Filesystem
+	spec.Format = "raw"
+	// without its record the block would never be collected
+	if err := saveVolumeRecord(ctx, s.db, podId, spec); err != nil {
+		s.unthrottleBlock(ctx, block)
+		s.closeEncryptedBlock(ctx, block)
+		os.Remove(volumeMetaPath(block))
+		os.Remove(block)
+		return err
+	}
+	return nil
+}
 
-	vol := &runv.VolumeDescription{
-		Name:     devFullName,
-		Source:   devFullName,
-		Fstype:   "xfs",
-		Format:   "raw",
-		ReadOnly: readonly,
+func (s *RawBlockStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	defer wrapStorageError(&err, s.Type(), "RemoveVolume", volumeID(podId, parseVolumeRecord(record).Name))
+	name := parseVolumeRecord(record).Name
+	block := s.volumePath(podId, name)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	// the block file is held open by the hypervisor while attached to a VM
+	if storage.PathInUse(block) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", block, podId)
+		return ErrVolumeInUse
+	}
+	if err := s.unthrottleBlock(ctx, block); err != nil {
+		if err == ErrVolumeInUse {
+			glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", block, podId)
+		}
+		return err
+	}
+	if err := s.closeEncryptedBlock(ctx, block); err != nil {
+		if err == ErrVolumeInUse {
+			glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", block, podId)
+		}
+		return err
+	}
+	if err := s.unlimitBlock(ctx, block); err != nil {
+		return err
+	}
+	if s.SecureRemove {
+		err := secureErase(ctx, block, func(ctx context.Context) error {
+			return eraseFiles(ctx, append([]string{block}, snapshotFiles(s.snapshotPath(podId, name, ""))...)...)
+		})
+		if err != nil {
+			glog.Errorf("failed to erase volume %s: %v", block, err)
+			return err
+		}
+	}
+	if err := os.Remove(block); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("failed to remove volume %s: %v", block, err)
+		return err
+	}
+	// a sidecar left by a crash here is pruned by Init
+	if err := os.Remove(volumeMetaPath(block)); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("failed to remove the metadata of volume %s: %v", block, err)
+		return err
+	}
+	if err := os.RemoveAll(s.snapshotPath(podId, name, "")); err != nil {
+		glog.Errorf("failed to remove the snapshots of volume %s: %v", block, err)
+		return err
+	}
+	if err := deleteVolumeRecord(ctx, s.db, podId, name); err != nil {
+		glog.Error(err.Error())
+		return err
 	}
+	return nil
+}
 
-	return vol, nil
+func (s *RawBlockStorage) ListVolumes(ctx context.Context, podId string) (vols []*apitypes.UserVolume, err error) {
+	defer wrapStorageError(&err, s.Type(), "ListVolumes", podId)
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols = make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		if isVolumeMeta(name) {
+			continue
+		}
+		vol := &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "raw",
+			Fstype: s.Filesystem,
+		}
+		// the volumes made before the sidecars have none
+		if meta, err := readVolumeMeta(vol.Source); err == nil {
+			vol.SizeBytes = meta.SizeBytes
+			vol.Fstype = meta.Filesystem
+			vol.Labels = meta.Labels
+		} else if !os.IsNotExist(err) {
+			glog.Warningf("failed to read the metadata of volume %s: %v", vol.Source, err)
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
 }
 
-func (s *RawBlockStorage) CleanupContainer(id, sharedDir string) error {
+// ResizeVolume grows the block file of the volume and the filesystem on it.
+// xfs can not be shrunk, and shrinking ext4 would need to check it first, so
+// a size below the current one is refused.
+func (s *RawBlockStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) (err error) {
+	defer wrapStorageError(&err, s.Type(), "ResizeVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	fi, err := os.Stat(block)
+	if err != nil {
+		return err
+	}
+	// the device the block is opened through would not grow with it
+	if s.attachedBlock(block) {
+		return ErrNotSupported
+	}
+	fstype := s.volumeFilesystem(block)
+	size := uint64(fi.Size())
+	if newSizeBytes < size {
+		return fmt.Errorf("cannot shrink volume %s of pod %s from %d to %d bytes, %s can only grow", volName, podId, size, newSizeBytes, fstype)
+	}
+	if newSizeBytes == size {
+		return nil
+	}
+	// the sandbox would not notice the new size of an attached block
+	if storage.PathInUse(block) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to resize it", volName, podId)
+		return ErrVolumeInUse
+	}
+	// the limit is raised first, growing the filesystem writes to the block
+	if err := s.limitBlock(ctx, block, newSizeBytes); err != nil {
+		return err
+	}
+	if err := os.Truncate(block, int64(newSizeBytes)); err != nil {
+		return err
+	}
+	if err := growFs(ctx, block, fstype); err != nil {
+		return err
+	}
+	if err := updateVolumeMeta(block, func(meta *volumeMeta) { meta.SizeBytes = newSizeBytes }); err != nil {
+		glog.Warningf("failed to update the size in the metadata of volume %s: %v", block, err)
+	}
+	glog.V(1).Infof("volume %s of pod %s resized from %d to %d bytes", volName, podId, size, newSizeBytes)
 	return nil
 }
 
-func (s *RawBlockStorage) InjectFile(src io.Reader, mountId, target, baseDir string, perm, uid, gid int) error {
-	if err := rawblock.GetImage(filepath.Join(s.RootPath(), "blocks"), baseDir, mountId, "xfs", "", uid, gid); err != nil {
+// volumeFilesystem returns the filesystem the volume was made with, which is
+// the one of the driver for the volumes made before their metadata.
+func (s *RawBlockStorage) volumeFilesystem(block string) string {
+	if meta, err := readVolumeMeta(block); err == nil && meta.Filesystem != "" {
+		return meta.Filesystem
+	}
+	return s.Filesystem
+}
+
+func growFs(ctx context.Context, block, fstype string) error {
+	if fstype == "ext4" {
+		// resize2fs grows an unmounted ext4 in place
+		if out, err := execCommand(ctx, "resize2fs", block).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to grow ext4 on %s: %v, %s", block, err, out)
+		}
+		return nil
+	}
+
+	mountPoint, err := ioutil.TempDir("", "hyper-resize-")
+	if err != nil {
 		return err
 	}
-	defer rawblock.PutImage(baseDir, mountId)
-	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid)
+	defer os.Remove(mountPoint)
+	if out, err := execCommand(ctx, "mount", "-o", "loop", block, mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount %s: %v, %s", block, err, out)
+	}
+	// the block is unmounted even when ctx is done
+	defer func() {
+		if out, err := execCommand(context.Background(), "umount", mountPoint).CombinedOutput(); err != nil {
+			glog.Errorf("failed to unmount %s: %v: %s", mountPoint, err, out)
+		}
+	}()
+	if out, err := execCommand(ctx, "xfs_growfs", mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to grow xfs on %s: %v, %s", block, err, out)
+	}
+	return nil
+}
+
+func (s *RawBlockStorage) VolumeExists(ctx context.Context, podId, volName string) (exists bool, err error) {
+	defer wrapStorageError(&err, s.Type(), "VolumeExists", volumeID(podId, volName))
+	return pathExists(s.volumePath(podId, volName))
 }
 
-func (s *RawBlockStorage) CreateVolume(podId string, spec *apitypes.UserVolume) error {
-	block := filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, spec.Name))
-	if err := rawblock.CreateBlock(block, "xfs", "", uint64(storage.DEFAULT_DM_VOL_SIZE)); err != nil {
+func (s *RawBlockStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *RawBlockStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	if err := saveVolumeLabels(context.Background(), s.db, podId, volName, labels); err != nil {
 		return err
 	}
-	spec.Source = block
-	spec.Fstype = "xfs"
-	spec.Format = "raw"
+	return updateVolumeMeta(s.volumePath(podId, volName), func(meta *volumeMeta) { meta.Labels = labels })
+}
+
+func (s *RawBlockStorage) snapshotPath(podId, volName, snapshot string) string {
+	return filepath.Join(s.RootPath(), "volumes", ".snapshots", fmt.Sprintf("%s-%s", podId, volName), snapshot)
+}
+
+// copyBlockFile copies the block file with cp, sharing the extents with the
+// source where the backing filesystem supports reflinks.
+func copyBlockFile(ctx context.Context, src, dst string) error {
+	if out, err := execCommand(ctx, "cp", "--reflink=auto", "--sparse=always", src, dst).CombinedOutput(); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy %s to %s: %v, %s", src, dst, err, out)
+	}
+	return nil
+}
+
+func (s *RawBlockStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "SnapshotVolume", volumeID(podId, volName))
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+	// a block attached to a sandbox may be inconsistent on the host side,
+	// unless its filesystem is frozen
+	if storage.PathInUse(block) && s.frozenMount(block) == "" {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to snapshot it", volName, podId)
+		return ErrVolumeInUse
+	}
+	snap := s.snapshotPath(podId, volName, snapshot)
+	if _, err := os.Stat(snap); err == nil {
+		return fmt.Errorf("snapshot %s of volume %s already exists", snapshot, volName)
+	}
+	if err := ensureDir(filepath.Dir(snap), 0700); err != nil {
+		return err
+	}
+	return s.copyBlock(ctx, block, snap)
+}
+
+// RollbackVolume copies the snapshot next to the block of the volume and
+// renames it over the block, the snapshot itself is kept.
+func (s *RawBlockStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "RollbackVolume", volumeID(podId, volName))
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	snap := s.snapshotPath(podId, volName, snapshot)
+	if _, err := os.Stat(snap); err != nil {
+		return err
+	}
+	// the device the block is opened through would keep the replaced one
+	if s.attachedBlock(block) {
+		return ErrNotSupported
+	}
+	if storage.PathInUse(block) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to roll it back", volName, podId)
+		return ErrVolumeInUse
+	}
+	tmp := filepath.Join(filepath.Dir(block), "."+filepath.Base(block)+".rollback")
+	if err := s.copyBlock(ctx, snap, tmp); err != nil {
+		return err
+	}
+	if err := storage.ReplacePath(tmp, block); err != nil {
+		return err
+	}
+	// the snapshot may predate a resize
+	syncVolumeMetaSize(block)
 	return nil
 }
 
-func (s *RawBlockStorage) RemoveVolume(podId string, record []byte) error {
+// CloneVolume copies the block of the source volume, sharing its extents
+// where the filesystem of the root supports reflinks. The source is copied
+// while detached only, as for a snapshot.
+func (s *RawBlockStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "CloneVolume", volumeID(dstPodId, dstVolName))
+	src, dst := s.volumePath(srcPodId, srcVolName), s.volumePath(dstPodId, dstVolName)
+	if src == dst {
+		return fmt.Errorf("cannot clone volume %s onto itself", srcVolName)
+	}
+	// lock in order, a clone the other way round would deadlock
+	first, second := src, dst
+	if second < first {
+		first, second = second, first
+	}
+	s.locks.Lock(first)
+	defer s.locks.Unlock(first)
+	s.locks.Lock(second)
+	defer s.locks.Unlock(second)
+
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("volume %s of pod %s already exists", dstVolName, dstPodId)
+	}
+	// the clone would share the uuid, and so the dm-crypt device, of the source
+	if id, _ := luksUUID(src); id != "" {
+		return ErrNotSupported
+	}
+	if storage.PathInUse(src) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to clone it", srcVolName, srcPodId)
+		return ErrVolumeInUse
+	}
+	if err := s.copyBlock(ctx, src, dst); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dst)
+	if err == nil {
+		err = s.limitBlock(ctx, dst, uint64(fi.Size()))
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	spec := &apitypes.UserVolume{
+		Name:   dstVolName,
+		Source: dst,
+		Fstype: s.Filesystem,
+		Format: "raw",
+	}
+	if err := writeVolumeMeta(dst, s.newVolumeMeta(dstPodId, spec, uint64(fi.Size()))); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if err := saveVolumeRecord(ctx, s.db, dstPodId, spec); err != nil {
+		os.Remove(volumeMetaPath(dst))
+		os.Remove(dst)
+		return err
+	}
 	return nil
 }
 
+// ContainerStats returns the size of the block of the container. Its
+// filesystem is only mounted in the sandbox, the blocks allocated to the
+// sparse file stand for the bytes written.
+func (s *RawBlockStorage) ContainerStats(ctx context.Context, containerId string) (stats *StorageStats, err error) {
+	defer wrapStorageError(&err, s.Type(), "ContainerStats", containerId)
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(s.RootPath(), "blocks", containerId), &st); err != nil {
+		return nil, err
+	}
+	stats = &StorageStats{
+		WrittenBytes: uint64(st.Blocks) * 512,
+		SizeBytes:    uint64(st.Size),
+		LayerCount:   1,
+	}
+	return stats, nil
+}
+
+// GarbageCollect removes the blocks of the orphaned volumes with their
+// snapshots, the blocks still attached to a sandbox are left.
+func (s *RawBlockStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (collected []string, err error) {
+	defer wrapStorageError(&err, s.Type(), "GarbageCollect", "")
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range orphans {
+		// the sidecar goes with its block
+		if isVolumeMeta(name) {
+			continue
+		}
+		if s.removeOrphan(ctx, filepath.Join(dir, name)) {
+			collected = append(collected, name)
+		}
+	}
+	return collected, nil
+}
+
+func (s *RawBlockStorage) removeOrphan(ctx context.Context, block string) bool {
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if storage.PathInUse(block) {
+		glog.Warningf("orphaned volume %s is still in use, leave it", block)
+		return false
+	}
+	if err := s.unthrottleBlock(ctx, block); err != nil {
+		glog.Errorf("failed to unthrottle orphaned volume %s: %v", block, err)
+		return false
+	}
+	if err := s.closeEncryptedBlock(ctx, block); err != nil {
+		glog.Errorf("failed to close orphaned volume %s: %v", block, err)
+		return false
+	}
+	if err := os.Remove(block); err != nil {
+		glog.Errorf("failed to remove orphaned volume %s: %v", block, err)
+		return false
+	}
+	os.Remove(volumeMetaPath(block))
+	os.RemoveAll(filepath.Join(filepath.Dir(block), ".snapshots", filepath.Base(block)))
+	return true
+}
+
 type VBoxStorage struct {
+	storageEvents
+	volumeRefs
 	rootPath string
 }
 
-func VBoxStorageFactory(_ *dockertypes.Info, _ *daemondb.DaemonDB) (Storage, error) {
+func VBoxStorageFactory(_ *dockertypes.Info, _ *daemondb.DaemonDB, _ *StorageConfig) (Storage, error) {
 	driver := &VBoxStorage{
 		rootPath: filepath.Join(utils.HYPER_ROOT, "vbox"),
 	}
@@ -576,11 +2412,28 @@ func (v *VBoxStorage) RootPath() string {
 	return v.rootPath
 }
 
-func (*VBoxStorage) Init() error { return nil }
+func (*VBoxStorage) Init(ctx context.Context) error { return nil }
+
+func (*VBoxStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (*VBoxStorage) HealthCheck(ctx context.Context) error { return nil }
+
+func (*VBoxStorage) WaitReady(ctx context.Context) error { return nil }
 
-func (*VBoxStorage) CleanUp() error { return nil }
+func (*VBoxStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots: true,
+		SupportsClone:     true,
+	}
+}
+
+func (*VBoxStorage) KernelCapabilities() []string {
+	return nil
+}
 
-func (v *VBoxStorage) PrepareContainer(mountId, sharedDir string, readonly bool) (*runv.VolumeDescription, error) {
+func (v *VBoxStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer v.emit(ContainerPrepared, "", mountId, &err)
+	defer v.takeVolumes(mountId, opts, &err)
 	devFullName, err := vbox.MountContainerToSharedDir(mountId, v.RootPath(), "")
 	if err != nil {
 		glog.Error("got error when mount container to share dir ", err.Error())
@@ -592,22 +2445,33 @@ func (v *VBoxStorage) PrepareContainer(mountId, sharedDir string, readonly bool)
 		Source:   devFullName,
 		Fstype:   "ext4",
 		Format:   "vdi",
-		ReadOnly: readonly,
+		ReadOnly: opts.ReadOnly,
 	}
 
 	return vol, nil
 }
 
-func (v *VBoxStorage) CleanupContainer(id, sharedDir string) error {
+func (v *VBoxStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer v.emit(ContainerCleanedUp, "", id, &err)
+	defer v.releaseVolumes(id, &err)
 	return nil
 }
 
-func (v *VBoxStorage) InjectFile(src io.Reader, containerId, target, rootDir string, perm, uid, gid int) error {
+func (v *VBoxStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, rootDir string, perm, uid, gid int, xattrs map[string][]byte) error {
 	return errors.New("vbox storage driver does not support file insert yet")
 }
 
-func (v *VBoxStorage) CreateVolume(podId string, spec *apitypes.UserVolume) error {
-	volName, err := storage.CreateVFSVolume(podId, spec.Name)
+func (v *VBoxStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, rootDir string, uid, gid int) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+func (v *VBoxStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer v.emit(VolumeCreated, podId, spec.Name, &err)
+	volName, err := storage.CreateVFSVolume(storage.VFSVolumeRoot, podId, spec.Name)
 	if err != nil {
 		return err
 	}
@@ -617,6 +2481,115 @@ func (v *VBoxStorage) CreateVolume(podId string, spec *apitypes.UserVolume) erro
 	return nil
 }
 
-func (v *VBoxStorage) RemoveVolume(podId string, record []byte) error {
+func (v *VBoxStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer v.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if v.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
 	return nil
 }
+
+func (v *VBoxStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	return listVFSVolumes(storage.VFSVolumeRoot, podId)
+}
+
+func (v *VBoxStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (v *VBoxStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(storage.VFSVolumePath(storage.VFSVolumeRoot, podId, volName))
+}
+
+func (v *VBoxStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (v *VBoxStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return snapshotVFSVolume(storage.VFSVolumeRoot, podId, volName, snapshot)
+}
+
+func (v *VBoxStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return rollbackVFSVolume(storage.VFSVolumeRoot, podId, volName, snapshot)
+}
+
+func (v *VBoxStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	_, err := storage.CloneVFSVolume(storage.VFSVolumeRoot, srcPodId, srcVolName, dstPodId, dstVolName)
+	return err
+}
+
+func (v *VBoxStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return exportVFSVolume(ctx, storage.VFSVolumeRoot, podId, volName, dst)
+}
+
+func (v *VBoxStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return importVFSVolume(ctx, storage.VFSVolumeRoot, podId, volName, src)
+}
+
+func (v *VBoxStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (v *VBoxStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (v *VBoxStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (v *VBoxStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (v *VBoxStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (v *VBoxStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	return collectVFSVolumes(storage.VFSVolumeRoot, activePodIDs)
+}
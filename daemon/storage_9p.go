@@ -0,0 +1,325 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// ninePTagSize is the longest mount tag of virtio-9p.
+const ninePTagSize = 31
+
+// VirtIO9pStorage exports host directories to the guest over virtio-9p, each
+// one under a mount tag of its own: the rootfs of a container is bind mounted
+// on <root>/exports/<tag>, which the hypervisor exports as the tag, and the
+// volumes are plain host directories exported as they are. The guest works
+// right in the directories of the host, e.g. the working tree of a developer.
+type VirtIO9pStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+}
+
+func VirtIO9pFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	return &VirtIO9pStorage{
+		db:       db,
+		rootPath: config.DriverRoot("9p"),
+	}, nil
+}
+
+func (s *VirtIO9pStorage) Type() string {
+	return "9p"
+}
+
+func (s *VirtIO9pStorage) RootPath() string {
+	return s.rootPath
+}
+
+// ninePTag is the mount tag of the rootfs of the container.
+func ninePTag(mountId string) string {
+	tag := "hyper-" + mountId
+	if len(tag) > ninePTagSize {
+		tag = tag[:ninePTagSize]
+	}
+	return tag
+}
+
+func (s *VirtIO9pStorage) exportPath(tag string) string {
+	return filepath.Join(s.RootPath(), "exports", tag)
+}
+
+func (s *VirtIO9pStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+func (s *VirtIO9pStorage) Init(ctx context.Context) error {
+	for _, dir := range []string{"exports", "volumes"} {
+		if err := ensureDir(filepath.Join(s.RootPath(), dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanUp leaves the exports mounted, the sandboxes of a restarted hyperd are
+// still using them.
+func (*VirtIO9pStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (s *VirtIO9pStorage) HealthCheck(ctx context.Context) error {
+	return checkWritable(filepath.Join(s.RootPath(), "exports"))
+}
+
+func (s *VirtIO9pStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *VirtIO9pStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{}
+}
+
+func (s *VirtIO9pStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// PrepareContainer bind mounts the rootfs of the container on the export of
+// its tag, the description has the tag as Name and the export as Source. The
+// export of a container prepared already is kept.
+func (s *VirtIO9pStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	defer wrapStorageError(&err, s.Type(), "PrepareContainer", mountId)
+	rootfs := filepath.Join(sharedDir, mountId, "rootfs")
+	if err := ensureDir(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	tag := ninePTag(mountId)
+	export := s.exportPath(tag)
+	if err := ensureDir(export, 0755); err != nil {
+		return nil, err
+	}
+	if mounted, err := mount.Mounted(export); err != nil {
+		return nil, err
+	} else if !mounted {
+		if err := syscall.Mount(rootfs, export, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return nil, fmt.Errorf("failed to mount %s to %s: %v", rootfs, export, err)
+		}
+		if opts.ReadOnly {
+			if err := syscall.Mount(rootfs, export, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+				syscall.Unmount(export, syscall.MNT_DETACH)
+				return nil, fmt.Errorf("failed to mount %s to %s readonly: %v", rootfs, export, err)
+			}
+		}
+	}
+
+	return &runv.VolumeDescription{
+		Name:     tag,
+		Source:   export,
+		Fstype:   "9p",
+		Format:   "9p",
+		ReadOnly: opts.ReadOnly,
+	}, nil
+}
+
+// CleanupContainer unmounts the export of the container, releasing its tag.
+func (s *VirtIO9pStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	defer wrapStorageError(&err, s.Type(), "CleanupContainer", id)
+	export := s.exportPath(ninePTag(id))
+	if err := syscall.Unmount(export, 0); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		return fmt.Errorf("failed to unmount %s: %v", export, err)
+	}
+	if err := os.Remove(export); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *VirtIO9pStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *VirtIO9pStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *VirtIO9pStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume makes the host directory of the volume, exported as it is.
+func (s *VirtIO9pStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	defer wrapStorageError(&err, s.Type(), "CreateVolume", volumeID(podId, spec.Name))
+	dir := s.volumePath(podId, spec.Name)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	spec.Source = dir
+	spec.Format = "9p"
+	spec.Fstype = "9p"
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+func (s *VirtIO9pStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	dir := s.volumePath(podId, name)
+	if storage.PathInUse(dir) {
+		return ErrVolumeInUse
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *VirtIO9pStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "9p",
+			Fstype: "9p",
+		})
+	}
+	return vols, nil
+}
+
+func (s *VirtIO9pStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.volumePath(podId, volName))
+}
+
+func (s *VirtIO9pStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *VirtIO9pStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *VirtIO9pStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtIO9pStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect removes the directories of the volumes of the pods which
+// are not active, but those still in use.
+func (s *VirtIO9pStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		if storage.PathInUse(filepath.Join(dir, name)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return collected, err
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
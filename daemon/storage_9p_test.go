@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestVirtIO9pStorage(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the exports are bind mounts, which need root")
+	}
+	root, err := ioutil.TempDir("", "9p-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &VirtIO9pStorage{rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mountId := strings.Repeat("0123456789abcdef", 4)
+	sharedDir := filepath.Join(root, "shared")
+	if err := os.MkdirAll(filepath.Join(sharedDir, mountId, "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sharedDir, mountId, "rootfs", "hello"), []byte("world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := s.PrepareContainer(ctx, mountId, sharedDir, storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	if len(vol.Name) > ninePTagSize || vol.Format != "9p" || vol.Source != s.exportPath(vol.Name) || !vol.ReadOnly {
+		t.Fatalf("unexpected volume description %+v", vol)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(vol.Source, "hello")); string(data) != "world" {
+		t.Fatalf("the rootfs should be exported on %s, got %q", vol.Source, data)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vol.Source, "x"), nil, 0644); err == nil {
+		t.Fatal("the export of a readonly container should be readonly")
+	}
+	// preparing again keeps the export
+	if _, err := s.PrepareContainer(ctx, mountId, sharedDir, storage.ContainerOptions{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanupContainer(ctx, mountId, sharedDir); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+	if mounted, _ := mount.Mounted(vol.Source); mounted {
+		t.Fatal("the export should be unmounted")
+	}
+	if exists, _ := pathExists(vol.Source); exists {
+		t.Fatal("the tag should be released")
+	}
+	if err := s.CleanupContainer(ctx, mountId, sharedDir); err != nil {
+		t.Fatalf("cleaning up twice should succeed: %v", err)
+	}
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "src"}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if fi, err := os.Stat(spec.Source); err != nil || !fi.IsDir() || spec.Format != "9p" {
+		t.Fatalf("the volume should be a host directory exported over 9p, got %+v, %v", spec, err)
+	}
+	if vols, err := s.ListVolumes(ctx, podId); err != nil || len(vols) != 1 || vols[0].Source != spec.Source {
+		t.Fatalf("unexpected volumes %v, %v", vols, err)
+	}
+	if err := s.RemoveVolume(ctx, podId, []byte("src")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "src"); exists {
+		t.Fatal("the volume should be removed")
+	}
+}
@@ -0,0 +1,133 @@
+package daemon
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// asyncInit is one run of the Init of the driver in the background, err is
+// set before done is closed.
+type asyncInit struct {
+	done chan struct{}
+	err  error
+}
+
+// AsyncInitStorage runs the Init of the wrapped Storage in the background, so
+// that hyperd does not wait on e.g. the rbd driver reaching its cluster to
+// start serving. The health of the driver is checked once it is initialized,
+// and both make it ready or failed. PrepareContainer and CreateVolume wait
+// for the driver to be ready, the other operations go to the driver as they
+// are.
+type AsyncInitStorage struct {
+	Storage
+
+	lock sync.Mutex
+	init *asyncInit
+}
+
+func NewAsyncInitStorage(inner Storage) *AsyncInitStorage {
+	return &AsyncInitStorage{Storage: inner}
+}
+
+// Init starts the initialization of the wrapped Storage and returns at once,
+// WaitReady returns its error. It runs on a context of its own, ctx is done
+// long before a slow driver is ready.
+func (a *AsyncInitStorage) Init(ctx context.Context) error {
+	init := &asyncInit{done: make(chan struct{})}
+	a.lock.Lock()
+	a.init = init
+	a.lock.Unlock()
+	go func() {
+		defer close(init.done)
+		ctx := context.Background()
+		if init.err = a.Storage.Init(ctx); init.err != nil {
+			return
+		}
+		if init.err = a.Storage.HealthCheck(ctx); init.err != nil {
+			a.Storage.CleanUp(ctx)
+		}
+	}()
+	return nil
+}
+
+// WaitReady waits for the initialization started by Init, then for the
+// wrapped Storage.
+func (a *AsyncInitStorage) WaitReady(ctx context.Context) error {
+	a.lock.Lock()
+	init := a.init
+	a.lock.Unlock()
+	if init != nil {
+		select {
+		case <-init.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if init.err != nil {
+			return init.err
+		}
+	}
+	return a.Storage.WaitReady(ctx)
+}
+
+// CleanUp waits for the initialization to be over, not to clean up the
+// driver while it is being initialized.
+func (a *AsyncInitStorage) CleanUp(ctx context.Context) error {
+	a.WaitReady(ctx)
+	return a.Storage.CleanUp(ctx)
+}
+
+// HealthCheck reports a driver still being initialized as healthy, the
+// MonitoredStorage above would initialize it again otherwise. A driver which
+// failed to initialize is not.
+func (a *AsyncInitStorage) HealthCheck(ctx context.Context) error {
+	a.lock.Lock()
+	init := a.init
+	a.lock.Unlock()
+	if init != nil {
+		select {
+		case <-init.done:
+			if init.err != nil {
+				return init.err
+			}
+		default:
+			return nil
+		}
+	}
+	return a.Storage.HealthCheck(ctx)
+}
+
+func (a *AsyncInitStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	if err := a.WaitReady(ctx); err != nil {
+		return nil, err
+	}
+	return a.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (a *AsyncInitStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	if err := a.WaitReady(ctx); err != nil {
+		return err
+	}
+	return a.Storage.CreateVolume(ctx, podId, spec)
+}
+
+func (a *AsyncInitStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	if err := a.WaitReady(ctx); err != nil {
+		return nil, err
+	}
+	return a.Storage.HotPlugVolume(ctx, podId, spec)
+}
+
+// logStorageReady waits for the driver initialized in the background, and
+// logs whether it got ready.
+func logStorageReady(s Storage) {
+	if err := s.WaitReady(context.Background()); err != nil {
+		glog.Errorf("storage driver %s failed to initialize: %v", s.Type(), err)
+		return
+	}
+	glog.Infof("storage driver %s is ready", s.Type())
+}
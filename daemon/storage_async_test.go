@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// slowInitStorage is a MockStorage whose Init blocks until released.
+type slowInitStorage struct {
+	*MockStorage
+	release chan error
+}
+
+func (s *slowInitStorage) Init(ctx context.Context) error {
+	s.MockStorage.Init(ctx)
+	return <-s.release
+}
+
+func TestAsyncDriverInit(t *testing.T) {
+	mock := &slowInitStorage{MockStorage: NewMockStorage(), release: make(chan error, 1)}
+	RegisterDriver("test-async", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return mock, nil
+	})
+	defer unregisterDriver("test-async")
+	s, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "test-async"}, nil, &StorageConfig{AsyncDriverInit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("the driver should not be ready before its Init returned, got %v", err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{}); err != context.DeadlineExceeded {
+		t.Fatalf("PrepareContainer should wait for the driver, got %v", err)
+	}
+	if len(mock.Calls("PrepareContainer")) != 0 {
+		t.Fatal("the driver should not prepare a container before it is ready")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.CreateVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "vol"})
+	}()
+	mock.release <- nil
+	if err := <-done; err != nil {
+		t.Fatalf("CreateVolume should go through once the driver is ready, got %v", err)
+	}
+	if err := s.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.Calls("HealthCheck")) == 0 {
+		t.Fatal("the health of the driver should be checked once it is initialized")
+	}
+}
+
+func TestAsyncDriverInitFailure(t *testing.T) {
+	mock := &slowInitStorage{MockStorage: NewMockStorage(), release: make(chan error, 1)}
+	s := NewAsyncInitStorage(mock)
+	ctx := context.Background()
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HealthCheck(ctx); err != nil {
+		t.Fatalf("a driver being initialized should be healthy, got %v", err)
+	}
+
+	failure := errors.New("cluster unreachable")
+	mock.release <- failure
+	if err := s.WaitReady(ctx); err != failure {
+		t.Fatalf("WaitReady should return the error of Init, got %v", err)
+	}
+	if err := s.CreateVolume(ctx, "pod", &apitypes.UserVolume{Name: "vol"}); err != failure {
+		t.Fatalf("CreateVolume should fail on a failed driver, got %v", err)
+	}
+	if err := s.HealthCheck(ctx); err != failure {
+		t.Fatalf("a failed driver should not be healthy, got %v", err)
+	}
+
+	// initializing the driver again retries
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mock.release <- nil
+	if err := s.WaitReady(ctx); err != nil {
+		t.Fatalf("the driver should be ready once initialized again, got %v", err)
+	}
+}
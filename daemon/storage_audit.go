@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// AuditEntry records an operation on a volume or on the rootfs of a
+// container, whose id is then the VolumeName.
+type AuditEntry struct {
+	Timestamp  time.Time
+	Operation  string
+	Driver     string
+	PodID      string `json:",omitempty"`
+	VolumeName string
+	// ActorUID is the uid the operation was requested by, the one of the
+	// daemon unless given with WithAuditActor.
+	ActorUID int
+	Error    string `json:",omitempty"`
+}
+
+// AuditLog keeps the entries of an AuditedStorage.
+type AuditLog interface {
+	Append(entry AuditEntry) error
+}
+
+// FileAuditLog appends the entries to a file as JSON lines, each entry is
+// synced to the disk before Append returns.
+type FileAuditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditLog opens the log at path, the entries are appended to the ones
+// already in it.
+func NewFileAuditLog(path string) (*FileAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditLog{file: f}, nil
+}
+
+func (l *FileAuditLog) Append(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *FileAuditLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
+
+type auditActorKey struct{}
+
+// WithAuditActor makes the operations run with ctx audited as requested by
+// uid.
+func WithAuditActor(ctx context.Context, uid int) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, uid)
+}
+
+func auditActor(ctx context.Context) int {
+	if uid, ok := ctx.Value(auditActorKey{}).(int); ok {
+		return uid
+	}
+	return os.Getuid()
+}
+
+// appendAudit appends the entry of the operation to log. An entry which can
+// not be appended is logged, the operation is done by then.
+func appendAudit(log AuditLog, ctx context.Context, operation, driver, podId, volName string, err error) {
+	entry := AuditEntry{
+		Timestamp:  time.Now(),
+		Operation:  operation,
+		Driver:     driver,
+		PodID:      podId,
+		VolumeName: volName,
+		ActorUID:   auditActor(ctx),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if aerr := log.Append(entry); aerr != nil {
+		glog.Errorf("failed to audit %s of %s on storage %s: %v", operation, volumeID(podId, volName), driver, aerr)
+	}
+}
+
+// AuditedStorage appends the operations of the wrapped Storage changing the
+// volumes or the containers to an AuditLog, whether they succeeded or not.
+// The volumes removed as they expire are audited by the ExpiringStorage, which
+// the AuditedStorage wraps.
+type AuditedStorage struct {
+	Storage
+	log AuditLog
+}
+
+func NewAuditedStorage(s Storage, log AuditLog) *AuditedStorage {
+	return &AuditedStorage{
+		Storage: s,
+		log:     log,
+	}
+}
+
+// audit takes the named result of the caller, so it sees the returned error
+// once run deferred.
+func (a *AuditedStorage) audit(ctx context.Context, operation, podId, volName string, err *error) {
+	appendAudit(a.log, ctx, operation, a.Type(), podId, volName, *err)
+}
+
+func (a *AuditedStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer a.audit(ctx, "PrepareContainer", "", mountId, &err)
+	return a.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (a *AuditedStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer a.audit(ctx, "CleanupContainer", "", id, &err)
+	return a.Storage.CleanupContainer(ctx, id, sharedDir)
+}
+
+func (a *AuditedStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) (err error) {
+	defer a.audit(ctx, "InjectFile", "", containerId, &err)
+	return a.Storage.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (a *AuditedStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) (err error) {
+	defer a.audit(ctx, "InjectDir", "", containerId, &err)
+	return a.Storage.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+}
+
+func (a *AuditedStorage) CompactContainerLayer(ctx context.Context, mountId string) (err error) {
+	defer a.audit(ctx, "CompactContainerLayer", "", mountId, &err)
+	return a.Storage.CompactContainerLayer(ctx, mountId)
+}
+
+func (a *AuditedStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer a.audit(ctx, "CreateVolume", podId, spec.Name, &err)
+	return a.Storage.CreateVolume(ctx, podId, spec)
+}
+
+func (a *AuditedStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer a.audit(ctx, "RemoveVolume", podId, parseVolumeRecord(record).Name, &err)
+	return a.Storage.RemoveVolume(ctx, podId, record)
+}
+
+func (a *AuditedStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) (err error) {
+	defer a.audit(ctx, "ResizeVolume", podId, volName, &err)
+	return a.Storage.ResizeVolume(ctx, podId, volName, newSizeBytes)
+}
+
+func (a *AuditedStorage) DefragVolume(ctx context.Context, podId, volName string) (err error) {
+	defer a.audit(ctx, "DefragVolume", podId, volName, &err)
+	return a.Storage.DefragVolume(ctx, podId, volName)
+}
+
+func (a *AuditedStorage) SetVolumeLabels(podId, volName string, labels map[string]string) (err error) {
+	defer a.audit(context.Background(), "SetVolumeLabels", podId, volName, &err)
+	return a.Storage.SetVolumeLabels(podId, volName, labels)
+}
+
+func (a *AuditedStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer a.audit(ctx, "SnapshotVolume", podId, volName, &err)
+	return a.Storage.SnapshotVolume(ctx, podId, volName, snapshot)
+}
+
+func (a *AuditedStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer a.audit(ctx, "RollbackVolume", podId, volName, &err)
+	return a.Storage.RollbackVolume(ctx, podId, volName, snapshot)
+}
+
+// CloneVolume is audited on the destination volume, the one it creates.
+func (a *AuditedStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) (err error) {
+	defer a.audit(ctx, "CloneVolume", dstPodId, dstVolName, &err)
+	return a.Storage.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+}
+
+func (a *AuditedStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer a.audit(ctx, "ImportVolume", podId, volName, &err)
+	return a.Storage.ImportVolume(ctx, podId, volName, src)
+}
+
+func (a *AuditedStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer a.audit(ctx, "ImportIncrementalVolume", podId, volName, &err)
+	return a.Storage.ImportIncrementalVolume(ctx, podId, volName, src)
+}
+
+func (a *AuditedStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (_ *runv.VolumeDescription, err error) {
+	defer a.audit(ctx, "HotPlugVolume", podId, spec.Name, &err)
+	return a.Storage.HotPlugVolume(ctx, podId, spec)
+}
+
+func (a *AuditedStorage) HotUnplugVolume(ctx context.Context, podId, volName string) (err error) {
+	defer a.audit(ctx, "HotUnplugVolume", podId, volName, &err)
+	return a.Storage.HotUnplugVolume(ctx, podId, volName)
+}
+
+// GarbageCollect audits each collected volume or container, as named by the
+// driver, and the error of the collection if any.
+func (a *AuditedStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	collected, err := a.Storage.GarbageCollect(ctx, activePodIDs)
+	for _, id := range collected {
+		appendAudit(a.log, ctx, "GarbageCollect", a.Type(), "", id, nil)
+	}
+	if err != nil {
+		appendAudit(a.log, ctx, "GarbageCollect", a.Type(), "", "", err)
+	}
+	return collected, err
+}
@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestAuditedStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "audit.log")
+	log, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	mock := NewMockStorage()
+	s := NewAuditedStorage(mock, log)
+	ctx := WithAuditActor(context.Background(), 1000)
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanupContainer(context.Background(), "c1", "/shared"); err != nil {
+		t.Fatal(err)
+	}
+	mock.SetError("RemoveVolume", errors.New("device busy"))
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err == nil {
+		t.Fatal("the error of the driver should be returned")
+	}
+	// the volumes are not audited on the other operations
+	if _, err := s.ListVolumes(ctx, podId); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	expected := []AuditEntry{
+		{Operation: "CreateVolume", Driver: "mock", PodID: podId, VolumeName: "vol1", ActorUID: 1000},
+		{Operation: "PrepareContainer", Driver: "mock", VolumeName: "c1", ActorUID: os.Getuid()},
+		{Operation: "CleanupContainer", Driver: "mock", VolumeName: "c1", ActorUID: os.Getuid()},
+		{Operation: "RemoveVolume", Driver: "mock", PodID: podId, VolumeName: "vol1", ActorUID: 1000, Error: "device busy"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.Timestamp.IsZero() {
+			t.Fatalf("entry %d has no timestamp", i)
+		}
+		entry.Timestamp = expected[i].Timestamp
+		if entry != expected[i] {
+			t.Fatalf("expected entry %v, got %v", expected[i], entry)
+		}
+	}
+}
+
+// memoryAuditLog keeps the entries in memory.
+type memoryAuditLog struct {
+	sync.Mutex
+	entries []AuditEntry
+}
+
+func (l *memoryAuditLog) Append(entry AuditEntry) error {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// operations returns the operations of the entries, as op:pod/volume.
+func (l *memoryAuditLog) operations() []string {
+	l.Lock()
+	defer l.Unlock()
+	var ops []string
+	for _, entry := range l.entries {
+		ops = append(ops, entry.Operation+":"+volumeID(entry.PodID, entry.VolumeName))
+	}
+	return ops
+}
+
+func TestAuditedStorageMutations(t *testing.T) {
+	log := &memoryAuditLog{}
+	mock := NewMockStorage()
+	s := NewAuditedStorage(mock, log)
+	ctx := context.Background()
+
+	if err := s.CreateVolume(ctx, "pod", &apitypes.UserVolume{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, op := range map[string]func() error{
+		"ResizeVolume":            func() error { return s.ResizeVolume(ctx, "pod", "vol1", 1<<30) },
+		"DefragVolume":            func() error { return s.DefragVolume(ctx, "pod", "vol1") },
+		"SetVolumeLabels":         func() error { return s.SetVolumeLabels("pod", "vol1", map[string]string{"a": "b"}) },
+		"SnapshotVolume":          func() error { return s.SnapshotVolume(ctx, "pod", "vol1", "snap1") },
+		"RollbackVolume":          func() error { return s.RollbackVolume(ctx, "pod", "vol1", "snap1") },
+		"CloneVolume":             func() error { return s.CloneVolume(ctx, "pod", "vol1", "pod2", "vol2") },
+		"ImportVolume":            func() error { return s.ImportVolume(ctx, "pod", "vol1", bytes.NewReader(nil)) },
+		"ImportIncrementalVolume": func() error { return s.ImportIncrementalVolume(ctx, "pod", "vol1", bytes.NewReader(nil)) },
+	} {
+		before := len(log.operations())
+		op()
+		ops := log.operations()
+		if len(ops) != before+1 || !strings.HasPrefix(ops[before], name+":") {
+			t.Fatalf("%s should be audited, got %v", name, ops[before:])
+		}
+	}
+	if ops := log.operations(); ops[len(ops)-1] == "CloneVolume:pod/vol1" {
+		t.Fatal("the clone should be audited on its destination")
+	}
+
+	// every collected volume is audited
+	collected, err := s.GarbageCollect(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := log.operations()
+	if len(collected) == 0 || len(ops) < len(collected) {
+		t.Fatalf("expected the collected volumes audited, got %v for %v", ops, collected)
+	}
+	for i, id := range collected {
+		if ops[len(ops)-len(collected)+i] != "GarbageCollect:"+volumeID("", id) {
+			t.Fatalf("expected the collection of %s audited, got %v", id, ops)
+		}
+	}
+	mock.SetError("GarbageCollect", errors.New("failed"))
+	if _, err := s.GarbageCollect(ctx, nil); err == nil {
+		t.Fatal("the error of the driver should be returned")
+	}
+	if entry := log.entries[len(log.entries)-1]; entry.Operation != "GarbageCollect" || entry.Error != "failed" {
+		t.Fatalf("expected the failed collection audited, got %v", entry)
+	}
+}
@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// bandwidthLimiter is a token bucket of bytes, shared by all the readers it
+// throttles. The bucket holds a second of bandwidth, and a reader may take
+// more than the bucket holds: the readers after it wait for the debt to be
+// paid back.
+type bandwidthLimiter struct {
+	lock   sync.Mutex
+	limit  int64 // bytes per second, 0 when unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (l *bandwidthLimiter) setLimit(bytesPerSec int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.limit = bytesPerSec
+	if l.tokens > float64(bytesPerSec) {
+		l.tokens = float64(bytesPerSec)
+	}
+}
+
+func (l *bandwidthLimiter) getLimit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// refill adds the tokens of the time elapsed since the last call, up to a
+// second of bandwidth. Called with the lock held.
+func (l *bandwidthLimiter) refill(now time.Time) {
+	if l.limit > 0 && !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+		if l.tokens > float64(l.limit) {
+			l.tokens = float64(l.limit)
+		}
+	}
+	l.last = now
+}
+
+// chunk is the most a reader should read at once, so that a large read does
+// not block the other readers for long.
+func (l *bandwidthLimiter) chunk(n int) int {
+	if limit := l.getLimit(); limit > 0 && int64(n) > limit {
+		return int(limit)
+	}
+	return n
+}
+
+// wait takes n bytes from the bucket, and waits until they are paid for or
+// the context is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.lock.Lock()
+	if l.limit <= 0 {
+		l.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+	l.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+	record  func(n int)
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:r.limiter.chunk(len(p))])
+	if n > 0 {
+		r.record(n)
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// ThrottledStorage limits the bandwidth of the files injected into the
+// containers by the wrapped Storage, so that a large InjectFile does not
+// starve the I/O of the running containers. The limit is shared by all the
+// InjectFile calls, and may be changed while they run.
+type ThrottledStorage struct {
+	Storage
+	limiter *bandwidthLimiter
+	metrics StorageMetrics
+}
+
+// NewThrottledStorage limits the injected files to maxBytesPerSec, no limit
+// when it is 0.
+func NewThrottledStorage(s Storage, maxBytesPerSec int64, metrics StorageMetrics) *ThrottledStorage {
+	if metrics == nil {
+		metrics = NoopStorageMetrics{}
+	}
+	t := &ThrottledStorage{
+		Storage: s,
+		limiter: &bandwidthLimiter{},
+		metrics: metrics,
+	}
+	t.SetMaxBytesPerSec(maxBytesPerSec)
+	return t
+}
+
+// MaxBytesPerSec returns the limit of the bandwidth, 0 when unlimited.
+func (t *ThrottledStorage) MaxBytesPerSec() int64 {
+	return t.limiter.getLimit()
+}
+
+// SetMaxBytesPerSec changes the limit of the bandwidth, the running
+// injections are throttled to the new limit from their next read.
+func (t *ThrottledStorage) SetMaxBytesPerSec(maxBytesPerSec int64) {
+	if maxBytesPerSec < 0 {
+		maxBytesPerSec = 0
+	}
+	t.limiter.setLimit(maxBytesPerSec)
+	t.metrics.RecordInjectBandwidth(t.Type(), maxBytesPerSec, 0)
+}
+
+func (t *ThrottledStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	src = &throttledReader{
+		ctx:     ctx,
+		r:       src,
+		limiter: t.limiter,
+		record: func(n int) {
+			t.metrics.RecordInjectBandwidth(t.Type(), t.limiter.getLimit(), int64(n))
+		},
+	}
+	return t.Storage.InjectFile(ctx, src, mountId, target, baseDir, perm, uid, gid, xattrs)
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// readingStorage is a MockStorage which reads the injected files.
+type readingStorage struct {
+	*MockStorage
+}
+
+func (s *readingStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if _, err := io.Copy(ioutil.Discard, src); err != nil {
+		return err
+	}
+	return s.MockStorage.InjectFile(ctx, src, mountId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+type fakeBandwidthMetrics struct {
+	NoopStorageMetrics
+	sync.Mutex
+	limit, injected int64
+}
+
+func (m *fakeBandwidthMetrics) RecordInjectBandwidth(driver string, limitBytesPerSec, injectedBytes int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.limit = limitBytesPerSec
+	m.injected += injectedBytes
+}
+
+func TestThrottledStorage(t *testing.T) {
+	metrics := &fakeBandwidthMetrics{}
+	s := NewThrottledStorage(&readingStorage{NewMockStorage()}, 200<<10, metrics)
+	inject := func(size int) <-chan error {
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				errs <- s.InjectFile(context.Background(), bytes.NewReader(make([]byte, size)), "c", "/file", "/shared", 0644, 0, 0, nil)
+			}()
+		}
+		return errs
+	}
+
+	// the limit is shared by the concurrent injections
+	start := time.Now()
+	errs := inject(50 << 10)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("100K should take 500ms at 200K/s, took %v", elapsed)
+	}
+	metrics.Lock()
+	if metrics.limit != 200<<10 || metrics.injected != 100<<10 {
+		t.Fatalf("expected the limit of 200K/s and 100K injected, got %d and %d", metrics.limit, metrics.injected)
+	}
+	metrics.Unlock()
+
+	// the limit is lifted without recreating the storage
+	s.SetMaxBytesPerSec(0)
+	if s.MaxBytesPerSec() != 0 {
+		t.Fatalf("the limit should be lifted, got %d", s.MaxBytesPerSec())
+	}
+	start = time.Now()
+	errs = inject(1 << 20)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("the unlimited injections should not wait, took %v", elapsed)
+	}
+}
+
+func TestThrottledStorageCancel(t *testing.T) {
+	s := NewThrottledStorage(&readingStorage{NewMockStorage()}, 1<<10, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := s.InjectFile(ctx, bytes.NewReader(make([]byte, 1<<20)), "c", "/file", "/shared", 0644, 0, 0, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("the throttled injection should give up at its deadline, got %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// ErrCircuitOpen is returned by the operations of a CircuitBreakerStorage
+// while its circuit is open, without calling the driver.
+var ErrCircuitOpen = errors.New("storage circuit breaker is open")
+
+// IsCircuitOpen tells whether an operation was refused by an open circuit
+// breaker.
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, ErrCircuitOpen)
+}
+
+// The states of the circuit of a CircuitBreakerStorage.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// The defaults of CircuitBreakerConfig.
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitWindow           = time.Minute
+	defaultCircuitHalfOpenTimeout  = 30 * time.Second
+)
+
+// CircuitBreakerConfig tells when the circuit of a CircuitBreakerStorage
+// opens and when it is tried again, its zero fields are the defaults.
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of failed operations in a row which
+	// opens the circuit.
+	FailureThreshold int
+	// Window is the time the failures in a row must happen within, a
+	// failure after it counts as the first of a new run.
+	Window time.Duration
+	// HalfOpenTimeout is the time the circuit stays open before one
+	// operation is let through to try the driver again.
+	HalfOpenTimeout time.Duration
+}
+
+// CircuitBreakerStorage stops calling the wrapped Storage once its
+// operations failed FailureThreshold times in a row, so that a broken
+// driver, e.g. out of inodes, fails the callers at once instead of holding
+// them on operations bound to fail. After HalfOpenTimeout a single operation
+// is let through: the circuit closes if it succeeds, and opens again if it
+// fails.
+//
+// The errors of the caller, e.g. a missing volume or one in use, do not
+// count as failures, the driver answered them.
+type CircuitBreakerStorage struct {
+	Storage
+	config  CircuitBreakerConfig
+	metrics StorageMetrics
+
+	lock     sync.Mutex
+	state    string
+	failures int
+	// first is the time of the first of the failures in a row.
+	first time.Time
+	// opened is the time the circuit last opened.
+	opened time.Time
+}
+
+func NewCircuitBreakerStorage(s Storage, config CircuitBreakerConfig, metrics StorageMetrics) *CircuitBreakerStorage {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if config.Window <= 0 {
+		config.Window = defaultCircuitWindow
+	}
+	if config.HalfOpenTimeout <= 0 {
+		config.HalfOpenTimeout = defaultCircuitHalfOpenTimeout
+	}
+	if metrics == nil {
+		metrics = NoopStorageMetrics{}
+	}
+	c := &CircuitBreakerStorage{
+		Storage: s,
+		config:  config,
+		metrics: metrics,
+		state:   CircuitClosed,
+	}
+	metrics.RecordCircuitState(s.Type(), CircuitClosed)
+	return c
+}
+
+// State returns the state of the circuit, one of CircuitClosed, CircuitOpen
+// and CircuitHalfOpen.
+func (c *CircuitBreakerStorage) State() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.state
+}
+
+// setState moves the circuit to state, called with the lock held.
+func (c *CircuitBreakerStorage) setState(state string) {
+	if c.state == state {
+		return
+	}
+	glog.Warningf("circuit breaker of storage %s is %s, was %s", c.Type(), state, c.state)
+	c.state = state
+	c.metrics.RecordCircuitState(c.Type(), state)
+}
+
+// allow tells whether an operation may call the driver, and moves the
+// circuit to half-open for the operation trying the driver again.
+func (c *CircuitBreakerStorage) allow(now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch c.state {
+	case CircuitOpen:
+		if now.Sub(c.opened) < c.config.HalfOpenTimeout {
+			return false
+		}
+		c.setState(CircuitHalfOpen)
+		return true
+	case CircuitHalfOpen:
+		// the trial operation is still running
+		return false
+	}
+	return true
+}
+
+// done records the outcome of an operation allowed to call the driver.
+func (c *CircuitBreakerStorage) done(now time.Time, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == CircuitHalfOpen && errors.Is(err, context.Canceled) {
+		// the trial told nothing, the next operation tries again
+		c.setState(CircuitOpen)
+		return
+	}
+	if !circuitFailure(err) {
+		c.failures = 0
+		c.setState(CircuitClosed)
+		return
+	}
+	if c.state == CircuitHalfOpen {
+		c.opened = now
+		c.setState(CircuitOpen)
+		return
+	}
+	if c.failures == 0 || now.Sub(c.first) > c.config.Window {
+		c.failures, c.first = 0, now
+	}
+	c.failures++
+	if c.failures >= c.config.FailureThreshold {
+		c.opened = now
+		c.setState(CircuitOpen)
+	}
+}
+
+// circuitFailure tells whether the error of an operation tells the driver is
+// failing, rather than the caller asking for something wrong or giving up.
+func circuitFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		IsNotFound(err),
+		IsDeviceBusy(err),
+		IsNotSupported(err),
+		IsReadOnly(err),
+		IsInvalidTransition(err):
+		return false
+	}
+	return true
+}
+
+// call runs op on the driver unless the circuit is open.
+func (c *CircuitBreakerStorage) call(op string, fn func() error) error {
+	if !c.allow(time.Now()) {
+		return fmt.Errorf("%s of storage %s: %w", op, c.Type(), ErrCircuitOpen)
+	}
+	err := fn()
+	c.done(time.Now(), err)
+	return err
+}
+
+func (c *CircuitBreakerStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (vol *runv.VolumeDescription, err error) {
+	err = c.call("PrepareContainer", func() error {
+		vol, err = c.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+		return err
+	})
+	return vol, err
+}
+
+func (c *CircuitBreakerStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return c.call("PrewarmContainer", func() error {
+		return c.Storage.PrewarmContainer(ctx, mountId, sharedDir)
+	})
+}
+
+func (c *CircuitBreakerStorage) CleanupContainer(ctx context.Context, id, sharedDir string) error {
+	return c.call("CleanupContainer", func() error {
+		return c.Storage.CleanupContainer(ctx, id, sharedDir)
+	})
+}
+
+func (c *CircuitBreakerStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return c.call("InjectFile", func() error {
+		return c.Storage.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+	})
+}
+
+func (c *CircuitBreakerStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	return c.call("InjectDir", func() error {
+		return c.Storage.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+	})
+}
+
+func (c *CircuitBreakerStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	return c.call("CreateVolume", func() error {
+		return c.Storage.CreateVolume(ctx, podId, spec)
+	})
+}
+
+func (c *CircuitBreakerStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	return c.call("RemoveVolume", func() error {
+		return c.Storage.RemoveVolume(ctx, podId, record)
+	})
+}
+
+func (c *CircuitBreakerStorage) ListVolumes(ctx context.Context, podId string) (vols []*apitypes.UserVolume, err error) {
+	err = c.call("ListVolumes", func() error {
+		vols, err = c.Storage.ListVolumes(ctx, podId)
+		return err
+	})
+	return vols, err
+}
+
+func (c *CircuitBreakerStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return c.call("ResizeVolume", func() error {
+		return c.Storage.ResizeVolume(ctx, podId, volName, newSizeBytes)
+	})
+}
+
+func (c *CircuitBreakerStorage) VolumeExists(ctx context.Context, podId, volName string) (exists bool, err error) {
+	err = c.call("VolumeExists", func() error {
+		exists, err = c.Storage.VolumeExists(ctx, podId, volName)
+		return err
+	})
+	return exists, err
+}
+
+func (c *CircuitBreakerStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return c.call("DefragVolume", func() error {
+		return c.Storage.DefragVolume(ctx, podId, volName)
+	})
+}
+
+func (c *CircuitBreakerStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return c.call("WarmVolume", func() error {
+		return c.Storage.WarmVolume(ctx, podId, volName)
+	})
+}
+
+func (c *CircuitBreakerStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return c.call("SnapshotVolume", func() error {
+		return c.Storage.SnapshotVolume(ctx, podId, volName, snapshot)
+	})
+}
+
+func (c *CircuitBreakerStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return c.call("RollbackVolume", func() error {
+		return c.Storage.RollbackVolume(ctx, podId, volName, snapshot)
+	})
+}
+
+func (c *CircuitBreakerStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return c.call("FreezeVolume", func() error {
+		return c.Storage.FreezeVolume(ctx, podId, volName)
+	})
+}
+
+func (c *CircuitBreakerStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return c.call("ThawVolume", func() error {
+		return c.Storage.ThawVolume(ctx, podId, volName)
+	})
+}
+
+func (c *CircuitBreakerStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return c.call("CloneVolume", func() error {
+		return c.Storage.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+	})
+}
+
+func (c *CircuitBreakerStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return c.call("ExportVolume", func() error {
+		return c.Storage.ExportVolume(ctx, podId, volName, dst)
+	})
+}
+
+func (c *CircuitBreakerStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return c.call("ImportVolume", func() error {
+		return c.Storage.ImportVolume(ctx, podId, volName, src)
+	})
+}
+
+func (c *CircuitBreakerStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return c.call("ExportIncrementalVolume", func() error {
+		return c.Storage.ExportIncrementalVolume(ctx, podId, volName, sinceSnapshot, dst)
+	})
+}
+
+func (c *CircuitBreakerStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return c.call("ImportIncrementalVolume", func() error {
+		return c.Storage.ImportIncrementalVolume(ctx, podId, volName, src)
+	})
+}
+
+func (c *CircuitBreakerStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (vol *runv.VolumeDescription, err error) {
+	err = c.call("HotPlugVolume", func() error {
+		vol, err = c.Storage.HotPlugVolume(ctx, podId, spec)
+		return err
+	})
+	return vol, err
+}
+
+func (c *CircuitBreakerStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return c.call("HotUnplugVolume", func() error {
+		return c.Storage.HotUnplugVolume(ctx, podId, volName)
+	})
+}
+
+func (c *CircuitBreakerStorage) ContainerStats(ctx context.Context, containerId string) (stats *StorageStats, err error) {
+	err = c.call("ContainerStats", func() error {
+		stats, err = c.Storage.ContainerStats(ctx, containerId)
+		return err
+	})
+	return stats, err
+}
+
+func (c *CircuitBreakerStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return c.call("CompactContainerLayer", func() error {
+		return c.Storage.CompactContainerLayer(ctx, mountId)
+	})
+}
+
+func (c *CircuitBreakerStorage) UsageReport(ctx context.Context) (report *StorageUsageReport, err error) {
+	err = c.call("UsageReport", func() error {
+		report, err = c.Storage.UsageReport(ctx)
+		return err
+	})
+	return report, err
+}
+
+func (c *CircuitBreakerStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (collected []string, err error) {
+	err = c.call("GarbageCollect", func() error {
+		collected, err = c.Storage.GarbageCollect(ctx, activePodIDs)
+		return err
+	})
+	return collected, err
+}
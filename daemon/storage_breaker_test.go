@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+type fakeCircuitMetrics struct {
+	NoopStorageMetrics
+	sync.Mutex
+	states []string
+}
+
+func (m *fakeCircuitMetrics) RecordCircuitState(driver, state string) {
+	m.Lock()
+	defer m.Unlock()
+	m.states = append(m.states, state)
+}
+
+func TestCircuitBreakerStorage(t *testing.T) {
+	mock := NewMockStorage()
+	metrics := &fakeCircuitMetrics{}
+	s := NewCircuitBreakerStorage(mock, CircuitBreakerConfig{
+		FailureThreshold: 3,
+		Window:           time.Minute,
+		HalfOpenTimeout:  50 * time.Millisecond,
+	}, metrics)
+	create := func() error {
+		return s.CreateVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "data"})
+	}
+
+	// the errors of the caller do not count
+	mock.SetError("CreateVolume", os.ErrNotExist)
+	for i := 0; i < 5; i++ {
+		create()
+	}
+	if s.State() != CircuitClosed {
+		t.Fatalf("a missing volume should not open the circuit, got %s", s.State())
+	}
+
+	mock.SetError("CreateVolume", errors.New("input/output error"))
+	for i := 0; i < 3; i++ {
+		if err := create(); err == nil || IsCircuitOpen(err) {
+			t.Fatalf("the failure %d should reach the driver, got %v", i, err)
+		}
+	}
+	if s.State() != CircuitOpen {
+		t.Fatalf("3 failures in a row should open the circuit, got %s", s.State())
+	}
+	calls := len(mock.Calls("CreateVolume"))
+	if err := s.RemoveVolume(context.Background(), "pod", []byte("data")); !IsCircuitOpen(err) {
+		t.Fatalf("the open circuit should refuse every operation, got %v", err)
+	}
+	if err := create(); !IsCircuitOpen(err) {
+		t.Fatalf("the open circuit should refuse the operation, got %v", err)
+	}
+	if len(mock.Calls("CreateVolume")) != calls || len(mock.Calls("RemoveVolume")) != 0 {
+		t.Fatal("the open circuit should not call the driver")
+	}
+
+	// the failed trial opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	if err := create(); err == nil || IsCircuitOpen(err) {
+		t.Fatalf("the trial should reach the driver, got %v", err)
+	}
+	if s.State() != CircuitOpen {
+		t.Fatalf("the failed trial should open the circuit, got %s", s.State())
+	}
+
+	// the successful trial closes it
+	mock.SetError("CreateVolume", nil)
+	time.Sleep(60 * time.Millisecond)
+	if err := create(); err != nil {
+		t.Fatalf("the trial should succeed, got %v", err)
+	}
+	if s.State() != CircuitClosed {
+		t.Fatalf("the successful trial should close the circuit, got %s", s.State())
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	expected := []string{CircuitClosed, CircuitOpen, CircuitHalfOpen, CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(metrics.states) != len(expected) {
+		t.Fatalf("expected the states %v, got %v", expected, metrics.states)
+	}
+	for i := range expected {
+		if metrics.states[i] != expected[i] {
+			t.Fatalf("expected the states %v, got %v", expected, metrics.states)
+		}
+	}
+}
+
+func TestCircuitBreakerStorageWindow(t *testing.T) {
+	mock := NewMockStorage()
+	s := NewCircuitBreakerStorage(mock, CircuitBreakerConfig{
+		FailureThreshold: 2,
+		Window:           20 * time.Millisecond,
+	}, nil)
+	mock.SetError("WarmVolume", errors.New("input/output error"))
+	s.WarmVolume(context.Background(), "pod", "data")
+	time.Sleep(30 * time.Millisecond)
+	s.WarmVolume(context.Background(), "pod", "data")
+	if s.State() != CircuitClosed {
+		t.Fatalf("the failures further apart than the window should not open the circuit, got %s", s.State())
+	}
+	s.WarmVolume(context.Background(), "pod", "data")
+	if s.State() != CircuitOpen {
+		t.Fatalf("2 failures within the window should open the circuit, got %s", s.State())
+	}
+}
@@ -0,0 +1,455 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+type BtrfsStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	rootPath string
+	db       *daemondb.DaemonDB
+}
+
+func BtrfsFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &BtrfsStorage{
+		rootPath: config.DriverRoot("btrfs"),
+		db:       db,
+	}
+	return driver, nil
+}
+
+func (s *BtrfsStorage) Type() string {
+	return "btrfs"
+}
+
+func (s *BtrfsStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *BtrfsStorage) subvolumesDirID(id string) string {
+	return filepath.Join(s.RootPath(), "subvolumes", id)
+}
+
+func (s *BtrfsStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+func (s *BtrfsStorage) Init(ctx context.Context) error {
+	return ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700)
+}
+
+func (*BtrfsStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (s *BtrfsStorage) HealthCheck(ctx context.Context) error {
+	return checkWritable(filepath.Join(s.RootPath(), "volumes"))
+}
+
+func (s *BtrfsStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *BtrfsStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots: true,
+	}
+}
+
+func (s *BtrfsStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// snapshotDirID is the dir of the snapshot taken of the subvolume of the
+// container by PrepareContainer, the snapshot is its rootfs.
+func (s *BtrfsStorage) snapshotDirID(id string) string {
+	return filepath.Join(s.RootPath(), "containers", id)
+}
+
+// injectBaseDir returns the dir the files are injected under, the snapshot
+// of the container once it is prepared, its subvolume before.
+func (s *BtrfsStorage) injectBaseDir(id string) string {
+	if ok, _ := pathExists(filepath.Join(s.snapshotDirID(id), "rootfs")); ok {
+		return filepath.Dir(s.snapshotDirID(id))
+	}
+	return filepath.Dir(s.subvolumesDirID(id))
+}
+
+// PrepareContainer takes a snapshot of the subvolume of the container, which
+// is readonly for a readonly container, and binds it to the shared dir. The
+// snapshot is deleted by CleanupContainer.
+func (s *BtrfsStorage) PrepareContainer(ctx context.Context, containerId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", containerId, &err)
+	defer s.takeVolumes(containerId, opts, &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	btrfsRootfs := s.subvolumesDirID(containerId)
+	snapshot := filepath.Join(s.snapshotDirID(containerId), "rootfs")
+	mountPoint := filepath.Join(sharedDir, containerId, "rootfs")
+
+	exists, err := pathExists(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := ensureDir(s.snapshotDirID(containerId), 0700); err != nil {
+			return nil, err
+		}
+		args := []string{"snapshot"}
+		if opts.ReadOnly {
+			args = append(args, "-r")
+		}
+		if err := btrfsSubvolume(ctx, append(args, btrfsRootfs, snapshot)...); err != nil {
+			os.Remove(s.snapshotDirID(containerId))
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				s.deleteSnapshot(context.Background(), containerId)
+			}
+		}()
+	}
+
+	if _, err := os.Stat(mountPoint); err != nil {
+		if err = os.MkdirAll(mountPoint, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := syscall.Mount(snapshot, mountPoint, "bind", syscall.MS_BIND, ""); err != nil {
+		return nil, fmt.Errorf("failed to mount %s to %s: %v", snapshot, mountPoint, err)
+	}
+	if opts.ReadOnly {
+		if err := syscall.Mount(snapshot, mountPoint, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+			return nil, fmt.Errorf("failed to mount %s to %s readonly: %v", snapshot, mountPoint, err)
+		}
+	}
+
+	containerPath := "/" + containerId
+	vol := &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "btrfs",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+// CleanupContainer unbinds the snapshot of the container and deletes it.
+func (s *BtrfsStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	if err := syscall.Unmount(filepath.Join(sharedDir, id, "rootfs"), 0); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return s.deleteSnapshot(ctx, id)
+}
+
+// deleteSnapshot deletes the snapshot of the container, if it was taken.
+func (s *BtrfsStorage) deleteSnapshot(ctx context.Context, id string) error {
+	snapshot := filepath.Join(s.snapshotDirID(id), "rootfs")
+	exists, err := pathExists(snapshot)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := btrfsSubvolume(ctx, "delete", snapshot); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(s.snapshotDirID(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *BtrfsStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return storage.FsInjectFile(src, mountId, target, s.injectBaseDir(mountId), perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *BtrfsStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return storage.FsInjectDir(src, mountId, targetDir, s.injectBaseDir(mountId), uid, gid, s.verifyChecksum)
+}
+
+func (s *BtrfsStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume creates the volume as a btrfs subvolume, so that it can be
+// snapshotted and removed independently of the container layers.
+func (s *BtrfsStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	volPath := s.volumePath(podId, spec.Name)
+	if _, err := os.Stat(volPath); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if out, err := execCommand(ctx, "btrfs", "subvolume", "create", volPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create btrfs subvolume %s: %v: %s", volPath, err, string(out))
+		}
+	}
+	spec.Source = volPath
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return nil
+}
+
+func (s *BtrfsStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	volPath := s.volumePath(podId, name)
+	if _, err := os.Stat(volPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if storage.PathInUse(volPath) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volPath, podId)
+		return ErrVolumeInUse
+	}
+	if out, err := execCommand(ctx, "btrfs", "subvolume", "delete", volPath).CombinedOutput(); err != nil {
+		err = fmt.Errorf("failed to delete btrfs subvolume %s: %v: %s", volPath, err, string(out))
+		glog.Error(err)
+		return err
+	}
+	if err := s.removeSnapshots(ctx, s.snapshotPath(podId, name, "")); err != nil {
+		glog.Errorf("failed to remove the snapshots of volume %s: %v", volPath, err)
+		return err
+	}
+	return nil
+}
+
+func (s *BtrfsStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "vfs",
+			Fstype: "dir",
+		})
+	}
+	return vols, nil
+}
+
+func (s *BtrfsStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *BtrfsStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.volumePath(podId, volName))
+}
+
+func (s *BtrfsStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *BtrfsStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) snapshotPath(podId, volName, snapshot string) string {
+	return filepath.Join(s.RootPath(), "volumes", ".snapshots", fmt.Sprintf("%s-%s", podId, volName), snapshot)
+}
+
+func btrfsSubvolume(ctx context.Context, args ...string) error {
+	if out, err := execCommand(ctx, "btrfs", append([]string{"subvolume"}, args...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("btrfs subvolume %s failed: %v: %s", strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+// SnapshotVolume takes a readonly snapshot of the volume subvolume.
+func (s *BtrfsStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	volPath := s.volumePath(podId, volName)
+	if _, err := os.Stat(volPath); err != nil {
+		return err
+	}
+	if storage.PathInUse(volPath) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to snapshot it", volPath, podId)
+		return ErrVolumeInUse
+	}
+	snapPath := s.snapshotPath(podId, volName, snapshot)
+	if _, err := os.Stat(snapPath); err == nil {
+		return fmt.Errorf("snapshot %s of volume %s already exists", snapshot, volName)
+	}
+	if err := ensureDir(filepath.Dir(snapPath), 0700); err != nil {
+		return err
+	}
+	return btrfsSubvolume(ctx, "snapshot", "-r", volPath, snapPath)
+}
+
+// RollbackVolume puts a writable snapshot of the snapshot in place of the
+// volume and deletes the former volume subvolume.
+func (s *BtrfsStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	volPath := s.volumePath(podId, volName)
+	snapPath := s.snapshotPath(podId, volName, snapshot)
+	if _, err := os.Stat(snapPath); err != nil {
+		return err
+	}
+	if storage.PathInUse(volPath) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to roll it back", volPath, podId)
+		return ErrVolumeInUse
+	}
+
+	tmp := filepath.Join(filepath.Dir(volPath), "."+filepath.Base(volPath)+".rollback")
+	if err := btrfsSubvolume(ctx, "snapshot", snapPath, tmp); err != nil {
+		return err
+	}
+	old := filepath.Join(filepath.Dir(volPath), "."+filepath.Base(volPath)+".old")
+	if err := os.Rename(volPath, old); err != nil {
+		btrfsSubvolume(ctx, "delete", tmp)
+		return err
+	}
+	if err := os.Rename(tmp, volPath); err != nil {
+		os.Rename(old, volPath)
+		btrfsSubvolume(ctx, "delete", tmp)
+		return err
+	}
+	return btrfsSubvolume(ctx, "delete", old)
+}
+
+func (s *BtrfsStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *BtrfsStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *BtrfsStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *BtrfsStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *BtrfsStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *BtrfsStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		volPath := filepath.Join(dir, name)
+		if storage.PathInUse(volPath) {
+			glog.Warningf("orphaned volume %s is still in use, leave it", volPath)
+			continue
+		}
+		if err := btrfsSubvolume(ctx, "delete", volPath); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", volPath, err)
+			continue
+		}
+		if err := s.removeSnapshots(ctx, filepath.Join(dir, ".snapshots", name)); err != nil {
+			glog.Errorf("failed to remove the snapshots of orphaned volume %s: %v", volPath, err)
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
+
+func (s *BtrfsStorage) removeSnapshots(ctx context.Context, dir string) error {
+	snapshots, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, snap := range snapshots {
+		if err := btrfsSubvolume(ctx, "delete", filepath.Join(dir, snap.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(dir)
+}
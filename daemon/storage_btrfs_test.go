@@ -0,0 +1,196 @@
+package daemon
+
+import (
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestBtrfsVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "btrfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &BtrfsStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := s.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if spec.Source != s.volumePath(podId, "vol1") || spec.Format != "vfs" {
+		t.Fatalf("unexpected volume spec %#v", spec)
+	}
+	if _, err := os.Stat(spec.Source); err != nil {
+		t.Fatalf("subvolume %s is not created: %v", spec.Source, err)
+	}
+
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(spec.Source); !os.IsNotExist(err) {
+		t.Fatalf("subvolume %s still exists after removal: %v", spec.Source, err)
+	}
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("removing a missing volume should succeed, got %v", err)
+	}
+}
+
+func TestBtrfsSnapshotVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "btrfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &BtrfsStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := s.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	testSnapshotRollback(t, s, podId, "vol1", filepath.Join(spec.Source, "data"))
+
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(s.snapshotPath(podId, "vol1", "")); !os.IsNotExist(err) {
+		t.Fatalf("the snapshots should be removed with the volume: %v", err)
+	}
+}
+
+func TestBtrfsPrepareContainer(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "btrfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &BtrfsStorage{rootPath: filepath.Join(root, "btrfs")}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(s.subvolumesDirID("c1"), "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.subvolumesDirID("c1"), "etc/hostname"), []byte("lower"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sharedDir := filepath.Join(root, "shared")
+	vol, err := s.PrepareContainer(context.Background(), "c1", sharedDir, storage.ContainerOptions{})
+	if err != nil {
+		if os.IsPermission(err) || strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("cannot bind mount: %v", err)
+		}
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	if vol.Fstype != "btrfs" || vol.Format != "vfs" || vol.Source != "/c1" {
+		t.Fatalf("unexpected volume description %#v", vol)
+	}
+	snapshot := filepath.Join(s.snapshotDirID("c1"), "rootfs")
+	if data, err := ioutil.ReadFile(filepath.Join(snapshot, "etc/hostname")); err != nil || string(data) != "lower" {
+		t.Fatalf("the container should be prepared from a snapshot of its subvolume, got %q: %v", data, err)
+	}
+
+	// the files are injected in the snapshot, the subvolume is left as is
+	if err := s.InjectFile(context.Background(), strings.NewReader("upper"), "c1", "/etc/hostname", "", 0644, os.Getuid(), os.Getgid(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(sharedDir, "c1/rootfs/etc/hostname")); string(data) != "upper" {
+		t.Fatalf("the injected file should be seen in the shared dir, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(s.subvolumesDirID("c1"), "etc/hostname")); string(data) != "lower" {
+		t.Fatalf("the subvolume should not be written, got %q", data)
+	}
+
+	if err := s.CleanupContainer(context.Background(), "c1", sharedDir); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+	if _, err := os.Stat(s.snapshotDirID("c1")); !os.IsNotExist(err) {
+		t.Fatalf("the snapshot should be deleted by the cleanup: %v", err)
+	}
+	if _, err := os.Stat(s.subvolumesDirID("c1")); err != nil {
+		t.Fatalf("the subvolume should be kept: %v", err)
+	}
+}
+
+func TestBtrfsInjectDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "btrfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &BtrfsStorage{rootPath: root}
+	rootfs := filepath.Join(s.subvolumesDirID("c1"), "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	src := fstest.MapFS{
+		"conf.d/a/b/c/d/app.conf": {Data: []byte("deep"), Mode: 0600},
+		"conf.d/a":                {Mode: fs.ModeDir | 0750},
+		"run.sh":                  {Data: []byte("#!/bin/sh\n"), Mode: 0755},
+	}
+	if err := s.InjectDir(context.Background(), src, "c1", "/etc/app", "", os.Getuid(), os.Getgid()); err != nil {
+		t.Fatalf("inject dir failed: %v", err)
+	}
+	for p, mode := range map[string]os.FileMode{
+		"etc/app/conf.d/a/b/c/d/app.conf": 0600,
+		"etc/app/conf.d/a":                0750 | os.ModeDir,
+		"etc/app/run.sh":                  0755,
+	} {
+		fi, err := os.Stat(filepath.Join(rootfs, p))
+		if err != nil {
+			t.Fatalf("%s is not injected: %v", p, err)
+		}
+		if fi.Mode() != mode {
+			t.Fatalf("expected mode %v of %s, got %v", mode, p, fi.Mode())
+		}
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(rootfs, "etc/app/conf.d/a/b/c/d/app.conf")); string(data) != "deep" {
+		t.Fatalf("unexpected content %q", data)
+	}
+
+	// the walk fails on the link, after the files before it are injected
+	src = fstest.MapFS{
+		"a/b/c/app.conf": {Data: []byte("conf"), Mode: 0644},
+		"z/link":         {Data: []byte("/etc/passwd"), Mode: fs.ModeSymlink | 0777},
+	}
+	if err := s.InjectDir(context.Background(), src, "c1", "/opt/app", "", os.Getuid(), os.Getgid()); err == nil {
+		t.Fatal("injecting a link should fail")
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "opt")); !os.IsNotExist(err) {
+		t.Fatalf("the failed injection is not cleaned up: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/app/run.sh")); err != nil {
+		t.Fatalf("the cleanup removed a file it did not create: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// TestCapabilities checks the drivers refuse the features they report as
+// not supported.
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+	drivers := []Storage{
+		&AufsStorage{}, &OverlayFsStorage{}, &RawBlockStorage{}, &VBoxStorage{},
+		&BtrfsStorage{}, &CSIStorage{}, &DevMapperStorage{}, &GlusterFSStorage{},
+		&ISCSIStorage{}, &LVMStorage{}, &NFSStorage{}, &CephRBDStorage{},
+		&TmpfsStorage{}, &ZFSStorage{},
+	}
+	for _, s := range drivers {
+		caps := s.Capabilities()
+		if !caps.SupportsSnapshots {
+			if err := s.SnapshotVolume(ctx, "pod", "vol", "snap"); !IsNotSupported(err) {
+				t.Errorf("%T should not support snapshots, got %v", s, err)
+			}
+			if err := s.RollbackVolume(ctx, "pod", "vol", "snap"); !IsNotSupported(err) {
+				t.Errorf("%T should not support rollbacks, got %v", s, err)
+			}
+		}
+		if !caps.SupportsResize {
+			if err := s.ResizeVolume(ctx, "pod", "vol", 1<<30); !IsNotSupported(err) {
+				t.Errorf("%T should not support resize, got %v", s, err)
+			}
+		}
+		if !caps.SupportsClone {
+			if err := s.CloneVolume(ctx, "pod", "vol", "pod", "clone"); !IsNotSupported(err) {
+				t.Errorf("%T should not support clones, got %v", s, err)
+			}
+		}
+	}
+}
+
+func TestMigrateEncryptedVolume(t *testing.T) {
+	src, dst := NewMockStorage(), NewMockStorage()
+	dst.SetCapabilities(storage.Capabilities{SupportsQuota: true})
+	if err := src.CreateVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "vol1", Encrypted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateVolume(context.Background(), src, dst, "pod", "vol1"); !IsNotSupported(err) {
+		t.Fatalf("an encrypted volume should not move to a driver without encryption, got %v", err)
+	}
+	if len(dst.Calls("CreateVolume")) != 0 {
+		t.Fatal("no volume should be created")
+	}
+}
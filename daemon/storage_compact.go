@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// CompactContainerLayer rewrites the upper dir of the stopped container from
+// a tarball of itself, which packs the tree the whiteouts and the small
+// writes left fragmented. The overlay still mounted, e.g. after a failed
+// cleanup, is unmounted first. The extended attributes are kept, overlay
+// marks the opaque directories with them.
+func (o *OverlayFsStorage) CompactContainerLayer(ctx context.Context, mountId string) (err error) {
+	defer wrapStorageError(&err, o.Type(), "CompactContainerLayer", mountId)
+	o.locks.Lock(mountId)
+	defer o.locks.Unlock(mountId)
+
+	upper := filepath.Join(o.RootPath(), mountId, "upper")
+	if _, err := os.Stat(upper); err != nil {
+		return err
+	}
+	if o.namespaces.get(mountId) != nil {
+		return fmt.Errorf("the rootfs of container %s is mounted in its mount namespace: %w", mountId, syscall.EBUSY)
+	}
+	for _, mountPoint := range overlayMountPoints(upper) {
+		if err := syscall.Unmount(mountPoint, 0); err != nil {
+			return fmt.Errorf("failed to unmount the rootfs %s of container %s: %w", mountPoint, mountId, err)
+		}
+	}
+	if storage.PathOpened(upper) {
+		return fmt.Errorf("the upper dir of container %s is still held open: %w", mountId, syscall.EBUSY)
+	}
+
+	tarball, err := ioutil.TempFile(filepath.Dir(upper), ".upper-*.tar")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tarball.Close()
+		os.Remove(tarball.Name())
+	}()
+	if err := storage.TarDirWithXattrs(ctx, upper, tarball); err != nil {
+		return fmt.Errorf("failed to archive the upper dir of container %s: %v", mountId, err)
+	}
+	if _, err := tarball.Seek(0, 0); err != nil {
+		return err
+	}
+
+	// the upper dir is only replaced once extracted again in full
+	compacted := filepath.Join(filepath.Dir(upper), ".upper.compact")
+	os.RemoveAll(compacted)
+	if err := os.Mkdir(compacted, 0755); err != nil {
+		return err
+	}
+	if err := storage.UntarDirWithXattrs(ctx, tarball, compacted); err != nil {
+		os.RemoveAll(compacted)
+		return fmt.Errorf("failed to extract the upper dir of container %s: %v", mountId, err)
+	}
+	return storage.ReplacePath(compacted, upper)
+}
+
+// CompactContainerLayer does nothing, the layer of the container is a block
+// whose filesystem only the sandbox mounts.
+func (s *RawBlockStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return nil
+}
+
+// overlayMountPoints returns where the overlays of the upper dir are mounted.
+func overlayMountPoints(upper string) []string {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil
+	}
+	var mountPoints []string
+	for _, m := range mounts {
+		if m.Fstype != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(m.VfsOpts, ",") {
+			if opt == "upperdir="+upper {
+				mountPoints = append(mountPoints, m.Mountpoint)
+			}
+		}
+	}
+	return mountPoints
+}
+
+// CompactContainerLayer compacts the writable layer of a container of a pod
+// which is not alive, its sandbox would keep the layer mounted.
+func (daemon *Daemon) CompactContainerLayer(ctx context.Context, name string) error {
+	p, id, ok := daemon.PodList.GetByContainerIdOrName(name)
+	if !ok {
+		return fmt.Errorf("Can not find container by name(%s)", name)
+	}
+	if p.IsAlive() {
+		return fmt.Errorf("can not compact the layer of container %s of running pod %s: %w", name, p.Id(), ErrVolumeInUse)
+	}
+	mountId, err := pod.GetMountIdByContainer(daemon.Storage.Type(), id)
+	if err != nil {
+		return fmt.Errorf("cannot find the mount of container %s: %v", id, err)
+	}
+	return daemon.Storage.CompactContainerLayer(ctx, mountId)
+}
+
+// autoCompact compacts every interval the writable layers of the containers
+// of the pods which are not alive once they hold more than fileCount files.
+func (daemon *Daemon) autoCompact(fileCount uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		daemon.compactLayers(context.Background(), fileCount)
+	}
+}
+
+// compactLayers compacts the writable layers holding more than fileCount
+// files, and returns the containers compacted.
+func (daemon *Daemon) compactLayers(ctx context.Context, fileCount uint64) []string {
+	var containers []string
+	daemon.PodList.Foreach(func(p *pod.XPod) error {
+		if !p.IsAlive() {
+			containers = append(containers, p.ContainerIds()...)
+		}
+		return nil
+	})
+
+	var compacted []string
+	for _, id := range containers {
+		mountId, err := pod.GetMountIdByContainer(daemon.Storage.Type(), id)
+		if err != nil {
+			continue
+		}
+		stats, err := daemon.Storage.ContainerStats(ctx, mountId)
+		if err != nil || stats.InodeCount <= fileCount {
+			continue
+		}
+		// the pod may have been started in between
+		if err := daemon.CompactContainerLayer(ctx, id); IsNotSupported(err) {
+			return compacted
+		} else if err != nil {
+			glog.Warningf("failed to compact the layer of container %s, %d files: %v", id, stats.InodeCount, err)
+			continue
+		}
+		glog.Infof("compacted the layer of container %s, %d files", id, stats.InodeCount)
+		compacted = append(compacted, id)
+	}
+	return compacted
+}
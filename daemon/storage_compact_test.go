@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestOverlayFsCompactContainerLayer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the whiteouts and the trusted xattrs need root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+	upper := filepath.Join(root, mountId, "upper")
+	if err := os.MkdirAll(filepath.Join(upper, "etc", "opaque"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "etc", "hosts"), []byte("127.0.0.1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(upper, "etc", "hosts"), filepath.Join(upper, "etc", "hosts.link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mknod(filepath.Join(upper, "etc", "removed"), syscall.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SetXattrs(filepath.Join(upper, "etc", "opaque"), map[string][]byte{"trusted.overlay.opaque": []byte("y")}); err != nil {
+		t.Skipf("the filesystem of the tests has no trusted xattrs: %v", err)
+	}
+
+	o := &OverlayFsStorage{rootPath: root}
+	ctx := context.Background()
+	sharedDir := filepath.Join(root, "shared")
+	if _, err := o.PrepareContainer(ctx, mountId, sharedDir, storage.ContainerOptions{}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	held, err := os.Open(filepath.Join(upper, "etc", "hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.CompactContainerLayer(ctx, mountId); !IsDeviceBusy(err) {
+		t.Fatalf("a layer held open should not be compacted, got %v", err)
+	}
+	held.Close()
+
+	if err := o.CompactContainerLayer(ctx, mountId); err != nil {
+		t.Fatalf("compact container layer failed: %v", err)
+	}
+	if mounted, _ := overlayMounted(filepath.Join(sharedDir, mountId, "rootfs")); mounted {
+		t.Fatal("the rootfs should be unmounted by the compaction")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(upper, "etc", "hosts")); err != nil || string(data) != "127.0.0.1" {
+		t.Fatalf("the files should be kept, got %q, %v", data, err)
+	}
+	var hosts, link syscall.Stat_t
+	syscall.Stat(filepath.Join(upper, "etc", "hosts"), &hosts)
+	syscall.Stat(filepath.Join(upper, "etc", "hosts.link"), &link)
+	if hosts.Ino != link.Ino || hosts.Mode&0777 != 0600 {
+		t.Fatalf("the hard link and the mode should be kept, got %+v and %+v", hosts, link)
+	}
+	var whiteout syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(upper, "etc", "removed"), &whiteout); err != nil || whiteout.Mode&syscall.S_IFMT != syscall.S_IFCHR || whiteout.Rdev != 0 {
+		t.Fatalf("the whiteout should be kept, got %+v, %v", whiteout, err)
+	}
+	xattrs, err := storage.Xattrs(filepath.Join(upper, "etc", "opaque"))
+	if err != nil || string(xattrs["trusted.overlay.opaque"]) != "y" {
+		t.Fatalf("the opaque dir should be kept, got %v, %v", xattrs, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(root, mountId, ".upper*")); len(leftovers) != 0 {
+		t.Fatalf("nothing should be left next to the upper dir, got %v", leftovers)
+	}
+}
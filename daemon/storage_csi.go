@@ -0,0 +1,675 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/docker/go-units"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/csi"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// csiOptions are the driver options of the csi storage:
+//
+//	csi.endpoint            unix socket of the node plugin, required
+//	csi.controllerendpoint  unix socket of the controller plugin, the node
+//	                        plugin one by default
+//	csi.fstype              filesystem of the volumes, ext4 by default
+//	csi.volumesize          size of the volumes which do not ask for one
+//	csi.param.<key>         parameter <key> passed to the plugin on the
+//	                        creation of the volumes
+type csiOptions struct {
+	Endpoint           string
+	ControllerEndpoint string
+	Fstype             string
+	VolumeSize         uint64
+	Parameters         map[string]string
+}
+
+func parseCSIOptions(config *StorageConfig) (*csiOptions, error) {
+	opts := &csiOptions{
+		Endpoint:           config.DriverOption("csi", "endpoint"),
+		ControllerEndpoint: config.DriverOption("csi", "controllerendpoint"),
+		Fstype:             config.DriverOption("csi", "fstype"),
+		VolumeSize:         uint64(storage.DEFAULT_DM_VOL_SIZE),
+		Parameters:         make(map[string]string),
+	}
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("csi.endpoint is required by the csi storage")
+	}
+	if opts.ControllerEndpoint == "" {
+		opts.ControllerEndpoint = opts.Endpoint
+	}
+	if opts.Fstype == "" {
+		opts.Fstype = storage.DEFAULT_VOL_FS
+	}
+	if size := config.DriverOption("csi", "volumesize"); size != "" {
+		bytes, err := units.RAMInBytes(size)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid csi.volumesize %q", size)
+		}
+		opts.VolumeSize = uint64(bytes)
+	}
+	if config != nil {
+		for opt, val := range config.DriverOptions["csi"] {
+			if strings.HasPrefix(opt, "param.") {
+				opts.Parameters[strings.TrimPrefix(opt, "param.")] = val
+			}
+		}
+	}
+	return opts, nil
+}
+
+// csiVolume is what the plugin returned for a volume, kept to publish and
+// delete it again.
+type csiVolume struct {
+	VolumeId       string
+	VolumeContext  map[string]string `json:",omitempty"`
+	PublishContext map[string]string `json:",omitempty"`
+	Block          bool              `json:",omitempty"`
+}
+
+// CSIStorage delegates the volumes to a plugin of the Container Storage
+// Interface. The volumes are created by the controller plugin and published
+// by the node plugin under the root, the rootfs of each container is expected
+// as the CSI volume whose id is its mountId.
+type CSIStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	opts     *csiOptions
+
+	conns      []*grpc.ClientConn
+	identity   csi.IdentityClient
+	controller csi.ControllerClient
+	node       csi.NodeClient
+	// nodeId is the id of this host for the controller plugin
+	nodeId string
+	// stage and publish tell whether the plugin wants the volumes staged on
+	// the node, and published to the node by the controller
+	stage   bool
+	publish bool
+}
+
+func CSIFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	opts, err := parseCSIOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	driver := &CSIStorage{
+		db:       db,
+		rootPath: config.DriverRoot("csi"),
+		opts:     opts,
+	}
+	return driver, nil
+}
+
+func (s *CSIStorage) Type() string {
+	return "csi"
+}
+
+func (s *CSIStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *CSIStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+func (s *CSIStorage) statePath(key string) string {
+	return filepath.Join(s.RootPath(), "state", key)
+}
+
+func (s *CSIStorage) stagingPath(key string) string {
+	return filepath.Join(s.RootPath(), "staging", key)
+}
+
+func dialCSI(endpoint string) (*grpc.ClientConn, error) {
+	return grpc.Dial(endpoint, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+}
+
+// Init connects to the plugins and asks them for the id of the node and for
+// the steps they need to publish a volume.
+func (s *CSIStorage) Init(ctx context.Context) error {
+	for _, dir := range []string{"volumes", "state", "staging"} {
+		if err := ensureDir(filepath.Join(s.RootPath(), dir), 0700); err != nil {
+			return err
+		}
+	}
+	conn, err := dialCSI(s.opts.Endpoint)
+	if err != nil {
+		return fmt.Errorf("cannot connect to the csi plugin %s: %v", s.opts.Endpoint, err)
+	}
+	s.conns = []*grpc.ClientConn{conn}
+	controllerConn := conn
+	if s.opts.ControllerEndpoint != s.opts.Endpoint {
+		if controllerConn, err = dialCSI(s.opts.ControllerEndpoint); err != nil {
+			s.CleanUp(ctx)
+			return fmt.Errorf("cannot connect to the csi plugin %s: %v", s.opts.ControllerEndpoint, err)
+		}
+		s.conns = append(s.conns, controllerConn)
+	}
+	s.identity = csi.NewIdentityClient(conn)
+	s.node = csi.NewNodeClient(conn)
+	s.controller = csi.NewControllerClient(controllerConn)
+
+	if err := s.init(ctx); err != nil {
+		s.CleanUp(ctx)
+		return err
+	}
+	return nil
+}
+
+func (s *CSIStorage) init(ctx context.Context) error {
+	info, err := s.identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot get the info of the csi plugin %s: %v", s.opts.Endpoint, err)
+	}
+	node, err := s.node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot get the node id from csi plugin %s: %v", info.Name, err)
+	}
+	s.nodeId = node.NodeId
+
+	nodeCaps, err := s.node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot get the node capabilities of csi plugin %s: %v", info.Name, err)
+	}
+	for _, c := range nodeCaps.Capabilities {
+		if c.GetRpc().GetType() == csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME {
+			s.stage = true
+		}
+	}
+	controllerCaps, err := s.controller.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot get the controller capabilities of csi plugin %s: %v", info.Name, err)
+	}
+	create := false
+	for _, c := range controllerCaps.Capabilities {
+		switch c.GetRpc().GetType() {
+		case csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME:
+			create = true
+		case csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME:
+			s.publish = true
+		}
+	}
+	if !create {
+		return fmt.Errorf("csi plugin %s cannot create volumes", info.Name)
+	}
+	glog.Infof("csi plugin %s %s ready on node %s", info.Name, info.VendorVersion, s.nodeId)
+	return nil
+}
+
+func (s *CSIStorage) CleanUp(ctx context.Context) error {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	return nil
+}
+
+// HealthCheck probes the plugin, which may be up but not ready yet.
+func (s *CSIStorage) HealthCheck(ctx context.Context) error {
+	resp, err := s.identity.Probe(ctx, &csi.ProbeRequest{})
+	if err != nil {
+		return fmt.Errorf("cannot probe the csi plugin: %v", err)
+	}
+	if resp.Ready != nil && !resp.Ready.Value {
+		return fmt.Errorf("csi plugin is not ready")
+	}
+	return nil
+}
+
+func (s *CSIStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *CSIStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsQuota: true,
+	}
+}
+
+func (s *CSIStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// volumeCapability translates the volume into the capability asked to the
+// plugin: a raw volume is a block device, any other one is mounted.
+func (s *CSIStorage) volumeCapability(spec *apitypes.UserVolume, readonly bool) *csi.VolumeCapability {
+	mode := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	if readonly {
+		mode = csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	}
+	capability := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+	if spec.Format == "raw" {
+		capability.Block = &csi.VolumeCapability_BlockVolume{}
+		return capability
+	}
+	fstype := s.opts.Fstype
+	if spec.Fstype != "" && spec.Fstype != "dir" {
+		fstype = spec.Fstype
+	}
+	capability.Mount = &csi.VolumeCapability_MountVolume{FsType: fstype}
+	return capability
+}
+
+// publishVolume makes the volume available at target: published to this node
+// by the controller, staged and published by the node plugin, as the plugin
+// needs. The steps done are undone if one fails.
+func (s *CSIStorage) publishVolume(ctx context.Context, key string, vol *csiVolume, capability *csi.VolumeCapability, target string, readonly bool) (err error) {
+	if s.publish {
+		resp, err := s.controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         vol.VolumeId,
+			NodeId:           s.nodeId,
+			VolumeCapability: capability,
+			Readonly:         readonly,
+			VolumeContext:    vol.VolumeContext,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to publish csi volume %s to node %s: %v", vol.VolumeId, s.nodeId, err)
+		}
+		vol.PublishContext = resp.PublishContext
+	}
+	defer func() {
+		if err != nil {
+			s.unpublishVolume(ctx, key, vol, target)
+		}
+	}()
+
+	var staging string
+	if s.stage {
+		staging = s.stagingPath(key)
+		if err := os.MkdirAll(staging, 0700); err != nil {
+			return err
+		}
+		_, err := s.node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          vol.VolumeId,
+			PublishContext:    vol.PublishContext,
+			StagingTargetPath: staging,
+			VolumeCapability:  capability,
+			VolumeContext:     vol.VolumeContext,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to stage csi volume %s: %v", vol.VolumeId, err)
+		}
+	}
+	// the plugin creates target, a file for the block volumes
+	if err := ensureDir(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	_, err = s.node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          vol.VolumeId,
+		PublishContext:    vol.PublishContext,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  capability,
+		Readonly:          readonly,
+		VolumeContext:     vol.VolumeContext,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish csi volume %s to %s: %v", vol.VolumeId, target, err)
+	}
+	return nil
+}
+
+// unpublishVolume undoes publishVolume, the steps the plugin was not asked
+// for are no-ops.
+func (s *CSIStorage) unpublishVolume(ctx context.Context, key string, vol *csiVolume, target string) error {
+	if _, err := s.node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   vol.VolumeId,
+		TargetPath: target,
+	}); err != nil {
+		return fmt.Errorf("failed to unpublish csi volume %s from %s: %v", vol.VolumeId, target, err)
+	}
+	if s.stage {
+		if _, err := s.node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          vol.VolumeId,
+			StagingTargetPath: s.stagingPath(key),
+		}); err != nil {
+			return fmt.Errorf("failed to unstage csi volume %s: %v", vol.VolumeId, err)
+		}
+		os.Remove(s.stagingPath(key))
+	}
+	if s.publish {
+		if _, err := s.controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: vol.VolumeId,
+			NodeId:   s.nodeId,
+		}); err != nil {
+			return fmt.Errorf("failed to unpublish csi volume %s from node %s: %v", vol.VolumeId, s.nodeId, err)
+		}
+	}
+	return nil
+}
+
+func (s *CSIStorage) saveState(key string, vol *csiVolume) error {
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.statePath(key), data, 0600)
+}
+
+func (s *CSIStorage) loadState(key string) (*csiVolume, error) {
+	data, err := ioutil.ReadFile(s.statePath(key))
+	if err != nil {
+		return nil, err
+	}
+	vol := &csiVolume{}
+	if err := json.Unmarshal(data, vol); err != nil {
+		return nil, fmt.Errorf("invalid state of csi volume %s: %v", key, err)
+	}
+	return vol, nil
+}
+
+// rootfsCapability is the capability of the rootfs of the containers.
+func (s *CSIStorage) rootfsCapability(readonly bool) *csi.VolumeCapability {
+	return s.volumeCapability(&apitypes.UserVolume{}, readonly)
+}
+
+// PrepareContainer publishes the volume of the rootfs of the container into
+// sharedDir.
+func (s *CSIStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	vol := &csiVolume{VolumeId: mountId}
+	target := filepath.Join(sharedDir, mountId, "rootfs")
+	if err := s.publishVolume(ctx, mountId, vol, s.rootfsCapability(opts.ReadOnly), target, opts.ReadOnly); err != nil {
+		return nil, err
+	}
+
+	containerPath := "/" + mountId
+	desc := &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return desc, nil
+}
+
+func (s *CSIStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return s.unpublishVolume(ctx, id, &csiVolume{VolumeId: id}, filepath.Join(sharedDir, id, "rootfs"))
+}
+
+// withRootfs runs inject with the rootfs of the container published under
+// baseDir, as it is while the container is prepared.
+func (s *CSIStorage) withRootfs(ctx context.Context, mountId, baseDir string, inject func() error) error {
+	target := filepath.Join(baseDir, mountId, "rootfs")
+	if mounted, _ := mount.Mounted(target); mounted {
+		return inject()
+	}
+	vol := &csiVolume{VolumeId: mountId}
+	if err := s.publishVolume(ctx, mountId, vol, s.rootfsCapability(false), target, false); err != nil {
+		return err
+	}
+	defer s.unpublishVolume(ctx, mountId, vol, target)
+	return inject()
+}
+
+func (s *CSIStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return s.withRootfs(ctx, mountId, baseDir, func() error {
+		return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+	})
+}
+
+func (s *CSIStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return s.withRootfs(ctx, mountId, baseDir, func() error {
+		return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+	})
+}
+
+func (s *CSIStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume creates the volume with the controller plugin and publishes it
+// under the root, the volume is deleted again if any step fails.
+func (s *CSIStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	key := fmt.Sprintf("%s-%s", podId, spec.Name)
+	size := spec.SizeBytes
+	if size == 0 {
+		size = s.opts.VolumeSize
+	}
+	capability := s.volumeCapability(spec, false)
+	resp, err := s.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               key,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: int64(size)},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		Parameters:         s.opts.Parameters,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create csi volume %s: %v", key, err)
+	}
+	vol := &csiVolume{
+		VolumeId:      resp.GetVolume().GetVolumeId(),
+		VolumeContext: resp.GetVolume().GetVolumeContext(),
+		Block:         capability.Block != nil,
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(s.statePath(key))
+			s.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.VolumeId})
+		}
+	}()
+
+	volPath := s.volumePath(podId, spec.Name)
+	if err := s.publishVolume(ctx, key, vol, capability, volPath, false); err != nil {
+		return err
+	}
+	if err := s.saveState(key, vol); err != nil {
+		s.unpublishVolume(ctx, key, vol, volPath)
+		return err
+	}
+	glog.V(1).Infof("volume %s created as csi volume %s", spec.Name, vol.VolumeId)
+
+	spec.Source = volPath
+	if vol.Block {
+		spec.Format = "raw"
+		spec.Fstype = s.opts.Fstype
+	} else {
+		spec.Format = "vfs"
+		spec.Fstype = "dir"
+	}
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// removeVolume unpublishes the volume kept as key and deletes it.
+func (s *CSIStorage) removeVolume(ctx context.Context, key string) error {
+	volPath := filepath.Join(s.RootPath(), "volumes", key)
+	vol, err := s.loadState(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// the volume was never created, or already deleted
+		os.Remove(volPath)
+		return nil
+	}
+	if err := s.unpublishVolume(ctx, key, vol, volPath); err != nil {
+		return err
+	}
+	if _, err := s.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.VolumeId}); err != nil {
+		return fmt.Errorf("failed to delete csi volume %s: %v", vol.VolumeId, err)
+	}
+	if err := os.Remove(s.statePath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(volPath)
+	return nil
+}
+
+// RemoveVolume unpublishes the volume and deletes it with the controller
+// plugin.
+func (s *CSIStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	if err := s.removeVolume(ctx, fmt.Sprintf("%s-%s", podId, name)); err != nil {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *CSIStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "state"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vol := &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "vfs",
+			Fstype: "dir",
+		}
+		if state, err := s.loadState(fmt.Sprintf("%s-%s", podId, name)); err == nil && state.Block {
+			vol.Format, vol.Fstype = "raw", s.opts.Fstype
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
+
+func (s *CSIStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CSIStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.statePath(fmt.Sprintf("%s-%s", podId, volName)))
+}
+
+func (s *CSIStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *CSIStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *CSIStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CSIStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CSIStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *CSIStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *CSIStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CSIStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect deletes the csi volumes of the orphaned volumes.
+func (s *CSIStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	orphans, err := orphanedVolumes(filepath.Join(s.RootPath(), "state"), activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		if err := s.removeVolume(ctx, name); err != nil {
+			glog.Warningf("failed to remove orphaned volume %s: %v", name, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
@@ -0,0 +1,252 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/csi"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// fakeCSIPlugin is a csi plugin which stages and publishes the volumes as
+// plain directories, and records the calls.
+type fakeCSIPlugin struct {
+	sync.Mutex
+	calls    []string
+	requests []interface{}
+	notReady bool
+}
+
+func (p *fakeCSIPlugin) record(call string, req interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	p.calls = append(p.calls, call)
+	p.requests = append(p.requests, req)
+}
+
+func (p *fakeCSIPlugin) reset() ([]string, []interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	calls, requests := p.calls, p.requests
+	p.calls, p.requests = nil, nil
+	return calls, requests
+}
+
+func (p *fakeCSIPlugin) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: "csi.fake", VendorVersion: "1.0"}, nil
+}
+
+func (p *fakeCSIPlugin) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	p.Lock()
+	defer p.Unlock()
+	return &csi.ProbeResponse{Ready: &csi.BoolValue{Value: !p.notReady}}, nil
+}
+
+func (p *fakeCSIPlugin) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	p.record("CreateVolume", req)
+	vol := &csi.Volume{
+		VolumeId:      "id-" + req.Name,
+		CapacityBytes: req.CapacityRange.RequiredBytes,
+	}
+	return &csi.CreateVolumeResponse{Volume: vol}, nil
+}
+
+func (p *fakeCSIPlugin) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	p.record("DeleteVolume", req)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (p *fakeCSIPlugin) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	p.record("ControllerPublishVolume", req)
+	return &csi.ControllerPublishVolumeResponse{PublishContext: map[string]string{"device": "/dev/fake"}}, nil
+}
+
+func (p *fakeCSIPlugin) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	p.record("ControllerUnpublishVolume", req)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (p *fakeCSIPlugin) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	var caps []*csi.ControllerServiceCapability
+	for _, t := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	} {
+		caps = append(caps, &csi.ControllerServiceCapability{Rpc: &csi.ControllerServiceCapability_RPC{Type: t}})
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+func (p *fakeCSIPlugin) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	p.record("NodeStageVolume", req)
+	if _, err := os.Stat(req.StagingTargetPath); err != nil {
+		return nil, err
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (p *fakeCSIPlugin) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	p.record("NodeUnstageVolume", req)
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (p *fakeCSIPlugin) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	p.record("NodePublishVolume", req)
+	if strings.HasSuffix(req.VolumeId, "-broken") {
+		return nil, fmt.Errorf("cannot publish %s", req.VolumeId)
+	}
+	if err := os.Mkdir(req.TargetPath, 0755); err != nil {
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (p *fakeCSIPlugin) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	p.record("NodeUnpublishVolume", req)
+	if err := os.Remove(req.TargetPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (p *fakeCSIPlugin) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	caps := []*csi.NodeServiceCapability{
+		{Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME}},
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+func (p *fakeCSIPlugin) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: "node1"}, nil
+}
+
+func TestCSIStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "csi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	plugin := &fakeCSIPlugin{}
+	srv := grpc.NewServer()
+	csi.RegisterIdentityServer(srv, plugin)
+	csi.RegisterControllerServer(srv, plugin)
+	csi.RegisterNodeServer(srv, plugin)
+	sock := filepath.Join(root, "csi.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	config := &StorageConfig{
+		Root: root,
+		DriverOptions: map[string]map[string]string{
+			"csi": {"endpoint": sock, "param.type": "ssd"},
+		},
+	}
+	sd, err := CSIFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*CSIStorage)
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	defer s.CleanUp(context.Background())
+	if s.nodeId != "node1" || !s.stage || !s.publish {
+		t.Fatalf("unexpected node %q, stage %v, publish %v", s.nodeId, s.stage, s.publish)
+	}
+	if err := s.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	plugin.notReady = true
+	if err := s.HealthCheck(context.Background()); err == nil {
+		t.Fatal("a plugin which is not ready should be unhealthy")
+	}
+	plugin.notReady = false
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 1 << 30}
+	if err := s.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	calls, requests := plugin.reset()
+	if expected := []string{"CreateVolume", "ControllerPublishVolume", "NodeStageVolume", "NodePublishVolume"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected the calls %v, got %v", expected, calls)
+	}
+	create := requests[0].(*csi.CreateVolumeRequest)
+	if create.Name != podId+"-vol1" || create.CapacityRange.RequiredBytes != 1<<30 || create.Parameters["type"] != "ssd" {
+		t.Fatalf("unexpected create request %v", create)
+	}
+	if capability := create.VolumeCapabilities[0]; capability.Mount.GetFsType() != "ext4" || capability.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		t.Fatalf("unexpected capability %v", capability)
+	}
+	if publish := requests[3].(*csi.NodePublishVolumeRequest); publish.PublishContext["device"] != "/dev/fake" || publish.StagingTargetPath == "" {
+		t.Fatalf("unexpected publish request %v", publish)
+	}
+	if spec.Source != s.volumePath(podId, "vol1") || spec.Format != "vfs" {
+		t.Fatalf("unexpected volume %v", spec)
+	}
+	if fi, err := os.Stat(spec.Source); err != nil || !fi.IsDir() {
+		t.Fatalf("the volume should be published to %s: %v", spec.Source, err)
+	}
+	if vols, err := s.ListVolumes(context.Background(), podId); err != nil || len(vols) != 1 || vols[0].Name != "vol1" {
+		t.Fatalf("unexpected volumes %v: %v", vols, err)
+	}
+
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	calls, requests = plugin.reset()
+	if expected := []string{"NodeUnpublishVolume", "NodeUnstageVolume", "ControllerUnpublishVolume", "DeleteVolume"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected the calls %v, got %v", expected, calls)
+	}
+	if id := requests[3].(*csi.DeleteVolumeRequest).VolumeId; id != "id-"+podId+"-vol1" {
+		t.Fatalf("unexpected deleted volume %s", id)
+	}
+	if exists, _ := s.VolumeExists(context.Background(), podId, "vol1"); exists {
+		t.Fatal("the volume should be removed")
+	}
+
+	// the volume is deleted again when it can not be published
+	if err := s.CreateVolume(context.Background(), podId, &apitypes.UserVolume{Name: "broken"}); err == nil {
+		t.Fatal("create volume should fail")
+	}
+	if calls, _ := plugin.reset(); calls[len(calls)-1] != "DeleteVolume" {
+		t.Fatalf("the volume should be deleted, got %v", calls)
+	}
+	if exists, _ := s.VolumeExists(context.Background(), podId, "broken"); exists {
+		t.Fatal("no volume should be kept")
+	}
+
+	sharedDir := filepath.Join(root, "shared")
+	desc, err := s.PrepareContainer(context.Background(), "c1", sharedDir, storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	if desc.Source != "/c1" || !desc.ReadOnly {
+		t.Fatalf("unexpected rootfs %v", desc)
+	}
+	_, requests = plugin.reset()
+	if publish := requests[2].(*csi.NodePublishVolumeRequest); publish.VolumeId != "c1" || publish.TargetPath != filepath.Join(sharedDir, "c1", "rootfs") || !publish.Readonly {
+		t.Fatalf("unexpected publish request %v", publish)
+	}
+	if err := s.CleanupContainer(context.Background(), "c1", sharedDir); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+	if calls, _ := plugin.reset(); calls[0] != "NodeUnpublishVolume" {
+		t.Fatalf("the rootfs should be unpublished, got %v", calls)
+	}
+}
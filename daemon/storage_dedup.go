@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"golang.org/x/net/context"
+)
+
+// The blocks of the containers made from the same image are identical copies
+// until the containers write to them. PrepareContainer fingerprints the block
+// of each container with the SHA-256 of its first 4096 bytes, and the first
+// block seen with a fingerprint is recorded in the db. A later block with the
+// same fingerprint and the same content is replaced by a reflink clone of the
+// recorded one, so that both share their extents. The fingerprint only finds
+// the candidates: the whole blocks are compared before one is replaced.
+
+const dedupFingerprintSize = 4096
+
+// blockFingerprint is the hex SHA-256 of the first 4096 bytes of the block.
+func blockFingerprint(block string) (string, error) {
+	f, err := os.Open(block)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, dedupFingerprintSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sameContent tells whether the files a and b hold the same bytes.
+func sameContent(ctx context.Context, a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	sta, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	stb, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if sta.Size() != stb.Size() {
+		return false, nil
+	}
+	bufa, bufb := make([]byte, 1<<20), make([]byte, 1<<20)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+		if erra == io.EOF || erra == io.ErrUnexpectedEOF {
+			return errb == erra, nil
+		} else if erra != nil {
+			return false, erra
+		} else if errb != nil {
+			return false, errb
+		}
+	}
+}
+
+// dedupBlock shares the extents of the block of the container with those of
+// an identical block prepared before, when the root supports reflinks. It is
+// best effort, the block is left as is on any failure.
+func (s *RawBlockStorage) dedupBlock(ctx context.Context, mountId, block string) {
+	if s.db == nil || !s.reflink {
+		return
+	}
+	if _, err := s.db.GetDedupedBlock(mountId); err == nil {
+		return
+	}
+	if err := s.dedup(ctx, mountId, block); err != nil {
+		glog.Warningf("failed to deduplicate the block of container %s: %v", mountId, err)
+	}
+}
+
+func (s *RawBlockStorage) dedup(ctx context.Context, mountId, block string) error {
+	fp, err := blockFingerprint(block)
+	if err != nil {
+		return err
+	}
+	src, err := s.db.GetBlockFingerprint(fp)
+	if err != nil || src == mountId {
+		return s.db.UpdateBlockFingerprint(fp, mountId)
+	}
+	srcBlock := filepath.Join(s.RootPath(), "blocks", src)
+	same, err := sameContent(ctx, srcBlock, block)
+	if os.IsNotExist(err) || (err == nil && !same) {
+		// the recorded block is gone or was written to since, this one
+		// stands for the fingerprint from now on
+		return s.db.UpdateBlockFingerprint(fp, mountId)
+	} else if err != nil {
+		return err
+	}
+
+	saved, err := fileUsage(block)
+	if err != nil {
+		return err
+	}
+	tmp := block + ".dedup"
+	if err := cloneFile(srcBlock, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, block); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	glog.V(1).Infof("block of container %s deduplicated with the block of %s, %d bytes saved", mountId, src, saved)
+	return s.db.UpdateDedupedBlock(mountId, saved)
+}
+
+// dedupSavedBytes sums the bytes saved by the deduplicated blocks which still
+// exist, as they were at the time of the dedup, and forgets the others.
+func (s *RawBlockStorage) dedupSavedBytes(ctx context.Context) (int64, error) {
+	var total int64
+	for kv := range s.db.ListDedupedBlocks() {
+		if kv == nil {
+			return 0, fmt.Errorf("failed to list the deduplicated blocks")
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		mountId := strings.TrimPrefix(string(kv.K), daemondb.BLOCK_DEDUP_PREFIX)
+		if exists, err := pathExists(filepath.Join(s.RootPath(), "blocks", mountId)); err != nil {
+			return 0, err
+		} else if !exists {
+			s.db.DeleteDedupedBlock(mountId)
+			continue
+		}
+		saved, err := strconv.ParseInt(string(kv.V), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += saved
+	}
+	return total, nil
+}
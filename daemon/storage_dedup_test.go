@@ -0,0 +1,114 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestRawBlockDedup(t *testing.T) {
+	root, err := ioutil.TempDir("", "dedup-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{db: db, rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureDir(filepath.Join(root, "blocks"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	image := bytes.Repeat([]byte("image"), 4096)
+	// c3 has the fingerprint of the image but another content
+	diverged := append(append([]byte{}, image[:8192]...), bytes.Repeat([]byte("layer"), 2048)...)
+	for id, data := range map[string][]byte{"c1": image, "c2": image, "c3": diverged} {
+		if err := ioutil.WriteFile(filepath.Join(root, "blocks", id), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.reflink {
+		// nothing is fingerprinted where the blocks can not share extents
+		if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if fp, _ := blockFingerprint(filepath.Join(root, "blocks", "c1")); fp != "" {
+			if _, err := db.GetBlockFingerprint(fp); err == nil {
+				t.Fatal("the block should not be fingerprinted without reflinks")
+			}
+		}
+		t.Skip("the filesystem of the temporary directory does not support reflinks")
+	}
+
+	for _, id := range []string{"c1", "c2", "c3"} {
+		if _, err := s.PrepareContainer(ctx, id, "/shared", storage.ContainerOptions{}); err != nil {
+			t.Fatalf("prepare container %s failed: %v", id, err)
+		}
+	}
+	fp, err := blockFingerprint(filepath.Join(root, "blocks", "c1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src, err := db.GetBlockFingerprint(fp); err != nil || src != "c3" {
+		t.Fatalf("the fingerprint should stand for the last diverged block, got %q, %v", src, err)
+	}
+	if _, err := db.GetDedupedBlock("c3"); err == nil {
+		t.Fatal("a block with another content should not be deduplicated")
+	}
+	saved, err := db.GetDedupedBlock("c2")
+	if err != nil || saved == 0 {
+		t.Fatalf("the block of c2 should be deduplicated, got %d, %v", saved, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "blocks", "c2")); !bytes.Equal(data, image) {
+		t.Fatal("the deduplicated block should keep its content")
+	}
+
+	report, err := s.UsageReport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DedupSavedBytes != saved {
+		t.Fatalf("the report should count %d bytes saved, got %d", saved, report.DedupSavedBytes)
+	}
+	os.Remove(filepath.Join(root, "blocks", "c2"))
+	if report, err = s.UsageReport(ctx); err != nil || report.DedupSavedBytes != 0 {
+		t.Fatalf("the removed blocks should not be counted, got %v, %v", report, err)
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "same-content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	big := bytes.Repeat([]byte{1}, 3<<20)
+	other := append(append([]byte{}, big[:len(big)-1]...), 2)
+	for name, data := range map[string][]byte{"a": big, "b": big, "c": other, "d": big[:1<<20]} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		b    string
+		same bool
+	}{{"b", true}, {"c", false}, {"d", false}} {
+		if same, err := sameContent(context.Background(), filepath.Join(dir, "a"), filepath.Join(dir, c.b)); err != nil || same != c.same {
+			t.Fatalf("a and %s should be the same: %v, got %v, %v", c.b, c.same, same, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// DefragVolume mounts the filesystem of the volume aside and reorganizes its
+// fragmented files with xfs_fsr. The volume must not be attached to a
+// sandbox, the files are moved under the feet of its users.
+func (s *RawBlockStorage) DefragVolume(ctx context.Context, podId, volName string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "DefragVolume", volumeID(podId, volName))
+	if s.Filesystem != "xfs" {
+		return unsupportedFeature(s, "defragmenting "+s.Filesystem+" volumes")
+	}
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+	device := s.blockDevice(block)
+	if s.VolumeRefCount(podId, volName) > 0 || storage.PathInUse(block) || storage.PathInUse(device) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to defragment it", volName, podId)
+		return ErrVolumeInUse
+	}
+	mnt, err := ioutil.TempDir(filepath.Dir(block), ".defrag-")
+	if err != nil {
+		return err
+	}
+	if err := s.mountBlock(ctx, device, mnt, false); err != nil {
+		os.Remove(mnt)
+		return err
+	}
+	defer unmountBlock(mnt)
+	return xfsFsr(ctx, volumeID(podId, volName), mnt)
+}
+
+// xfsFsr runs xfs_fsr on the filesystem mounted on mnt, its progress is
+// logged as it goes.
+func xfsFsr(ctx context.Context, volume, mnt string) error {
+	pr, pw := io.Pipe()
+	cmd := execCommand(ctx, "xfs_fsr", "-v", mnt)
+	cmd.Stdout, cmd.Stderr = pw, pw
+	var last string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			last = scanner.Text()
+			glog.V(2).Infof("defragmenting volume %s: %s", volume, last)
+		}
+		io.Copy(ioutil.Discard, pr)
+	}()
+	err := cmd.Run()
+	pw.Close()
+	<-done
+	if err != nil {
+		return fmt.Errorf("xfs_fsr failed: %v: %s", err, last)
+	}
+	glog.V(2).Infof("defragmented volume %s", volume)
+	return nil
+}
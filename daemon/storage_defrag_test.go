@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestRawBlockDefragVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "defrag-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := ioutil.WriteFile(s.volumePath(podId, "vol1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DefragVolume(ctx, podId, "vol1"); err != nil {
+		t.Fatalf("defrag volume failed: %v", err)
+	}
+	commands, _ := ioutil.ReadFile(log)
+	block := regexp.QuoteMeta(s.volumePath(podId, "vol1"))
+	mnt := regexp.QuoteMeta(filepath.Join(root, "volumes", ".defrag-")) + `\d+`
+	if !regexp.MustCompile(`^mount -t xfs -o loop,nouuid ` + block + ` (` + mnt + `)\nxfs_fsr -v (` + mnt + `)\numount -d (` + mnt + `)\n$`).Match(commands) {
+		t.Fatalf("expected the volume mounted, defragmented and unmounted, got\n%s", commands)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(root, "volumes", ".defrag-*")); len(entries) != 0 {
+		t.Fatalf("the mount point should be removed, got %v", entries)
+	}
+
+	// a container of the pod uses the volume
+	if _, err := s.PrepareContainer(ctx, "c1", root, storage.ContainerOptions{PodID: podId, Volumes: []string{"vol1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefragVolume(ctx, podId, "vol1"); !IsDeviceBusy(err) {
+		t.Fatalf("expected the volume in use, got %v", err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DefragVolume(ctx, podId, "missing"); !IsNotFound(err) {
+		t.Fatalf("expected the volume not found, got %v", err)
+	}
+	s.Filesystem = "ext4"
+	if err := s.DefragVolume(ctx, podId, "vol1"); !IsNotSupported(err) {
+		t.Fatalf("expected the ext4 volumes not supported, got %v", err)
+	}
+	if err := (&OverlayFsStorage{rootPath: root}).DefragVolume(ctx, podId, "vol1"); !IsNotSupported(err) {
+		t.Fatalf("expected overlay not supported, got %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package daemon
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// The incremental exports of the rawblock volumes hold the regions of the
+// block which changed since one of its snapshots, in the format of
+// storage.DeltaWriter. The extent maps of the block and of the snapshot tell
+// the regions which are holes in both, or which still share their extents
+// with the snapshot, as the snapshots made with reflinks do: those did not
+// change and are not read. The other regions are read and compared.
+
+const (
+	ioctlFiemap = 0xc020660b
+
+	fiemapFlagSync          = 0x1
+	fiemapExtentLast        = 0x1
+	fiemapExtentUnwritten   = 0x800
+	fiemapExtentsPerRequest = 256
+
+	// deltaChunk is the granularity of the regions of the deltas.
+	deltaChunk = 64 << 10
+)
+
+// fiemap is struct fiemap of linux/fiemap.h, followed by its extents.
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extents       [fiemapExtentsPerRequest]fiemapExtent
+}
+
+// fiemapExtent is struct fiemap_extent of linux/fiemap.h.
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// extent maps length bytes of a file at logical to the disk at physical.
+type extent struct {
+	logical, physical, length int64
+}
+
+// fileExtents returns the extents of the file holding data, in increasing
+// logical offsets. The unwritten extents read as zeros and are left out.
+func fileExtents(f *os.File) ([]extent, error) {
+	var extents []extent
+	var start uint64
+	for {
+		m := fiemap{start: start, length: ^uint64(0) - start, flags: fiemapFlagSync, extentCount: fiemapExtentsPerRequest}
+		if err := ioctl(f.Fd(), ioctlFiemap, uintptr(unsafe.Pointer(&m))); err != nil {
+			return nil, err
+		}
+		if m.mappedExtents == 0 {
+			return extents, nil
+		}
+		for _, e := range m.extents[:m.mappedExtents] {
+			if e.flags&fiemapExtentUnwritten == 0 {
+				extents = append(extents, extent{int64(e.logical), int64(e.physical), int64(e.length)})
+			}
+			if e.flags&fiemapExtentLast != 0 {
+				return extents, nil
+			}
+			start = e.logical + e.length
+		}
+	}
+}
+
+// extentMap answers whether the regions of a file are holes, or which disk
+// they are mapped to. A nil map does not know the extents, its regions are
+// data mapped nowhere.
+type extentMap []extent
+
+// mapping returns the extents of the map overlapping the region.
+func (m extentMap) mapping(offset, length int64) []extent {
+	var overlap []extent
+	for _, e := range m {
+		if e.logical+e.length <= offset {
+			continue
+		}
+		if e.logical >= offset+length {
+			break
+		}
+		overlap = append(overlap, e)
+	}
+	return overlap
+}
+
+// hole tells whether the region holds no data.
+func (m extentMap) hole(offset, length int64) bool {
+	return m != nil && len(m.mapping(offset, length)) == 0
+}
+
+// shared tells whether the region is mapped to the same disk in both maps,
+// its content is then the same.
+func (m extentMap) shared(other extentMap, offset, length int64) bool {
+	if m == nil || other == nil {
+		return false
+	}
+	for end := offset + length; offset < end; {
+		a, b := m.mapping(offset, 1), other.mapping(offset, 1)
+		if len(a) == 0 || len(b) == 0 || a[0].physical-a[0].logical != b[0].physical-b[0].logical {
+			return false
+		}
+		offset = a[0].logical + a[0].length
+		if next := b[0].logical + b[0].length; next < offset {
+			offset = next
+		}
+	}
+	return true
+}
+
+// readExtents returns the extent map of the file, nil when the filesystem
+// can not tell it.
+func readExtents(f *os.File) extentMap {
+	extents, err := fileExtents(f)
+	if err != nil {
+		glog.V(1).Infof("cannot map the extents of %s, compare all its content: %v", f.Name(), err)
+		return nil
+	}
+	return extents
+}
+
+// writeBlockDelta writes the regions of block which differ from base to dst.
+func writeBlockDelta(ctx context.Context, base, block *os.File, name string, dst io.Writer) error {
+	bfi, err := base.Stat()
+	if err != nil {
+		return err
+	}
+	fi, err := block.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := storage.NewDeltaWriter(dst, storage.DeltaHeader{BaseSize: bfi.Size(), Size: fi.Size(), Base: name})
+	if err != nil {
+		return err
+	}
+	baseExtents, extents := readExtents(base), readExtents(block)
+
+	old, cur := make([]byte, deltaChunk), make([]byte, deltaChunk)
+	for offset := int64(0); offset < fi.Size(); offset += deltaChunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := fi.Size() - offset
+		if n > deltaChunk {
+			n = deltaChunk
+		}
+		// past the size of the base, it reads as zeros
+		baseHole := offset >= bfi.Size() || baseExtents.hole(offset, n)
+		if extents.hole(offset, n) {
+			if !baseHole {
+				if err := w.WriteZero(offset, n); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if offset+n <= bfi.Size() && extents.shared(baseExtents, offset, n) {
+			continue
+		}
+		if _, err := block.ReadAt(cur[:n], offset); err != nil && err != io.EOF {
+			return err
+		}
+		for i := range old[:n] {
+			old[i] = 0
+		}
+		if !baseHole {
+			if _, err := base.ReadAt(old[:n], offset); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if !bytes.Equal(old[:n], cur[:n]) {
+			if err := w.WriteData(offset, cur[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Close()
+}
+
+// ExportIncrementalVolume writes the regions of the block of the volume which
+// changed since the snapshot, see storage.DeltaWriter for the format. As for a
+// snapshot, the block is read while detached, or frozen.
+func (s *RawBlockStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) (err error) {
+	defer wrapStorageError(&err, s.Type(), "ExportIncrementalVolume", volumeID(podId, volName))
+	if err := validateSnapshotName(sinceSnapshot); err != nil {
+		return err
+	}
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if storage.PathInUse(block) && s.frozenMount(block) == "" {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to export it", volName, podId)
+		return ErrVolumeInUse
+	}
+	cur, err := os.Open(block)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	base, err := os.Open(s.snapshotPath(podId, volName, sinceSnapshot))
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	return writeBlockDelta(ctx, base, cur, sinceSnapshot, dst)
+}
+
+// ImportIncrementalVolume applies a delta written by ExportIncrementalVolume
+// to the block of the volume, which must be as the base snapshot of the delta
+// was. The delta is applied to a copy of the block, which replaces it once
+// complete, so that a broken delta leaves the volume as it was.
+func (s *RawBlockStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer wrapStorageError(&err, s.Type(), "ImportIncrementalVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+	// the device the block is opened through would keep the replaced one
+	if s.attachedBlock(block) {
+		return ErrNotSupported
+	}
+	if storage.PathInUse(block) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to import into it", volName, podId)
+		return ErrVolumeInUse
+	}
+	tmp := filepath.Join(filepath.Dir(block), "."+filepath.Base(block)+".import")
+	if err := s.copyBlock(ctx, block, tmp); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	header, err := storage.ApplyDelta(ctx, src, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	glog.V(1).Infof("applied the delta since snapshot %s to volume %s of pod %s", header.Base, volName, podId)
+	if err := storage.ReplacePath(tmp, block); err != nil {
+		return err
+	}
+	syncVolumeMetaSize(block)
+	return nil
+}
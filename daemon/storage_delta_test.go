@@ -0,0 +1,182 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestRawBlockIncrementalVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	// the block is closed between the changes, an open block is in use
+	open := func() *os.File {
+		f, err := os.OpenFile(block, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	random := rand.New(rand.NewSource(1))
+	write := func(offset int64, length int) {
+		f := open()
+		defer f.Close()
+		data := make([]byte, length)
+		random.Read(data)
+		if _, err := f.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	truncate := func(size int64) {
+		if err := os.Truncate(block, size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0, 4<<20)
+	truncate(16 << 20)
+
+	// each round changes the volume since the last snapshot, exports the
+	// change, rolls the volume back and imports it
+	rounds := []struct {
+		snapshot string
+		change   func()
+		maxDelta int
+	}{
+		{"snap1", func() {
+			write(1<<20, 100)
+			write(10<<20, 200<<10)
+		}, 400 << 10},
+		{"snap2", func() {
+			f := open()
+			err := syscall.Fallocate(int(f.Fd()), 0x03, 0, 1<<20)
+			f.Close()
+			if err != nil {
+				t.Skipf("cannot punch a hole: %v", err)
+			}
+			truncate(20 << 20)
+			write(18<<20, 1000)
+		}, 200 << 10},
+	}
+	for _, r := range rounds {
+		if err := s.SnapshotVolume(ctx, podId, "vol1", r.snapshot); err != nil {
+			t.Fatal(err)
+		}
+		r.change()
+		expected, err := ioutil.ReadFile(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var delta bytes.Buffer
+		if err := s.ExportIncrementalVolume(ctx, podId, "vol1", r.snapshot, &delta); err != nil {
+			t.Fatalf("incremental export since %s failed: %v", r.snapshot, err)
+		}
+		if delta.Len() > r.maxDelta {
+			t.Fatalf("the delta since %s should hold the changes only, got %d bytes", r.snapshot, delta.Len())
+		}
+		if err := s.RollbackVolume(ctx, podId, "vol1", r.snapshot); err != nil {
+			t.Fatal(err)
+		}
+
+		// a corrupt delta leaves the volume as it was
+		corrupt := append([]byte(nil), delta.Bytes()...)
+		corrupt[len(corrupt)/2] ^= 0xff
+		if err := s.ImportIncrementalVolume(ctx, podId, "vol1", bytes.NewReader(corrupt)); !errors.Is(err, storage.ErrCorruptDelta) {
+			t.Fatalf("a corrupt delta should be refused, got %v", err)
+		}
+		if err := s.ImportIncrementalVolume(ctx, podId, "vol1", bytes.NewReader(delta.Bytes()[:delta.Len()-1])); !errors.Is(err, storage.ErrCorruptDelta) {
+			t.Fatalf("a truncated delta should be refused, got %v", err)
+		}
+		base, _ := ioutil.ReadFile(s.snapshotPath(podId, "vol1", r.snapshot))
+		if data, _ := ioutil.ReadFile(block); !bytes.Equal(data, base) {
+			t.Fatal("the refused delta should not change the volume")
+		}
+
+		if err := s.ImportIncrementalVolume(ctx, podId, "vol1", &delta); err != nil {
+			t.Fatalf("incremental import since %s failed: %v", r.snapshot, err)
+		}
+		data, err := ioutil.ReadFile(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("the volume should be restored by the delta since %s", r.snapshot)
+		}
+	}
+
+	// a delta applies to the base it was made from only
+	var delta bytes.Buffer
+	if err := s.ExportIncrementalVolume(ctx, podId, "vol1", "snap1", &delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportIncrementalVolume(ctx, podId, "vol1", &delta); err == nil {
+		t.Fatal("the delta should not apply to a volume of another size")
+	}
+	if err := s.ExportIncrementalVolume(ctx, podId, "vol1", "missing", &delta); !IsNotFound(err) {
+		t.Fatalf("expected a missing snapshot, got %v", err)
+	}
+}
+
+func TestIncrementalVolumeWrappers(t *testing.T) {
+	mock := NewMockStorage()
+	RegisterDriver("test-delta", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return mock, nil
+	})
+	defer unregisterDriver("test-delta")
+	info := &dockertypes.Info{Driver: "test-delta"}
+	ctx := context.Background()
+
+	s, err := StorageFactory(ctx, info, nil, &StorageConfig{
+		Metrics:        NoopStorageMetrics{},
+		Timeouts:       StorageTimeouts{ExportIncrementalVolume: time.Minute, ImportIncrementalVolume: time.Minute},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExportIncrementalVolume(ctx, "pod", "vol1", "snap1", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportIncrementalVolume(ctx, "pod", "vol1", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"ExportIncrementalVolume", "ImportIncrementalVolume"} {
+		if calls := mock.Calls(method); len(calls) != 1 {
+			t.Fatalf("%s should reach the driver through the wrappers, got %v", method, calls)
+		}
+	}
+
+	if s, err = StorageFactory(ctx, info, nil, &StorageConfig{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ImportIncrementalVolume(ctx, "pod", "vol1", bytes.NewReader(nil)); err != ErrReadOnlyStorage {
+		t.Fatalf("the import should be refused by a read-only storage, got %v", err)
+	}
+
+	o := &OverlayFsStorage{}
+	if err := o.ExportIncrementalVolume(ctx, "pod", "vol1", "snap1", ioutil.Discard); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("the drivers without deltas should not support them, got %v", err)
+	}
+}
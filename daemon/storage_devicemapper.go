@@ -0,0 +1,409 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	dm "github.com/hyperhq/hyperd/storage/devicemapper"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"github.com/hyperhq/hyperd/utils"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+type DevMapperStorage struct {
+	storageEvents
+	volumeRefs
+	db          *daemondb.DaemonDB
+	CtnPoolName string
+	VolPoolName string
+	DevPrefix   string
+	FsType      string
+	rootPath    string
+	DmPoolData  *dm.DeviceMapper
+}
+
+func DMFactory(sysinfo *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &DevMapperStorage{
+		db: db,
+	}
+
+	driver.VolPoolName = storage.DEFAULT_DM_POOL
+
+	for _, pair := range sysinfo.DriverStatus {
+		if pair[0] == "Pool Name" {
+			driver.CtnPoolName = pair[1]
+		}
+		if pair[0] == "Backing Filesystem" {
+			if strings.Contains(pair[1], "ext") {
+				driver.FsType = "ext4"
+			} else if strings.Contains(pair[1], "xfs") {
+				driver.FsType = "xfs"
+			} else {
+				driver.FsType = "dir"
+			}
+			break
+		}
+	}
+	idx := strings.Index(driver.CtnPoolName, "-pool")
+	if idx < 0 {
+		return nil, fmt.Errorf("cannot get the devicemapper pool of docker from %q", driver.CtnPoolName)
+	}
+	driver.DevPrefix = driver.CtnPoolName[:idx]
+	driver.rootPath = config.DriverRoot("devicemapper")
+	return driver, nil
+}
+
+func (dms *DevMapperStorage) Type() string {
+	return "devicemapper"
+}
+
+func (dms *DevMapperStorage) RootPath() string {
+	return dms.rootPath
+}
+
+func (dms *DevMapperStorage) Init(ctx context.Context) error {
+	dmPool := dm.DeviceMapper{
+		Datafile:         filepath.Join(utils.HYPER_ROOT, "lib") + "/data",
+		Metadatafile:     filepath.Join(utils.HYPER_ROOT, "lib") + "/metadata",
+		DataLoopFile:     storage.DEFAULT_DM_DATA_LOOP,
+		MetadataLoopFile: storage.DEFAULT_DM_META_LOOP,
+		PoolName:         dms.VolPoolName,
+		Size:             storage.DEFAULT_DM_POOL_SIZE,
+	}
+	dms.DmPoolData = &dmPool
+	rand.Seed(time.Now().UnixNano())
+
+	// Prepare the DeviceMapper storage
+	return dm.CreatePool(&dmPool)
+}
+
+func (dms *DevMapperStorage) CleanUp(ctx context.Context) error {
+	return dm.DMCleanup(dms.DmPoolData)
+}
+
+// HealthCheck checks that the thin pool is still there.
+func (dms *DevMapperStorage) HealthCheck(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join("/dev/mapper", dms.VolPoolName)); err != nil {
+		return fmt.Errorf("cannot find the thin pool %s: %v", dms.VolPoolName, err)
+	}
+	return nil
+}
+
+func (dms *DevMapperStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (dms *DevMapperStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsQuota: true,
+	}
+}
+
+func (dms *DevMapperStorage) KernelCapabilities() []string {
+	return nil
+}
+
+func (dms *DevMapperStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer dms.emit(ContainerPrepared, "", mountId, &err)
+	defer dms.takeVolumes(mountId, opts, &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := dm.CreateNewDevice(mountId, dms.DevPrefix, dms.RootPath()); err != nil {
+		return nil, err
+	}
+	devFullName, err := dm.MountContainerToSharedDir(mountId, sharedDir, dms.DevPrefix)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return nil, err
+	}
+	fstype, err := dm.ProbeFsType(devFullName)
+	if err != nil {
+		fstype = storage.DEFAULT_VOL_FS
+	}
+
+	vol := &runv.VolumeDescription{
+		Name:     devFullName,
+		Source:   devFullName,
+		Fstype:   fstype,
+		Format:   "raw",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (dms *DevMapperStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer dms.emit(ContainerCleanedUp, "", id, &err)
+	defer dms.releaseVolumes(id, &err)
+	devFullName, err := dm.MountContainerToSharedDir(id, sharedDir, dms.DevPrefix)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return err
+	}
+
+	return dm.UnmapVolume(devFullName)
+}
+
+func (dms *DevMapperStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := dm.CreateNewDevice(mountId, dms.DevPrefix, dms.RootPath()); err != nil {
+		return err
+	}
+	return dm.InjectFile(src, mountId, dms.DevPrefix, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (dms *DevMapperStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) getPersistedId(podId, volName string) (int, error) {
+	vols, err := dms.db.ListPodVolumes(podId)
+	if err != nil {
+		return -1, err
+	}
+
+	dev_id := 0
+	for _, vol := range vols {
+		fields := strings.Split(string(vol), ":")
+		if fields[0] == volName {
+			dev_id, _ = strconv.Atoi(fields[1])
+		}
+	}
+	return dev_id, nil
+}
+
+func (dms *DevMapperStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+func (dms *DevMapperStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer dms.emit(VolumeCreated, podId, spec.Name, &err)
+
+	deviceName := fmt.Sprintf("%s-%s-%s", dms.VolPoolName, podId, spec.Name)
+	dev_id, _ := dms.getPersistedId(podId, deviceName)
+	glog.Infof("DeviceID is %d", dev_id)
+
+	restore := dev_id > 0
+
+	for {
+		if !restore {
+			dev_id = dms.randDevId()
+		}
+		dev_id_str := strconv.Itoa(dev_id)
+
+		err = dm.CreateVolume(dms.VolPoolName, deviceName, dev_id_str, storage.DEFAULT_VOL_MKFS, storage.DEFAULT_DM_VOL_SIZE, restore)
+		if err != nil && !restore && strings.Contains(err.Error(), "failed: File exists") {
+			glog.V(1).Infof("retry for dev_id #%d creating collision: %v", dev_id, err)
+			continue
+		} else if err != nil {
+			glog.V(1).Infof("failed to create dev_id #%d: %v", dev_id, err)
+			return err
+		}
+
+		glog.V(3).Infof("device (%d) created (restore:%v) for %s: %s", dev_id, restore, podId, deviceName)
+		dms.db.UpdatePodVolume(podId, deviceName, []byte(fmt.Sprintf("%s:%s", deviceName, dev_id_str)))
+		break
+	}
+
+	fstype := storage.DEFAULT_VOL_FS
+	if !restore {
+		if spec.Fstype == "" {
+			fstype, err = dm.ProbeFsType("/dev/mapper/" + deviceName)
+			if err != nil {
+				fstype = storage.DEFAULT_VOL_FS
+			}
+		} else {
+			fstype = spec.Fstype
+		}
+	}
+
+	glog.V(1).Infof("volume %s created with dm as %s", spec.Name, deviceName)
+
+	spec.Source = filepath.Join("/dev/mapper/", deviceName)
+	spec.Format = "raw"
+	spec.Fstype = fstype
+
+	return nil
+}
+
+func (dms *DevMapperStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer dms.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if dms.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	fields := strings.SplitN(string(record), ":", 2)
+	if len(fields) == 1 {
+		record, err := dms.db.GetPodVolume(podId, fields[0])
+		if err != nil {
+			glog.Error(err)
+			return err
+		}
+		fields = strings.SplitN(string(record), ":", 2)
+		if len(fields) == 1 {
+			err = fmt.Errorf("cannot get valid volume %s/%s from db", podId, record)
+			glog.Error(err)
+			return err
+		}
+	}
+	dev_id, _ := strconv.Atoi(fields[1])
+	if err := dm.DeleteVolume(dms.DmPoolData, dev_id); err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	if err := dms.db.DeletePodVolume(podId, fields[0]); err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (dms *DevMapperStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	records, err := dms.db.ListPodVolumes(podId)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		vols   []*apitypes.UserVolume
+		prefix = fmt.Sprintf("%s-%s-", dms.VolPoolName, podId)
+	)
+	for _, record := range records {
+		deviceName := strings.SplitN(string(record), ":", 2)[0]
+		if !strings.HasPrefix(deviceName, prefix) {
+			continue
+		}
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   strings.TrimPrefix(deviceName, prefix),
+			Source: filepath.Join("/dev/mapper/", deviceName),
+			Format: "raw",
+			Fstype: storage.DEFAULT_VOL_FS,
+		})
+	}
+	return vols, nil
+}
+
+func (dms *DevMapperStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+// VolumeExists looks for the persisted id of the thin device, the device may
+// exist in the pool without being activated.
+func (dms *DevMapperStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	devId, err := dms.getPersistedId(podId, fmt.Sprintf("%s-%s-%s", dms.VolPoolName, podId, volName))
+	if err != nil {
+		return false, err
+	}
+	return devId > 0, nil
+}
+
+func (dms *DevMapperStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(dms.db, podId, volName)
+}
+
+func (dms *DevMapperStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), dms.db, podId, volName, labels)
+}
+
+func (dms *DevMapperStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (dms *DevMapperStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (dms *DevMapperStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (dms *DevMapperStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (dms *DevMapperStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (dms *DevMapperStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect is not supported, the thin devices of the volumes are only
+// known by the records of their pods.
+func (dms *DevMapperStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (dms *DevMapperStorage) randDevId() int {
+	return rand.Intn(1<<24-1) + 1 // 0 reserved for pool device
+}
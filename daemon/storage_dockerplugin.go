@@ -0,0 +1,523 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// dockerPluginMimetype is the content type of the docker plugin protocol.
+const dockerPluginMimetype = "application/vnd.docker.plugins.v1.2+json"
+
+// dockerPluginOptions are the driver options of the docker-plugin storage:
+//
+//	docker-plugin.socket     unix socket of the volume plugin, required, e.g.
+//	                         /run/docker/plugins/<plugin>.sock
+//	docker-plugin.opt.<key>  option <key> passed to the plugin on the
+//	                         creation of the volumes
+type dockerPluginOptions struct {
+	Socket string
+	Opts   map[string]string
+}
+
+func parseDockerPluginOptions(config *StorageConfig) (*dockerPluginOptions, error) {
+	opts := &dockerPluginOptions{
+		Socket: config.DriverOption("docker-plugin", "socket"),
+		Opts:   make(map[string]string),
+	}
+	if opts.Socket == "" {
+		return nil, fmt.Errorf("docker-plugin.socket is required by the docker-plugin storage")
+	}
+	if config != nil {
+		for opt, val := range config.DriverOptions["docker-plugin"] {
+			if strings.HasPrefix(opt, "opt.") {
+				opts.Opts[strings.TrimPrefix(opt, "opt.")] = val
+			}
+		}
+	}
+	return opts, nil
+}
+
+// dockerPluginVolume is what the plugin mounted a volume on, kept to list the
+// volumes and to unmount them again.
+type dockerPluginVolume struct {
+	Name       string
+	Mountpoint string
+}
+
+// DockerVolumePluginStorage delegates the volumes to a docker volume plugin,
+// speaking the JSON over HTTP protocol of docker on the socket of the plugin:
+// CreateVolume creates and mounts a plugin volume named "<podId>-<name>",
+// whose mount point is the source of the volume, and RemoveVolume unmounts and
+// removes it. As with the csi storage, the rootfs of each container is
+// expected as the plugin volume named after its mountId, mounted by
+// PrepareContainer into the shared dir and unmounted by CleanupContainer.
+type DockerVolumePluginStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	opts     *dockerPluginOptions
+	client   *http.Client
+}
+
+func DockerVolumePluginFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	opts, err := parseDockerPluginOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	socket := opts.Socket
+	driver := &DockerVolumePluginStorage{
+		db:       db,
+		rootPath: config.DriverRoot("docker-plugin"),
+		opts:     opts,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}
+	return driver, nil
+}
+
+func (s *DockerVolumePluginStorage) Type() string {
+	return "docker-plugin"
+}
+
+func (s *DockerVolumePluginStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *DockerVolumePluginStorage) statePath(key string) string {
+	return filepath.Join(s.RootPath(), "state", key)
+}
+
+// call posts the request of the method to the plugin and decodes its response
+// into resp, the Err of the response is returned as an error.
+func (s *DockerVolumePluginStorage) call(ctx context.Context, method string, req, resp interface{}) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest("POST", "http://plugin/"+method, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", dockerPluginMimetype)
+	r.Header.Set("Content-Type", dockerPluginMimetype)
+	res, err := s.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s of docker volume plugin %s failed: %v", method, s.opts.Socket, err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("%s of docker volume plugin %s failed: %v", method, s.opts.Socket, err)
+	}
+	var status struct{ Err string }
+	if err := json.Unmarshal(data, &status); err == nil && status.Err != "" {
+		return fmt.Errorf("%s of docker volume plugin %s failed: %s", method, s.opts.Socket, status.Err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s of docker volume plugin %s failed: %s: %s", method, s.opts.Socket, res.Status, bytes.TrimSpace(data))
+	}
+	if resp != nil {
+		if err := json.Unmarshal(data, resp); err != nil {
+			return fmt.Errorf("invalid response to %s of docker volume plugin %s: %v", method, s.opts.Socket, err)
+		}
+	}
+	return nil
+}
+
+// activate is the handshake of the plugin, which must implement the volume
+// driver protocol.
+func (s *DockerVolumePluginStorage) activate(ctx context.Context) error {
+	var resp struct{ Implements []string }
+	if err := s.call(ctx, "Plugin.Activate", nil, &resp); err != nil {
+		return err
+	}
+	for _, api := range resp.Implements {
+		if api == "VolumeDriver" {
+			return nil
+		}
+	}
+	return fmt.Errorf("docker plugin %s is not a volume driver, it implements %v", s.opts.Socket, resp.Implements)
+}
+
+// mountVolume asks the plugin to mount the volume for the caller id, and
+// returns where it did.
+func (s *DockerVolumePluginStorage) mountVolume(ctx context.Context, name, id string) (string, error) {
+	var resp struct{ Mountpoint string }
+	if err := s.call(ctx, "VolumeDriver.Mount", map[string]string{"Name": name, "ID": id}, &resp); err != nil {
+		return "", err
+	}
+	if resp.Mountpoint == "" {
+		return "", fmt.Errorf("docker volume plugin %s mounted volume %s nowhere", s.opts.Socket, name)
+	}
+	return resp.Mountpoint, nil
+}
+
+func (s *DockerVolumePluginStorage) unmountVolume(ctx context.Context, name, id string) error {
+	return s.call(ctx, "VolumeDriver.Unmount", map[string]string{"Name": name, "ID": id}, nil)
+}
+
+func (s *DockerVolumePluginStorage) Init(ctx context.Context) error {
+	if err := ensureDir(filepath.Join(s.RootPath(), "state"), 0700); err != nil {
+		return err
+	}
+	if err := s.activate(ctx); err != nil {
+		return fmt.Errorf("cannot activate the docker volume plugin %s: %v", s.opts.Socket, err)
+	}
+	glog.Infof("docker volume plugin %s ready", s.opts.Socket)
+	return nil
+}
+
+func (s *DockerVolumePluginStorage) CleanUp(ctx context.Context) error {
+	return nil
+}
+
+// HealthCheck activates the plugin again, which may have been restarted.
+func (s *DockerVolumePluginStorage) HealthCheck(ctx context.Context) error {
+	return s.activate(ctx)
+}
+
+func (s *DockerVolumePluginStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *DockerVolumePluginStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{}
+}
+
+func (s *DockerVolumePluginStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// bindRootfs mounts the rootfs of the plugin on the rootfs dir of the
+// container in baseDir.
+func bindRootfs(rootfs, baseDir, mountId string, readonly bool) error {
+	mountPoint := filepath.Join(baseDir, mountId, "rootfs")
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(rootfs, mountPoint, "bind", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount %s to %s: %v", rootfs, mountPoint, err)
+	}
+	if readonly {
+		if err := syscall.Mount(rootfs, mountPoint, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+			return fmt.Errorf("failed to mount %s to %s readonly: %v", rootfs, mountPoint, err)
+		}
+	}
+	return nil
+}
+
+// PrepareContainer mounts the plugin volume of the rootfs of the container
+// into sharedDir.
+func (s *DockerVolumePluginStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	rootfs, err := s.mountVolume(ctx, mountId, mountId)
+	if err != nil {
+		return nil, err
+	}
+	if err := bindRootfs(rootfs, sharedDir, mountId, opts.ReadOnly); err != nil {
+		s.unmountVolume(ctx, mountId, mountId)
+		return nil, err
+	}
+
+	containerPath := "/" + mountId
+	return &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}, nil
+}
+
+func (s *DockerVolumePluginStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	if err := syscall.Unmount(filepath.Join(sharedDir, id, "rootfs"), 0); err != nil && err != syscall.EINVAL {
+		return err
+	}
+	return s.unmountVolume(ctx, id, id)
+}
+
+// withRootfs runs inject with the rootfs of the container mounted under
+// baseDir, as it is while the container is prepared.
+func (s *DockerVolumePluginStorage) withRootfs(ctx context.Context, mountId, baseDir string, inject func() error) error {
+	target := filepath.Join(baseDir, mountId, "rootfs")
+	if mounted, _ := mount.Mounted(target); mounted {
+		return inject()
+	}
+	// a caller id of its own, the plugin counts the mounts of each volume
+	id := mountId + "-inject"
+	rootfs, err := s.mountVolume(ctx, mountId, id)
+	if err != nil {
+		return err
+	}
+	defer s.unmountVolume(ctx, mountId, id)
+	if err := bindRootfs(rootfs, baseDir, mountId, false); err != nil {
+		return err
+	}
+	defer syscall.Unmount(target, 0)
+	return inject()
+}
+
+func (s *DockerVolumePluginStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return s.withRootfs(ctx, mountId, baseDir, func() error {
+		return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+	})
+}
+
+func (s *DockerVolumePluginStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return s.withRootfs(ctx, mountId, baseDir, func() error {
+		return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+	})
+}
+
+func (s *DockerVolumePluginStorage) saveState(key string, vol *dockerPluginVolume) error {
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.statePath(key), data, 0600)
+}
+
+func (s *DockerVolumePluginStorage) loadState(key string) (*dockerPluginVolume, error) {
+	data, err := ioutil.ReadFile(s.statePath(key))
+	if err != nil {
+		return nil, err
+	}
+	vol := &dockerPluginVolume{}
+	if err := json.Unmarshal(data, vol); err != nil {
+		return nil, fmt.Errorf("invalid state of docker plugin volume %s: %v", key, err)
+	}
+	return vol, nil
+}
+
+func (s *DockerVolumePluginStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume creates the volume with the plugin and mounts it, the volume is
+// removed again if it can not be mounted. The size of the volume is left to
+// the options of the plugin.
+func (s *DockerVolumePluginStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	key := fmt.Sprintf("%s-%s", podId, spec.Name)
+	if err := s.call(ctx, "VolumeDriver.Create", map[string]interface{}{"Name": key, "Opts": s.opts.Opts}, nil); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.call(ctx, "VolumeDriver.Remove", map[string]string{"Name": key}, nil)
+		}
+	}()
+	mountpoint, err := s.mountVolume(ctx, key, key)
+	if err != nil {
+		return err
+	}
+	if err := s.saveState(key, &dockerPluginVolume{Name: key, Mountpoint: mountpoint}); err != nil {
+		s.unmountVolume(ctx, key, key)
+		return err
+	}
+	glog.V(1).Infof("volume %s created as docker plugin volume %s on %s", spec.Name, key, mountpoint)
+
+	spec.Source = mountpoint
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// removeVolume unmounts the volume kept as key and removes it.
+func (s *DockerVolumePluginStorage) removeVolume(ctx context.Context, key string) error {
+	if _, err := s.loadState(key); err != nil {
+		if os.IsNotExist(err) {
+			// the volume was never created, or already removed
+			return nil
+		}
+		return err
+	}
+	if err := s.unmountVolume(ctx, key, key); err != nil {
+		return err
+	}
+	if err := s.call(ctx, "VolumeDriver.Remove", map[string]string{"Name": key}, nil); err != nil {
+		return err
+	}
+	if err := os.Remove(s.statePath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DockerVolumePluginStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	if err := s.removeVolume(ctx, fmt.Sprintf("%s-%s", podId, name)); err != nil {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *DockerVolumePluginStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "state"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		state, err := s.loadState(fmt.Sprintf("%s-%s", podId, name))
+		if err != nil {
+			return nil, err
+		}
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: state.Mountpoint,
+			Format: "vfs",
+			Fstype: "dir",
+		})
+	}
+	return vols, nil
+}
+
+func (s *DockerVolumePluginStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.statePath(fmt.Sprintf("%s-%s", podId, volName)))
+}
+
+func (s *DockerVolumePluginStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *DockerVolumePluginStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *DockerVolumePluginStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *DockerVolumePluginStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect removes the plugin volumes of the orphaned volumes.
+func (s *DockerVolumePluginStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	orphans, err := orphanedVolumes(filepath.Join(s.RootPath(), "state"), activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		if err := s.removeVolume(ctx, name); err != nil {
+			glog.Warningf("failed to remove orphaned volume %s: %v", name, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
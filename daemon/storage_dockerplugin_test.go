@@ -0,0 +1,147 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// fakeDockerPlugin is a docker volume plugin which mounts the volumes on plain
+// directories, and records the calls.
+type fakeDockerPlugin struct {
+	sync.Mutex
+	root     string
+	calls    []string
+	requests []map[string]interface{}
+}
+
+func (p *fakeDockerPlugin) reset() ([]string, []map[string]interface{}) {
+	p.Lock()
+	defer p.Unlock()
+	calls, requests := p.calls, p.requests
+	p.calls, p.requests = nil, nil
+	return calls, requests
+}
+
+func (p *fakeDockerPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	req := map[string]interface{}{}
+	json.NewDecoder(r.Body).Decode(&req)
+	p.Lock()
+	p.calls = append(p.calls, method)
+	p.requests = append(p.requests, req)
+	p.Unlock()
+
+	w.Header().Set("Content-Type", dockerPluginMimetype)
+	resp := map[string]interface{}{}
+	switch method {
+	case "Plugin.Activate":
+		resp["Implements"] = []string{"VolumeDriver"}
+	case "VolumeDriver.Mount":
+		name, _ := req["Name"].(string)
+		if strings.HasSuffix(name, "-broken") {
+			resp["Err"] = "no such device"
+			break
+		}
+		mnt := filepath.Join(p.root, name)
+		os.MkdirAll(mnt, 0755)
+		resp["Mountpoint"] = mnt
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestDockerVolumePluginStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	plugin := &fakeDockerPlugin{root: filepath.Join(root, "plugin")}
+	sock := filepath.Join(root, "plugin.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: plugin}
+	go srv.Serve(lis)
+	defer srv.Close()
+
+	if _, err := DockerVolumePluginFactory(nil, nil, &StorageConfig{Root: root}); err == nil {
+		t.Fatal("the socket of the plugin should be required")
+	}
+	config := &StorageConfig{
+		Root: root,
+		DriverOptions: map[string]map[string]string{
+			"docker-plugin": {"socket": sock, "opt.type": "ssd"},
+		},
+	}
+	sd, err := DockerVolumePluginFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*DockerVolumePluginStorage)
+	ctx := context.Background()
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	if err := s.HealthCheck(ctx); err != nil {
+		t.Fatal(err)
+	}
+	plugin.reset()
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	calls, requests := plugin.reset()
+	if expected := []string{"VolumeDriver.Create", "VolumeDriver.Mount"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected the calls %v, got %v", expected, calls)
+	}
+	if create := requests[0]; create["Name"] != podId+"-vol1" || !reflect.DeepEqual(create["Opts"], map[string]interface{}{"type": "ssd"}) {
+		t.Fatalf("unexpected create request %v", create)
+	}
+	if spec.Source != filepath.Join(plugin.root, podId+"-vol1") || spec.Format != "vfs" {
+		t.Fatalf("unexpected volume %v", spec)
+	}
+	if vols, err := s.ListVolumes(ctx, podId); err != nil || len(vols) != 1 || vols[0].Name != "vol1" || vols[0].Source != spec.Source {
+		t.Fatalf("unexpected volumes %v: %v", vols, err)
+	}
+
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	calls, requests = plugin.reset()
+	if expected := []string{"VolumeDriver.Unmount", "VolumeDriver.Remove"}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected the calls %v, got %v", expected, calls)
+	}
+	if name := requests[1]["Name"]; name != podId+"-vol1" {
+		t.Fatalf("unexpected removed volume %v", name)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "vol1"); exists {
+		t.Fatal("the volume should be removed")
+	}
+
+	// the error of the plugin is returned, and the volume removed again
+	err = s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "broken"})
+	if err == nil || !strings.Contains(err.Error(), "no such device") {
+		t.Fatalf("create volume should fail with the error of the plugin, got %v", err)
+	}
+	if calls, _ := plugin.reset(); calls[len(calls)-1] != "VolumeDriver.Remove" {
+		t.Fatalf("the volume should be removed, got %v", calls)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "broken"); exists {
+		t.Fatal("no volume should be kept")
+	}
+}
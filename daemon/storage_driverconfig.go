@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/daemon/graphdriver"
+)
+
+// DefaultStorageDriverConfig is the file the options of the drivers are
+// loaded from when StorageConfig.DriverConfigFile is empty, it may not exist.
+const DefaultStorageDriverConfig = "/etc/hyperd/storage.json"
+
+// StorageDriverConfig is the JSON file of the options of the drivers, e.g.
+//
+//	{"driverOptions": {"rawblock": {"rootPath": "/data/blocks", "filesystem": "ext4"}}}
+//
+// The options are the ones of the [Storage] section of the hyperd config,
+// which win over those of the file; their names are case insensitive.
+type StorageDriverConfig struct {
+	DriverOptions map[string]map[string]string
+}
+
+// LoadStorageDriverConfig reads the options of the drivers from the JSON file
+// at path.
+func LoadStorageDriverConfig(path string) (*StorageDriverConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &StorageDriverConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("invalid storage driver config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// loadDriverConfig adds the options of the DriverConfigFile to those of the
+// config which are not set.
+func (c *StorageConfig) loadDriverConfig() error {
+	path := c.DriverConfigFile
+	if path == "" {
+		path = DefaultStorageDriverConfig
+	}
+	file, err := LoadStorageDriverConfig(path)
+	if os.IsNotExist(err) && c.DriverConfigFile == "" {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if c.DriverOptions == nil {
+		c.DriverOptions = make(map[string]map[string]string)
+	}
+	for driver, opts := range file.DriverOptions {
+		driver = strings.ToLower(driver)
+		for opt, val := range opts {
+			opt = strings.ToLower(opt)
+			if c.DriverOptions[driver] == nil {
+				c.DriverOptions[driver] = make(map[string]string)
+			}
+			if _, ok := c.DriverOptions[driver][opt]; !ok {
+				c.DriverOptions[driver][opt] = strings.TrimSpace(val)
+			}
+		}
+	}
+	return nil
+}
+
+// filesystemOf returns the name of the filesystem path is on, as the
+// "filesystem" option of the drivers names it. The ext filesystems are not
+// told apart by statfs, they are all "extfs".
+func filesystemOf(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	if name, ok := graphdriver.FsNames[graphdriver.FsMagic(st.Type)]; ok {
+		return name, nil
+	}
+	return fmt.Sprintf("0x%x", st.Type), nil
+}
+
+// sameFilesystemName tells whether the filesystem name, as in the options of
+// the drivers, is the one statfs reports.
+func sameFilesystemName(name, statfs string) bool {
+	switch name {
+	case "ext2", "ext3", "ext4":
+		name = "extfs"
+	}
+	return name == statfs
+}
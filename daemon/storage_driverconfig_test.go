@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStorageDriverConfig(t *testing.T) {
+	root, err := ioutil.TempDir("", "storage-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	file := filepath.Join(root, "storage.json")
+	if err := ioutil.WriteFile(file, []byte(`{"driverOptions": {
+		"overlay": {"rootPath": "`+filepath.Join(root, "overlay")+`", "mountAttempts": "5"},
+		"RawBlock": {"rootPath": "`+filepath.Join(root, "blocks")+`", "filesystem": "ext4", "volumesize": "1G"}
+	}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewStorageConfig(map[string]string{"rawblock.volumesize": "2G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.DriverConfigFile = file
+	if err := config.loadDriverConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OverlayFsFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := s.(*OverlayFsStorage); o.RootPath() != filepath.Join(root, "overlay") || o.MountAttempts != 5 {
+		t.Fatalf("the options of the file should be used, got %s and %d attempts", o.RootPath(), o.MountAttempts)
+	}
+	s, err = RawBlockFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := s.(*RawBlockStorage); r.RootPath() != filepath.Join(root, "blocks") || r.Filesystem != "ext4" {
+		t.Fatalf("the options of the file should be used, got %s on %s", r.RootPath(), r.Filesystem)
+	}
+	if r := s.(*RawBlockStorage); r.VolumeSize != 2*1024*1024*1024 {
+		t.Fatalf("the options of the hyperd config should win, got %d", r.VolumeSize)
+	}
+
+	config.DriverConfigFile = filepath.Join(root, "missing.json")
+	if err := config.loadDriverConfig(); !os.IsNotExist(err) {
+		t.Fatalf("a missing file which is configured should fail, got %v", err)
+	}
+	if err := ioutil.WriteFile(file, []byte(`{"driverOptions": {"overlay": {"rootPath": "overlay"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = NewStorageConfig(nil)
+	config.DriverConfigFile = file
+	config.loadDriverConfig()
+	if _, err := OverlayFsFactory(nil, nil, config); err == nil {
+		t.Fatal("a relative root path should be refused")
+	}
+}
+
+func TestOverlayFsFilesystem(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	defer fakeProc(t, "Linux version 4.9.0-3-amd64 (debian-kernel@lists.debian.org) #1 SMP\n", "nodev\toverlay\n")()
+
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs, err := filesystemOf(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := (&OverlayFsStorage{rootPath: root, Filesystem: fs}).Init(ctx); err != nil {
+		t.Fatalf("the root path is on %s, got %v", fs, err)
+	}
+	other := "xfs"
+	if fs == "xfs" {
+		other = "btrfs"
+	}
+	err = (&OverlayFsStorage{rootPath: root, Filesystem: other}).Init(ctx)
+	if err == nil || !strings.Contains(err.Error(), "not on "+other) {
+		t.Fatalf("the root path is not on %s, got %v", other, err)
+	}
+}
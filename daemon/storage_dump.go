@@ -0,0 +1,183 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/hyperhq/hyperd/daemon/pod"
+)
+
+// The dumps of DumpState are partial rather than failed when a part of the
+// state can not be read, as a broken driver is what they are taken for: the
+// error of the part is dumped in its place.
+
+// overlayState is the dump of an OverlayFsStorage.
+type overlayState struct {
+	Driver   string
+	RootPath string
+	WorkDir  string `json:",omitempty"`
+	// MountIds are the mount ids of the containers in the daemon db.
+	MountIds      []string
+	MountIdsError string `json:",omitempty"`
+	// Mounts are the overlays mounted from the root path.
+	Mounts      []mountState
+	MountsError string `json:",omitempty"`
+	// Volumes are the containers holding each volume, by volume id.
+	Volumes map[string]int
+}
+
+type mountState struct {
+	Mountpoint string
+	Options    string
+}
+
+// rawBlockState is the dump of a RawBlockStorage.
+type rawBlockState struct {
+	Driver      string
+	RootPath    string
+	Blocks      []blockState
+	BlocksError string `json:",omitempty"`
+	Volumes     []blockState
+	// VolumesError tells why the volumes, or their records, are not all
+	// dumped.
+	VolumesError string `json:",omitempty"`
+	// VolumeRefs are the containers holding each volume, by volume id.
+	VolumeRefs map[string]int
+}
+
+// blockState is a file of the blocks or volumes dir, with the record of the
+// container or volume it belongs to.
+type blockState struct {
+	Name           string
+	SizeBytes      int64
+	AllocatedBytes int64
+	// Record is the volume record, or true for the block of a container in
+	// the daemon db.
+	Record json.RawMessage `json:",omitempty"`
+}
+
+// volumeRefCounts returns the counts of the containers holding each volume.
+func (r *volumeRefs) volumeRefCounts() map[string]int {
+	r.refsLock.Lock()
+	defer r.refsLock.Unlock()
+	counts := make(map[string]int, len(r.refs))
+	for id, n := range r.refs {
+		counts[id] = n
+	}
+	return counts
+}
+
+func writeState(w io.Writer, state interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(state)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// DumpState writes the root path, the mount ids of the daemon db, the
+// overlays mounted from the root path and the counts of the volumes held by
+// the prepared containers.
+func (o *OverlayFsStorage) DumpState(w io.Writer) error {
+	state := &overlayState{
+		Driver:   o.Type(),
+		RootPath: o.RootPath(),
+		WorkDir:  o.WorkDir,
+		Volumes:  o.volumeRefCounts(),
+	}
+	if o.db != nil {
+		ids, err := pod.ListContainerMountIds(o.db)
+		sort.Strings(ids)
+		state.MountIds, state.MountIdsError = ids, errorString(err)
+	}
+	mounts, err := mount.GetMounts()
+	state.MountsError = errorString(err)
+	for _, m := range mounts {
+		if m.Fstype == "overlay" && strings.Contains(m.VfsOpts, o.RootPath()+"/") {
+			state.Mounts = append(state.Mounts, mountState{Mountpoint: m.Mountpoint, Options: m.VfsOpts})
+		}
+	}
+	return writeState(w, state)
+}
+
+// dumpBlocks returns the files of dir, which may not exist yet, with their
+// records.
+func dumpBlocks(dir string, records map[string]json.RawMessage) ([]blockState, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var blocks []blockState
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		b := blockState{Name: e.Name(), SizeBytes: e.Size(), Record: records[e.Name()]}
+		if st, ok := e.Sys().(*syscall.Stat_t); ok {
+			b.AllocatedBytes = st.Blocks * 512
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// DumpState writes the files of the blocks and volumes dirs with their sizes
+// and their records in the daemon db, and the counts of the volumes held by
+// the prepared containers.
+func (s *RawBlockStorage) DumpState(w io.Writer) error {
+	state := &rawBlockState{
+		Driver:     s.Type(),
+		RootPath:   s.RootPath(),
+		VolumeRefs: s.volumeRefCounts(),
+	}
+	containers := make(map[string]json.RawMessage)
+	volumes := make(map[string]json.RawMessage)
+	var blocksErr, volumesErr error
+	if s.db != nil {
+		ids, err := pod.ListContainerMountIds(s.db)
+		for _, id := range ids {
+			containers[id] = json.RawMessage("true")
+		}
+		blocksErr = err
+		// the channel is drained to the end, its producer would block otherwise
+		for kv := range s.db.ListAllVolumes() {
+			if kv == nil {
+				volumesErr = fmt.Errorf("failed to list the volume records")
+				continue
+			}
+			name := parseVolumeRecord(kv.V).Name
+			block := filepath.Base(s.volumePath(recordPodId(kv.K, name), name))
+			volumes[block] = json.RawMessage(kv.V)
+		}
+	}
+	var err error
+	if state.Blocks, err = dumpBlocks(filepath.Join(s.RootPath(), "blocks"), containers); err != nil {
+		blocksErr = err
+	}
+	if state.Volumes, err = dumpBlocks(filepath.Join(s.RootPath(), "volumes"), volumes); err != nil {
+		volumesErr = err
+	}
+	state.BlocksError, state.VolumesError = errorString(blocksErr), errorString(volumesErr)
+	return writeState(w, state)
+}
+
+// DumpStorageState writes the state of the storage driver, for debugging.
+func (daemon *Daemon) DumpStorageState(w io.Writer) error {
+	return daemon.Storage.DumpState(w)
+}
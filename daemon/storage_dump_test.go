@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockDumpState(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{db: db, rootPath: filepath.Join(root, "rawblock")}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "data", SizeBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	var noErr error
+	s.takeVolumes("container1", storage.ContainerOptions{PodID: podId, Volumes: []string{"data"}}, &noErr)
+
+	var buf bytes.Buffer
+	if err := s.DumpState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var state rawBlockState
+	if err := json.Unmarshal(buf.Bytes(), &state); err != nil {
+		t.Fatalf("the dump should be json: %v\n%s", err, buf.String())
+	}
+	if state.Driver != "rawblock" || state.RootPath != s.RootPath() || state.BlocksError != "" || state.VolumesError != "" {
+		t.Fatalf("unexpected dump %s", buf.String())
+	}
+	if state.VolumeRefs[volumeID(podId, "data")] != 1 {
+		t.Fatalf("the dump should count the container holding the volume, got %v", state.VolumeRefs)
+	}
+	name := filepath.Base(s.volumePath(podId, "data"))
+	var found bool
+	for _, v := range state.Volumes {
+		if v.Name != name {
+			continue
+		}
+		found = true
+		var record apitypes.UserVolume
+		if err := json.Unmarshal(v.Record, &record); err != nil || record.Name != "data" {
+			t.Fatalf("the volume should be dumped with its record, got %s: %v", v.Record, err)
+		}
+		if v.SizeBytes != 1<<20 {
+			t.Fatalf("the volume should be dumped with its size, got %d", v.SizeBytes)
+		}
+	}
+	if !found {
+		t.Fatalf("the volume should be dumped, got %s", buf.String())
+	}
+}
+
+func TestOverlayFsDumpState(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	o := &OverlayFsStorage{rootPath: root}
+	var buf bytes.Buffer
+	if err := o.DumpState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var state overlayState
+	if err := json.Unmarshal(buf.Bytes(), &state); err != nil {
+		t.Fatalf("the dump should be json: %v\n%s", err, buf.String())
+	}
+	if state.Driver != "overlay" || state.RootPath != root || len(state.Mounts) != 0 {
+		t.Fatalf("unexpected dump %s", buf.String())
+	}
+}
@@ -0,0 +1,112 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// zeroChunk is the size of the writes overwriting a file with zeros.
+const zeroChunk = 1 << 20
+
+// zeroFile overwrites the whole size of the file with zeros, and syncs it so
+// the zeros reach the disk before the file is removed.
+func zeroFile(ctx context.Context, p string) error {
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, zeroChunk)
+	for left := fi.Size(); left > 0; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return fmt.Errorf("failed to overwrite %s: %v", p, err)
+		}
+		left -= n
+	}
+	return f.Sync()
+}
+
+// shredTree overwrites every regular file under dir with shred, the files are
+// kept for the caller to remove.
+func shredTree(ctx context.Context, dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if out, err := execCommand(ctx, "shred", "--iterations=1", "--zero", p).CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to shred %s: %v, %s", p, err, out)
+		}
+		return nil
+	})
+}
+
+// secureErase runs erase, which may take long on large volumes, until it is
+// done or ctx is. The erase is skipped with a warning once ctx is done, the
+// caller goes on removing the data; any other failure is returned.
+func secureErase(ctx context.Context, what string, erase func(context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- erase(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || ctx.Err() == nil {
+			return err
+		}
+	case <-ctx.Done():
+		// erase gives up on its own once ctx is done
+		<-done
+	}
+	glog.Warningf("secure erase of %s skipped: %v", what, ctx.Err())
+	return nil
+}
+
+// eraseFiles zeroes the files of paths, the missing ones are ignored.
+func eraseFiles(ctx context.Context, paths ...string) error {
+	for _, p := range paths {
+		err := zeroFile(ctx, p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotFiles returns the files of the snapshots kept in dir.
+func snapshotFiles(dir string) []string {
+	var files []string
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files
+}
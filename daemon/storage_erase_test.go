@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+// erased fails unless the file p links to holds zeros only.
+func erased(t *testing.T, p string) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || bytes.Count(data, []byte{0}) != len(data) {
+		t.Fatalf("expected %s overwritten with zeros, got %q", p, data)
+	}
+}
+
+func TestRawBlockSecureRemove(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	s := &RawBlockStorage{rootPath: root, SecureRemove: true}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	if err := ioutil.WriteFile(block, bytes.Repeat([]byte("secret"), zeroChunk/3), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snap := s.snapshotPath(podId, "vol1", "snap1")
+	if err := os.MkdirAll(filepath.Dir(snap), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(snap, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the links keep the inodes, and so the content, of the removed files
+	for _, p := range []string{block, snap} {
+		if err := os.Link(p, filepath.Join(root, filepath.Base(p)+".link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(block); !os.IsNotExist(err) {
+		t.Fatalf("the block should be removed: %v", err)
+	}
+	erased(t, filepath.Join(root, filepath.Base(block)+".link"))
+	erased(t, filepath.Join(root, "snap1.link"))
+
+	// the erase is skipped, not the removal, once the context is done
+	block = s.volumePath(podId, "vol2")
+	if err := ioutil.WriteFile(block, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.RemoveVolume(ctx, podId, []byte("vol2")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(block); !os.IsNotExist(err) {
+		t.Fatalf("the block should be removed: %v", err)
+	}
+}
+
+func TestOverlayFsSecureRemove(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	o := &OverlayFsStorage{rootPath: root, SecureRemove: true}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+	if err := os.Mkdir(filepath.Join(spec.Source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(spec.Source, "dir", "data")
+	if err := ioutil.WriteFile(data, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.SnapshotVolume(context.Background(), podId, "vol1", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"volume.link":   data,
+		"snapshot.link": filepath.Join(storage.VFSSnapshotPath(o.vfsVolumeRoot(), podId, "vol1", "snap1"), "dir", "data"),
+	}
+	for link, p := range links {
+		if err := os.Link(p, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := o.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(spec.Source); !os.IsNotExist(err) {
+		t.Fatalf("the volume should be removed: %v", err)
+	}
+	for link := range links {
+		erased(t, filepath.Join(root, link))
+	}
+}
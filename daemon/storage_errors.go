@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// StorageError is the error of an operation of a storage driver, the error
+// which made it fail is kept as Err.
+type StorageError struct {
+	// Op is the operation of the Storage, e.g. "PrepareContainer".
+	Op     string
+	Driver string
+	// ID is the container, or the "<podId>/<volume>", operated on.
+	ID  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("%s storage: %s: %v", e.Driver, e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s storage: %s %s: %v", e.Driver, e.Op, e.ID, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// wrapStorageError turns the error returned by an operation into a
+// *StorageError, it is deferred with the named error result of the operation.
+func wrapStorageError(err *error, driver, op, id string) {
+	if *err == nil {
+		return
+	}
+	if _, ok := (*err).(*StorageError); ok {
+		return
+	}
+	*err = &StorageError{Op: op, Driver: driver, ID: id, Err: *err}
+}
+
+// StorageInitError is the error of a driver which can not work as a tool it
+// runs is not installed on the host.
+type StorageInitError struct {
+	Driver string
+	// Tool is the command which is not found in the PATH, e.g. "mkfs.xfs".
+	Tool string
+	// Package is the package of the usual distributions providing Tool.
+	Package string
+	Err     error
+}
+
+func (e *StorageInitError) Error() string {
+	return fmt.Sprintf("the %s storage needs %s, which is not found in the PATH (%v), install the %s package", e.Driver, e.Tool, e.Err, e.Package)
+}
+
+func (e *StorageInitError) Unwrap() error {
+	return e.Err
+}
+
+// lookTool looks for the tool a driver needs in the PATH, it returns a
+// *StorageInitError naming pkg if missing.
+func lookTool(s Storage, tool, pkg string) error {
+	if _, err := exec.LookPath(tool); err != nil {
+		return &StorageInitError{Driver: s.Type(), Tool: tool, Package: pkg, Err: err}
+	}
+	return nil
+}
+
+func volumeID(podId, volName string) string {
+	return podId + "/" + volName
+}
+
+// IsNotFound tells whether the volume, snapshot or file an operation works on
+// does not exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// IsDeviceBusy tells whether an operation failed as the volume or the mount
+// of the container is still in use.
+func IsDeviceBusy(err error) bool {
+	return errors.Is(err, ErrVolumeInUse) || errors.Is(err, syscall.EBUSY)
+}
+
+// IsNoSpace tells whether an operation failed as the backing filesystem is
+// full, or the quota is exceeded, or would be by the volume.
+func IsNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || errors.Is(err, ErrInsufficientStorage)
+}
+
+// unsupportedFeature is the error of asking s for a feature its capabilities
+// lack.
+func unsupportedFeature(s Storage, feature string) error {
+	return fmt.Errorf("the %s storage does not support %s: %w", s.Type(), feature, ErrNotSupported)
+}
+
+// IsNotSupported tells whether the operation is not supported by the driver.
+func IsNotSupported(err error) bool {
+	return errors.Is(err, ErrNotSupported)
+}
+
+// IsReadOnly tells whether an operation failed as it would write to a
+// read-only container or volume.
+func IsReadOnly(err error) bool {
+	return errors.Is(err, ErrReadOnly) || errors.Is(err, syscall.EROFS)
+}
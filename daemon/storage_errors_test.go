@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStorageErrors(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	podId := testPodId(t)
+
+	o := &OverlayFsStorage{rootPath: root}
+	err = o.ResizeVolume(ctx, podId, "vol1", 8192)
+	var serr *StorageError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a StorageError, got %#v", err)
+	}
+	if serr.Op != "ResizeVolume" || serr.Driver != "overlay" || serr.ID != podId+"/vol1" || serr.Err != ErrNotSupported {
+		t.Fatalf("unexpected StorageError %#v", serr)
+	}
+	if !IsNotSupported(err) || IsNotFound(err) || IsDeviceBusy(err) {
+		t.Fatalf("wrong category of %v", err)
+	}
+
+	s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+	if err := os.MkdirAll(filepath.Join(root, "volumes"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = s.ResizeVolume(ctx, podId, "missing", 8192)
+	if !errors.As(err, &serr) || serr.Op != "ResizeVolume" || serr.Driver != "rawblock" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if !IsNotFound(err) {
+		t.Fatalf("a missing volume should be not found, got %v", err)
+	}
+	if err := s.SnapshotVolume(ctx, podId, "missing", "snap1"); !IsNotFound(err) {
+		t.Fatalf("snapshotting a missing volume should be not found, got %v", err)
+	}
+
+	block := s.volumePath(podId, "vol1")
+	if err := ioutil.WriteFile(block, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RemoveVolume(ctx, podId, []byte("vol1"))
+	f.Close()
+	if !IsDeviceBusy(err) {
+		t.Fatalf("removing an opened volume should be busy, got %v", err)
+	}
+	if !errors.As(err, &serr) || serr.Op != "RemoveVolume" || serr.ID != podId+"/vol1" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	if !IsDeviceBusy(&StorageError{Err: syscall.EBUSY}) || !IsNoSpace(&StorageError{Err: &os.PathError{Op: "write", Path: block, Err: syscall.ENOSPC}}) {
+		t.Fatal("the errno of the StorageError is not categorized")
+	}
+}
@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// StorageEventType is the kind of a volume lifecycle event.
+type StorageEventType int
+
+const (
+	// VolumeCreated is sent once a volume is created.
+	VolumeCreated StorageEventType = iota
+	// VolumeRemoved is sent once a volume is removed.
+	VolumeRemoved
+	// ContainerPrepared is sent once the rootfs of a container is mounted.
+	ContainerPrepared
+	// ContainerCleanedUp is sent once the rootfs of a container is unmounted.
+	ContainerCleanedUp
+	// DriverFailure is sent once the driver failed its health checks, the
+	// event has neither PodID nor VolumeName.
+	DriverFailure
+)
+
+func (t StorageEventType) String() string {
+	switch t {
+	case VolumeCreated:
+		return "VolumeCreated"
+	case VolumeRemoved:
+		return "VolumeRemoved"
+	case ContainerPrepared:
+		return "ContainerPrepared"
+	case ContainerCleanedUp:
+		return "ContainerCleanedUp"
+	case DriverFailure:
+		return "DriverFailure"
+	}
+	return "Unknown"
+}
+
+// StorageEvent is sent by the storage drivers on the success of an operation.
+// The container events have no PodID and the container id as VolumeName.
+type StorageEvent struct {
+	Type       StorageEventType
+	Driver     string
+	PodID      string
+	VolumeName string
+	Timestamp  time.Time
+}
+
+// storageEventBuffer is the number of events a subscriber may fall behind
+// before the next ones are dropped.
+const storageEventBuffer = 64
+
+// StorageEventBus fans the events of the storage drivers out to the
+// subscribers. The events are never blocked on a slow subscriber, they are
+// dropped once its channel is full.
+type StorageEventBus struct {
+	sync.Mutex
+	subscribers map[<-chan StorageEvent]chan StorageEvent
+}
+
+func NewStorageEventBus() *StorageEventBus {
+	return &StorageEventBus{
+		subscribers: make(map[<-chan StorageEvent]chan StorageEvent),
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on, in
+// their order.
+func (b *StorageEventBus) Subscribe() <-chan StorageEvent {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan StorageEvent, storageEventBuffer)
+	b.subscribers[ch] = ch
+	return ch
+}
+
+// Unsubscribe stops sending the events to ch and closes it.
+func (b *StorageEventBus) Unsubscribe(ch <-chan StorageEvent) {
+	b.Lock()
+	defer b.Unlock()
+	if sub, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(sub)
+	}
+}
+
+// Publish sends ev to every subscriber, it does nothing on a nil bus.
+func (b *StorageEventBus) Publish(ev StorageEvent) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	for _, sub := range b.subscribers {
+		select {
+		case sub <- ev:
+		default:
+			glog.Warningf("storage event %s of %s dropped, the subscriber is too slow", ev.Type, ev.VolumeName)
+		}
+	}
+}
+
+// storageEvents is embedded by the drivers publishing their events.
+type storageEvents struct {
+	// EventBus receives the events of the driver when set.
+	EventBus *StorageEventBus
+	driver   string
+}
+
+func (e *storageEvents) setEventBus(bus *StorageEventBus, driver string) {
+	e.EventBus, e.driver = bus, driver
+}
+
+// emit publishes an event unless the operation failed, it is deferred with
+// the named error result of the operation.
+func (e *storageEvents) emit(typ StorageEventType, podId, volName string, err *error) {
+	if *err != nil {
+		return
+	}
+	e.EventBus.Publish(StorageEvent{
+		Type:       typ,
+		Driver:     e.driver,
+		PodID:      podId,
+		VolumeName: volName,
+		Timestamp:  time.Now(),
+	})
+}
+
+// eventSource is implemented by the drivers embedding storageEvents.
+type eventSource interface {
+	setEventBus(bus *StorageEventBus, driver string)
+}
+
+// attachEventBus makes s publish its events on bus, the drivers which do not
+// publish events are left as they are.
+func attachEventBus(s Storage, bus *StorageEventBus) {
+	if src, ok := s.(eventSource); ok {
+		src.setEventBus(bus, s.Type())
+	}
+}
@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestStorageEventBus(t *testing.T) {
+	bus := NewStorageEventBus()
+	kept, dropped := bus.Subscribe(), bus.Subscribe()
+
+	for _, name := range []string{"vol1", "vol2", "vol3"} {
+		bus.Publish(StorageEvent{Type: VolumeCreated, VolumeName: name})
+	}
+	for _, ch := range []<-chan StorageEvent{kept, dropped} {
+		for _, name := range []string{"vol1", "vol2", "vol3"} {
+			if ev := <-ch; ev.VolumeName != name {
+				t.Fatalf("expected the event of %s, got %v", name, ev)
+			}
+		}
+	}
+
+	bus.Unsubscribe(dropped)
+	bus.Publish(StorageEvent{Type: VolumeRemoved, VolumeName: "vol1"})
+	if ev, ok := <-dropped; ok {
+		t.Fatalf("an unsubscribed channel should receive no event, got %v", ev)
+	}
+	if ev := <-kept; ev.Type != VolumeRemoved {
+		t.Fatalf("expected the removal, got %v", ev)
+	}
+	// unsubscribing twice is harmless
+	bus.Unsubscribe(dropped)
+
+	// a slow subscriber misses the events instead of blocking the drivers
+	for i := 0; i < storageEventBuffer+1; i++ {
+		bus.Publish(StorageEvent{Type: VolumeCreated})
+	}
+	if len(kept) != storageEventBuffer {
+		t.Fatalf("expected %d buffered events, got %d", storageEventBuffer, len(kept))
+	}
+}
+
+func TestStorageEvents(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	o := &OverlayFsStorage{rootPath: root}
+	RegisterDriver("test-events", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return o, nil
+	})
+	defer unregisterDriver("test-events")
+	config := &StorageConfig{}
+	if _, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "test-events"}, nil, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Events == nil || o.EventBus != config.Events {
+		t.Fatal("the driver should publish on the bus of the config")
+	}
+	events := config.Events.Subscribe()
+	defer config.Events.Unsubscribe(events)
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+	if err := o.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	// a failed operation sends no event
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := o.PrepareContainer(ctx, "c1", root, storage.ContainerOptions{}); err == nil {
+		t.Fatal("prepare container should fail once the context is done")
+	}
+
+	for _, typ := range []StorageEventType{VolumeCreated, VolumeRemoved} {
+		ev := <-events
+		if ev.Type != typ || ev.Driver != "overlay" || ev.PodID != podId || ev.VolumeName != "vol1" || ev.Timestamp.IsZero() {
+			t.Fatalf("expected the %s event of vol1, got %v", typ, ev)
+		}
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no more events, got %v", <-events)
+	}
+}
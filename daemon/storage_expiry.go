@@ -0,0 +1,133 @@
+package daemon
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"golang.org/x/net/context"
+)
+
+// ExpiringStorage removes the volumes of the wrapped Storage once their
+// ExpiresAt has passed. The volumes are found from the records the drivers
+// keep in the db, so the drivers which keep none never expire their volumes.
+// The removals are audited as ExpireVolume when an AuditLog is given, they
+// do not go through the AuditedStorage wrapping this one.
+type ExpiringStorage struct {
+	Storage
+	db    *daemondb.DaemonDB
+	audit AuditLog
+	// interval between two lookups of the expired volumes
+	interval time.Duration
+
+	sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewExpiringStorage(s Storage, db *daemondb.DaemonDB, audit AuditLog) *ExpiringStorage {
+	return &ExpiringStorage{
+		Storage:  s,
+		db:       db,
+		audit:    audit,
+		interval: time.Minute,
+	}
+}
+
+// Init initializes the wrapped Storage, then starts removing the expired
+// volumes in the background.
+func (e *ExpiringStorage) Init(ctx context.Context) error {
+	if err := e.Storage.Init(ctx); err != nil {
+		return err
+	}
+	e.Lock()
+	defer e.Unlock()
+	if e.stop != nil {
+		return nil
+	}
+	e.stop, e.done = make(chan struct{}), make(chan struct{})
+	go e.loop(e.stop, e.done)
+	return nil
+}
+
+// CleanUp stops removing the expired volumes, then cleans the wrapped Storage
+// up.
+func (e *ExpiringStorage) CleanUp(ctx context.Context) error {
+	e.Lock()
+	if e.stop != nil {
+		close(e.stop)
+		<-e.done
+		e.stop, e.done = nil, nil
+	}
+	e.Unlock()
+	return e.Storage.CleanUp(ctx)
+}
+
+func (e *ExpiringStorage) loop(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	// the volumes may have expired while the daemon was down
+	e.removeExpired(time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			e.removeExpired(now)
+		}
+	}
+}
+
+// removeExpired removes the volumes expired at now. A volume which can not be
+// removed, e.g. still in use, is tried again the next time.
+func (e *ExpiringStorage) removeExpired(now time.Time) []string {
+	var removed []string
+	for kv := range e.db.ListAllVolumes() {
+		if kv == nil {
+			glog.Warning("failed to list the volumes, some expired volumes may be kept")
+			continue
+		}
+		vol := parseVolumeRecord(kv.V)
+		if vol.ExpiresAt == 0 || now.Before(time.Unix(vol.ExpiresAt, 0)) {
+			continue
+		}
+		podId := recordPodId(kv.K, vol.Name)
+		err := e.Storage.RemoveVolume(context.Background(), podId, kv.V)
+		if e.audit != nil {
+			appendAudit(e.audit, context.Background(), "ExpireVolume", e.Type(), podId, vol.Name, err)
+		}
+		if err != nil {
+			glog.Warningf("failed to remove the expired volume %s of pod %s: %v", vol.Name, podId, err)
+			continue
+		}
+		glog.Infof("removed the volume %s of pod %s, expired at %s", vol.Name, podId, time.Unix(vol.ExpiresAt, 0))
+		removed = append(removed, volumeID(podId, vol.Name))
+	}
+	return removed
+}
+
+// SetVolumeExpiry sets the time the volume of the pod is removed at, the zero
+// time keeps it.
+func (daemon *Daemon) SetVolumeExpiry(podId, volName string, expiresAt time.Time) error {
+	p, ok := daemon.PodList.Get(podId)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", podId)
+	}
+	record, err := daemon.db.GetPodVolume(p.Id(), volName)
+	if err != nil {
+		return fmt.Errorf("cannot find volume %s of pod %s: %v", volName, p.Id(), err)
+	}
+	// the records which are not json carry the name only
+	if len(record) == 0 || record[0] != '{' {
+		return fmt.Errorf("volume %s of pod %s can not expire: %v", volName, p.Id(), ErrNotSupported)
+	}
+	vol := parseVolumeRecord(record)
+	vol.ExpiresAt = 0
+	if !expiresAt.IsZero() {
+		vol.ExpiresAt = expiresAt.Unix()
+	}
+	return saveVolumeRecord(context.Background(), daemon.db, p.Id(), vol)
+}
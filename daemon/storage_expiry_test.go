@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestExpiringStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	podId := testPodId(t)
+	vols := []*apitypes.UserVolume{
+		{Name: "expired", ExpiresAt: now.Add(-time.Minute).Unix()},
+		{Name: "kept"},
+		{Name: "later", ExpiresAt: now.Add(time.Hour).Unix()},
+	}
+	for _, vol := range vols {
+		if err := saveVolumeRecord(context.Background(), db, podId, vol); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mock := NewMockStorage()
+	log := &memoryAuditLog{}
+	e := NewExpiringStorage(mock, db, log)
+	removed := e.removeExpired(now)
+	if len(removed) != 1 || removed[0] != volumeID(podId, "expired") {
+		t.Fatalf("expected the expired volume removed, got %v", removed)
+	}
+	if ops := log.operations(); len(ops) != 1 || ops[0] != "ExpireVolume:"+volumeID(podId, "expired") {
+		t.Fatalf("expected the removal of the expired volume audited, got %v", ops)
+	}
+	calls := mock.Calls("RemoveVolume")
+	if len(calls) != 1 || calls[0].Args[0] != podId {
+		t.Fatalf("expected the expired volume removed from the storage, got %v", calls)
+	}
+
+	// a volume which can not be removed is tried again
+	mock.SetError("RemoveVolume", ErrVolumeInUse)
+	if removed := e.removeExpired(now.Add(2 * time.Hour)); len(removed) != 0 {
+		t.Fatalf("no volume should be removed while in use, got %v", removed)
+	}
+	if entry := log.entries[len(log.entries)-1]; entry.Operation != "ExpireVolume" || entry.Error == "" {
+		t.Fatalf("expected the failed removal audited, got %v", entry)
+	}
+	mock.SetError("RemoveVolume", nil)
+	if removed := e.removeExpired(now.Add(2 * time.Hour)); len(removed) != 2 {
+		t.Fatalf("expected the expired volumes removed, got %v", removed)
+	}
+
+	e.interval = 10 * time.Millisecond
+	if err := e.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mock.Calls("RemoveVolume")) < 7 {
+		if time.Now().After(deadline) {
+			t.Fatal("the expired volumes should be removed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := e.CleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := len(mock.Calls("RemoveVolume"))
+	time.Sleep(50 * time.Millisecond)
+	if calls := mock.Calls("RemoveVolume"); len(calls) != stopped {
+		t.Fatalf("no volume should be removed once cleaned up, got %d more", len(calls)-stopped)
+	}
+}
@@ -0,0 +1,225 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// exportVFSVolume archives a snapshot of the volume, so that the pod may keep
+// changing it while dst is written.
+func exportVFSVolume(ctx context.Context, root, podId, volName string, dst io.Writer) error {
+	if _, err := os.Stat(storage.VFSVolumePath(root, podId, volName)); err != nil {
+		return err
+	}
+	// a dot name can not clash with the snapshots of the user
+	snapshot := fmt.Sprintf(".export-%d", time.Now().UnixNano())
+	if err := storage.SnapshotVFSVolume(root, podId, volName, snapshot); err != nil {
+		return err
+	}
+	snap := storage.VFSSnapshotPath(root, podId, volName, snapshot)
+	defer func() {
+		os.RemoveAll(snap)
+		// drop the snapshot directories unless the user has snapshots
+		os.Remove(filepath.Dir(snap))
+		os.Remove(filepath.Dir(filepath.Dir(snap)))
+	}()
+	return storage.TarDir(ctx, snap, dst)
+}
+
+// importVFSVolume extracts the archive next to the volume and replaces the
+// volume with it once complete.
+func importVFSVolume(ctx context.Context, root, podId, volName string, src io.Reader) error {
+	vol := storage.VFSVolumePath(root, podId, volName)
+	if _, err := os.Stat(vol); err != nil {
+		return err
+	}
+	if storage.PathInUse(vol) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to import into it", volName, podId)
+		return ErrVolumeInUse
+	}
+	tmp := storage.VFSVolumePath(root, podId, "."+volName+".import")
+	os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0777); err != nil {
+		return err
+	}
+	if err := storage.UntarDir(ctx, src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return storage.ReplacePath(tmp, vol)
+}
+
+// blockDevice returns what the block of the volume is opened from: its
+// dm-crypt device when encrypted, its loop device when throttled, or the block
+// itself.
+func (s *RawBlockStorage) blockDevice(block string) string {
+	if id, _ := luksUUID(block); id != "" {
+		return luksDevice(id)
+	}
+	if target, err := filepath.EvalSymlinks(s.deviceLink(filepath.Base(block))); err == nil {
+		return target
+	}
+	return block
+}
+
+// mountBlock mounts the filesystem of the volume from device, a block file is
+// mounted through a loop device.
+func (s *RawBlockStorage) mountBlock(ctx context.Context, device, mnt string, readonly bool) error {
+	var options []string
+	if fi, err := os.Stat(device); err == nil && fi.Mode().IsRegular() {
+		options = append(options, "loop")
+	}
+	if readonly {
+		options = append(options, "ro")
+	}
+	if s.Filesystem == "xfs" {
+		// the blocks copied from the volume have the same uuid
+		options = append(options, "nouuid")
+	}
+	args := []string{"-t", s.Filesystem}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	if out, err := execCommand(ctx, "mount", append(args, device, mnt)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount %s to %s: %v: %s", device, mnt, err, out)
+	}
+	return nil
+}
+
+// unmountBlock unmounts and removes mnt, even once the context of the
+// operation is done.
+func unmountBlock(mnt string) {
+	if out, err := execCommand(context.Background(), "umount", "-d", mnt).CombinedOutput(); err != nil {
+		glog.Errorf("failed to unmount %s: %v: %s", mnt, err, out)
+		return
+	}
+	os.Remove(mnt)
+}
+
+// ExportVolume mounts the block of the volume readonly and archives its
+// content. The block of a volume attached to a sandbox is copied first, and
+// the copy is mounted instead, replaying its journal.
+func (s *RawBlockStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) (err error) {
+	defer wrapStorageError(&err, s.Type(), "ExportVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+	device, readonly := s.blockDevice(block), true
+	if storage.PathInUse(block) || storage.PathInUse(device) {
+		// the copy of an encrypted block could only be opened with its key
+		if id, _ := luksUUID(block); id != "" {
+			glog.Warningf("encrypted volume %s of pod %s is still in use, refuse to export it", volName, podId)
+			return ErrVolumeInUse
+		}
+		copy := filepath.Join(filepath.Dir(block), "."+filepath.Base(block)+".export")
+		if err := s.copyBlock(ctx, block, copy); err != nil {
+			return err
+		}
+		defer os.Remove(copy)
+		device, readonly = copy, false
+	}
+	mnt, err := ioutil.TempDir(filepath.Dir(block), ".export-")
+	if err != nil {
+		return err
+	}
+	if err := s.mountBlock(ctx, device, mnt, readonly); err != nil {
+		os.Remove(mnt)
+		return err
+	}
+	defer unmountBlock(mnt)
+	return storage.TarDir(ctx, mnt, dst)
+}
+
+// ImportVolume replaces the content of the filesystem of the volume with the
+// archive, which is extracted aside first so that a broken archive leaves the
+// volume as it was.
+func (s *RawBlockStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer wrapStorageError(&err, s.Type(), "ImportVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+	device := s.blockDevice(block)
+	if storage.PathInUse(block) || storage.PathInUse(device) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to import into it", volName, podId)
+		return ErrVolumeInUse
+	}
+	mnt, err := ioutil.TempDir(filepath.Dir(block), ".import-")
+	if err != nil {
+		return err
+	}
+	if err := s.mountBlock(ctx, device, mnt, false); err != nil {
+		os.Remove(mnt)
+		return err
+	}
+	defer unmountBlock(mnt)
+	return replaceDirContent(ctx, mnt, src)
+}
+
+// replaceDirContent extracts the archive into a directory of dir, then
+// replaces the other entries of dir with the extracted ones.
+func replaceDirContent(ctx context.Context, dir string, src io.Reader) error {
+	tmp, err := ioutil.TempDir(dir, ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := storage.UntarDir(ctx, src, tmp); err != nil {
+		return err
+	}
+
+	old, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range old {
+		// lost+found belongs to the filesystem
+		if e.Name() == filepath.Base(tmp) || e.Name() == "lost+found" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == "lost+found" {
+			continue
+		}
+		if err := os.Rename(filepath.Join(tmp, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	// the root of the archive gives the mode and the owner of dir
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, fi.Mode()); err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(dir, int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestOverlayFsExportImportVolume(t *testing.T) {
+	o := &OverlayFsStorage{}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+
+	vol := spec.Source
+	if err := os.MkdirAll(filepath.Join(vol, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vol, "dir", "data"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(filepath.Join(vol, "dir", "data"), 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(vol, "dir", "data"), filepath.Join(vol, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/data", filepath.Join(vol, "symlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := o.ExportVolume(context.Background(), podId, "vol1", &archive); err != nil {
+		t.Fatalf("export volume failed: %v", err)
+	}
+	if _, err := os.Stat(storage.VFSSnapshotPath(o.vfsVolumeRoot(), podId, "vol1", "")); !os.IsNotExist(err) {
+		t.Fatalf("the export snapshot should be removed: %v", err)
+	}
+
+	if err := os.RemoveAll(vol); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(vol, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vol, "stale"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.ImportVolume(context.Background(), podId, "vol1", &archive); err != nil {
+		t.Fatalf("import volume failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(vol, "stale")); !os.IsNotExist(err) {
+		t.Fatal("the import should replace the content of the volume")
+	}
+	fi, err := os.Stat(filepath.Join(vol, "dir"))
+	if err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("unexpected dir %v: %v", fi, err)
+	}
+	fi, err = os.Stat(filepath.Join(vol, "dir", "data"))
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected file %v: %v", fi, err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 || st.Nlink != 2 {
+		t.Fatalf("expected the file owned by 1000:1000 with 2 links, got %d:%d with %d", st.Uid, st.Gid, st.Nlink)
+	}
+	if link, err := os.Readlink(filepath.Join(vol, "symlink")); err != nil || link != "dir/data" {
+		t.Fatalf("unexpected symlink %q: %v", link, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(vol, "hardlink")); string(data) != "content" {
+		t.Fatalf("unexpected content %q", data)
+	}
+
+	if err := o.ImportVolume(context.Background(), podId, "vol2", &archive); err == nil {
+		t.Fatal("importing into a missing volume should fail")
+	}
+	b := &BtrfsStorage{}
+	if err := b.ExportVolume(context.Background(), podId, "vol1", &archive); !IsNotSupported(err) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestUntarDirEscape(t *testing.T) {
+	src, err := ioutil.TempDir("", "archive-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "archive-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// a symlink out of the directory, then an entry through it
+	if err := os.Symlink("/tmp", filepath.Join(src, "out")); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := storage.TarDir(context.Background(), src, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(src, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "out", "escaped"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var second bytes.Buffer
+	if err := storage.TarDir(context.Background(), src, &second); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UntarDir(context.Background(), &archive, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UntarDir(context.Background(), &second, dst); err == nil {
+		t.Fatal("an entry through a symlink out of the directory should fail")
+	}
+	if _, err := os.Stat("/tmp/escaped"); !os.IsNotExist(err) {
+		os.Remove("/tmp/escaped")
+		t.Fatal("the entry escaped the directory")
+	}
+}
+
+func TestRawBlockExportVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	log := filepath.Join(root, "log")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	s := &RawBlockStorage{rootPath: root, Filesystem: "ext4"}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	if err := ioutil.WriteFile(block, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := s.ExportVolume(context.Background(), podId, "vol1", &archive); err != nil {
+		t.Fatalf("export volume failed: %v", err)
+	}
+	data, _ := ioutil.ReadFile(log)
+	if !strings.Contains(string(data), "mount -t ext4 -o loop,ro "+block+" ") {
+		t.Fatalf("expected the block mounted readonly, got %q", data)
+	}
+	if !strings.Contains(string(data), "umount -d ") {
+		t.Fatalf("expected the block unmounted, got %q", data)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Dir(block))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".export-") {
+			t.Fatalf("the mount point %s should be removed", e.Name())
+		}
+	}
+
+	if err := s.ExportVolume(context.Background(), podId, "vol2", &archive); err == nil {
+		t.Fatal("exporting a missing volume should fail")
+	}
+}
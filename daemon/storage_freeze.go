@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// A filesystem is frozen with the FIFREEZE ioctl on its mount point: the
+// kernel flushes it and blocks its writers until FITHAW, so that a copy of
+// its device taken meanwhile is as consistent as after a clean unmount. Only
+// the filesystems mounted on the host can be frozen so, those of the volumes
+// attached to a sandbox are frozen by its guest.
+
+const (
+	ioctlFifreeze = 0xc0045877
+	ioctlFithaw   = 0xc0045878
+)
+
+func ioctlMountPoint(mnt string, req uintptr) error {
+	f, err := os.Open(mnt)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := ioctl(f.Fd(), req, 0); err != nil {
+		return &os.PathError{Op: "ioctl", Path: mnt, Err: err}
+	}
+	return nil
+}
+
+// SnapshotConsistentVolume freezes the volume while taking its snapshot, so
+// that the snapshot holds no half written file. The volume is thawed whether
+// the snapshot succeeds or not, even once ctx is done.
+func SnapshotConsistentVolume(ctx context.Context, s Storage, podId, volName, snapshot string) (err error) {
+	if err := s.FreezeVolume(ctx, podId, volName); err != nil {
+		return err
+	}
+	defer func() {
+		if thawErr := s.ThawVolume(context.Background(), podId, volName); thawErr != nil {
+			glog.Errorf("failed to thaw volume %s of pod %s: %v", volName, podId, thawErr)
+			if err == nil {
+				err = thawErr
+			}
+		}
+	}()
+	return s.SnapshotVolume(ctx, podId, volName, snapshot)
+}
+
+// FreezeVolume does nothing, the snapshots of the volumes are copies of
+// directories which are not consistent anyway.
+func (o *OverlayFsStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return nil
+}
+
+func (o *OverlayFsStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return nil
+}
+
+// hostMount returns the mount point of the filesystem of the block on the
+// host, or "" if it is not mounted.
+func (s *RawBlockStorage) hostMount(ctx context.Context, block string) (string, error) {
+	device := s.blockDevice(block)
+	if device == block {
+		loop, err := loopDevice(ctx, block)
+		if err != nil || loop == "" {
+			return "", err
+		}
+		device = loop
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(device, &st); err != nil {
+		return "", err
+	}
+	major := int((st.Rdev >> 8) & 0xfff)
+	minor := int((st.Rdev & 0xff) | ((st.Rdev >> 12) & 0xfff00))
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if m.Major == major && m.Minor == minor && m.Root == "/" {
+			return m.Mountpoint, nil
+		}
+	}
+	return "", nil
+}
+
+// FreezeVolume freezes the filesystem of the volume where it is mounted on
+// the host. SnapshotVolume copies the block of a frozen volume even though it
+// is in use.
+func (s *RawBlockStorage) FreezeVolume(ctx context.Context, podId, volName string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "FreezeVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	if _, err := os.Stat(block); err != nil {
+		return err
+	}
+	if s.frozenMount(block) != "" {
+		return fmt.Errorf("volume %s of pod %s is already frozen", volName, podId)
+	}
+	mnt, err := s.hostMount(ctx, block)
+	if err != nil {
+		return err
+	} else if mnt == "" {
+		return unsupportedFeature(s, "freezing the volumes which are not mounted on the host")
+	}
+	if err := ioctlMountPoint(mnt, ioctlFifreeze); err != nil {
+		return err
+	}
+	s.frozenLock.Lock()
+	defer s.frozenLock.Unlock()
+	if s.frozen == nil {
+		s.frozen = make(map[string]string)
+	}
+	s.frozen[block] = mnt
+	return nil
+}
+
+// ThawVolume thaws the filesystem of the volume, it is looked for again if
+// the volume was not frozen by this driver, e.g. before hyperd restarted.
+func (s *RawBlockStorage) ThawVolume(ctx context.Context, podId, volName string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "ThawVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	mnt := s.frozenMount(block)
+	if mnt == "" {
+		if mnt, err = s.hostMount(ctx, block); err != nil {
+			return err
+		} else if mnt == "" {
+			return fmt.Errorf("volume %s of pod %s is not mounted on the host", volName, podId)
+		}
+	}
+	if err := ioctlMountPoint(mnt, ioctlFithaw); err != nil {
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EINVAL {
+			return err
+		}
+		return fmt.Errorf("volume %s of pod %s is not frozen", volName, podId)
+	}
+	s.frozenLock.Lock()
+	defer s.frozenLock.Unlock()
+	delete(s.frozen, block)
+	return nil
+}
+
+func (s *RawBlockStorage) frozenMount(block string) string {
+	s.frozenLock.Lock()
+	defer s.frozenLock.Unlock()
+	return s.frozen[block]
+}
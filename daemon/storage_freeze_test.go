@@ -0,0 +1,157 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotConsistentVolume(t *testing.T) {
+	ctx := context.Background()
+	mock := NewMockStorage()
+	if err := SnapshotConsistentVolume(ctx, mock, "pod", "vol1", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+	calls := mock.Calls("")
+	if len(calls) != 3 || calls[0].Method != "FreezeVolume" || calls[1].Method != "SnapshotVolume" || calls[2].Method != "ThawVolume" {
+		t.Fatalf("the volume should be frozen, snapshotted then thawed, got %v", calls)
+	}
+
+	mock = NewMockStorage()
+	failed := errors.New("no space left")
+	mock.SetError("SnapshotVolume", failed)
+	if err := SnapshotConsistentVolume(ctx, mock, "pod", "vol1", "snap1"); err != failed {
+		t.Fatalf("the error of the snapshot should be returned, got %v", err)
+	}
+	if calls := mock.Calls("ThawVolume"); len(calls) != 1 {
+		t.Fatalf("the volume should be thawed after a failed snapshot, got %v", mock.Calls(""))
+	}
+
+	mock = NewMockStorage()
+	mock.SetError("FreezeVolume", ErrNotSupported)
+	if err := SnapshotConsistentVolume(ctx, mock, "pod", "vol1", "snap1"); err != ErrNotSupported {
+		t.Fatalf("the error of the freeze should be returned, got %v", err)
+	}
+	if calls := mock.Calls(""); len(calls) != 1 {
+		t.Fatalf("nothing should follow a failed freeze, got %v", calls)
+	}
+}
+
+func TestRawBlockFreezeVolume(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting the block needs root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root, Filesystem: "ext4"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	if err := ensureDir(filepath.Dir(block), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("sh", "-c", "truncate -s 32M "+block+" && mkfs.ext4 -q "+block).CombinedOutput(); err != nil {
+		t.Fatalf("failed to make the block: %v: %s", err, out)
+	}
+	if err := s.FreezeVolume(ctx, podId, "vol1"); !IsNotSupported(err) {
+		t.Fatalf("a volume which is not mounted should not be frozen, got %v", err)
+	}
+
+	mnt := filepath.Join(root, "mnt")
+	os.Mkdir(mnt, 0755)
+	if err := s.mountBlock(ctx, block, mnt, false); err != nil {
+		t.Fatal(err)
+	}
+	defer unmountBlock(mnt)
+
+	data := filepath.Join(mnt, "data")
+	f, err := os.Create(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		chunk := make([]byte, 4096)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := f.Write(chunk); err != nil {
+				return
+			}
+			if fi, _ := f.Stat(); fi.Size() > 16<<20 {
+				f.Truncate(0)
+				f.Seek(0, 0)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.FreezeVolume(ctx, podId, "vol1"); err != nil {
+		t.Fatalf("freeze volume failed: %v", err)
+	}
+	if err := s.FreezeVolume(ctx, podId, "vol1"); err == nil {
+		t.Fatal("a frozen volume should not be frozen again")
+	}
+	fi, err := os.Stat(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frozen := fi.Size()
+	time.Sleep(200 * time.Millisecond)
+	if fi, _ := os.Stat(data); fi.Size() != frozen {
+		s.ThawVolume(ctx, podId, "vol1")
+		t.Fatalf("nothing should be written to a frozen volume, %d bytes then %d", frozen, fi.Size())
+	}
+	snapErr := s.SnapshotVolume(ctx, podId, "vol1", "snap1")
+	if err := s.ThawVolume(ctx, podId, "vol1"); err != nil {
+		t.Fatalf("thaw volume failed: %v", err)
+	}
+	if snapErr != nil {
+		t.Fatalf("snapshot of the frozen volume failed: %v", snapErr)
+	}
+	if err := s.ThawVolume(ctx, podId, "vol1"); err == nil {
+		t.Fatal("a volume which is not frozen should not be thawed")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if fi, _ := os.Stat(data); fi.Size() != frozen {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the writer should go on once the volume is thawed")
+		}
+	}
+
+	snap := filepath.Join(root, "snap")
+	os.Mkdir(snap, 0755)
+	if err := s.mountBlock(ctx, s.snapshotPath(podId, "vol1", "snap1"), snap, true); err != nil {
+		t.Fatal(err)
+	}
+	defer unmountBlock(snap)
+	if fi, err := os.Stat(filepath.Join(snap, "data")); err != nil || fi.Size() != frozen {
+		t.Fatalf("the snapshot should hold the %d bytes written before the freeze, got %v, %v", frozen, fi, err)
+	}
+}
@@ -0,0 +1,186 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// After a crash of the host, the filesystems of the rawblock volumes may be
+// inconsistent. With rawblock.fsck, Init checks the filesystem of each volume
+// with xfs_repair -n, or e2fsck -n, and warns about the inconsistent ones.
+// With the --storage-fsck flag of hyperd, it repairs them instead, and the
+// volumes which can not be repaired are moved to volumes/quarantine and
+// forgotten. The volumes attached to the sandboxes which survived hyperd are
+// left alone.
+
+// quarantineDir is the directory of volumes/ holding the volumes which could
+// not be repaired.
+const quarantineDir = "quarantine"
+
+// fsckSummary counts the volumes scanned by Init.
+type fsckSummary struct {
+	checked, inconsistent, repaired, quarantined, skipped int
+}
+
+func (s *RawBlockStorage) fsckTool() string {
+	if s.Filesystem == "ext4" {
+		return "e2fsck"
+	}
+	return "xfs_repair"
+}
+
+// fsckArgs are the arguments checking the filesystem of device, or repairing
+// it.
+func (s *RawBlockStorage) fsckArgs(device string, repair bool) []string {
+	if s.Filesystem == "ext4" {
+		if repair {
+			return []string{"-f", "-y", device}
+		}
+		return []string{"-f", "-n", device}
+	}
+	var args []string
+	if fi, err := os.Stat(device); err == nil && fi.Mode().IsRegular() {
+		args = append(args, "-f")
+	}
+	if !repair {
+		args = append(args, "-n")
+	}
+	return append(args, device)
+}
+
+// fsckClean tells whether the exit code of the check, or of the repair, of
+// the filesystem leaves it consistent: e2fsck exits with 1 or 2 when it
+// corrected the errors.
+func (s *RawBlockStorage) fsckClean(code int, repair bool) bool {
+	if s.Filesystem == "ext4" && repair {
+		return code < 4
+	}
+	return code == 0
+}
+
+// fsck runs the check, or the repair, of the filesystem of device and tells
+// whether it is consistent once done.
+func (s *RawBlockStorage) fsck(ctx context.Context, device string, repair bool) (bool, error) {
+	out, err := execCommand(ctx, s.fsckTool(), s.fsckArgs(device, repair)...).CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		return false, fmt.Errorf("failed to run %s on %s: %v", s.fsckTool(), device, err)
+	}
+	code := exit.ExitCode()
+	if s.fsckClean(code, repair) {
+		return true, nil
+	}
+	glog.V(1).Infof("%s on %s exited with %d: %s", s.fsckTool(), device, code, strings.TrimSpace(string(out)))
+	return false, nil
+}
+
+// scanVolumes checks, or repairs, the filesystems of the volumes. The
+// volumes are scanned on their own, a failure is counted and logged but
+// fails no other volume, nor Init.
+func (s *RawBlockStorage) scanVolumes(ctx context.Context, repair bool) (*fsckSummary, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	summary := &fsckSummary{}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return summary, err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || isVolumeMeta(entry.Name()) {
+			continue
+		}
+		block := filepath.Join(dir, entry.Name())
+		if storage.PathInUse(block) {
+			glog.Warningf("volume %s is in use, its filesystem is not checked", block)
+			summary.skipped++
+			continue
+		}
+		summary.checked++
+		device := s.blockDevice(block)
+		clean, err := s.fsck(ctx, device, false)
+		if err != nil {
+			glog.Errorf("failed to check volume %s: %v", block, err)
+			summary.skipped++
+			continue
+		} else if clean {
+			continue
+		}
+		summary.inconsistent++
+		glog.Warningf("the filesystem of volume %s is inconsistent", block)
+		if !repair {
+			continue
+		}
+		if clean, err = s.fsck(ctx, device, true); err == nil && clean {
+			glog.Infof("the filesystem of volume %s is repaired", block)
+			summary.repaired++
+			continue
+		}
+		if err := s.quarantineVolume(ctx, block); err != nil {
+			glog.Errorf("failed to quarantine volume %s: %v", block, err)
+			continue
+		}
+		summary.quarantined++
+	}
+	return summary, nil
+}
+
+// quarantineVolume moves the block of the volume to volumes/quarantine, and
+// forgets the volume record, so that the volume is no longer listed.
+func (s *RawBlockStorage) quarantineVolume(ctx context.Context, block string) error {
+	if err := s.closeEncryptedBlock(ctx, block); err != nil {
+		return err
+	}
+	dir := filepath.Join(s.RootPath(), "volumes", quarantineDir)
+	if err := ensureDir(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(block, filepath.Join(dir, filepath.Base(block))); err != nil {
+		return err
+	}
+	glog.Errorf("the filesystem of volume %s can not be repaired, it is moved to %s", block, dir)
+	if s.db == nil {
+		return nil
+	}
+	// the whole list is read, not to leave its producer blocked
+	var podId, name string
+	for kv := range s.db.ListAllVolumes() {
+		if kv == nil {
+			return fmt.Errorf("failed to list the volumes")
+		}
+		n := parseVolumeRecord(kv.V).Name
+		if p := recordPodId(kv.K, n); s.volumePath(p, n) == block {
+			podId, name = p, n
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+// checkVolumes runs the scan of the volumes at Init, and logs its summary.
+func (s *RawBlockStorage) checkVolumes(ctx context.Context) error {
+	if !s.FsckCheck && !s.FsckRepair {
+		return nil
+	}
+	summary, err := s.scanVolumes(ctx, s.FsckRepair)
+	if err != nil {
+		return err
+	}
+	glog.Infof("rawblock volumes scanned with %s: %d checked, %d inconsistent, %d repaired, %d quarantined, %d skipped",
+		s.fsckTool(), summary.checked, summary.inconsistent, summary.repaired, summary.quarantined, summary.skipped)
+	return nil
+}
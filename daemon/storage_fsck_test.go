@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockFsck(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsck-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+	defer fakeTools(t, root, "xfs_repair")()
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{db: db, rootPath: root, FsckCheck: true}
+	if err := ensureDir(filepath.Join(root, "volumes"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	for vol, state := range map[string]string{"clean": "clean", "corrupt": "corrupt", "broken": "broken"} {
+		if err := ioutil.WriteFile(s.volumePath(podId, vol), []byte(state), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveVolumeRecord(ctx, db, podId, &apitypes.UserVolume{Name: vol}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the check alone changes nothing
+	summary, err := s.scanVolumes(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *summary != (fsckSummary{checked: 3, inconsistent: 2}) {
+		t.Fatalf("unexpected summary of the check %+v", *summary)
+	}
+	if data, _ := ioutil.ReadFile(s.volumePath(podId, "corrupt")); string(data) != "corrupt" {
+		t.Fatalf("the check should not repair the volume, got %q", data)
+	}
+
+	s.FsckRepair = true
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(s.volumePath(podId, "corrupt")); string(data) != "repaired" {
+		t.Fatalf("the volume should be repaired, got %q", data)
+	}
+	if exists, _ := pathExists(s.volumePath(podId, "broken")); exists {
+		t.Fatal("the volume which can not be repaired should be moved away")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "volumes", quarantineDir, podId+"-broken")); string(data) != "broken" {
+		t.Fatalf("the volume should be quarantined, got %q", data)
+	}
+	if _, err := db.GetPodVolume(podId, "broken"); err == nil {
+		t.Fatal("the record of the quarantined volume should be removed")
+	}
+	if _, err := db.GetPodVolume(podId, "clean"); err != nil {
+		t.Fatalf("the record of the clean volume should be kept: %v", err)
+	}
+
+	// the quarantine is no orphan
+	if collected, err := s.GarbageCollect(ctx, nil); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, name := range collected {
+			if name == quarantineDir {
+				t.Fatal("the quarantined volumes should not be collected")
+			}
+		}
+	}
+	if exists, _ := pathExists(filepath.Join(root, "volumes", quarantineDir)); !exists {
+		t.Fatal("the quarantined volumes should be kept")
+	}
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"golang.org/x/net/context"
+)
+
+// ErrGCRunning is returned by TriggerGC while a collection is running.
+var ErrGCRunning = errors.New("storage garbage collection already running")
+
+// GCReport tells what a garbage collection of the storage removed.
+type GCReport struct {
+	// ReclaimedBytes is the disk space freed on the filesystem of the
+	// driver, as seen by statfs, so writes running at the same time skew it.
+	ReclaimedBytes int64
+	DeletedVolumes []string
+	Errors         []string
+}
+
+// TriggerGC removes the volumes the driver keeps for the pods which are not
+// in the db any more. Only one collection runs at a time, ErrGCRunning is
+// returned while one is running.
+func (daemon *Daemon) TriggerGC(ctx context.Context) (*GCReport, error) {
+	if !atomic.CompareAndSwapInt32(&daemon.gcRunning, 0, 1) {
+		return nil, ErrGCRunning
+	}
+	defer atomic.StoreInt32(&daemon.gcRunning, 0)
+
+	keys, err := pod.ListAllPods(daemon.db)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pods = append(pods, strings.TrimPrefix(string(key), pod.LAYOUT_KEY_PREFIX))
+	}
+
+	report := &GCReport{}
+	before, statErr := availableBytes(daemon.Storage.RootPath())
+	collected, err := daemon.Storage.GarbageCollect(ctx, pods)
+	if err != nil && !IsNotSupported(err) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.DeletedVolumes = collected
+	if after, err := availableBytes(daemon.Storage.RootPath()); statErr == nil && err == nil && after > before {
+		report.ReclaimedBytes = after - before
+	}
+	return report, nil
+}
+
+// statfs reads the free space of the filesystems, tests replace it with a
+// stub.
+var statfs = syscall.Statfs
+
+func availableBytes(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// collectVolumes removes the volumes left on disk by the pods which are not in
+// the db, e.g. when the daemon crashed before the pod was created.
+func (daemon *Daemon) collectVolumes() {
+	report, err := daemon.TriggerGC(context.Background())
+	if err != nil {
+		glog.Errorf("fail to collect the orphaned volumes: %v", err)
+		return
+	}
+	for _, e := range report.Errors {
+		glog.Warningf("failed to collect the orphaned volumes: %s", e)
+	}
+	if len(report.DeletedVolumes) > 0 {
+		glog.Infof("removed the orphaned volumes %v", report.DeletedVolumes)
+	}
+}
@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// blockingGCStorage is a MockStorage whose GarbageCollect waits for release.
+type blockingGCStorage struct {
+	*MockStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingGCStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	close(b.started)
+	<-b.release
+	return b.MockStorage.GarbageCollect(ctx, activePodIDs)
+}
+
+func TestTriggerGC(t *testing.T) {
+	root, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock := NewMockStorage()
+	daemon := &Daemon{db: db, Storage: mock}
+	active, orphan := testPodId(t)+"-active", testPodId(t)+"-orphan"
+	if err := db.Update([]byte(pod.LAYOUT_KEY_PREFIX+active), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	for _, podId := range []string{active, orphan} {
+		if err := mock.CreateVolume(context.Background(), podId, &apitypes.UserVolume{Name: "vol"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := daemon.TriggerGC(context.Background())
+	if err != nil {
+		t.Fatalf("trigger gc failed: %v", err)
+	}
+	if len(report.DeletedVolumes) != 1 || report.DeletedVolumes[0] != orphan+"-vol" {
+		t.Fatalf("only the volume of the orphaned pod should be deleted, got %v", report.DeletedVolumes)
+	}
+	if len(report.Errors) != 0 {
+		t.Fatalf("unexpected errors %v", report.Errors)
+	}
+	if calls := mock.Calls("GarbageCollect"); len(calls) != 1 || len(calls[0].Args[0].([]string)) != 1 {
+		t.Fatalf("the active pod should be handed to the storage, got %v", calls)
+	}
+
+	blocking := &blockingGCStorage{MockStorage: mock, started: make(chan struct{}), release: make(chan struct{})}
+	daemon.Storage = blocking
+	done := make(chan error)
+	go func() {
+		_, err := daemon.TriggerGC(context.Background())
+		done <- err
+	}()
+	<-blocking.started
+	if _, err := daemon.TriggerGC(context.Background()); err != ErrGCRunning {
+		t.Fatalf("expected the gc already running, got %v", err)
+	}
+	close(blocking.release)
+	if err := <-done; err != nil {
+		t.Fatalf("trigger gc failed: %v", err)
+	}
+	daemon.Storage = mock
+	if _, err := daemon.TriggerGC(context.Background()); err != nil {
+		t.Fatalf("the gc should run again once done: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// glusterfsOptions are the driver options of the glusterfs storage:
+//
+//	glusterfs.server    host of the cluster the volumes are managed on, required
+//	glusterfs.volume    volume holding the rootfs of the containers
+//	glusterfs.loglevel  log level of the fuse client, WARNING by default
+//	glusterfs.brickdir  directory of the bricks of the volumes created on the
+//	                    server, /data/glusterfs by default
+type glusterfsOptions struct {
+	Server   string
+	Volume   string
+	LogLevel string
+	BrickDir string
+}
+
+var glusterfsLogLevels = []string{"CRITICAL", "ERROR", "WARNING", "INFO", "DEBUG", "TRACE", "NONE"}
+
+func validGlusterFSLogLevel(level string) bool {
+	for _, l := range glusterfsLogLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+func parseGlusterFSOptions(config *StorageConfig) (*glusterfsOptions, error) {
+	opts := &glusterfsOptions{
+		Server:   config.DriverOption("glusterfs", "server"),
+		Volume:   config.DriverOption("glusterfs", "volume"),
+		LogLevel: strings.ToUpper(config.DriverOption("glusterfs", "loglevel")),
+		BrickDir: config.DriverOption("glusterfs", "brickdir"),
+	}
+	if opts.Server == "" {
+		return nil, fmt.Errorf("glusterfs.server is required by the glusterfs storage")
+	}
+	if opts.LogLevel == "" {
+		opts.LogLevel = "WARNING"
+	}
+	if !validGlusterFSLogLevel(opts.LogLevel) {
+		return nil, fmt.Errorf("invalid glusterfs.loglevel %q, should be one of %s", opts.LogLevel, strings.Join(glusterfsLogLevels, ", "))
+	}
+	if opts.BrickDir == "" {
+		opts.BrickDir = "/data/glusterfs"
+	}
+	if !filepath.IsAbs(opts.BrickDir) {
+		return nil, fmt.Errorf("invalid glusterfs.brickdir %q, should be an absolute path", opts.BrickDir)
+	}
+	return opts, nil
+}
+
+// GlusterFSStorage mounts the volumes from the glusterfs cluster, creating
+// the ones which do not exist yet, and finds the rootfs of the containers in
+// the glusterfs.volume volume.
+type GlusterFSStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db         *daemondb.DaemonDB
+	rootPath   string
+	opts       *glusterfsOptions
+	fuseDevice string
+}
+
+func GlusterFSFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	opts, err := parseGlusterFSOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	driver := &GlusterFSStorage{
+		db:         db,
+		rootPath:   config.DriverRoot("glusterfs"),
+		opts:       opts,
+		fuseDevice: "/dev/fuse",
+	}
+	return driver, nil
+}
+
+func (s *GlusterFSStorage) Type() string {
+	return "glusterfs"
+}
+
+func (s *GlusterFSStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *GlusterFSStorage) shareDir() string {
+	return filepath.Join(s.RootPath(), "share")
+}
+
+func (s *GlusterFSStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+// clusterVolume is the volume of the cluster backing the volume of the pod,
+// the source of the spec if given.
+func clusterVolume(podId string, spec *apitypes.UserVolume) string {
+	if spec.Source != "" {
+		return spec.Source
+	}
+	return fmt.Sprintf("%s-%s", podId, spec.Name)
+}
+
+// mountGlusterFS mounts the volume of the cluster to target. The mount is
+// done by mount.glusterfs, which starts the fuse client serving it, a mount
+// syscall alone would leave the mount point without a filesystem behind it.
+func (s *GlusterFSStorage) mountGlusterFS(ctx context.Context, volume, target string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	source := fmt.Sprintf("%s:/%s", s.opts.Server, volume)
+	options := "log-level=" + s.opts.LogLevel
+	if out, err := execCommand(ctx, "mount", "-t", "glusterfs", "-o", options, source, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount glusterfs %s to %s: %v: %s", source, target, err, out)
+	}
+	return nil
+}
+
+func (s *GlusterFSStorage) gluster(ctx context.Context, args ...string) ([]byte, error) {
+	args = append([]string{"--mode=script", "--remote-host=" + s.opts.Server}, args...)
+	return execCommand(ctx, "gluster", args...).CombinedOutput()
+}
+
+// ensureVolume creates and starts the volume on the cluster, with a single
+// brick on the server, unless it exists already.
+func (s *GlusterFSStorage) ensureVolume(ctx context.Context, volume string) error {
+	out, err := s.gluster(ctx, "volume", "info", volume)
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(string(out), "does not exist") {
+		return fmt.Errorf("failed to get glusterfs volume %s: %v: %s", volume, err, out)
+	}
+	brick := fmt.Sprintf("%s:%s", s.opts.Server, filepath.Join(s.opts.BrickDir, volume))
+	if out, err := s.gluster(ctx, "volume", "create", volume, brick, "force"); err != nil {
+		return fmt.Errorf("failed to create glusterfs volume %s: %v: %s", volume, err, out)
+	}
+	if out, err := s.gluster(ctx, "volume", "start", volume); err != nil {
+		return fmt.Errorf("failed to start glusterfs volume %s: %v: %s", volume, err, out)
+	}
+	glog.Infof("glusterfs volume %s created on %s", volume, brick)
+	return nil
+}
+
+// Init checks that the fuse client is installed before mounting anything.
+func (s *GlusterFSStorage) Init(ctx context.Context) error {
+	if _, err := os.Stat(s.fuseDevice); err != nil {
+		return fmt.Errorf("glusterfs storage needs fuse, %s is not available: %v", s.fuseDevice, err)
+	}
+	if _, err := exec.LookPath("mount.glusterfs"); err != nil {
+		return fmt.Errorf("glusterfs storage needs the glusterfs fuse client, mount.glusterfs is not installed")
+	}
+	if err := ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700); err != nil {
+		return err
+	}
+	if s.opts.Volume == "" {
+		return nil
+	}
+	if mounted, _ := mount.Mounted(s.shareDir()); mounted {
+		return nil
+	}
+	return s.mountGlusterFS(ctx, s.opts.Volume, s.shareDir())
+}
+
+func (s *GlusterFSStorage) CleanUp(ctx context.Context) error {
+	if mounted, _ := mount.Mounted(s.shareDir()); !mounted {
+		return nil
+	}
+	return syscall.Unmount(s.shareDir(), 0)
+}
+
+// HealthCheck checks that the volume of the rootfs is still mounted, the fuse
+// client may have died.
+func (s *GlusterFSStorage) HealthCheck(ctx context.Context) error {
+	if s.opts.Volume != "" {
+		if mounted, _ := mount.Mounted(s.shareDir()); !mounted {
+			return fmt.Errorf("glusterfs volume %s is not mounted on %s", s.opts.Volume, s.shareDir())
+		}
+	}
+	return checkWritable(filepath.Join(s.RootPath(), "volumes"))
+}
+
+func (s *GlusterFSStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *GlusterFSStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{}
+}
+
+func (s *GlusterFSStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// PrepareContainer bind mounts the rootfs of the container from the volume
+// mounted by Init.
+func (s *GlusterFSStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.opts.Volume == "" {
+		return nil, fmt.Errorf("glusterfs.volume is not set, cannot find the rootfs of %s", mountId)
+	}
+	rootfs := filepath.Join(s.shareDir(), mountId, "rootfs")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return nil, err
+	}
+	if err := syscall.Mount(rootfs, mountPoint, "bind", syscall.MS_BIND, ""); err != nil {
+		return nil, fmt.Errorf("failed to mount %s to %s: %v", rootfs, mountPoint, err)
+	}
+	if opts.ReadOnly {
+		if err := syscall.Mount(rootfs, mountPoint, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+			return nil, fmt.Errorf("failed to mount %s to %s readonly: %v", rootfs, mountPoint, err)
+		}
+	}
+
+	containerPath := "/" + mountId
+	vol := &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (s *GlusterFSStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return syscall.Unmount(filepath.Join(sharedDir, id, "rootfs"), 0)
+}
+
+func (s *GlusterFSStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return storage.FsInjectFile(src, mountId, target, s.shareDir(), perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *GlusterFSStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return storage.FsInjectDir(src, mountId, targetDir, s.shareDir(), uid, gid, s.verifyChecksum)
+}
+
+func (s *GlusterFSStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume mounts the volume of the cluster named by the source of the
+// volume, or after the pod and the volume, creating it if needed.
+func (s *GlusterFSStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	volume := clusterVolume(podId, spec)
+	volPath := s.volumePath(podId, spec.Name)
+	if mounted, _ := mount.Mounted(volPath); !mounted {
+		if err := s.ensureVolume(ctx, volume); err != nil {
+			return err
+		}
+		if err := s.mountGlusterFS(ctx, volume, volPath); err != nil {
+			return err
+		}
+	}
+	glog.V(1).Infof("volume %s mounted from glusterfs %s:/%s", spec.Name, s.opts.Server, volume)
+
+	spec.Source = volPath
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// RemoveVolume unmounts the volume, the data stays in the cluster.
+func (s *GlusterFSStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	volPath := s.volumePath(podId, name)
+	if mounted, _ := mount.Mounted(volPath); mounted {
+		if err := syscall.Unmount(volPath, 0); err != nil {
+			if err == syscall.EBUSY {
+				glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volPath, podId)
+				return ErrVolumeInUse
+			}
+			return err
+		}
+	}
+	if err := os.Remove(volPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *GlusterFSStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "vfs",
+			Fstype: "dir",
+		})
+	}
+	return vols, nil
+}
+
+func (s *GlusterFSStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *GlusterFSStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.volumePath(podId, volName))
+}
+
+func (s *GlusterFSStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *GlusterFSStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *GlusterFSStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *GlusterFSStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *GlusterFSStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *GlusterFSStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *GlusterFSStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *GlusterFSStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect unmounts the orphaned volumes, the data stays in the
+// cluster.
+func (s *GlusterFSStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		volPath := filepath.Join(dir, name)
+		if mounted, _ := mount.Mounted(volPath); mounted {
+			if err := syscall.Unmount(volPath, 0); err != nil {
+				glog.Warningf("failed to unmount orphaned volume %s: %v", volPath, err)
+				continue
+			}
+		}
+		if err := os.Remove(volPath); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", volPath, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
@@ -0,0 +1,141 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestGlusterFSOptions(t *testing.T) {
+	if _, err := GlusterFSFactory(nil, nil, nil); err == nil {
+		t.Fatal("glusterfs.server should be required")
+	}
+	config, err := NewStorageConfig(map[string]string{"glusterfs.server": "gluster1", "glusterfs.loglevel": "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := parseGlusterFSOptions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Server != "gluster1" || opts.LogLevel != "DEBUG" || opts.BrickDir != "/data/glusterfs" {
+		t.Fatalf("unexpected options %#v", opts)
+	}
+
+	for _, invalid := range []map[string]string{
+		{"glusterfs.server": "gluster1", "glusterfs.loglevel": "verbose"},
+		{"glusterfs.server": "gluster1", "glusterfs.brickdir": "bricks"},
+	} {
+		config, _ := NewStorageConfig(invalid)
+		if _, err := parseGlusterFSOptions(config); err == nil {
+			t.Fatalf("invalid options %v should be refused", invalid)
+		}
+	}
+}
+
+func TestGlusterFSInit(t *testing.T) {
+	root, err := ioutil.TempDir("", "glusterfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &GlusterFSStorage{
+		rootPath:   root,
+		opts:       &glusterfsOptions{Server: "gluster1"},
+		fuseDevice: filepath.Join(root, "fuse"),
+	}
+	if err := s.Init(context.Background()); err == nil || !strings.Contains(err.Error(), "needs fuse") {
+		t.Fatalf("Init should fail without fuse, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(s.fuseDevice, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", root)
+	if err := s.Init(context.Background()); err == nil || !strings.Contains(err.Error(), "mount.glusterfs is not installed") {
+		t.Fatalf("Init should fail without the fuse client, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, "mount.glusterfs"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGlusterFSVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "glusterfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+	cluster := filepath.Join(root, "cluster")
+	if err := os.Mkdir(cluster, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("HELPER_GLUSTER_DIR", cluster)
+	defer os.Unsetenv("HELPER_GLUSTER_DIR")
+	if err := ioutil.WriteFile(filepath.Join(cluster, "shared"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &GlusterFSStorage{
+		rootPath: filepath.Join(root, "glusterfs"),
+		opts:     &glusterfsOptions{Server: "gluster1", LogLevel: "ERROR", BrickDir: "/bricks"},
+	}
+	ctx := context.Background()
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if spec.Source != s.volumePath(podId, "vol1") || spec.Format != "vfs" || spec.Fstype != "dir" {
+		t.Fatalf("unexpected volume %#v", spec)
+	}
+	if brick, _ := ioutil.ReadFile(filepath.Join(cluster, podId+"-vol1")); string(brick) != "gluster1:/bricks/"+podId+"-vol1" {
+		t.Fatalf("unexpected brick %q", brick)
+	}
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "vol2", Source: "shared"}); err != nil {
+		t.Fatalf("create volume from an existing one failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := string(data)
+	if strings.Count(commands, "volume create") != 1 {
+		t.Fatalf("only the missing volume should be created:\n%s", commands)
+	}
+	if !strings.Contains(commands, "mount -t glusterfs -o log-level=ERROR gluster1:/shared "+s.volumePath(podId, "vol2")) {
+		t.Fatalf("the existing volume should be mounted:\n%s", commands)
+	}
+
+	vols, err := s.ListVolumes(ctx, podId)
+	if err != nil || len(vols) != 2 {
+		t.Fatalf("expected 2 volumes, got %v, %v", vols, err)
+	}
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "vol1"); exists {
+		t.Fatal("the volume should be removed")
+	}
+	if _, err := os.Stat(filepath.Join(cluster, podId+"-vol1")); err != nil {
+		t.Fatal("the data of the volume should stay in the cluster")
+	}
+}
@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// ErrStorageDegraded is returned by PrepareContainer while the driver failed
+// its health checks and could not be initialized again.
+var ErrStorageDegraded = errors.New("storage driver is degraded")
+
+// storageFailureThreshold is the number of health checks in a row the driver
+// fails before it is initialized again.
+const storageFailureThreshold = 3
+
+// MonitoredStorage runs the health check of the wrapped Storage in the
+// background, so that e.g. the overlay root going away is found before the
+// next container is started. Once the driver failed storageFailureThreshold
+// checks in a row, a DriverFailure event is sent and the driver is cleaned up
+// and initialized again; if that fails too, the driver is degraded and no
+// container is prepared on it until a health check succeeds.
+type MonitoredStorage struct {
+	Storage
+	events   *StorageEventBus
+	interval time.Duration
+
+	sync.Mutex
+	failures int
+	degraded bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func NewMonitoredStorage(s Storage, events *StorageEventBus, interval time.Duration) *MonitoredStorage {
+	return &MonitoredStorage{
+		Storage:  s,
+		events:   events,
+		interval: interval,
+	}
+}
+
+// Init initializes the wrapped Storage, then starts checking its health in
+// the background.
+func (m *MonitoredStorage) Init(ctx context.Context) error {
+	if err := m.Storage.Init(ctx); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.stop != nil {
+		return nil
+	}
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go m.loop(m.stop, m.done)
+	return nil
+}
+
+// CleanUp stops checking the health of the wrapped Storage, then cleans it
+// up.
+func (m *MonitoredStorage) CleanUp(ctx context.Context) error {
+	m.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	return m.Storage.CleanUp(ctx)
+}
+
+func (m *MonitoredStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	if m.Degraded() {
+		return nil, fmt.Errorf("can not prepare container %s on storage %s: %w", mountId, m.Type(), ErrStorageDegraded)
+	}
+	return m.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+// Degraded tells whether the driver could not be recovered from its failed
+// health checks.
+func (m *MonitoredStorage) Degraded() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.degraded
+}
+
+func (m *MonitoredStorage) loop(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.check(context.Background())
+		}
+	}
+}
+
+// check runs one health check, and recovers the driver once it failed
+// storageFailureThreshold checks in a row. A degraded driver is tried again
+// after as many failed checks.
+func (m *MonitoredStorage) check(ctx context.Context) {
+	err := m.Storage.HealthCheck(ctx)
+	m.Lock()
+	if err == nil {
+		if m.failures > 0 {
+			glog.Infof("storage %s is healthy again after %d failed health checks", m.Type(), m.failures)
+		}
+		m.failures, m.degraded = 0, false
+		m.Unlock()
+		return
+	}
+	m.failures++
+	failures := m.failures
+	m.Unlock()
+	if failures%storageFailureThreshold != 0 {
+		glog.Warningf("health check of storage %s failed: %v", m.Type(), err)
+		return
+	}
+
+	glog.Errorf("storage %s failed %d health checks in a row, initialize it again: %v", m.Type(), failures, err)
+	m.events.Publish(StorageEvent{
+		Type:      DriverFailure,
+		Driver:    m.Type(),
+		Timestamp: time.Now(),
+	})
+	if err := m.recover(ctx); err != nil {
+		glog.Errorf("failed to initialize storage %s again, it is degraded: %v", m.Type(), err)
+		m.Lock()
+		m.degraded = true
+		m.Unlock()
+	}
+}
+
+func (m *MonitoredStorage) recover(ctx context.Context) error {
+	if err := m.Storage.CleanUp(ctx); err != nil {
+		glog.Warningf("failed to clean up storage %s: %v", m.Type(), err)
+	}
+	return m.Storage.Init(ctx)
+}
@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// flappingStorage is a MockStorage whose health checks alternate between
+// healthy and unhealthy, following healthy in turn.
+type flappingStorage struct {
+	*MockStorage
+	healthy []bool
+}
+
+func (f *flappingStorage) HealthCheck(ctx context.Context) error {
+	f.MockStorage.HealthCheck(ctx)
+	healthy := f.healthy[0]
+	f.healthy = append(f.healthy[1:], healthy)
+	if !healthy {
+		return errors.New("mount point is gone")
+	}
+	return nil
+}
+
+func TestMonitoredStorage(t *testing.T) {
+	mock := NewMockStorage()
+	flapping := &flappingStorage{MockStorage: mock, healthy: []bool{true, false}}
+	bus := NewStorageEventBus()
+	events := bus.Subscribe()
+	defer bus.Unsubscribe(events)
+	m := NewMonitoredStorage(flapping, bus, time.Hour)
+
+	// a failure between healthy checks is not counted up
+	for i := 0; i < 6; i++ {
+		m.check(context.Background())
+	}
+	if calls := mock.Calls("Init"); len(calls) != 0 {
+		t.Fatalf("the driver should not be initialized again, got %v", calls)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev)
+	default:
+	}
+
+	// three failures in a row, the driver is initialized again
+	flapping.healthy = []bool{false}
+	for i := 0; i < 3; i++ {
+		m.check(context.Background())
+	}
+	if len(mock.Calls("CleanUp")) != 1 || len(mock.Calls("Init")) != 1 {
+		t.Fatalf("the driver should be cleaned up and initialized again, got %v", mock.Calls(""))
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != DriverFailure || ev.Driver != "mock" {
+			t.Fatalf("unexpected event %v", ev)
+		}
+	default:
+		t.Fatal("the failure of the driver should be sent")
+	}
+	if m.Degraded() {
+		t.Fatal("the driver initialized again should not be degraded")
+	}
+
+	// the driver can not be initialized again
+	mock.SetError("Init", errors.New("no such device"))
+	for i := 0; i < 3; i++ {
+		m.check(context.Background())
+	}
+	if !m.Degraded() {
+		t.Fatal("the driver should be degraded")
+	}
+	if _, err := m.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); !errors.Is(err, ErrStorageDegraded) {
+		t.Fatalf("expected the driver degraded, got %v", err)
+	}
+	if calls := mock.Calls("PrepareContainer"); len(calls) != 0 {
+		t.Fatalf("the degraded driver should not be called, got %v", calls)
+	}
+
+	// a healthy check resumes
+	flapping.healthy = []bool{true}
+	m.check(context.Background())
+	if m.Degraded() {
+		t.Fatal("the driver should not be degraded once healthy")
+	}
+	if _, err := m.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+}
+
+func TestMonitoredStorageLoop(t *testing.T) {
+	mock := NewMockStorage()
+	m := NewMonitoredStorage(mock, nil, 10*time.Millisecond)
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mock.Calls("HealthCheck")) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the health of the driver should be checked in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.CleanUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checks := len(mock.Calls("HealthCheck"))
+	time.Sleep(50 * time.Millisecond)
+	if len(mock.Calls("HealthCheck")) != checks {
+		t.Fatal("the health checks should stop on clean up")
+	}
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// The volumes plugged into a running pod are made by the driver as those of
+// a new pod are, the pod then inserts them into its sandbox with the runv
+// API; a vfs volume is bound into the shared dir of the sandbox by the pod,
+// the driver does not know that dir.
+
+// hotPlugVolume creates the volume of a running pod with the driver s, and
+// describes it to the sandbox.
+func hotPlugVolume(ctx context.Context, s Storage, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	if exists, err := s.VolumeExists(ctx, podId, spec.Name); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, fmt.Errorf("volume %s of pod %s already exists", spec.Name, podId)
+	}
+	if errs := s.ValidateVolumeSpec(spec); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid volume %s: %s", spec.Name, storage.JoinValidationErrors(errs))
+	}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		return nil, err
+	}
+	return &runv.VolumeDescription{
+		Name:   spec.Name,
+		Source: spec.Source,
+		Format: spec.Format,
+		Fstype: spec.Fstype,
+	}, nil
+}
+
+// HotPlugVolume creates and formats the block of the volume.
+func (s *RawBlockStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return hotPlugVolume(ctx, s, podId, spec)
+}
+
+// HotUnplugVolume removes the block of the volume, once the sandbox let it
+// go.
+func (s *RawBlockStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return s.RemoveVolume(ctx, podId, []byte(volName))
+}
+
+// HotPlugVolume creates the directory of the vfs volume.
+func (o *OverlayFsStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return hotPlugVolume(ctx, o, podId, spec)
+}
+
+// HotUnplugVolume removes the directory of the vfs volume, once the pod
+// unbound it from the shared dir.
+func (o *OverlayFsStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return o.RemoveVolume(ctx, podId, []byte(volName))
+}
@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockHotPlugVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if _, err := s.HotPlugVolume(context.Background(), podId, &apitypes.UserVolume{Name: "tiny", SizeBytes: 4096}); err == nil {
+		t.Fatal("an invalid volume should be refused")
+	}
+	if exists, _ := s.VolumeExists(context.Background(), podId, "tiny"); exists {
+		t.Fatal("the invalid volume should not be created")
+	}
+
+	spec := &apitypes.UserVolume{Name: "data", SizeBytes: 1 << 20}
+	vol, err := s.HotPlugVolume(context.Background(), podId, spec)
+	if err != nil {
+		t.Fatalf("hot plug failed: %v", err)
+	}
+	if vol.Name != "data" || vol.Source != s.volumePath(podId, "data") || vol.Format != "raw" || vol.Fstype != "xfs" {
+		t.Fatalf("unexpected description of the volume %+v", vol)
+	}
+	if _, err := s.HotPlugVolume(context.Background(), podId, &apitypes.UserVolume{Name: "data"}); err == nil {
+		t.Fatal("a volume should not be plugged twice")
+	}
+
+	if err := s.HotUnplugVolume(context.Background(), podId, "data"); err != nil {
+		t.Fatalf("hot unplug failed: %v", err)
+	}
+	if exists, _ := s.VolumeExists(context.Background(), podId, "data"); exists {
+		t.Fatal("the unplugged volume should be removed")
+	}
+}
+
+func TestOverlayFsHotPlugVolume(t *testing.T) {
+	o := &OverlayFsStorage{}
+	podId := testPodId(t)
+	vol, err := o.HotPlugVolume(context.Background(), podId, &apitypes.UserVolume{Name: "data"})
+	if err != nil {
+		t.Fatalf("hot plug failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(vol.Source))
+	if vol.Format != "vfs" || vol.Fstype != "dir" {
+		t.Fatalf("expected a vfs volume, got %+v", vol)
+	}
+	if _, err := os.Stat(vol.Source); err != nil {
+		t.Fatalf("the directory of the volume should be made: %v", err)
+	}
+
+	if err := o.HotUnplugVolume(context.Background(), podId, "data"); err != nil {
+		t.Fatalf("hot unplug failed: %v", err)
+	}
+	if _, err := os.Stat(vol.Source); !os.IsNotExist(err) {
+		t.Fatalf("the unplugged volume should be removed, got %v", err)
+	}
+}
+
+func TestOrderedStorageHotUnplugVolumeInUse(t *testing.T) {
+	o := NewOrderedStorage(NewMockStorage()).(*OrderedStorage)
+	if _, err := o.HotPlugVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "data"}); err != nil {
+		t.Fatal(err)
+	}
+	o.used[volumeID("pod", "data")] = 1
+	if err := o.HotUnplugVolume(context.Background(), "pod", "data"); !IsInvalidTransition(err) {
+		t.Fatalf("a volume used by a prepared container should not be unplugged, got %v", err)
+	}
+	o.used[volumeID("pod", "data")] = 0
+	if err := o.HotUnplugVolume(context.Background(), "pod", "data"); err != nil {
+		t.Fatal(err)
+	}
+}
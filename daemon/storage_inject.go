@@ -0,0 +1,26 @@
+package daemon
+
+// injectOptions holds how a driver injects the files into its containers, it
+// is embedded by the drivers injecting them with storage.FsInjectFile.
+type injectOptions struct {
+	// verifyChecksum makes the injected files read back and compared with
+	// their source, see storage.FsInjectFile.
+	verifyChecksum bool
+}
+
+func (o *injectOptions) setVerifyChecksum(verify bool) {
+	o.verifyChecksum = verify
+}
+
+// fileInjector is implemented by the drivers embedding injectOptions.
+type fileInjector interface {
+	setVerifyChecksum(verify bool)
+}
+
+// configureInjection applies the inject options of the config to s, the
+// drivers which do not inject with storage.FsInjectFile are left as they are.
+func configureInjection(s Storage, config *StorageConfig) {
+	if injector, ok := s.(fileInjector); ok {
+		injector.setVerifyChecksum(config.VerifyChecksum)
+	}
+}
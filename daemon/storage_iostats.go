@@ -0,0 +1,419 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// The I/O of a container to its volumes is counted from the time it is
+// prepared to the time it is cleaned up. The rawblock driver reads the
+// counters the kernel keeps for the device of each volume, the dm-crypt device
+// of an encrypted one or the loop device of a throttled one; the blocks the
+// hypervisor opens as files have no device, and their I/O is not accounted.
+// The overlay driver watches the directories of the volumes with inotify,
+// which tells a file was read or written but not how much: the bytes written
+// are the growth of the files, and the bytes read are not counted.
+
+// sysClassBlock is replaced by the tests.
+var sysClassBlock = "/sys/class/block"
+
+// VolumeIOStats is the I/O of a container to one of its volumes.
+type VolumeIOStats struct {
+	ReadBytes  int64
+	WriteBytes int64
+	ReadOps    int64
+	WriteOps   int64
+}
+
+// since returns the I/O counted from base on. Counters lower than those of
+// base were reset by the device being attached again, they are returned as
+// they are.
+func (s *VolumeIOStats) since(base *VolumeIOStats) *VolumeIOStats {
+	if s.ReadOps < base.ReadOps || s.WriteOps < base.WriteOps {
+		return s
+	}
+	return &VolumeIOStats{
+		ReadBytes:  s.ReadBytes - base.ReadBytes,
+		WriteBytes: s.WriteBytes - base.WriteBytes,
+		ReadOps:    s.ReadOps - base.ReadOps,
+		WriteOps:   s.WriteOps - base.WriteOps,
+	}
+}
+
+// diskStats reads the counters of the block device from its stat file in
+// sysfs, whose sectors are of 512 bytes whatever the device.
+func diskStats(device string) (*VolumeIOStats, error) {
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(sysClassBlock, filepath.Base(target), "stat")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// reads, reads merged, sectors read, ms reading, writes, writes merged,
+	// sectors written, ...
+	fields := strings.Fields(string(data))
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("unexpected %s: %q", path, strings.TrimSpace(string(data)))
+	}
+	var counters [4]int64
+	for i, field := range []string{fields[0], fields[2], fields[4], fields[6]} {
+		if counters[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+			return nil, fmt.Errorf("unexpected %s: %v", path, err)
+		}
+	}
+	return &VolumeIOStats{
+		ReadOps:    counters[0],
+		ReadBytes:  counters[1] * 512,
+		WriteOps:   counters[2],
+		WriteBytes: counters[3] * 512,
+	}, nil
+}
+
+// volumeIOBaselines holds the counters of the devices of the volumes of each
+// prepared container, by volume name, as they were when it was prepared.
+type volumeIOBaselines struct {
+	sync.Mutex
+	counters map[string]map[string]*VolumeIOStats
+}
+
+func (b *volumeIOBaselines) get(containerId, volName string) *VolumeIOStats {
+	b.Lock()
+	defer b.Unlock()
+	return b.counters[containerId][volName]
+}
+
+// set keeps the counters of the container, unless it was prepared already.
+func (b *volumeIOBaselines) set(containerId string, counters map[string]*VolumeIOStats) {
+	b.Lock()
+	defer b.Unlock()
+	if b.counters == nil {
+		b.counters = make(map[string]map[string]*VolumeIOStats)
+	}
+	if _, ok := b.counters[containerId]; !ok {
+		b.counters[containerId] = counters
+	}
+}
+
+// remove resets the counters of the container once it is cleaned up, it is
+// deferred with the named error result of CleanupContainer.
+func (b *volumeIOBaselines) remove(containerId string, err *error) {
+	if *err != nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	delete(b.counters, containerId)
+}
+
+// takeIOBaselines reads the counters of the devices of the volumes of the
+// container, it is deferred with the named error result of
+// PrepareContainer.
+func (s *RawBlockStorage) takeIOBaselines(containerId string, opts storage.ContainerOptions, err *error) {
+	if *err != nil || len(opts.Volumes) == 0 {
+		return
+	}
+	counters := make(map[string]*VolumeIOStats, len(opts.Volumes))
+	for _, name := range opts.Volumes {
+		block := s.volumePath(opts.PodID, name)
+		device := s.blockDevice(block)
+		if device == block {
+			continue
+		}
+		stats, err := diskStats(device)
+		if err != nil {
+			glog.V(1).Infof("the I/O of volume %s is not accounted: %v", block, err)
+			continue
+		}
+		counters[name] = stats
+	}
+	s.ioBaselines.set(containerId, counters)
+}
+
+// GetVolumeIOStats returns the counters of the device of the volume, less
+// those of the time the container was prepared.
+func (s *RawBlockStorage) GetVolumeIOStats(containerId, volName string) (stats *VolumeIOStats, err error) {
+	defer wrapStorageError(&err, s.Type(), "GetVolumeIOStats", containerId)
+	base := s.ioBaselines.get(containerId, volName)
+	if base == nil {
+		return nil, fmt.Errorf("the I/O of volume %s of container %s is not accounted", volName, containerId)
+	}
+	podId := s.containerPods()[containerId]
+	current, err := diskStats(s.blockDevice(s.volumePath(podId, volName)))
+	if err != nil {
+		return nil, err
+	}
+	return current.since(base), nil
+}
+
+const ioWatchMask = syscall.IN_ACCESS | syscall.IN_MODIFY | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// ioWatch accounts the I/O to the directories of the volumes of a container
+// from the events of an inotify instance, which watches each directory of
+// their trees.
+type ioWatch struct {
+	fd   int
+	file *os.File
+
+	lock sync.Mutex
+	// dirs and volumes are the directory and the volume of each watch
+	dirs    map[int32]string
+	volumes map[int32]string
+	// sizes holds the size of each file seen, so that the growth of a file
+	// written is counted
+	sizes map[string]int64
+	stats map[string]*VolumeIOStats
+}
+
+// newIOWatch starts accounting the I/O to dirs, keyed by volume name.
+func newIOWatch(dirs map[string]string) (*ioWatch, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &ioWatch{
+		fd: fd,
+		// non-blocking, the file is polled and Close stops the loop
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int32]string),
+		volumes: make(map[int32]string),
+		sizes:   make(map[string]int64),
+		stats:   make(map[string]*VolumeIOStats),
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for name, dir := range dirs {
+		w.stats[name] = &VolumeIOStats{}
+		if err := w.addTree(name, dir, false); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+	go w.loop()
+	return w, nil
+}
+
+// addTree watches dir and the directories below it, and keeps the size of
+// the files. The files of a directory just created were written before it was
+// watched, they are counted as written. Called with the lock held.
+func (w *ioWatch) addTree(volume, dir string, created bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the volume is in use, its files may be removed during the walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			w.sizes[path] = info.Size()
+			if created {
+				w.stats[volume].WriteOps++
+				w.stats[volume].WriteBytes += info.Size()
+			}
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, ioWatchMask)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %v", path, err)
+		}
+		w.dirs[int32(wd)] = path
+		w.volumes[int32(wd)] = volume
+		return nil
+	})
+}
+
+func (w *ioWatch) loop() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			off = start + int(event.Len)
+			w.account(event.Wd, event.Mask, strings.TrimRight(string(buf[start:off]), "\x00"))
+		}
+	}
+}
+
+// account counts the event of the watch wd on the file name of its directory.
+func (w *ioWatch) account(wd int32, mask uint32, name string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return
+	}
+	volume := w.volumes[wd]
+	stats := w.stats[volume]
+	path := filepath.Join(dir, name)
+	switch {
+	case mask&syscall.IN_IGNORED != 0:
+		delete(w.dirs, wd)
+		delete(w.volumes, wd)
+	case mask&syscall.IN_ISDIR != 0:
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			if err := w.addTree(volume, path, mask&syscall.IN_CREATE != 0); err != nil {
+				glog.V(1).Infof("the I/O to %s is not accounted: %v", path, err)
+			}
+		}
+	case mask&syscall.IN_ACCESS != 0:
+		stats.ReadOps++
+	case mask&syscall.IN_MODIFY != 0:
+		stats.WriteOps++
+		if info, err := os.Lstat(path); err == nil {
+			if grown := info.Size() - w.sizes[path]; grown > 0 {
+				stats.WriteBytes += grown
+			}
+			w.sizes[path] = info.Size()
+		}
+	case mask&syscall.IN_CREATE != 0:
+		// the writes to the file follow in the queue
+		w.sizes[path] = 0
+	case mask&syscall.IN_MOVED_TO != 0:
+		if info, err := os.Lstat(path); err == nil {
+			w.sizes[path] = info.Size()
+		}
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		delete(w.sizes, path)
+	}
+}
+
+func (w *ioWatch) get(volName string) *VolumeIOStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats, ok := w.stats[volName]
+	if !ok {
+		return nil
+	}
+	counted := *stats
+	return &counted
+}
+
+func (w *ioWatch) close() error {
+	return w.file.Close()
+}
+
+// volumeIOWatches holds the ioWatch of each prepared container.
+type volumeIOWatches struct {
+	sync.Mutex
+	watches map[string]*ioWatch
+}
+
+// start watches the dirs of the volumes of the container, unless it was
+// prepared already.
+func (v *volumeIOWatches) start(containerId string, dirs map[string]string) error {
+	v.Lock()
+	defer v.Unlock()
+	if _, ok := v.watches[containerId]; ok {
+		return nil
+	}
+	w, err := newIOWatch(dirs)
+	if err != nil {
+		return err
+	}
+	if v.watches == nil {
+		v.watches = make(map[string]*ioWatch)
+	}
+	v.watches[containerId] = w
+	return nil
+}
+
+func (v *volumeIOWatches) get(containerId string) *ioWatch {
+	v.Lock()
+	defer v.Unlock()
+	return v.watches[containerId]
+}
+
+// stop stops accounting the I/O of the container once it is cleaned up, it
+// is deferred with the named error result of CleanupContainer.
+func (v *volumeIOWatches) stop(containerId string, err *error) {
+	if *err != nil {
+		return
+	}
+	v.Lock()
+	w, ok := v.watches[containerId]
+	delete(v.watches, containerId)
+	v.Unlock()
+	if ok {
+		w.close()
+	}
+}
+
+// watchVolumeIO starts accounting the I/O of the container to its volumes,
+// it is deferred with the named error result of PrepareContainer. A failure
+// leaves the I/O unaccounted, the container is prepared all the same.
+func (o *OverlayFsStorage) watchVolumeIO(mountId string, opts storage.ContainerOptions, err *error) {
+	if *err != nil || len(opts.Volumes) == 0 {
+		return
+	}
+	dirs := make(map[string]string, len(opts.Volumes))
+	for _, name := range opts.Volumes {
+		dirs[name] = storage.VFSVolumePath(o.volumeRoot(opts.PodID, name), opts.PodID, name)
+	}
+	if err := o.ioWatches.start(mountId, dirs); err != nil {
+		glog.Warningf("the I/O of container %s to its volumes is not accounted: %v", mountId, err)
+	}
+}
+
+// GetVolumeIOStats returns the I/O to the volume the inotify watch of the
+// container counted, the bytes read are not.
+func (o *OverlayFsStorage) GetVolumeIOStats(containerId, volName string) (stats *VolumeIOStats, err error) {
+	defer wrapStorageError(&err, o.Type(), "GetVolumeIOStats", containerId)
+	if w := o.ioWatches.get(containerId); w != nil {
+		if stats := w.get(volName); stats != nil {
+			return stats, nil
+		}
+	}
+	return nil, fmt.Errorf("the I/O of volume %s of container %s is not accounted", volName, containerId)
+}
+
+// ContainerVolumeIOStats returns the I/O of the container to each of its
+// volumes since it was prepared, by volume name.
+func (daemon *Daemon) ContainerVolumeIOStats(ctx context.Context, name string) (map[string]*VolumeIOStats, error) {
+	p, id, ok := daemon.PodList.GetByContainerIdOrName(name)
+	if !ok {
+		return nil, fmt.Errorf("Can not find container by name(%s)", name)
+	}
+	info, err := p.ContainerInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	mountId, err := pod.GetMountIdByContainer(daemon.Storage.Type(), id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the mount of container %s: %v", id, err)
+	}
+	stats := make(map[string]*VolumeIOStats)
+	for _, mnt := range info.Container.VolumeMounts {
+		if _, ok := stats[mnt.Name]; ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		s, err := daemon.Storage.GetVolumeIOStats(mountId, mnt.Name)
+		if err != nil {
+			return nil, err
+		}
+		stats[mnt.Name] = s
+	}
+	return stats, nil
+}
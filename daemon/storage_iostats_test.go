@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestDiskStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "iostats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(dir string) { sysClassBlock = dir }(sysClassBlock)
+	sysClassBlock = filepath.Join(root, "sys")
+
+	if err := os.MkdirAll(filepath.Join(sysClassBlock, "dm-3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stat := "     120       4     2048     30      60       2     1024     15        0      40      45\n"
+	if err := ioutil.WriteFile(filepath.Join(sysClassBlock, "dm-3", "stat"), []byte(stat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	device := filepath.Join(root, "dm-3")
+	if err := ioutil.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the device is read through its links, as /dev/mapper ones
+	link := filepath.Join(root, "luks-volume")
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := diskStats(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (VolumeIOStats{ReadOps: 120, ReadBytes: 2048 * 512, WriteOps: 60, WriteBytes: 1024 * 512}) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(sysClassBlock, "dm-3", "stat"), []byte("1 2 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := diskStats(link); err == nil {
+		t.Fatal("a truncated stat file should be refused")
+	}
+}
+
+func TestRawBlockVolumeIOStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(dir string) { sysClassBlock = dir }(sysClassBlock)
+	sysClassBlock = filepath.Join(root, "sys")
+
+	s := &RawBlockStorage{rootPath: root}
+	podId := testPodId(t)
+	for _, dir := range []string{"volumes", "devices", "dev", "sys/loop7"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeStat := func(reads, writes int) {
+		stat := []byte(fmtDiskStat(reads, writes))
+		if err := ioutil.WriteFile(filepath.Join(sysClassBlock, "loop7", "stat"), stat, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the throttled volume is opened through its loop device, the plain
+	// one as a file
+	for _, name := range []string{"throttled", "plain"} {
+		if err := ioutil.WriteFile(s.volumePath(podId, name), make([]byte, 4096), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loop := filepath.Join(root, "dev", "loop7")
+	if err := ioutil.WriteFile(loop, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(loop, s.deviceLink(filepath.Base(s.volumePath(podId, "throttled")))); err != nil {
+		t.Fatal(err)
+	}
+	writeStat(10, 5)
+
+	var noErr error
+	opts := storage.ContainerOptions{PodID: podId, Volumes: []string{"throttled", "plain"}}
+	s.takeVolumes("c1", opts, &noErr)
+	s.takeIOBaselines("c1", opts, &noErr)
+	writeStat(25, 9)
+
+	stats, err := s.GetVolumeIOStats("c1", "throttled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (VolumeIOStats{ReadOps: 15, ReadBytes: 15 * 8 * 512, WriteOps: 4, WriteBytes: 4 * 8 * 512}) {
+		t.Fatalf("the I/O since the container was prepared should be counted, got %+v", stats)
+	}
+	if _, err := s.GetVolumeIOStats("c1", "plain"); err == nil {
+		t.Fatal("the I/O of a volume opened as a file should not be accounted")
+	}
+
+	// the device attached again starts from zero
+	writeStat(3, 1)
+	if stats, err = s.GetVolumeIOStats("c1", "throttled"); err != nil {
+		t.Fatal(err)
+	} else if stats.ReadOps != 3 || stats.WriteOps != 1 {
+		t.Fatalf("the counters of a device attached again should be returned as they are, got %+v", stats)
+	}
+
+	s.ioBaselines.remove("c1", &noErr)
+	if _, err := s.GetVolumeIOStats("c1", "throttled"); err == nil {
+		t.Fatal("the counters should be reset once the container is cleaned up")
+	}
+}
+
+// fmtDiskStat formats a sysfs stat file of a device, each I/O of 8 sectors.
+func fmtDiskStat(reads, writes int) string {
+	return fmt.Sprintf("%d 0 %d 0 %d 0 %d 0 0 0 0\n", reads, reads*8, writes, writes*8)
+}
+
+func TestOverlayFsVolumeIOStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay-volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "existing"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &OverlayFsStorage{}
+	if err := o.ioWatches.start("c1", map[string]string{"data": dir}); err != nil {
+		t.Fatal(err)
+	}
+	// a new directory is watched as well
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "new"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "existing"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 500))
+	f.Close()
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "existing")); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats *VolumeIOStats
+	for i := 0; i < 100; i++ {
+		if stats, err = o.GetVolumeIOStats("c1", "data"); err != nil {
+			t.Fatal(err)
+		}
+		if stats.ReadOps > 0 && stats.WriteBytes >= 4096+500 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.ReadOps == 0 || stats.WriteOps < 2 || stats.WriteBytes != 4096+500 {
+		t.Fatalf("the growth of the files written should be counted, got %+v", stats)
+	}
+	if _, err := o.GetVolumeIOStats("c1", "other"); err == nil {
+		t.Fatal("a volume the container does not use should not be accounted")
+	}
+
+	var noErr error
+	o.ioWatches.stop("c1", &noErr)
+	if _, err := o.GetVolumeIOStats("c1", "data"); err == nil {
+		t.Fatal("the counters should be reset once the container is cleaned up")
+	}
+}
@@ -0,0 +1,414 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// ISCSIStorage maps the logical units of an iSCSI target to the volumes. The
+// LUN of a volume is given as its source, and the rootfs of each container is
+// expected as the block <root>/blocks/<mountId>, usually a link to a LUN.
+//
+// The driver options are:
+//
+//	iscsi.portal  ip[:port] of the portal of the target
+//	iscsi.target  iqn of the target
+//	iscsi.fstype  filesystem of the volumes without fstype, ext4 by default
+type ISCSIStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	Portal   string
+	Target   string
+	Fstype   string
+	// devDir holds the links to the LUNs the kernel made for the sessions.
+	devDir string
+}
+
+func ISCSIFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &ISCSIStorage{
+		db:       db,
+		rootPath: config.DriverRoot("iscsi"),
+		Portal:   config.DriverOption("iscsi", "portal"),
+		Target:   config.DriverOption("iscsi", "target"),
+		Fstype:   config.DriverOption("iscsi", "fstype"),
+		devDir:   "/dev/disk/by-path",
+	}
+	if driver.Portal == "" || driver.Target == "" {
+		return nil, fmt.Errorf("iscsi.portal and iscsi.target are required by the iscsi storage")
+	}
+	if !strings.Contains(driver.Portal, ":") {
+		driver.Portal += ":3260"
+	}
+	if driver.Fstype == "" {
+		driver.Fstype = storage.DEFAULT_VOL_FS
+	}
+	return driver, nil
+}
+
+func (s *ISCSIStorage) Type() string {
+	return "iscsi"
+}
+
+func (s *ISCSIStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *ISCSIStorage) iscsiadm(ctx context.Context, args ...string) error {
+	if out, err := execCommand(ctx, "iscsiadm", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iscsiadm %s failed: %v: %s", strings.Join(args, " "), err, string(out))
+	}
+	return nil
+}
+
+// lunDevice is the path udev gives to the LUN of the target.
+func (s *ISCSIStorage) lunDevice(lun int) string {
+	return filepath.Join(s.devDir, fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", s.Portal, s.Target, lun))
+}
+
+func (s *ISCSIStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+func (s *ISCSIStorage) login(ctx context.Context) error {
+	if err := s.iscsiadm(ctx, "-m", "discovery", "-t", "sendtargets", "-p", s.Portal); err != nil {
+		return err
+	}
+	if err := s.iscsiadm(ctx, "-m", "node", "-T", s.Target, "-p", s.Portal, "--login"); err != nil {
+		// iscsiadm fails when the session exists already
+		if !strings.Contains(err.Error(), "already present") {
+			return err
+		}
+	}
+	glog.Infof("logged in to iscsi target %s at %s", s.Target, s.Portal)
+	return nil
+}
+
+func (s *ISCSIStorage) logout(ctx context.Context) error {
+	if err := s.iscsiadm(ctx, "-m", "node", "-T", s.Target, "-p", s.Portal, "--logout"); err != nil {
+		return err
+	}
+	glog.Infof("logged out of iscsi target %s at %s", s.Target, s.Portal)
+	return nil
+}
+
+func (s *ISCSIStorage) Init(ctx context.Context) error {
+	if err := ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700); err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Join(s.RootPath(), "blocks"), 0700); err != nil {
+		return err
+	}
+	return s.login(ctx)
+}
+
+func (*ISCSIStorage) CleanUp(ctx context.Context) error { return nil }
+
+// HealthCheck checks that the session to the target is still up.
+func (s *ISCSIStorage) HealthCheck(ctx context.Context) error {
+	out, err := execCommand(ctx, "iscsiadm", "-m", "session").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iscsiadm -m session failed: %v: %s", err, string(out))
+	}
+	if !strings.Contains(string(out), s.Target) {
+		return fmt.Errorf("no session to iscsi target %s at %s", s.Target, s.Portal)
+	}
+	return nil
+}
+
+func (s *ISCSIStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *ISCSIStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsQuota: true,
+	}
+}
+
+func (s *ISCSIStorage) KernelCapabilities() []string {
+	return nil
+}
+
+func (s *ISCSIStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	block, err := filepath.EvalSymlinks(filepath.Join(s.RootPath(), "blocks", mountId))
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the block of container %s: %v", mountId, err)
+	}
+
+	vol := &runv.VolumeDescription{
+		Name:     block,
+		Source:   block,
+		Fstype:   s.Fstype,
+		Format:   "raw",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (s *ISCSIStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return nil
+}
+
+func (s *ISCSIStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if err := rawblock.GetImage(filepath.Join(s.RootPath(), "blocks"), baseDir, mountId, s.Fstype, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *ISCSIStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	if err := rawblock.GetImage(filepath.Join(s.RootPath(), "blocks"), baseDir, mountId, s.Fstype, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+// waitDevice rescans the session until the LUN shows up.
+func (s *ISCSIStorage) waitDevice(ctx context.Context, lun int) (string, error) {
+	device := s.lunDevice(lun)
+	for i := 0; i < 10; i++ {
+		if _, err := os.Stat(device); err == nil {
+			return device, nil
+		}
+		if i == 0 {
+			if err := s.iscsiadm(ctx, "-m", "node", "-T", s.Target, "-p", s.Portal, "--rescan"); err != nil {
+				return "", err
+			}
+		}
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	return "", fmt.Errorf("lun %d of iscsi target %s does not show up as %s", lun, s.Target, device)
+}
+
+func (s *ISCSIStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume links the volume to the device of the LUN given as the source
+// of the volume.
+func (s *ISCSIStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	lun, err := strconv.Atoi(spec.Source)
+	if err != nil || lun < 0 {
+		return fmt.Errorf("invalid source %q of iscsi volume %s, should be a lun", spec.Source, spec.Name)
+	}
+	device, err := s.waitDevice(ctx, lun)
+	if err != nil {
+		return err
+	}
+	volPath := s.volumePath(podId, spec.Name)
+	if err := os.Symlink(device, volPath); err != nil && !os.IsExist(err) {
+		return err
+	}
+	glog.V(1).Infof("volume %s mapped to lun %d of iscsi target %s", spec.Name, lun, s.Target)
+
+	spec.Source = device
+	spec.Format = "raw"
+	if spec.Fstype == "" {
+		spec.Fstype = s.Fstype
+	}
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// RemoveVolume unmaps the volume, and logs out of the target once no volume
+// of any pod is mapped anymore. The data stays on the LUN.
+func (s *ISCSIStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	volPath := s.volumePath(podId, name)
+	if device, err := filepath.EvalSymlinks(volPath); err == nil && storage.PathInUse(device) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volPath, podId)
+		return ErrVolumeInUse
+	}
+	if err := os.Remove(volPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := deleteVolumeRecord(ctx, s.db, podId, name); err != nil {
+		return err
+	}
+
+	vols, err := ioutil.ReadDir(filepath.Join(s.RootPath(), "volumes"))
+	if err != nil {
+		return err
+	}
+	if len(vols) == 0 {
+		return s.logout(ctx)
+	}
+	return nil
+}
+
+func (s *ISCSIStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		device, _ := os.Readlink(s.volumePath(podId, name))
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: device,
+			Format: "raw",
+			Fstype: s.Fstype,
+		})
+	}
+	return vols, nil
+}
+
+func (s *ISCSIStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ISCSIStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	if _, err := os.Lstat(s.volumePath(podId, volName)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *ISCSIStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *ISCSIStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *ISCSIStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ISCSIStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ISCSIStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *ISCSIStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *ISCSIStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ISCSIStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect unmaps the orphaned volumes, the data stays on the LUNs.
+func (s *ISCSIStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		volPath := filepath.Join(dir, name)
+		if device, err := filepath.EvalSymlinks(volPath); err == nil && storage.PathInUse(device) {
+			glog.Warningf("orphaned volume %s is still in use, leave it", volPath)
+			continue
+		}
+		if err := os.Remove(volPath); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", volPath, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
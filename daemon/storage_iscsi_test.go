@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestISCSIVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "iscsi-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	config, err := NewStorageConfig(map[string]string{
+		"iscsi.portal": "10.0.0.1",
+		"iscsi.target": "iqn.2016-01.sh.hyper:test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := ISCSIFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*ISCSIStorage)
+	s.rootPath = filepath.Join(root, "iscsi")
+	s.devDir = filepath.Join(root, "dev")
+	if err := os.MkdirAll(s.devDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.lunDevice(1), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	if err := s.CreateVolume(context.Background(), podId, &apitypes.UserVolume{Name: "vol1", Source: "disk"}); err == nil {
+		t.Fatal("a source which is not a lun should be refused")
+	}
+	spec := &apitypes.UserVolume{Name: "vol1", Source: "1"}
+	if err := s.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if spec.Source != s.lunDevice(1) || spec.Format != "raw" || spec.Fstype != "ext4" {
+		t.Fatalf("unexpected volume spec %#v", spec)
+	}
+	if exists, err := s.VolumeExists(context.Background(), podId, "vol1"); err != nil || !exists {
+		t.Fatalf("expected vol1 to exist, got %v, %v", exists, err)
+	}
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+
+	commands, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"iscsiadm -m discovery -t sendtargets -p 10.0.0.1:3260",
+		"iscsiadm -m node -T iqn.2016-01.sh.hyper:test -p 10.0.0.1:3260 --login",
+		"iscsiadm -m node -T iqn.2016-01.sh.hyper:test -p 10.0.0.1:3260 --logout",
+	} {
+		if !strings.Contains(string(commands), expected) {
+			t.Fatalf("%q is not run, got:\n%s", expected, commands)
+		}
+	}
+}
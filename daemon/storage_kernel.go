@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/pkg/parsers/kernel"
+	"golang.org/x/net/context"
+)
+
+// The kernel capabilities a driver returns from KernelCapabilities are
+// either a minimum version, as "kernel>=3.18", or a filesystem the kernel
+// must list in /proc/filesystems, as "fs:overlay".
+const (
+	kernelVersionPrefix    = "kernel>="
+	kernelFilesystemPrefix = "fs:"
+)
+
+// procVersion and procFilesystems are replaced by the tests.
+var (
+	procVersion     = "/proc/version"
+	procFilesystems = "/proc/filesystems"
+)
+
+// kernelVersion parses the release out of /proc/version, as in
+// "Linux version 4.9.0-3-amd64 (...)".
+func kernelVersion() (*kernel.VersionInfo, error) {
+	data, err := ioutil.ReadFile(procVersion)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 || fields[0] != "Linux" || fields[1] != "version" {
+		return nil, fmt.Errorf("unexpected %s: %q", procVersion, strings.TrimSpace(string(data)))
+	}
+	return kernel.ParseRelease(fields[2])
+}
+
+// kernelFilesystems returns the filesystems listed in /proc/filesystems.
+func kernelFilesystems() (map[string]bool, error) {
+	f, err := os.Open(procFilesystems)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	filesystems := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// "nodev\toverlay" or "\text4"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			filesystems[fields[len(fields)-1]] = true
+		}
+	}
+	return filesystems, scanner.Err()
+}
+
+// checkKernelCapabilities checks the kernel against the capabilities of the
+// driver. A filesystem which is not listed is looked for again after
+// modprobe, as the modules are only listed once loaded.
+func checkKernelCapabilities(ctx context.Context, driver string, caps []string) error {
+	var filesystems map[string]bool
+	for _, c := range caps {
+		switch {
+		case strings.HasPrefix(c, kernelVersionPrefix):
+			min, err := kernel.ParseRelease(strings.TrimPrefix(c, kernelVersionPrefix))
+			if err != nil {
+				return err
+			}
+			v, err := kernelVersion()
+			if err != nil {
+				return fmt.Errorf("cannot check that the kernel is at least %s for the %s storage driver: %v", strings.TrimPrefix(c, kernelVersionPrefix), driver, err)
+			}
+			if kernel.CompareKernelVersion(*v, *min) < 0 {
+				return fmt.Errorf("the %s storage driver needs linux %s or later, the kernel is %s", driver, strings.TrimPrefix(c, kernelVersionPrefix), v)
+			}
+		case strings.HasPrefix(c, kernelFilesystemPrefix):
+			fs := strings.TrimPrefix(c, kernelFilesystemPrefix)
+			var err error
+			if filesystems == nil {
+				if filesystems, err = kernelFilesystems(); err != nil {
+					return fmt.Errorf("cannot check that the kernel supports %s for the %s storage driver: %v", fs, driver, err)
+				}
+			}
+			if !filesystems[fs] {
+				execCommand(ctx, "modprobe", fs).Run()
+				if filesystems, err = kernelFilesystems(); err != nil {
+					return fmt.Errorf("cannot check that the kernel supports %s for the %s storage driver: %v", fs, driver, err)
+				}
+			}
+			if !filesystems[fs] {
+				return fmt.Errorf("the %s storage driver needs the %s filesystem, which the kernel does not support: it is not in %s, even after modprobe %s", driver, fs, procFilesystems, fs)
+			}
+		default:
+			return fmt.Errorf("unknown kernel capability %q of the %s storage driver", c, driver)
+		}
+	}
+	return nil
+}
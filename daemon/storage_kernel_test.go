@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeProc replaces /proc/version and /proc/filesystems until the returned
+// function is called.
+func fakeProc(t *testing.T, version, filesystems string) func() {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "version"), []byte(version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "filesystems"), []byte(filesystems), 0644); err != nil {
+		t.Fatal(err)
+	}
+	procVersion, procFilesystems = filepath.Join(dir, "version"), filepath.Join(dir, "filesystems")
+	return func() {
+		procVersion, procFilesystems = "/proc/version", "/proc/filesystems"
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheckKernelCapabilities(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	defer fakeProc(t, "Linux version 3.16.0-4-amd64 (debian-kernel@lists.debian.org) #1 SMP\n",
+		"nodev\tsysfs\nnodev\ttmpfs\n\text4\n\txfs\n")()
+
+	ctx := context.Background()
+	if err := checkKernelCapabilities(ctx, "rawblock", []string{"kernel>=3.16", "fs:xfs", "fs:ext4"}); err != nil {
+		t.Fatalf("the kernel should be supported, got %v", err)
+	}
+	if err := checkKernelCapabilities(ctx, "rawblock", []string{"fs:tmpfs"}); err != nil {
+		t.Fatalf("the nodev filesystems should be listed, got %v", err)
+	}
+
+	err := checkKernelCapabilities(ctx, "overlay", []string{"kernel>=3.18", "fs:overlay"})
+	if err == nil || !strings.Contains(err.Error(), "needs linux 3.18 or later, the kernel is 3.16.0") {
+		t.Fatalf("expected the kernel too old, got %v", err)
+	}
+	err = checkKernelCapabilities(ctx, "overlay", []string{"fs:overlay"})
+	if err == nil || !strings.Contains(err.Error(), "needs the overlay filesystem") {
+		t.Fatalf("expected overlay unsupported, got %v", err)
+	}
+	if err := checkKernelCapabilities(ctx, "overlay", []string{"overlay"}); err == nil {
+		t.Fatal("an unknown capability should fail")
+	}
+}
+
+func TestStorageInitChecksKernel(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	defer fakeProc(t, "Linux version 3.10.0-957.el7.x86_64 (mockbuild@kbuilder) #1 SMP\n", "\text4\n\txfs\nnodev\toverlay\n")()
+
+	root, err := ioutil.TempDir("", "kernel-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	o := &OverlayFsStorage{rootPath: root}
+	if err := o.Init(ctx); err == nil || !strings.Contains(err.Error(), "3.18") {
+		t.Fatalf("overlay should need a newer kernel, got %v", err)
+	}
+	s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+	if err := s.Init(ctx); err == nil || !strings.Contains(err.Error(), "3.16") {
+		t.Fatalf("xfs should need a newer kernel, got %v", err)
+	}
+	if err := (&AufsStorage{}).Init(ctx); err == nil || !strings.Contains(err.Error(), "needs the aufs filesystem") {
+		t.Fatalf("aufs should not be supported, got %v", err)
+	}
+	s = &RawBlockStorage{rootPath: root, Filesystem: "ext4"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatalf("ext4 should be supported, got %v", err)
+	}
+}
+
+func TestOverlayFsRenameWorkaround(t *testing.T) {
+	root, err := ioutil.TempDir("", "kernel-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+
+	restore := fakeProc(t, "Linux version 4.9.0-3-amd64 (debian-kernel@lists.debian.org) #1 SMP\n", "nodev\toverlay\n")
+	o := &OverlayFsStorage{rootPath: root, RenameWorkaround: RenameRedirectDir}
+	if err := o.Init(ctx); err == nil || !strings.Contains(err.Error(), "needs linux 4.10") {
+		t.Fatalf("redirect_dir should need a newer kernel, got %v", err)
+	}
+	o = &OverlayFsStorage{rootPath: root, RenameWorkaround: RenameWorkdirSplit}
+	if err := o.Init(ctx); err != nil {
+		t.Fatalf("the work dirs should be split on any kernel, got %v", err)
+	}
+	if o.WorkDir != filepath.Join(root, "work") || o.renameMountData() != nil {
+		t.Fatalf("expected the work dirs under the root, got %q with %v", o.WorkDir, o.renameMountData())
+	}
+	if fi, err := os.Stat(o.WorkDir); err != nil || !fi.IsDir() {
+		t.Fatalf("the work dir should be made: %v", err)
+	}
+	if err := (&OverlayFsStorage{rootPath: root}).Init(ctx); err != nil {
+		t.Fatalf("no workaround should only warn, got %v", err)
+	}
+	restore()
+
+	defer fakeProc(t, "Linux version 4.19.0-6-amd64 (debian-kernel@lists.debian.org) #1 SMP\n", "nodev\toverlay\n")()
+	o = &OverlayFsStorage{rootPath: root, RenameWorkaround: RenameRedirectDir}
+	if err := o.Init(ctx); err != nil {
+		t.Fatalf("redirect_dir should be supported, got %v", err)
+	}
+	if data := o.renameMountData(); len(data) != 1 || data[0] != "redirect_dir=on" {
+		t.Fatalf("expected the overlays mounted with redirect_dir, got %v", data)
+	}
+
+	if _, err := parseRenameMode("rename-copy"); err == nil {
+		t.Fatal("an unknown workaround should be refused")
+	}
+	if mode, err := parseRenameMode("workdir-split"); err != nil || mode != RenameWorkdirSplit {
+		t.Fatalf("expected workdir-split, got %q: %v", mode, err)
+	}
+}
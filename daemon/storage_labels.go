@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+// PodVolume is a volume of the pod PodId, as listed by ListVolumes.
+type PodVolume struct {
+	PodId string `json:"podId"`
+	*apitypes.UserVolume
+}
+
+// ListVolumes returns the recorded volumes of the pod, or of all the pods
+// when podId is empty, which carry all the labels given.
+func (daemon *Daemon) ListVolumes(podId string, labels map[string]string) ([]*PodVolume, error) {
+	if podId != "" {
+		p, ok := daemon.PodList.Get(podId)
+		if !ok {
+			return nil, fmt.Errorf("Can not get Pod %s info", podId)
+		}
+		podId = p.Id()
+	}
+	var vols []*PodVolume
+	for kv := range daemon.db.ListAllVolumes() {
+		if kv == nil {
+			return nil, fmt.Errorf("failed to list the volumes")
+		}
+		vol := parseVolumeRecord(kv.V)
+		id := recordPodId(kv.K, vol.Name)
+		if podId != "" && id != podId {
+			continue
+		}
+		if !matchLabels(vol.Labels, labels) {
+			continue
+		}
+		vols = append(vols, &PodVolume{PodId: id, UserVolume: vol})
+	}
+	sort.Slice(vols, func(i, j int) bool {
+		if vols[i].PodId != vols[j].PodId {
+			return vols[i].PodId < vols[j].PodId
+		}
+		return vols[i].Name < vols[j].Name
+	})
+	return vols, nil
+}
+
+// matchLabels tells whether labels holds every label of filter.
+func matchLabels(labels, filter map[string]string) bool {
+	for k, v := range filter {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SetVolumeLabels replaces the labels of the volume of the pod.
+func (daemon *Daemon) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	p, ok := daemon.PodList.Get(podId)
+	if !ok {
+		return fmt.Errorf("Can not get Pod %s info", podId)
+	}
+	return daemon.Storage.SetVolumeLabels(p.Id(), volName, labels)
+}
@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestVolumeLabels(t *testing.T) {
+	root, err := ioutil.TempDir("", "labels-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dbPath := filepath.Join(root, "hyper.db")
+	db, err := daemondb.NewDaemonDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &OverlayFsStorage{db: db, rootPath: root}
+	podId := testPodId(t)
+	labels := map[string]string{"team": "storage", "cost-center": "42"}
+	for _, spec := range []*apitypes.UserVolume{
+		{Name: "vol1", Labels: labels},
+		{Name: "vol2"},
+	} {
+		if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+			t.Fatalf("create volume failed: %v", err)
+		}
+		defer os.RemoveAll(filepath.Dir(spec.Source))
+	}
+	if got, err := o.GetVolumeLabels(podId, "vol1"); err != nil || !reflect.DeepEqual(got, labels) {
+		t.Fatalf("the labels should be kept on creation, got %v, %v", got, err)
+	}
+	if err := o.SetVolumeLabels(podId, "vol2", map[string]string{"team": "web"}); err != nil {
+		t.Fatalf("set volume labels failed: %v", err)
+	}
+	if err := o.SetVolumeLabels(podId, "vol2", map[string]string{"": "web"}); err == nil {
+		t.Fatal("an empty label should be refused")
+	}
+	if _, err := o.GetVolumeLabels(podId, "missing"); !IsNotFound(err) {
+		t.Fatalf("expected the volume not found, got %v", err)
+	}
+	if _, err := (&AufsStorage{}).GetVolumeLabels(podId, "vol1"); !IsNotSupported(err) {
+		t.Fatalf("expected the labels not supported without records, got %v", err)
+	}
+
+	// the labels are read back from the db after a restart
+	db.Close()
+	if db, err = daemondb.NewDaemonDB(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	o = &OverlayFsStorage{db: db, rootPath: root}
+	if got, err := o.GetVolumeLabels(podId, "vol1"); err != nil || !reflect.DeepEqual(got, labels) {
+		t.Fatalf("the labels should survive a restart, got %v, %v", got, err)
+	}
+	if got, err := o.GetVolumeLabels(podId, "vol2"); err != nil || got["team"] != "web" {
+		t.Fatalf("the labels set should survive a restart, got %v, %v", got, err)
+	}
+
+	daemon := &Daemon{db: db}
+	vols, err := daemon.ListVolumes("", map[string]string{"team": "storage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].PodId != podId || vols[0].Name != "vol1" {
+		t.Fatalf("expected vol1 only, got %v", vols)
+	}
+	if vols, _ = daemon.ListVolumes("", nil); len(vols) != 2 {
+		t.Fatalf("expected all the volumes without filter, got %v", vols)
+	}
+}
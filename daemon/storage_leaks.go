@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"golang.org/x/net/context"
+)
+
+// The blocks of the containers are mounted on the host while files are
+// injected into them, and unmounted right after. A daemon killed in between
+// leaves the block mounted, and nothing records it: the container may be
+// gone from the db by the next start. Init unmounts the blocks of the
+// containers which are not in the db any more, as the overlay GC removes
+// the volumes of the pods which are not.
+
+// loopBackingFile returns the file backing the loop device, "" when the
+// device is not a loop device or has no backing file.
+func loopBackingFile(device string) string {
+	if !strings.HasPrefix(device, "/dev/loop") {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sysClassBlock, filepath.Base(device), "loop", "backing_file"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// unmountLeakedBlocks unmounts the container blocks mounted on the host
+// whose container is not in the db, and returns their mount points.
+func (s *RawBlockStorage) unmountLeakedBlocks(ctx context.Context) ([]string, error) {
+	ids, err := pod.ListContainerMountIds(s.db)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		active[id] = true
+	}
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := filepath.Join(s.RootPath(), "blocks")
+	var unmounted []string
+	for _, m := range mounts {
+		block := loopBackingFile(m.Source)
+		if filepath.Dir(block) != blocks || active[filepath.Base(block)] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return unmounted, err
+		}
+		glog.Warningf("block %s of the removed container %s is leaked on %s, unmount it", block, filepath.Base(block), m.Mountpoint)
+		// the loop device was set up with autoclear by mount, the unmount
+		// releases it
+		if err := syscall.Unmount(m.Mountpoint, 0); err != nil {
+			glog.Errorf("failed to unmount the leaked block %s from %s: %v", block, m.Mountpoint, err)
+			continue
+		}
+		// the mount point is removed as PutImage does, it is empty now
+		os.Remove(m.Mountpoint)
+		unmounted = append(unmounted, m.Mountpoint)
+	}
+	return unmounted, nil
+}
@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+)
+
+func TestRawBlockUnmountLeakedBlocks(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting blocks needs root")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the daemon was killed while injecting files into both containers, the
+	// removed one is not in the db any more
+	blocks, sharedDir := filepath.Join(root, "blocks"), filepath.Join(root, "shared")
+	if err := os.MkdirAll(blocks, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"active", "removed"} {
+		if err := rawblock.CreateBlock(filepath.Join(blocks, id), "ext4", "", 16<<20); err != nil {
+			t.Fatal(err)
+		}
+		if err := rawblock.GetImage(blocks, sharedDir, id, "ext4", "", 0, 0); err != nil {
+			t.Skipf("the block can not be mounted: %v", err)
+		}
+		defer rawblock.PutImage(sharedDir, id)
+	}
+	cx, err := proto.Marshal(&apitypes.PersistContainer{
+		Id:       "active-container",
+		Descript: &runv.ContainerDescription{MountId: "active"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update([]byte(fmt.Sprintf(pod.CX_KEY_FMT, "active-container")), cx); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &RawBlockStorage{db: db, rootPath: root, Filesystem: "ext4"}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := mount.Mounted(filepath.Join(sharedDir, "removed")); mounted {
+		t.Fatal("the block of the removed container should be unmounted")
+	}
+	if mounted, _ := mount.Mounted(filepath.Join(sharedDir, "active")); !mounted {
+		t.Fatal("the block of the active container should be left mounted")
+	}
+}
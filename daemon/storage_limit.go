@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/hyperhq/hyperd/storage"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// defaultPrepareConcurrency is the number of containers prepared at once
+// when the config sets none.
+func defaultPrepareConcurrency() int {
+	return runtime.NumCPU() * 2
+}
+
+// ConcurrencyLimitedStorage bounds the PrepareContainer calls running at once
+// on the wrapped Storage, so that the pods started together, e.g. when the
+// host boots, do not fail on ENOMEM or EBUSY from a flood of mounts. The
+// calls past the limit wait for their turn, or for their context to be done.
+type ConcurrencyLimitedStorage struct {
+	Storage
+	slots   chan struct{}
+	metrics StorageMetrics
+
+	lock   sync.Mutex
+	queued int
+}
+
+func NewConcurrencyLimitedStorage(s Storage, limit int, metrics StorageMetrics) *ConcurrencyLimitedStorage {
+	if limit <= 0 {
+		limit = defaultPrepareConcurrency()
+	}
+	if metrics == nil {
+		metrics = NoopStorageMetrics{}
+	}
+	return &ConcurrencyLimitedStorage{
+		Storage: s,
+		slots:   make(chan struct{}, limit),
+		metrics: metrics,
+	}
+}
+
+// Concurrency returns the number of PrepareContainer calls running, and of
+// those waiting for their turn.
+func (c *ConcurrencyLimitedStorage) Concurrency() (running, queued int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.slots), c.queued
+}
+
+// report sends the concurrency to the metrics, called with the lock held so
+// that the reports are in order.
+func (c *ConcurrencyLimitedStorage) report() {
+	c.metrics.RecordPrepareConcurrency(c.Type(), len(c.slots), c.queued)
+}
+
+func (c *ConcurrencyLimitedStorage) acquire(ctx context.Context) error {
+	c.lock.Lock()
+	select {
+	case c.slots <- struct{}{}:
+		c.report()
+		c.lock.Unlock()
+		return nil
+	default:
+	}
+	c.queued++
+	c.report()
+	c.lock.Unlock()
+
+	var err error
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.lock.Lock()
+	c.queued--
+	c.report()
+	c.lock.Unlock()
+	return err
+}
+
+func (c *ConcurrencyLimitedStorage) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	<-c.slots
+	c.report()
+}
+
+func (c *ConcurrencyLimitedStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
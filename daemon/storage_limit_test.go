@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// blockingPrepareStorage is a MockStorage whose PrepareContainer blocks until
+// released.
+type blockingPrepareStorage struct {
+	*MockStorage
+	started chan string
+	release chan struct{}
+}
+
+func (s *blockingPrepareStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	s.started <- mountId
+	<-s.release
+	return s.MockStorage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+type concurrencyRecord struct {
+	running, queued int
+}
+
+type fakeConcurrencyMetrics struct {
+	NoopStorageMetrics
+	sync.Mutex
+	records []concurrencyRecord
+}
+
+func (m *fakeConcurrencyMetrics) RecordPrepareConcurrency(driver string, running, queued int) {
+	m.Lock()
+	defer m.Unlock()
+	m.records = append(m.records, concurrencyRecord{running, queued})
+}
+
+func TestConcurrencyLimitedStorage(t *testing.T) {
+	inner := &blockingPrepareStorage{
+		MockStorage: NewMockStorage(),
+		started:     make(chan string, 3),
+		release:     make(chan struct{}),
+	}
+	metrics := &fakeConcurrencyMetrics{}
+	s := NewConcurrencyLimitedStorage(inner, 2, metrics)
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			_, err := s.PrepareContainer(context.Background(), fmt.Sprintf("c%d", i), "/shared", storage.ContainerOptions{})
+			errs <- err
+		}(i)
+	}
+	<-inner.started
+	<-inner.started
+	for deadline := time.Now().Add(time.Second); ; {
+		if running, queued := s.Concurrency(); running == 2 && queued == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("2 calls should run and 1 wait, got %d and %d", running, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case id := <-inner.started:
+		t.Fatalf("%s should wait for its turn", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a call waiting past its deadline gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.PrepareContainer(ctx, "late", "/shared", storage.ContainerOptions{}); err != context.DeadlineExceeded {
+		t.Fatalf("the call should give up at its deadline, got %v", err)
+	}
+
+	close(inner.release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if running, queued := s.Concurrency(); running != 0 || queued != 0 {
+		t.Fatalf("no call should be left, got %d running and %d waiting", running, queued)
+	}
+	if len(inner.Calls("PrepareContainer")) != 3 {
+		t.Fatalf("the waiting call should run once its turn comes, got %v", inner.Calls("PrepareContainer"))
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	maxRunning, maxQueued := 0, 0
+	for _, r := range metrics.records {
+		if r.running > maxRunning {
+			maxRunning = r.running
+		}
+		if r.queued > maxQueued {
+			maxQueued = r.queued
+		}
+	}
+	if last := metrics.records[len(metrics.records)-1]; maxRunning != 2 || maxQueued != 2 || last != (concurrencyRecord{}) {
+		t.Fatalf("unexpected concurrency records %v", metrics.records)
+	}
+}
+
+func TestConcurrencyLimitedStorageDefault(t *testing.T) {
+	s := NewConcurrencyLimitedStorage(NewMockStorage(), 0, nil)
+	if cap(s.slots) != defaultPrepareConcurrency() {
+		t.Fatalf("the limit should default to %d, got %d", defaultPrepareConcurrency(), cap(s.slots))
+	}
+}
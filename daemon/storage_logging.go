@@ -0,0 +1,245 @@
+package daemon
+
+import (
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// defaultStorageLogVerbosity is the glog verbosity of the storage operations
+// in the hyperd config.
+const defaultStorageLogVerbosity glog.Level = 3
+
+// LoggingStorage logs the start and the end of every operation of the wrapped
+// Storage, as "key=value" fields: the operation, the driver, the id of the
+// container or of the volume, and at the end the duration and the error. Only
+// Type, RootPath, Capabilities and KernelCapabilities, which describe the
+// driver, are not logged.
+type LoggingStorage struct {
+	Storage
+	logf func(format string, args ...interface{})
+}
+
+func NewLoggingStorage(inner Storage, verbosity glog.Level) Storage {
+	return &LoggingStorage{
+		Storage: inner,
+		logf: func(format string, args ...interface{}) {
+			glog.V(verbosity).Infof(format, args...)
+		},
+	}
+}
+
+// log logs the start of the operation, and returns the function logging its
+// end, to be deferred with the named error result of the operation:
+//
+//	defer l.log("Op", id)(&err)
+func (l *LoggingStorage) log(operation, id string) func(*error) {
+	driver := l.Type()
+	l.logf("storage op=%s driver=%s id=%s phase=start", operation, driver, id)
+	start := time.Now()
+	return func(err *error) {
+		if *err != nil {
+			l.logf("storage op=%s driver=%s id=%s phase=end duration=%s err=%q", operation, driver, id, time.Since(start), (*err).Error())
+			return
+		}
+		l.logf("storage op=%s driver=%s id=%s phase=end duration=%s", operation, driver, id, time.Since(start))
+	}
+}
+
+func (l *LoggingStorage) Init(ctx context.Context) (err error) {
+	defer l.log("Init", "")(&err)
+	return l.Storage.Init(ctx)
+}
+
+func (l *LoggingStorage) CleanUp(ctx context.Context) (err error) {
+	defer l.log("CleanUp", "")(&err)
+	return l.Storage.CleanUp(ctx)
+}
+
+func (l *LoggingStorage) HealthCheck(ctx context.Context) (err error) {
+	defer l.log("HealthCheck", "")(&err)
+	return l.Storage.HealthCheck(ctx)
+}
+
+func (l *LoggingStorage) WaitReady(ctx context.Context) (err error) {
+	defer l.log("WaitReady", "")(&err)
+	return l.Storage.WaitReady(ctx)
+}
+
+func (l *LoggingStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer l.log("PrepareContainer", mountId)(&err)
+	return l.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (l *LoggingStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) (err error) {
+	defer l.log("PrewarmContainer", mountId)(&err)
+	return l.Storage.PrewarmContainer(ctx, mountId, sharedDir)
+}
+
+func (l *LoggingStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer l.log("CleanupContainer", id)(&err)
+	return l.Storage.CleanupContainer(ctx, id, sharedDir)
+}
+
+func (l *LoggingStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) (err error) {
+	defer l.log("InjectFile", containerId)(&err)
+	return l.Storage.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (l *LoggingStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) (err error) {
+	defer l.log("InjectDir", containerId)(&err)
+	return l.Storage.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+}
+
+// ValidateVolumeSpec has no error, its end is logged as a success whatever
+// the validation errors.
+func (l *LoggingStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	defer l.log("ValidateVolumeSpec", spec.Name)(new(error))
+	return l.Storage.ValidateVolumeSpec(spec)
+}
+
+func (l *LoggingStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer l.log("CreateVolume", volumeID(podId, spec.Name))(&err)
+	return l.Storage.CreateVolume(ctx, podId, spec)
+}
+
+func (l *LoggingStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer l.log("RemoveVolume", volumeID(podId, parseVolumeRecord(record).Name))(&err)
+	return l.Storage.RemoveVolume(ctx, podId, record)
+}
+
+func (l *LoggingStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (_ *runv.VolumeDescription, err error) {
+	defer l.log("HotPlugVolume", volumeID(podId, spec.Name))(&err)
+	return l.Storage.HotPlugVolume(ctx, podId, spec)
+}
+
+func (l *LoggingStorage) HotUnplugVolume(ctx context.Context, podId, volName string) (err error) {
+	defer l.log("HotUnplugVolume", volumeID(podId, volName))(&err)
+	return l.Storage.HotUnplugVolume(ctx, podId, volName)
+}
+
+func (l *LoggingStorage) ListVolumes(ctx context.Context, podId string) (_ []*apitypes.UserVolume, err error) {
+	defer l.log("ListVolumes", podId)(&err)
+	return l.Storage.ListVolumes(ctx, podId)
+}
+
+func (l *LoggingStorage) GetVolumeLabels(podId, volName string) (_ map[string]string, err error) {
+	defer l.log("GetVolumeLabels", volumeID(podId, volName))(&err)
+	return l.Storage.GetVolumeLabels(podId, volName)
+}
+
+func (l *LoggingStorage) SetVolumeLabels(podId, volName string, labels map[string]string) (err error) {
+	defer l.log("SetVolumeLabels", volumeID(podId, volName))(&err)
+	return l.Storage.SetVolumeLabels(podId, volName, labels)
+}
+
+func (l *LoggingStorage) VolumeRefCount(podId, volName string) int {
+	defer l.log("VolumeRefCount", volumeID(podId, volName))(new(error))
+	return l.Storage.VolumeRefCount(podId, volName)
+}
+
+func (l *LoggingStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) (err error) {
+	defer l.log("ResizeVolume", volumeID(podId, volName))(&err)
+	return l.Storage.ResizeVolume(ctx, podId, volName, newSizeBytes)
+}
+
+func (l *LoggingStorage) VolumeExists(ctx context.Context, podId, volName string) (_ bool, err error) {
+	defer l.log("VolumeExists", volumeID(podId, volName))(&err)
+	return l.Storage.VolumeExists(ctx, podId, volName)
+}
+
+func (l *LoggingStorage) DefragVolume(ctx context.Context, podId, volName string) (err error) {
+	defer l.log("DefragVolume", volumeID(podId, volName))(&err)
+	return l.Storage.DefragVolume(ctx, podId, volName)
+}
+
+func (l *LoggingStorage) WarmVolume(ctx context.Context, podId, volName string) (err error) {
+	defer l.log("WarmVolume", volumeID(podId, volName))(&err)
+	return l.Storage.WarmVolume(ctx, podId, volName)
+}
+
+func (l *LoggingStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer l.log("SnapshotVolume", volumeID(podId, volName))(&err)
+	return l.Storage.SnapshotVolume(ctx, podId, volName, snapshot)
+}
+
+func (l *LoggingStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	defer l.log("RollbackVolume", volumeID(podId, volName))(&err)
+	return l.Storage.RollbackVolume(ctx, podId, volName, snapshot)
+}
+
+func (l *LoggingStorage) FreezeVolume(ctx context.Context, podId, volName string) (err error) {
+	defer l.log("FreezeVolume", volumeID(podId, volName))(&err)
+	return l.Storage.FreezeVolume(ctx, podId, volName)
+}
+
+func (l *LoggingStorage) ThawVolume(ctx context.Context, podId, volName string) (err error) {
+	defer l.log("ThawVolume", volumeID(podId, volName))(&err)
+	return l.Storage.ThawVolume(ctx, podId, volName)
+}
+
+func (l *LoggingStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) (err error) {
+	defer l.log("CloneVolume", volumeID(dstPodId, dstVolName))(&err)
+	return l.Storage.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+}
+
+func (l *LoggingStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) (err error) {
+	defer l.log("ExportVolume", volumeID(podId, volName))(&err)
+	return l.Storage.ExportVolume(ctx, podId, volName, dst)
+}
+
+func (l *LoggingStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer l.log("ImportVolume", volumeID(podId, volName))(&err)
+	return l.Storage.ImportVolume(ctx, podId, volName, src)
+}
+
+func (l *LoggingStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) (err error) {
+	defer l.log("ExportIncrementalVolume", volumeID(podId, volName))(&err)
+	return l.Storage.ExportIncrementalVolume(ctx, podId, volName, sinceSnapshot, dst)
+}
+
+func (l *LoggingStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer l.log("ImportIncrementalVolume", volumeID(podId, volName))(&err)
+	return l.Storage.ImportIncrementalVolume(ctx, podId, volName, src)
+}
+
+func (l *LoggingStorage) ContainerStats(ctx context.Context, containerId string) (_ *StorageStats, err error) {
+	defer l.log("ContainerStats", containerId)(&err)
+	return l.Storage.ContainerStats(ctx, containerId)
+}
+
+func (l *LoggingStorage) GetVolumeIOStats(containerId, volName string) (_ *VolumeIOStats, err error) {
+	defer l.log("GetVolumeIOStats", containerId)(&err)
+	return l.Storage.GetVolumeIOStats(containerId, volName)
+}
+
+func (l *LoggingStorage) CompactContainerLayer(ctx context.Context, mountId string) (err error) {
+	defer l.log("CompactContainerLayer", mountId)(&err)
+	return l.Storage.CompactContainerLayer(ctx, mountId)
+}
+
+func (l *LoggingStorage) UsageReport(ctx context.Context) (_ *StorageUsageReport, err error) {
+	defer l.log("UsageReport", "")(&err)
+	return l.Storage.UsageReport(ctx)
+}
+
+func (l *LoggingStorage) AvailableBytes() (_ int64, err error) {
+	defer l.log("AvailableBytes", "")(&err)
+	return l.Storage.AvailableBytes()
+}
+
+func (l *LoggingStorage) DumpState(w io.Writer) (err error) {
+	defer l.log("DumpState", "")(&err)
+	return l.Storage.DumpState(w)
+}
+
+func (l *LoggingStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (_ []string, err error) {
+	defer l.log("GarbageCollect", "")(&err)
+	return l.Storage.GarbageCollect(ctx, activePodIDs)
+}
@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+func TestLoggingStorage(t *testing.T) {
+	mock := NewMockStorage()
+	l := NewLoggingStorage(mock, 0).(*LoggingStorage)
+	var entries []string
+	l.logf = func(format string, args ...interface{}) {
+		entries = append(entries, fmt.Sprintf(format, args...))
+	}
+
+	if _, err := l.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected a start and an end entry, got %q", entries)
+	}
+	if entries[0] != "storage op=PrepareContainer driver=mock id=c1 phase=start" {
+		t.Fatalf("unexpected start entry %q", entries[0])
+	}
+	if !strings.HasPrefix(entries[1], "storage op=PrepareContainer driver=mock id=c1 phase=end duration=") || strings.Contains(entries[1], "err=") {
+		t.Fatalf("unexpected end entry %q", entries[1])
+	}
+	if len(mock.Calls("PrepareContainer")) != 1 {
+		t.Fatal("the call should reach the driver")
+	}
+
+	entries = nil
+	mock.SetError("RemoveVolume", errors.New("disk gone"))
+	if err := l.RemoveVolume(context.Background(), "pod", []byte("vol1")); err == nil {
+		t.Fatal("the error of the driver should be returned")
+	}
+	if len(entries) != 2 || !strings.HasPrefix(entries[1], "storage op=RemoveVolume driver=mock id=pod/vol1 phase=end") || !strings.HasSuffix(entries[1], ` err="disk gone"`) {
+		t.Fatalf("unexpected entries %q", entries)
+	}
+}
+
+func TestLoggingStorageQueries(t *testing.T) {
+	l := NewLoggingStorage(NewMockStorage(), 0).(*LoggingStorage)
+	var entries []string
+	l.logf = func(format string, args ...interface{}) {
+		entries = append(entries, fmt.Sprintf(format, args...))
+	}
+
+	for _, c := range []struct {
+		op   string
+		id   string
+		call func()
+	}{
+		{"WaitReady", "", func() { l.WaitReady(context.Background()) }},
+		{"ValidateVolumeSpec", "vol1", func() { l.ValidateVolumeSpec(&apitypes.UserVolume{Name: "vol1"}) }},
+		{"GetVolumeLabels", "pod/vol1", func() { l.GetVolumeLabels("pod", "vol1") }},
+		{"SetVolumeLabels", "pod/vol1", func() { l.SetVolumeLabels("pod", "vol1", nil) }},
+		{"VolumeRefCount", "pod/vol1", func() { l.VolumeRefCount("pod", "vol1") }},
+		{"GetVolumeIOStats", "c1", func() { l.GetVolumeIOStats("c1", "vol1") }},
+		{"AvailableBytes", "", func() { l.AvailableBytes() }},
+		{"DumpState", "", func() { l.DumpState(ioutil.Discard) }},
+	} {
+		entries = nil
+		c.call()
+		start := fmt.Sprintf("storage op=%s driver=mock id=%s phase=start", c.op, c.id)
+		if len(entries) != 2 || entries[0] != start || !strings.HasPrefix(entries[1], fmt.Sprintf("storage op=%s driver=mock id=%s phase=end", c.op, c.id)) {
+			t.Fatalf("expected the start and the end of %s, got %q", c.op, entries)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/pborman/uuid"
+	"golang.org/x/net/context"
+)
+
+// The encrypted rawblock volumes are LUKS formatted block files, opened as
+// /dev/mapper/hyperd-<uuid> with the uuid of their LUKS header. Their keys
+// are kept in the DaemonDB under that uuid, sealed with the master key of the
+// daemon, so the volumes can be opened again after a reboot of the host.
+
+const (
+	luksKeySize    = 64
+	masterKeySize  = 32
+	luksUUIDOffset = 168
+	luksUUIDSize   = 40
+	// luksHeaderSize is added to the size of the encrypted volumes, so their
+	// filesystem gets the whole size asked for.
+	luksHeaderSize = 16 * 1024 * 1024
+)
+
+var (
+	luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+	// luksMapperDir is where dm-crypt exposes the opened devices, tests
+	// point it to a temporary directory.
+	luksMapperDir = "/dev/mapper"
+)
+
+func luksMapperName(uuid string) string {
+	return "hyperd-" + uuid
+}
+
+func luksDevice(uuid string) string {
+	return filepath.Join(luksMapperDir, luksMapperName(uuid))
+}
+
+// luksUUID reads the uuid in the LUKS header of the block, it is empty for
+// the blocks which are not encrypted.
+func luksUUID(block string) (string, error) {
+	f, err := os.Open(block)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, luksUUIDOffset+luksUUIDSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return "", nil
+		}
+		return "", err
+	}
+	if !bytes.Equal(header[:len(luksMagic)], luksMagic) {
+		return "", nil
+	}
+	return string(bytes.TrimRight(header[luksUUIDOffset:], "\x00")), nil
+}
+
+func cryptsetup(ctx context.Context, key []byte, args ...string) error {
+	cmd := execCommand(ctx, "cryptsetup", args...)
+	if key != nil {
+		// never pass the key on the command line, it shows in ps
+		cmd.Stdin = bytes.NewReader(key)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// masterKey loads the master key of the daemon, generating it on first use.
+func (s *RawBlockStorage) masterKey() ([]byte, error) {
+	s.masterLock.Lock()
+	defer s.masterLock.Unlock()
+	if s.master != nil {
+		return s.master, nil
+	}
+
+	path := s.MasterKeyPath
+	if path == "" {
+		path = filepath.Join(s.RootPath(), "master.key")
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		key = make([]byte, masterKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, key, 0600); err != nil {
+			return nil, err
+		}
+		glog.Infof("generated the master key of the encrypted volumes at %s", path)
+	}
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("master key %s should be %d bytes, got %d", path, masterKeySize, len(key))
+	}
+	s.master = key
+	return key, nil
+}
+
+func volumeKeyCipher(master []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealVolumeKey encrypts the key of a volume with the master key, the nonce
+// is prepended to the result.
+func sealVolumeKey(master, key []byte) ([]byte, error) {
+	gcm, err := volumeKeyCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, nil), nil
+}
+
+func openVolumeKey(master, sealed []byte) ([]byte, error) {
+	gcm, err := volumeKeyCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("sealed volume key is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func makeFs(ctx context.Context, fstype, device string) error {
+	force := "-F"
+	if fstype == "xfs" {
+		force = "-f"
+	}
+	if out, err := execCommand(ctx, "mkfs."+fstype, force, device).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to make %s on %s: %v, %s", fstype, device, err, out)
+	}
+	return nil
+}
+
+// createEncryptedBlock makes a LUKS block of the size plus the LUKS header,
+// opens it and makes the filesystem of the driver on the opened device. The
+// path of the device is returned.
+func (s *RawBlockStorage) createEncryptedBlock(ctx context.Context, block string, size uint64) (device string, err error) {
+	if s.db == nil {
+		return "", fmt.Errorf("encrypted volumes need the daemon db to keep their keys")
+	}
+	master, err := s.masterKey()
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, luksKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	sealed, err := sealVolumeKey(master, key)
+	if err != nil {
+		return "", err
+	}
+
+	// never format over an existing volume
+	f, err := os.OpenFile(block, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = f.Truncate(int64(size + luksHeaderSize))
+	f.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(block)
+		}
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	id := uuid.New()
+	if err := cryptsetup(ctx, key, "luksFormat", "--batch-mode", "--uuid="+id, "--key-file=-", block); err != nil {
+		return "", err
+	}
+	if err := s.db.UpdateVolumeKey(id, sealed); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			s.db.DeleteVolumeKey(id)
+		}
+	}()
+	if err := cryptsetup(ctx, key, "luksOpen", "--key-file=-", block, luksMapperName(id)); err != nil {
+		return "", err
+	}
+	if err := makeFs(ctx, s.Filesystem, luksDevice(id)); err != nil {
+		// the device is closed even when ctx is done
+		if e := cryptsetup(context.Background(), nil, "luksClose", luksMapperName(id)); e != nil {
+			glog.Errorf("failed to close %s: %v", luksDevice(id), e)
+		}
+		return "", err
+	}
+	glog.V(1).Infof("encrypted volume %s opened as %s", block, luksDevice(id))
+	return luksDevice(id), nil
+}
+
+// openEncryptedBlock opens the LUKS block with its key from the DaemonDB.
+func (s *RawBlockStorage) openEncryptedBlock(ctx context.Context, block, id string) error {
+	if s.db == nil {
+		return fmt.Errorf("no daemon db to load the key of %s", block)
+	}
+	sealed, err := s.db.GetVolumeKey(id)
+	if err != nil {
+		return fmt.Errorf("failed to load the key of %s: %v", block, err)
+	}
+	master, err := s.masterKey()
+	if err != nil {
+		return err
+	}
+	key, err := openVolumeKey(master, sealed)
+	if err != nil {
+		return fmt.Errorf("failed to unseal the key of %s: %v", block, err)
+	}
+	return cryptsetup(ctx, key, "luksOpen", "--key-file=-", block, luksMapperName(id))
+}
+
+// openEncryptedBlocks opens the encrypted volumes which are not opened yet,
+// as after a reboot of the host. A volume failing to open does not prevent
+// the others.
+func (s *RawBlockStorage) openEncryptedBlocks(ctx context.Context) error {
+	if s.db == nil {
+		return nil
+	}
+	dir := filepath.Join(s.RootPath(), "volumes")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || isVolumeMeta(entry.Name()) {
+			continue
+		}
+		block := filepath.Join(dir, entry.Name())
+		id, err := luksUUID(block)
+		if err != nil || id == "" {
+			continue
+		}
+		if exists, _ := pathExists(luksDevice(id)); exists {
+			continue
+		}
+		if err := s.openEncryptedBlock(ctx, block, id); err != nil {
+			glog.Errorf("failed to open encrypted volume %s: %v", block, err)
+			continue
+		}
+		glog.V(1).Infof("encrypted volume %s opened as %s", block, luksDevice(id))
+	}
+	return nil
+}
+
+// closeEncryptedBlock closes the device of the LUKS block and drops its key,
+// nothing is done for the blocks which are not encrypted. ErrVolumeInUse is
+// returned while the device is attached to a sandbox.
+func (s *RawBlockStorage) closeEncryptedBlock(ctx context.Context, block string) error {
+	id, err := luksUUID(block)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if id == "" {
+		return nil
+	}
+	device := luksDevice(id)
+	if exists, _ := pathExists(device); exists {
+		if storage.PathInUse(device) {
+			return ErrVolumeInUse
+		}
+		if err := cryptsetup(ctx, nil, "luksClose", luksMapperName(id)); err != nil {
+			return err
+		}
+	}
+	if s.db != nil {
+		return s.db.DeleteVolumeKey(id)
+	}
+	return nil
+}
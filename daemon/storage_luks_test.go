@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockEncryptedVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "luks-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+	mapper := filepath.Join(root, "mapper")
+	if err := os.Mkdir(mapper, 0700); err != nil {
+		t.Fatal(err)
+	}
+	luksMapperDir = mapper
+	defer func() { luksMapperDir = "/dev/mapper" }()
+	os.Setenv("HELPER_MAPPER_DIR", mapper)
+	defer os.Unsetenv("HELPER_MAPPER_DIR")
+
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{db: db, rootPath: root, Filesystem: "xfs"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 1024 * 1024, Encrypted: true}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create encrypted volume failed: %v", err)
+	}
+
+	block := s.volumePath(podId, "vol1")
+	id, err := luksUUID(block)
+	if err != nil || id == "" {
+		t.Fatalf("expected a LUKS header on %s, got %q, %v", block, id, err)
+	}
+	if spec.Source != luksDevice(id) {
+		t.Fatalf("expected the volume on %s, got %s", luksDevice(id), spec.Source)
+	}
+	if fi, err := os.Stat(block); err != nil || fi.Size() != 1024*1024+luksHeaderSize {
+		t.Fatalf("unexpected size of the encrypted block: %v, %v", fi, err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "master.key")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected a private master key: %v, %v", fi, err)
+	}
+	sealed, err := db.GetVolumeKey(id)
+	if err != nil {
+		t.Fatalf("the key should be kept in the db: %v", err)
+	}
+	if key, err := openVolumeKey(s.master, sealed); err != nil || len(key) != luksKeySize {
+		t.Fatalf("failed to unseal the volume key: %v", err)
+	}
+	if _, err := openVolumeKey(make([]byte, masterKeySize), sealed); err == nil {
+		t.Fatal("the volume key should not unseal with another master key")
+	}
+
+	// a reboot closes the device, the driver opens it again on Init
+	if err := os.Remove(spec.Source); err != nil {
+		t.Fatal(err)
+	}
+	s = &RawBlockStorage{db: db, rootPath: root, Filesystem: "xfs"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(spec.Source); err != nil {
+		t.Fatalf("the encrypted volume should be opened on Init: %v", err)
+	}
+
+	if err := s.ResizeVolume(ctx, podId, "vol1", 4*1024*1024); !IsNotSupported(err) {
+		t.Fatalf("resizing an encrypted volume should not be supported, got %v", err)
+	}
+
+	record, err := db.GetPodVolume(podId, "vol1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := parseVolumeRecord(record); !vol.Encrypted || vol.Source != spec.Source {
+		t.Fatalf("unexpected volume record %v", vol)
+	}
+	if err := s.RemoveVolume(ctx, podId, record); err != nil {
+		t.Fatalf("remove encrypted volume failed: %v", err)
+	}
+	if _, err := os.Stat(spec.Source); !os.IsNotExist(err) {
+		t.Fatalf("the device should be closed, got %v", err)
+	}
+	if _, err := os.Stat(block); !os.IsNotExist(err) {
+		t.Fatalf("the block should be removed, got %v", err)
+	}
+	if _, err := db.GetVolumeKey(id); err == nil {
+		t.Fatal("the key should be deleted with the volume")
+	}
+}
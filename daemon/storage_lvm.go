@@ -0,0 +1,462 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/docker/go-units"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// lvmOptions are the driver options of the lvm storage:
+//
+//	lvm.vg          volume group of the logical volumes, required
+//	lvm.thinpool    thin pool of the volume group the volumes are provisioned
+//	                from, the volumes are fully allocated when not set
+//	lvm.fstype      filesystem made on the volumes, ext4 by default
+//	lvm.volumesize  size of the volumes which do not ask for one
+type lvmOptions struct {
+	VolumeGroup string
+	ThinPool    string
+	Fstype      string
+	VolumeSize  uint64
+}
+
+func parseLVMOptions(config *StorageConfig) (*lvmOptions, error) {
+	opts := &lvmOptions{
+		VolumeGroup: config.DriverOption("lvm", "vg"),
+		ThinPool:    config.DriverOption("lvm", "thinpool"),
+		Fstype:      config.DriverOption("lvm", "fstype"),
+		VolumeSize:  uint64(storage.DEFAULT_DM_VOL_SIZE),
+	}
+	if opts.VolumeGroup == "" {
+		return nil, fmt.Errorf("lvm.vg is required by the lvm storage")
+	}
+	if opts.Fstype == "" {
+		opts.Fstype = storage.DEFAULT_VOL_FS
+	}
+	if size := config.DriverOption("lvm", "volumesize"); size != "" {
+		bytes, err := units.RAMInBytes(size)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid lvm.volumesize %q", size)
+		}
+		opts.VolumeSize = uint64(bytes)
+	}
+	return opts, nil
+}
+
+// LVMStorage provisions the volumes as logical volumes of a volume group,
+// thin ones when a thin pool is configured. The rootfs of each container is
+// expected as the logical volume named after its mountId in the same group.
+type LVMStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	opts     *lvmOptions
+	// devDir holds the links udev makes to the active logical volumes, as
+	// <devDir>/<vg>/<lv> and <devDir>/mapper/<vg>-<lv>.
+	devDir string
+}
+
+func LVMFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	opts, err := parseLVMOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	driver := &LVMStorage{
+		db:       db,
+		rootPath: config.DriverRoot("lvm"),
+		opts:     opts,
+		devDir:   "/dev",
+	}
+	return driver, nil
+}
+
+func (s *LVMStorage) Type() string {
+	return "lvm"
+}
+
+func (s *LVMStorage) RootPath() string {
+	return s.rootPath
+}
+
+// lvm runs the lvm command, its stderr is returned in the error.
+func lvm(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	c := execCommand(ctx, cmd, args...)
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %v: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// lvmMapperName is the name device mapper gives to the logical volume, the
+// dashes of both names are doubled.
+func lvmMapperName(vg, lv string) string {
+	return strings.Replace(vg, "-", "--", -1) + "-" + strings.Replace(lv, "-", "--", -1)
+}
+
+func (s *LVMStorage) lvName(podId, volName string) string {
+	return fmt.Sprintf("%s-%s", podId, volName)
+}
+
+// lvPath is the logical volume as the lvm commands take it.
+func (s *LVMStorage) lvPath(lv string) string {
+	return s.opts.VolumeGroup + "/" + lv
+}
+
+// device is the device mapper path of the active logical volume.
+func (s *LVMStorage) device(lv string) string {
+	return filepath.Join(s.devDir, "mapper", lvmMapperName(s.opts.VolumeGroup, lv))
+}
+
+func (s *LVMStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", s.lvName(podId, volName))
+}
+
+// activate activates the logical volume unless it is active already, and
+// returns its device. Thin volumes may be flagged to skip the activation,
+// which is ignored.
+func (s *LVMStorage) activate(ctx context.Context, lv string) (string, error) {
+	device := s.device(lv)
+	if exists, _ := pathExists(device); exists {
+		return device, nil
+	}
+	if _, err := lvm(ctx, "lvchange", "-ay", "-K", s.lvPath(lv)); err != nil {
+		return "", err
+	}
+	glog.V(1).Infof("logical volume %s activated as %s", s.lvPath(lv), device)
+	return device, nil
+}
+
+// deactivate deactivates the logical volume, refusing while its device is in
+// use.
+func (s *LVMStorage) deactivate(ctx context.Context, lv string) error {
+	device := s.device(lv)
+	if exists, _ := pathExists(device); !exists {
+		return nil
+	}
+	if storage.PathInUse(device) {
+		return ErrVolumeInUse
+	}
+	if _, err := lvm(ctx, "lvchange", "-an", s.lvPath(lv)); err != nil {
+		return err
+	}
+	glog.V(1).Infof("logical volume %s deactivated", s.lvPath(lv))
+	return nil
+}
+
+// Init checks that the volume group, and the thin pool if any, exist.
+func (s *LVMStorage) Init(ctx context.Context) error {
+	if _, err := lvm(ctx, "vgdisplay", s.opts.VolumeGroup); err != nil {
+		return fmt.Errorf("cannot find volume group %s: %v", s.opts.VolumeGroup, err)
+	}
+	if s.opts.ThinPool != "" {
+		if _, err := lvm(ctx, "lvdisplay", s.lvPath(s.opts.ThinPool)); err != nil {
+			return fmt.Errorf("cannot find thin pool %s: %v", s.lvPath(s.opts.ThinPool), err)
+		}
+	}
+	return ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700)
+}
+
+func (*LVMStorage) CleanUp(ctx context.Context) error { return nil }
+
+// HealthCheck checks that the volume group is still there.
+func (s *LVMStorage) HealthCheck(ctx context.Context) error {
+	_, err := lvm(ctx, "vgdisplay", s.opts.VolumeGroup)
+	return err
+}
+
+func (s *LVMStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *LVMStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsQuota: true,
+	}
+}
+
+func (s *LVMStorage) KernelCapabilities() []string {
+	return nil
+}
+
+func (s *LVMStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	device, err := s.activate(ctx, mountId)
+	if err != nil {
+		return nil, fmt.Errorf("cannot activate the logical volume of container %s: %v", mountId, err)
+	}
+
+	vol := &runv.VolumeDescription{
+		Name:     device,
+		Source:   device,
+		Fstype:   s.opts.Fstype,
+		Format:   "raw",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (s *LVMStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return s.deactivate(ctx, id)
+}
+
+func (s *LVMStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if _, err := s.activate(ctx, mountId); err != nil {
+		return err
+	}
+	if err := rawblock.GetImage(filepath.Join(s.devDir, s.opts.VolumeGroup), baseDir, mountId, s.opts.Fstype, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *LVMStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	if _, err := s.activate(ctx, mountId); err != nil {
+		return err
+	}
+	if err := rawblock.GetImage(filepath.Join(s.devDir, s.opts.VolumeGroup), baseDir, mountId, s.opts.Fstype, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *LVMStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume creates the logical volume of the volume, from the thin pool
+// if any, and makes the filesystem on it. The logical volume is removed again
+// if any step fails.
+func (s *LVMStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	lv := s.lvName(podId, spec.Name)
+	size := spec.SizeBytes
+	if size == 0 {
+		size = s.opts.VolumeSize
+	}
+	// lvm rounds the size up to the extent size
+	args := []string{"--yes", "-n", lv}
+	if s.opts.ThinPool != "" {
+		args = append(args, "-V", fmt.Sprintf("%db", size), "--thin", s.lvPath(s.opts.ThinPool))
+	} else {
+		args = append(args, "-L", fmt.Sprintf("%db", size), s.opts.VolumeGroup)
+	}
+	if _, err := lvm(ctx, "lvcreate", args...); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(s.volumePath(podId, spec.Name))
+			lvm(ctx, "lvremove", "-f", s.lvPath(lv))
+		}
+	}()
+	device, err := s.activate(ctx, lv)
+	if err != nil {
+		return err
+	}
+	if err := makeFs(ctx, s.opts.Fstype, device); err != nil {
+		return err
+	}
+	volPath := s.volumePath(podId, spec.Name)
+	if err := os.Symlink(device, volPath); err != nil && !os.IsExist(err) {
+		return err
+	}
+	glog.V(1).Infof("volume %s created as logical volume %s", spec.Name, s.lvPath(lv))
+
+	spec.Source = device
+	spec.Format = "raw"
+	spec.Fstype = s.opts.Fstype
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// RemoveVolume deactivates the logical volume of the volume and removes it.
+func (s *LVMStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	lv := s.lvName(podId, name)
+	if err := s.deactivate(ctx, lv); err != nil {
+		if err == ErrVolumeInUse {
+			glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", name, podId)
+		}
+		return err
+	}
+	if _, err := lvm(ctx, "lvremove", "-f", s.lvPath(lv)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.volumePath(podId, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *LVMStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.device(s.lvName(podId, name)),
+			Format: "raw",
+			Fstype: s.opts.Fstype,
+		})
+	}
+	return vols, nil
+}
+
+func (s *LVMStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *LVMStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	if _, err := os.Lstat(s.volumePath(podId, volName)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LVMStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *LVMStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *LVMStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *LVMStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *LVMStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *LVMStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *LVMStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *LVMStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect removes the logical volumes of the orphaned volumes.
+func (s *LVMStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		if err := s.deactivate(ctx, name); err != nil {
+			glog.Warningf("failed to deactivate orphaned volume %s: %v", name, err)
+			continue
+		}
+		if _, err := lvm(ctx, "lvremove", "-f", s.lvPath(name)); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", name, err)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", name, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
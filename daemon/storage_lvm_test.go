@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestLVMOptions(t *testing.T) {
+	if _, err := LVMFactory(nil, nil, nil); err == nil {
+		t.Fatal("lvm.vg should be required")
+	}
+	config, err := NewStorageConfig(map[string]string{"lvm.vg": "hyper", "lvm.volumesize": "1G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := parseLVMOptions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.VolumeGroup != "hyper" || opts.ThinPool != "" || opts.Fstype != "ext4" || opts.VolumeSize != 1024*1024*1024 {
+		t.Fatalf("unexpected options %#v", opts)
+	}
+	if lvmMapperName("vg-1", "pod-vol") != "vg--1-pod--vol" {
+		t.Fatalf("unexpected mapper name %s", lvmMapperName("vg-1", "pod-vol"))
+	}
+}
+
+func setupFakeLVM(t *testing.T, root string) {
+	for _, dir := range []string{"lvs", "mapper"} {
+		if err := os.MkdirAll(filepath.Join(root, "dev", dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("HELPER_LVM_DIR", filepath.Join(root, "dev"))
+	os.Setenv("HELPER_LVM_VG", "hyper")
+	os.Setenv("HELPER_LOG", filepath.Join(root, "commands"))
+}
+
+func TestLVMInit(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "lvm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	setupFakeLVM(t, root)
+	defer os.Unsetenv("HELPER_LVM_DIR")
+	defer os.Unsetenv("HELPER_LVM_VG")
+	defer os.Unsetenv("HELPER_LOG")
+
+	s := &LVMStorage{rootPath: filepath.Join(root, "lvm"), opts: &lvmOptions{VolumeGroup: "other"}}
+	if err := s.Init(context.Background()); err == nil || !strings.Contains(err.Error(), `Volume group "other" not found`) {
+		t.Fatalf("Init should report the missing volume group with the stderr of lvm, got %v", err)
+	}
+	s.opts = &lvmOptions{VolumeGroup: "hyper", ThinPool: "pool"}
+	if err := s.Init(context.Background()); err == nil {
+		t.Fatal("Init should fail without the thin pool")
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dev", "lvs", "pool"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLVMVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "lvm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	setupFakeLVM(t, root)
+	defer os.Unsetenv("HELPER_LVM_DIR")
+	defer os.Unsetenv("HELPER_LVM_VG")
+	defer os.Unsetenv("HELPER_LOG")
+	if err := ioutil.WriteFile(filepath.Join(root, "dev", "lvs", "pool"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &LVMStorage{
+		rootPath: filepath.Join(root, "lvm"),
+		opts:     &lvmOptions{VolumeGroup: "hyper", ThinPool: "pool", Fstype: "ext4", VolumeSize: 1024 * 1024},
+		devDir:   filepath.Join(root, "dev"),
+	}
+	ctx := context.Background()
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	device := filepath.Join(root, "dev", "mapper", lvmMapperName("hyper", podId+"-vol1"))
+	if spec.Source != device || spec.Format != "raw" || spec.Fstype != "ext4" {
+		t.Fatalf("unexpected volume %#v", spec)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(root, "commands"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "lvcreate --yes -n "+podId+"-vol1 -V 1048576b --thin hyper/pool") {
+		t.Fatalf("the volume should be provisioned from the thin pool:\n%s", data)
+	}
+	if !strings.Contains(string(data), "mkfs.ext4 -F "+device) {
+		t.Fatalf("the filesystem should be made on the volume:\n%s", data)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "vol1"); !exists {
+		t.Fatal("the volume should exist")
+	}
+
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if fileExists(device) || fileExists(filepath.Join(root, "dev", "lvs", podId+"-vol1")) {
+		t.Fatal("the logical volume should be deactivated and removed")
+	}
+
+	// the rootfs of a container
+	if err := ioutil.WriteFile(filepath.Join(root, "dev", "lvs", "container"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	vol, err := s.PrepareContainer(ctx, "container", root, storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Source != filepath.Join(root, "dev", "mapper", "hyper-container") || !vol.ReadOnly {
+		t.Fatalf("unexpected rootfs %#v", vol)
+	}
+	if err := s.CleanupContainer(ctx, "container", root); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(vol.Source) {
+		t.Fatal("the logical volume of the container should be deactivated")
+	}
+}
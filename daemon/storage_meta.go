@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+// Each block of a rawblock volume has a json sidecar, <block>.meta, telling
+// what the volume is without the daemon db nor mounting the block, as after a
+// crash. The sidecar is written once the block is made, and removed right
+// after it: a daemon dying in between leaves a sidecar without a block, which
+// Init prunes.
+
+const volumeMetaSuffix = ".meta"
+
+// volumeMeta is the content of the sidecar of a block.
+type volumeMeta struct {
+	PodID      string
+	VolumeName string
+	SizeBytes  uint64
+	Filesystem string
+	CreatedAt  time.Time
+	Labels     map[string]string `json:",omitempty"`
+}
+
+func volumeMetaPath(block string) string {
+	return block + volumeMetaSuffix
+}
+
+// isVolumeMeta tells whether the entry of the volumes dir is a sidecar rather
+// than a block.
+func isVolumeMeta(name string) bool {
+	return strings.HasSuffix(name, volumeMetaSuffix)
+}
+
+// writeVolumeMeta replaces the sidecar of the block, a sidecar is never seen
+// partially written.
+func writeVolumeMeta(block string, meta *volumeMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// a dot entry is skipped by the walks of the volumes dir
+	tmp := filepath.Join(filepath.Dir(block), "."+filepath.Base(volumeMetaPath(block))+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, volumeMetaPath(block))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func readVolumeMeta(block string) (*volumeMeta, error) {
+	data, err := ioutil.ReadFile(volumeMetaPath(block))
+	if err != nil {
+		return nil, err
+	}
+	meta := &volumeMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// newVolumeMeta describes a volume the driver just made.
+func (s *RawBlockStorage) newVolumeMeta(podId string, spec *apitypes.UserVolume, size uint64) *volumeMeta {
+	return &volumeMeta{
+		PodID:      podId,
+		VolumeName: spec.Name,
+		SizeBytes:  size,
+		Filesystem: s.Filesystem,
+		CreatedAt:  time.Now().UTC(),
+		Labels:     spec.Labels,
+	}
+}
+
+// updateVolumeMeta changes the sidecar of the block, the volumes made before
+// the sidecars have none to change.
+func updateVolumeMeta(block string, update func(*volumeMeta)) error {
+	meta, err := readVolumeMeta(block)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	update(meta)
+	return writeVolumeMeta(block, meta)
+}
+
+// syncVolumeMetaSize sets the size in the sidecar of the block to the size
+// of the block, once it was replaced.
+func syncVolumeMetaSize(block string) {
+	fi, err := os.Stat(block)
+	if err == nil {
+		err = updateVolumeMeta(block, func(meta *volumeMeta) { meta.SizeBytes = uint64(fi.Size()) })
+	}
+	if err != nil {
+		glog.Warningf("failed to update the size in the metadata of volume %s: %v", block, err)
+	}
+}
+
+// pruneVolumeMetas removes the sidecars left without their block, and those
+// left half written.
+func (s *RawBlockStorage) pruneVolumeMetas() error {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !isVolumeMeta(strings.TrimSuffix(e.Name(), ".tmp")) {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if !strings.HasPrefix(e.Name(), ".") {
+			if exists, err := pathExists(strings.TrimSuffix(p, volumeMetaSuffix)); err != nil || exists {
+				continue
+			}
+		}
+		if err := os.Remove(p); err != nil {
+			glog.Errorf("failed to remove the orphaned volume metadata %s: %v", p, err)
+			continue
+		}
+		glog.V(1).Infof("removed the orphaned volume metadata %s", p)
+	}
+	return nil
+}
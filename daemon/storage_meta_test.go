@@ -0,0 +1,136 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockVolumeMeta(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "ext4")()
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{db: db, rootPath: filepath.Join(root, "rawblock"), Filesystem: "ext4"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "data", SizeBytes: 1 << 20, Labels: map[string]string{"tier": "gold"}}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatal(err)
+	}
+	block := s.volumePath(podId, "data")
+	meta, err := readVolumeMeta(block)
+	if err != nil {
+		t.Fatalf("the volume should have its metadata: %v", err)
+	}
+	if meta.PodID != podId || meta.VolumeName != "data" || meta.SizeBytes != 1<<20 || meta.Filesystem != "ext4" ||
+		meta.CreatedAt.IsZero() || meta.Labels["tier"] != "gold" {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+
+	// the sidecar follows the resizes and the labels
+	if err := s.ResizeVolume(ctx, podId, "data", 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetVolumeLabels(podId, "data", map[string]string{"tier": "silver"}); err != nil {
+		t.Fatal(err)
+	}
+	vols, err := s.ListVolumes(ctx, podId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 {
+		t.Fatalf("the sidecar should not be listed as a volume, got %d volumes", len(vols))
+	}
+	if vols[0].SizeBytes != 2<<20 || vols[0].Fstype != "ext4" || vols[0].Labels["tier"] != "silver" {
+		t.Fatalf("the volume should be listed from its metadata, got %+v", vols[0])
+	}
+
+	record, err := db.GetPodVolume(podId, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveVolume(ctx, podId, record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(volumeMetaPath(block)); !os.IsNotExist(err) {
+		t.Fatalf("the metadata should be removed with the volume, got %v", err)
+	}
+
+	// the sidecars left without their block are pruned at start
+	kept := s.volumePath(podId, "kept")
+	orphan := s.volumePath(podId, "orphan")
+	partial := filepath.Join(filepath.Dir(kept), ".partial.meta.tmp")
+	for _, p := range []string{kept, volumeMetaPath(kept), volumeMetaPath(orphan), partial} {
+		if err := ioutil.WriteFile(p, []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(volumeMetaPath(kept)); err != nil {
+		t.Fatalf("the metadata of an existing block should be kept: %v", err)
+	}
+	for _, p := range []string{volumeMetaPath(orphan), partial} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("the orphaned metadata %s should be pruned, got %v", p, err)
+		}
+	}
+}
+
+func TestRawBlockResizeVolumeFilesystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "ext4")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: filepath.Join(root, "rawblock"), Filesystem: "ext4"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "data", SizeBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the volume keeps the filesystem it was made with after the driver
+	// is reconfigured
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+	s.Filesystem = "xfs"
+	if err := s.ResizeVolume(ctx, podId, "data", 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	commands, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(commands), "resize2fs ") || strings.Contains(string(commands), "xfs_growfs") {
+		t.Fatalf("the ext4 volume should be grown with resize2fs, ran %q", commands)
+	}
+}
@@ -0,0 +1,169 @@
+package daemon
+
+import (
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// StorageMetrics receives the duration and the result of the operations of
+// the storage driver, the daemon embedding hyperd implements it with the
+// metrics backend it exports.
+type StorageMetrics interface {
+	RecordOperation(driver, operation string, durationNs int64, err error)
+	// RecordPrepareConcurrency receives the number of PrepareContainer
+	// calls running and waiting, see ConcurrencyLimitedStorage.
+	RecordPrepareConcurrency(driver string, running, queued int)
+	// RecordInjectBandwidth receives the limit of the bandwidth of the
+	// injected files, 0 when unlimited, and the bytes injected since the
+	// last record, see ThrottledStorage.
+	RecordInjectBandwidth(driver string, limitBytesPerSec, injectedBytes int64)
+	// RecordCircuitState receives the state of the circuit breaker of the
+	// driver each time it changes, see CircuitBreakerStorage.
+	RecordCircuitState(driver, state string)
+}
+
+// NoopStorageMetrics drops every record.
+type NoopStorageMetrics struct{}
+
+func (NoopStorageMetrics) RecordOperation(driver, operation string, durationNs int64, err error) {}
+
+func (NoopStorageMetrics) RecordPrepareConcurrency(driver string, running, queued int) {}
+
+func (NoopStorageMetrics) RecordInjectBandwidth(driver string, limitBytesPerSec, injectedBytes int64) {
+}
+
+func (NoopStorageMetrics) RecordCircuitState(driver, state string) {}
+
+// MetricedStorage reports the operations which touch the disk of the wrapped
+// Storage to a StorageMetrics.
+type MetricedStorage struct {
+	Storage
+	metrics StorageMetrics
+}
+
+func NewMetricedStorage(s Storage, metrics StorageMetrics) *MetricedStorage {
+	if metrics == nil {
+		metrics = NoopStorageMetrics{}
+	}
+	return &MetricedStorage{
+		Storage: s,
+		metrics: metrics,
+	}
+}
+
+// record takes the named result of the caller, so it sees the returned error
+// once run deferred.
+func (m *MetricedStorage) record(operation string, start time.Time, err *error) {
+	m.metrics.RecordOperation(m.Type(), operation, time.Since(start).Nanoseconds(), *err)
+}
+
+func (m *MetricedStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer m.record("PrepareContainer", time.Now(), &err)
+	return m.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (m *MetricedStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) (err error) {
+	defer m.record("PrewarmContainer", time.Now(), &err)
+	return m.Storage.PrewarmContainer(ctx, mountId, sharedDir)
+}
+
+func (m *MetricedStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer m.record("CleanupContainer", time.Now(), &err)
+	return m.Storage.CleanupContainer(ctx, id, sharedDir)
+}
+
+func (m *MetricedStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) (err error) {
+	defer m.record("InjectFile", time.Now(), &err)
+	return m.Storage.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (m *MetricedStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) (err error) {
+	defer m.record("InjectDir", time.Now(), &err)
+	return m.Storage.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+}
+
+func (m *MetricedStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer m.record("CreateVolume", time.Now(), &err)
+	return m.Storage.CreateVolume(ctx, podId, spec)
+}
+
+func (m *MetricedStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer m.record("RemoveVolume", time.Now(), &err)
+	return m.Storage.RemoveVolume(ctx, podId, record)
+}
+
+func (m *MetricedStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (_ *runv.VolumeDescription, err error) {
+	defer m.record("HotPlugVolume", time.Now(), &err)
+	return m.Storage.HotPlugVolume(ctx, podId, spec)
+}
+
+func (m *MetricedStorage) HotUnplugVolume(ctx context.Context, podId, volName string) (err error) {
+	defer m.record("HotUnplugVolume", time.Now(), &err)
+	return m.Storage.HotUnplugVolume(ctx, podId, volName)
+}
+
+func (m *MetricedStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) (err error) {
+	defer m.record("ResizeVolume", time.Now(), &err)
+	return m.Storage.ResizeVolume(ctx, podId, volName, newSizeBytes)
+}
+
+func (m *MetricedStorage) DefragVolume(ctx context.Context, podId, volName string) (err error) {
+	defer m.record("DefragVolume", time.Now(), &err)
+	return m.Storage.DefragVolume(ctx, podId, volName)
+}
+
+func (m *MetricedStorage) WarmVolume(ctx context.Context, podId, volName string) (err error) {
+	defer m.record("WarmVolume", time.Now(), &err)
+	return m.Storage.WarmVolume(ctx, podId, volName)
+}
+
+func (m *MetricedStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (collected []string, err error) {
+	defer m.record("GarbageCollect", time.Now(), &err)
+	return m.Storage.GarbageCollect(ctx, activePodIDs)
+}
+
+func (m *MetricedStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) (err error) {
+	defer m.record("CloneVolume", time.Now(), &err)
+	return m.Storage.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+}
+
+func (m *MetricedStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) (err error) {
+	defer m.record("ExportVolume", time.Now(), &err)
+	return m.Storage.ExportVolume(ctx, podId, volName, dst)
+}
+
+func (m *MetricedStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer m.record("ImportVolume", time.Now(), &err)
+	return m.Storage.ImportVolume(ctx, podId, volName, src)
+}
+
+func (m *MetricedStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) (err error) {
+	defer m.record("ExportIncrementalVolume", time.Now(), &err)
+	return m.Storage.ExportIncrementalVolume(ctx, podId, volName, sinceSnapshot, dst)
+}
+
+func (m *MetricedStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	defer m.record("ImportIncrementalVolume", time.Now(), &err)
+	return m.Storage.ImportIncrementalVolume(ctx, podId, volName, src)
+}
+
+func (m *MetricedStorage) ContainerStats(ctx context.Context, containerId string) (stats *StorageStats, err error) {
+	defer m.record("ContainerStats", time.Now(), &err)
+	return m.Storage.ContainerStats(ctx, containerId)
+}
+
+func (m *MetricedStorage) CompactContainerLayer(ctx context.Context, mountId string) (err error) {
+	defer m.record("CompactContainerLayer", time.Now(), &err)
+	return m.Storage.CompactContainerLayer(ctx, mountId)
+}
+
+func (m *MetricedStorage) UsageReport(ctx context.Context) (report *StorageUsageReport, err error) {
+	defer m.record("UsageReport", time.Now(), &err)
+	return m.Storage.UsageReport(ctx)
+}
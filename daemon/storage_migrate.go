@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// MigrateVolume moves the volume of the pod from the driver src to dst, e.g.
+// when switching from overlay to rawblock. The content is exported from src
+// as a tar archive, imported into a new volume of the same name on dst, and
+// the volume is then removed from src. The DaemonDB record of the volume is
+// only changed once all of it succeeded; on failure the volume is kept on src
+// and the one made on dst is removed.
+func MigrateVolume(ctx context.Context, src, dst Storage, podId, volumeName string) error {
+	vols, err := src.ListVolumes(ctx, podId)
+	if err != nil {
+		return err
+	}
+	var spec *apitypes.UserVolume
+	for _, vol := range vols {
+		if vol.Name == volumeName {
+			spec = vol
+		}
+	}
+	if spec == nil {
+		return fmt.Errorf("volume %s not found on %s storage: %w", volumeID(podId, volumeName), src.Type(), os.ErrNotExist)
+	}
+	// the content would be left in the clear
+	if spec.Encrypted && !dst.Capabilities().SupportsEncryption {
+		return unsupportedFeature(dst, "encrypted volumes")
+	}
+
+	// the archive is spooled to disk, the volumes may not fit in memory
+	archive, err := ioutil.TempFile("", "hyper-migrate-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	if err := src.ExportVolume(ctx, podId, volumeName, archive); err != nil {
+		return fmt.Errorf("failed to export %s from %s storage: %w", volumeID(podId, volumeName), src.Type(), err)
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ctx, tx := withVolumeRecordTx(ctx)
+	migrated := &apitypes.UserVolume{
+		Name:      spec.Name,
+		Option:    spec.Option,
+		SizeBytes: spec.SizeBytes,
+		Encrypted: spec.Encrypted,
+		Throttle:  spec.Throttle,
+		ExpiresAt: spec.ExpiresAt,
+	}
+	if err := dst.CreateVolume(ctx, podId, migrated); err != nil {
+		return fmt.Errorf("failed to create %s on %s storage: %w", volumeID(podId, volumeName), dst.Type(), err)
+	}
+	if err := dst.ImportVolume(ctx, podId, volumeName, archive); err != nil {
+		discardMigratedVolume(ctx, dst, podId, volumeName)
+		return fmt.Errorf("failed to import %s into %s storage: %w", volumeID(podId, volumeName), dst.Type(), err)
+	}
+	if err := src.RemoveVolume(ctx, podId, []byte(volumeName)); err != nil {
+		discardMigratedVolume(ctx, dst, podId, volumeName)
+		return fmt.Errorf("failed to remove %s from %s storage: %w", volumeID(podId, volumeName), src.Type(), err)
+	}
+	return tx.commit()
+}
+
+// discardMigratedVolume removes the volume made on dst by a failed migration,
+// its record changes are dropped with the ones of the migration.
+func discardMigratedVolume(ctx context.Context, dst Storage, podId, volumeName string) {
+	if err := dst.RemoveVolume(ctx, podId, []byte(volumeName)); err != nil {
+		glog.Warningf("failed to remove %s from %s storage after a failed migration: %v", volumeID(podId, volumeName), dst.Type(), err)
+	}
+}
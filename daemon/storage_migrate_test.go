@@ -0,0 +1,140 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// recordingStorage is a MockStorage which records its volumes in the
+// DaemonDB, with its name as fstype, and keeps their content in memory.
+type recordingStorage struct {
+	*MockStorage
+	name    string
+	db      *daemondb.DaemonDB
+	content map[string][]byte
+}
+
+func newRecordingStorage(name string, db *daemondb.DaemonDB) *recordingStorage {
+	return &recordingStorage{MockStorage: NewMockStorage(), name: name, db: db, content: make(map[string][]byte)}
+}
+
+func (r *recordingStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	if err := r.MockStorage.CreateVolume(ctx, podId, spec); err != nil {
+		return err
+	}
+	spec.Fstype = r.name
+	return saveVolumeRecord(ctx, r.db, podId, spec)
+}
+
+func (r *recordingStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	if err := r.MockStorage.RemoveVolume(ctx, podId, record); err != nil {
+		return err
+	}
+	name := parseVolumeRecord(record).Name
+	delete(r.content, volumeID(podId, name))
+	return deleteVolumeRecord(ctx, r.db, podId, name)
+}
+
+func (r *recordingStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	if err := r.MockStorage.ExportVolume(ctx, podId, volName, dst); err != nil {
+		return err
+	}
+	_, err := dst.Write(r.content[volumeID(podId, volName)])
+	return err
+}
+
+func (r *recordingStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	if err := r.MockStorage.ImportVolume(ctx, podId, volName, src); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(src)
+	r.content[volumeID(podId, volName)] = data
+	return err
+}
+
+func TestMigrateVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	podId := testPodId(t)
+	src, dst := newRecordingStorage("src", db), newRecordingStorage("dst", db)
+	for _, name := range []string{"vol1", "vol2", "vol3"} {
+		if err := src.CreateVolume(context.Background(), podId, &apitypes.UserVolume{Name: name, SizeBytes: 1 << 20}); err != nil {
+			t.Fatal(err)
+		}
+		src.content[volumeID(podId, name)] = []byte("data of " + name)
+	}
+	recordOn := func(name string) string {
+		record, err := db.GetPodVolume(podId, name)
+		if err != nil {
+			t.Fatalf("the record of %s should be kept: %v", name, err)
+		}
+		return parseVolumeRecord(record).Fstype
+	}
+	volumes := func(s *recordingStorage) int {
+		vols, _ := s.ListVolumes(context.Background(), podId)
+		return len(vols)
+	}
+
+	if err := MigrateVolume(context.Background(), src, dst, podId, "vol1"); err != nil {
+		t.Fatalf("migrate volume failed: %v", err)
+	}
+	if data := dst.content[volumeID(podId, "vol1")]; string(data) != "data of vol1" {
+		t.Fatalf("the content should be migrated, got %q", data)
+	}
+	if exists, _ := src.VolumeExists(context.Background(), podId, "vol1"); exists {
+		t.Fatal("the volume should be removed from the source")
+	}
+	if on := recordOn("vol1"); on != "dst" {
+		t.Fatalf("the record should be the one of the destination, got %s", on)
+	}
+	if vols, _ := dst.ListVolumes(context.Background(), podId); len(vols) != 1 || vols[0].SizeBytes != 1<<20 {
+		t.Fatalf("the volume should be created with the same size, got %v", vols)
+	}
+
+	// the import fails
+	dst.SetError("ImportVolume", errors.New("no space"))
+	if err := MigrateVolume(context.Background(), src, dst, podId, "vol2"); err == nil {
+		t.Fatal("migrate volume should fail")
+	}
+	dst.SetError("ImportVolume", nil)
+	if on := recordOn("vol2"); on != "src" {
+		t.Fatalf("the record should be the one of the source, got %s", on)
+	}
+	if volumes(src) != 2 || volumes(dst) != 1 {
+		t.Fatal("the volume should be kept on the source only")
+	}
+
+	// the removal from the source fails
+	src.SetError("RemoveVolume", ErrVolumeInUse)
+	if err := MigrateVolume(context.Background(), src, dst, podId, "vol3"); !IsDeviceBusy(err) {
+		t.Fatalf("expected the volume in use, got %v", err)
+	}
+	src.SetError("RemoveVolume", nil)
+	if on := recordOn("vol3"); on != "src" {
+		t.Fatalf("the record should be the one of the source, got %s", on)
+	}
+	if volumes(src) != 2 || volumes(dst) != 1 {
+		t.Fatal("the volume should be kept on the source only")
+	}
+
+	if err := MigrateVolume(context.Background(), src, dst, podId, "missing"); !IsNotFound(err) {
+		t.Fatalf("expected the volume not found, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/sys/unix"
+)
+
+// A container prepared with ContainerOptions.MountNamespace has its rootfs
+// mounted in a mount namespace of its own, made private so that nothing is
+// propagated back to the host. The namespace lives as long as the driver
+// holds its file open. The threads entering it are thrown away afterwards,
+// the Go runtime would hand them to any goroutine otherwise.
+
+// mountNamespaces holds the mount namespaces of the containers, by mount id.
+type mountNamespaces struct {
+	sync.Mutex
+	files map[string]*os.File
+}
+
+func (n *mountNamespaces) get(mountId string) *os.File {
+	n.Lock()
+	defer n.Unlock()
+	return n.files[mountId]
+}
+
+func (n *mountNamespaces) set(mountId string, ns *os.File) {
+	n.Lock()
+	defer n.Unlock()
+	if n.files == nil {
+		n.files = make(map[string]*os.File)
+	}
+	n.files[mountId] = ns
+}
+
+// remove closes the namespace of the container, the kernel drops it with its
+// mounts once no process is in it either.
+func (n *mountNamespaces) remove(mountId string) error {
+	n.Lock()
+	defer n.Unlock()
+	ns, ok := n.files[mountId]
+	if !ok {
+		return nil
+	}
+	delete(n.files, mountId)
+	return ns.Close()
+}
+
+// onDisposableThread runs fn on a thread of its own, which exits once fn
+// returns, so that the namespaces fn moves it to are left behind.
+func onDisposableThread(fn func()) {
+	done := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		if unix.Gettid() == unix.Getpid() {
+			// the main thread never exits, it is held while another thread
+			// runs fn
+			onDisposableThread(fn)
+			runtime.UnlockOSThread()
+		} else {
+			fn()
+		}
+		close(done)
+	}()
+	<-done
+}
+
+// inNewMountNamespace runs fn in a new private mount namespace, and returns
+// the file of the namespace when fn succeeds.
+func inNewMountNamespace(fn func() error) (ns *os.File, err error) {
+	onDisposableThread(func() {
+		if err = unix.Unshare(unix.CLONE_NEWNS); err != nil {
+			err = fmt.Errorf("failed to make a mount namespace: %v", err)
+			return
+		}
+		if err = unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			err = fmt.Errorf("failed to make the mount namespace private: %v", err)
+			return
+		}
+		if err = fn(); err != nil {
+			return
+		}
+		ns, err = os.Open(fmt.Sprintf("/proc/%d/task/%d/ns/mnt", unix.Getpid(), unix.Gettid()))
+	})
+	return ns, err
+}
+
+// inMountNamespace runs fn in the mount namespace ns.
+func inMountNamespace(ns *os.File, fn func() error) (err error) {
+	onDisposableThread(func() {
+		// a thread sharing its root and cwd with others cannot change of
+		// mount namespace
+		if err = unix.Unshare(unix.CLONE_FS); err != nil {
+			return
+		}
+		if err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNS); err != nil {
+			err = fmt.Errorf("failed to enter the mount namespace %s: %v", ns.Name(), err)
+			return
+		}
+		err = fn()
+	})
+	return err
+}
+
+// prepareInNamespace mounts the rootfs of the container in a new mount
+// namespace, unless it has one already.
+func (o *OverlayFsStorage) prepareInNamespace(mountId, sharedDir string, opts storage.ContainerOptions) error {
+	if o.namespaces.get(mountId) != nil {
+		return nil
+	}
+	ns, err := inNewMountNamespace(func() error {
+		if err := o.mountContainer(mountId, sharedDir, opts.LowerLayers, opts.ReadOnly); err != nil {
+			return err
+		}
+		return storage.SetSELinuxLabel(filepath.Join(sharedDir, mountId, "rootfs"), opts.SELinuxLabel)
+	})
+	if err != nil {
+		return err
+	}
+	o.namespaces.set(mountId, ns)
+	return nil
+}
+
+// MountNamespace returns the file descriptor of the mount namespace of the
+// container, for the hypervisor to serve its rootfs from. runv's
+// VolumeDescription has no room for it.
+func (o *OverlayFsStorage) MountNamespace(mountId string) (int, bool) {
+	ns := o.namespaces.get(mountId)
+	if ns == nil {
+		return -1, false
+	}
+	return int(ns.Fd()), true
+}
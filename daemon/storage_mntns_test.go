@@ -0,0 +1,66 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestOverlayFsMountNamespace(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+	if err := ioutil.WriteFile(filepath.Join(root, "image", "root", "hosts"), []byte("127.0.0.1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	o := &OverlayFsStorage{rootPath: root}
+	if !o.Capabilities().SupportsMountNamespace {
+		t.Fatal("overlay should support the mount namespaces")
+	}
+	ctx := context.Background()
+	sharedDir := filepath.Join(root, "shared")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	opts := storage.ContainerOptions{MountNamespace: true}
+	if _, err := o.PrepareContainer(ctx, mountId, sharedDir, opts); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	// prepared again as is
+	if _, err := o.PrepareContainer(ctx, mountId, sharedDir, opts); err != nil {
+		t.Fatalf("prepare container again failed: %v", err)
+	}
+
+	if mounted, _ := overlayMounted(mountPoint); mounted {
+		t.Fatal("the rootfs should not be mounted on the host")
+	}
+	if _, err := os.Stat(filepath.Join(mountPoint, "hosts")); !os.IsNotExist(err) {
+		t.Fatalf("the rootfs should not be reachable from the host, got %v", err)
+	}
+	if fd, ok := o.MountNamespace(mountId); !ok || fd < 0 {
+		t.Fatal("the namespace of the container should be kept")
+	}
+	if err := inMountNamespace(o.namespaces.get(mountId), func() error {
+		_, err := os.Stat(filepath.Join(mountPoint, "hosts"))
+		return err
+	}); err != nil {
+		t.Fatalf("the rootfs should be mounted in the namespace: %v", err)
+	}
+
+	if err := o.CleanupContainer(ctx, mountId, sharedDir); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+	if _, ok := o.MountNamespace(mountId); ok {
+		t.Fatal("the namespace should be dropped on cleanup")
+	}
+}
@@ -0,0 +1,393 @@
+package daemon
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// MockCall is a call to a MockStorage, the context is not recorded.
+type MockCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// MockStorage implements Storage without touching the disk, for the tests of
+// the daemon logic. It records every call, returns the error set for the
+// method if any, and keeps the volumes created in memory.
+type MockStorage struct {
+	sync.Mutex
+	volumeRefs
+	calls   []MockCall
+	errors  map[string]error
+	root    *runv.VolumeDescription
+	stats   *StorageStats
+	caps    *storage.Capabilities
+	volumes map[string]map[string]*apitypes.UserVolume
+	invalid []storage.ValidationError
+}
+
+func NewMockStorage() *MockStorage {
+	return &MockStorage{
+		errors:  make(map[string]error),
+		volumes: make(map[string]map[string]*apitypes.UserVolume),
+	}
+}
+
+// SetError makes the method return err, until set to nil again.
+func (m *MockStorage) SetError(method string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.errors[method] = err
+}
+
+func (m *MockStorage) SetPrepareContainerError(err error) {
+	m.SetError("PrepareContainer", err)
+}
+
+// SetVolumeDescription sets the rootfs PrepareContainer returns, a vfs
+// volume named after the container by default.
+func (m *MockStorage) SetVolumeDescription(vol *runv.VolumeDescription) {
+	m.Lock()
+	defer m.Unlock()
+	m.root = vol
+}
+
+// SetContainerStats sets the stats ContainerStats returns, empty ones by
+// default.
+func (m *MockStorage) SetContainerStats(stats *StorageStats) {
+	m.Lock()
+	defer m.Unlock()
+	m.stats = stats
+}
+
+// SetCapabilities sets the capabilities the mock reports, all of them by
+// default.
+func (m *MockStorage) SetCapabilities(caps storage.Capabilities) {
+	m.Lock()
+	defer m.Unlock()
+	m.caps = &caps
+}
+
+// Calls returns the calls to the method, or all of them if method is empty.
+func (m *MockStorage) Calls(method string) []MockCall {
+	m.Lock()
+	defer m.Unlock()
+	var calls []MockCall
+	for _, call := range m.calls {
+		if method == "" || call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (m *MockStorage) record(method string, args ...interface{}) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls = append(m.calls, MockCall{Method: method, Args: args})
+	return m.errors[method]
+}
+
+func (m *MockStorage) Type() string {
+	return "mock"
+}
+
+func (m *MockStorage) RootPath() string {
+	return "/mock"
+}
+
+func (m *MockStorage) Init(ctx context.Context) error {
+	return m.record("Init")
+}
+
+func (m *MockStorage) CleanUp(ctx context.Context) error {
+	return m.record("CleanUp")
+}
+
+func (m *MockStorage) HealthCheck(ctx context.Context) error {
+	return m.record("HealthCheck")
+}
+
+func (m *MockStorage) WaitReady(ctx context.Context) error {
+	return m.record("WaitReady")
+}
+
+func (m *MockStorage) Capabilities() storage.Capabilities {
+	m.Lock()
+	defer m.Unlock()
+	if m.caps != nil {
+		return *m.caps
+	}
+	return storage.Capabilities{
+		SupportsSnapshots:  true,
+		SupportsResize:     true,
+		SupportsEncryption: true,
+		SupportsQuota:      true,
+		SupportsClone:      true,
+	}
+}
+
+func (m *MockStorage) KernelCapabilities() []string {
+	return nil
+}
+
+func (m *MockStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	if err := m.record("PrepareContainer", mountId, sharedDir, opts); err != nil {
+		return nil, err
+	}
+	defer m.takeVolumes(mountId, opts, &err)
+	m.Lock()
+	defer m.Unlock()
+	if m.root != nil {
+		return m.root, nil
+	}
+	return &runv.VolumeDescription{
+		Name:     "/" + mountId,
+		Source:   "/" + mountId,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}, nil
+}
+
+func (m *MockStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return m.record("PrewarmContainer", mountId, sharedDir)
+}
+
+func (m *MockStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer m.releaseVolumes(id, &err)
+	return m.record("CleanupContainer", id, sharedDir)
+}
+
+func (m *MockStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return m.record("InjectFile", containerId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (m *MockStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	return m.record("InjectDir", containerId, targetDir, baseDir, uid, gid)
+}
+
+// SetValidationErrors sets the errors ValidateVolumeSpec returns, none by
+// default.
+func (m *MockStorage) SetValidationErrors(errs []storage.ValidationError) {
+	m.Lock()
+	defer m.Unlock()
+	m.invalid = errs
+}
+
+func (m *MockStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	m.record("ValidateVolumeSpec", spec.Name)
+	m.Lock()
+	defer m.Unlock()
+	return m.invalid
+}
+
+func (m *MockStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	if err := m.record("CreateVolume", podId, spec.Name); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	spec.Source = "/mock/" + podId + "/" + spec.Name
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	if m.volumes[podId] == nil {
+		m.volumes[podId] = make(map[string]*apitypes.UserVolume)
+	}
+	m.volumes[podId][spec.Name] = spec
+	return nil
+}
+
+func (m *MockStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	name := parseVolumeRecord(record).Name
+	if err := m.record("RemoveVolume", podId, name); err != nil {
+		return err
+	}
+	if m.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	m.Lock()
+	defer m.Unlock()
+	delete(m.volumes[podId], name)
+	return nil
+}
+
+func (m *MockStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	if err := m.record("ListVolumes", podId); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	vols := make([]*apitypes.UserVolume, 0, len(m.volumes[podId]))
+	for _, vol := range m.volumes[podId] {
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
+
+func (m *MockStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return m.record("ResizeVolume", podId, volName, newSizeBytes)
+}
+
+func (m *MockStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	if err := m.record("VolumeExists", podId, volName); err != nil {
+		return false, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.volumes[podId][volName]
+	return ok, nil
+}
+
+func (m *MockStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return m.record("DefragVolume", podId, volName)
+}
+
+func (m *MockStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return m.record("WarmVolume", podId, volName)
+}
+
+func (m *MockStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	if err := m.record("GetVolumeLabels", podId, volName); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	vol, ok := m.volumes[podId][volName]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return vol.Labels, nil
+}
+
+func (m *MockStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	if err := m.record("SetVolumeLabels", podId, volName, labels); err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	vol, ok := m.volumes[podId][volName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	vol.Labels = labels
+	return nil
+}
+
+func (m *MockStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return m.record("SnapshotVolume", podId, volName, snapshot)
+}
+
+func (m *MockStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return m.record("RollbackVolume", podId, volName, snapshot)
+}
+
+func (m *MockStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return m.record("FreezeVolume", podId, volName)
+}
+
+func (m *MockStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return m.record("ThawVolume", podId, volName)
+}
+
+func (m *MockStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return m.record("CloneVolume", srcPodId, srcVolName, dstPodId, dstVolName)
+}
+
+func (m *MockStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return m.record("ExportVolume", podId, volName)
+}
+
+func (m *MockStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return m.record("ImportVolume", podId, volName)
+}
+
+func (m *MockStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return m.record("ExportIncrementalVolume", podId, volName, sinceSnapshot)
+}
+
+func (m *MockStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return m.record("ImportIncrementalVolume", podId, volName)
+}
+
+func (m *MockStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	if err := m.record("ContainerStats", containerId); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.stats != nil {
+		return m.stats, nil
+	}
+	return &StorageStats{}, nil
+}
+
+func (m *MockStorage) AvailableBytes() (int64, error) {
+	if err := m.record("AvailableBytes"); err != nil {
+		return 0, err
+	}
+	return 1 << 40, nil
+}
+
+func (m *MockStorage) DumpState(w io.Writer) error {
+	if err := m.record("DumpState"); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "{}\n")
+	return err
+}
+
+func (m *MockStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	if err := m.record("GetVolumeIOStats", containerId, volName); err != nil {
+		return nil, err
+	}
+	return &VolumeIOStats{}, nil
+}
+
+func (m *MockStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	if err := m.record("HotPlugVolume", podId, spec.Name); err != nil {
+		return nil, err
+	}
+	return &runv.VolumeDescription{Name: spec.Name, Source: spec.Source, Format: spec.Format, Fstype: spec.Fstype}, nil
+}
+
+func (m *MockStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return m.record("HotUnplugVolume", podId, volName)
+}
+
+func (m *MockStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return m.record("CompactContainerLayer", mountId)
+}
+
+func (m *MockStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	if err := m.record("UsageReport"); err != nil {
+		return nil, err
+	}
+	return newStorageUsageReport(m), nil
+}
+
+func (m *MockStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	if err := m.record("GarbageCollect", activePodIDs); err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	var collected []string
+	for podId, vols := range m.volumes {
+		if !orphanedVolume(podId+"-", activePodIDs) {
+			continue
+		}
+		for name := range vols {
+			collected = append(collected, podId+"-"+name)
+		}
+		delete(m.volumes, podId)
+	}
+	return collected, nil
+}
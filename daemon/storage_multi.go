@@ -0,0 +1,528 @@
+package daemon
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// PerPodStorageSelector returns the name of the storage driver of a pod from
+// its annotations, which are the labels of its spec; the default driver is
+// used when it returns "".
+type PerPodStorageSelector func(podAnnotations map[string]string) string
+
+// PodLabelStorageSelector selects the driver named by the label of the pods.
+func PodLabelStorageSelector(label string) PerPodStorageSelector {
+	return func(podAnnotations map[string]string) string {
+		return strings.ToLower(strings.TrimSpace(podAnnotations[label]))
+	}
+}
+
+// MultiDriverStorage routes the operations of each pod, and of its
+// containers, to the storage driver the selector chose for the pod, e.g.
+// tmpfs for the batch jobs and rbd for the databases. The driver of a pod is
+// chosen when the pod is created, or else by the first PrepareContainer,
+// CreateVolume or CloneVolume of the pod, and is kept in the DaemonDB; the
+// other operations of a pod no driver was chosen for go to the default
+// driver, as do PrewarmContainer and the accessors taking no pod.
+//
+// The drivers other than the default one are created and initialized, with
+// the wrappers of the default one, the first time a pod selects them.
+type MultiDriverStorage struct {
+	Storage
+	defaultDriver string
+	selector      PerPodStorageSelector
+	db            *daemondb.DaemonDB
+	newDriver     func(ctx context.Context, driver string) (Storage, error)
+
+	lock    sync.Mutex
+	drivers map[string]Storage
+	// pods holds the drivers of the pods, and containers the pods of the
+	// containers prepared, as kept in the DaemonDB.
+	pods       map[string]string
+	containers map[string]string
+}
+
+func NewMultiDriverStorage(defaultStorage Storage, defaultDriver string, db *daemondb.DaemonDB, selector PerPodStorageSelector, newDriver func(context.Context, string) (Storage, error)) *MultiDriverStorage {
+	return &MultiDriverStorage{
+		Storage:       defaultStorage,
+		defaultDriver: defaultDriver,
+		selector:      selector,
+		db:            db,
+		newDriver:     newDriver,
+		drivers:       map[string]Storage{defaultDriver: defaultStorage},
+		pods:          make(map[string]string),
+		containers:    make(map[string]string),
+	}
+}
+
+// SelectPodStorage chooses the driver of the pod from its annotations, unless
+// one was already chosen, and returns its name.
+func (m *MultiDriverStorage) SelectPodStorage(podId string, annotations map[string]string) (string, error) {
+	driver, _, err := m.podDriver(context.Background(), podId, annotations, true)
+	return driver, err
+}
+
+// selectDriver returns the driver chosen for the pod, or else the one of its
+// annotations, which is recorded if record is set. Called with the lock held.
+func (m *MultiDriverStorage) selectDriver(podId string, annotations map[string]string, record bool) (string, error) {
+	if driver, ok := m.pods[podId]; ok {
+		return driver, nil
+	}
+	if m.db != nil {
+		if driver, err := m.db.GetPodStorageDriver(podId); err == nil && driver != "" {
+			m.pods[podId] = driver
+			return driver, nil
+		}
+	}
+	driver := ""
+	if annotations != nil {
+		driver = m.selector(annotations)
+	}
+	if driver == "" {
+		driver = m.defaultDriver
+	}
+	if !record {
+		return driver, nil
+	}
+	if m.db != nil {
+		if err := m.db.UpdatePodStorageDriver(podId, driver); err != nil {
+			return "", err
+		}
+	}
+	m.pods[podId] = driver
+	glog.V(1).Infof("pod %s uses the %s storage driver", podId, driver)
+	return driver, nil
+}
+
+// driver returns the driver of the name, created on first use. Called with
+// the lock held.
+func (m *MultiDriverStorage) driver(ctx context.Context, name string) (Storage, error) {
+	if s, ok := m.drivers[name]; ok {
+		return s, nil
+	}
+	s, err := m.newDriver(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	m.drivers[name] = s
+	return s, nil
+}
+
+// podStorage returns the driver of the pod, see selectDriver.
+func (m *MultiDriverStorage) podStorage(ctx context.Context, podId string, annotations map[string]string, record bool) (Storage, error) {
+	_, s, err := m.podDriver(ctx, podId, annotations, record)
+	return s, err
+}
+
+// podDriver returns the name of the driver of the pod along with it.
+func (m *MultiDriverStorage) podDriver(ctx context.Context, podId string, annotations map[string]string, record bool) (string, Storage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name, err := m.selectDriver(podId, annotations, record)
+	if err != nil {
+		return "", nil, err
+	}
+	s, err := m.driver(ctx, name)
+	return name, s, err
+}
+
+// containerStorage returns the driver of the pod of the container, the
+// default one if the container was never prepared.
+func (m *MultiDriverStorage) containerStorage(ctx context.Context, mountId string) (Storage, error) {
+	m.lock.Lock()
+	podId, ok := m.containers[mountId]
+	if !ok && m.db != nil {
+		if id, err := m.db.GetContainerStoragePod(mountId); err == nil && id != "" {
+			podId, ok = id, true
+			m.containers[mountId] = podId
+		}
+	}
+	m.lock.Unlock()
+	if !ok {
+		return m.Storage, nil
+	}
+	return m.podStorage(ctx, podId, nil, false)
+}
+
+// all returns the drivers created so far.
+func (m *MultiDriverStorage) all() []Storage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	drivers := make([]Storage, 0, len(m.drivers))
+	for _, s := range m.drivers {
+		drivers = append(drivers, s)
+	}
+	return drivers
+}
+
+func (m *MultiDriverStorage) Init(ctx context.Context) error {
+	for _, s := range m.all() {
+		if err := s.Init(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiDriverStorage) CleanUp(ctx context.Context) error {
+	var first error
+	for _, s := range m.all() {
+		if err := s.CleanUp(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m *MultiDriverStorage) HealthCheck(ctx context.Context) error {
+	for _, s := range m.all() {
+		if err := s.HealthCheck(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiDriverStorage) WaitReady(ctx context.Context) error {
+	for _, s := range m.all() {
+		if err := s.WaitReady(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiDriverStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	if opts.PodID == "" {
+		return m.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+	}
+	s, err := m.podStorage(ctx, opts.PodID, opts.PodAnnotations, true)
+	if err != nil {
+		return nil, err
+	}
+	m.lock.Lock()
+	if m.containers[mountId] != opts.PodID {
+		if m.db != nil {
+			if err := m.db.UpdateContainerStoragePod(mountId, opts.PodID); err != nil {
+				m.lock.Unlock()
+				return nil, err
+			}
+		}
+		m.containers[mountId] = opts.PodID
+	}
+	m.lock.Unlock()
+	return s.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (m *MultiDriverStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	s, err := m.containerStorage(ctx, mountId)
+	if err != nil {
+		return err
+	}
+	return s.PrewarmContainer(ctx, mountId, sharedDir)
+}
+
+func (m *MultiDriverStorage) CleanupContainer(ctx context.Context, id, sharedDir string) error {
+	s, err := m.containerStorage(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.CleanupContainer(ctx, id, sharedDir)
+}
+
+func (m *MultiDriverStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	s, err := m.containerStorage(ctx, containerId)
+	if err != nil {
+		return err
+	}
+	return s.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (m *MultiDriverStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	s, err := m.containerStorage(ctx, containerId)
+	if err != nil {
+		return err
+	}
+	return s.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+}
+
+// ValidateVolumeSpec checks nothing, the driver the volume would be created
+// on depends on its pod, which the spec does not tell; CreateVolume checks
+// the spec on that driver.
+func (m *MultiDriverStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+func (m *MultiDriverStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	s, err := m.podStorage(ctx, podId, nil, true)
+	if err != nil {
+		return err
+	}
+	return s.CreateVolume(ctx, podId, spec)
+}
+
+func (m *MultiDriverStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.RemoveVolume(ctx, podId, record)
+}
+
+func (m *MultiDriverStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.ListVolumes(ctx, podId)
+}
+
+func (m *MultiDriverStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.ResizeVolume(ctx, podId, volName, newSizeBytes)
+}
+
+func (m *MultiDriverStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return false, err
+	}
+	return s.VolumeExists(ctx, podId, volName)
+}
+
+func (m *MultiDriverStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.DefragVolume(ctx, podId, volName)
+}
+
+func (m *MultiDriverStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.WarmVolume(ctx, podId, volName)
+}
+
+// VolumeRefCount is 0 when the driver of the pod can not be created.
+func (m *MultiDriverStorage) VolumeRefCount(podId, volName string) int {
+	s, err := m.podStorage(context.Background(), podId, nil, false)
+	if err != nil {
+		glog.Errorf("cannot count the references of volume %s of pod %s: %v", volName, podId, err)
+		return 0
+	}
+	return s.VolumeRefCount(podId, volName)
+}
+
+func (m *MultiDriverStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	s, err := m.podStorage(context.Background(), podId, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVolumeLabels(podId, volName)
+}
+
+func (m *MultiDriverStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	s, err := m.podStorage(context.Background(), podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.SetVolumeLabels(podId, volName, labels)
+}
+
+func (m *MultiDriverStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.SnapshotVolume(ctx, podId, volName, snapshot)
+}
+
+func (m *MultiDriverStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.RollbackVolume(ctx, podId, volName, snapshot)
+}
+
+func (m *MultiDriverStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.FreezeVolume(ctx, podId, volName)
+}
+
+func (m *MultiDriverStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.ThawVolume(ctx, podId, volName)
+}
+
+// CloneVolume clones the volumes within a driver only.
+func (m *MultiDriverStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	src, _, err := m.podDriver(ctx, srcPodId, nil, false)
+	if err != nil {
+		return err
+	}
+	dst, s, err := m.podDriver(ctx, dstPodId, nil, true)
+	if err != nil {
+		return err
+	}
+	if src != dst {
+		return unsupportedFeature(m, "cloning the volumes of the "+src+" driver into the "+dst+" driver")
+	}
+	return s.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+}
+
+func (m *MultiDriverStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.ExportVolume(ctx, podId, volName, dst)
+}
+
+func (m *MultiDriverStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.ImportVolume(ctx, podId, volName, src)
+}
+
+func (m *MultiDriverStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.ExportIncrementalVolume(ctx, podId, volName, sinceSnapshot, dst)
+}
+
+func (m *MultiDriverStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.ImportIncrementalVolume(ctx, podId, volName, src)
+}
+
+func (m *MultiDriverStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	s, err := m.podStorage(ctx, podId, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.HotPlugVolume(ctx, podId, spec)
+}
+
+func (m *MultiDriverStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	s, err := m.podStorage(ctx, podId, nil, false)
+	if err != nil {
+		return err
+	}
+	return s.HotUnplugVolume(ctx, podId, volName)
+}
+
+func (m *MultiDriverStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	s, err := m.containerStorage(ctx, containerId)
+	if err != nil {
+		return nil, err
+	}
+	return s.ContainerStats(ctx, containerId)
+}
+
+func (m *MultiDriverStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	s, err := m.containerStorage(context.Background(), containerId)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetVolumeIOStats(containerId, volName)
+}
+
+func (m *MultiDriverStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	s, err := m.containerStorage(ctx, mountId)
+	if err != nil {
+		return err
+	}
+	return s.CompactContainerLayer(ctx, mountId)
+}
+
+// UsageReport merges the reports of the drivers, the drivers which do not
+// report their usage are left out.
+func (m *MultiDriverStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	report := newStorageUsageReport(m)
+	for _, s := range m.all() {
+		r, err := s.UsageReport(ctx)
+		if IsNotSupported(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for podId, u := range r.ByPod {
+			report.add(podId, u.VolumeBytes, u.ContainerLayerBytes, u.SnapshotBytes)
+		}
+		report.DedupSavedBytes += r.DedupSavedBytes
+	}
+	return report, nil
+}
+
+// GarbageCollect collects the volumes of every driver, and forgets the
+// drivers of the pods which are not active.
+func (m *MultiDriverStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	var collected []string
+	for _, s := range m.all() {
+		removed, err := s.GarbageCollect(ctx, activePodIDs)
+		collected = append(collected, removed...)
+		if err != nil && !IsNotSupported(err) {
+			return collected, err
+		}
+	}
+	active := make(map[string]bool, len(activePodIDs))
+	for _, podId := range activePodIDs {
+		active[podId] = true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.db != nil {
+		for kv := range m.db.ListPodStorageDrivers() {
+			m.pods[strings.TrimPrefix(string(kv.K), daemondb.POD_STORAGE_PREFIX)] = string(kv.V)
+		}
+		for kv := range m.db.ListContainerStoragePods() {
+			m.containers[strings.TrimPrefix(string(kv.K), daemondb.CTR_STORAGE_PREFIX)] = string(kv.V)
+		}
+	}
+	for mountId, podId := range m.containers {
+		if !active[podId] {
+			if m.db != nil {
+				m.db.DeleteContainerStoragePod(mountId)
+			}
+			delete(m.containers, mountId)
+		}
+	}
+	for podId := range m.pods {
+		if !active[podId] {
+			if m.db != nil {
+				m.db.DeletePodStorageDriver(podId)
+			}
+			delete(m.pods, podId)
+		}
+	}
+	return collected, nil
+}
@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestMultiDriverStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "multi-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a, b := NewMockStorage(), NewMockStorage()
+	RegisterDriver("test-multi-a", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) { return a, nil })
+	RegisterDriver("test-multi-b", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) { return b, nil })
+	defer unregisterDriver("test-multi-a")
+	defer unregisterDriver("test-multi-b")
+	newMulti := func() Storage {
+		s, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "test-multi-a"}, db, &StorageConfig{
+			PodStorageSelector: PodLabelStorageSelector("storage"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := newMulti()
+	if len(b.Calls("Init")) != 0 {
+		t.Fatal("the drivers no pod selected should not be created")
+	}
+
+	ctx := context.Background()
+	driver, err := s.(pod.PodStorageSelector).SelectPodStorage("pod-b", map[string]string{"storage": "test-multi-b"})
+	if err != nil || driver != "test-multi-b" {
+		t.Fatalf("pod-b should select test-multi-b, got %s, %v", driver, err)
+	}
+	if len(b.Calls("Init")) != 1 {
+		t.Fatal("the driver selected should be initialized")
+	}
+	if err := s.CreateVolume(ctx, "pod-b", &apitypes.UserVolume{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{PodID: "pod-b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c2", "/shared", storage.ContainerOptions{PodID: "pod-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c3", "/shared", storage.ContainerOptions{PodID: "pod-x", PodAnnotations: map[string]string{"storage": "test-multi-b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", "/shared"); err != nil {
+		t.Fatal(err)
+	}
+	for method, want := range map[string]int{"CreateVolume": 1, "PrepareContainer": 2, "CleanupContainer": 1} {
+		if calls := b.Calls(method); len(calls) != want {
+			t.Fatalf("%s should go to the driver of the pod %d times, got %v", method, want, calls)
+		}
+	}
+	if calls := a.Calls("PrepareContainer"); len(calls) != 1 || calls[0].Args[0] != "c2" {
+		t.Fatalf("the pods without a driver should use the default one, got %v", calls)
+	}
+	if err := s.CloneVolume(ctx, "pod-b", "vol1", "pod-a", "vol2"); !IsNotSupported(err) {
+		t.Fatalf("cloning across drivers should not be supported, got %v", err)
+	}
+	if _, err := s.(pod.PodStorageSelector).SelectPodStorage("pod-c", map[string]string{"storage": "missing"}); err == nil {
+		t.Fatal("a pod selecting a missing driver should fail")
+	}
+
+	// the drivers of the pods and of the containers are kept in the db
+	if driver, _ := db.GetPodStorageDriver("pod-b"); driver != "test-multi-b" {
+		t.Fatalf("the driver of pod-b should be recorded, got %q", driver)
+	}
+	s = newMulti()
+	if _, err := s.ContainerStats(ctx, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := b.Calls("ContainerStats"); len(calls) != 1 {
+		t.Fatalf("the driver of c1 should be found in the db, the default one got %v", a.Calls("ContainerStats"))
+	}
+
+	if _, err := s.GarbageCollect(ctx, []string{"pod-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if driver, err := db.GetPodStorageDriver("pod-b"); err == nil {
+		t.Fatalf("the driver of pod-b should be forgotten once inactive, got %q", driver)
+	}
+	if _, err := db.GetContainerStoragePod("c1"); err == nil {
+		t.Fatal("the containers of pod-b should be forgotten once inactive")
+	}
+	if driver, _ := db.GetPodStorageDriver("pod-a"); driver != "test-multi-a" {
+		t.Fatalf("the driver of pod-a should be kept, got %q", driver)
+	}
+}
@@ -0,0 +1,397 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// nfsOptions are the driver options of the nfs storage:
+//
+//	nfs.share    host:path of the export holding the rootfs of the containers
+//	nfs.options  nfs mount options, e.g. "nolock,vers=4"
+type nfsOptions struct {
+	Share        string
+	MountOptions []string
+}
+
+func parseNFSOptions(config *StorageConfig) (*nfsOptions, error) {
+	opts := &nfsOptions{
+		Share: config.DriverOption("nfs", "share"),
+	}
+	if opts.Share != "" && !strings.Contains(opts.Share, ":") {
+		return nil, fmt.Errorf("invalid nfs.share %q, should be host:path", opts.Share)
+	}
+	for _, opt := range strings.Split(config.DriverOption("nfs", "options"), ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			opts.MountOptions = append(opts.MountOptions, opt)
+		}
+	}
+	return opts, nil
+}
+
+// NFSStorage mounts the volumes from nfs exports given as the source of the
+// volumes, and finds the rootfs of the containers in the nfs.share export.
+type NFSStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	opts     *nfsOptions
+}
+
+func NFSFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	opts, err := parseNFSOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	driver := &NFSStorage{
+		db:       db,
+		rootPath: config.DriverRoot("nfs"),
+		opts:     opts,
+	}
+	return driver, nil
+}
+
+func (s *NFSStorage) Type() string {
+	return "nfs"
+}
+
+func (s *NFSStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *NFSStorage) shareDir() string {
+	return filepath.Join(s.RootPath(), "share")
+}
+
+func (s *NFSStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+// nfsMountData returns the data of the nfs mount of source. Unlike mount.nfs,
+// the kernel does not resolve the server, so its address is passed as addr.
+func nfsMountData(source string, options []string) (string, error) {
+	fields := strings.SplitN(source, ":", 2)
+	if len(fields) != 2 || fields[0] == "" || !strings.HasPrefix(fields[1], "/") {
+		return "", fmt.Errorf("invalid nfs source %q, should be host:/path", source)
+	}
+	addr := fields[0]
+	if net.ParseIP(addr) == nil {
+		ips, err := net.LookupIP(addr)
+		if err != nil || len(ips) == 0 {
+			return "", fmt.Errorf("cannot resolve nfs server %s: %v", addr, err)
+		}
+		addr = ips[0].String()
+	}
+	return strings.Join(append([]string{"addr=" + addr}, options...), ","), nil
+}
+
+func (s *NFSStorage) mountNFS(ctx context.Context, source, target string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := nfsMountData(source, s.opts.MountOptions)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, "nfs", 0, data); err != nil {
+		return fmt.Errorf("failed to mount nfs %s to %s: %v", source, target, err)
+	}
+	return nil
+}
+
+func (s *NFSStorage) Init(ctx context.Context) error {
+	if err := ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700); err != nil {
+		return err
+	}
+	if s.opts.Share == "" {
+		return nil
+	}
+	if mounted, _ := mount.Mounted(s.shareDir()); mounted {
+		return nil
+	}
+	return s.mountNFS(ctx, s.opts.Share, s.shareDir())
+}
+
+func (s *NFSStorage) CleanUp(ctx context.Context) error {
+	if mounted, _ := mount.Mounted(s.shareDir()); !mounted {
+		return nil
+	}
+	return syscall.Unmount(s.shareDir(), 0)
+}
+
+// HealthCheck checks that the share is still mounted.
+func (s *NFSStorage) HealthCheck(ctx context.Context) error {
+	if s.opts.Share != "" {
+		if mounted, _ := mount.Mounted(s.shareDir()); !mounted {
+			return fmt.Errorf("nfs share %s is not mounted on %s", s.opts.Share, s.shareDir())
+		}
+	}
+	return checkWritable(filepath.Join(s.RootPath(), "volumes"))
+}
+
+func (s *NFSStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *NFSStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{}
+}
+
+func (s *NFSStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// PrepareContainer bind mounts the rootfs of the container from the share,
+// which is already mounted by Init.
+func (s *NFSStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.opts.Share == "" {
+		return nil, fmt.Errorf("nfs.share is not set, cannot find the rootfs of %s", mountId)
+	}
+	rootfs := filepath.Join(s.shareDir(), mountId, "rootfs")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return nil, err
+	}
+	if err := syscall.Mount(rootfs, mountPoint, "bind", syscall.MS_BIND, ""); err != nil {
+		return nil, fmt.Errorf("failed to mount %s to %s: %v", rootfs, mountPoint, err)
+	}
+	if opts.ReadOnly {
+		if err := syscall.Mount(rootfs, mountPoint, "bind", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+			return nil, fmt.Errorf("failed to mount %s to %s readonly: %v", rootfs, mountPoint, err)
+		}
+	}
+
+	containerPath := "/" + mountId
+	vol := &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (s *NFSStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return syscall.Unmount(filepath.Join(sharedDir, id, "rootfs"), 0)
+}
+
+func (s *NFSStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return storage.FsInjectFile(src, mountId, target, s.shareDir(), perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *NFSStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return storage.FsInjectDir(src, mountId, targetDir, s.shareDir(), uid, gid, s.verifyChecksum)
+}
+
+func (s *NFSStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume mounts the export given as the source of the volume.
+func (s *NFSStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	volPath := s.volumePath(podId, spec.Name)
+	if mounted, _ := mount.Mounted(volPath); !mounted {
+		if err := s.mountNFS(ctx, spec.Source, volPath); err != nil {
+			return err
+		}
+	}
+	glog.V(1).Infof("volume %s mounted from nfs %s", spec.Name, spec.Source)
+
+	spec.Source = volPath
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// RemoveVolume unmounts the volume, the data stays on the nfs server.
+func (s *NFSStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	volPath := s.volumePath(podId, name)
+	if mounted, _ := mount.Mounted(volPath); mounted {
+		if err := syscall.Unmount(volPath, 0); err != nil {
+			if err == syscall.EBUSY {
+				glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volPath, podId)
+				return ErrVolumeInUse
+			}
+			return err
+		}
+	}
+	if err := os.Remove(volPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *NFSStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "vfs",
+			Fstype: "dir",
+		})
+	}
+	return vols, nil
+}
+
+func (s *NFSStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *NFSStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.volumePath(podId, volName))
+}
+
+func (s *NFSStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *NFSStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *NFSStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *NFSStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *NFSStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *NFSStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *NFSStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *NFSStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect unmounts the orphaned volumes, the data stays on the nfs
+// server.
+func (s *NFSStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		volPath := filepath.Join(dir, name)
+		if mounted, _ := mount.Mounted(volPath); mounted {
+			if err := syscall.Unmount(volPath, 0); err != nil {
+				glog.Warningf("failed to unmount orphaned volume %s: %v", volPath, err)
+				continue
+			}
+		}
+		if err := os.Remove(volPath); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", volPath, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
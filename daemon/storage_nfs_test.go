@@ -0,0 +1,41 @@
+package daemon
+
+import (
+	"testing"
+)
+
+func TestNFSOptions(t *testing.T) {
+	config, err := NewStorageConfig(map[string]string{
+		"nfs.share":   "10.0.0.1:/exports/hyper",
+		"nfs.options": "nolock, vers=4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := NFSFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*NFSStorage)
+	if s.opts.Share != "10.0.0.1:/exports/hyper" {
+		t.Fatalf("unexpected share %s", s.opts.Share)
+	}
+
+	data, err := nfsMountData(s.opts.Share, s.opts.MountOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "addr=10.0.0.1,nolock,vers=4" {
+		t.Fatalf("unexpected mount data %s", data)
+	}
+
+	for _, source := range []string{"10.0.0.1", "10.0.0.1:relative", ":/exports"} {
+		if _, err := nfsMountData(source, nil); err == nil {
+			t.Fatalf("invalid source %s should be refused", source)
+		}
+	}
+	config, _ = NewStorageConfig(map[string]string{"nfs.share": "/exports/hyper"})
+	if _, err := NFSFactory(nil, nil, config); err == nil {
+		t.Fatal("a share without host should be refused")
+	}
+}
@@ -0,0 +1,271 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// ErrInvalidTransition is the error of an operation the state of its
+// container or volume does not allow, e.g. cleaning a container up while it
+// is being prepared.
+var ErrInvalidTransition = errors.New("invalid storage state transition")
+
+// The states of the containers and of the volumes of an OrderedStorage. The
+// containers and the volumes it knows nothing of, e.g. after a restart of the
+// daemon, are in stateNone.
+const (
+	stateNone      = "none"
+	statePreparing = "preparing"
+	statePrepared  = "prepared"
+	stateCleaning  = "cleaning up"
+	stateCreating  = "creating"
+	stateCreated   = "created"
+	stateRemoving  = "removing"
+)
+
+// TransitionError is the ErrInvalidTransition of an operation, with the
+// state the container or the volume is in and the one the operation would
+// move it to.
+type TransitionError struct {
+	// ID is the container, or the "<podId>/<volume>", operated on.
+	ID        string
+	Current   string
+	Requested string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s is %s, can not move to %s: %v", e.ID, e.Current, e.Requested, ErrInvalidTransition)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrInvalidTransition
+}
+
+// IsInvalidTransition tells whether an operation was refused as it overlaps
+// with another one on the same container or volume.
+func IsInvalidTransition(err error) bool {
+	return errors.Is(err, ErrInvalidTransition)
+}
+
+// OrderedStorage keeps the state of every container and volume of the
+// wrapped Storage, and refuses the operations which would overlap: a
+// container is prepared and cleaned up one operation at a time, and a volume
+// is created and removed one operation at a time, never removed while a
+// prepared container uses it. The states are kept in memory only.
+type OrderedStorage struct {
+	Storage
+
+	mu sync.Mutex
+	// containers holds the state of the containers, by mount id
+	containers map[string]string
+	// volumes holds the state of the volumes, by volumeID
+	volumes map[string]string
+	// used counts the prepared containers using each volume, by volumeID
+	used map[string]int
+	// taken holds the volumes of each prepared container
+	taken map[string][]string
+}
+
+func NewOrderedStorage(inner Storage) Storage {
+	return &OrderedStorage{
+		Storage:    inner,
+		containers: make(map[string]string),
+		volumes:    make(map[string]string),
+		used:       make(map[string]int),
+		taken:      make(map[string][]string),
+	}
+}
+
+// stateOf returns the state of id in states.
+func stateOf(states map[string]string, id string) string {
+	if current, ok := states[id]; ok {
+		return current
+	}
+	return stateNone
+}
+
+// transition moves id of states to requested if it is in one of the states
+// from, and returns the state it was in. It is called with the
+// OrderedStorage locked.
+func transition(states map[string]string, id, requested string, from ...string) (string, error) {
+	current := stateOf(states, id)
+	for _, s := range from {
+		if current == s {
+			states[id] = requested
+			return current, nil
+		}
+	}
+	return current, &TransitionError{ID: id, Current: current, Requested: requested}
+}
+
+// containerState returns the state of the container mountId.
+func (o *OrderedStorage) containerState(mountId string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return stateOf(o.containers, mountId)
+}
+
+// volumeState returns the state of the volume volName of podId.
+func (o *OrderedStorage) volumeState(podId, volName string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return stateOf(o.volumes, volumeID(podId, volName))
+}
+
+// settle leaves id of states in settled once its operation returned.
+func (o *OrderedStorage) settle(states map[string]string, id, settled string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if settled == stateNone {
+		delete(states, id)
+		return
+	}
+	states[id] = settled
+}
+
+// PrepareContainer may prepare a prepared container again, as the drivers
+// do, the volumes it uses are only counted once.
+func (o *OrderedStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	o.mu.Lock()
+	// the volumes must not be created or removed meanwhile
+	for _, name := range opts.Volumes {
+		id := volumeID(opts.PodID, name)
+		if current := stateOf(o.volumes, id); current == stateCreating || current == stateRemoving {
+			o.mu.Unlock()
+			return nil, &TransitionError{ID: id, Current: current, Requested: statePrepared}
+		}
+	}
+	previous, err := transition(o.containers, mountId, statePreparing, stateNone, statePrepared)
+	o.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	vol, err := o.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+	if err != nil {
+		o.settle(o.containers, mountId, previous)
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.containers[mountId] = statePrepared
+	if _, ok := o.taken[mountId]; !ok {
+		ids := make([]string, 0, len(opts.Volumes))
+		for _, name := range opts.Volumes {
+			id := volumeID(opts.PodID, name)
+			o.used[id]++
+			ids = append(ids, id)
+		}
+		o.taken[mountId] = ids
+	}
+	return vol, nil
+}
+
+// CleanupContainer may clean up a container it does not know, which may
+// have been prepared before the daemon restarted.
+func (o *OrderedStorage) CleanupContainer(ctx context.Context, id, sharedDir string) error {
+	o.mu.Lock()
+	previous, err := transition(o.containers, id, stateCleaning, stateNone, statePrepared)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := o.Storage.CleanupContainer(ctx, id, sharedDir); err != nil {
+		o.settle(o.containers, id, previous)
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.containers, id)
+	for _, vol := range o.taken[id] {
+		if o.used[vol]--; o.used[vol] <= 0 {
+			delete(o.used, vol)
+		}
+	}
+	delete(o.taken, id)
+	return nil
+}
+
+func (o *OrderedStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	id := volumeID(podId, spec.Name)
+	o.mu.Lock()
+	previous, err := transition(o.volumes, id, stateCreating, stateNone, stateCreated)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := o.Storage.CreateVolume(ctx, podId, spec); err != nil {
+		o.settle(o.volumes, id, previous)
+		return err
+	}
+	o.settle(o.volumes, id, stateCreated)
+	return nil
+}
+
+// RemoveVolume refuses to remove a volume while a prepared container uses
+// it, the volume is then in statePrepared.
+func (o *OrderedStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	id := volumeID(podId, parseVolumeRecord(record).Name)
+	o.mu.Lock()
+	if o.used[id] > 0 {
+		o.mu.Unlock()
+		return &TransitionError{ID: id, Current: statePrepared, Requested: stateRemoving}
+	}
+	previous, err := transition(o.volumes, id, stateRemoving, stateNone, stateCreated)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := o.Storage.RemoveVolume(ctx, podId, record); err != nil {
+		o.settle(o.volumes, id, previous)
+		return err
+	}
+	o.settle(o.volumes, id, stateNone)
+	return nil
+}
+
+func (o *OrderedStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	id := volumeID(podId, spec.Name)
+	o.mu.Lock()
+	previous, err := transition(o.volumes, id, stateCreating, stateNone)
+	o.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	vol, err := o.Storage.HotPlugVolume(ctx, podId, spec)
+	if err != nil {
+		o.settle(o.volumes, id, previous)
+		return nil, err
+	}
+	o.settle(o.volumes, id, stateCreated)
+	return vol, nil
+}
+
+// HotUnplugVolume removes the volume as RemoveVolume does, never while a
+// prepared container uses it.
+func (o *OrderedStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	id := volumeID(podId, volName)
+	o.mu.Lock()
+	if o.used[id] > 0 {
+		o.mu.Unlock()
+		return &TransitionError{ID: id, Current: statePrepared, Requested: stateRemoving}
+	}
+	previous, err := transition(o.volumes, id, stateRemoving, stateNone, stateCreated)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := o.Storage.HotUnplugVolume(ctx, podId, volName); err != nil {
+		o.settle(o.volumes, id, previous)
+		return err
+	}
+	o.settle(o.volumes, id, stateNone)
+	return nil
+}
@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+func TestOrderedStorageContainers(t *testing.T) {
+	h := &hangingStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	s := NewOrderedStorage(h)
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() {
+		_, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{})
+		done <- err
+	}()
+	// wait for the prepare to be running
+	for i := 0; i < 100 && s.(*OrderedStorage).containerState("c1") != statePreparing; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	err := s.CleanupContainer(ctx, "c1", "/shared")
+	var transition *TransitionError
+	if !errors.As(err, &transition) || transition.Current != statePreparing || transition.Requested != stateCleaning {
+		t.Fatalf("cleaning up a container being prepared should be refused, got %v", err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{}); !IsInvalidTransition(err) {
+		t.Fatalf("preparing a container twice at once should be refused, got %v", err)
+	}
+	close(h.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// prepared again as is
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", "/shared"); err != nil {
+		t.Fatal(err)
+	}
+	// unknown to the wrapper, e.g. prepared before a restart
+	if err := s.CleanupContainer(ctx, "c2", "/shared"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failure leaves the container as it was
+	h.SetError("CleanupContainer", errors.New("umount failed"))
+	s.PrepareContainer(ctx, "c3", "/shared", storage.ContainerOptions{})
+	if err := s.CleanupContainer(ctx, "c3", "/shared"); err == nil || IsInvalidTransition(err) {
+		t.Fatalf("expected the error of the driver, got %v", err)
+	}
+	if current := s.(*OrderedStorage).containerState("c3"); current != statePrepared {
+		t.Fatalf("the container should still be prepared, got %s", current)
+	}
+}
+
+func TestOrderedStorageVolumes(t *testing.T) {
+	h := &hangingStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	s := NewOrderedStorage(h)
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() {
+		done <- s.CreateVolume(ctx, "pod", &apitypes.UserVolume{Name: "vol1"})
+	}()
+	for i := 0; i < 100 && s.(*OrderedStorage).volumeState("pod", "vol1") != stateCreating; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.RemoveVolume(ctx, "pod", []byte("vol1")); !IsInvalidTransition(err) {
+		t.Fatalf("removing a volume being created should be refused, got %v", err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{PodID: "pod", Volumes: []string{"vol1"}}); !IsInvalidTransition(err) {
+		t.Fatalf("preparing a container with a volume being created should be refused, got %v", err)
+	}
+	close(h.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	opts := storage.ContainerOptions{PodID: "pod", Volumes: []string{"vol1"}}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", opts); err != nil {
+		t.Fatal(err)
+	}
+	err := s.RemoveVolume(ctx, "pod", []byte("vol1"))
+	var transition *TransitionError
+	if !errors.As(err, &transition) || transition.Current != statePrepared || transition.Requested != stateRemoving {
+		t.Fatalf("removing a prepared volume should be refused, got %v", err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", "/shared"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveVolume(ctx, "pod", []byte("vol1")); err != nil {
+		t.Fatalf("the volume should be removed once its container is cleaned up, got %v", err)
+	}
+	if len(h.Calls("RemoveVolume")) != 1 {
+		t.Fatalf("the refused removals should not reach the driver, got %v", h.Calls("RemoveVolume"))
+	}
+}
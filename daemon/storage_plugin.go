@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+)
+
+// StoragePluginSymbol is the symbol a storage plugin exports, of the type
+// PluginContract.
+const StoragePluginSymbol = "StorageDriverFactory"
+
+// PluginContract is the type of the StorageDriverFactory function of a storage
+// plugin. It returns the name of the docker graph driver the storage works
+// with, and the factory registered with RegisterDriver under that name:
+//
+//	package main
+//
+//	func StorageDriverFactory() (string, daemon.DriverFactory) {
+//		return "mydriver", NewMyStorage
+//	}
+//
+// The plugin has to be built with the same version of hyperd as the daemon
+// loading it, with go build -buildmode=plugin.
+type PluginContract func() (string, DriverFactory)
+
+// LoadStoragePlugins loads the *.so plugins in pluginDir and registers their
+// storage drivers.
+func LoadStoragePlugins(pluginDir string) error {
+	paths, err := filepath.Glob(filepath.Join(pluginDir, "*.so"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		p, err := plugin.Open(path)
+		if err != nil {
+			return fmt.Errorf("cannot open storage plugin %s: %v", path, err)
+		}
+		sym, err := p.Lookup(StoragePluginSymbol)
+		if err != nil {
+			return fmt.Errorf("invalid storage plugin %s: %v", path, err)
+		}
+		name, err := registerPlugin(sym)
+		if err != nil {
+			return fmt.Errorf("invalid storage plugin %s: %v", path, err)
+		}
+		glog.Infof("loaded storage driver %s from %s", name, path)
+	}
+	return nil
+}
+
+// registerPlugin registers the driver of the StorageDriverFactory symbol of a
+// plugin, and returns its name.
+func registerPlugin(sym plugin.Symbol) (string, error) {
+	var contract PluginContract
+	switch f := sym.(type) {
+	case func() (string, DriverFactory):
+		contract = f
+	case func() (string, func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error)):
+		contract = func() (string, DriverFactory) {
+			name, factory := f()
+			return name, factory
+		}
+	default:
+		return "", fmt.Errorf("%s is a %T, not a %T", StoragePluginSymbol, sym, contract)
+	}
+	name, factory := contract()
+	if name == "" || factory == nil {
+		return "", fmt.Errorf("%s returned no driver", StoragePluginSymbol)
+	}
+	RegisterDriver(name, factory)
+	return name, nil
+}
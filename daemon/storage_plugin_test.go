@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+)
+
+func TestRegisterPlugin(t *testing.T) {
+	contract := func() (string, DriverFactory) {
+		return "test-plugin", OverlayFsFactory
+	}
+	if name, err := registerPlugin(contract); err != nil || name != "test-plugin" {
+		t.Fatalf("register plugin failed: %s, %v", name, err)
+	}
+	if _, ok := lookupDriver("test-plugin"); !ok {
+		t.Fatal("the driver of the plugin is not registered")
+	}
+
+	literal := func() (string, func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error)) {
+		return "test-plugin-literal", OverlayFsFactory
+	}
+	if _, err := registerPlugin(literal); err != nil {
+		t.Fatalf("register plugin failed: %v", err)
+	}
+	if _, ok := lookupDriver("test-plugin-literal"); !ok {
+		t.Fatal("the driver of the plugin is not registered")
+	}
+
+	if _, err := registerPlugin(func() string { return "test-plugin-invalid" }); err == nil {
+		t.Fatal("a symbol of another type should be refused")
+	}
+}
+
+func TestLoadStoragePlugins(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building a plugin is slow")
+	}
+	dir, err := ioutil.TempDir("", "storage-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := LoadStoragePlugins(dir); err != nil {
+		t.Fatalf("loading no plugin failed: %v", err)
+	}
+
+	// the plugin can not import this package, the test binary does not have
+	// the version of it the plugin would be built with
+	src := filepath.Join(dir, "plugin.go")
+	code := "package main\n\nfunc StorageDriverFactory() string { return \"minimal\" }\n"
+	if err := ioutil.WriteFile(src, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("go", "build", "-buildmode=plugin", "-o", filepath.Join(dir, "minimal.so"), src).CombinedOutput(); err != nil {
+		t.Skipf("cannot build the plugin: %v, %s", err, out)
+	}
+	err = LoadStoragePlugins(dir)
+	if err == nil || !strings.Contains(err.Error(), "invalid storage plugin") {
+		t.Fatalf("a plugin with an invalid symbol should be refused, got %v", err)
+	}
+}
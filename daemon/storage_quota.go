@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	"golang.org/x/net/context"
+)
+
+// The rawblock volumes are sparse files, which take the disk of the host as
+// they are written. With rawblock.projectquota, each block is made an XFS
+// project with a hard limit of the size of the volume, so the root of the
+// driver must be on an XFS mounted with project quotas. The project of a
+// block is numbered after its inode, so it is found again from the block.
+
+// xfsQuotaMount returns the mount point of the filesystem holding dir, which
+// must be an XFS enforcing project quotas.
+func xfsQuotaMount(dir string) (string, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+	var fs *mount.Info
+	for _, m := range mounts {
+		if dir != m.Mountpoint && !strings.HasPrefix(dir, strings.TrimSuffix(m.Mountpoint, "/")+"/") {
+			continue
+		}
+		if fs == nil || len(m.Mountpoint) >= len(fs.Mountpoint) {
+			fs = m
+		}
+	}
+	if fs == nil {
+		return "", fmt.Errorf("cannot find the filesystem of %s", dir)
+	}
+	if fs.Fstype != "xfs" {
+		return "", fmt.Errorf("%s is on %s, the project quotas need xfs", dir, fs.Fstype)
+	}
+	for _, opt := range strings.Split(fs.VfsOpts+","+fs.Opts, ",") {
+		if opt == "prjquota" || opt == "pquota" {
+			return fs.Mountpoint, nil
+		}
+	}
+	return "", fmt.Errorf("xfs %s holding %s is not mounted with pquota", fs.Mountpoint, dir)
+}
+
+func projectID(block string) (uint32, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(block, &st); err != nil {
+		return 0, err
+	}
+	// project 0 is the default one of every file
+	if id := uint32(st.Ino); id != 0 {
+		return id, nil
+	}
+	return 1, nil
+}
+
+func xfsQuota(ctx context.Context, mnt, command string) error {
+	if out, err := execCommand(ctx, "xfs_quota", "-x", "-c", command, mnt).CombinedOutput(); err != nil {
+		return fmt.Errorf("xfs_quota %q failed: %v, %s", command, err, out)
+	}
+	return nil
+}
+
+// limitBlock limits the disk space the block may take to size, it does
+// nothing unless the project quotas are enabled.
+func (s *RawBlockStorage) limitBlock(ctx context.Context, block string, size uint64) error {
+	if s.quotaMount == "" {
+		return nil
+	}
+	id, err := projectID(block)
+	if err != nil {
+		return err
+	}
+	if err := xfsQuota(ctx, s.quotaMount, fmt.Sprintf("project -s -p %s %d", block, id)); err != nil {
+		return err
+	}
+	return xfsQuota(ctx, s.quotaMount, fmt.Sprintf("limit -p bhard=%d %d", size, id))
+}
+
+// unlimitBlock drops the limit of the block before it is removed.
+func (s *RawBlockStorage) unlimitBlock(ctx context.Context, block string) error {
+	if s.quotaMount == "" {
+		return nil
+	}
+	id, err := projectID(block)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return xfsQuota(ctx, s.quotaMount, fmt.Sprintf("limit -p bhard=0 %d", id))
+}
@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockProjectQuota(t *testing.T) {
+	root, err := ioutil.TempDir("", "quota-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeTools(t, root, "mkfs.ext4", "resize2fs", "xfs_quota")()
+
+	ctx := context.Background()
+	if err := (&RawBlockStorage{rootPath: root, Filesystem: "ext4", ProjectQuota: true}).Init(ctx); err == nil {
+		t.Fatal("the project quotas should be refused out of an xfs mounted with pquota")
+	}
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	s := &RawBlockStorage{rootPath: root, Filesystem: "ext4", ProjectQuota: true, quotaMount: root}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 4 << 20}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	id, err := projectID(spec.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResizeVolume(ctx, podId, "vol1", 8<<20); err != nil {
+		t.Fatalf("resize volume failed: %v", err)
+	}
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+
+	commands, _ := ioutil.ReadFile(log)
+	for _, command := range []string{
+		fmt.Sprintf("xfs_quota -x -c project -s -p %s %d %s", spec.Source, id, root),
+		fmt.Sprintf("xfs_quota -x -c limit -p bhard=%d %d %s", 4<<20, id, root),
+		fmt.Sprintf("xfs_quota -x -c limit -p bhard=%d %d %s", 8<<20, id, root),
+		fmt.Sprintf("xfs_quota -x -c limit -p bhard=0 %d %s", id, root),
+	} {
+		if !strings.Contains(string(commands), command+"\n") {
+			t.Fatalf("expected %q to be run, got\n%s", command, commands)
+		}
+	}
+}
+
+func TestRawBlockProjectQuotaLimit(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting xfs needs root")
+	}
+	for _, tool := range []string{"mkfs.xfs", "xfs_quota"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	root, err := ioutil.TempDir("", "quota-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// an xfs with project quotas, on a loop device
+	image, mnt := filepath.Join(root, "xfs.img"), filepath.Join(root, "xfs")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 512<<20); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.xfs", "-q", image).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.xfs failed: %v, %s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop,prjquota", image, mnt).CombinedOutput(); err != nil {
+		t.Skipf("cannot mount xfs with project quotas: %v, %s", err, out)
+	}
+	defer syscall.Unmount(mnt, syscall.MNT_DETACH)
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: mnt, Filesystem: "ext4", ProjectQuota: true}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 4 << 20}
+	if err := s.CreateVolume(ctx, testPodId(t), spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+
+	f, err := os.OpenFile(spec.Source, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// writing past the end of the block grows it beyond the limit
+	data := make([]byte, 1<<20)
+	for i := 0; i < 8; i++ {
+		if _, err = f.Write(data); err != nil {
+			break
+		}
+		if err = f.Sync(); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, syscall.EDQUOT) {
+		t.Fatalf("expected the quota exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/docker/go-units"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// rbdOptions are the driver options of the rbd storage:
+//
+//	rbd.monitors    comma separated addresses of the ceph monitors
+//	rbd.pool        pool of the images, rbd by default
+//	rbd.user        ceph user, admin by default
+//	rbd.keyring     keyring of the user
+//	rbd.fstype      filesystem made on the volumes, ext4 by default
+//	rbd.volumesize  size of the volumes which do not ask for one
+type rbdOptions struct {
+	Monitors   []string
+	Pool       string
+	User       string
+	Keyring    string
+	Fstype     string
+	VolumeSize uint64
+}
+
+func parseRBDOptions(config *StorageConfig) (*rbdOptions, error) {
+	opts := &rbdOptions{
+		Pool:       config.DriverOption("rbd", "pool"),
+		User:       config.DriverOption("rbd", "user"),
+		Keyring:    config.DriverOption("rbd", "keyring"),
+		Fstype:     config.DriverOption("rbd", "fstype"),
+		VolumeSize: uint64(storage.DEFAULT_DM_VOL_SIZE),
+	}
+	for _, mon := range strings.Split(config.DriverOption("rbd", "monitors"), ",") {
+		if mon = strings.TrimSpace(mon); mon != "" {
+			opts.Monitors = append(opts.Monitors, mon)
+		}
+	}
+	if len(opts.Monitors) == 0 {
+		return nil, fmt.Errorf("rbd.monitors is required by the rbd storage")
+	}
+	if opts.Pool == "" {
+		opts.Pool = "rbd"
+	}
+	if opts.User == "" {
+		opts.User = "admin"
+	}
+	if opts.Fstype == "" {
+		opts.Fstype = storage.DEFAULT_VOL_FS
+	}
+	if size := config.DriverOption("rbd", "volumesize"); size != "" {
+		bytes, err := units.RAMInBytes(size)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid rbd.volumesize %q", size)
+		}
+		opts.VolumeSize = uint64(bytes)
+	}
+	return opts, nil
+}
+
+// CephRBDStorage provisions the volumes as images of a ceph pool, mapped to
+// the host with the rbd kernel module. The rootfs of each container is
+// expected as the image named after its mountId in the same pool.
+type CephRBDStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	opts     *rbdOptions
+	// devDir holds the links udev makes to the mapped images, as
+	// <devDir>/<pool>/<image>.
+	devDir string
+}
+
+func CephRBDFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	opts, err := parseRBDOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	driver := &CephRBDStorage{
+		db:       db,
+		rootPath: config.DriverRoot("rbd"),
+		opts:     opts,
+		devDir:   "/dev/rbd",
+	}
+	return driver, nil
+}
+
+func (s *CephRBDStorage) Type() string {
+	return "rbd"
+}
+
+func (s *CephRBDStorage) RootPath() string {
+	return s.rootPath
+}
+
+// rbd runs the rbd subcommand against the cluster and returns its output.
+func (s *CephRBDStorage) rbd(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	cs := []string{cmd, "--pool", s.opts.Pool, "--id", s.opts.User, "-m", strings.Join(s.opts.Monitors, ",")}
+	if s.opts.Keyring != "" {
+		cs = append(cs, "--keyring", s.opts.Keyring)
+	}
+	cs = append(cs, args...)
+	out, err := execCommand(ctx, "rbd", cs...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("rbd %s %s failed: %v: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func (s *CephRBDStorage) imageName(podId, volName string) string {
+	return fmt.Sprintf("%s-%s", podId, volName)
+}
+
+// device is the path udev gives to the mapped image.
+func (s *CephRBDStorage) device(image string) string {
+	return filepath.Join(s.devDir, s.opts.Pool, image)
+}
+
+func (s *CephRBDStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", s.imageName(podId, volName))
+}
+
+// mapImage maps the image unless it is mapped already, and returns its
+// device.
+func (s *CephRBDStorage) mapImage(ctx context.Context, image string, readonly bool) (string, error) {
+	device := s.device(image)
+	if exists, _ := pathExists(device); exists {
+		return device, nil
+	}
+	args := []string{image}
+	if readonly {
+		args = append([]string{"--read-only"}, args...)
+	}
+	if _, err := s.rbd(ctx, "map", args...); err != nil {
+		return "", err
+	}
+	glog.V(1).Infof("rbd image %s/%s mapped to %s", s.opts.Pool, image, device)
+	return device, nil
+}
+
+// unmapImage unmaps the image, refusing while the device is in use.
+func (s *CephRBDStorage) unmapImage(ctx context.Context, image string) error {
+	device := s.device(image)
+	if exists, _ := pathExists(device); !exists {
+		return nil
+	}
+	if storage.PathInUse(device) {
+		return ErrVolumeInUse
+	}
+	if _, err := s.rbd(ctx, "unmap", device); err != nil {
+		return err
+	}
+	glog.V(1).Infof("rbd image %s/%s unmapped", s.opts.Pool, image)
+	return nil
+}
+
+func (s *CephRBDStorage) Init(ctx context.Context) error {
+	return ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700)
+}
+
+func (*CephRBDStorage) CleanUp(ctx context.Context) error { return nil }
+
+// HealthCheck checks that the pool can be listed from the cluster.
+func (s *CephRBDStorage) HealthCheck(ctx context.Context) error {
+	_, err := s.rbd(ctx, "ls")
+	return err
+}
+
+func (s *CephRBDStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *CephRBDStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsQuota: true,
+	}
+}
+
+func (s *CephRBDStorage) KernelCapabilities() []string {
+	return nil
+}
+
+func (s *CephRBDStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	device, err := s.mapImage(ctx, mountId, opts.ReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("cannot map the image of container %s: %v", mountId, err)
+	}
+
+	vol := &runv.VolumeDescription{
+		Name:     device,
+		Source:   device,
+		Fstype:   s.opts.Fstype,
+		Format:   "raw",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (s *CephRBDStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return s.unmapImage(ctx, id)
+}
+
+func (s *CephRBDStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if _, err := s.mapImage(ctx, mountId, false); err != nil {
+		return err
+	}
+	if err := rawblock.GetImage(filepath.Join(s.devDir, s.opts.Pool), baseDir, mountId, s.opts.Fstype, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *CephRBDStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	if _, err := s.mapImage(ctx, mountId, false); err != nil {
+		return err
+	}
+	if err := rawblock.GetImage(filepath.Join(s.devDir, s.opts.Pool), baseDir, mountId, s.opts.Fstype, "", uid, gid); err != nil {
+		return err
+	}
+	defer rawblock.PutImage(baseDir, mountId)
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *CephRBDStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume creates the image of the volume, maps it and makes the
+// filesystem on it. The image is removed again if any step fails.
+func (s *CephRBDStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	image := s.imageName(podId, spec.Name)
+	size := spec.SizeBytes
+	if size == 0 {
+		size = s.opts.VolumeSize
+	}
+	// rbd takes the size in MiB
+	mb := (size + 1024*1024 - 1) / (1024 * 1024)
+	if _, err := s.rbd(ctx, "create", "--size", strconv.FormatUint(mb, 10), image); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(s.volumePath(podId, spec.Name))
+			s.unmapImage(ctx, image)
+			s.rbd(ctx, "rm", image)
+		}
+	}()
+	device, err := s.mapImage(ctx, image, false)
+	if err != nil {
+		return err
+	}
+	if err := makeFs(ctx, s.opts.Fstype, device); err != nil {
+		return err
+	}
+	volPath := s.volumePath(podId, spec.Name)
+	if err := os.Symlink(device, volPath); err != nil && !os.IsExist(err) {
+		return err
+	}
+	glog.V(1).Infof("volume %s created as rbd image %s/%s", spec.Name, s.opts.Pool, image)
+
+	spec.Source = device
+	spec.Format = "raw"
+	spec.Fstype = s.opts.Fstype
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// RemoveVolume unmaps the image of the volume and removes it from the pool.
+func (s *CephRBDStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	image := s.imageName(podId, name)
+	if err := s.unmapImage(ctx, image); err != nil {
+		if err == ErrVolumeInUse {
+			glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", name, podId)
+		}
+		return err
+	}
+	if _, err := s.rbd(ctx, "rm", image); err != nil {
+		return err
+	}
+	if err := os.Remove(s.volumePath(podId, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *CephRBDStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.device(s.imageName(podId, name)),
+			Format: "raw",
+			Fstype: s.opts.Fstype,
+		})
+	}
+	return vols, nil
+}
+
+func (s *CephRBDStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CephRBDStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	if _, err := os.Lstat(s.volumePath(podId, volName)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *CephRBDStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *CephRBDStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *CephRBDStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CephRBDStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CephRBDStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *CephRBDStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *CephRBDStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *CephRBDStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect unmaps the images of the orphaned volumes, the images stay
+// in the pool as it may be shared with other hosts.
+func (s *CephRBDStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		if err := s.unmapImage(ctx, name); err != nil {
+			glog.Warningf("failed to unmap orphaned volume %s: %v", name, err)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", name, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
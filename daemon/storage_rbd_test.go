@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRBDOptions(t *testing.T) {
+	if _, err := CephRBDFactory(nil, nil, nil); err == nil {
+		t.Fatal("rbd.monitors should be required")
+	}
+	config, err := NewStorageConfig(map[string]string{
+		"rbd.monitors":   "10.0.0.1:6789, 10.0.0.2:6789",
+		"rbd.volumesize": "1G",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := parseRBDOptions(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.Monitors) != 2 || opts.Monitors[1] != "10.0.0.2:6789" {
+		t.Fatalf("unexpected monitors %v", opts.Monitors)
+	}
+	if opts.Pool != "rbd" || opts.User != "admin" || opts.Fstype != "ext4" || opts.VolumeSize != 1024*1024*1024 {
+		t.Fatalf("unexpected defaults %#v", opts)
+	}
+}
+
+func TestRBDVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "rbd-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+	os.Setenv("HELPER_RBD_DIR", filepath.Join(root, "dev"))
+	defer os.Unsetenv("HELPER_RBD_DIR")
+
+	config, err := NewStorageConfig(map[string]string{
+		"rbd.monitors": "10.0.0.1:6789",
+		"rbd.pool":     "hyper",
+		"rbd.keyring":  "/etc/ceph/keyring",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := CephRBDFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*CephRBDStorage)
+	s.rootPath = filepath.Join(root, "rbd")
+	s.devDir = filepath.Join(root, "dev")
+	ctx := context.Background()
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 10*1024*1024 + 1}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	image := podId + "-vol1"
+	if spec.Source != filepath.Join(root, "dev", "hyper", image) || spec.Format != "raw" || spec.Fstype != "ext4" {
+		t.Fatalf("unexpected volume spec %#v", spec)
+	}
+	if exists, err := s.VolumeExists(ctx, podId, "vol1"); err != nil || !exists {
+		t.Fatalf("expected vol1 to exist, got %v, %v", exists, err)
+	}
+
+	vol, err := s.PrepareContainer(ctx, "container", "", storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	if vol.Source != filepath.Join(root, "dev", "hyper", "container") || vol.Format != "raw" || !vol.ReadOnly {
+		t.Fatalf("unexpected container volume %#v", vol)
+	}
+	if err := s.CleanupContainer(ctx, "container", ""); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(spec.Source); !os.IsNotExist(err) {
+		t.Fatalf("the image should be unmapped, got %v", err)
+	}
+
+	commands, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := "--pool hyper --id admin -m 10.0.0.1:6789 --keyring /etc/ceph/keyring"
+	for _, expected := range []string{
+		"rbd create " + conn + " --size 11 " + image,
+		"rbd map " + conn + " " + image,
+		"mkfs.ext4 -F " + spec.Source,
+		"rbd map " + conn + " --read-only container",
+		"rbd unmap " + conn + " " + vol.Source,
+		"rbd unmap " + conn + " " + spec.Source,
+		"rbd rm " + conn + " " + image,
+	} {
+		if !strings.Contains(string(commands), expected) {
+			t.Fatalf("%q is not run, got:\n%s", expected, commands)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// ErrReadOnlyStorage is the error of the operations a ReadOnlyStorage
+// refuses, IsReadOnly holds for it.
+var ErrReadOnlyStorage = fmt.Errorf("the storage layer is frozen: %w", ErrReadOnly)
+
+// ReadOnlyStorage freezes the whole wrapped Storage, e.g. to look into the
+// volumes while recovering from a disaster: the containers may only be
+// prepared read-only, and every operation which would write to the volumes
+// or to the containers returns ErrReadOnlyStorage. The operations which only
+// read, and cleaning up the containers prepared, go through.
+type ReadOnlyStorage struct {
+	Storage
+}
+
+func NewReadOnlyStorage(inner Storage) Storage {
+	return &ReadOnlyStorage{Storage: inner}
+}
+
+func (r *ReadOnlyStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	if !opts.ReadOnly {
+		return nil, ErrReadOnlyStorage
+	}
+	return r.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+// PrewarmContainer is refused as it may create the layer of the container,
+// which PrepareContainer does not need.
+func (r *ReadOnlyStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrReadOnlyStorage
+}
+
+func (r *ReadOnlyStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	return nil, ErrReadOnlyStorage
+}
@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestReadOnlyStorage(t *testing.T) {
+	mock := NewMockStorage()
+	RegisterDriver("test-readonly", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return mock, nil
+	})
+	defer unregisterDriver("test-readonly")
+	s, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: "test-readonly"}, nil, &StorageConfig{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if s.Type() != "mock" {
+		t.Fatalf("the accessors should go through, got %s", s.Type())
+	}
+	if _, err := s.PrepareContainer(ctx, "c1", "/shared", storage.ContainerOptions{ReadOnly: true}); err != nil {
+		t.Fatalf("a read-only container should be prepared, got %v", err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", "/shared"); err != nil {
+		t.Fatalf("the container prepared should be cleaned up, got %v", err)
+	}
+	if _, err := s.ListVolumes(ctx, "pod"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, op := range map[string]func() error{
+		"PrepareContainer": func() error {
+			_, err := s.PrepareContainer(ctx, "c2", "/shared", storage.ContainerOptions{})
+			return err
+		},
+		"CreateVolume": func() error { return s.CreateVolume(ctx, "pod", &apitypes.UserVolume{Name: "vol1"}) },
+		"RemoveVolume": func() error { return s.RemoveVolume(ctx, "pod", []byte("vol1")) },
+		"InjectFile": func() error {
+			return s.InjectFile(ctx, bytes.NewReader(nil), "c1", "/etc/hosts", "/shared", 0644, 0, 0, nil)
+		},
+		"ImportVolume":    func() error { return s.ImportVolume(ctx, "pod", "vol1", bytes.NewReader(nil)) },
+		"SetVolumeLabels": func() error { return s.SetVolumeLabels("pod", "vol1", nil) },
+	} {
+		if err := op(); err != ErrReadOnlyStorage || !IsReadOnly(err) {
+			t.Fatalf("%s should be refused, got %v", name, err)
+		}
+		if calls := mock.Calls(name); name != "PrepareContainer" && len(calls) != 0 {
+			t.Fatalf("%s should not reach the driver, got %v", name, calls)
+		}
+	}
+	if calls := mock.Calls("PrepareContainer"); len(calls) != 1 {
+		t.Fatalf("only the read-only container should reach the driver, got %v", calls)
+	}
+}
@@ -0,0 +1,206 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/net/context"
+)
+
+// The volumes of a pod are recorded in the DaemonDB under their name, so the
+// daemon knows them after a restart. A record is the json of the volume spec
+// as created by the driver. Older records, and the ones of devicemapper, are
+// "<name>" or "<name>:<driver data>" instead.
+
+func saveVolumeRecord(ctx context.Context, db *daemondb.DaemonDB, podId string, vol *apitypes.UserVolume) error {
+	if db == nil {
+		return nil
+	}
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	if tx := volumeRecordTxFrom(ctx); tx != nil {
+		tx.hold(volumeRecordChange{db: db, podId: podId, name: vol.Name, data: data})
+		return nil
+	}
+	return db.UpdatePodVolume(podId, vol.Name, data)
+}
+
+// parseVolumeRecord returns the volume of a record, only the name is known
+// for the records which are not json.
+func parseVolumeRecord(record []byte) *apitypes.UserVolume {
+	vol := &apitypes.UserVolume{}
+	if len(record) > 0 && record[0] == '{' && json.Unmarshal(record, vol) == nil {
+		return vol
+	}
+	vol.Name = strings.SplitN(string(record), ":", 2)[0]
+	return vol
+}
+
+// recordPodId returns the pod of the volume recorded under key, which is
+// vol-<podId>-<volname>.
+func recordPodId(key []byte, volName string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(string(key), "vol-"), "-"+volName)
+}
+
+// loadVolumeRecords returns the volumes recorded for podId. The keys of a pod
+// the id of which extends podId share its prefix, the pod of each record is
+// compared whole instead.
+func loadVolumeRecords(db *daemondb.DaemonDB, podId string) ([]*apitypes.UserVolume, error) {
+	if db == nil {
+		return nil, nil
+	}
+	var vols []*apitypes.UserVolume
+	for kv := range db.ListAllVolumes() {
+		if kv == nil {
+			return nil, fmt.Errorf("failed to list the volumes of pod %s", podId)
+		}
+		vol := parseVolumeRecord(kv.V)
+		if recordPodId(kv.K, vol.Name) == podId {
+			vols = append(vols, vol)
+		}
+	}
+	return vols, nil
+}
+
+// otherPodVolumes returns the "<podId>-<name>" entries of the volumes recorded
+// for the pods other than podId.
+func otherPodVolumes(db *daemondb.DaemonDB, podId string) (map[string]bool, error) {
+	others := make(map[string]bool)
+	if db == nil {
+		return others, nil
+	}
+	for kv := range db.ListAllVolumes() {
+		if kv == nil {
+			return nil, fmt.Errorf("failed to list the volumes of pod %s", podId)
+		}
+		name := parseVolumeRecord(kv.V).Name
+		if owner := recordPodId(kv.K, name); owner != podId {
+			others[owner+"-"+name] = true
+		}
+	}
+	return others, nil
+}
+
+// labelledVolumeRecord returns the record of the volume, the labels of which
+// are kept in it. The volumes of the drivers which keep no json record carry
+// no labels.
+func labelledVolumeRecord(db *daemondb.DaemonDB, podId, volName string) ([]byte, error) {
+	if db == nil {
+		return nil, fmt.Errorf("volume %s has no record to keep labels in: %w", volumeID(podId, volName), ErrNotSupported)
+	}
+	record, err := db.GetPodVolume(podId, volName)
+	if err == leveldb.ErrNotFound {
+		return nil, fmt.Errorf("volume %s has no record: %w", volumeID(podId, volName), os.ErrNotExist)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(record) == 0 || record[0] != '{' {
+		return nil, fmt.Errorf("volume %s can not be labelled: %w", volumeID(podId, volName), ErrNotSupported)
+	}
+	return record, nil
+}
+
+func loadVolumeLabels(db *daemondb.DaemonDB, podId, volName string) (map[string]string, error) {
+	record, err := labelledVolumeRecord(db, podId, volName)
+	if err != nil {
+		return nil, err
+	}
+	return parseVolumeRecord(record).Labels, nil
+}
+
+// saveVolumeLabels replaces the labels in the record of the volume.
+func saveVolumeLabels(ctx context.Context, db *daemondb.DaemonDB, podId, volName string, labels map[string]string) error {
+	for key := range labels {
+		if key == "" {
+			return fmt.Errorf("invalid empty label of volume %s", volumeID(podId, volName))
+		}
+	}
+	record, err := labelledVolumeRecord(db, podId, volName)
+	if err != nil {
+		return err
+	}
+	vol := parseVolumeRecord(record)
+	vol.Labels = labels
+	return saveVolumeRecord(ctx, db, podId, vol)
+}
+
+func deleteVolumeRecord(ctx context.Context, db *daemondb.DaemonDB, podId, volName string) error {
+	if db == nil {
+		return nil
+	}
+	if tx := volumeRecordTxFrom(ctx); tx != nil {
+		tx.hold(volumeRecordChange{db: db, podId: podId, name: volName})
+		return nil
+	}
+	return db.DeletePodVolume(podId, volName)
+}
+
+// volumeRecordChange is a record saved, or removed when data is nil.
+type volumeRecordChange struct {
+	db          *daemondb.DaemonDB
+	podId, name string
+	data        []byte
+}
+
+// volumeRecordTx holds back the changes the drivers make to the records
+// under its context, until committed, so that an operation spanning several
+// drivers changes the records only once it succeeded.
+type volumeRecordTx struct {
+	sync.Mutex
+	changes []volumeRecordChange
+}
+
+type volumeRecordTxKey struct{}
+
+func withVolumeRecordTx(ctx context.Context) (context.Context, *volumeRecordTx) {
+	tx := &volumeRecordTx{}
+	return context.WithValue(ctx, volumeRecordTxKey{}, tx), tx
+}
+
+func volumeRecordTxFrom(ctx context.Context) *volumeRecordTx {
+	if ctx == nil {
+		return nil
+	}
+	tx, _ := ctx.Value(volumeRecordTxKey{}).(*volumeRecordTx)
+	return tx
+}
+
+func (tx *volumeRecordTx) hold(change volumeRecordChange) {
+	tx.Lock()
+	defer tx.Unlock()
+	tx.changes = append(tx.changes, change)
+}
+
+// commit applies the changes held back, the removals before the saves: a
+// volume removed from a driver and created on another keeps the record of
+// the latter.
+func (tx *volumeRecordTx) commit() error {
+	tx.Lock()
+	defer tx.Unlock()
+	for _, removal := range []bool{true, false} {
+		for _, c := range tx.changes {
+			if (c.data == nil) != removal {
+				continue
+			}
+			var err error
+			if removal {
+				err = c.db.DeletePodVolume(c.podId, c.name)
+			} else {
+				err = c.db.UpdatePodVolume(c.podId, c.name, c.data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	tx.changes = nil
+	return nil
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestParseVolumeRecord(t *testing.T) {
+	for record, name := range map[string]string{
+		"vol1":                             "vol1",
+		"hyper-volpool-pod-vol1:42":        "hyper-volpool-pod-vol1",
+		`{"name":"vol1","source":"/vol1"}`: "vol1",
+	} {
+		if vol := parseVolumeRecord([]byte(record)); vol.Name != name {
+			t.Fatalf("expected volume %s from record %s, got %s", name, record, vol.Name)
+		}
+	}
+}
+
+func TestVolumeRecords(t *testing.T) {
+	root, err := ioutil.TempDir("", "records-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	o := &OverlayFsStorage{db: db, rootPath: root}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+
+	vols, err := loadVolumeRecords(db, podId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].Name != "vol1" || vols[0].Source != spec.Source || vols[0].Format != "vfs" {
+		t.Fatalf("unexpected volume records %v", vols)
+	}
+
+	record, err := db.GetPodVolume(podId, "vol1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RemoveVolume(context.Background(), podId, record); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if vols, err = loadVolumeRecords(db, podId); err != nil || len(vols) != 0 {
+		t.Fatalf("the record should be deleted with the volume, got %v, %v", vols, err)
+	}
+}
@@ -0,0 +1,109 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// The snapshots and clones of the rawblock volumes share the extents of the
+// block where the root of the driver supports reflinks, as an XFS made with
+// reflink=1 does, so that the snapshot of a large volume is instant and takes
+// no space until either file is written to. Init probes the root once, the
+// blocks are copied by cp otherwise.
+
+const (
+	ioctlFiclone      = 0x40049409
+	ioctlFiclonerange = 0x4020940d
+)
+
+// fileCloneRange is struct file_clone_range of linux/fs.h.
+type fileCloneRange struct {
+	srcFd      int64
+	srcOffset  uint64
+	srcLength  uint64
+	destOffset uint64
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// probeReflink tells whether the filesystem of dir can clone a range of a
+// file into another one.
+func probeReflink(dir string) bool {
+	src, err := ioutil.TempFile(dir, ".reflink-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	dst, err := ioutil.TempFile(dir, ".reflink-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	// a range must be aligned on the blocks of the filesystem
+	if _, err := src.Write(make([]byte, 4096)); err != nil {
+		return false
+	}
+	if err := src.Sync(); err != nil {
+		return false
+	}
+	arg := fileCloneRange{srcFd: int64(src.Fd()), srcLength: 4096}
+	return ioctl(dst.Fd(), ioctlFiclonerange, uintptr(unsafe.Pointer(&arg))) == nil
+}
+
+// cloneFile makes dst a copy of src sharing all its extents, with the mode of
+// src. Nothing is left behind when it fails.
+func cloneFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	if err := ioctl(out.Fd(), ioctlFiclone, in.Fd()); err != nil {
+		return fmt.Errorf("failed to clone %s to %s: %v", src, dst, err)
+	}
+	return nil
+}
+
+// copyBlock copies the block file, with a reflink where the root supports
+// them. A clone which fails, e.g. as dst is on another filesystem, falls back
+// to a copy.
+func (s *RawBlockStorage) copyBlock(ctx context.Context, src, dst string) error {
+	if s.reflink {
+		err := cloneFile(src, dst)
+		if err == nil {
+			return nil
+		}
+		glog.V(1).Infof("%v, copy it instead", err)
+	}
+	return copyBlockFile(ctx, src, dst)
+}
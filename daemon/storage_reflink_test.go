@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRawBlockSnapshotReflink(t *testing.T) {
+	root, err := ioutil.TempDir("", "reflink-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	if !s.reflink {
+		// a clone failing on the filesystem falls back to a copy
+		s.reflink = true
+		if err := ioutil.WriteFile(block, []byte("before"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SnapshotVolume(ctx, podId, "vol1", "snap1"); err != nil {
+			t.Fatalf("snapshot volume failed: %v", err)
+		}
+		if data, _ := ioutil.ReadFile(s.snapshotPath(podId, "vol1", "snap1")); string(data) != "before" {
+			t.Fatalf("unexpected snapshot %q", data)
+		}
+		t.Skip("the filesystem of the temporary directory does not support reflinks")
+	}
+
+	f, err := os.OpenFile(block, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Fallocate(int(f.Fd()), 0, 0, 1<<30)
+	f.Close()
+	if err != nil {
+		t.Skipf("cannot allocate a volume of 1G: %v", err)
+	}
+	start := time.Now()
+	if err := s.SnapshotVolume(ctx, podId, "vol1", "snap1"); err != nil {
+		t.Fatalf("snapshot volume failed: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("the snapshot of 1G took %v, it should share the extents", d)
+	}
+	start = time.Now()
+	if err := s.RollbackVolume(ctx, podId, "vol1", "snap1"); err != nil {
+		t.Fatalf("rollback volume failed: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("the rollback of 1G took %v, it should share the extents", d)
+	}
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"sync"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+// volumeRefs is embedded by the drivers to count the containers using each
+// volume, so that the volumes are not removed under a running container. The
+// volumes are taken by PrepareContainer, from the container options, and
+// given back by CleanupContainer; the counts are kept in memory only.
+type volumeRefs struct {
+	refsLock sync.Mutex
+	// refs holds the count of each volume, by volumeID
+	refs map[string]int
+	// taken holds the volumes taken by each container
+	taken map[string][]string
+	// pods holds the pod of each container prepared with one
+	pods map[string]string
+}
+
+// VolumeRefCount returns the number of prepared containers using the volume.
+func (r *volumeRefs) VolumeRefCount(podId, volName string) int {
+	r.refsLock.Lock()
+	defer r.refsLock.Unlock()
+	return r.refs[volumeID(podId, volName)]
+}
+
+// takeVolumes counts the volumes of opts as used by the container, unless
+// preparing it failed. It is deferred with the named error result of
+// PrepareContainer; preparing a container twice does not count it twice.
+func (r *volumeRefs) takeVolumes(containerId string, opts storage.ContainerOptions, err *error) {
+	if *err != nil || len(opts.Volumes) == 0 && opts.PodID == "" {
+		return
+	}
+	r.refsLock.Lock()
+	defer r.refsLock.Unlock()
+	if _, ok := r.taken[containerId]; ok {
+		return
+	}
+	if r.refs == nil {
+		r.refs = make(map[string]int)
+		r.taken = make(map[string][]string)
+		r.pods = make(map[string]string)
+	}
+	ids := make([]string, 0, len(opts.Volumes))
+	for _, name := range opts.Volumes {
+		id := volumeID(opts.PodID, name)
+		r.refs[id]++
+		ids = append(ids, id)
+	}
+	r.taken[containerId] = ids
+	if opts.PodID != "" {
+		r.pods[containerId] = opts.PodID
+	}
+}
+
+// releaseVolumes gives back the volumes taken by the container once it is
+// cleaned up, it is deferred with the named error result of CleanupContainer.
+func (r *volumeRefs) releaseVolumes(containerId string, err *error) {
+	if *err != nil {
+		return
+	}
+	r.refsLock.Lock()
+	defer r.refsLock.Unlock()
+	for _, id := range r.taken[containerId] {
+		if r.refs[id]--; r.refs[id] <= 0 {
+			delete(r.refs, id)
+		}
+	}
+	delete(r.taken, containerId)
+	delete(r.pods, containerId)
+}
+
+// containerPods returns the pod of each prepared container.
+func (r *volumeRefs) containerPods() map[string]string {
+	r.refsLock.Lock()
+	defer r.refsLock.Unlock()
+	pods := make(map[string]string, len(r.pods))
+	for id, podId := range r.pods {
+		pods[id] = podId
+	}
+	return pods
+}
+
+// volumeInUse tells whether a prepared container uses the volume of record.
+func (r *volumeRefs) volumeInUse(podId string, record []byte) bool {
+	return r.VolumeRefCount(podId, parseVolumeRecord(record).Name) > 0
+}
@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestVolumeRefCount(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := ioutil.WriteFile(s.volumePath(podId, "vol1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := storage.ContainerOptions{PodID: podId, Volumes: []string{"vol1", "vol2"}}
+
+	const containers = 16
+	var wg sync.WaitGroup
+	for i := 0; i < containers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := s.PrepareContainer(context.Background(), id, root, opts); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("c%d", i))
+	}
+	wg.Wait()
+	if n := s.VolumeRefCount(podId, "vol1"); n != containers {
+		t.Fatalf("expected %d references, got %d", containers, n)
+	}
+	// preparing a container again does not count it twice
+	if _, err := s.PrepareContainer(context.Background(), "c0", root, opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.VolumeRefCount(podId, "vol2"); n != containers {
+		t.Fatalf("expected %d references, got %d", containers, n)
+	}
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != ErrVolumeInUse {
+		t.Fatalf("expected the volume in use, got %v", err)
+	}
+
+	for i := 1; i < containers; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := s.CleanupContainer(context.Background(), id, root); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("c%d", i))
+	}
+	wg.Wait()
+	if n := s.VolumeRefCount(podId, "vol1"); n != 1 {
+		t.Fatalf("expected a single reference, got %d", n)
+	}
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != ErrVolumeInUse {
+		t.Fatalf("expected the volume in use, got %v", err)
+	}
+
+	if err := s.CleanupContainer(context.Background(), "c0", root); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.VolumeRefCount(podId, "vol1"); n != 0 {
+		t.Fatalf("expected no reference, got %d", n)
+	}
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+}
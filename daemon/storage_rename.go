@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/parsers/kernel"
+	"github.com/golang/glog"
+)
+
+// Before linux 4.10, rename(2) of a directory of a lower layer of an overlay
+// fails with EXDEV, which most programs do not fall back from as mv does.
+// From 4.10 the redirect_dir option of the mount lets overlay rename it in
+// the upper dir. The older kernels have no fix; there, the work dirs can be
+// split from the container dirs, into a work dir per mount under a root of
+// their own, so that the copies the kernel stages for the programs falling
+// back are not mixed with the upper dirs.
+
+// RenameMode is the workaround of OverlayFsStorage for the renames of the
+// directories of the lower layers.
+type RenameMode string
+
+const (
+	// RenameNone applies no workaround, Init warns on the kernels affected.
+	RenameNone RenameMode = ""
+	// RenameWorkdirSplit mounts the overlays with their work dirs under
+	// WorkDir, <root>/work when it is not set.
+	RenameWorkdirSplit RenameMode = "workdir-split"
+	// RenameRedirectDir mounts the overlays with redirect_dir=on, it needs
+	// linux 4.10.
+	RenameRedirectDir RenameMode = "redirect-dir"
+)
+
+// redirectDirKernel is the first release supporting redirect_dir.
+const redirectDirKernel = "4.10"
+
+func parseRenameMode(s string) (RenameMode, error) {
+	switch mode := RenameMode(s); mode {
+	case RenameNone, RenameWorkdirSplit, RenameRedirectDir:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown rename workaround %q, should be %s or %s", s, RenameWorkdirSplit, RenameRedirectDir)
+	}
+}
+
+// renameAffected tells whether the kernel fails the renames of the
+// directories of the lower layers.
+func renameAffected() (bool, error) {
+	v, err := kernelVersion()
+	if err != nil {
+		return false, err
+	}
+	min, err := kernel.ParseRelease(redirectDirKernel)
+	if err != nil {
+		return false, err
+	}
+	return kernel.CompareKernelVersion(*v, *min) < 0, nil
+}
+
+// checkRenameWorkaround checks that the kernel supports the rename
+// workaround, and sets up the work dirs for RenameWorkdirSplit. Called by
+// Init before the work dir is checked.
+func (o *OverlayFsStorage) checkRenameWorkaround() error {
+	affected, err := renameAffected()
+	switch o.RenameWorkaround {
+	case RenameNone:
+		if err != nil {
+			glog.V(1).Infof("cannot tell whether the kernel renames the overlay directories: %v", err)
+		} else if affected {
+			glog.Warningf("the kernel fails the renames of the directories of the overlay lower layers with EXDEV, see overlay.renameworkaround")
+		}
+	case RenameWorkdirSplit:
+		if o.WorkDir == "" {
+			o.WorkDir = filepath.Join(o.RootPath(), "work")
+		}
+	case RenameRedirectDir:
+		if err != nil {
+			return fmt.Errorf("cannot check that the kernel supports the redirect_dir of overlay: %v", err)
+		}
+		if affected {
+			return fmt.Errorf("redirect_dir of overlay needs linux %s or later, use the %s workaround instead", redirectDirKernel, RenameWorkdirSplit)
+		}
+	default:
+		return fmt.Errorf("unknown rename workaround %q", o.RenameWorkaround)
+	}
+	return nil
+}
+
+// renameMountData returns the overlay options of the rename workaround.
+func (o *OverlayFsStorage) renameMountData() []string {
+	if o.RenameWorkaround == RenameRedirectDir {
+		return []string{"redirect_dir=on"}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// A shared vfs volume of the overlay storage lives in the shared dir of the
+// root path instead of the dir of its pod: every pod creating a shared volume
+// of the same name gets the same directory, which it binds into its sandbox
+// as any vfs volume. Each pod keeps its own record of the volume. The
+// containers prepared with a shared volume are counted in the daemon db, so
+// that the volume is not removed while any pod mounts it; the directory goes
+// with the record of the last pod. The creations and removals of a shared
+// volume are serialized on the lock "shared/<name>" of the driver.
+
+func (o *OverlayFsStorage) sharedVolumePath(name string) string {
+	return filepath.Join(o.RootPath(), "shared", name)
+}
+
+func sharedVolumeLock(name string) string {
+	return "shared/" + name
+}
+
+// createSharedVolume makes the directory of the shared volume, unless another
+// pod did already.
+func (o *OverlayFsStorage) createSharedVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	if spec.Name == "" || strings.Contains(spec.Name, "/") || strings.HasPrefix(spec.Name, ".") {
+		return fmt.Errorf("invalid name %q of shared volume", spec.Name)
+	}
+	o.locks.Lock(sharedVolumeLock(spec.Name))
+	defer o.locks.Unlock(sharedVolumeLock(spec.Name))
+	dir := o.sharedVolumePath(spec.Name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	spec.Source = dir
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, o.db, podId, spec)
+}
+
+// refSharedVolumes counts the container as mounting the shared volumes among
+// the volumes of opts, unless preparing it failed. It is deferred with the
+// named error result of PrepareContainer.
+func (o *OverlayFsStorage) refSharedVolumes(mountId string, opts storage.ContainerOptions, err *error) {
+	if *err != nil || o.db == nil {
+		return
+	}
+	for _, name := range opts.Volumes {
+		record, e := o.db.GetPodVolume(opts.PodID, name)
+		if e != nil || !parseVolumeRecord(record).Shared {
+			continue
+		}
+		if e := o.db.AddSharedVolumeRef(name, opts.PodID, mountId); e != nil {
+			glog.Errorf("failed to count container %s as mounting the shared volume %s: %v", mountId, name, e)
+		}
+	}
+}
+
+// unrefSharedVolumes drops the counts of the container, once cleaned up.
+func (o *OverlayFsStorage) unrefSharedVolumes(mountId string, err *error) {
+	if *err != nil || o.db == nil {
+		return
+	}
+	for kv := range o.db.ListSharedVolumeRefs("") {
+		if kv == nil {
+			glog.Warningf("failed to list the shared volumes, container %s may still count as mounting some", mountId)
+			continue
+		}
+		name, podId, id := parseSharedVolumeRef(kv.K)
+		if id != mountId {
+			continue
+		}
+		if e := o.db.DeleteSharedVolumeRef(name, podId, id); e != nil {
+			glog.Errorf("failed to drop container %s from the shared volume %s: %v", id, name, e)
+		}
+	}
+}
+
+// parseSharedVolumeRef splits the key shared-volume-<name>/<podId>/<mountId>.
+func parseSharedVolumeRef(key []byte) (name, podId, mountId string) {
+	parts := strings.SplitN(strings.TrimPrefix(string(key), daemondb.SHARED_VOLUME_PREFIX), "/", 3)
+	if len(parts) != 3 {
+		return "", "", ""
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// sharedVolumePods returns the pods whose prepared containers mount the
+// shared volume.
+func (o *OverlayFsStorage) sharedVolumePods(name string) ([]string, error) {
+	if o.db == nil {
+		return nil, nil
+	}
+	pods := make(map[string]bool)
+	for kv := range o.db.ListSharedVolumeRefs(name) {
+		if kv == nil {
+			return nil, fmt.Errorf("failed to list the pods mounting the shared volume %s", name)
+		}
+		if _, podId, _ := parseSharedVolumeRef(kv.K); podId != "" {
+			pods[podId] = true
+		}
+	}
+	list := make([]string, 0, len(pods))
+	for podId := range pods {
+		list = append(list, podId)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// removeSharedVolume removes the record of the pod of the shared volume, and
+// its directory when no other pod has a record of it. It is refused while any
+// pod mounts the volume.
+func (o *OverlayFsStorage) removeSharedVolume(ctx context.Context, podId, name string) error {
+	o.locks.Lock(sharedVolumeLock(name))
+	defer o.locks.Unlock(sharedVolumeLock(name))
+	pods, err := o.sharedVolumePods(name)
+	if err != nil {
+		return err
+	}
+	if len(pods) > 0 {
+		glog.Warningf("shared volume %s is mounted by the pods %v, refuse to remove it", name, pods)
+		return ErrVolumeInUse
+	}
+	owners, err := o.sharedVolumeOwners(name)
+	if err != nil {
+		return err
+	}
+	for _, kept := range owners {
+		if kept != podId {
+			glog.V(1).Infof("shared volume %s is kept for pod %s", name, kept)
+			return deleteVolumeRecord(ctx, o.db, podId, name)
+		}
+	}
+	dir := o.sharedVolumePath(name)
+	if o.SecureRemove {
+		if err := secureErase(ctx, dir, func(ctx context.Context) error { return shredTree(ctx, dir) }); err != nil {
+			glog.Errorf("failed to erase shared volume %s: %v", dir, err)
+			return err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		glog.Errorf("failed to remove shared volume %s: %v", dir, err)
+		return err
+	}
+	return deleteVolumeRecord(ctx, o.db, podId, name)
+}
+
+// sharedVolumeOwners returns the pods having a record of the shared volume.
+func (o *OverlayFsStorage) sharedVolumeOwners(name string) ([]string, error) {
+	if o.db == nil {
+		return nil, nil
+	}
+	// the volumes are listed to the end, the list is not left blocked
+	var owners []string
+	var listErr error
+	for kv := range o.db.ListAllVolumes() {
+		if kv == nil {
+			listErr = fmt.Errorf("failed to list the pods of the shared volume %s", name)
+			continue
+		}
+		vol := parseVolumeRecord(kv.V)
+		if vol.Shared && vol.Name == name {
+			owners = append(owners, recordPodId(kv.K, name))
+		}
+	}
+	if listErr != nil {
+		return nil, listErr
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// collectSharedVolumes removes the shared volumes of which no active pod has
+// a record or mounts a container, with the counts left by the pods gone. The
+// volumes are returned as "shared/<name>". Without the daemon db the owners
+// of the volumes are unknown and nothing is collected.
+func (o *OverlayFsStorage) collectSharedVolumes(activePodIDs []string) ([]string, error) {
+	if o.db == nil {
+		return nil, nil
+	}
+	dirs, err := ioutil.ReadDir(filepath.Join(o.RootPath(), "shared"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	active := make(map[string]bool, len(activePodIDs))
+	for _, podId := range activePodIDs {
+		active[podId] = true
+	}
+
+	var collected []string
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		if o.collectSharedVolume(dir.Name(), active) {
+			collected = append(collected, sharedVolumeLock(dir.Name()))
+		}
+	}
+	return collected, nil
+}
+
+// collectSharedVolume removes the shared volume if it is orphaned, under its
+// lock so that no pod creates it meanwhile.
+func (o *OverlayFsStorage) collectSharedVolume(name string, active map[string]bool) bool {
+	o.locks.Lock(sharedVolumeLock(name))
+	defer o.locks.Unlock(sharedVolumeLock(name))
+	owners, err := o.sharedVolumeOwners(name)
+	if err != nil {
+		glog.Errorf("failed to list the owners of the shared volume %s: %v", name, err)
+		return false
+	}
+	pods, err := o.sharedVolumePods(name)
+	if err != nil {
+		glog.Errorf("failed to list the pods mounting the shared volume %s: %v", name, err)
+		return false
+	}
+	for _, podId := range append(owners, pods...) {
+		if active[podId] {
+			return false
+		}
+	}
+	dir := o.sharedVolumePath(name)
+	if storage.PathInUse(dir) {
+		glog.Warningf("orphaned shared volume %s is still in use, leave it", dir)
+		return false
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		glog.Errorf("failed to remove the orphaned shared volume %s: %v", dir, err)
+		return false
+	}
+	var refs [][]byte
+	for kv := range o.db.ListSharedVolumeRefs(name) {
+		if kv != nil {
+			refs = append(refs, kv.K)
+		}
+	}
+	for _, key := range refs {
+		_, podId, mountId := parseSharedVolumeRef(key)
+		if err := o.db.DeleteSharedVolumeRef(name, podId, mountId); err != nil {
+			glog.Errorf("failed to drop container %s from the shared volume %s: %v", mountId, name, err)
+		}
+	}
+	return true
+}
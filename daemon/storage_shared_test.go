@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestOverlayFsSharedVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	o := &OverlayFsStorage{db: db, rootPath: filepath.Join(root, "overlay")}
+	pods := []string{testPodId(t) + "-a", testPodId(t) + "-b"}
+	mounts := make([]string, len(pods))
+	for i, podId := range pods {
+		spec := &apitypes.UserVolume{Name: "data", Shared: true}
+		if err := o.CreateVolume(ctx, podId, spec); err != nil {
+			t.Fatalf("create shared volume of pod %s failed: %v", podId, err)
+		}
+		if spec.Source != o.sharedVolumePath("data") {
+			t.Fatalf("the shared volume should be made in the shared dir, got %s", spec.Source)
+		}
+		// the pod binds the volume into its sandbox as any vfs volume
+		sharedDir := filepath.Join(root, "sandbox-"+podId)
+		vol, err := storage.MountVFSVolume(spec.Source, sharedDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer storage.UmountVFSVolume(vol, sharedDir)
+		mounts[i] = filepath.Join(sharedDir, vol)
+	}
+
+	// each pod sees the file written by the other one
+	if err := ioutil.WriteFile(filepath.Join(mounts[0], "from-a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mounts[1], "from-b"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(mounts[1], "from-a")); err != nil || string(data) != "a" {
+		t.Fatalf("pod b should see the file of pod a, got %q: %v", data, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(mounts[0], "from-b")); err != nil || string(data) != "b" {
+		t.Fatalf("pod a should see the file of pod b, got %q: %v", data, err)
+	}
+
+	// the volume is kept while a container of either pod mounts it
+	var noErr error
+	opts := storage.ContainerOptions{PodID: pods[1], Volumes: []string{"data"}}
+	o.refSharedVolumes("container-b", opts, &noErr)
+	if mounted, err := o.sharedVolumePods("data"); err != nil || len(mounted) != 1 || mounted[0] != pods[1] {
+		t.Fatalf("expected pod b to mount the shared volume, got %v: %v", mounted, err)
+	}
+	record, err := db.GetPodVolume(pods[0], "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RemoveVolume(ctx, pods[0], record); !IsDeviceBusy(err) {
+		t.Fatalf("the shared volume mounted by pod b should not be removed, got %v", err)
+	}
+	o.unrefSharedVolumes("container-b", &noErr)
+
+	// the directory goes with the record of the last pod
+	if err := o.RemoveVolume(ctx, pods[0], record); err != nil {
+		t.Fatalf("remove shared volume of pod a failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(o.sharedVolumePath("data"), "from-a")); err != nil {
+		t.Fatalf("the shared volume should be kept for pod b: %v", err)
+	}
+	record, err = db.GetPodVolume(pods[1], "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RemoveVolume(ctx, pods[1], record); err != nil {
+		t.Fatalf("remove shared volume of pod b failed: %v", err)
+	}
+	if _, err := os.Stat(o.sharedVolumePath("data")); !os.IsNotExist(err) {
+		t.Fatalf("the shared volume should be removed with its last pod, got %v", err)
+	}
+}
+
+func TestOverlayFsCollectSharedVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	o := &OverlayFsStorage{db: db, rootPath: filepath.Join(root, "overlay")}
+	podA, podB := testPodId(t)+"-a", testPodId(t)+"-b"
+	for _, podId := range []string{podA, podB} {
+		if err := o.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "data", Shared: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var noErr error
+	o.refSharedVolumes("container-b", storage.ContainerOptions{PodID: podB, Volumes: []string{"data"}}, &noErr)
+
+	// the volume is kept while any pod owning or mounting it is active
+	collected, err := o.GarbageCollect(ctx, []string{podA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collected) != 0 {
+		t.Fatalf("the shared volume of an active pod should be kept, collected %v", collected)
+	}
+
+	collected, err = o.GarbageCollect(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collected) != 1 || collected[0] != "shared/data" {
+		t.Fatalf("expected the orphaned shared volume to be collected, got %v", collected)
+	}
+	if _, err := os.Stat(o.sharedVolumePath("data")); !os.IsNotExist(err) {
+		t.Fatalf("the orphaned shared volume should be removed, got %v", err)
+	}
+	if pods, err := o.sharedVolumePods("data"); err != nil || len(pods) != 0 {
+		t.Fatalf("the counts of the pods gone should be dropped, got %v: %v", pods, err)
+	}
+}
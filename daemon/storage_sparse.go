@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// The blocks of the rawblock volumes are sparse files by default: only the
+// extents the filesystem of the volume writes take space on the root. With
+// rawblock.sparse=false, the whole block is allocated when it is created, so
+// that writing to the volume never fails for lack of space on the root. The
+// dense blocks made before, or so, are punched back to sparse files by Init
+// with rawblock.sparsify=true.
+
+// preallocateBlock allocates all the space of the block, its content is
+// left as is.
+func preallocateBlock(block string, size uint64) error {
+	f, err := os.OpenFile(block, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, int64(size)); err != nil {
+		return fmt.Errorf("failed to allocate %d bytes to %s: %v", size, block, err)
+	}
+	return nil
+}
+
+// denseBlock tells whether all the space of the block is allocated.
+func denseBlock(block string) (bool, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(block, &st); err != nil {
+		return false, err
+	}
+	return st.Size > 0 && st.Blocks*512 >= st.Size, nil
+}
+
+// sparsifyBlock rewrites the block as a sparse file, holes standing for its
+// zeroed ranges. The copy must not share the extents of the block, they are
+// all allocated.
+func sparsifyBlock(ctx context.Context, block string) error {
+	tmp := block + ".sparse"
+	if out, err := execCommand(ctx, "cp", "--reflink=never", "--sparse=always", block, tmp).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to copy %s to %s: %v, %s", block, tmp, err, out)
+	}
+	if err := os.Rename(tmp, block); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// sparsifyVolumes rewrites the dense blocks of the volumes as sparse files,
+// the blocks in use are left as they are.
+func (s *RawBlockStorage) sparsifyVolumes(ctx context.Context) error {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sparsified := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") || isVolumeMeta(entry.Name()) {
+			continue
+		}
+		block := filepath.Join(dir, entry.Name())
+		if dense, err := denseBlock(block); err != nil || !dense {
+			continue
+		}
+		if loop, _ := loopDevice(ctx, block); loop != "" || storage.PathInUse(block) {
+			glog.Warningf("volume %s is in use, it is not made sparse", block)
+			continue
+		}
+		if err := sparsifyBlock(ctx, block); err != nil {
+			glog.Errorf("failed to make volume %s sparse: %v", block, err)
+			continue
+		}
+		// the project of the quota went with the former file
+		if err := s.limitBlock(ctx, block, uint64(entry.Size())); err != nil {
+			glog.Errorf("failed to limit volume %s made sparse: %v", block, err)
+		}
+		sparsified++
+	}
+	glog.Infof("%d dense rawblock volumes made sparse", sparsified)
+	return nil
+}
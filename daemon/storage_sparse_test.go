@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func blockUsage(t *testing.T, block string) (size, allocated int64) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(block, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Size, st.Blocks * 512
+}
+
+func TestRawBlockSparseVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "sparse-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	const size = 64 << 20
+	spec := &apitypes.UserVolume{Name: "sparse", SizeBytes: size}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	apparent, allocated := blockUsage(t, s.volumePath(podId, "sparse"))
+	if apparent != size || allocated > 1<<20 || !spec.Sparse {
+		t.Fatalf("the block should be sparse, %d bytes allocated to %d, sparse %v", allocated, apparent, spec.Sparse)
+	}
+
+	s.Preallocate = true
+	spec = &apitypes.UserVolume{Name: "dense", SizeBytes: 8 << 20}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if apparent, allocated := blockUsage(t, s.volumePath(podId, "dense")); apparent != 8<<20 || allocated < apparent || spec.Sparse {
+		t.Fatalf("the block should be allocated, %d bytes allocated to %d, sparse %v", allocated, apparent, spec.Sparse)
+	}
+}
+
+func TestRawBlockSparsify(t *testing.T) {
+	root, err := ioutil.TempDir("", "sparse-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	data := append([]byte("superblock"), make([]byte, 4<<20)...)
+	if err := ioutil.WriteFile(block, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if dense, err := denseBlock(block); err != nil || !dense {
+		t.Fatalf("the block written should be dense, got %v, %v", dense, err)
+	}
+
+	s.Sparsify = true
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if apparent, allocated := blockUsage(t, block); apparent != int64(len(data)) || allocated > 64<<10 {
+		t.Fatalf("the block should be made sparse, %d bytes allocated to %d", allocated, apparent)
+	}
+	if got, _ := ioutil.ReadFile(block); !bytes.Equal(got, data) {
+		t.Fatal("the block made sparse should keep its content")
+	}
+}
@@ -0,0 +1,440 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/pkg/locker"
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// SquashfsStorage starts the containers from pre-built squashfs images, which
+// are mounted as is rather than stacked from layers. The image of a container
+// is <root>/images/<id>.squashfs; a read-only container gets the image as its
+// rootfs, a writable one gets an overlay with the image as the lower layer.
+// The volumes are images built from a directory of the host:
+//
+//	squashfs.compression  compressor of mksquashfs, e.g. "zstd", its default when unset
+type SquashfsStorage struct {
+	storageEvents
+	volumeRefs
+	db       *daemondb.DaemonDB
+	rootPath string
+	// locks serializes the mount operations on the same container.
+	locks locker.Locker
+	// Compression is the compressor of the volume images.
+	Compression string
+}
+
+func SquashfsFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &SquashfsStorage{
+		db:          db,
+		rootPath:    config.DriverRoot("squashfs"),
+		Compression: config.DriverOption("squashfs", "compression"),
+	}
+	return driver, nil
+}
+
+func (s *SquashfsStorage) Type() string {
+	return "squashfs"
+}
+
+func (s *SquashfsStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *SquashfsStorage) imagePath(mountId string) string {
+	return filepath.Join(s.RootPath(), "images", mountId+".squashfs")
+}
+
+// layerPath is where the image of a writable container is mounted, as the
+// lower layer of its overlay.
+func (s *SquashfsStorage) layerPath(mountId string) string {
+	return filepath.Join(s.RootPath(), "layers", mountId)
+}
+
+// containerPath holds the upper and the work dir of a writable container,
+// kept across the cleanups as the upper dirs of the overlay driver are.
+func (s *SquashfsStorage) containerPath(mountId string) string {
+	return filepath.Join(s.RootPath(), "containers", mountId)
+}
+
+func (s *SquashfsStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+// mountSquashfs mounts the image read-only at target, unless it is mounted
+// there already. The loop device of the image is detached once mounted, the
+// kernel then releases it with the mount.
+func mountSquashfs(ctx context.Context, image, target string) error {
+	if mounted, _ := mount.Mounted(target); mounted {
+		return nil
+	}
+	if _, err := os.Stat(image); err != nil {
+		return err
+	}
+	if err := ensureDir(target, 0755); err != nil {
+		return err
+	}
+	device, err := attachLoop(ctx, image)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if out, err := execCommand(ctx, "losetup", "-d", device).CombinedOutput(); err != nil {
+			glog.Warningf("failed to detach %s from %s: %v, %s", device, image, err, out)
+		}
+	}()
+	if err := syscall.Mount(device, target, "squashfs", syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("failed to mount squashfs %s to %s: %w", image, target, err)
+	}
+	return nil
+}
+
+// unmountPath unmounts target unless nothing is mounted there.
+func unmountPath(target string) error {
+	if mounted, _ := mount.Mounted(target); !mounted {
+		return nil
+	}
+	return syscall.Unmount(target, 0)
+}
+
+func (s *SquashfsStorage) Init(ctx context.Context) error {
+	for _, dir := range []string{"images", "layers", "containers", "volumes"} {
+		if err := ensureDir(filepath.Join(s.RootPath(), dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*SquashfsStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (s *SquashfsStorage) HealthCheck(ctx context.Context) (err error) {
+	defer wrapStorageError(&err, s.Type(), "HealthCheck", "")
+	return checkWritable(filepath.Join(s.RootPath(), "volumes"))
+}
+
+func (s *SquashfsStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *SquashfsStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{}
+}
+
+func (s *SquashfsStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// PrepareContainer mounts the image of the container as its rootfs, or as the
+// lower layer of its overlay when the container is writable.
+func (s *SquashfsStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (vol *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	defer wrapStorageError(&err, s.Type(), "PrepareContainer", mountId)
+	s.locks.Lock(mountId)
+	defer s.locks.Unlock(mountId)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	rootfs := filepath.Join(sharedDir, mountId, "rootfs")
+	if opts.ReadOnly {
+		if err := mountSquashfs(ctx, s.imagePath(mountId), rootfs); err != nil {
+			return nil, err
+		}
+	} else if err := s.mountOverlay(ctx, mountId, rootfs); err != nil {
+		return nil, err
+	}
+	if err := storage.SetSELinuxLabel(rootfs, opts.SELinuxLabel); err != nil {
+		return nil, err
+	}
+
+	containerPath := "/" + mountId
+	vol = &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+	return vol, nil
+}
+
+// mountOverlay mounts a writable overlay at rootfs, with the image of the
+// container as the lower layer.
+func (s *SquashfsStorage) mountOverlay(ctx context.Context, mountId, rootfs string) error {
+	if mounted, _ := mount.Mounted(rootfs); mounted {
+		return nil
+	}
+	layer := s.layerPath(mountId)
+	if err := mountSquashfs(ctx, s.imagePath(mountId), layer); err != nil {
+		return err
+	}
+	upper, work := filepath.Join(s.containerPath(mountId), "upper"), filepath.Join(s.containerPath(mountId), "work")
+	for _, dir := range []string{upper, work, rootfs} {
+		if err := ensureDir(dir, 0755); err != nil {
+			unmountPath(layer)
+			return err
+		}
+	}
+	params := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", layer, upper, work)
+	if err := syscall.Mount("overlay", rootfs, "overlay", 0, params); err != nil {
+		unmountPath(layer)
+		return fmt.Errorf("error creating overlay mount to %s: %w", rootfs, err)
+	}
+	return nil
+}
+
+// CleanupContainer unmounts the rootfs of the container, and the image below
+// it; cleaning up a container which is not prepared succeeds.
+func (s *SquashfsStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	defer wrapStorageError(&err, s.Type(), "CleanupContainer", id)
+	s.locks.Lock(id)
+	defer s.locks.Unlock(id)
+
+	if err := unmountPath(filepath.Join(sharedDir, id, "rootfs")); err != nil {
+		return err
+	}
+	return unmountPath(s.layerPath(id))
+}
+
+// InjectFile fails, the images can not be written to.
+func (s *SquashfsStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return ErrReadOnly
+}
+
+// InjectDir fails, the images can not be written to.
+func (s *SquashfsStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	return ErrReadOnly
+}
+
+func (s *SquashfsStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume builds the image of the volume from the directory of the host
+// given as the source of the spec. The image is handed to the hypervisor as a
+// block, its filesystem is read-only.
+func (s *SquashfsStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	defer wrapStorageError(&err, s.Type(), "CreateVolume", volumeID(podId, spec.Name))
+	if spec.Source == "" {
+		return fmt.Errorf("squashfs volume %s needs a source directory", spec.Name)
+	}
+	if fi, err := os.Stat(spec.Source); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("source %s of squashfs volume %s is not a directory", spec.Source, spec.Name)
+	}
+	volPath := s.volumePath(podId, spec.Name)
+	if _, err := os.Stat(volPath); err == nil {
+		return fmt.Errorf("volume %s of pod %s already exists", spec.Name, podId)
+	}
+
+	// mksquashfs appends to an existing image, the image is built aside and
+	// only moved in place once complete
+	tmp := filepath.Join(filepath.Dir(volPath), "."+filepath.Base(volPath))
+	args := []string{spec.Source, tmp, "-noappend", "-no-progress"}
+	if s.Compression != "" {
+		args = append(args, "-comp", s.Compression)
+	}
+	if out, err := execCommand(ctx, "mksquashfs", args...).CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("mksquashfs %s failed: %v, %s", spec.Source, err, out)
+	}
+	if err := os.Rename(tmp, volPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fi, err := os.Stat(volPath)
+	if err != nil {
+		return err
+	}
+	glog.V(1).Infof("volume %s of pod %s built from %s", spec.Name, podId, spec.Source)
+
+	spec.Source = volPath
+	spec.Format = "raw"
+	spec.Fstype = "squashfs"
+	spec.SizeBytes = uint64(fi.Size())
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+func (s *SquashfsStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	defer wrapStorageError(&err, s.Type(), "RemoveVolume", volumeID(podId, parseVolumeRecord(record).Name))
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	if err := os.Remove(s.volumePath(podId, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *SquashfsStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vol := &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "raw",
+			Fstype: "squashfs",
+		}
+		if fi, err := os.Stat(vol.Source); err == nil {
+			vol.SizeBytes = uint64(fi.Size())
+		}
+		vols = append(vols, vol)
+	}
+	return vols, nil
+}
+
+func (s *SquashfsStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *SquashfsStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.volumePath(podId, volName))
+}
+
+func (s *SquashfsStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *SquashfsStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *SquashfsStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrReadOnly
+}
+
+func (s *SquashfsStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+// ContainerStats returns the disk usage of the upper dir of a writable
+// container, a read-only one writes nothing.
+func (s *SquashfsStorage) ContainerStats(ctx context.Context, containerId string) (stats *StorageStats, err error) {
+	defer wrapStorageError(&err, s.Type(), "ContainerStats", containerId)
+	upper := filepath.Join(s.containerPath(containerId), "upper")
+	if _, err := os.Stat(upper); os.IsNotExist(err) {
+		return &StorageStats{LayerCount: 1}, nil
+	}
+	stats, err = dirStats(ctx, upper)
+	if err != nil {
+		return nil, err
+	}
+	stats.LayerCount = 2
+	return stats, nil
+}
+
+func (s *SquashfsStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *SquashfsStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *SquashfsStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *SquashfsStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *SquashfsStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect removes the images of the orphaned volumes.
+func (s *SquashfsStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (collected []string, err error) {
+	defer wrapStorageError(&err, s.Type(), "GarbageCollect", "")
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range orphans {
+		volPath := filepath.Join(dir, name)
+		if storage.PathOpened(volPath) {
+			glog.Warningf("orphaned volume %s is still in use, leave it", volPath)
+			continue
+		}
+		if err := os.Remove(volPath); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", name, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
@@ -0,0 +1,143 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestSquashfsVolume(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "squashfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	ctx := context.Background()
+	s := &SquashfsStorage{rootPath: filepath.Join(root, "squashfs"), Compression: "zstd"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "vol1"}); err == nil {
+		t.Fatal("a volume without source should be refused")
+	}
+
+	src := filepath.Join(root, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	spec := &apitypes.UserVolume{Name: "vol1", Source: src}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if spec.Source != s.volumePath(podId, "vol1") || spec.Format != "raw" || spec.Fstype != "squashfs" {
+		t.Fatalf("unexpected volume spec %#v", spec)
+	}
+	if data, err := ioutil.ReadFile(spec.Source); err != nil || string(data) != "hsqs"+src {
+		t.Fatalf("the image should be built from %s, got %q, %v", src, data, err)
+	}
+	if commands, _ := ioutil.ReadFile(log); !strings.Contains(string(commands), "-noappend") || !strings.Contains(string(commands), "-comp zstd") {
+		t.Fatalf("unexpected mksquashfs command %s", commands)
+	}
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "vol1", Source: src}); err == nil {
+		t.Fatal("an existing volume should not be rebuilt")
+	}
+	if vols, err := s.ListVolumes(ctx, podId); err != nil || len(vols) != 1 || vols[0].SizeBytes != spec.SizeBytes {
+		t.Fatalf("unexpected volumes %v, %v", vols, err)
+	}
+	if err := s.ImportVolume(ctx, podId, "vol1", strings.NewReader("")); !IsReadOnly(err) {
+		t.Fatalf("expected the volume to be read-only, got %v", err)
+	}
+
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "vol1"); exists {
+		t.Fatal("the image should be removed with the volume")
+	}
+}
+
+func TestSquashfsContainer(t *testing.T) {
+	root, err := ioutil.TempDir("", "squashfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &SquashfsStorage{rootPath: filepath.Join(root, "squashfs")}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sharedDir := filepath.Join(root, "shared")
+	if _, err := s.PrepareContainer(ctx, "missing", sharedDir, storage.ContainerOptions{ReadOnly: true}); !IsNotFound(err) {
+		t.Fatalf("expected the image not found, got %v", err)
+	}
+	if err := s.CleanupContainer(ctx, "missing", sharedDir); err != nil {
+		t.Fatalf("cleaning up a container which is not prepared should succeed, got %v", err)
+	}
+	if err := s.InjectFile(ctx, strings.NewReader("x"), "c1", "/etc/x", sharedDir, 0644, 0, 0, nil); !IsReadOnly(err) {
+		t.Fatalf("expected the container to be read-only, got %v", err)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("mounting squashfs needs root")
+	}
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		t.Skip("mksquashfs is not installed")
+	}
+	src := filepath.Join(root, "src")
+	if err := os.MkdirAll(filepath.Join(src, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "etc", "hostname"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mksquashfs", src, s.imagePath("c1"), "-noappend").CombinedOutput(); err != nil {
+		t.Fatalf("mksquashfs failed: %v, %s", err, out)
+	}
+	rootfs := filepath.Join(sharedDir, "c1", "rootfs")
+
+	vol, err := s.PrepareContainer(ctx, "c1", sharedDir, storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	if !vol.ReadOnly {
+		t.Fatal("the container should be read-only")
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("c1"), 0644); !IsReadOnly(err) {
+		t.Fatalf("expected the image to be read-only, got %v", err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", sharedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// a writable container writes to the overlay on top of the image
+	if vol, err = s.PrepareContainer(ctx, "c1", sharedDir, storage.ContainerOptions{}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	defer s.CleanupContainer(ctx, "c1", sharedDir)
+	if vol.ReadOnly {
+		t.Fatal("the container should be writable")
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc", "hostname"), []byte("c1"), 0644); err != nil {
+		t.Fatalf("the container should be writable, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(s.containerPath("c1"), "upper", "etc", "hostname")); string(data) != "c1" {
+		t.Fatalf("the write should land in the upper dir, got %q", data)
+	}
+}
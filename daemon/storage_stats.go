@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hyperhq/hyperd/daemon/pod"
+	"golang.org/x/net/context"
+)
+
+// StorageStats is the disk usage of the writable layer of a container.
+type StorageStats struct {
+	// WrittenBytes is the disk space taken by what the container wrote.
+	WrittenBytes uint64
+	// SizeBytes bounds the writable layer, 0 when only the filesystem of the
+	// driver bounds it.
+	SizeBytes  uint64
+	InodeCount uint64
+	LayerCount int
+}
+
+type inode struct {
+	dev, ino uint64
+}
+
+// dirStats walks dir and sums the disk space of its inodes, each hard link
+// counted once. The files removed during the walk are ignored, the container
+// may be running.
+func dirStats(ctx context.Context, dir string) (*StorageStats, error) {
+	stats := &StorageStats{}
+	seen := make(map[inode]struct{})
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p != dir {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot stat %s", p)
+		}
+		key := inode{uint64(st.Dev), st.Ino}
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+		stats.InodeCount++
+		stats.WrittenBytes += uint64(st.Blocks) * 512
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+type cachedStorageStats struct {
+	stats *StorageStats
+	at    time.Time
+}
+
+// storageStatsCache keeps the stats of the containers for ttl, walking the
+// writable layers is expensive. A nil cache or a ttl of 0 caches nothing.
+type storageStatsCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedStorageStats
+}
+
+func newStorageStatsCache(ttl time.Duration) *storageStatsCache {
+	return &storageStatsCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedStorageStats),
+	}
+}
+
+// get returns the stats of the container id, computed by compute unless the
+// cached ones are still fresh. The errors are not cached.
+func (c *storageStatsCache) get(id string, compute func() (*StorageStats, error)) (*StorageStats, error) {
+	if c == nil || c.ttl <= 0 {
+		return compute()
+	}
+	c.Lock()
+	entry, ok := c.entries[id]
+	c.Unlock()
+	if ok && time.Since(entry.at) < c.ttl {
+		return entry.stats, nil
+	}
+
+	stats, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.Sub(entry.at) >= c.ttl {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[id] = cachedStorageStats{stats: stats, at: now}
+	return stats, nil
+}
+
+// ContainerStorageStats returns the disk usage of the writable layer of the
+// container, cached for the StorageStatsTTL of the config.
+func (daemon *Daemon) ContainerStorageStats(ctx context.Context, name string) (*StorageStats, error) {
+	_, id, ok := daemon.PodList.GetByContainerIdOrName(name)
+	if !ok {
+		return nil, fmt.Errorf("Can not find container by name(%s)", name)
+	}
+	return daemon.storageStats.get(id, func() (*StorageStats, error) {
+		mountId, err := pod.GetMountIdByContainer(daemon.Storage.Type(), id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find the mount of container %s: %v", id, err)
+		}
+		return daemon.Storage.ContainerStats(ctx, mountId)
+	})
+}
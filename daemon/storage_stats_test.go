@@ -0,0 +1,114 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverlayFsContainerStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	upper := filepath.Join(root, "container", "upper")
+	if err := os.MkdirAll(filepath.Join(upper, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "etc", "hosts"), make([]byte, 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(upper, "etc", "hosts"), filepath.Join(upper, "hosts")); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &OverlayFsStorage{rootPath: root}
+	stats, err := o.ContainerStats(context.Background(), "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// upper, etc and the hard linked file
+	if stats.InodeCount != 3 || stats.LayerCount != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.WrittenBytes < 8192 {
+		t.Fatalf("the written file should be counted once at least, got %d bytes", stats.WrittenBytes)
+	}
+
+	if _, err := o.ContainerStats(context.Background(), "unknown"); err == nil {
+		t.Fatal("the stats of an unknown container should fail")
+	}
+}
+
+func TestRawBlockContainerStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "blocks"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	block := filepath.Join(root, "blocks", "container")
+	f, err := os.Create(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(64 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s := &RawBlockStorage{rootPath: root}
+	stats, err := s.ContainerStats(context.Background(), "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SizeBytes != 64*1024*1024 || stats.LayerCount != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.WrittenBytes < 4096 || stats.WrittenBytes >= stats.SizeBytes {
+		t.Fatalf("only the written blocks should be counted, got %d bytes", stats.WrittenBytes)
+	}
+}
+
+func TestStorageStatsCache(t *testing.T) {
+	mock := NewMockStorage()
+	mock.SetContainerStats(&StorageStats{WrittenBytes: 42})
+	compute := func() (*StorageStats, error) {
+		return mock.ContainerStats(context.Background(), "container")
+	}
+
+	cache := newStorageStatsCache(time.Minute)
+	for i := 0; i < 3; i++ {
+		stats, err := cache.get("container", compute)
+		if err != nil || stats.WrittenBytes != 42 {
+			t.Fatalf("unexpected stats %+v, %v", stats, err)
+		}
+	}
+	if calls := mock.Calls("ContainerStats"); len(calls) != 1 {
+		t.Fatalf("the stats should be computed once, got %d calls", len(calls))
+	}
+
+	// expire the entry
+	cache.entries["container"] = cachedStorageStats{stats: &StorageStats{}, at: time.Now().Add(-time.Hour)}
+	if stats, _ := cache.get("container", compute); stats.WrittenBytes != 42 {
+		t.Fatalf("the expired stats should be computed again, got %+v", stats)
+	}
+
+	var nocache *storageStatsCache
+	nocache.get("container", compute)
+	newStorageStatsCache(0).get("container", compute)
+	if calls := mock.Calls("ContainerStats"); len(calls) != 4 {
+		t.Fatalf("nothing should be cached without a ttl, got %d calls", len(calls))
+	}
+}
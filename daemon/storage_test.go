@@ -0,0 +1,2147 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"github.com/hyperhq/hyperd/utils"
+	"github.com/opencontainers/runc/libcontainer/selinux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func testPodId(t *testing.T) string {
+	return fmt.Sprintf("test-%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+// unregisterDriver drops a driver registered by a test from the registry.
+func unregisterDriver(name string) {
+	storageDrivers.Lock()
+	defer storageDrivers.Unlock()
+	delete(storageDrivers.drivers, name)
+}
+
+// fakeExecCommand re-runs the test binary as TestHelperProcess instead of the
+// real storage tool.
+func fakeExecCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cs := append([]string{"-test.run=TestHelperProcess", "--", name}, args...)
+	cmd := exec.CommandContext(ctx, os.Args[0], cs...)
+	cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1")
+	return cmd
+}
+
+// TestHelperProcess emulates the external tools used by the storage drivers,
+// only the side effects the drivers rely on are reproduced.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "no command")
+		os.Exit(2)
+	}
+	cmd, args := args[1], args[2:]
+
+	// let the tests check the commands run
+	if log := os.Getenv("HELPER_LOG"); log != "" {
+		if f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+			fmt.Fprintln(f, cmd, strings.Join(args, " "))
+			f.Close()
+		}
+	}
+
+	switch cmd {
+	case "mount", "umount", "xfs_growfs", "resize2fs", "iscsiadm", "mkfs.xfs", "mkfs.ext4", "xfs_quota", "xfs_fsr":
+		os.Exit(0)
+	case "cryptsetup":
+		if err := fakeCryptsetup(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "rbd":
+		if err := fakeRBD(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "losetup":
+		if err := fakeLosetup(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "vgdisplay", "lvdisplay", "lvcreate", "lvchange", "lvremove":
+		if err := fakeLVM(cmd, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(5)
+		}
+		os.Exit(0)
+	case "shred":
+		if err := zeroFile(context.Background(), args[len(args)-1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "gluster":
+		if err := fakeGluster(args); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "virtiofsd":
+		// listen on the socket until terminated
+		if os.Getenv("HELPER_VIRTIOFSD_FAIL") != "" {
+			fmt.Fprintln(os.Stderr, "cannot open the shared dir")
+			os.Exit(1)
+		}
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--socket-path=") {
+				if _, err := net.Listen("unix", strings.TrimPrefix(arg, "--socket-path=")); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+		os.Exit(0)
+	case "xfs_repair":
+		// the block tells its state: a "corrupt" one is repaired, a "broken"
+		// one can not be
+		block := args[len(args)-1]
+		data, _ := ioutil.ReadFile(block)
+		switch state := string(data); {
+		case state != "corrupt" && state != "broken":
+			os.Exit(0)
+		case args[len(args)-2] == "-n":
+			fmt.Println("would fix the inode btree")
+			os.Exit(1)
+		case state == "corrupt":
+			ioutil.WriteFile(block, []byte("repaired"), 0600)
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "fatal error -- the superblock is unreadable")
+		os.Exit(1)
+	case "mksquashfs":
+		// the image holds the magic and the source it is built from
+		if err := ioutil.WriteFile(args[1], []byte("hsqs"+args[0]), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var err error
+	switch cmd + " " + strings.Join(args[:2], " ") {
+	case "btrfs subvolume create":
+		err = os.Mkdir(args[len(args)-1], 0755)
+	case "btrfs subvolume delete":
+		err = os.RemoveAll(args[len(args)-1])
+	case "btrfs subvolume snapshot":
+		err = exec.Command("cp", "-a", args[len(args)-2], args[len(args)-1]).Run()
+	default:
+		err = fmt.Errorf("unknown command %s %v", cmd, args)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// fakeCryptsetup writes the LUKS header with the uuid on luksFormat, and
+// opens the devices as files of HELPER_MAPPER_DIR.
+func fakeCryptsetup(args []string) error {
+	last := args[len(args)-1]
+	switch args[0] {
+	case "luksFormat", "luksOpen":
+		key, err := ioutil.ReadAll(os.Stdin)
+		if err != nil || len(key) == 0 {
+			return fmt.Errorf("no key given on stdin")
+		}
+	}
+	switch args[0] {
+	case "luksFormat":
+		header := make([]byte, luksUUIDOffset+luksUUIDSize)
+		copy(header, luksMagic)
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--uuid=") {
+				copy(header[luksUUIDOffset:], strings.TrimPrefix(arg, "--uuid="))
+			}
+		}
+		f, err := os.OpenFile(last, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(header)
+		return err
+	case "luksOpen":
+		return ioutil.WriteFile(filepath.Join(os.Getenv("HELPER_MAPPER_DIR"), last), nil, 0600)
+	case "luksClose":
+		return os.Remove(filepath.Join(os.Getenv("HELPER_MAPPER_DIR"), last))
+	}
+	return fmt.Errorf("unknown command cryptsetup %v", args)
+}
+
+func TestOverlayFsRemoveVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+
+	if _, err := os.Stat(spec.Source); err != nil {
+		t.Fatalf("volume %s is not created: %v", spec.Source, err)
+	}
+	if !strings.HasPrefix(spec.Source, root+"/") {
+		t.Fatalf("volume %s should be created under the root path %s", spec.Source, root)
+	}
+
+	// a bind mount of a dir of the same name on another filesystem does not
+	// hold the volume, a bind mount of the volume does
+	tmpfs, bind := filepath.Join(root, "tmpfs"), filepath.Join(root, "bind")
+	for _, dir := range []string{tmpfs, bind} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mount("tmpfs", tmpfs, "tmpfs", 0, ""); err != nil {
+		t.Skipf("cannot mount a tmpfs: %v", err)
+	}
+	defer syscall.Unmount(tmpfs, syscall.MNT_DETACH)
+	if err := os.Mkdir(filepath.Join(tmpfs, "vol1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount(filepath.Join(tmpfs, "vol1"), bind, "bind", syscall.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	if storage.PathInUse(spec.Source) {
+		syscall.Unmount(bind, syscall.MNT_DETACH)
+		t.Fatalf("volume %s should not be held by the bind mount of %s", spec.Source, filepath.Join(tmpfs, "vol1"))
+	}
+	if err := syscall.Unmount(bind, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount(spec.Source, bind, "bind", syscall.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	err = o.RemoveVolume(context.Background(), podId, []byte(spec.Name))
+	syscall.Unmount(bind, syscall.MNT_DETACH)
+	if !IsDeviceBusy(err) {
+		t.Fatalf("the bound volume should not be removed, got %v", err)
+	}
+
+	if err := o.RemoveVolume(context.Background(), podId, []byte(spec.Name)); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(spec.Source); !os.IsNotExist(err) {
+		t.Fatalf("volume %s still exists after removal: %v", spec.Source, err)
+	}
+}
+
+// TestOverlayFsLegacyVolume checks the volumes created under
+// storage.VFSVolumeRoot, before the overlay volumes moved under the root path,
+// are still found and removed from there.
+func TestOverlayFsLegacyVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	legacy, err := storage.CreateVFSVolume(storage.VFSVolumeRoot, podId, "vol1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storage.VFSVolumePath(storage.VFSVolumeRoot, podId, ""))
+
+	if exists, err := o.VolumeExists(context.Background(), podId, "vol1"); err != nil || !exists {
+		t.Fatalf("the legacy volume should exist, got %v, %v", exists, err)
+	}
+	vols, err := o.ListVolumes(context.Background(), podId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].Source != legacy {
+		t.Fatalf("expected the legacy volume %s, got %v", legacy, vols)
+	}
+
+	record, err := json.Marshal(&apitypes.UserVolume{Name: "vol1", Source: legacy, Format: "vfs", Fstype: "dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RemoveVolume(context.Background(), podId, record); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("legacy volume %s still exists after removal: %v", legacy, err)
+	}
+}
+
+func TestAufsRemoveVolume(t *testing.T) {
+	a := &AufsStorage{}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := a.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+	if err := a.SnapshotVolume(context.Background(), podId, "vol1", "snap1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.RemoveVolume(context.Background(), podId, []byte(spec.Name)); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(spec.Source)); !os.IsNotExist(err) {
+		t.Fatalf("the volume and its snapshots should be removed, got %v", err)
+	}
+}
+
+func TestRawBlockRemoveVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	// CreateVolume needs mkfs.xfs, an empty file is enough to exercise removal
+	block := s.volumePath(podId, "vol1")
+	if err := ioutil.WriteFile(block, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(block); !os.IsNotExist(err) {
+		t.Fatalf("block %s still exists after removal: %v", block, err)
+	}
+	if err := s.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("removing a missing volume should succeed, got %v", err)
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "list-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	names := []string{"vol1", "vol2", "vol3"}
+
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	for _, name := range names {
+		spec := &apitypes.UserVolume{Name: name}
+		if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+			t.Fatalf("create volume %s failed: %v", name, err)
+		}
+		defer os.RemoveAll(filepath.Dir(spec.Source))
+	}
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(s.volumePath(podId, name), make([]byte, 4096), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// volumes of other pods must not show up
+	if err := ioutil.WriteFile(s.volumePath(podId+"x", "other"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sd := range []Storage{o, s} {
+		vols, err := sd.ListVolumes(context.Background(), podId)
+		if err != nil {
+			t.Fatalf("%s: list volumes failed: %v", sd.Type(), err)
+		}
+		found := map[string]bool{}
+		for _, v := range vols {
+			found[v.Name] = true
+		}
+		if len(vols) != len(names) {
+			t.Fatalf("%s: expected %d volumes, got %v", sd.Type(), len(names), found)
+		}
+		for _, name := range names {
+			if !found[name] {
+				t.Fatalf("%s: volume %s is not listed: %v", sd.Type(), name, found)
+			}
+		}
+	}
+}
+
+func TestListVolumesPodPrefix(t *testing.T) {
+	root, err := ioutil.TempDir("", "list-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := &RawBlockStorage{rootPath: root, db: db}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the volume x of pod-a is kept as pod-a-x, as the volume a-x of pod
+	podId := testPodId(t)
+	for _, vol := range []struct{ pod, name string }{{podId, "vol1"}, {podId + "-a", "x"}} {
+		if err := ioutil.WriteFile(s.volumePath(vol.pod, vol.name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.UpdatePodVolume(vol.pod, vol.name, []byte(vol.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vols, err := s.ListVolumes(context.Background(), podId)
+	if err != nil {
+		t.Fatalf("list volumes failed: %v", err)
+	}
+	if len(vols) != 1 || vols[0].Name != "vol1" {
+		t.Fatalf("expected only the volume vol1 of pod %s, got %v", podId, vols)
+	}
+	records, err := loadVolumeRecords(db, podId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Name != "vol1" {
+		t.Fatalf("expected only the record of vol1 of pod %s, got %v", podId, records)
+	}
+}
+
+func TestRawBlockResizeVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	block := s.volumePath(podId, "vol1")
+	if err := ioutil.WriteFile(block, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ResizeVolume(context.Background(), podId, "vol1", 1024); err == nil {
+		t.Fatal("shrinking a volume should fail")
+	}
+	if err := s.ResizeVolume(context.Background(), podId, "vol1", 8192); err != nil {
+		t.Fatalf("resize volume failed: %v", err)
+	}
+	fi, err := os.Stat(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 8192 {
+		t.Fatalf("expected block of 8192 bytes, got %d", fi.Size())
+	}
+
+	o := &OverlayFsStorage{rootPath: root}
+	if err := o.ResizeVolume(context.Background(), podId, "vol1", 8192); !IsNotSupported(err) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestConcurrentDriverRegistration(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	factory := func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return &OverlayFsStorage{rootPath: root}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("test-driver-%d", i)
+		defer unregisterDriver(name)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			RegisterDriver(name, factory)
+		}()
+		go func() {
+			defer wg.Done()
+			// the driver may or may not be registered yet
+			StorageFactory(context.Background(), &dockertypes.Info{Driver: name}, nil, nil)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("test-driver-%d", i)
+		if _, err := StorageFactory(context.Background(), &dockertypes.Info{Driver: name}, nil, nil); err != nil {
+			t.Fatalf("driver %s is not registered: %v", name, err)
+		}
+	}
+}
+
+// layOutOverlayContainer lays out the container under root the way docker's
+// overlay graphdriver does, with a "shared" dir to mount it into.
+func layOutOverlayContainer(t *testing.T, root, mountId string) {
+	lowerId := "image"
+	for _, dir := range []string{
+		filepath.Join(root, lowerId, "root"),
+		filepath.Join(root, mountId, "upper"),
+		filepath.Join(root, mountId, "work"),
+		filepath.Join(root, "shared"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, mountId, "lower-id"), []byte(lowerId), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayFsConcurrentPrepareContainer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+
+	o := &OverlayFsStorage{rootPath: root}
+	sharedDir := filepath.Join(root, "shared")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	defer o.CleanupContainer(context.Background(), mountId, sharedDir)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("prepare container failed: %v", err)
+		}
+	}
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, m := range mounts {
+		if m.Mountpoint == mountPoint {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Fatalf("expected the container to be mounted once, got %d mounts", count)
+	}
+}
+
+func TestRawBlockConcurrentPrepareContainer(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "data", SizeBytes: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	opts := storage.ContainerOptions{PodID: podId, Volumes: []string{"data"}}
+
+	// the calls wait for the lock of the block
+	block := filepath.Join(root, "blocks", "container")
+	s.locks.Lock(block)
+	done := make(chan error, 2)
+	go func() {
+		_, err := s.PrepareContainer(ctx, "container", root, opts)
+		done <- err
+	}()
+	go func() {
+		done <- s.CleanupContainer(ctx, "container", root)
+	}()
+	select {
+	case err := <-done:
+		s.locks.Unlock(block)
+		t.Fatalf("the call should wait for the lock of the block, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.locks.Unlock(block)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.CleanupContainer(ctx, "container", root)
+
+	// the containers prepared and cleaned up in parallel hold the volume
+	// once per container prepared and not cleaned up yet
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.PrepareContainer(ctx, "container", root, opts); err != nil {
+				errs <- err
+				return
+			}
+			errs <- s.CleanupContainer(ctx, "container", root)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("prepare or cleanup failed: %v", err)
+		}
+	}
+	if n := s.volumeRefCounts()[volumeID(podId, "data")]; n != 0 {
+		t.Fatalf("the volume should not be held once the containers are cleaned up, held %d times", n)
+	}
+}
+
+func TestPrepareContainerTwice(t *testing.T) {
+	root, err := ioutil.TempDir("", "prepare-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	prepareTwice := func(t *testing.T, s Storage, sharedDir string) {
+		mountId := "container"
+		first, err := s.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("prepare container failed: %v", err)
+		}
+		defer s.CleanupContainer(context.Background(), mountId, sharedDir)
+		second, err := s.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("preparing the container again failed: %v", err)
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Fatalf("expected the same description, got %+v and %+v", first, second)
+		}
+	}
+
+	t.Run("rawblock", func(t *testing.T) {
+		prepareTwice(t, &RawBlockStorage{rootPath: root}, root)
+	})
+	t.Run("overlay", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("mounting overlay needs root")
+		}
+		layOutOverlayContainer(t, root, "container")
+		prepareTwice(t, &OverlayFsStorage{rootPath: root}, filepath.Join(root, "shared"))
+	})
+}
+
+func TestCleanupContainerTwice(t *testing.T) {
+	root, err := ioutil.TempDir("", "cleanup-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	cleanupTwice := func(t *testing.T, s Storage, sharedDir string) {
+		mountId := "container"
+		if _, err := s.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{}); err != nil {
+			t.Fatalf("prepare container failed: %v", err)
+		}
+		if err := s.CleanupContainer(context.Background(), mountId, sharedDir); err != nil {
+			t.Fatalf("cleanup container failed: %v", err)
+		}
+		if err := s.CleanupContainer(context.Background(), mountId, sharedDir); err != nil {
+			t.Fatalf("cleaning up the container again failed: %v", err)
+		}
+	}
+
+	t.Run("rawblock", func(t *testing.T) {
+		cleanupTwice(t, &RawBlockStorage{rootPath: root}, root)
+	})
+	t.Run("overlay", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("mounting overlay needs root")
+		}
+		layOutOverlayContainer(t, root, "container")
+		cleanupTwice(t, &OverlayFsStorage{rootPath: root}, filepath.Join(root, "shared"))
+	})
+}
+
+type recordedOperation struct {
+	driver, operation string
+	err               error
+}
+
+type fakeStorageMetrics struct {
+	records []recordedOperation
+}
+
+func (m *fakeStorageMetrics) RecordOperation(driver, operation string, durationNs int64, err error) {
+	m.records = append(m.records, recordedOperation{driver, operation, err})
+}
+
+func (m *fakeStorageMetrics) RecordPrepareConcurrency(driver string, running, queued int) {}
+
+func (m *fakeStorageMetrics) RecordInjectBandwidth(driver string, limitBytesPerSec, injectedBytes int64) {
+}
+
+func (m *fakeStorageMetrics) RecordCircuitState(driver, state string) {}
+
+func TestMetricedStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	metrics := &fakeStorageMetrics{}
+	s := NewMetricedStorage(&RawBlockStorage{rootPath: root}, metrics)
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveVolume(context.Background(), testPodId(t), []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if err := s.ResizeVolume(context.Background(), testPodId(t), "vol1", 4096); err == nil {
+		t.Fatal("resizing a missing volume should fail")
+	}
+
+	if len(metrics.records) != 2 {
+		t.Fatalf("expected 2 records, got %v", metrics.records)
+	}
+	if r := metrics.records[0]; r.driver != "rawblock" || r.operation != "RemoveVolume" || r.err != nil {
+		t.Fatalf("unexpected record %v", r)
+	}
+	if r := metrics.records[1]; r.operation != "ResizeVolume" || r.err == nil {
+		t.Fatalf("the error of ResizeVolume is not recorded: %v", r)
+	}
+}
+
+func TestStorageHealthCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "health-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+
+	if err := (&OverlayFsStorage{rootPath: root}).HealthCheck(ctx); err != nil {
+		t.Fatalf("overlay should be healthy: %v", err)
+	}
+	if err := (&OverlayFsStorage{rootPath: filepath.Join(root, "missing")}).HealthCheck(ctx); err == nil {
+		t.Fatal("overlay without root should not be healthy")
+	}
+	if entries, _ := ioutil.ReadDir(root); len(entries) != 0 {
+		t.Fatalf("the health check left %d files in the root", len(entries))
+	}
+
+	restore := fakeMkfs(t, root, "xfs")
+	if err := (&RawBlockStorage{rootPath: root, Filesystem: "xfs"}).HealthCheck(ctx); err != nil {
+		t.Fatalf("rawblock should be healthy: %v", err)
+	}
+	restore()
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", filepath.Join(root, "bin"))
+	defer os.Setenv("PATH", path)
+	if err := (&RawBlockStorage{rootPath: root, Filesystem: "ext4"}).HealthCheck(ctx); err == nil {
+		t.Fatal("rawblock without mkfs.ext4 should not be healthy")
+	}
+
+	RegisterDriver("test-unhealthy", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return &OverlayFsStorage{rootPath: filepath.Join(root, "missing")}, nil
+	})
+	defer unregisterDriver("test-unhealthy")
+	if _, err := StorageFactory(ctx, &dockertypes.Info{Driver: "test-unhealthy"}, nil, nil); err == nil {
+		t.Fatal("an unhealthy driver should be refused")
+	}
+}
+
+func TestRawBlockMissingTools(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+
+	// only the tools put in bin are found
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	defer os.Setenv("PATH", path)
+	for _, c := range []struct {
+		tools   []string
+		missing string
+		pkg     string
+	}{
+		{nil, "mkfs.xfs", "xfsprogs"},
+		{[]string{"mkfs.xfs"}, "xfs_growfs", "xfsprogs"},
+	} {
+		fakeTools(t, root, c.tools...)
+		s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+		var initErr *StorageInitError
+		if err := s.Init(ctx); !errors.As(err, &initErr) || initErr.Tool != c.missing || !strings.Contains(err.Error(), "install the "+c.pkg+" package") {
+			t.Fatalf("Init should name the missing %s, got %v", c.missing, err)
+		}
+		if err := s.HealthCheck(ctx); !errors.As(err, &initErr) || initErr.Tool != c.missing {
+			t.Fatalf("HealthCheck should name the missing %s, got %v", c.missing, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "volumes")); !os.IsNotExist(err) {
+		t.Fatalf("Init should fail before creating the volumes, got %v", err)
+	}
+
+	fakeTools(t, root, "xfs_growfs")
+	if err := (&RawBlockStorage{rootPath: root, Filesystem: "xfs"}).Init(ctx); err != nil {
+		t.Fatalf("Init should find the tools, got %v", err)
+	}
+	var initErr *StorageInitError
+	if err := (&RawBlockStorage{rootPath: root, Filesystem: "ext4"}).Init(ctx); !errors.As(err, &initErr) || initErr.Package != "e2fsprogs" {
+		t.Fatalf("Init should name the missing mkfs.ext4, got %v", err)
+	}
+}
+
+// fakeMkfs puts a mkfs.<fstype>, and the tool growing fstype, which do
+// nothing in front of PATH.
+func fakeMkfs(t *testing.T, dir, fstype string) func() {
+	grow := "xfs_growfs"
+	if fstype == "ext4" {
+		grow = "resize2fs"
+	}
+	return fakeTools(t, dir, "mkfs."+fstype, grow)
+}
+
+// fakeTools puts the tools, which do nothing, in front of PATH.
+func fakeTools(t *testing.T, dir string, tools ...string) func() {
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tool := range tools {
+		if err := ioutil.WriteFile(filepath.Join(bin, tool), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestRawBlockCreateVolumeNoSpace(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig func(string, *syscall.Statfs_t) error) { statfs = orig }(statfs)
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		if path != filepath.Join(root, "volumes") {
+			t.Fatalf("expected the free space of the volumes dir, got %s", path)
+		}
+		st.Bsize, st.Bavail = 4096, 512
+		return nil
+	}
+	if n, err := s.AvailableBytes(); err != nil || n != 2<<20 {
+		t.Fatalf("expected 2M available, got %d: %v", n, err)
+	}
+
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "large", SizeBytes: 4 << 20}
+	if err := s.CreateVolume(context.Background(), podId, spec); !errors.Is(err, ErrInsufficientStorage) || !IsNoSpace(err) {
+		t.Fatalf("a volume larger than the free space should be refused, got %v", err)
+	}
+	if _, err := os.Stat(s.volumePath(podId, "large")); !os.IsNotExist(err) {
+		t.Fatalf("the refused volume should leave nothing behind, got %v", err)
+	}
+	spec = &apitypes.UserVolume{Name: "small", SizeBytes: 1 << 20}
+	if err := s.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("a volume within the free space should be created, got %v", err)
+	}
+}
+
+func TestRawBlockVolumeSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	config, err := NewStorageConfig(map[string]string{"rawblock.volumesize": "1M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := RawBlockFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*RawBlockStorage)
+	s.rootPath = root
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	for _, tc := range []struct {
+		name string
+		size uint64
+		want int64
+	}{
+		{"explicit", 3 * 1024 * 1024, 3 * 1024 * 1024},
+		{"default", 0, 1024 * 1024},
+	} {
+		spec := &apitypes.UserVolume{Name: tc.name, SizeBytes: tc.size}
+		if err := s.CreateVolume(context.Background(), podId, spec); err != nil {
+			t.Fatalf("create volume %s failed: %v", tc.name, err)
+		}
+		fi, err := os.Stat(spec.Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != tc.want {
+			t.Fatalf("volume %s: expected %d bytes, got %d", tc.name, tc.want, fi.Size())
+		}
+	}
+
+	if _, err := NewStorageConfig(map[string]string{"volumesize": "1M"}); err == nil {
+		t.Fatal("an option without driver should be refused")
+	}
+	config, _ = NewStorageConfig(map[string]string{"rawblock.volumesize": "big"})
+	if _, err := RawBlockFactory(nil, nil, config); err == nil {
+		t.Fatal("an invalid volume size should be refused")
+	}
+}
+
+func TestRawBlockFilesystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "ext4")()
+
+	if err := (&RawBlockStorage{rootPath: root, Filesystem: "btrfs"}).Init(context.Background()); err == nil {
+		t.Fatal("an unsupported filesystem should be refused")
+	}
+
+	config, err := NewStorageConfig(map[string]string{"rawblock.fs": "ext4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysinfo := &dockertypes.Info{DriverStatus: [][2]string{{"Block Filesystem", "xfs"}}}
+	sd, err := RawBlockFactory(sysinfo, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sd.(*RawBlockStorage)
+	s.rootPath = root
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 1024 * 1024}
+	if err := s.CreateVolume(context.Background(), testPodId(t), spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	if spec.Fstype != "ext4" {
+		t.Fatalf("expected an ext4 volume, got %s", spec.Fstype)
+	}
+	vol, err := s.PrepareContainer(context.Background(), "container", root, storage.ContainerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Fstype != "ext4" {
+		t.Fatalf("expected an ext4 container block, got %s", vol.Fstype)
+	}
+}
+
+func TestDMFactoryPoolName(t *testing.T) {
+	config, err := NewStorageConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysinfo := &dockertypes.Info{DriverStatus: [][2]string{{"Pool Name", "docker-8:1-1234-pool"}, {"Backing Filesystem", "xfs"}}}
+	sd, err := DMFactory(sysinfo, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dms := sd.(*DevMapperStorage); dms.DevPrefix != "docker-8:1-1234" || dms.FsType != "xfs" {
+		t.Fatalf("unexpected prefix %q and filesystem %q", dms.DevPrefix, dms.FsType)
+	}
+
+	for _, pool := range []string{"", "docker-thinpool"} {
+		sysinfo = &dockertypes.Info{DriverStatus: [][2]string{{"Pool Name", pool}}}
+		if _, err := DMFactory(sysinfo, nil, config); err == nil || !strings.Contains(err.Error(), "cannot get the devicemapper pool") {
+			t.Fatalf("the pool %q should be refused, got %v", pool, err)
+		}
+	}
+}
+
+func TestVolumeExists(t *testing.T) {
+	root, err := ioutil.TempDir("", "exists-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.volumePath(podId, "vol1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sd := range []Storage{o, s} {
+		if exists, err := sd.VolumeExists(context.Background(), podId, "vol1"); err != nil || !exists {
+			t.Fatalf("%s: expected vol1 to exist, got %v, %v", sd.Type(), exists, err)
+		}
+		if exists, err := sd.VolumeExists(context.Background(), podId, "vol2"); err != nil || exists {
+			t.Fatalf("%s: expected vol2 to be missing, got %v, %v", sd.Type(), exists, err)
+		}
+	}
+
+	// a file in place of a parent directory makes the volume path inaccessible
+	// even to root
+	notDir := testPodId(t)
+	if err := ioutil.WriteFile(storage.VFSVolumePath(o.vfsVolumeRoot(), notDir, ""), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(storage.VFSVolumePath(o.vfsVolumeRoot(), notDir, ""))
+	if _, err := o.VolumeExists(context.Background(), notDir, "vol1"); err == nil {
+		t.Fatal("overlay: expected an error for an inaccessible volume")
+	}
+	s.rootPath = filepath.Join(root, "rawblock-file")
+	if err := ioutil.WriteFile(s.rootPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.VolumeExists(context.Background(), podId, "vol1"); err == nil {
+		t.Fatal("rawblock: expected an error for an inaccessible volume")
+	}
+}
+
+// testSnapshotRollback snapshots the volume, changes the file and checks it
+// is restored by the rollback.
+func testSnapshotRollback(t *testing.T, sd Storage, podId, volName, file string) {
+	if err := ioutil.WriteFile(file, []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.SnapshotVolume(context.Background(), podId, volName, "snap1"); err != nil {
+		t.Fatalf("%s: snapshot volume failed: %v", sd.Type(), err)
+	}
+	if err := sd.SnapshotVolume(context.Background(), podId, volName, "snap1"); err == nil {
+		t.Fatalf("%s: an existing snapshot should not be overwritten", sd.Type())
+	}
+	if err := sd.SnapshotVolume(context.Background(), podId, volName, "../snap"); err == nil {
+		t.Fatalf("%s: an invalid snapshot name should be refused", sd.Type())
+	}
+	if err := ioutil.WriteFile(file, []byte("after"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sd.RollbackVolume(context.Background(), podId, volName, "snap2"); err == nil {
+		t.Fatalf("%s: rolling back to a missing snapshot should fail", sd.Type())
+	}
+	if err := sd.RollbackVolume(context.Background(), podId, volName, "snap1"); err != nil {
+		t.Fatalf("%s: rollback volume failed: %v", sd.Type(), err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "before" {
+		t.Fatalf("%s: expected the content of the snapshot, got %q", sd.Type(), data)
+	}
+	vols, err := sd.ListVolumes(context.Background(), podId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vols) != 1 || vols[0].Name != volName {
+		t.Fatalf("%s: snapshots should not be listed as volumes, got %v", sd.Type(), vols)
+	}
+}
+
+func TestSnapshotVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "snapshot-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+	testSnapshotRollback(t, o, podId, "vol1", filepath.Join(spec.Source, "data"))
+
+	if err := o.RemoveVolume(context.Background(), podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(spec.Source)); !os.IsNotExist(err) {
+		t.Fatalf("the snapshots should be removed with the volume: %v", err)
+	}
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testSnapshotRollback(t, s, podId, "vol1", s.volumePath(podId, "vol1"))
+}
+
+func TestCloneVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "clone-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	o := &OverlayFsStorage{rootPath: root}
+	podId, clonePodId := testPodId(t), testPodId(t)+"-clone"
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(context.Background(), podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+	defer os.RemoveAll(filepath.Dir(storage.VFSVolumePath(o.vfsVolumeRoot(), clonePodId, "vol1")))
+	if err := ioutil.WriteFile(filepath.Join(spec.Source, "data"), []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.CloneVolume(context.Background(), podId, "vol1", clonePodId, "vol1"); err != nil {
+		t.Fatalf("clone volume failed: %v", err)
+	}
+	if err := o.CloneVolume(context.Background(), podId, "vol1", clonePodId, "vol1"); err == nil {
+		t.Fatal("cloning over an existing volume should fail")
+	}
+	if err := o.CloneVolume(context.Background(), podId, "vol2", clonePodId, "vol2"); err == nil {
+		t.Fatal("cloning a missing volume should fail")
+	}
+	clone := filepath.Join(storage.VFSVolumePath(o.vfsVolumeRoot(), clonePodId, "vol1"), "data")
+	if err := ioutil.WriteFile(clone, []byte("clone"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(spec.Source, "data")); string(data) != "source" {
+		t.Fatalf("the source changed with the clone: %q", data)
+	}
+
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.volumePath(podId, "vol1"), []byte("source"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloneVolume(context.Background(), podId, "vol1", podId, "vol1"); err == nil {
+		t.Fatal("cloning a volume onto itself should fail")
+	}
+	if err := s.CloneVolume(context.Background(), podId, "vol1", clonePodId, "vol1"); err != nil {
+		t.Fatalf("clone volume failed: %v", err)
+	}
+	if err := s.CloneVolume(context.Background(), podId, "vol2", clonePodId, "vol2"); err == nil {
+		t.Fatal("cloning a missing volume should fail")
+	}
+	if err := ioutil.WriteFile(s.volumePath(clonePodId, "vol1"), []byte("clone"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(s.volumePath(podId, "vol1")); string(data) != "source" {
+		t.Fatalf("the source changed with the clone: %q", data)
+	}
+}
+
+func TestRawBlockGarbageCollect(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+	dir := filepath.Join(root, "volumes")
+	for _, name := range []string{"pod-active-vol1", "pod-gone-vol1", "pod-gone-vol2", "pod-busy-vol1"} {
+		if err := os.MkdirAll(filepath.Join(dir, ".snapshots", name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, 4096), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(filepath.Join(dir, "pod-busy-vol1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	collected, err := s.GarbageCollect(context.Background(), []string{"pod-active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(collected, ",") != "pod-gone-vol1,pod-gone-vol2" {
+		t.Fatalf("unexpected collected volumes %v", collected)
+	}
+	for name, exists := range map[string]bool{
+		"pod-active-vol1":            true,
+		"pod-busy-vol1":              true,
+		"pod-gone-vol1":              false,
+		".snapshots/pod-gone-vol2":   false,
+		".snapshots/pod-active-vol1": true,
+	} {
+		if ok, _ := pathExists(filepath.Join(dir, name)); ok != exists {
+			t.Fatalf("expected %s to exist: %v", name, exists)
+		}
+	}
+}
+
+func TestRawBlockCreateVolumeRecordFailure(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s := &RawBlockStorage{db: db, rootPath: filepath.Join(root, "rawblock")}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the record of the volume can not be saved in a closed db
+	db.Close()
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "vol1", SizeBytes: 1 << 20}); err == nil {
+		t.Fatal("the volume should not be created without its record")
+	}
+	block := s.volumePath(podId, "vol1")
+	for _, path := range []string{block, volumeMetaPath(block)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should be removed with the volume, got %v", path, err)
+		}
+	}
+}
+
+func TestCollectVFSVolumes(t *testing.T) {
+	root, err := ioutil.TempDir("", "vfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, vol := range []string{"pod-active/vol1", "pod-gone/vol1", "pod-gone/vol2", "pod-gone/.snapshots/vol1/snap1"} {
+		if err := os.MkdirAll(filepath.Join(root, vol), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collected, err := collectVFSVolumes(root, []string{"pod-active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(collected, ",") != "pod-gone-vol1,pod-gone-vol2" {
+		t.Fatalf("unexpected collected volumes %v", collected)
+	}
+	if ok, _ := pathExists(filepath.Join(root, "pod-gone")); ok {
+		t.Fatal("the directory of the orphaned volumes is not removed")
+	}
+	if ok, _ := pathExists(filepath.Join(root, "pod-active", "vol1")); !ok {
+		t.Fatal("the volume of an active pod is removed")
+	}
+}
+
+func TestRetryMount(t *testing.T) {
+	calls := 0
+	err := retryMount(func() error {
+		calls++
+		if calls <= 2 {
+			return fmt.Errorf("error creating overlay mount: %w", syscall.EBUSY)
+		}
+		return nil
+	}, 3, time.Millisecond)
+	if err != nil || calls != 3 {
+		t.Fatalf("expected the third attempt to succeed, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = retryMount(func() error {
+		calls++
+		return syscall.EAGAIN
+	}, 2, time.Millisecond)
+	if err != syscall.EAGAIN || calls != 2 {
+		t.Fatalf("expected EAGAIN after 2 calls, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = retryMount(func() error {
+		calls++
+		return syscall.EINVAL
+	}, 3, time.Millisecond)
+	if err != syscall.EINVAL || calls != 1 {
+		t.Fatalf("EINVAL should not be retried, got %v after %d calls", err, calls)
+	}
+}
+
+func TestEnsureDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "ensure-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	// left by a previous installation
+	volumes := filepath.Join(root, "volumes")
+	if err := os.Mkdir(volumes, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := &RawBlockStorage{rootPath: root}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(volumes); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("expected the permissions of the volumes fixed to 0700, got %v, %v", fi.Mode(), err)
+	}
+
+	// the permissions are not masked by the umask
+	old := syscall.Umask(077)
+	err = ensureDir(filepath.Join(root, "a", "b"), 0755)
+	syscall.Umask(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "a", "b")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Fatalf("expected a new directory with 0755, got %v, %v", fi.Mode(), err)
+	}
+	if err := ensureDir(filepath.Join(root, "a", "b"), 0711); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(filepath.Join(root, "a", "b")); fi.Mode().Perm() != 0711 {
+		t.Fatalf("expected the permissions fixed to 0711, got %v", fi.Mode())
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureDir(filepath.Join(root, "file"), 0700); err == nil {
+		t.Fatal("a file in place of the directory should fail")
+	}
+}
+
+func TestOverlayFsMountOptions(t *testing.T) {
+	config, err := NewStorageConfig(map[string]string{"overlay.mountattempts": "5", "overlay.mountretrydelay": "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := OverlayFsFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := sd.(*OverlayFsStorage); o.MountAttempts != 5 || o.MountRetryDelay != 10*time.Millisecond {
+		t.Fatalf("unexpected mount retries %d, %v", o.MountAttempts, o.MountRetryDelay)
+	}
+	if !sd.(*OverlayFsStorage).UseLazyUnmount {
+		t.Fatal("the lazy unmount should be used by default")
+	}
+	config, _ = NewStorageConfig(map[string]string{"overlay.lazyunmount": "false"})
+	if sd, err = OverlayFsFactory(nil, nil, config); err != nil || sd.(*OverlayFsStorage).UseLazyUnmount {
+		t.Fatalf("the lazy unmount should be disabled, got %v", err)
+	}
+
+	config, _ = NewStorageConfig(map[string]string{"overlay.mountoptions": "noatime, nodiratime"})
+	if sd, err = OverlayFsFactory(nil, nil, config); err != nil || !reflect.DeepEqual(sd.(*OverlayFsStorage).MountOptions, []string{"noatime", "nodiratime"}) {
+		t.Fatalf("unexpected mount options %v, %v", sd, err)
+	}
+
+	for _, opts := range []map[string]string{{"overlay.mountattempts": "0"}, {"overlay.mountretrydelay": "soon"}, {"overlay.lazyunmount": "maybe"}, {"overlay.mountoptions": "noatime,suid"}} {
+		config, _ := NewStorageConfig(opts)
+		if _, err := OverlayFsFactory(nil, nil, config); err == nil {
+			t.Fatalf("invalid options %v should be refused", opts)
+		}
+	}
+}
+
+func TestOverlayFsMountFlags(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+	o := &OverlayFsStorage{rootPath: root, MountOptions: []string{"noatime", "nodev"}}
+	sharedDir := filepath.Join(root, "shared")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	if _, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	defer syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != mountPoint {
+			continue
+		}
+		opts := "," + fields[3] + ","
+		if !strings.Contains(opts, ",noatime,") || !strings.Contains(opts, ",nodev,") {
+			t.Fatalf("expected the rootfs mounted with noatime and nodev, got %s", fields[3])
+		}
+		return
+	}
+	t.Fatalf("%s is not mounted", mountPoint)
+}
+
+func TestOverlayFsReadOnly(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+	o := &OverlayFsStorage{rootPath: root}
+	sharedDir := filepath.Join(root, "shared")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	vol, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	defer syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+	if !vol.ReadOnly {
+		t.Fatal("the volume should be described read-only")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(mountPoint, "file"), []byte("data"), 0644)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("writing to the read-only rootfs should fail with EROFS, got %v", err)
+	}
+	err = o.InjectFile(context.Background(), strings.NewReader("data"), mountId, "/file", sharedDir, 0644, 0, 0, nil)
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("injecting into the read-only container should fail, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, mountId, "upper", "file")); !os.IsNotExist(err) {
+		t.Fatalf("nothing should be written to the upper dir, got %v", err)
+	}
+}
+
+func TestOverlayFsLazyUnmount(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+	o := &OverlayFsStorage{rootPath: root}
+	sharedDir := filepath.Join(root, "shared")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	if _, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	defer syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+
+	// a stray process keeps a file of the rootfs open
+	f, err := os.Create(filepath.Join(mountPoint, "busy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.CleanupContainer(context.Background(), mountId, sharedDir); !IsDeviceBusy(err) {
+		t.Fatalf("expected the rootfs busy without lazy unmount, got %v", err)
+	}
+	o.UseLazyUnmount = true
+	if err := o.CleanupContainer(context.Background(), mountId, sharedDir); err != nil {
+		t.Fatalf("the busy rootfs should be unmounted lazily, got %v", err)
+	}
+	if mounted, _ := overlayMounted(mountPoint); mounted {
+		t.Fatal("the rootfs should be detached")
+	}
+	if waitReleased(uint64(st.Dev), time.Millisecond, 10*time.Millisecond) {
+		t.Fatal("the rootfs should be held open until the file is closed")
+	}
+	f.Close()
+	if !waitReleased(uint64(st.Dev), time.Millisecond, time.Second) {
+		t.Fatal("the rootfs should be released once the file is closed")
+	}
+}
+
+func TestOverlayFsWorkDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	workDir := filepath.Join(root, "work")
+
+	config, err := NewStorageConfig(map[string]string{"overlay.workdir": workDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Root = root
+	sd, err := OverlayFsFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := sd.(*OverlayFsStorage)
+	if o.WorkDir != workDir {
+		t.Fatalf("unexpected work dir %s", o.WorkDir)
+	}
+	if err := o.Init(context.Background()); err != nil {
+		t.Fatalf("a work dir on the filesystem of the driver should be accepted, got %v", err)
+	}
+	config, _ = NewStorageConfig(map[string]string{"overlay.workdir": "work"})
+	if _, err := OverlayFsFactory(nil, nil, config); err == nil {
+		t.Fatal("a relative work dir should be refused")
+	}
+
+	// /dev/shm is a tmpfs on most hosts
+	var shm, tmp syscall.Stat_t
+	if syscall.Stat("/dev/shm", &shm) == nil && syscall.Stat(root, &tmp) == nil && shm.Dev != tmp.Dev {
+		other, err := ioutil.TempDir("/dev/shm", "overlay-work")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(other)
+		if err := (&OverlayFsStorage{rootPath: root, WorkDir: other}).Init(context.Background()); err == nil {
+			t.Fatal("a work dir on another filesystem should be refused")
+		}
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	mountId := "container"
+	layOutOverlayContainer(t, o.RootPath(), mountId)
+	sharedDir := filepath.Join(o.RootPath(), "shared")
+	if _, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == filepath.Join(sharedDir, mountId, "rootfs") && !strings.Contains(m.VfsOpts, "workdir="+filepath.Join(workDir, mountId)) {
+			t.Fatalf("the container should be mounted with the configured work dir, got %s", m.VfsOpts)
+		}
+	}
+	if err := o.CleanupContainer(context.Background(), mountId, sharedDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, mountId)); !os.IsNotExist(err) {
+		t.Fatalf("the work dir of the container should be removed, got %v", err)
+	}
+}
+
+func TestOverlayFsLowerLayers(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId := "container"
+	layOutOverlayContainer(t, root, mountId)
+	// the base layer has a root dir, the layers above it an upper dir
+	var layers []string
+	for i := 5; i > 0; i-- {
+		layer := fmt.Sprintf("layer%d", i)
+		dir := filepath.Join(root, layer, "upper")
+		if i == 1 {
+			dir = filepath.Join(root, layer, "root")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, layer), []byte(layer), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "top"), []byte(layer), 0644); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, layer)
+	}
+
+	o := &OverlayFsStorage{rootPath: root}
+	sharedDir := filepath.Join(root, "shared")
+	mountPoint := filepath.Join(sharedDir, mountId, "rootfs")
+	if _, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{LowerLayers: layers}); err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	defer syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overlays []*mount.Info
+	for _, m := range mounts {
+		if strings.HasPrefix(m.Mountpoint, root) {
+			overlays = append(overlays, m)
+		}
+	}
+	if len(overlays) != 1 {
+		t.Fatalf("expected a single overlay mount, got %d", len(overlays))
+	}
+	if lower := strings.Split(strings.SplitN(overlays[0].VfsOpts, "lowerdir=", 2)[1], ","); len(strings.Split(lower[0], ":")) != 5 {
+		t.Fatalf("expected 5 lower dirs, got %s", lower[0])
+	}
+	for _, layer := range layers {
+		if _, err := os.Stat(filepath.Join(mountPoint, layer)); err != nil {
+			t.Fatalf("the content of %s should be visible: %v", layer, err)
+		}
+	}
+	if top, _ := ioutil.ReadFile(filepath.Join(mountPoint, "top")); string(top) != "layer5" {
+		t.Fatalf("the first layer should be the top-most, got %q", top)
+	}
+	if err := o.CleanupContainer(context.Background(), mountId, sharedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.PrepareContainer(context.Background(), mountId, sharedDir, storage.ContainerOptions{LowerLayers: []string{"missing"}}); !IsNotFound(err) {
+		t.Fatalf("expected a missing layer not found, got %v", err)
+	}
+}
+
+func TestStorageRoot(t *testing.T) {
+	config := &StorageConfig{Root: "/data/hyper"}
+	for name, factory := range map[string]DriverFactory{"overlay": OverlayFsFactory, "rawblock": RawBlockFactory} {
+		sd, err := factory(nil, nil, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.RootPath() != filepath.Join("/data/hyper", name) {
+			t.Fatalf("unexpected root %s of driver %s", sd.RootPath(), name)
+		}
+		if sd, _ := factory(nil, nil, nil); sd.RootPath() != filepath.Join(utils.HYPER_ROOT, name) {
+			t.Fatalf("driver %s should default to the hyperd root, got %s", name, sd.RootPath())
+		}
+	}
+}
+
+func TestRawBlockSELinuxLabel(t *testing.T) {
+	if selinux.SelinuxEnabled() {
+		t.Skip("the label is only skipped on hosts without selinux")
+	}
+	root, err := ioutil.TempDir("", "selinux-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &RawBlockStorage{rootPath: root}
+	opts := storage.ContainerOptions{SELinuxLabel: "system_u:object_r:svirt_image_t:s0:c1,c2"}
+	vol, err := s.PrepareContainer(context.Background(), "container", root, opts)
+	if err != nil {
+		t.Fatalf("the label should be skipped when selinux is disabled, got %v", err)
+	}
+	if vol.Source != filepath.Join(root, "blocks", "container") {
+		t.Fatalf("unexpected container block %s", vol.Source)
+	}
+}
+
+// failingReader returns data, then fails as a copy interrupted halfway.
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, fmt.Errorf("interrupted copy")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestOverlayFsInjectFileRollback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting overlay needs root")
+	}
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mountId, lowerId := "container", "image"
+	for _, dir := range []string{
+		filepath.Join(root, lowerId, "root", "etc"),
+		filepath.Join(root, mountId, "upper", "etc"),
+		filepath.Join(root, mountId, "work"),
+		filepath.Join(root, "shared"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, mountId, "lower-id"), []byte(lowerId), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upper := filepath.Join(root, mountId, "upper", "etc", "hosts")
+	if err := ioutil.WriteFile(upper, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &OverlayFsStorage{rootPath: root}
+	sharedDir := filepath.Join(root, "shared")
+	src := &failingReader{data: "10.0.0.1 partial"}
+	if err := o.InjectFile(context.Background(), src, mountId, "/etc/hosts", sharedDir, 0644, 0, 0, nil); err == nil {
+		t.Fatal("the interrupted injection should fail")
+	}
+	data, err := ioutil.ReadFile(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "127.0.0.1 localhost\n" {
+		t.Fatalf("the file should be restored, got %q", data)
+	}
+
+	src = &failingReader{data: "partial"}
+	if err := o.InjectFile(context.Background(), src, mountId, "/etc/resolv.conf", sharedDir, 0644, 0, 0, nil); err == nil {
+		t.Fatal("the interrupted injection should fail")
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(upper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("the partial file and the backups should be removed, got %d files", len(entries))
+	}
+
+	if err := o.InjectFile(context.Background(), strings.NewReader("nameserver 10.0.0.1\n"), mountId, "/etc/resolv.conf", sharedDir, 0644, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(filepath.Dir(upper), "resolv.conf")); string(data) != "nameserver 10.0.0.1\n" {
+		t.Fatalf("unexpected injected file %q", data)
+	}
+}
+
+// fakeRBD maps the images as files of HELPER_RBD_DIR, laid out as udev does.
+func fakeRBD(args []string) error {
+	pool, last := "rbd", args[len(args)-1]
+	for i, arg := range args[:len(args)-1] {
+		if arg == "--pool" {
+			pool = args[i+1]
+		}
+	}
+	switch args[0] {
+	case "create", "rm", "ls":
+		return nil
+	case "map":
+		dir := filepath.Join(os.Getenv("HELPER_RBD_DIR"), pool)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, last), nil, 0600)
+	case "unmap":
+		return os.Remove(last)
+	}
+	return fmt.Errorf("unknown command rbd %v", args)
+}
+
+// fakeLosetup makes the loop devices as block devices of HELPER_LOOP_DIR,
+// with the backing file of loopN kept in loopN.backing.
+func fakeLosetup(args []string) error {
+	dir := os.Getenv("HELPER_LOOP_DIR")
+	last := args[len(args)-1]
+	switch args[0] {
+	case "-j":
+		backings, _ := filepath.Glob(filepath.Join(dir, "*.backing"))
+		for _, backing := range backings {
+			if data, _ := ioutil.ReadFile(backing); string(data) == last {
+				device := strings.TrimSuffix(backing, ".backing")
+				fmt.Printf("%s: [2049]:42 (%s)\n", device, last)
+			}
+		}
+		return nil
+	case "--find":
+		backings, _ := filepath.Glob(filepath.Join(dir, "*.backing"))
+		n := len(backings)
+		device := filepath.Join(dir, fmt.Sprintf("loop%d", n))
+		if err := syscall.Mknod(device, syscall.S_IFBLK|0600, 7<<8|n); err != nil {
+			return err
+		}
+		fmt.Println(device)
+		return ioutil.WriteFile(device+".backing", []byte(last), 0600)
+	case "-d":
+		os.Remove(last + ".backing")
+		return os.Remove(last)
+	}
+	return fmt.Errorf("unknown command losetup %v", args)
+}
+
+// fakeGluster keeps the volumes of the cluster as files of HELPER_GLUSTER_DIR.
+func fakeGluster(args []string) error {
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		args = args[1:]
+	}
+	if len(args) < 3 || args[0] != "volume" {
+		return fmt.Errorf("unknown command gluster %v", args)
+	}
+	volume := filepath.Join(os.Getenv("HELPER_GLUSTER_DIR"), args[2])
+	switch args[1] {
+	case "info", "start":
+		if _, err := os.Stat(volume); err != nil {
+			return fmt.Errorf("Volume %s does not exist", args[2])
+		}
+		return nil
+	case "create":
+		return ioutil.WriteFile(volume, []byte(args[3]), 0600)
+	}
+	return fmt.Errorf("unknown command gluster %v", args)
+}
+
+// fakeLVM keeps the logical volumes of the volume group HELPER_LVM_VG as files
+// of HELPER_LVM_DIR/lvs, and their devices in HELPER_LVM_DIR/mapper while
+// they are active.
+func fakeLVM(cmd string, args []string) error {
+	dir, vg := os.Getenv("HELPER_LVM_DIR"), os.Getenv("HELPER_LVM_VG")
+	last := args[len(args)-1]
+	lvFile := func(path string) (string, string) {
+		fields := strings.SplitN(path, "/", 2)
+		if len(fields) != 2 || fields[0] != vg {
+			return "", ""
+		}
+		return filepath.Join(dir, "lvs", fields[1]), filepath.Join(dir, "mapper", lvmMapperName(vg, fields[1]))
+	}
+	switch cmd {
+	case "vgdisplay":
+		if last != vg {
+			return fmt.Errorf("Volume group %q not found", last)
+		}
+		return nil
+	case "lvdisplay":
+		if lv, _ := lvFile(last); lv == "" || !fileExists(lv) {
+			return fmt.Errorf("Failed to find logical volume %q", last)
+		}
+		return nil
+	case "lvcreate":
+		var name string
+		for i, arg := range args {
+			if arg == "-n" {
+				name = args[i+1]
+			}
+		}
+		if strings.Contains(last, "/") {
+			if pool, _ := lvFile(last); pool == "" || !fileExists(pool) {
+				return fmt.Errorf("Thin pool %s not found", last)
+			}
+		} else if last != vg {
+			return fmt.Errorf("Volume group %q not found", last)
+		}
+		lv, device := lvFile(vg + "/" + name)
+		if err := ioutil.WriteFile(lv, nil, 0600); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(device, nil, 0600)
+	case "lvchange":
+		lv, device := lvFile(last)
+		if lv == "" || !fileExists(lv) {
+			return fmt.Errorf("Failed to find logical volume %q", last)
+		}
+		if args[0] == "-an" {
+			return os.Remove(device)
+		}
+		return ioutil.WriteFile(device, nil, 0600)
+	case "lvremove":
+		lv, device := lvFile(last)
+		os.Remove(device)
+		return os.Remove(lv)
+	}
+	return fmt.Errorf("unknown command %s %v", cmd, args)
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+func TestInjectFileACLs(t *testing.T) {
+	root, err := ioutil.TempDir("", "acl-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// user::rw- user:1000:r-- group::r-- mask::r-- other::r--
+	acl := []byte{2, 0, 0, 0}
+	for _, e := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{{0x01, 6, 0xffffffff}, {0x02, 4, 1000}, {0x04, 4, 0xffffffff}, {0x10, 4, 0xffffffff}, {0x20, 4, 0xffffffff}} {
+		acl = append(acl, byte(e.tag), byte(e.tag>>8), byte(e.perm), byte(e.perm>>8),
+			byte(e.id), byte(e.id>>8), byte(e.id>>16), byte(e.id>>24))
+	}
+	src := filepath.Join(root, "config")
+	if err := ioutil.WriteFile(src, []byte("key=value\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(src, "system.posix_acl_access", acl, 0); err != nil {
+		t.Skipf("the filesystem does not support ACLs: %v", err)
+	}
+	xattrs, err := storage.PosixACLs(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(xattrs) != 1 || !reflect.DeepEqual(xattrs["system.posix_acl_access"], acl) {
+		t.Fatalf("expected the access ACL of the file, got %v", xattrs)
+	}
+	if none, err := storage.PosixACLs(filepath.Join(root, "acl-storage")); err == nil || none != nil {
+		t.Fatalf("expected no ACLs of a missing file, got %v, %v", none, err)
+	}
+
+	s := &NFSStorage{rootPath: root}
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := s.InjectFile(context.Background(), f, "c1", "/etc/config", "", 0644, 0, 0, xattrs); err != nil {
+		t.Fatalf("inject file failed: %v", err)
+	}
+	target := filepath.Join(s.shareDir(), "c1", "rootfs", "etc", "config")
+	value := make([]byte, 64)
+	n, err := syscall.Getxattr(target, "system.posix_acl_access", value)
+	if err != nil {
+		t.Fatalf("the ACL should be kept: %v", err)
+	}
+	if !reflect.DeepEqual(value[:n], acl) {
+		t.Fatalf("expected the ACL %v, got %v", acl, value[:n])
+	}
+}
+
+// corruptingReader appends to file once src is read, as a faulty disk would
+// write more than it was given.
+type corruptingReader struct {
+	src  io.Reader
+	file string
+}
+
+func (r *corruptingReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	if err == io.EOF {
+		if f, ferr := os.OpenFile(r.file, os.O_WRONLY|os.O_APPEND, 0); ferr == nil {
+			f.WriteString("garbage")
+			f.Close()
+		}
+	}
+	return n, err
+}
+
+func TestInjectFileReplacesLongerFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "inject-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &NFSStorage{rootPath: root}
+	target := filepath.Join(s.shareDir(), "c1", "rootfs", "etc", "config")
+	if err := s.InjectFile(ctx, strings.NewReader("a much longer previous content\n"), "c1", "/etc/config", "", 0644, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the shorter content replaces the previous one entirely
+	if err := s.InjectFile(ctx, strings.NewReader("key=value\n"), "c1", "/etc/config", "", 0644, 0, 0, nil); err != nil {
+		t.Fatalf("inject file failed: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "key=value\n" {
+		t.Fatalf("unexpected content %q", data)
+	}
+}
+
+func TestInjectFileChecksum(t *testing.T) {
+	root, err := ioutil.TempDir("", "checksum-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &NFSStorage{rootPath: root}
+	s.setVerifyChecksum(true)
+	target := filepath.Join(s.shareDir(), "c1", "rootfs", "etc", "config")
+	if err := s.InjectFile(ctx, strings.NewReader("key=value\n"), "c1", "/etc/config", "", 0644, 0, 0, nil); err != nil {
+		t.Fatalf("inject file failed: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "key=value\n" {
+		t.Fatalf("unexpected content %q", data)
+	}
+
+	src := &corruptingReader{src: strings.NewReader("key=other\n"), file: target}
+	if err := s.InjectFile(ctx, src, "c1", "/etc/config", "", 0644, 0, 0, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatal("the corrupted file should have been removed")
+	}
+
+	s.setVerifyChecksum(false)
+	src = &corruptingReader{src: strings.NewReader("key=other\n"), file: target}
+	if err := s.InjectFile(ctx, src, "c1", "/etc/config", "", 0644, 0, 0, nil); err != nil {
+		t.Fatalf("inject file without verification failed: %v", err)
+	}
+}
+
+// tracedStorage marks the drivers wrapped by the StorageTracer of the tests.
+type tracedStorage struct {
+	Storage
+	tracer trace.Tracer
+}
+
+func TestStorageTracer(t *testing.T) {
+	RegisterDriver("test-traced", func(*dockertypes.Info, *daemondb.DaemonDB, *StorageConfig) (Storage, error) {
+		return NewMockStorage(), nil
+	})
+	defer unregisterDriver("test-traced")
+	info := &dockertypes.Info{Driver: "test-traced"}
+
+	// no tracer registered, the driver is not traced
+	tracer := trace.NewNoopTracerProvider().Tracer("")
+	s, err := StorageFactory(context.Background(), info, nil, &StorageConfig{Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*tracedStorage); ok {
+		t.Fatal("the driver should not be traced with no tracer registered")
+	}
+
+	RegisterStorageTracer(func(s Storage, tracer trace.Tracer) Storage {
+		return &tracedStorage{Storage: s, tracer: tracer}
+	})
+	defer RegisterStorageTracer(nil)
+	if s, err = StorageFactory(context.Background(), info, nil, &StorageConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*tracedStorage); ok {
+		t.Fatal("the driver should not be traced with no Tracer configured")
+	}
+	if s, err = StorageFactory(context.Background(), info, nil, &StorageConfig{Tracer: tracer}); err != nil {
+		t.Fatal(err)
+	}
+	traced, ok := s.(*tracedStorage)
+	if !ok || traced.tracer != tracer {
+		t.Fatalf("the driver should be traced with the configured Tracer, got %T", s)
+	}
+}
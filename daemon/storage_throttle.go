@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
+)
+
+// The blkio limits only apply to block devices, so a throttled rawblock
+// volume is attached to a loop device, or throttled on its dm-crypt device
+// when encrypted. The hypervisor opens the loop device through the link
+// <root>/devices/<podId>-<name>, which stays valid when the device is
+// attached again. The limits are kept in <root>/volumes/.throttle, to be
+// applied again by Init after a reboot of the host.
+
+func throttleOptions(t *apitypes.VolumeThrottle) rawblock.ThrottleOptions {
+	return rawblock.ThrottleOptions{
+		ReadBPS:   t.GetReadBPS(),
+		WriteBPS:  t.GetWriteBPS(),
+		ReadIOPS:  t.GetReadIOPS(),
+		WriteIOPS: t.GetWriteIOPS(),
+	}
+}
+
+func (s *RawBlockStorage) throttlePath(name string) string {
+	return filepath.Join(s.RootPath(), "volumes", ".throttle", name)
+}
+
+func (s *RawBlockStorage) deviceLink(name string) string {
+	return filepath.Join(s.RootPath(), "devices", name)
+}
+
+// loopDevice returns the loop device the block is attached to, if any.
+func loopDevice(ctx context.Context, block string) (string, error) {
+	out, err := execCommand(ctx, "losetup", "-j", block).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("losetup -j %s failed: %v: %s", block, err, out)
+	}
+	// "/dev/loop0: [2049]:1234 (/path/to/block)"
+	if line := strings.TrimSpace(string(out)); line != "" {
+		return strings.SplitN(line, ":", 2)[0], nil
+	}
+	return "", nil
+}
+
+func attachLoop(ctx context.Context, block string) (string, error) {
+	if device, err := loopDevice(ctx, block); err != nil || device != "" {
+		return device, err
+	}
+	out, err := execCommand(ctx, "losetup", "--find", "--show", block).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to attach %s to a loop device: %v: %s", block, err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// throttledDevice returns the device the limits of the block apply to, the
+// block is attached to a loop device unless it is encrypted.
+func (s *RawBlockStorage) throttledDevice(ctx context.Context, block string) (string, error) {
+	if id, _ := luksUUID(block); id != "" {
+		return luksDevice(id), nil
+	}
+	device, err := attachLoop(ctx, block)
+	if err != nil {
+		return "", err
+	}
+	link := s.deviceLink(filepath.Base(block))
+	if err := ensureDir(filepath.Dir(link), 0700); err != nil {
+		return "", err
+	}
+	if target, _ := os.Readlink(link); target != device {
+		os.Remove(link)
+		if err := os.Symlink(device, link); err != nil {
+			return "", err
+		}
+	}
+	return link, nil
+}
+
+// throttleBlock applies the limits to the device of the block and keeps
+// them, the device the volume should be opened from is returned.
+func (s *RawBlockStorage) throttleBlock(ctx context.Context, block string, limits rawblock.ThrottleOptions) (string, error) {
+	device, err := s.throttledDevice(ctx, block)
+	if err != nil {
+		return "", err
+	}
+	dev, err := rawblock.DeviceMajorMinor(device)
+	if err != nil {
+		return "", err
+	}
+	if err := rawblock.ApplyBlkioThrottle(dev, limits); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(limits)
+	if err != nil {
+		return "", err
+	}
+	path := s.throttlePath(filepath.Base(block))
+	if err := ensureDir(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	glog.V(1).Infof("volume %s throttled on %s (%s): %+v", block, device, dev, limits)
+	return device, nil
+}
+
+// unthrottleBlock removes the limits of the block and detaches its loop
+// device, nothing is done for the blocks which are not throttled.
+// ErrVolumeInUse is returned while the device is attached to a sandbox.
+func (s *RawBlockStorage) unthrottleBlock(ctx context.Context, block string) error {
+	name := filepath.Base(block)
+	if exists, _ := pathExists(s.throttlePath(name)); !exists {
+		return nil
+	}
+	id, _ := luksUUID(block)
+	device := s.deviceLink(name)
+	if id != "" {
+		device = luksDevice(id)
+	}
+	if target, err := filepath.EvalSymlinks(device); err == nil {
+		if storage.PathInUse(target) {
+			return ErrVolumeInUse
+		}
+		if dev, err := rawblock.DeviceMajorMinor(target); err == nil {
+			if err := rawblock.ClearBlkioThrottle(dev); err != nil {
+				glog.Warningf("failed to clear the limits of volume %s: %v", block, err)
+			}
+		}
+	}
+	if id == "" {
+		loop, err := loopDevice(ctx, block)
+		if err != nil {
+			return err
+		}
+		if loop != "" {
+			if out, err := execCommand(ctx, "losetup", "-d", loop).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to detach %s from %s: %v: %s", block, loop, err, out)
+			}
+		}
+		os.Remove(s.deviceLink(name))
+	}
+	return os.Remove(s.throttlePath(name))
+}
+
+// restoreThrottles attaches the throttled volumes again and applies their
+// limits, which do not survive a reboot of the host.
+func (s *RawBlockStorage) restoreThrottles(ctx context.Context) error {
+	dir := filepath.Join(s.RootPath(), "volumes", ".throttle")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		block := filepath.Join(s.RootPath(), "volumes", entry.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			glog.Errorf("failed to read the limits of volume %s: %v", block, err)
+			continue
+		}
+		var limits rawblock.ThrottleOptions
+		if err := json.Unmarshal(data, &limits); err != nil {
+			glog.Errorf("invalid limits of volume %s: %v", block, err)
+			continue
+		}
+		if _, err := s.throttleBlock(ctx, block, limits); err != nil {
+			glog.Errorf("failed to throttle volume %s: %v", block, err)
+		}
+	}
+	return nil
+}
+
+// attachedBlock tells whether the block is opened through a device, which
+// would not follow a change of the block file.
+func (s *RawBlockStorage) attachedBlock(block string) bool {
+	if id, _ := luksUUID(block); id != "" {
+		return true
+	}
+	exists, _ := pathExists(s.throttlePath(filepath.Base(block)))
+	return exists
+}
@@ -0,0 +1,108 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockThrottledVolume(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("making the fake loop devices needs root")
+	}
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+
+	root, err := ioutil.TempDir("", "throttle-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	loops := filepath.Join(root, "loops")
+	cgroup := filepath.Join(root, "blkio")
+	for _, dir := range []string{loops, cgroup} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("HELPER_LOOP_DIR", loops)
+	defer os.Unsetenv("HELPER_LOOP_DIR")
+	rawblock.BlkioCgroupDir = cgroup
+	defer func() { rawblock.BlkioCgroupDir = "/sys/fs/cgroup/blkio" }()
+	for _, file := range []string{"read_bps", "write_bps", "read_iops", "write_iops"} {
+		if err := ioutil.WriteFile(filepath.Join(cgroup, "blkio.throttle."+file+"_device"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the files keep what was written before, unlike the cgroup files
+	limit := func(file string) string {
+		path := filepath.Join(cgroup, "blkio.throttle."+file+"_device")
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Truncate(path, 0)
+		return string(data)
+	}
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root, Filesystem: "ext4"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{
+		Name:      "vol1",
+		SizeBytes: 16 * 1024 * 1024,
+		Throttle:  &apitypes.VolumeThrottle{ReadBPS: 1048576, WriteIOPS: 100},
+	}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create throttled volume failed: %v", err)
+	}
+	loop := filepath.Join(loops, "loop0")
+	if target, err := os.Readlink(spec.Source); err != nil || target != loop {
+		t.Fatalf("expected the volume on a link to %s, got %s: %v", loop, target, err)
+	}
+	if l := limit("read_bps"); l != "7:0 1048576" {
+		t.Fatalf("unexpected read bps limit %q", l)
+	}
+	if l := limit("write_iops"); l != "7:0 100" {
+		t.Fatalf("unexpected write iops limit %q", l)
+	}
+
+	// a reboot detaches the loop device and drops the limits
+	os.Remove(loop)
+	os.Remove(loop + ".backing")
+	s = &RawBlockStorage{rootPath: root, Filesystem: "ext4"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(spec.Source); err != nil || target != loop {
+		t.Fatalf("expected the volume attached again to %s, got %s: %v", loop, target, err)
+	}
+	if l := limit("read_bps"); l != "7:0 1048576" {
+		t.Fatalf("the limits should be applied again on Init, got %q", l)
+	}
+
+	if err := s.ResizeVolume(ctx, podId, "vol1", 32*1024*1024); !IsNotSupported(err) {
+		t.Fatalf("resizing a throttled volume should not be supported, got %v", err)
+	}
+
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove throttled volume failed: %v", err)
+	}
+	if l := limit("read_bps"); l != "7:0 0" {
+		t.Fatalf("the limits should be cleared, got %q", l)
+	}
+	for _, path := range []string{loop, spec.Source, s.throttlePath(filepath.Base(s.volumePath(podId, "vol1")))} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should be removed with the volume, got %v", path, err)
+		}
+	}
+}
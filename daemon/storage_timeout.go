@@ -0,0 +1,359 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// StorageTimeouts holds the longest time each operation of a TimeoutStorage
+// may take, zero means no timeout.
+type StorageTimeouts struct {
+	Init                    time.Duration
+	CleanUp                 time.Duration
+	HealthCheck             time.Duration
+	WaitReady               time.Duration
+	PrepareContainer        time.Duration
+	PrewarmContainer        time.Duration
+	CleanupContainer        time.Duration
+	InjectFile              time.Duration
+	InjectDir               time.Duration
+	CreateVolume            time.Duration
+	RemoveVolume            time.Duration
+	ListVolumes             time.Duration
+	SetVolumeLabels         time.Duration
+	HotPlugVolume           time.Duration
+	HotUnplugVolume         time.Duration
+	ResizeVolume            time.Duration
+	VolumeExists            time.Duration
+	DefragVolume            time.Duration
+	WarmVolume              time.Duration
+	SnapshotVolume          time.Duration
+	RollbackVolume          time.Duration
+	FreezeVolume            time.Duration
+	ThawVolume              time.Duration
+	CloneVolume             time.Duration
+	ExportVolume            time.Duration
+	ImportVolume            time.Duration
+	ExportIncrementalVolume time.Duration
+	ImportIncrementalVolume time.Duration
+	ContainerStats          time.Duration
+	UsageReport             time.Duration
+	GarbageCollect          time.Duration
+	CompactContainerLayer   time.Duration
+}
+
+// TimeoutStorage bounds the time the operations of the wrapped Storage may
+// take, so that a driver stuck on e.g. a hanging nfs mount does not block the
+// daemon. An operation which runs out of time is cancelled through its
+// context and returns context.DeadlineExceeded at once, even if the driver
+// does not give up; the driver may then still be using the readers and
+// writers handed to the operation. When such an operation creating a mount
+// or a volume succeeds after all, nobody holds what it made: it is undone,
+// the container cleaned up or the volume removed.
+type TimeoutStorage struct {
+	Storage
+	timeouts StorageTimeouts
+}
+
+func NewTimeoutStorage(inner Storage, timeouts StorageTimeouts) Storage {
+	return &TimeoutStorage{
+		Storage:  inner,
+		timeouts: timeouts,
+	}
+}
+
+// run runs call in its own goroutine, and returns its error or the one of the
+// context once the timeout is reached.
+func (t *TimeoutStorage) run(ctx context.Context, operation string, timeout time.Duration, call func(context.Context) error) error {
+	return t.runUndo(ctx, operation, timeout, call, nil)
+}
+
+// runUndo is run for the operations making something the caller has to hold,
+// undo is called if call succeeds once the caller was given up on.
+func (t *TimeoutStorage) runUndo(ctx context.Context, operation string, timeout time.Duration, call func(context.Context) error, undo func(context.Context) error) error {
+	if timeout <= 0 {
+		return call(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- call(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	select {
+	case err := <-done:
+		return err
+	default:
+	}
+	glog.Warningf("%s of storage %s gave up after %v", operation, t.Type(), timeout)
+	go func() {
+		if err := <-done; err != nil {
+			return
+		}
+		if undo == nil {
+			glog.Warningf("%s of storage %s succeeded after giving up on it", operation, t.Type())
+			return
+		}
+		glog.Warningf("%s of storage %s succeeded after giving up on it, undoing it", operation, t.Type())
+		if err := undo(context.Background()); err != nil {
+			glog.Errorf("failed to undo %s of storage %s: %v", operation, t.Type(), err)
+		}
+	}()
+	return ctx.Err()
+}
+
+func (t *TimeoutStorage) Init(ctx context.Context) error {
+	return t.run(ctx, "Init", t.timeouts.Init, t.Storage.Init)
+}
+
+func (t *TimeoutStorage) CleanUp(ctx context.Context) error {
+	return t.run(ctx, "CleanUp", t.timeouts.CleanUp, t.Storage.CleanUp)
+}
+
+func (t *TimeoutStorage) HealthCheck(ctx context.Context) error {
+	return t.run(ctx, "HealthCheck", t.timeouts.HealthCheck, t.Storage.HealthCheck)
+}
+
+func (t *TimeoutStorage) WaitReady(ctx context.Context) error {
+	return t.run(ctx, "WaitReady", t.timeouts.WaitReady, t.Storage.WaitReady)
+}
+
+func (t *TimeoutStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	var vol *runv.VolumeDescription
+	if err := t.runUndo(ctx, "PrepareContainer", t.timeouts.PrepareContainer, func(ctx context.Context) (err error) {
+		vol, err = t.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+		return err
+	}, func(ctx context.Context) error {
+		return t.Storage.CleanupContainer(ctx, mountId, sharedDir)
+	}); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+func (t *TimeoutStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return t.run(ctx, "PrewarmContainer", t.timeouts.PrewarmContainer, func(ctx context.Context) error {
+		return t.Storage.PrewarmContainer(ctx, mountId, sharedDir)
+	})
+}
+
+func (t *TimeoutStorage) CleanupContainer(ctx context.Context, id, sharedDir string) error {
+	return t.run(ctx, "CleanupContainer", t.timeouts.CleanupContainer, func(ctx context.Context) error {
+		return t.Storage.CleanupContainer(ctx, id, sharedDir)
+	})
+}
+
+func (t *TimeoutStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return t.run(ctx, "InjectFile", t.timeouts.InjectFile, func(ctx context.Context) error {
+		return t.Storage.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+	})
+}
+
+func (t *TimeoutStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) error {
+	return t.run(ctx, "InjectDir", t.timeouts.InjectDir, func(ctx context.Context) error {
+		return t.Storage.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+	})
+}
+
+// CreateVolume hands a copy of spec to the driver, the spec of the caller is
+// only updated once the volume is created.
+func (t *TimeoutStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	created := *spec
+	if err := t.runUndo(ctx, "CreateVolume", t.timeouts.CreateVolume, func(ctx context.Context) error {
+		return t.Storage.CreateVolume(ctx, podId, &created)
+	}, func(ctx context.Context) error {
+		record, err := json.Marshal(&created)
+		if err != nil {
+			return err
+		}
+		return t.Storage.RemoveVolume(ctx, podId, record)
+	}); err != nil {
+		return err
+	}
+	*spec = created
+	return nil
+}
+
+func (t *TimeoutStorage) RemoveVolume(ctx context.Context, podId string, record []byte) error {
+	return t.run(ctx, "RemoveVolume", t.timeouts.RemoveVolume, func(ctx context.Context) error {
+		return t.Storage.RemoveVolume(ctx, podId, record)
+	})
+}
+
+// HotPlugVolume hands a copy of spec to the driver like CreateVolume, the
+// volume plugged after the timeout is unplugged again.
+func (t *TimeoutStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	var vol *runv.VolumeDescription
+	plugged := *spec
+	if err := t.runUndo(ctx, "HotPlugVolume", t.timeouts.HotPlugVolume, func(ctx context.Context) (err error) {
+		vol, err = t.Storage.HotPlugVolume(ctx, podId, &plugged)
+		return err
+	}, func(ctx context.Context) error {
+		return t.Storage.HotUnplugVolume(ctx, podId, plugged.Name)
+	}); err != nil {
+		return nil, err
+	}
+	*spec = plugged
+	return vol, nil
+}
+
+func (t *TimeoutStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return t.run(ctx, "HotUnplugVolume", t.timeouts.HotUnplugVolume, func(ctx context.Context) error {
+		return t.Storage.HotUnplugVolume(ctx, podId, volName)
+	})
+}
+
+func (t *TimeoutStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	var vols []*apitypes.UserVolume
+	if err := t.run(ctx, "ListVolumes", t.timeouts.ListVolumes, func(ctx context.Context) (err error) {
+		vols, err = t.Storage.ListVolumes(ctx, podId)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return vols, nil
+}
+
+// SetVolumeLabels takes no context, it is only bounded by its timeout.
+func (t *TimeoutStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return t.run(context.Background(), "SetVolumeLabels", t.timeouts.SetVolumeLabels, func(ctx context.Context) error {
+		return t.Storage.SetVolumeLabels(podId, volName, labels)
+	})
+}
+
+func (t *TimeoutStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return t.run(ctx, "ResizeVolume", t.timeouts.ResizeVolume, func(ctx context.Context) error {
+		return t.Storage.ResizeVolume(ctx, podId, volName, newSizeBytes)
+	})
+}
+
+func (t *TimeoutStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	var exists bool
+	if err := t.run(ctx, "VolumeExists", t.timeouts.VolumeExists, func(ctx context.Context) (err error) {
+		exists, err = t.Storage.VolumeExists(ctx, podId, volName)
+		return err
+	}); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (t *TimeoutStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return t.run(ctx, "DefragVolume", t.timeouts.DefragVolume, func(ctx context.Context) error {
+		return t.Storage.DefragVolume(ctx, podId, volName)
+	})
+}
+
+func (t *TimeoutStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return t.run(ctx, "WarmVolume", t.timeouts.WarmVolume, func(ctx context.Context) error {
+		return t.Storage.WarmVolume(ctx, podId, volName)
+	})
+}
+
+func (t *TimeoutStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return t.run(ctx, "SnapshotVolume", t.timeouts.SnapshotVolume, func(ctx context.Context) error {
+		return t.Storage.SnapshotVolume(ctx, podId, volName, snapshot)
+	})
+}
+
+func (t *TimeoutStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return t.run(ctx, "RollbackVolume", t.timeouts.RollbackVolume, func(ctx context.Context) error {
+		return t.Storage.RollbackVolume(ctx, podId, volName, snapshot)
+	})
+}
+
+func (t *TimeoutStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return t.run(ctx, "FreezeVolume", t.timeouts.FreezeVolume, func(ctx context.Context) error {
+		return t.Storage.FreezeVolume(ctx, podId, volName)
+	})
+}
+
+func (t *TimeoutStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return t.run(ctx, "ThawVolume", t.timeouts.ThawVolume, func(ctx context.Context) error {
+		return t.Storage.ThawVolume(ctx, podId, volName)
+	})
+}
+
+func (t *TimeoutStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return t.runUndo(ctx, "CloneVolume", t.timeouts.CloneVolume, func(ctx context.Context) error {
+		return t.Storage.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+	}, func(ctx context.Context) error {
+		return t.Storage.RemoveVolume(ctx, dstPodId, []byte(dstVolName))
+	})
+}
+
+func (t *TimeoutStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return t.run(ctx, "ExportVolume", t.timeouts.ExportVolume, func(ctx context.Context) error {
+		return t.Storage.ExportVolume(ctx, podId, volName, dst)
+	})
+}
+
+func (t *TimeoutStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return t.run(ctx, "ImportVolume", t.timeouts.ImportVolume, func(ctx context.Context) error {
+		return t.Storage.ImportVolume(ctx, podId, volName, src)
+	})
+}
+
+func (t *TimeoutStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return t.run(ctx, "ExportIncrementalVolume", t.timeouts.ExportIncrementalVolume, func(ctx context.Context) error {
+		return t.Storage.ExportIncrementalVolume(ctx, podId, volName, sinceSnapshot, dst)
+	})
+}
+
+func (t *TimeoutStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return t.run(ctx, "ImportIncrementalVolume", t.timeouts.ImportIncrementalVolume, func(ctx context.Context) error {
+		return t.Storage.ImportIncrementalVolume(ctx, podId, volName, src)
+	})
+}
+
+func (t *TimeoutStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	var stats *StorageStats
+	if err := t.run(ctx, "ContainerStats", t.timeouts.ContainerStats, func(ctx context.Context) (err error) {
+		stats, err = t.Storage.ContainerStats(ctx, containerId)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (t *TimeoutStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return t.run(ctx, "CompactContainerLayer", t.timeouts.CompactContainerLayer, func(ctx context.Context) error {
+		return t.Storage.CompactContainerLayer(ctx, mountId)
+	})
+}
+
+func (t *TimeoutStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	var report *StorageUsageReport
+	if err := t.run(ctx, "UsageReport", t.timeouts.UsageReport, func(ctx context.Context) (err error) {
+		report, err = t.Storage.UsageReport(ctx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (t *TimeoutStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	var collected []string
+	if err := t.run(ctx, "GarbageCollect", t.timeouts.GarbageCollect, func(ctx context.Context) (err error) {
+		collected, err = t.Storage.GarbageCollect(ctx, activePodIDs)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return collected, nil
+}
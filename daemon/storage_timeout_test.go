@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// hangingStorage blocks PrepareContainer, CreateVolume and HotPlugVolume until
+// released, whatever their context says, like a driver stuck on a dead mount.
+type hangingStorage struct {
+	*MockStorage
+	release chan struct{}
+}
+
+func (h *hangingStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (*runv.VolumeDescription, error) {
+	<-h.release
+	return h.MockStorage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (h *hangingStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) error {
+	<-h.release
+	return h.MockStorage.CreateVolume(ctx, podId, spec)
+}
+
+func (h *hangingStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	<-h.release
+	return h.MockStorage.HotPlugVolume(ctx, podId, spec)
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	h := &hangingStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	s := NewTimeoutStorage(h, StorageTimeouts{
+		PrepareContainer: 10 * time.Millisecond,
+		RemoveVolume:     time.Second,
+	})
+
+	if _, err := s.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline exceeded, got %v", err)
+	}
+
+	// a zero timeout waits for the driver
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	done := make(chan error)
+	go func() {
+		done <- s.CreateVolume(context.Background(), "pod", spec)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("create volume should not time out, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if spec.Source != "/mock/pod/vol1" {
+		t.Fatalf("the volume should be updated by the driver, got %v", spec)
+	}
+
+	// the error of the driver is kept
+	h.SetError("RemoveVolume", ErrVolumeInUse)
+	if err := s.RemoveVolume(context.Background(), "pod", []byte("vol1")); err != ErrVolumeInUse {
+		t.Fatalf("expected the error of the driver, got %v", err)
+	}
+}
+
+func TestTimeoutStorageUndo(t *testing.T) {
+	h := &hangingStorage{MockStorage: NewMockStorage(), release: make(chan struct{})}
+	s := NewTimeoutStorage(h, StorageTimeouts{
+		PrepareContainer: 10 * time.Millisecond,
+		CreateVolume:     10 * time.Millisecond,
+		HotPlugVolume:    10 * time.Millisecond,
+	})
+	if _, err := s.PrepareContainer(context.Background(), "c1", "/shared", storage.ContainerOptions{}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline exceeded, got %v", err)
+	}
+	if err := s.CreateVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "vol1"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline exceeded, got %v", err)
+	}
+
+	if _, err := s.HotPlugVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "vol2"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline exceeded, got %v", err)
+	}
+
+	// the late successes are undone, nobody holds what they made
+	close(h.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.Calls("CleanupContainer")) == 0 || len(h.Calls("RemoveVolume")) == 0 || len(h.Calls("HotUnplugVolume")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the late operations should be undone, got %v", h.Calls(""))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if call := h.Calls("CleanupContainer")[0]; call.Args[0] != "c1" || call.Args[1] != "/shared" {
+		t.Fatalf("unexpected cleanup %v", call)
+	}
+	if call := h.Calls("RemoveVolume")[0]; call.Args[0] != "pod" || call.Args[1] != "vol1" {
+		t.Fatalf("unexpected removal %v", call)
+	}
+	if call := h.Calls("HotUnplugVolume")[0]; call.Args[0] != "pod" || call.Args[1] != "vol2" {
+		t.Fatalf("unexpected unplug %v", call)
+	}
+}
+
+func TestTimeoutStorageDeadline(t *testing.T) {
+	var deadline time.Time
+	s := NewTimeoutStorage(&deadlineStorage{MockStorage: NewMockStorage(), deadline: &deadline}, StorageTimeouts{
+		VolumeExists: time.Minute,
+	})
+	if _, err := s.VolumeExists(context.Background(), "pod", "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	if left := time.Until(deadline); left <= 0 || left > time.Minute {
+		t.Fatalf("expected a deadline within a minute, got %v", deadline)
+	}
+}
+
+// deadlineStorage records the deadline VolumeExists is called with.
+type deadlineStorage struct {
+	*MockStorage
+	deadline *time.Time
+}
+
+func (d *deadlineStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	*d.deadline, _ = ctx.Deadline()
+	return d.MockStorage.VolumeExists(ctx, podId, volName)
+}
@@ -0,0 +1,357 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/docker/go-units"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+// TmpfsStorage backs the rootfs of the containers and the volumes with tmpfs
+// mounts, for scratch space which does not outlive the containers. Every
+// mount is bounded, by the size of the volume spec or by the driver option:
+//
+//	tmpfs.size  size of the tmpfs of each container, required
+type TmpfsStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	// Size bounds the tmpfs of each container.
+	Size uint64
+}
+
+func TmpfsFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	size := config.DriverOption("tmpfs", "size")
+	if size == "" {
+		return nil, fmt.Errorf("tmpfs.size is required by the tmpfs storage, an unbounded tmpfs could take all the memory")
+	}
+	bytes, err := units.RAMInBytes(size)
+	if err != nil || bytes <= 0 {
+		return nil, fmt.Errorf("invalid tmpfs.size %q", size)
+	}
+	driver := &TmpfsStorage{
+		db:       db,
+		rootPath: config.DriverRoot("tmpfs"),
+		Size:     uint64(bytes),
+	}
+	return driver, nil
+}
+
+func (s *TmpfsStorage) Type() string {
+	return "tmpfs"
+}
+
+func (s *TmpfsStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *TmpfsStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+// mountTmpfs mounts a tmpfs of size bytes at target, unless one is mounted
+// there already.
+func mountTmpfs(ctx context.Context, target string, size uint64, readonly bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if mounted, _ := mount.Mounted(target); mounted {
+		return nil
+	}
+	if err := ensureDir(target, 0755); err != nil {
+		return err
+	}
+	var flags uintptr = syscall.MS_NOSUID | syscall.MS_NODEV
+	if readonly {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := syscall.Mount("tmpfs", target, "tmpfs", flags, fmt.Sprintf("size=%d", size)); err != nil {
+		return fmt.Errorf("failed to mount tmpfs of %d bytes to %s: %v", size, target, err)
+	}
+	return nil
+}
+
+// unmountTmpfs unmounts the tmpfs at target, its content is lost, and
+// removes the mount point.
+func unmountTmpfs(target string) error {
+	if mounted, _ := mount.Mounted(target); mounted {
+		if err := syscall.Unmount(target, 0); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *TmpfsStorage) Init(ctx context.Context) error {
+	return ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700)
+}
+
+func (*TmpfsStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (s *TmpfsStorage) HealthCheck(ctx context.Context) error {
+	return checkWritable(filepath.Join(s.RootPath(), "volumes"))
+}
+
+func (s *TmpfsStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *TmpfsStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsQuota: true,
+	}
+}
+
+func (s *TmpfsStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// PrepareContainer mounts an empty tmpfs as the rootfs of the container.
+func (s *TmpfsStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	if err := mountTmpfs(ctx, filepath.Join(sharedDir, mountId, "rootfs"), s.Size, opts.ReadOnly); err != nil {
+		return nil, err
+	}
+
+	containerPath := "/" + mountId
+	vol := &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "tmpfs",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+// CleanupContainer unmounts the tmpfs of the container, discarding it.
+func (s *TmpfsStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	if err := unmountTmpfs(filepath.Join(sharedDir, id, "rootfs")); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(sharedDir, id))
+	return nil
+}
+
+// preparedRootfs fails unless the tmpfs of the container is mounted, the
+// files injected into a rootfs which is not would be lost.
+func (s *TmpfsStorage) preparedRootfs(mountId, baseDir string) error {
+	rootfs := filepath.Join(baseDir, mountId, "rootfs")
+	if mounted, _ := mount.Mounted(rootfs); !mounted {
+		return fmt.Errorf("the tmpfs of container %s is not mounted at %s", mountId, rootfs)
+	}
+	return nil
+}
+
+func (s *TmpfsStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	if err := s.preparedRootfs(mountId, baseDir); err != nil {
+		return err
+	}
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *TmpfsStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	if err := s.preparedRootfs(mountId, baseDir); err != nil {
+		return err
+	}
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *TmpfsStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+// CreateVolume mounts a tmpfs of the size of the volume, which must be given.
+func (s *TmpfsStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	if spec.SizeBytes == 0 {
+		return fmt.Errorf("tmpfs volume %s needs a size", spec.Name)
+	}
+	volPath := s.volumePath(podId, spec.Name)
+	if err := mountTmpfs(ctx, volPath, spec.SizeBytes, false); err != nil {
+		return err
+	}
+	glog.V(1).Infof("volume %s of pod %s mounted as a tmpfs of %d bytes", spec.Name, podId, spec.SizeBytes)
+
+	spec.Source = volPath
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+// RemoveVolume discards the tmpfs of the volume, there is nothing to keep.
+func (s *TmpfsStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	volPath := s.volumePath(podId, name)
+	// the volume is a mount point itself, the unmount fails with EBUSY if
+	// anything is mounted beneath it
+	if storage.PathOpened(volPath) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volPath, podId)
+		return ErrVolumeInUse
+	}
+	if err := unmountTmpfs(volPath); err != nil {
+		return err
+	}
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *TmpfsStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	names, err := listPodVolumes(s.db, filepath.Join(s.RootPath(), "volumes"), podId)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*apitypes.UserVolume, 0, len(names))
+	for _, name := range names {
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   name,
+			Source: s.volumePath(podId, name),
+			Format: "vfs",
+			Fstype: "dir",
+		})
+	}
+	return vols, nil
+}
+
+func (s *TmpfsStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *TmpfsStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(s.volumePath(podId, volName))
+}
+
+func (s *TmpfsStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *TmpfsStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *TmpfsStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *TmpfsStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *TmpfsStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *TmpfsStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *TmpfsStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *TmpfsStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect discards the tmpfs of the orphaned volumes.
+func (s *TmpfsStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	dir := filepath.Join(s.RootPath(), "volumes")
+	orphans, err := orphanedVolumes(dir, activePodIDs)
+	if err != nil {
+		return nil, err
+	}
+	var collected []string
+	for _, name := range orphans {
+		volPath := filepath.Join(dir, name)
+		if storage.PathOpened(volPath) {
+			glog.Warningf("orphaned volume %s is still in use, leave it", volPath)
+			continue
+		}
+		if err := unmountTmpfs(volPath); err != nil {
+			glog.Errorf("failed to remove orphaned volume %s: %v", volPath, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
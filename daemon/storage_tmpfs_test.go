@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestTmpfsFactory(t *testing.T) {
+	if _, err := TmpfsFactory(nil, nil, nil); err == nil {
+		t.Fatal("tmpfs.size should be required")
+	}
+	for _, size := range []string{"0", "-1M", "big"} {
+		config, _ := NewStorageConfig(map[string]string{"tmpfs.size": size})
+		if _, err := TmpfsFactory(nil, nil, config); err == nil {
+			t.Fatalf("tmpfs.size %q should be refused", size)
+		}
+	}
+	config, _ := NewStorageConfig(map[string]string{"tmpfs.size": "64M"})
+	sd, err := TmpfsFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := sd.(*TmpfsStorage).Size; size != 64*1024*1024 {
+		t.Fatalf("expected a tmpfs of 64M, got %d", size)
+	}
+}
+
+func TestTmpfsStorage(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("mounting tmpfs needs root")
+	}
+	root, err := ioutil.TempDir("", "tmpfs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &TmpfsStorage{rootPath: root, Size: 1024 * 1024}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	if err := s.CreateVolume(ctx, podId, &apitypes.UserVolume{Name: "vol1"}); err == nil {
+		t.Fatal("a tmpfs volume without size should be refused")
+	}
+	spec := &apitypes.UserVolume{Name: "vol1", SizeBytes: 2 * 1024 * 1024}
+	if err := s.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatalf("create volume failed: %v", err)
+	}
+	defer syscall.Unmount(spec.Source, 0)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(spec.Source, &stat); err != nil {
+		t.Fatal(err)
+	}
+	if size := stat.Blocks * uint64(stat.Bsize); size != spec.SizeBytes {
+		t.Fatalf("expected a tmpfs of %d bytes, got %d", spec.SizeBytes, size)
+	}
+
+	sharedDir := filepath.Join(root, "shared")
+	if err := s.InjectFile(ctx, strings.NewReader("x"), "c1", "/etc/x", sharedDir, 0644, 0, 0, nil); err == nil {
+		t.Fatal("injecting into a container which is not prepared should fail")
+	}
+	vol, err := s.PrepareContainer(ctx, "c1", sharedDir, storage.ContainerOptions{})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	rootfs := filepath.Join(sharedDir, "c1", "rootfs")
+	defer syscall.Unmount(rootfs, 0)
+	if vol.Fstype != "tmpfs" || vol.Format != "vfs" || vol.Source != "/c1" {
+		t.Fatalf("unexpected container volume %#v", vol)
+	}
+	if err := s.InjectFile(ctx, strings.NewReader("x"), "c1", "/etc/x", sharedDir, 0644, 0, 0, nil); err != nil {
+		t.Fatalf("inject file failed: %v", err)
+	}
+	if err := s.CleanupContainer(ctx, "c1", sharedDir); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+	if mounted, _ := mount.Mounted(rootfs); mounted {
+		t.Fatal("the tmpfs of the container should be unmounted")
+	}
+
+	if err := s.RemoveVolume(ctx, podId, []byte("vol1")); err != nil {
+		t.Fatalf("remove volume failed: %v", err)
+	}
+	if exists, _ := s.VolumeExists(ctx, podId, "vol1"); exists {
+		t.Fatal("the volume should be removed")
+	}
+}
@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hyperhq/hyperd/storage"
+	"golang.org/x/net/context"
+)
+
+// PodUsage is the disk space a pod takes on the storage driver.
+type PodUsage struct {
+	VolumeBytes int64
+	// ContainerLayerBytes counts the writable layers of the prepared
+	// containers only, the driver does not know the pod of the others.
+	ContainerLayerBytes int64
+	SnapshotBytes       int64
+}
+
+// StorageUsageReport is the disk usage of the storage driver by pod.
+type StorageUsageReport struct {
+	Driver      string
+	GeneratedAt time.Time
+	ByPod       map[string]PodUsage
+	// DedupSavedBytes is the space the deduplicated container layers saved
+	// by sharing their extents, for the drivers which deduplicate them.
+	DedupSavedBytes int64
+}
+
+func newStorageUsageReport(s Storage) *StorageUsageReport {
+	return &StorageUsageReport{
+		Driver:      s.Type(),
+		GeneratedAt: time.Now(),
+		ByPod:       make(map[string]PodUsage),
+	}
+}
+
+func (r *StorageUsageReport) add(podId string, volume, layer, snapshot int64) {
+	u := r.ByPod[podId]
+	u.VolumeBytes += volume
+	u.ContainerLayerBytes += layer
+	u.SnapshotBytes += snapshot
+	r.ByPod[podId] = u
+}
+
+// dirUsage is the disk space of the tree of dir, 0 if it does not exist.
+func dirUsage(ctx context.Context, dir string) (int64, error) {
+	stats, err := dirStats(ctx, dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int64(stats.WrittenBytes), nil
+}
+
+// fileUsage is the disk space allocated to the file, which is less than its
+// size for the sparse blocks, 0 if it does not exist.
+func fileUsage(file string) (int64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return st.Blocks * 512, nil
+}
+
+// UsageReport walks the vfs volumes of each pod and their snapshots, and the
+// upper directories of the prepared containers.
+func (o *OverlayFsStorage) UsageReport(ctx context.Context) (report *StorageUsageReport, err error) {
+	defer wrapStorageError(&err, o.Type(), "UsageReport", "")
+	report = newStorageUsageReport(o)
+	pods, err := ioutil.ReadDir(o.vfsVolumeRoot())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if !pod.IsDir() {
+			continue
+		}
+		vols, err := ioutil.ReadDir(storage.VFSVolumePath(o.vfsVolumeRoot(), pod.Name(), ""))
+		if err != nil {
+			return nil, err
+		}
+		for _, vol := range vols {
+			bytes, err := dirUsage(ctx, storage.VFSVolumePath(o.vfsVolumeRoot(), pod.Name(), vol.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if storage.VFSVolumePath(o.vfsVolumeRoot(), pod.Name(), vol.Name()) == storage.VFSSnapshotPath(o.vfsVolumeRoot(), pod.Name(), "", "") {
+				report.add(pod.Name(), 0, 0, bytes)
+			} else {
+				report.add(pod.Name(), bytes, 0, 0)
+			}
+		}
+	}
+	for id, podId := range o.containerPods() {
+		bytes, err := dirUsage(ctx, filepath.Join(o.RootPath(), id, "upper"))
+		if err != nil {
+			return nil, err
+		}
+		report.add(podId, 0, bytes, 0)
+	}
+	return report, nil
+}
+
+// UsageReport sums the disk space allocated to the blocks of the recorded
+// volumes and of their snapshots, and to the blocks of the prepared
+// containers.
+func (s *RawBlockStorage) UsageReport(ctx context.Context) (report *StorageUsageReport, err error) {
+	defer wrapStorageError(&err, s.Type(), "UsageReport", "")
+	if s.db == nil {
+		return nil, unsupportedFeature(s, "usage reports without volume records")
+	}
+	report = newStorageUsageReport(s)
+	for kv := range s.db.ListAllVolumes() {
+		if kv == nil {
+			return nil, fmt.Errorf("failed to list the volumes")
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := parseVolumeRecord(kv.V).Name
+		podId := recordPodId(kv.K, name)
+		volume, err := fileUsage(s.volumePath(podId, name))
+		if err != nil {
+			return nil, err
+		}
+		var snapshot int64
+		snaps, err := ioutil.ReadDir(s.snapshotPath(podId, name, ""))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, snap := range snaps {
+			bytes, err := fileUsage(s.snapshotPath(podId, name, snap.Name()))
+			if err != nil {
+				return nil, err
+			}
+			snapshot += bytes
+		}
+		report.add(podId, volume, 0, snapshot)
+	}
+	for id, podId := range s.containerPods() {
+		bytes, err := fileUsage(filepath.Join(s.RootPath(), "blocks", id))
+		if err != nil {
+			return nil, err
+		}
+		report.add(podId, 0, bytes, 0)
+	}
+	if report.DedupSavedBytes, err = s.dedupSavedBytes(ctx); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// storageUsageCache keeps the usage report for ttl, it walks every volume.
+// A ttl of 0 caches nothing.
+type storageUsageCache struct {
+	sync.Mutex
+	ttl    time.Duration
+	report *StorageUsageReport
+}
+
+func newStorageUsageCache(ttl time.Duration) *storageUsageCache {
+	return &storageUsageCache{ttl: ttl}
+}
+
+// StorageUsage returns the disk usage of the storage driver by pod, cached
+// for the StorageUsageTTL of the config. The reports are computed one at a
+// time.
+func (daemon *Daemon) StorageUsage(ctx context.Context) (*StorageUsageReport, error) {
+	c := daemon.storageUsage
+	if c == nil {
+		return daemon.Storage.UsageReport(ctx)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.report != nil && time.Since(c.report.GeneratedAt) < c.ttl {
+		return c.report, nil
+	}
+	report, err := daemon.Storage.UsageReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.report = report
+	return report, nil
+}
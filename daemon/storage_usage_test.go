@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestOverlayFsUsageReport(t *testing.T) {
+	root, err := ioutil.TempDir("", "overlay-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	defer os.RemoveAll(storage.VFSVolumePath(o.vfsVolumeRoot(), podId, ""))
+	if err := os.MkdirAll(storage.VFSVolumePath(o.vfsVolumeRoot(), podId, "vol1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storage.VFSVolumePath(o.vfsVolumeRoot(), podId, "vol1"), "data"), make([]byte, 8192), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(storage.VFSSnapshotPath(o.vfsVolumeRoot(), podId, "vol1", "snap1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storage.VFSSnapshotPath(o.vfsVolumeRoot(), podId, "vol1", "snap1"), "data"), make([]byte, 16384), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upper := filepath.Join(root, "c1", "upper")
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(upper, "hosts"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var prepared error
+	o.takeVolumes("c1", storage.ContainerOptions{PodID: podId}, &prepared)
+
+	report, err := o.UsageReport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := report.ByPod[podId]
+	if usage.VolumeBytes < 8192 || usage.VolumeBytes >= 16384 {
+		t.Fatalf("the snapshots should not be counted with the volumes, got %+v", usage)
+	}
+	if usage.SnapshotBytes < 16384 || usage.ContainerLayerBytes < 4096 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+
+	o.releaseVolumes("c1", &prepared)
+	if report, _ = o.UsageReport(ctx); report.ByPod[podId].ContainerLayerBytes != 0 {
+		t.Fatalf("the container cleaned up should not be counted, got %+v", report.ByPod[podId])
+	}
+}
+
+func TestRawBlockUsageReport(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root}
+	if _, err := s.UsageReport(ctx); err == nil {
+		t.Fatal("the usage report should fail without the volume records")
+	}
+	db, err := daemondb.NewDaemonDB(filepath.Join(root, "hyper.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s.db = db
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	podId := testPodId(t)
+	if err := saveVolumeRecord(ctx, db, podId, &apitypes.UserVolume{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	sparse := func(file string, written int) {
+		f, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(make([]byte, written)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Truncate(64 * 1024 * 1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sparse(s.volumePath(podId, "vol1"), 8192)
+	if err := os.MkdirAll(s.snapshotPath(podId, "vol1", ""), 0700); err != nil {
+		t.Fatal(err)
+	}
+	sparse(s.snapshotPath(podId, "vol1", "snap1"), 4096)
+	if _, err := s.PrepareContainer(ctx, "c1", root, storage.ContainerOptions{PodID: podId}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "blocks"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	sparse(filepath.Join(root, "blocks", "c1"), 16384)
+
+	report, err := s.UsageReport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := report.ByPod[podId]
+	if usage.VolumeBytes < 8192 || usage.SnapshotBytes < 4096 || usage.ContainerLayerBytes < 16384 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	if usage.VolumeBytes >= 64*1024*1024 {
+		t.Fatalf("only the written blocks should be counted, got %+v", usage)
+	}
+}
+
+func TestStorageUsageCache(t *testing.T) {
+	mock := NewMockStorage()
+	daemon := &Daemon{Storage: mock, storageUsage: newStorageUsageCache(time.Minute)}
+	for i := 0; i < 3; i++ {
+		if _, err := daemon.StorageUsage(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := mock.Calls("UsageReport"); len(calls) != 1 {
+		t.Fatalf("the report should be computed once, got %d calls", len(calls))
+	}
+
+	// expire the report
+	daemon.storageUsage.report.GeneratedAt = time.Now().Add(-time.Hour)
+	daemon.StorageUsage(context.Background())
+	daemon.storageUsage = newStorageUsageCache(0)
+	daemon.StorageUsage(context.Background())
+	daemon.StorageUsage(context.Background())
+	if calls := mock.Calls("UsageReport"); len(calls) != 4 {
+		t.Fatalf("nothing should be cached once expired or without a ttl, got %d calls", len(calls))
+	}
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/go-units"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+// The bounds of the size of a rawblock volume, a smaller block holds no
+// filesystem worth the name.
+const (
+	minRawBlockVolumeSize = 1 << 20
+	maxRawBlockVolumeSize = 10 << 40
+)
+
+// ValidateVolumeSpec checks the size and the filesystem of the volume, and
+// that the filesystem can be made.
+func (s *RawBlockStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	var errs []storage.ValidationError
+	if size := spec.SizeBytes; size != 0 && (size < minRawBlockVolumeSize || size > maxRawBlockVolumeSize) {
+		errs = append(errs, storage.ValidationError{
+			Field: "SizeBytes",
+			Message: fmt.Sprintf("%s is out of [%s, %s]", units.BytesSize(float64(size)),
+				units.BytesSize(minRawBlockVolumeSize), units.BytesSize(maxRawBlockVolumeSize)),
+		})
+	}
+	if spec.Fstype != "" && !validRawBlockFs(spec.Fstype) {
+		errs = append(errs, storage.ValidationError{
+			Field:   "Fstype",
+			Message: fmt.Sprintf("unsupported filesystem %q, supported: %v", spec.Fstype, supportedRawBlockFs),
+		})
+	}
+	if isVolumeMeta(spec.Name) {
+		errs = append(errs, storage.ValidationError{
+			Field:   "Name",
+			Message: fmt.Sprintf("%q would be taken for the metadata of a volume", spec.Name),
+		})
+	}
+	if spec.Shared {
+		errs = append(errs, storage.ValidationError{
+			Field:   "Shared",
+			Message: "the rawblock volumes can not be shared, only the overlay ones",
+		})
+	}
+	if err := lookTool(s, "mkfs."+s.Filesystem, rawBlockToolPackages["mkfs."+s.Filesystem]); err != nil {
+		errs = append(errs, storage.ValidationError{Message: err.Error()})
+	}
+	return errs
+}
+
+func validRawBlockFs(fs string) bool {
+	for _, supported := range supportedRawBlockFs {
+		if fs == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// validateVFSVolume checks that the directory of the vfs volumes can be
+// written, or made when it does not exist yet.
+func validateVFSVolume(root string) []storage.ValidationError {
+	dir := root
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return []storage.ValidationError{{Message: err.Error()}}
+		}
+		dir = filepath.Dir(dir)
+	}
+	if err := checkWritable(dir); err != nil {
+		return []storage.ValidationError{{Message: err.Error()}}
+	}
+	return nil
+}
+
+// ValidateVolumeSpec checks that the vfs volume can be made.
+func (o *OverlayFsStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return validateVFSVolume(o.vfsVolumeRoot())
+}
+
+// ValidateVolumeSpec checks that the vfs volume can be made.
+func (a *AufsStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	if spec.Shared {
+		return []storage.ValidationError{{Field: "Shared", Message: "the aufs volumes can not be shared, only the overlay ones"}}
+	}
+	return validateVFSVolume(storage.VFSVolumeRoot)
+}
@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockValidateVolumeSpec(t *testing.T) {
+	root, err := ioutil.TempDir("", "rawblock-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+
+	restore := fakeMkfs(t, root, "xfs")
+	for _, c := range []struct {
+		spec   apitypes.UserVolume
+		fields []string
+	}{
+		{apitypes.UserVolume{Name: "default"}, nil},
+		{apitypes.UserVolume{Name: "sized", SizeBytes: 10 << 30, Fstype: "xfs"}, nil},
+		{apitypes.UserVolume{Name: "tiny", SizeBytes: 4096}, []string{"SizeBytes"}},
+		{apitypes.UserVolume{Name: "huge", SizeBytes: 11 << 40}, []string{"SizeBytes"}},
+		{apitypes.UserVolume{Name: "btrfs", Fstype: "btrfs"}, []string{"Fstype"}},
+		{apitypes.UserVolume{Name: "both", SizeBytes: 1, Fstype: "ntfs"}, []string{"SizeBytes", "Fstype"}},
+	} {
+		errs := s.ValidateVolumeSpec(&c.spec)
+		if len(errs) != len(c.fields) {
+			t.Fatalf("volume %s: expected errors on %v, got %v", c.spec.Name, c.fields, errs)
+		}
+		for i, field := range c.fields {
+			if errs[i].Field != field {
+				t.Fatalf("volume %s: expected an error on %s, got %v", c.spec.Name, field, errs[i])
+			}
+		}
+	}
+	restore()
+
+	// the filesystem of the volumes can not be made without mkfs
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", "")
+	defer os.Setenv("PATH", path)
+	errs := s.ValidateVolumeSpec(&apitypes.UserVolume{Name: "nomkfs"})
+	if len(errs) != 1 || errs[0].Field != "" {
+		t.Fatalf("a missing mkfs.xfs should be reported, got %v", errs)
+	}
+	if exists, _ := pathExists(s.volumePath("pod", "nomkfs")); exists {
+		t.Fatal("the validation should not create the volume")
+	}
+}
+
+func TestOverlayFsValidateVolumeSpec(t *testing.T) {
+	o := &OverlayFsStorage{}
+	if errs := o.ValidateVolumeSpec(&apitypes.UserVolume{Name: "data"}); len(errs) != 0 {
+		t.Fatalf("the vfs volumes should be creatable, got %v", errs)
+	}
+}
@@ -0,0 +1,462 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"golang.org/x/net/context"
+)
+
+var (
+	// virtiofsdStartTimeout bounds the wait for virtiofsd to listen on its
+	// socket.
+	virtiofsdStartTimeout = 10 * time.Second
+	// virtiofsdStopTimeout is how long virtiofsd is given to exit on SIGTERM
+	// before it is killed.
+	virtiofsdStopTimeout = 10 * time.Second
+)
+
+var virtiofsCachePolicies = []string{"auto", "always", "never", "metadata"}
+
+// VirtiofsDaemonStorage shares the rootfs of the containers with the guest
+// over virtio-fs instead of 9p, one virtiofsd serving each container on a
+// unix socket the hypervisor connects to. The volumes are vfs directories.
+//
+//	virtiofs.cache_policy      cache mode of virtiofsd, auto by default
+//	virtiofs.thread_pool_size  request threads of virtiofsd, its default if 0
+type VirtiofsDaemonStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	rootPath string
+	// CachePolicy is one of virtiofsCachePolicies.
+	CachePolicy    string
+	ThreadPoolSize int
+
+	sync.Mutex
+	daemons map[string]*virtiofsd
+}
+
+// virtiofsd is a daemon started by this process, done is closed once it
+// exited.
+type virtiofsd struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+func VirtiofsFactory(_ *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &VirtiofsDaemonStorage{
+		db:          db,
+		rootPath:    config.DriverRoot("virtiofs"),
+		CachePolicy: "auto",
+		daemons:     make(map[string]*virtiofsd),
+	}
+	if policy := config.DriverOption("virtiofs", "cache_policy"); policy != "" {
+		driver.CachePolicy = ""
+		for _, p := range virtiofsCachePolicies {
+			if policy == p {
+				driver.CachePolicy = policy
+			}
+		}
+		if driver.CachePolicy == "" {
+			return nil, fmt.Errorf("invalid virtiofs.cache_policy %q, should be one of %v", policy, virtiofsCachePolicies)
+		}
+	}
+	if size := config.DriverOption("virtiofs", "thread_pool_size"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid virtiofs.thread_pool_size %q", size)
+		}
+		driver.ThreadPoolSize = n
+	}
+	return driver, nil
+}
+
+func (s *VirtiofsDaemonStorage) Type() string {
+	return "virtiofs"
+}
+
+func (s *VirtiofsDaemonStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *VirtiofsDaemonStorage) socketPath(mountId string) string {
+	return filepath.Join(s.RootPath(), "sockets", mountId+".sock")
+}
+
+func (s *VirtiofsDaemonStorage) pidPath(mountId string) string {
+	return filepath.Join(s.RootPath(), "sockets", mountId+".pid")
+}
+
+func (s *VirtiofsDaemonStorage) logPath(mountId string) string {
+	return filepath.Join(s.RootPath(), "sockets", mountId+".log")
+}
+
+func (s *VirtiofsDaemonStorage) Init(ctx context.Context) error {
+	return ensureDir(filepath.Join(s.RootPath(), "sockets"), 0700)
+}
+
+// CleanUp leaves the daemons running, the sandboxes of a restarted hyperd
+// are still using them.
+func (*VirtiofsDaemonStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (s *VirtiofsDaemonStorage) HealthCheck(ctx context.Context) error {
+	if _, err := exec.LookPath("virtiofsd"); err != nil {
+		return err
+	}
+	return checkWritable(filepath.Join(s.RootPath(), "sockets"))
+}
+
+func (s *VirtiofsDaemonStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *VirtiofsDaemonStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots: true,
+		SupportsClone:     true,
+	}
+}
+
+func (s *VirtiofsDaemonStorage) KernelCapabilities() []string {
+	return nil
+}
+
+// PrepareContainer starts a virtiofsd exporting the rootfs directory of the
+// container, the description has the socket of the daemon as Source.
+func (s *VirtiofsDaemonStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	rootfs := filepath.Join(sharedDir, mountId, "rootfs")
+	if err := ensureDir(rootfs, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.startDaemon(ctx, mountId, rootfs, opts.ReadOnly); err != nil {
+		return nil, err
+	}
+
+	vol := &runv.VolumeDescription{
+		Name:     "/" + mountId,
+		Source:   s.socketPath(mountId),
+		Fstype:   "virtiofs",
+		Format:   "virtiofs",
+		ReadOnly: opts.ReadOnly,
+	}
+	return vol, nil
+}
+
+// startDaemon runs virtiofsd in the namespaces of hyperd, in a session of its
+// own so that it outlives a restart of hyperd, and waits for it to listen on
+// its socket. A daemon already serving the container is kept.
+func (s *VirtiofsDaemonStorage) startDaemon(ctx context.Context, mountId, rootfs string, readonly bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if d, ok := s.daemons[mountId]; ok {
+		select {
+		case <-d.done:
+			delete(s.daemons, mountId)
+		default:
+			return nil
+		}
+	}
+
+	sock := s.socketPath(mountId)
+	os.Remove(sock)
+	logFile, err := os.OpenFile(s.logPath(mountId), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	args := []string{
+		"--socket-path=" + sock,
+		"--shared-dir=" + rootfs,
+		"--cache=" + s.CachePolicy,
+	}
+	if s.ThreadPoolSize > 0 {
+		args = append(args, "--thread-pool-size="+strconv.Itoa(s.ThreadPoolSize))
+	}
+	if readonly {
+		args = append(args, "--readonly")
+	}
+	// the daemon lives as long as the container, not as the request
+	cmd := execCommand(context.Background(), "virtiofsd", args...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start virtiofsd for container %s: %v", mountId, err)
+	}
+	d := &virtiofsd{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		d.err = cmd.Wait()
+		close(d.done)
+	}()
+	if err := ioutil.WriteFile(s.pidPath(mountId), []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+		stopVirtiofsd(d)
+		return err
+	}
+
+	timeout := time.NewTimer(virtiofsdStartTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		select {
+		case <-d.done:
+			os.Remove(s.pidPath(mountId))
+			out, _ := ioutil.ReadFile(s.logPath(mountId))
+			return fmt.Errorf("virtiofsd of container %s exited: %v: %s", mountId, d.err, strings.TrimSpace(string(out)))
+		case <-ctx.Done():
+			s.stopPid(mountId, d)
+			return ctx.Err()
+		case <-timeout.C:
+			s.stopPid(mountId, d)
+			return fmt.Errorf("virtiofsd of container %s did not listen on %s in %v", mountId, sock, virtiofsdStartTimeout)
+		case <-ticker.C:
+		}
+	}
+	glog.V(1).Infof("virtiofsd %d serving %s of container %s on %s", cmd.Process.Pid, rootfs, mountId, sock)
+	s.daemons[mountId] = d
+	return nil
+}
+
+// stopVirtiofsd terminates the daemon, and kills it unless it exits in
+// virtiofsdStopTimeout.
+func stopVirtiofsd(d *virtiofsd) {
+	d.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-d.done:
+	case <-time.After(virtiofsdStopTimeout):
+		d.cmd.Process.Kill()
+		<-d.done
+	}
+}
+
+func (s *VirtiofsDaemonStorage) stopPid(mountId string, d *virtiofsd) {
+	stopVirtiofsd(d)
+	os.Remove(s.pidPath(mountId))
+}
+
+// CleanupContainer terminates the virtiofsd of the container. The daemons
+// started before hyperd restarted are found from their pid files.
+func (s *VirtiofsDaemonStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	s.Lock()
+	d, ok := s.daemons[id]
+	delete(s.daemons, id)
+	s.Unlock()
+	if ok {
+		stopVirtiofsd(d)
+	} else if err := terminatePidFile(s.pidPath(id)); err != nil {
+		return fmt.Errorf("failed to terminate virtiofsd of container %s: %v", id, err)
+	}
+	for _, path := range []string{s.pidPath(id), s.socketPath(id), s.logPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminatePidFile sends SIGTERM to the process of the pid file, if any. The
+// process is not waited for, it is not a child of this one.
+func terminatePidFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid pid file %s: %v", path, err)
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+func (s *VirtiofsDaemonStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *VirtiofsDaemonStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *VirtiofsDaemonStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+func (s *VirtiofsDaemonStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	volName, err := storage.CreateVFSVolume(storage.VFSVolumeRoot, podId, spec.Name)
+	if err != nil {
+		return err
+	}
+	spec.Source = volName
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return saveVolumeRecord(ctx, s.db, podId, spec)
+}
+
+func (s *VirtiofsDaemonStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	name := parseVolumeRecord(record).Name
+	volName := storage.VFSVolumePath(storage.VFSVolumeRoot, podId, name)
+	if storage.PathInUse(volName) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", volName, podId)
+		return ErrVolumeInUse
+	}
+	if err := os.RemoveAll(volName); err != nil {
+		return err
+	}
+	if err := storage.RemoveVFSSnapshots(storage.VFSVolumeRoot, podId, name); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(volName))
+	return deleteVolumeRecord(ctx, s.db, podId, name)
+}
+
+func (s *VirtiofsDaemonStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	return listVFSVolumes(storage.VFSVolumeRoot, podId)
+}
+
+func (s *VirtiofsDaemonStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	return pathExists(storage.VFSVolumePath(storage.VFSVolumeRoot, podId, volName))
+}
+
+func (s *VirtiofsDaemonStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return loadVolumeLabels(s.db, podId, volName)
+}
+
+func (s *VirtiofsDaemonStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return saveVolumeLabels(context.Background(), s.db, podId, volName, labels)
+}
+
+func (s *VirtiofsDaemonStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return snapshotVFSVolume(storage.VFSVolumeRoot, podId, volName, snapshot)
+}
+
+func (s *VirtiofsDaemonStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	return rollbackVFSVolume(storage.VFSVolumeRoot, podId, volName, snapshot)
+}
+
+func (s *VirtiofsDaemonStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	volName, err := storage.CloneVFSVolume(storage.VFSVolumeRoot, srcPodId, srcVolName, dstPodId, dstVolName)
+	if err != nil {
+		return err
+	}
+	spec := &apitypes.UserVolume{
+		Name:   dstVolName,
+		Source: volName,
+		Format: "vfs",
+		Fstype: "dir",
+	}
+	return saveVolumeRecord(ctx, s.db, dstPodId, spec)
+}
+
+func (s *VirtiofsDaemonStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return exportVFSVolume(ctx, storage.VFSVolumeRoot, podId, volName, dst)
+}
+
+func (s *VirtiofsDaemonStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return importVFSVolume(ctx, storage.VFSVolumeRoot, podId, volName, src)
+}
+
+func (s *VirtiofsDaemonStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *VirtiofsDaemonStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	return collectVFSVolumes(storage.VFSVolumeRoot, activePodIDs)
+}
@@ -0,0 +1,112 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+)
+
+func TestVirtiofsFactory(t *testing.T) {
+	config, _ := NewStorageConfig(nil)
+	sd, err := VirtiofsFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := sd.(*VirtiofsDaemonStorage); s.CachePolicy != "auto" || s.ThreadPoolSize != 0 {
+		t.Fatalf("unexpected defaults %q, %d", s.CachePolicy, s.ThreadPoolSize)
+	}
+	for _, opts := range []map[string]string{
+		{"virtiofs.cache_policy": "sometimes"},
+		{"virtiofs.thread_pool_size": "-1"},
+		{"virtiofs.thread_pool_size": "many"},
+	} {
+		config, _ := NewStorageConfig(opts)
+		if _, err := VirtiofsFactory(nil, nil, config); err == nil {
+			t.Fatalf("options %v should be refused", opts)
+		}
+	}
+	config, _ = NewStorageConfig(map[string]string{"virtiofs.cache_policy": "never", "virtiofs.thread_pool_size": "4"})
+	sd, err = VirtiofsFactory(nil, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := sd.(*VirtiofsDaemonStorage); s.CachePolicy != "never" || s.ThreadPoolSize != 4 {
+		t.Fatalf("unexpected options %q, %d", s.CachePolicy, s.ThreadPoolSize)
+	}
+}
+
+func TestVirtiofsStorage(t *testing.T) {
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	root, err := ioutil.TempDir("", "virtiofs-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	ctx := context.Background()
+	s := &VirtiofsDaemonStorage{
+		rootPath:       root,
+		CachePolicy:    "always",
+		ThreadPoolSize: 2,
+		daemons:        make(map[string]*virtiofsd),
+	}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sharedDir := filepath.Join(root, "shared")
+	vol, err := s.PrepareContainer(ctx, "c1", sharedDir, storage.ContainerOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("prepare container failed: %v", err)
+	}
+	sock := filepath.Join(root, "sockets", "c1.sock")
+	if vol.Source != sock || vol.Format != "virtiofs" || !vol.ReadOnly {
+		t.Fatalf("unexpected volume description %+v", vol)
+	}
+	cmds, _ := ioutil.ReadFile(log)
+	expected := "virtiofsd --socket-path=" + sock + " --shared-dir=" + filepath.Join(sharedDir, "c1", "rootfs") + " --cache=always --thread-pool-size=2 --readonly"
+	if strings.TrimSpace(string(cmds)) != expected {
+		t.Fatalf("expected %q, got %q", expected, cmds)
+	}
+	// preparing again keeps the running daemon
+	if _, err := s.PrepareContainer(ctx, "c1", sharedDir, storage.ContainerOptions{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if cmds, _ := ioutil.ReadFile(log); strings.Count(string(cmds), "virtiofsd") != 1 {
+		t.Fatalf("virtiofsd should have been started once, got %q", cmds)
+	}
+	if err := s.InjectFile(ctx, strings.NewReader("x"), "c1", "/etc/x", sharedDir, 0644, os.Getuid(), os.Getgid(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d := s.daemons["c1"]
+	if err := s.CleanupContainer(ctx, "c1", sharedDir); err != nil {
+		t.Fatalf("cleanup container failed: %v", err)
+	}
+	select {
+	case <-d.done:
+	default:
+		t.Fatal("virtiofsd should have been terminated")
+	}
+	for _, path := range []string{sock, s.pidPath("c1")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should have been removed", path)
+		}
+	}
+
+	os.Setenv("HELPER_VIRTIOFSD_FAIL", "1")
+	defer os.Unsetenv("HELPER_VIRTIOFSD_FAIL")
+	if _, err := s.PrepareContainer(ctx, "c2", sharedDir, storage.ContainerOptions{}); err == nil || !strings.Contains(err.Error(), "cannot open the shared dir") {
+		t.Fatalf("expected the error of virtiofsd, got %v", err)
+	}
+}
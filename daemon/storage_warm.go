@@ -0,0 +1,113 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hyperhq/hyperd/storage"
+	"github.com/hyperhq/hyperd/storage/graphdriver/rawblock"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// warmHeadBytes is the head of a block read ahead by WarmVolume, where both
+// xfs and ext4 keep their superblock and the headers of their first groups.
+const warmHeadBytes = 64 << 20
+
+// WarmVolume reads the head of the block ahead, then mounts its filesystem
+// read-only aside and walks it, so that the inodes and the directories are
+// in the page cache of the block when the sandbox opens it. A volume already
+// in use is warm, it is left alone.
+func (s *RawBlockStorage) WarmVolume(ctx context.Context, podId, volName string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "WarmVolume", volumeID(podId, volName))
+	block := s.volumePath(podId, volName)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+
+	fi, err := os.Stat(block)
+	if err != nil {
+		return err
+	}
+	device := s.blockDevice(block)
+	if s.VolumeRefCount(podId, volName) > 0 || storage.PathInUse(block) || storage.PathInUse(device) {
+		return nil
+	}
+	head := fi.Size()
+	if head > warmHeadBytes {
+		head = warmHeadBytes
+	}
+	if err := fadviseWillNeed(block, head); err != nil {
+		return err
+	}
+	mnt, err := ioutil.TempDir(filepath.Dir(block), ".warm-")
+	if err != nil {
+		return err
+	}
+	if err := s.mountBlock(ctx, device, mnt, true); err != nil {
+		os.Remove(mnt)
+		return err
+	}
+	defer unmountBlock(mnt)
+	return warmTree(ctx, mnt, false)
+}
+
+// PrewarmContainer creates and formats the block of the container, of the
+// VolumeSize of the driver, unless the graph driver made it already, and
+// reads its head ahead, so that PrepareContainer only has to hand it over.
+func (s *RawBlockStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) (err error) {
+	defer wrapStorageError(&err, s.Type(), "PrewarmContainer", mountId)
+	block := filepath.Join(s.RootPath(), "blocks", mountId)
+	s.locks.Lock(block)
+	defer s.locks.Unlock(block)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(block)
+	if os.IsNotExist(err) {
+		if err := ensureDir(filepath.Dir(block), 0700); err != nil {
+			return err
+		}
+		if err := rawblock.CreateBlock(block, s.Filesystem, "", s.VolumeSize); err != nil {
+			return err
+		}
+		fi, err = os.Stat(block)
+	}
+	if err != nil {
+		return err
+	}
+	head := fi.Size()
+	if head > warmHeadBytes {
+		head = warmHeadBytes
+	}
+	return fadviseWillNeed(block, head)
+}
+
+// fadviseWillNeed starts reading the first length bytes of the file in the
+// background, the whole file if length is 0.
+func fadviseWillNeed(file string, length int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Fadvise(int(f.Fd()), 0, length, unix.FADV_WILLNEED)
+}
+
+// warmTree stats every file under root, and reads the regular ones ahead
+// when content is set.
+func warmTree(ctx context.Context, root string, content bool) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if content && info.Mode().IsRegular() {
+			return fadviseWillNeed(path, 0)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,177 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+)
+
+func TestRawBlockWarmVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "warm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer fakeMkfs(t, root, "xfs")()
+
+	execCommand = fakeExecCommand
+	defer func() { execCommand = exec.CommandContext }()
+	log := filepath.Join(root, "commands")
+	os.Setenv("HELPER_LOG", log)
+	defer os.Unsetenv("HELPER_LOG")
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root, Filesystem: "xfs"}
+	if err := s.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+	podId := testPodId(t)
+	if err := ioutil.WriteFile(s.volumePath(podId, "vol1"), make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.WarmVolume(ctx, podId, "vol1"); err != nil {
+		t.Fatalf("warm volume failed: %v", err)
+	}
+	commands, _ := ioutil.ReadFile(log)
+	block := regexp.QuoteMeta(s.volumePath(podId, "vol1"))
+	mnt := regexp.QuoteMeta(filepath.Join(root, "volumes", ".warm-")) + `\d+`
+	if !regexp.MustCompile(`^mount -t xfs -o loop,ro,nouuid ` + block + ` (` + mnt + `)\numount -d (` + mnt + `)\n$`).Match(commands) {
+		t.Fatalf("expected the volume mounted readonly and unmounted, got\n%s", commands)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(root, "volumes", ".warm-*")); len(entries) != 0 {
+		t.Fatalf("the mount point should be removed, got %v", entries)
+	}
+
+	// the volume of a running container is left alone
+	os.Remove(log)
+	if _, err := s.PrepareContainer(ctx, "c1", root, storage.ContainerOptions{PodID: podId, Volumes: []string{"vol1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WarmVolume(ctx, podId, "vol1"); err != nil {
+		t.Fatalf("warm volume in use failed: %v", err)
+	}
+	if commands, _ := ioutil.ReadFile(log); len(commands) != 0 {
+		t.Fatalf("the volume in use should not be mounted, got\n%s", commands)
+	}
+	if err := s.CleanupContainer(ctx, "c1", root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.WarmVolume(ctx, podId, "missing"); !IsNotFound(err) {
+		t.Fatalf("expected the volume not found, got %v", err)
+	}
+}
+
+func TestOverlayFsWarmVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "warm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	o := &OverlayFsStorage{rootPath: root}
+	podId := testPodId(t)
+	spec := &apitypes.UserVolume{Name: "vol1"}
+	if err := o.CreateVolume(ctx, podId, spec); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(spec.Source))
+	if err := os.MkdirAll(filepath.Join(spec.Source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(spec.Source, "dir", "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.WarmVolume(ctx, podId, "vol1"); err != nil {
+		t.Fatalf("warm volume failed: %v", err)
+	}
+	if err := o.WarmVolume(ctx, podId, "missing"); !IsNotFound(err) {
+		t.Fatalf("expected the volume not found, got %v", err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := o.WarmVolume(cancelled, podId, "vol1"); err == nil {
+		t.Fatal("warming up with a cancelled context should fail")
+	}
+}
+
+func TestRawBlockPrewarmContainer(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is needed to format the block")
+	}
+	root, err := ioutil.TempDir("", "warm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	s := &RawBlockStorage{rootPath: root, Filesystem: "ext4", VolumeSize: 16 * 1024 * 1024}
+	if err := s.PrewarmContainer(ctx, "c1", ""); err != nil {
+		t.Fatalf("prewarm container failed: %v", err)
+	}
+	block := filepath.Join(root, "blocks", "c1")
+	fi, err := os.Stat(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 16*1024*1024 {
+		t.Fatalf("the block should be of the volume size, got %d bytes", fi.Size())
+	}
+
+	// the block made by the graph driver is kept
+	if err := ioutil.WriteFile(filepath.Join(root, "blocks", "c2"), []byte("block"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PrewarmContainer(ctx, "c2", ""); err != nil {
+		t.Fatalf("prewarm existing container failed: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "blocks", "c2")); string(data) != "block" {
+		t.Fatalf("the existing block should be kept, got %q", data)
+	}
+}
+
+func TestOverlayFsPrewarmContainer(t *testing.T) {
+	root, err := ioutil.TempDir("", "warm-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ctx := context.Background()
+	o := &OverlayFsStorage{rootPath: filepath.Join(root, "overlay"), WorkDir: filepath.Join(root, "work")}
+	if err := os.MkdirAll(filepath.Join(o.RootPath(), "image", "root", "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(o.RootPath(), "c1", "upper"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(o.RootPath(), "c1", "lower-id"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := filepath.Join(root, "shared")
+	if err := o.PrewarmContainer(ctx, "c1", shared); err != nil {
+		t.Fatalf("prewarm container failed: %v", err)
+	}
+	for _, dir := range []string{filepath.Join(shared, "c1", "rootfs"), filepath.Join(root, "work", "c1")} {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Fatalf("%s should be made, got %v", dir, err)
+		}
+	}
+	if err := o.PrewarmContainer(ctx, "c1", ""); err != nil {
+		t.Fatalf("prewarm container without a sandbox failed: %v", err)
+	}
+	if err := o.PrewarmContainer(ctx, "missing", ""); !IsNotFound(err) {
+		t.Fatalf("expected the container not found, got %v", err)
+	}
+}
@@ -0,0 +1,466 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/mount"
+	dockertypes "github.com/docker/engine-api/types"
+	"github.com/golang/glog"
+	"github.com/hyperhq/hyperd/daemon/daemondb"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	zfs "github.com/mistifyio/go-zfs"
+	"golang.org/x/net/context"
+)
+
+// ZFSStorage shares the datasets created by docker's zfs graphdriver with the
+// sandbox, and keeps the pod volumes as datasets under <Zpool>/hyper-volumes.
+type ZFSStorage struct {
+	storageEvents
+	volumeRefs
+	injectOptions
+	db       *daemondb.DaemonDB
+	Zpool    string
+	Dataset  string
+	rootPath string
+}
+
+func ZFSFactory(sysinfo *dockertypes.Info, db *daemondb.DaemonDB, config *StorageConfig) (Storage, error) {
+	driver := &ZFSStorage{
+		db:       db,
+		rootPath: config.DriverRoot("zfs"),
+	}
+	for _, pair := range sysinfo.DriverStatus {
+		switch pair[0] {
+		case "Zpool":
+			driver.Zpool = pair[1]
+		case "Parent Dataset":
+			driver.Dataset = pair[1]
+		}
+	}
+	if driver.Zpool == "" || driver.Dataset == "" {
+		return nil, fmt.Errorf("cannot get the zpool and dataset of docker from %v", sysinfo.DriverStatus)
+	}
+	return driver, nil
+}
+
+func (s *ZFSStorage) Type() string {
+	return "zfs"
+}
+
+func (s *ZFSStorage) RootPath() string {
+	return s.rootPath
+}
+
+func (s *ZFSStorage) containerDataset(id string) string {
+	return s.Dataset + "/" + id
+}
+
+func (s *ZFSStorage) volumesDataset() string {
+	return s.Zpool + "/hyper-volumes"
+}
+
+func (s *ZFSStorage) volumeDataset(podId, volName string) string {
+	return fmt.Sprintf("%s/%s-%s", s.volumesDataset(), podId, volName)
+}
+
+func (s *ZFSStorage) volumePath(podId, volName string) string {
+	return filepath.Join(s.RootPath(), "volumes", fmt.Sprintf("%s-%s", podId, volName))
+}
+
+func (s *ZFSStorage) checkZpool() error {
+	pool, err := zfs.GetZpool(s.Zpool)
+	if err != nil {
+		return fmt.Errorf("cannot get zpool %s: %v", s.Zpool, err)
+	}
+	if pool.Health != "ONLINE" {
+		return fmt.Errorf("zpool %s is not healthy: %s", s.Zpool, pool.Health)
+	}
+	return nil
+}
+
+func (s *ZFSStorage) Init(ctx context.Context) error {
+	if err := s.checkZpool(); err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Join(s.RootPath(), "volumes"), 0700); err != nil {
+		return err
+	}
+	if _, err := zfs.GetDataset(s.volumesDataset()); err != nil {
+		if _, err = zfs.CreateFilesystem(s.volumesDataset(), map[string]string{"mountpoint": "none"}); err != nil {
+			return fmt.Errorf("cannot create dataset %s: %v", s.volumesDataset(), err)
+		}
+	}
+	return nil
+}
+
+func (*ZFSStorage) CleanUp(ctx context.Context) error { return nil }
+
+func (s *ZFSStorage) HealthCheck(ctx context.Context) error {
+	return s.checkZpool()
+}
+
+func (s *ZFSStorage) WaitReady(ctx context.Context) error {
+	return nil
+}
+
+func (s *ZFSStorage) Capabilities() storage.Capabilities {
+	return storage.Capabilities{
+		SupportsSnapshots: true,
+		SupportsResize:    true,
+		SupportsQuota:     true,
+	}
+}
+
+func (s *ZFSStorage) KernelCapabilities() []string {
+	return nil
+}
+
+func (s *ZFSStorage) mountContainer(ctx context.Context, id, sharedDir string, readonly bool) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	mountPoint := filepath.Join(sharedDir, id, "rootfs")
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", err
+	}
+	options := ""
+	if readonly {
+		options = "ro"
+	}
+	if err := mount.Mount(s.containerDataset(id), mountPoint, "zfs", options); err != nil {
+		return "", fmt.Errorf("error creating zfs mount of %s to %s: %v", s.containerDataset(id), mountPoint, err)
+	}
+	return mountPoint, nil
+}
+
+// PrepareContainer mounts the dataset of the container, which docker has
+// already cloned from the image, into the shared dir.
+func (s *ZFSStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	defer s.emit(ContainerPrepared, "", mountId, &err)
+	defer s.takeVolumes(mountId, opts, &err)
+	if _, err := s.mountContainer(ctx, mountId, sharedDir, opts.ReadOnly); err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return nil, err
+	}
+
+	containerPath := "/" + mountId
+	vol := &runv.VolumeDescription{
+		Name:     containerPath,
+		Source:   containerPath,
+		Fstype:   "dir",
+		Format:   "vfs",
+		ReadOnly: opts.ReadOnly,
+	}
+
+	return vol, nil
+}
+
+func (s *ZFSStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	defer s.emit(ContainerCleanedUp, "", id, &err)
+	defer s.releaseVolumes(id, &err)
+	return mount.Unmount(filepath.Join(sharedDir, id, "rootfs"))
+}
+
+func (s *ZFSStorage) InjectFile(ctx context.Context, src io.Reader, mountId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) error {
+	mountPoint, err := s.mountContainer(ctx, mountId, baseDir, false)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return err
+	}
+	defer mount.Unmount(mountPoint)
+
+	return storage.FsInjectFile(src, mountId, target, baseDir, perm, uid, gid, xattrs, s.verifyChecksum)
+}
+
+func (s *ZFSStorage) InjectDir(ctx context.Context, src fs.FS, mountId, targetDir, baseDir string, uid, gid int) error {
+	mountPoint, err := s.mountContainer(ctx, mountId, baseDir, false)
+	if err != nil {
+		glog.Error("got error when mount container to share dir ", err.Error())
+		return err
+	}
+	defer mount.Unmount(mountPoint)
+
+	return storage.FsInjectDir(src, mountId, targetDir, baseDir, uid, gid, s.verifyChecksum)
+}
+
+func (s *ZFSStorage) ValidateVolumeSpec(spec *apitypes.UserVolume) []storage.ValidationError {
+	return nil
+}
+
+func (s *ZFSStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	defer s.emit(VolumeCreated, podId, spec.Name, &err)
+	name := s.volumeDataset(podId, spec.Name)
+	volPath := s.volumePath(podId, spec.Name)
+	if _, err := zfs.GetDataset(name); err != nil {
+		if !zfsNotFound(err) {
+			return err
+		}
+		size := spec.SizeBytes
+		if size == 0 {
+			size = uint64(storage.DEFAULT_DM_VOL_SIZE)
+		}
+		props := map[string]string{
+			"mountpoint": volPath,
+			"quota":      strconv.FormatUint(size, 10),
+		}
+		if _, err = zfs.CreateFilesystem(name, props); err != nil {
+			return fmt.Errorf("failed to create zfs dataset %s: %v", name, err)
+		}
+	}
+	glog.V(1).Infof("volume %s created with zfs as %s", spec.Name, name)
+
+	spec.Source = volPath
+	spec.Format = "vfs"
+	spec.Fstype = "dir"
+	return nil
+}
+
+func (s *ZFSStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	defer s.emit(VolumeRemoved, podId, parseVolumeRecord(record).Name, &err)
+	if s.volumeInUse(podId, record) {
+		return ErrVolumeInUse
+	}
+	dataset, err := zfs.GetDataset(s.volumeDataset(podId, parseVolumeRecord(record).Name))
+	if err != nil {
+		if zfsNotFound(err) {
+			// the dataset is gone already
+			return nil
+		}
+		return err
+	}
+	// zfs refuses to unmount, and so to destroy, a busy dataset
+	if err := dataset.Destroy(zfs.DestroyRecursive); err != nil {
+		if zerr, ok := err.(*zfs.Error); ok && strings.Contains(zerr.Stderr, "busy") {
+			glog.Warningf("volume %s of pod %s is still in use, refuse to remove it", dataset.Name, podId)
+			return ErrVolumeInUse
+		}
+		glog.Errorf("failed to destroy zfs dataset %s: %v", dataset.Name, err)
+		return err
+	}
+	return nil
+}
+
+func (s *ZFSStorage) ListVolumes(ctx context.Context, podId string) ([]*apitypes.UserVolume, error) {
+	datasets, err := zfs.Filesystems(s.volumesDataset())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		vols   []*apitypes.UserVolume
+		prefix = s.volumeDataset(podId, "")
+	)
+	for _, ds := range datasets {
+		if !strings.HasPrefix(ds.Name, prefix) {
+			continue
+		}
+		vols = append(vols, &apitypes.UserVolume{
+			Name:   strings.TrimPrefix(ds.Name, prefix),
+			Source: ds.Mountpoint,
+			Format: "vfs",
+			Fstype: "dir",
+		})
+	}
+	return vols, nil
+}
+
+// ResizeVolume updates the quota of the volume dataset, zfs refuses a quota
+// below the space the dataset already uses.
+func (s *ZFSStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) error {
+	dataset, err := zfs.GetDataset(s.volumeDataset(podId, volName))
+	if err != nil {
+		return err
+	}
+	if newSizeBytes < dataset.Used {
+		return fmt.Errorf("cannot resize volume %s of pod %s to %d bytes, %d bytes are in use", volName, podId, newSizeBytes, dataset.Used)
+	}
+	return dataset.SetProperty("quota", strconv.FormatUint(newSizeBytes, 10))
+}
+
+func (s *ZFSStorage) DefragVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) WarmVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) FreezeVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) ThawVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) CompactContainerLayer(ctx context.Context, mountId string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) UsageReport(ctx context.Context) (*StorageUsageReport, error) {
+	return nil, ErrNotSupported
+}
+
+// zfsNotFound tells whether err is the one of zfs for a missing dataset.
+func zfsNotFound(err error) bool {
+	zerr, ok := err.(*zfs.Error)
+	return ok && strings.Contains(zerr.Stderr, "does not exist")
+}
+
+func (s *ZFSStorage) VolumeExists(ctx context.Context, podId, volName string) (bool, error) {
+	if _, err := zfs.GetDataset(s.volumeDataset(podId, volName)); err != nil {
+		if zfsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *ZFSStorage) GetVolumeLabels(podId, volName string) (map[string]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ZFSStorage) SetVolumeLabels(podId, volName string, labels map[string]string) error {
+	return ErrNotSupported
+}
+
+// SnapshotVolume takes a zfs snapshot of the volume dataset. zfs snapshots
+// are consistent even while the dataset is in use, but the volume has to be
+// unused to keep the same semantic as the other drivers.
+func (s *ZFSStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	dataset, err := zfs.GetDataset(s.volumeDataset(podId, volName))
+	if err != nil {
+		return err
+	}
+	if s.volumeBusy(dataset) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to snapshot it", dataset.Name, podId)
+		return ErrVolumeInUse
+	}
+	_, err = dataset.Snapshot(snapshot, false)
+	return err
+}
+
+// RollbackVolume rolls the volume dataset back to the snapshot, which has to
+// be the latest one as the more recent snapshots are not destroyed.
+func (s *ZFSStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) error {
+	if err := validateSnapshotName(snapshot); err != nil {
+		return err
+	}
+	dataset, err := zfs.GetDataset(s.volumeDataset(podId, volName))
+	if err != nil {
+		return err
+	}
+	if s.volumeBusy(dataset) {
+		glog.Warningf("volume %s of pod %s is still in use, refuse to roll it back", dataset.Name, podId)
+		return ErrVolumeInUse
+	}
+	snap, err := zfs.GetDataset(dataset.Name + "@" + snapshot)
+	if err != nil {
+		return err
+	}
+	return snap.Rollback(false)
+}
+
+func (s *ZFSStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) ContainerStats(ctx context.Context, containerId string) (*StorageStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ZFSStorage) GetVolumeIOStats(containerId, volName string) (*VolumeIOStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ZFSStorage) AvailableBytes() (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (s *ZFSStorage) DumpState(w io.Writer) error {
+	return ErrNotSupported
+}
+
+func (s *ZFSStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (*runv.VolumeDescription, error) {
+	return nil, ErrNotSupported
+}
+
+func (s *ZFSStorage) HotUnplugVolume(ctx context.Context, podId, volName string) error {
+	return ErrNotSupported
+}
+
+// GarbageCollect destroys the datasets of the orphaned volumes with their
+// snapshots.
+func (s *ZFSStorage) GarbageCollect(ctx context.Context, activePodIDs []string) ([]string, error) {
+	datasets, err := zfs.Filesystems(s.volumesDataset())
+	if err != nil {
+		return nil, err
+	}
+	var (
+		collected []string
+		prefix    = s.volumesDataset() + "/"
+	)
+	for _, ds := range datasets {
+		name := strings.TrimPrefix(ds.Name, prefix)
+		if name == ds.Name || strings.Contains(name, "/") || !orphanedVolume(name, activePodIDs) {
+			continue
+		}
+		if s.volumeBusy(ds) {
+			glog.Warningf("orphaned volume %s is still in use, leave it", ds.Name)
+			continue
+		}
+		if err := ds.Destroy(zfs.DestroyRecursive); err != nil {
+			glog.Errorf("failed to destroy orphaned volume %s: %v", ds.Name, err)
+			continue
+		}
+		collected = append(collected, name)
+	}
+	return collected, nil
+}
+
+// volumeBusy tells whether the volume dataset is used by anything else than
+// its own mount.
+func (s *ZFSStorage) volumeBusy(dataset *zfs.Dataset) bool {
+	if mounts, err := mount.GetMounts(); err == nil {
+		for _, m := range mounts {
+			if m.Source == dataset.Name && m.Mountpoint != dataset.Mountpoint {
+				return true
+			}
+			if m.Source != dataset.Name && strings.HasPrefix(m.Mountpoint, dataset.Mountpoint+"/") {
+				return true
+			}
+		}
+	}
+	return storage.PathOpened(dataset.Mountpoint)
+}
@@ -0,0 +1,23 @@
+package daemon
+
+import (
+	"errors"
+	"testing"
+
+	zfs "github.com/mistifyio/go-zfs"
+)
+
+func TestZfsNotFound(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		notFound bool
+	}{
+		{&zfs.Error{Err: errors.New("exit status 1"), Stderr: "cannot open 'pool/hyper/vol': dataset does not exist\n"}, true},
+		{&zfs.Error{Err: errors.New("exit status 1"), Stderr: "cannot open 'pool': pool I/O is currently suspended\n"}, false},
+		{errors.New("exec: \"zfs\": executable file not found in $PATH"), false},
+	} {
+		if zfsNotFound(c.err) != c.notFound {
+			t.Errorf("expected %v to be a missing dataset: %v", c.err, c.notFound)
+		}
+	}
+}
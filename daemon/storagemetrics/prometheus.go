@@ -0,0 +1,95 @@
+// Package storagemetrics exports the operations of the hyperd storage
+// drivers to prometheus.
+package storagemetrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// circuitStates are the states of the circuit breakers of the drivers, the
+// gauge of the current one is 1 and the others 0.
+var circuitStates = []string{"closed", "open", "half-open"}
+
+// PrometheusStorageMetrics implements daemon.StorageMetrics with a histogram
+// of the operation durations labeled by driver, operation and status, and
+// gauges of the prepared containers, the inject bandwidth and the circuit
+// breaker of each driver.
+type PrometheusStorageMetrics struct {
+	durations     *prometheus.HistogramVec
+	prepares      *prometheus.GaugeVec
+	injectLimit   *prometheus.GaugeVec
+	injectedBytes *prometheus.CounterVec
+	circuitState  *prometheus.GaugeVec
+}
+
+func NewPrometheusStorageMetrics(registerer prometheus.Registerer) (*PrometheusStorageMetrics, error) {
+	m := &PrometheusStorageMetrics{
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "hyperd",
+			Subsystem: "storage",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the storage driver operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"driver", "operation", "status"}),
+		prepares: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "hyperd",
+			Subsystem: "storage",
+			Name:      "prepare_containers",
+			Help:      "Containers being prepared by the storage driver, by state running or queued.",
+		}, []string{"driver", "state"}),
+		injectLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "hyperd",
+			Subsystem: "storage",
+			Name:      "inject_limit_bytes_per_second",
+			Help:      "Limit of the bandwidth of the injected files, 0 when unlimited.",
+		}, []string{"driver"}),
+		injectedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "hyperd",
+			Subsystem: "storage",
+			Name:      "injected_bytes_total",
+			Help:      "Bytes of the files injected into the containers.",
+		}, []string{"driver"}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "hyperd",
+			Subsystem: "storage",
+			Name:      "circuit_state",
+			Help:      "State of the circuit breaker of the storage driver, 1 for the current one.",
+		}, []string{"driver", "state"}),
+	}
+	for _, c := range []prometheus.Collector{m.durations, m.prepares, m.injectLimit, m.injectedBytes, m.circuitState} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *PrometheusStorageMetrics) RecordOperation(driver, operation string, durationNs int64, err error) {
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	m.durations.WithLabelValues(driver, operation, status).Observe(time.Duration(durationNs).Seconds())
+}
+
+func (m *PrometheusStorageMetrics) RecordPrepareConcurrency(driver string, running, queued int) {
+	m.prepares.WithLabelValues(driver, "running").Set(float64(running))
+	m.prepares.WithLabelValues(driver, "queued").Set(float64(queued))
+}
+
+func (m *PrometheusStorageMetrics) RecordInjectBandwidth(driver string, limitBytesPerSec, injectedBytes int64) {
+	m.injectLimit.WithLabelValues(driver).Set(float64(limitBytesPerSec))
+	m.injectedBytes.WithLabelValues(driver).Add(float64(injectedBytes))
+}
+
+func (m *PrometheusStorageMetrics) RecordCircuitState(driver, state string) {
+	for _, s := range circuitStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.circuitState.WithLabelValues(driver, s).Set(value)
+	}
+}
@@ -0,0 +1,75 @@
+package storagemetrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather returns the metrics of the registry by name, then by their labels
+// joined by commas.
+func gather(t *testing.T, registry *prometheus.Registry) map[string]map[string]*dto.Metric {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := make(map[string]map[string]*dto.Metric)
+	for _, family := range families {
+		byLabels := make(map[string]*dto.Metric)
+		for _, metric := range family.GetMetric() {
+			labels := ""
+			for i, pair := range metric.GetLabel() {
+				if i > 0 {
+					labels += ","
+				}
+				labels += pair.GetValue()
+			}
+			byLabels[labels] = metric
+		}
+		metrics[family.GetName()] = byLabels
+	}
+	return metrics
+}
+
+func TestPrometheusStorageMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := NewPrometheusStorageMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPrometheusStorageMetrics(registry); err == nil {
+		t.Fatal("the metrics should not be registered twice")
+	}
+
+	m.RecordOperation("rawblock", "CreateVolume", int64(2*time.Millisecond), nil)
+	m.RecordOperation("rawblock", "CreateVolume", int64(time.Second), errors.New("failed"))
+	m.RecordPrepareConcurrency("rawblock", 2, 3)
+	m.RecordInjectBandwidth("rawblock", 1024, 100)
+	m.RecordInjectBandwidth("rawblock", 1024, 50)
+	m.RecordCircuitState("rawblock", "open")
+
+	metrics := gather(t, registry)
+	durations := metrics["hyperd_storage_operation_duration_seconds"]
+	for _, labels := range []string{"rawblock,CreateVolume,success", "rawblock,CreateVolume,error"} {
+		if durations[labels].GetHistogram().GetSampleCount() != 1 {
+			t.Fatalf("expected an operation %s, got %v", labels, durations[labels])
+		}
+	}
+	for name, want := range map[string]map[string]float64{
+		"hyperd_storage_prepare_containers":            {"rawblock,running": 2, "rawblock,queued": 3},
+		"hyperd_storage_inject_limit_bytes_per_second": {"rawblock": 1024},
+		"hyperd_storage_circuit_state":                 {"rawblock,open": 1, "rawblock,closed": 0, "rawblock,half-open": 0},
+	} {
+		for labels, value := range want {
+			if got := metrics[name][labels].GetGauge().GetValue(); got != value {
+				t.Fatalf("expected %s{%s} %v, got %v", name, labels, value, got)
+			}
+		}
+	}
+	if got := metrics["hyperd_storage_injected_bytes_total"]["rawblock"].GetCounter().GetValue(); got != 150 {
+		t.Fatalf("expected 150 injected bytes, got %v", got)
+	}
+}
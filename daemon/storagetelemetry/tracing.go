@@ -0,0 +1,277 @@
+// Package storagetelemetry traces the operations of the hyperd storage
+// drivers with OpenTelemetry. Importing it registers NewTracedStorage as the
+// StorageTracer of the daemon, which then traces the drivers configured with
+// a Tracer.
+package storagetelemetry
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/hyperhq/hyperd/daemon"
+	"github.com/hyperhq/hyperd/storage"
+	apitypes "github.com/hyperhq/hyperd/types"
+	runv "github.com/hyperhq/runv/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// TracedStorage starts a span for every operation of the wrapped Storage, as
+// a child of the span of the context handed to the operation if any. The
+// accessors, which take no context and do not touch the disk, are not
+// traced; the labels of the volumes are traced from root spans.
+type TracedStorage struct {
+	daemon.Storage
+	tracer trace.Tracer
+}
+
+func NewTracedStorage(inner daemon.Storage, tracer trace.Tracer) daemon.Storage {
+	return &TracedStorage{
+		Storage: inner,
+		tracer:  tracer,
+	}
+}
+
+func init() {
+	daemon.RegisterStorageTracer(NewTracedStorage)
+}
+
+// ids are what an operation works on, the empty ones are not set on its span.
+type ids struct {
+	podId, containerId, volName string
+}
+
+// start starts the span of the operation, and returns the context of the
+// span and the function ending it, to be deferred with the named error
+// result of the operation:
+//
+//	ctx, end := t.start(ctx, "Op", ids{...})
+//	defer end(&err)
+func (t *TracedStorage) start(ctx context.Context, operation string, on ids) (context.Context, func(*error)) {
+	attrs := []attribute.KeyValue{
+		attribute.String("storage.driver", t.Type()),
+		attribute.String("storage.operation", operation),
+	}
+	if on.podId != "" {
+		attrs = append(attrs, attribute.String("storage.pod_id", on.podId))
+	}
+	if on.containerId != "" {
+		attrs = append(attrs, attribute.String("storage.container_id", on.containerId))
+	}
+	if on.volName != "" {
+		attrs = append(attrs, attribute.String("storage.volume_name", on.volName))
+	}
+	spanCtx, span := t.tracer.Start(ctx, "storage."+operation, trace.WithAttributes(attrs...))
+	return spanCtx, func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		} else {
+			span.SetStatus(codes.Ok, "")
+		}
+		span.End()
+	}
+}
+
+func (t *TracedStorage) Init(ctx context.Context) (err error) {
+	ctx, end := t.start(ctx, "Init", ids{})
+	defer end(&err)
+	return t.Storage.Init(ctx)
+}
+
+func (t *TracedStorage) CleanUp(ctx context.Context) (err error) {
+	ctx, end := t.start(ctx, "CleanUp", ids{})
+	defer end(&err)
+	return t.Storage.CleanUp(ctx)
+}
+
+func (t *TracedStorage) HealthCheck(ctx context.Context) (err error) {
+	ctx, end := t.start(ctx, "HealthCheck", ids{})
+	defer end(&err)
+	return t.Storage.HealthCheck(ctx)
+}
+
+func (t *TracedStorage) WaitReady(ctx context.Context) (err error) {
+	ctx, end := t.start(ctx, "WaitReady", ids{})
+	defer end(&err)
+	return t.Storage.WaitReady(ctx)
+}
+
+func (t *TracedStorage) PrepareContainer(ctx context.Context, mountId, sharedDir string, opts storage.ContainerOptions) (_ *runv.VolumeDescription, err error) {
+	ctx, end := t.start(ctx, "PrepareContainer", ids{podId: opts.PodID, containerId: mountId})
+	defer end(&err)
+	return t.Storage.PrepareContainer(ctx, mountId, sharedDir, opts)
+}
+
+func (t *TracedStorage) PrewarmContainer(ctx context.Context, mountId, sharedDir string) (err error) {
+	ctx, end := t.start(ctx, "PrewarmContainer", ids{containerId: mountId})
+	defer end(&err)
+	return t.Storage.PrewarmContainer(ctx, mountId, sharedDir)
+}
+
+func (t *TracedStorage) CleanupContainer(ctx context.Context, id, sharedDir string) (err error) {
+	ctx, end := t.start(ctx, "CleanupContainer", ids{containerId: id})
+	defer end(&err)
+	return t.Storage.CleanupContainer(ctx, id, sharedDir)
+}
+
+func (t *TracedStorage) InjectFile(ctx context.Context, src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte) (err error) {
+	ctx, end := t.start(ctx, "InjectFile", ids{containerId: containerId})
+	defer end(&err)
+	return t.Storage.InjectFile(ctx, src, containerId, target, baseDir, perm, uid, gid, xattrs)
+}
+
+func (t *TracedStorage) InjectDir(ctx context.Context, src fs.FS, containerId, targetDir, baseDir string, uid, gid int) (err error) {
+	ctx, end := t.start(ctx, "InjectDir", ids{containerId: containerId})
+	defer end(&err)
+	return t.Storage.InjectDir(ctx, src, containerId, targetDir, baseDir, uid, gid)
+}
+
+func (t *TracedStorage) CreateVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (err error) {
+	ctx, end := t.start(ctx, "CreateVolume", ids{podId: podId, volName: spec.Name})
+	defer end(&err)
+	return t.Storage.CreateVolume(ctx, podId, spec)
+}
+
+// RemoveVolume leaves the volume name out of its span, it is only known from
+// the record, whose format belongs to the driver.
+func (t *TracedStorage) RemoveVolume(ctx context.Context, podId string, record []byte) (err error) {
+	ctx, end := t.start(ctx, "RemoveVolume", ids{podId: podId})
+	defer end(&err)
+	return t.Storage.RemoveVolume(ctx, podId, record)
+}
+
+func (t *TracedStorage) ListVolumes(ctx context.Context, podId string) (_ []*apitypes.UserVolume, err error) {
+	ctx, end := t.start(ctx, "ListVolumes", ids{podId: podId})
+	defer end(&err)
+	return t.Storage.ListVolumes(ctx, podId)
+}
+
+func (t *TracedStorage) ResizeVolume(ctx context.Context, podId, volName string, newSizeBytes uint64) (err error) {
+	ctx, end := t.start(ctx, "ResizeVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.ResizeVolume(ctx, podId, volName, newSizeBytes)
+}
+
+func (t *TracedStorage) VolumeExists(ctx context.Context, podId, volName string) (_ bool, err error) {
+	ctx, end := t.start(ctx, "VolumeExists", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.VolumeExists(ctx, podId, volName)
+}
+
+func (t *TracedStorage) DefragVolume(ctx context.Context, podId, volName string) (err error) {
+	ctx, end := t.start(ctx, "DefragVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.DefragVolume(ctx, podId, volName)
+}
+
+func (t *TracedStorage) WarmVolume(ctx context.Context, podId, volName string) (err error) {
+	ctx, end := t.start(ctx, "WarmVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.WarmVolume(ctx, podId, volName)
+}
+
+func (t *TracedStorage) GetVolumeLabels(podId, volName string) (_ map[string]string, err error) {
+	_, end := t.start(context.Background(), "GetVolumeLabels", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.GetVolumeLabels(podId, volName)
+}
+
+func (t *TracedStorage) SetVolumeLabels(podId, volName string, labels map[string]string) (err error) {
+	_, end := t.start(context.Background(), "SetVolumeLabels", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.SetVolumeLabels(podId, volName, labels)
+}
+
+func (t *TracedStorage) SnapshotVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	ctx, end := t.start(ctx, "SnapshotVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.SnapshotVolume(ctx, podId, volName, snapshot)
+}
+
+func (t *TracedStorage) RollbackVolume(ctx context.Context, podId, volName, snapshot string) (err error) {
+	ctx, end := t.start(ctx, "RollbackVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.RollbackVolume(ctx, podId, volName, snapshot)
+}
+
+func (t *TracedStorage) FreezeVolume(ctx context.Context, podId, volName string) (err error) {
+	ctx, end := t.start(ctx, "FreezeVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.FreezeVolume(ctx, podId, volName)
+}
+
+func (t *TracedStorage) ThawVolume(ctx context.Context, podId, volName string) (err error) {
+	ctx, end := t.start(ctx, "ThawVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.ThawVolume(ctx, podId, volName)
+}
+
+// CloneVolume sets the destination volume on its span.
+func (t *TracedStorage) CloneVolume(ctx context.Context, srcPodId, srcVolName, dstPodId, dstVolName string) (err error) {
+	ctx, end := t.start(ctx, "CloneVolume", ids{podId: dstPodId, volName: dstVolName})
+	defer end(&err)
+	return t.Storage.CloneVolume(ctx, srcPodId, srcVolName, dstPodId, dstVolName)
+}
+
+func (t *TracedStorage) ExportVolume(ctx context.Context, podId, volName string, dst io.Writer) (err error) {
+	ctx, end := t.start(ctx, "ExportVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.ExportVolume(ctx, podId, volName, dst)
+}
+
+func (t *TracedStorage) ImportVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	ctx, end := t.start(ctx, "ImportVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.ImportVolume(ctx, podId, volName, src)
+}
+
+func (t *TracedStorage) ExportIncrementalVolume(ctx context.Context, podId, volName, sinceSnapshot string, dst io.Writer) (err error) {
+	ctx, end := t.start(ctx, "ExportIncrementalVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.ExportIncrementalVolume(ctx, podId, volName, sinceSnapshot, dst)
+}
+
+func (t *TracedStorage) ImportIncrementalVolume(ctx context.Context, podId, volName string, src io.Reader) (err error) {
+	ctx, end := t.start(ctx, "ImportIncrementalVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.ImportIncrementalVolume(ctx, podId, volName, src)
+}
+
+func (t *TracedStorage) HotPlugVolume(ctx context.Context, podId string, spec *apitypes.UserVolume) (_ *runv.VolumeDescription, err error) {
+	ctx, end := t.start(ctx, "HotPlugVolume", ids{podId: podId, volName: spec.Name})
+	defer end(&err)
+	return t.Storage.HotPlugVolume(ctx, podId, spec)
+}
+
+func (t *TracedStorage) HotUnplugVolume(ctx context.Context, podId, volName string) (err error) {
+	ctx, end := t.start(ctx, "HotUnplugVolume", ids{podId: podId, volName: volName})
+	defer end(&err)
+	return t.Storage.HotUnplugVolume(ctx, podId, volName)
+}
+
+func (t *TracedStorage) ContainerStats(ctx context.Context, containerId string) (_ *daemon.StorageStats, err error) {
+	ctx, end := t.start(ctx, "ContainerStats", ids{containerId: containerId})
+	defer end(&err)
+	return t.Storage.ContainerStats(ctx, containerId)
+}
+
+func (t *TracedStorage) CompactContainerLayer(ctx context.Context, mountId string) (err error) {
+	ctx, end := t.start(ctx, "CompactContainerLayer", ids{containerId: mountId})
+	defer end(&err)
+	return t.Storage.CompactContainerLayer(ctx, mountId)
+}
+
+func (t *TracedStorage) UsageReport(ctx context.Context) (_ *daemon.StorageUsageReport, err error) {
+	ctx, end := t.start(ctx, "UsageReport", ids{})
+	defer end(&err)
+	return t.Storage.UsageReport(ctx)
+}
+
+func (t *TracedStorage) GarbageCollect(ctx context.Context, activePodIDs []string) (_ []string, err error) {
+	ctx, end := t.start(ctx, "GarbageCollect", ids{})
+	defer end(&err)
+	return t.Storage.GarbageCollect(ctx, activePodIDs)
+}
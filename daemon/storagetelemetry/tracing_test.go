@@ -0,0 +1,111 @@
+package storagetelemetry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hyperhq/hyperd/daemon"
+	apitypes "github.com/hyperhq/hyperd/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	netcontext "golang.org/x/net/context"
+)
+
+// recordingTracer keeps the spans it starts, over the noop ones of otel.
+type recordingTracer struct {
+	trace.Tracer
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	trace.Span
+	name   string
+	attrs  map[attribute.Key]string
+	status codes.Code
+	ended  bool
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	span := &recordingSpan{
+		Span:  trace.SpanFromContext(ctx),
+		name:  name,
+		attrs: make(map[attribute.Key]string),
+	}
+	for _, kv := range cfg.Attributes() {
+		span.attrs[kv.Key] = kv.Value.AsString()
+	}
+	r.spans = append(r.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func (s *recordingSpan) SetStatus(code codes.Code, description string) {
+	s.status = code
+}
+
+func (s *recordingSpan) RecordError(err error, options ...trace.EventOption) {}
+
+func (s *recordingSpan) End(options ...trace.SpanEndOption) {
+	s.ended = true
+}
+
+// volumeStorage fails to create the volumes named "fail", the span the
+// operation runs in is kept.
+type volumeStorage struct {
+	daemon.Storage
+	span trace.Span
+}
+
+func (s *volumeStorage) Type() string {
+	return "fake"
+}
+
+func (s *volumeStorage) CreateVolume(ctx netcontext.Context, podId string, spec *apitypes.UserVolume) error {
+	s.span = trace.SpanFromContext(ctx)
+	if spec.Name == "fail" {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func TestTracedStorage(t *testing.T) {
+	tracer := &recordingTracer{Tracer: trace.NewNoopTracerProvider().Tracer("")}
+	inner := &volumeStorage{}
+	s := NewTracedStorage(inner, tracer)
+
+	if err := s.CreateVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "vol1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateVolume(context.Background(), "pod", &apitypes.UserVolume{Name: "fail"}); err == nil {
+		t.Fatal("the error of the driver should be returned")
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected a span per operation, got %d", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if span.name != "storage.CreateVolume" || !span.ended || span.status != codes.Ok {
+		t.Fatalf("unexpected span %s, ended %v, status %v", span.name, span.ended, span.status)
+	}
+	for key, val := range map[attribute.Key]string{
+		"storage.driver":      "fake",
+		"storage.operation":   "CreateVolume",
+		"storage.pod_id":      "pod",
+		"storage.volume_name": "vol1",
+	} {
+		if span.attrs[key] != val {
+			t.Fatalf("expected the attribute %s=%s, got %q", key, val, span.attrs[key])
+		}
+	}
+	if _, ok := span.attrs["storage.container_id"]; ok {
+		t.Fatal("the container is not set on the span of a volume")
+	}
+	if inner.span != tracer.spans[1] {
+		t.Fatal("the driver should run in the span of the operation")
+	}
+	if tracer.spans[1].status != codes.Error {
+		t.Fatalf("the failed operation should have the error status, got %v", tracer.spans[1].status)
+	}
+}
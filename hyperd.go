@@ -12,6 +12,7 @@ import (
 	"github.com/docker/docker/pkg/reexec"
 	"github.com/golang/glog"
 	"github.com/hyperhq/hyperd/daemon"
+	_ "github.com/hyperhq/hyperd/daemon/storagetelemetry"
 	"github.com/hyperhq/hyperd/server"
 	"github.com/hyperhq/hyperd/serverrpc"
 	"github.com/hyperhq/hyperd/types"
@@ -26,6 +27,7 @@ type Options struct {
 	Hosts              string
 	Mirrors            string
 	InsecureRegistries string
+	StorageFsck        bool
 }
 
 func main() {
@@ -50,6 +52,7 @@ func main() {
 	flHost := flag.String("host", "", "Host for hyperd")
 	flMirrors := flag.String("registry_mirror", "", "Prefered docker registry mirror")
 	flInsecureRegistries := flag.String("insecure_registry", "", "Enable insecure registry communication")
+	flStorageFsck := flag.Bool("storage-fsck", false, "Repair the filesystems of the storage volumes at startup")
 	flHelp := flag.Bool("help", false, "Print help message for Hyperd daemon")
 	flag.Set("log_dir", "/var/log/hyper/")
 	os.MkdirAll("/var/log/hyper/", 0755)
@@ -70,6 +73,7 @@ func main() {
 		Hosts:              *flHost,
 		Mirrors:            *flMirrors,
 		InsecureRegistries: *flInsecureRegistries,
+		StorageFsck:        *flStorageFsck,
 	}
 
 	mainDaemon(opt)
@@ -86,6 +90,7 @@ Application Options:
   --host                 Host address and port for hyperd(such as --host=tcp://127.0.0.1:12345)
   --registry_mirror      Prefered docker registry mirror, multiple values separated by a comma
   --insecure_registry    Enable insecure registry communication, multiple values separated by a comma
+  --storage-fsck         Repair the filesystems of the storage volumes at startup
   --logtostderr          Log to standard error instead of files
   --alsologtostderr      Log to standard error as well as files
 
@@ -102,6 +107,7 @@ func mainDaemon(opt *Options) {
 		return
 	}
 	c.DisableIptables = c.DisableIptables || opt.DisableIptables
+	c.StorageFsck = c.StorageFsck || opt.StorageFsck
 
 	c.AdvertiseEnv()
 	if _, err := os.Stat(c.Root); err != nil {
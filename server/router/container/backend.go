@@ -6,11 +6,15 @@ import (
 	"github.com/docker/engine-api/types"
 	"github.com/hyperhq/hyperd/daemon"
 	"github.com/hyperhq/hyperd/engine"
+	"golang.org/x/net/context"
 )
 
 type Backend interface {
 	CmdGetContainerInfo(container string) (interface{}, error)
 	CmdGetContainerLogs(name string, c *daemon.ContainerLogsConfig) error
+	CmdContainerStorageStats(ctx context.Context, container string) (*daemon.StorageStats, error)
+	CmdContainerVolumeIOStats(ctx context.Context, container string) (map[string]*daemon.VolumeIOStats, error)
+	CmdCompactContainerLayer(ctx context.Context, container string) (*engine.Env, error)
 	CmdExitCode(container, tag string) (int, error)
 	CmdCreateContainer(podId string, containerArgs []byte) (string, error)
 	CmdStartContainer(containerId string) (*engine.Env, error)
@@ -31,6 +31,8 @@ func (r *containerRouter) initRoutes() {
 		// GET
 		local.NewGetRoute("/container/info", r.getContainerInfo),
 		local.NewGetRoute("/container/logs", r.getContainerLogs),
+		local.NewGetRoute("/container/storage", r.getContainerStorageStats),
+		local.NewGetRoute("/containers/{id}/volumes/stats", r.getContainerVolumeIOStats),
 		local.NewGetRoute("/exitcode", r.getExitCode),
 		// POST
 		local.NewPostRoute("/container/create", r.postContainerCreate),
@@ -39,6 +41,7 @@ func (r *containerRouter) initRoutes() {
 		local.NewPostRoute("/container/commit", r.postContainerCommit),
 		local.NewPostRoute("/container/stop", r.postContainerStop),
 		local.NewPostRoute("/container/remove", r.postContainerRemove),
+		local.NewPostRoute("/container/compact", r.postContainerCompact),
 		local.NewPostRoute("/container/kill", r.postContainerKill),
 		local.NewPostRoute("/exec/create", r.postContainerExecCreate),
 		local.NewPostRoute("/exec/start", r.postContainerExecStart),
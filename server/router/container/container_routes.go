@@ -34,6 +34,32 @@ func (c *containerRouter) getContainerInfo(ctx context.Context, w http.ResponseW
 	return httputils.WriteJSON(w, http.StatusOK, data)
 }
 
+// getContainerStorageStats reports the disk usage of the writable layer of the
+// container.
+func (c *containerRouter) getContainerStorageStats(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	stats, err := c.backend.CmdContainerStorageStats(ctx, r.Form.Get("container"))
+	if err != nil {
+		return err
+	}
+
+	return httputils.WriteJSON(w, http.StatusOK, stats)
+}
+
+// getContainerVolumeIOStats reports the I/O of the container to each of its
+// volumes, by volume name.
+func (c *containerRouter) getContainerVolumeIOStats(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	stats, err := c.backend.CmdContainerVolumeIOStats(ctx, vars["id"])
+	if err != nil {
+		return err
+	}
+
+	return httputils.WriteJSON(w, http.StatusOK, stats)
+}
+
 func (c *containerRouter) getContainerLogs(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := httputils.ParseForm(r); err != nil {
 		return err
@@ -181,6 +207,21 @@ func (c *containerRouter) postContainerStop(ctx context.Context, w http.Response
 	return env.WriteJSON(w, http.StatusOK)
 }
 
+// postContainerCompact compacts the writable layer of the container, its pod
+// must not be running.
+func (c *containerRouter) postContainerCompact(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	env, err := c.backend.CmdCompactContainerLayer(ctx, r.Form.Get("container"))
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
 func (c *containerRouter) postContainerRemove(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := httputils.ParseForm(r); err != nil {
 		return err
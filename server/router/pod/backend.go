@@ -1,7 +1,11 @@
 package pod
 
 import (
+	"io"
+	"time"
+
 	"github.com/hyperhq/hyperd/engine"
+	apitypes "github.com/hyperhq/hyperd/types"
 )
 
 // Backend is the methods that need to be implemented to provide
@@ -11,6 +15,15 @@ type Backend interface {
 	CmdGetPodStats(podId string) (interface{}, error)
 	CmdCreatePod(podArgs string) (*engine.Env, error)
 	CmdSetPodLabels(podId string, override bool, labels map[string]string) (*engine.Env, error)
+	CmdResizeVolume(podId, volName string, size uint64) (*engine.Env, error)
+	CmdDefragVolume(podId, volName string) (*engine.Env, error)
+	CmdExportIncrementalVolume(podId, volName, sinceSnapshot string, dst io.Writer) error
+	CmdImportIncrementalVolume(podId, volName string, src io.Reader) (*engine.Env, error)
+	CmdHotPlugVolume(podId string, spec *apitypes.UserVolume) (*engine.Env, error)
+	CmdHotUnplugVolume(podId, volName string) (*engine.Env, error)
+	CmdSetVolumeExpiry(podId, volName string, expiresAt time.Time) (*engine.Env, error)
+	CmdSetVolumeLabels(podId, volName string, labels map[string]string) (*engine.Env, error)
+	CmdListVolumes(podId string, labels map[string]string) (interface{}, error)
 	CmdStartPod(podId string) (*engine.Env, error)
 	CmdPausePod(podId string) error
 	CmdUnpausePod(podId string) error
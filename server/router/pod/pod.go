@@ -21,10 +21,18 @@ func NewRouter(b Backend) router.Router {
 		// GET
 		local.NewGetRoute("/pod/info", r.getPodInfo),
 		local.NewGetRoute("/pod/stats", r.getPodStats),
+		local.NewGetRoute("/pod/volume/list", r.getPodVolumeList),
+		local.NewGetRoute("/volumes/{podId}/{name}/delta", r.getVolumeDelta),
 		local.NewGetRoute("/list", r.getList),
 		// POST
 		local.NewPostRoute("/pod/create", r.postPodCreate),
 		local.NewPostRoute("/pod/labels", r.postPodLabels),
+		local.NewPostRoute("/pod/volume/resize", r.postPodVolumeResize),
+		local.NewPostRoute("/pod/volume/expiry", r.postPodVolumeExpiry),
+		local.NewPostRoute("/pod/volume/labels", r.postPodVolumeLabels),
+		local.NewPostRoute("/volumes/{podId}/{name}/defrag", r.postVolumeDefrag),
+		local.NewPostRoute("/volumes/{podId}/{name}/delta", r.postVolumeDelta),
+		local.NewPostRoute("/pods/{id}/volumes", r.postPodVolume),
 		local.NewPostRoute("/pod/start", r.postPodStart),
 		local.NewPostRoute("/pod/stop", r.postPodStop),
 		local.NewPostRoute("/pod/kill", r.postPodKill),
@@ -33,6 +41,7 @@ func NewRouter(b Backend) router.Router {
 		// PUT
 		// DELETE
 		local.NewDeleteRoute("/pod", r.deletePod),
+		local.NewDeleteRoute("/pods/{id}/volumes/{name}", r.deletePodVolume),
 	}
 
 	return r
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/hyperhq/hyperd/server/httputils"
+	apitypes "github.com/hyperhq/hyperd/types"
 	"golang.org/x/net/context"
 )
 
@@ -36,6 +39,28 @@ func (p *podRouter) getPodStats(ctx context.Context, w http.ResponseWriter, r *h
 	return httputils.WriteJSON(w, http.StatusOK, data)
 }
 
+// getPodVolumeList lists the volumes of the pod, or of all the pods without
+// podId, carrying all the labels given as a json object.
+func (p *podRouter) getPodVolumeList(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	labels := make(map[string]string)
+	if value := r.Form.Get("labels"); value != "" {
+		if err := json.Unmarshal([]byte(value), &labels); err != nil {
+			return err
+		}
+	}
+
+	data, err := p.backend.CmdListVolumes(r.Form.Get("podId"), labels)
+	if err != nil {
+		return err
+	}
+
+	return httputils.WriteJSON(w, http.StatusOK, data)
+}
+
 func (p *podRouter) getList(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := httputils.ParseForm(r); err != nil {
 		return err
@@ -100,6 +125,129 @@ func (p *podRouter) postPodLabels(ctx context.Context, w http.ResponseWriter, r
 	return env.WriteJSON(w, http.StatusCreated)
 }
 
+func (p *podRouter) postPodVolumeResize(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	size, err := strconv.ParseUint(r.Form.Get("size"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	env, err := p.backend.CmdResizeVolume(r.Form.Get("podId"), r.Form.Get("volume"), size)
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
+// postVolumeDefrag defragments the volume, the pod must not be running.
+func (p *podRouter) postVolumeDefrag(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	env, err := p.backend.CmdDefragVolume(vars["podId"], vars["name"])
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
+// getVolumeDelta streams the changes of the volume since the snapshot of the
+// since parameter.
+func (p *podRouter) getVolumeDelta(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	return p.backend.CmdExportIncrementalVolume(vars["podId"], vars["name"], r.Form.Get("since"), w)
+}
+
+// postVolumeDelta applies the changes of the body, as streamed by
+// getVolumeDelta, to the volume.
+func (p *podRouter) postVolumeDelta(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	env, err := p.backend.CmdImportIncrementalVolume(vars["podId"], vars["name"], r.Body)
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
+// postPodVolume plugs the volume of the JSON body into the running pod.
+func (p *podRouter) postPodVolume(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.CheckForJSON(r); err != nil {
+		return err
+	}
+
+	var spec apitypes.UserVolume
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		return err
+	}
+
+	env, err := p.backend.CmdHotPlugVolume(vars["id"], &spec)
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusCreated)
+}
+
+// deletePodVolume unplugs the volume from the running pod and removes it.
+func (p *podRouter) deletePodVolume(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	env, err := p.backend.CmdHotUnplugVolume(vars["id"], vars["name"])
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
+// postPodVolumeExpiry sets the time the volume is removed at, as RFC 3339,
+// an empty expiresAt keeps the volume.
+func (p *podRouter) postPodVolumeExpiry(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	var expiresAt time.Time
+	if value := r.Form.Get("expiresAt"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+		expiresAt = t
+	}
+
+	env, err := p.backend.CmdSetVolumeExpiry(r.Form.Get("podId"), r.Form.Get("volume"), expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
+// postPodVolumeLabels replaces the labels of the volume with the json object
+// of labels.
+func (p *podRouter) postPodVolumeLabels(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := httputils.ParseForm(r); err != nil {
+		return err
+	}
+
+	labels := make(map[string]string)
+	if err := json.Unmarshal([]byte(r.Form.Get("labels")), &labels); err != nil {
+		return err
+	}
+
+	env, err := p.backend.CmdSetVolumeLabels(r.Form.Get("podId"), r.Form.Get("volume"), labels)
+	if err != nil {
+		return err
+	}
+
+	return env.WriteJSON(w, http.StatusOK)
+}
+
 func (p *podRouter) postPodStart(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	if err := httputils.ParseForm(r); err != nil {
 		return err
@@ -1,9 +1,12 @@
 package system
 
 import (
+	"io"
+
 	"github.com/docker/engine-api/types"
 	"github.com/hyperhq/hyperd/engine"
 	apitypes "github.com/hyperhq/hyperd/types"
+	"golang.org/x/net/context"
 )
 
 // Backend is the methods that need to be implemented to provide
@@ -12,4 +15,8 @@ type Backend interface {
 	CmdSystemInfo() (*apitypes.InfoResponse, error)
 	CmdSystemVersion() *engine.Env
 	CmdAuthenticateToRegistry(authConfig *types.AuthConfig) (string, error)
+	CmdStorageHealthCheck(ctx context.Context) error
+	CmdStorageGC(ctx context.Context) (interface{}, error)
+	CmdStorageUsage(ctx context.Context) (interface{}, error)
+	CmdStorageDumpState(w io.Writer) error
 }
@@ -23,7 +23,11 @@ func NewRouter(b Backend) router.Router {
 		local.NewGetRoute("/_ping", pingHandler),
 		local.NewGetRoute("/info", r.getInfo),
 		local.NewGetRoute("/version", r.getVersion),
+		local.NewGetRoute("/health", r.getHealth),
 		local.NewPostRoute("/auth", r.postAuth),
+		local.NewPostRoute("/storage/gc", r.postStorageGC),
+		local.NewGetRoute("/storage/usage", r.getStorageUsage),
+		local.NewGetRoute("/debug/storage", r.getStorageDump),
 	}
 
 	return r
@@ -1,10 +1,12 @@
 package system
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 
 	"github.com/docker/engine-api/types"
+	"github.com/hyperhq/hyperd/daemon"
 	"github.com/hyperhq/hyperd/engine"
 	"github.com/hyperhq/hyperd/server/httputils"
 	"golang.org/x/net/context"
@@ -52,6 +54,55 @@ func (s *systemRouter) getVersion(ctx context.Context, w http.ResponseWriter, r
 	return env.WriteJSON(w, http.StatusOK)
 }
 
+// getHealth reports the health of the storage driver, with the status code
+// 503 when it is not healthy.
+func (s *systemRouter) getHealth(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	env := &engine.Env{}
+	code := http.StatusOK
+	if err := s.backend.CmdStorageHealthCheck(ctx); err != nil {
+		env.Set("Storage", err.Error())
+		code = http.StatusServiceUnavailable
+	} else {
+		env.Set("Storage", "OK")
+	}
+	return env.WriteJSON(w, code)
+}
+
+// postStorageGC collects the orphaned volumes of the storage driver, with the
+// status code 202 when a collection is already running.
+func (s *systemRouter) postStorageGC(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	report, err := s.backend.CmdStorageGC(ctx)
+	if err == daemon.ErrGCRunning {
+		env := &engine.Env{}
+		env.Set("Cause", err.Error())
+		return env.WriteJSON(w, http.StatusAccepted)
+	} else if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, report)
+}
+
+// getStorageUsage reports the disk usage of the storage driver by pod.
+func (s *systemRouter) getStorageUsage(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	report, err := s.backend.CmdStorageUsage(ctx)
+	if err != nil {
+		return err
+	}
+	return httputils.WriteJSON(w, http.StatusOK, report)
+}
+
+// getStorageDump writes the state of the storage driver, for debugging.
+func (s *systemRouter) getStorageDump(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var buf bytes.Buffer
+	if err := s.backend.CmdStorageDumpState(&buf); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
 func (s *systemRouter) postAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
 	var config *types.AuthConfig
 	err := json.NewDecoder(r.Body).Decode(&config)
@@ -22,6 +22,7 @@ import (
 	"github.com/hyperhq/hyperd/server/router/system"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/context"
 )
 
@@ -195,6 +196,8 @@ func (s *Server) createMux() *mux.Router {
 	if utils.IsDebugEnabled() {
 		profilerSetup(m, "/debug/")
 	}
+	// the metrics of the storage driver, when exported, see StorageMetrics
+	m.Path("/metrics").Methods("GET").Handler(promhttp.Handler())
 
 	glog.V(3).Infof("Registering routers")
 	for _, apiRouter := range s.routers {
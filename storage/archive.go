@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// xattrPAXPrefix prefixes the extended attributes in the PAX records of the
+// archive entries, as GNU tar does.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// TarDir writes the tree of dir to dst as a tar archive, keeping the modes,
+// the owners, the symlinks and the hard links. The entries are named
+// relatively to dir, which is the "." entry.
+func TarDir(ctx context.Context, dir string, dst io.Writer) error {
+	return tarDir(ctx, dir, dst, false)
+}
+
+// TarDirWithXattrs is TarDir which keeps the extended attributes of the
+// entries as well, but those of the symlinks.
+func TarDirWithXattrs(ctx context.Context, dir string, dst io.Writer) error {
+	return tarDir(ctx, dir, dst, true)
+}
+
+func tarDir(ctx context.Context, dir string, dst io.Writer, withXattrs bool) error {
+	tw := tar.NewWriter(dst)
+	links := make(map[uint64]string)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// FileInfoHeader fills the owner in from the stat, keep the ids only
+		hdr.Uname, hdr.Gname = "", ""
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[st.Ino] = rel
+			}
+		}
+		if withXattrs && hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink {
+			xattrs, err := Xattrs(p)
+			if err != nil {
+				return err
+			}
+			for name, value := range xattrs {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords[xattrPAXPrefix+name] = string(value)
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// archivePath returns the path of the entry name under dir, refusing the
+// names which would escape it.
+func archivePath(dir, name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid archive entry %q", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// resolvedWithin fails unless p is under dir once the symlinks are resolved.
+func resolvedWithin(dir, p string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+		return fmt.Errorf("archive entry %s is out of %s", p, dir)
+	}
+	return nil
+}
+
+// mkdev encodes the device number the way glibc makedev does.
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// UntarDir extracts the tar archive of src, as written by TarDir, into the
+// existing directory dir. The extended attributes of the archive are ignored.
+func UntarDir(ctx context.Context, src io.Reader, dir string) error {
+	return untarDir(ctx, src, dir, false)
+}
+
+// UntarDirWithXattrs is UntarDir which sets the extended attributes of the
+// archive, as written by TarDirWithXattrs, on the entries. It is meant for the
+// archives the daemon wrote itself, those may hold trusted attributes.
+func UntarDirWithXattrs(ctx context.Context, src io.Reader, dir string) error {
+	return untarDir(ctx, src, dir, true)
+}
+
+func untarDir(ctx context.Context, src io.Reader, dir string, withXattrs bool) error {
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		target, err := archivePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target != filepath.Clean(dir) {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			// a symlink of the archive could lead the entries out of dir
+			if err := resolvedWithin(dir, filepath.Dir(target)); err != nil {
+				return err
+			}
+		}
+
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, mode); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			first, err := archivePath(dir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := resolvedWithin(dir, filepath.Dir(first)); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(first, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			devMode := uint32(syscall.S_IFIFO)
+			if hdr.Typeflag == tar.TypeChar {
+				devMode = syscall.S_IFCHR
+			} else if hdr.Typeflag == tar.TypeBlock {
+				devMode = syscall.S_IFBLK
+			}
+			os.Remove(target)
+			if err := syscall.Mknod(target, devMode|uint32(mode.Perm()), mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry %s of type %c", hdr.Name, hdr.Typeflag)
+		}
+
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			// the mode given to open and mkdir is masked by the umask, and
+			// chown drops the setuid bits
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		}
+		if withXattrs && hdr.Typeflag != tar.TypeSymlink {
+			for key, value := range hdr.PAXRecords {
+				if !strings.HasPrefix(key, xattrPAXPrefix) {
+					continue
+				}
+				if err := unix.Setxattr(target, strings.TrimPrefix(key, xattrPAXPrefix), []byte(value), 0); err != nil {
+					return fmt.Errorf("failed to set %s on %s: %w", strings.TrimPrefix(key, xattrPAXPrefix), target, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package storage
+
+// Capabilities tells which optional features a storage driver supports, so
+// that the callers can check before asking for one.
+type Capabilities struct {
+	// SupportsSnapshots is set when the volumes can be snapshotted and
+	// rolled back.
+	SupportsSnapshots bool
+	// SupportsResize is set when the volumes can be resized once created.
+	SupportsResize bool
+	// SupportsEncryption is set when the volumes asked as encrypted are
+	// encrypted at rest.
+	SupportsEncryption bool
+	// SupportsQuota is set when the space of each volume is bounded.
+	SupportsQuota bool
+	// SupportsClone is set when the volumes can be cloned.
+	SupportsClone bool
+	// SupportsMountNamespace is set when the rootfs of the containers can
+	// be mounted in a mount namespace of their own, see
+	// ContainerOptions.MountNamespace.
+	SupportsMountNamespace bool
+}
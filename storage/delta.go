@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// A block delta holds the regions of a block file which changed since a base
+// snapshot of it, so that a copy of the base can be brought up to date
+// without the whole file. It is a stream of big-endian fields:
+//
+//	header:
+//	  magic     8 bytes  "HBDELTA1"
+//	  base size uint64   size of the base the delta applies to
+//	  size      uint64   size of the file once the delta is applied
+//	  name len  uint16
+//	  name      bytes    name of the base snapshot, for information only
+//	records, in increasing offsets which do not overlap:
+//	  'D' offset uint64, length uint64, then length bytes: the data of the
+//	      region
+//	  'Z' offset uint64, length uint64: the region reads as zeros, it is
+//	      punched out of the file where the filesystem can
+//	trailer:
+//	  'E' then the SHA-256 of every byte of the stream before the 'E'
+//
+// The regions are within the size of the file. A stream without its trailer,
+// or whose checksum does not match, is truncated or corrupt and must not be
+// applied.
+
+const (
+	deltaMagic      = "HBDELTA1"
+	deltaDataRecord = 'D'
+	deltaZeroRecord = 'Z'
+	deltaEndRecord  = 'E'
+	// deltaMaxRecord bounds the length of a data record read back, so that
+	// a corrupt length does not allocate the memory of the host.
+	deltaMaxRecord = 64 << 20
+)
+
+// ErrCorruptDelta is the error of reading a block delta which is not well
+// formed, or whose checksum does not match.
+var ErrCorruptDelta = errors.New("corrupt block delta")
+
+// DeltaHeader describes the files a block delta goes from and to.
+type DeltaHeader struct {
+	BaseSize int64
+	Size     int64
+	Base     string
+}
+
+// DeltaWriter writes a block delta, its records must be written in
+// increasing offsets and Close must be called to terminate it.
+type DeltaWriter struct {
+	w    *bufio.Writer
+	sum  hash.Hash
+	next int64
+	size int64
+}
+
+func NewDeltaWriter(dst io.Writer, header DeltaHeader) (*DeltaWriter, error) {
+	if len(header.Base) > 0xffff {
+		return nil, fmt.Errorf("base name of the delta too long: %d bytes", len(header.Base))
+	}
+	w := &DeltaWriter{
+		w:    bufio.NewWriter(dst),
+		sum:  sha256.New(),
+		size: header.Size,
+	}
+	var buf bytes.Buffer
+	buf.WriteString(deltaMagic)
+	binary.Write(&buf, binary.BigEndian, uint64(header.BaseSize))
+	binary.Write(&buf, binary.BigEndian, uint64(header.Size))
+	binary.Write(&buf, binary.BigEndian, uint16(len(header.Base)))
+	buf.WriteString(header.Base)
+	if err := w.write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *DeltaWriter) write(p []byte) error {
+	w.sum.Write(p)
+	_, err := w.w.Write(p)
+	return err
+}
+
+func (w *DeltaWriter) record(kind byte, offset, length int64) error {
+	if offset < w.next || length <= 0 || offset+length > w.size {
+		return fmt.Errorf("invalid region %d+%d of the delta after %d, size %d", offset, length, w.next, w.size)
+	}
+	w.next = offset + length
+	var rec [17]byte
+	rec[0] = kind
+	binary.BigEndian.PutUint64(rec[1:], uint64(offset))
+	binary.BigEndian.PutUint64(rec[9:], uint64(length))
+	return w.write(rec[:])
+}
+
+// WriteData records the data of the region at offset.
+func (w *DeltaWriter) WriteData(offset int64, data []byte) error {
+	if err := w.record(deltaDataRecord, offset, int64(len(data))); err != nil {
+		return err
+	}
+	return w.write(data)
+}
+
+// WriteZero records that the region at offset reads as zeros.
+func (w *DeltaWriter) WriteZero(offset, length int64) error {
+	return w.record(deltaZeroRecord, offset, length)
+}
+
+// Close writes the trailer of the delta, the underlying writer is not closed.
+func (w *DeltaWriter) Close() error {
+	w.sum.Write([]byte{deltaEndRecord})
+	if err := w.w.WriteByte(deltaEndRecord); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.sum.Sum(nil)); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// deltaReader reads the fields of a delta, summing them.
+type deltaReader struct {
+	r   *bufio.Reader
+	sum hash.Hash
+}
+
+func (r *deltaReader) read(p []byte) error {
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated", ErrCorruptDelta)
+		}
+		return err
+	}
+	r.sum.Write(p)
+	return nil
+}
+
+func (r *deltaReader) uint(n int) (uint64, error) {
+	buf := make([]byte, n)
+	if err := r.read(buf); err != nil {
+		return 0, err
+	}
+	switch n {
+	case 2:
+		return uint64(binary.BigEndian.Uint16(buf)), nil
+	default:
+		return binary.BigEndian.Uint64(buf), nil
+	}
+}
+
+// ApplyDelta writes the regions of the delta read from src into dst, a copy
+// of the base it was made from, and resizes dst to the size of the delta.
+// dst may be left partially updated when it fails, callers apply the delta to
+// a copy to replace the file with once it succeeded.
+func ApplyDelta(ctx context.Context, src io.Reader, dst *os.File) (*DeltaHeader, error) {
+	r := &deltaReader{r: bufio.NewReader(src), sum: sha256.New()}
+	magic := make([]byte, len(deltaMagic))
+	if err := r.read(magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != deltaMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrCorruptDelta, magic)
+	}
+	var header DeltaHeader
+	baseSize, err := r.uint(8)
+	if err != nil {
+		return nil, err
+	}
+	size, err := r.uint(8)
+	if err != nil {
+		return nil, err
+	}
+	nameLen, err := r.uint(2)
+	if err != nil {
+		return nil, err
+	}
+	name := make([]byte, nameLen)
+	if err := r.read(name); err != nil {
+		return nil, err
+	}
+	header.BaseSize, header.Size, header.Base = int64(baseSize), int64(size), string(name)
+
+	fi, err := dst.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != header.BaseSize {
+		return nil, fmt.Errorf("the delta applies to a base of %d bytes, the file has %d", header.BaseSize, fi.Size())
+	}
+	if err := dst.Truncate(header.Size); err != nil {
+		return nil, err
+	}
+
+	var next int64
+	kind := make([]byte, 1)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := r.read(kind); err != nil {
+			return nil, err
+		}
+		if kind[0] == deltaEndRecord {
+			break
+		}
+		if kind[0] != deltaDataRecord && kind[0] != deltaZeroRecord {
+			return nil, fmt.Errorf("%w: unknown record %q", ErrCorruptDelta, kind[0])
+		}
+		off, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		offset, n := int64(off), int64(length)
+		if offset < next || n <= 0 || n > header.Size || offset > header.Size-n {
+			return nil, fmt.Errorf("%w: invalid region %d+%d", ErrCorruptDelta, off, length)
+		}
+		next = offset + n
+		if kind[0] == deltaZeroRecord {
+			if err := zeroRegion(dst, offset, n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if n > deltaMaxRecord {
+			return nil, fmt.Errorf("%w: data record of %d bytes", ErrCorruptDelta, n)
+		}
+		data := make([]byte, n)
+		if err := r.read(data); err != nil {
+			return nil, err
+		}
+		if _, err := dst.WriteAt(data, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	expected := r.sum.Sum(nil)
+	sum := make([]byte, len(expected))
+	if _, err := io.ReadFull(r.r, sum); err != nil {
+		return nil, fmt.Errorf("%w: truncated", ErrCorruptDelta)
+	}
+	if !bytes.Equal(sum, expected) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptDelta)
+	}
+	return &header, dst.Sync()
+}
+
+// zeroRegion punches the region out of f, or writes zeros over it where the
+// filesystem can not punch holes.
+func zeroRegion(f *os.File, offset, length int64) error {
+	const punchHole = 0x01 | 0x02 // FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+	if err := syscall.Fallocate(int(f.Fd()), punchHole, offset, length); err == nil {
+		return nil
+	}
+	zeros := make([]byte, 1<<20)
+	for length > 0 {
+		n := int64(len(zeros))
+		if n > length {
+			n = length
+		}
+		if _, err := f.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset, length = offset+n, length-n
+	}
+	return nil
+}
@@ -67,7 +67,7 @@ func CreateNewDevice(containerId, devPrefix, rootPath string) error {
 	return nil
 }
 
-func InjectFile(src io.Reader, containerId, devPrefix, target, basePath string, perm, uid, gid int) error {
+func InjectFile(src io.Reader, containerId, devPrefix, target, basePath string, perm, uid, gid int, xattrs map[string][]byte) error {
 	if containerId == "" {
 		return fmt.Errorf("Please make sure the arguments are not NULL!\n")
 	}
@@ -113,7 +113,10 @@ func InjectFile(src io.Reader, containerId, devPrefix, target, basePath string,
 	}
 	defer syscall.Unmount(idMountPath, syscall.MNT_DETACH)
 
-	return storage.WriteFile(src, targetFile, perm, uid, gid)
+	if err := storage.WriteFile(src, targetFile, perm, uid, gid); err != nil {
+		return err
+	}
+	return storage.SetXattrs(targetFile, xattrs)
 }
 
 func ProbeFsType(device string) (string, error) {
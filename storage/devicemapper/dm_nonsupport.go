@@ -15,7 +15,7 @@ func MountContainerToSharedDir(containerId, sharedDir, devPrefix string) (string
 	return "", nil
 }
 
-func InjectFile(src io.Reader, containerId, devPrefix, target, rootPath string, perm, uid, gid int) error {
+func InjectFile(src io.Reader, containerId, devPrefix, target, rootPath string, perm, uid, gid int, xattrs map[string][]byte) error {
 	return fmt.Errorf("Unsupported, inject file to %s is not supported in current arch", target)
 }
 
@@ -1,24 +1,209 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
-func FsInjectFile(src io.Reader, containerId, target, baseDir string, perm, uid, gid int) error {
+// posixACLXattrs are the extended attributes holding the POSIX ACLs of a file.
+var posixACLXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// FsInjectFile writes the file to target in the rootfs of the container, then
+// sets the extended attributes of xattrs on it, e.g. its POSIX ACLs. With
+// verify, the written file is read back and its SHA-256 compared with the one
+// of the source, for the callers whose integrity is not checked at a higher
+// layer already; a file whose content does not match is removed.
+func FsInjectFile(src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte, verify bool) error {
 	if containerId == "" {
 		return fmt.Errorf("Please make sure the arguments are not NULL!\n")
 	}
 
 	targetFile := path.Join(baseDir, containerId, "rootfs", target)
 
-	return WriteFile(src, targetFile, perm, uid, gid)
+	if !verify {
+		if err := WriteFile(src, targetFile, perm, uid, gid); err != nil {
+			return err
+		}
+		return SetXattrs(targetFile, xattrs)
+	}
+
+	hash := sha256.New()
+	if err := WriteFile(io.TeeReader(src, hash), targetFile, perm, uid, gid); err != nil {
+		return err
+	}
+	if err := verifyFile(targetFile, hash.Sum(nil)); err != nil {
+		os.Remove(targetFile)
+		return err
+	}
+	return SetXattrs(targetFile, xattrs)
+}
+
+// verifyFile fails unless the SHA-256 of the content of the file is sum.
+func verifyFile(file string, sum []byte) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return fmt.Errorf("failed to read back %s: %v", file, err)
+	}
+	if written := hash.Sum(nil); !bytes.Equal(written, sum) {
+		return fmt.Errorf("checksum mismatch of %s: wrote %x, expected %x", file, written, sum)
+	}
+	return nil
+}
+
+// SetXattrs sets the extended attributes of xattrs on the file.
+func SetXattrs(file string, xattrs map[string][]byte) error {
+	for name, value := range xattrs {
+		if err := unix.Setxattr(file, name, value, 0); err != nil {
+			return fmt.Errorf("failed to set %s on %s: %w", name, file, err)
+		}
+	}
+	return nil
+}
+
+// PosixACLs returns the extended attributes holding the POSIX ACLs of the
+// file, none when the file or its filesystem has no ACLs.
+func PosixACLs(file string) (map[string][]byte, error) {
+	var xattrs map[string][]byte
+	for _, name := range posixACLXattrs {
+		size, err := unix.Getxattr(file, name, nil)
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get %s of %s: %w", name, file, err)
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(file, name, value); err != nil {
+			return nil, fmt.Errorf("failed to get %s of %s: %w", name, file, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
+
+// Xattrs returns the extended attributes of the file, which is not a
+// symlink, none when its filesystem has no extended attributes.
+func Xattrs(file string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(file, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list the xattrs of %s: %w", file, err)
+	}
+	list := make([]byte, size)
+	if size, err = unix.Listxattr(file, list); err != nil {
+		return nil, fmt.Errorf("failed to list the xattrs of %s: %w", file, err)
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		size, err := unix.Getxattr(file, name, nil)
+		if err == unix.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get %s of %s: %w", name, file, err)
+		}
+		value := make([]byte, size)
+		if size, err = unix.Getxattr(file, name, value); err != nil {
+			return nil, fmt.Errorf("failed to get %s of %s: %w", name, file, err)
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
+
+// FsInjectFileAtomic is FsInjectFile which leaves the target as it was when
+// the injection fails: the previous file is restored from a backup, or the
+// partially written one is removed if there was none.
+func FsInjectFileAtomic(src io.Reader, containerId, target, baseDir string, perm, uid, gid int, xattrs map[string][]byte, verify bool) (err error) {
+	if containerId == "" {
+		return fmt.Errorf("Please make sure the arguments are not NULL!\n")
+	}
+
+	targetFile := path.Join(baseDir, containerId, "rootfs", target)
+	existed, backup, err := backupFile(targetFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		switch {
+		case err == nil:
+			if backup != "" {
+				os.Remove(backup)
+			}
+		case backup != "":
+			if rerr := os.Rename(backup, targetFile); rerr != nil {
+				err = fmt.Errorf("%v, and failed to restore %s: %v", err, targetFile, rerr)
+			}
+		case !existed:
+			os.Remove(targetFile)
+		}
+	}()
+
+	return FsInjectFile(src, containerId, target, baseDir, perm, uid, gid, xattrs, verify)
+}
+
+// backupFile copies the regular file to a temporary file of its directory,
+// with the same mode and owner, so that it can be renamed back over it. No
+// backup is made if the file does not exist or is not a regular file.
+func backupFile(file string) (existed bool, backup string, err error) {
+	info, err := os.Lstat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, "", nil
+		}
+		return false, "", err
+	}
+	if !info.Mode().IsRegular() {
+		return true, "", nil
+	}
 
+	src, err := os.Open(file)
+	if err != nil {
+		return true, "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".backup-")
+	if err != nil {
+		return true, "", err
+	}
+	defer func() {
+		dst.Close()
+		if err != nil {
+			os.Remove(dst.Name())
+		}
+	}()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return true, "", err
+	}
+	if err = dst.Chmod(info.Mode().Perm()); err != nil {
+		return true, "", err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err = dst.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			return true, "", err
+		}
+	}
+	return true, dst.Name(), nil
 }
 
 func WriteFile(src io.Reader, targetFile string, permFile, uid, gid int) error {
@@ -37,7 +222,7 @@ func WriteFile(src io.Reader, targetFile string, permFile, uid, gid int) error {
 		return errors.New("File target is not a dir: " + targetDir)
 	}
 
-	f, err := os.OpenFile(targetFile, os.O_RDWR|os.O_CREATE, os.FileMode(permFile))
+	f, err := os.OpenFile(targetFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(permFile))
 	if err != nil {
 		return err
 	}
@@ -55,3 +240,85 @@ func WriteFile(src io.Reader, targetFile string, permFile, uid, gid int) error {
 	return nil
 
 }
+
+// FsInjectDir copies the tree of src to targetDir in the rootfs of the
+// container, keeping the modes of the files and directories, and verifies the
+// files as FsInjectFile does. What it created is removed again if it fails
+// halfway.
+func FsInjectDir(src fs.FS, containerId, targetDir, baseDir string, uid, gid int, verify bool) (err error) {
+	if containerId == "" {
+		return fmt.Errorf("Please make sure the arguments are not NULL!\n")
+	}
+
+	root := path.Join(baseDir, containerId, "rootfs", targetDir)
+	var created []string
+	defer func() {
+		if err != nil {
+			for i := len(created) - 1; i >= 0; i-- {
+				os.Remove(created[i])
+			}
+		}
+	}()
+
+	return fs.WalkDir(src, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := path.Join(root, p)
+		perm := info.Mode().Perm()
+
+		if d.IsDir() {
+			dirs, err := mkdirAll(target, perm, uid, gid)
+			created = append(created, dirs...)
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("cannot inject %s, not a regular file", p)
+		}
+
+		f, err := src.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			created = append(created, target)
+		}
+		if err := FsInjectFile(f, containerId, path.Join(targetDir, p), baseDir, int(perm), uid, gid, nil, verify); err != nil {
+			return err
+		}
+		return os.Chmod(target, perm)
+	})
+}
+
+// mkdirAll is os.MkdirAll which gives the directories to uid:gid and returns
+// the ones it created, parents first.
+func mkdirAll(dir string, perm os.FileMode, uid, gid int) ([]string, error) {
+	stat, err := os.Stat(dir)
+	if err == nil {
+		if !stat.IsDir() {
+			return nil, errors.New("File target is not a dir: " + dir)
+		}
+		return nil, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	created, err := mkdirAll(filepath.Dir(dir), 0755, uid, gid)
+	if err != nil {
+		return created, err
+	}
+	if err := os.Mkdir(dir, perm); err != nil {
+		return created, err
+	}
+	created = append(created, dir)
+	// the mode given to mkdir is masked by the umask
+	if err := os.Chmod(dir, perm); err != nil {
+		return created, err
+	}
+	return created, syscall.Chown(dir, uid, gid)
+}
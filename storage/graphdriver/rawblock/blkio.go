@@ -0,0 +1,73 @@
+package rawblock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// BlkioCgroupDir is where the blkio cgroup hierarchy is mounted, the limits
+// are set on its root cgroup.
+var BlkioCgroupDir = "/sys/fs/cgroup/blkio"
+
+// ThrottleOptions are the blkio limits of a block device, 0 stands for no
+// limit.
+type ThrottleOptions struct {
+	ReadBPS   uint64
+	WriteBPS  uint64
+	ReadIOPS  uint64
+	WriteIOPS uint64
+}
+
+// DeviceMajorMinor returns the "major:minor" of the block device.
+func DeviceMajorMinor(device string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(device, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", device)
+	}
+	// the encoding of dev_t by glibc
+	major := (st.Rdev >> 8) & 0xfff
+	minor := (st.Rdev & 0xff) | ((st.Rdev >> 12) & 0xfff00)
+	return fmt.Sprintf("%d:%d", major, minor), nil
+}
+
+// ApplyBlkioThrottle sets the limits of the device, a limit of 0 removes the
+// previous one.
+func ApplyBlkioThrottle(deviceMajorMinor string, limits ThrottleOptions) error {
+	for file, limit := range map[string]uint64{
+		"blkio.throttle.read_bps_device":   limits.ReadBPS,
+		"blkio.throttle.write_bps_device":  limits.WriteBPS,
+		"blkio.throttle.read_iops_device":  limits.ReadIOPS,
+		"blkio.throttle.write_iops_device": limits.WriteIOPS,
+	} {
+		if err := writeBlkioLimit(filepath.Join(BlkioCgroupDir, file), deviceMajorMinor, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBlkioLimit(path, deviceMajorMinor string, limit uint64) error {
+	// the cgroup files exist already, never create one
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("blkio throttling is not available, %s does not exist", path)
+		}
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %d", deviceMajorMinor, limit); err != nil {
+		return fmt.Errorf("failed to write the limit of %s to %s: %v", deviceMajorMinor, path, err)
+	}
+	return nil
+}
+
+// ClearBlkioThrottle removes the limits of the device.
+func ClearBlkioThrottle(deviceMajorMinor string) error {
+	return ApplyBlkioThrottle(deviceMajorMinor, ThrottleOptions{})
+}
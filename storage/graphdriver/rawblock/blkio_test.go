@@ -0,0 +1,71 @@
+package rawblock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyBlkioThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blkio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	BlkioCgroupDir = dir
+	defer func() { BlkioCgroupDir = "/sys/fs/cgroup/blkio" }()
+
+	if err := ApplyBlkioThrottle("7:1", ThrottleOptions{ReadBPS: 1}); err == nil {
+		t.Fatal("expected an error without the cgroup files")
+	}
+
+	files := []string{
+		"blkio.throttle.read_bps_device",
+		"blkio.throttle.write_bps_device",
+		"blkio.throttle.read_iops_device",
+		"blkio.throttle.write_iops_device",
+	}
+	for _, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// unlike the cgroup files, the files keep what was written before
+	check := func(expected ...string) {
+		for i, file := range files {
+			path := filepath.Join(dir, file)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != expected[i] {
+				t.Fatalf("expected %q in %s, got %q", expected[i], file, data)
+			}
+			os.Truncate(path, 0)
+		}
+	}
+
+	limits := ThrottleOptions{ReadBPS: 1048576, WriteBPS: 524288, ReadIOPS: 100, WriteIOPS: 50}
+	if err := ApplyBlkioThrottle("7:1", limits); err != nil {
+		t.Fatal(err)
+	}
+	check("7:1 1048576", "7:1 524288", "7:1 100", "7:1 50")
+
+	if err := ClearBlkioThrottle("7:1"); err != nil {
+		t.Fatal(err)
+	}
+	check("7:1 0", "7:1 0", "7:1 0", "7:1 0")
+}
+
+func TestDeviceMajorMinor(t *testing.T) {
+	if _, err := DeviceMajorMinor("/dev/null"); err == nil {
+		t.Fatal("/dev/null is not a block device")
+	}
+	if _, err := os.Stat("/dev/loop0"); err != nil {
+		t.Skip("no /dev/loop0")
+	}
+	if dev, err := DeviceMajorMinor("/dev/loop0"); err != nil || dev != "7:0" {
+		t.Fatalf("expected 7:0 for /dev/loop0, got %s, %v", dev, err)
+	}
+}
@@ -195,8 +195,15 @@ func CreateBlock(block, fstype, mountLabel string, size uint64) error {
 	//if _, mountLabel, err := label.InitLabels(opts); err == nil {
 	//	label.SetFileLabel(dir, mountLabel)
 	//}
-	if out, err := exec.Command("truncate", fmt.Sprintf("--size=%d", size), block).CombinedOutput(); err != nil {
-		return fmt.Errorf("Failed to create block:%v:%s", err, string(out))
+	// a sparse file, its space is allocated as the filesystem is written
+	f, err := os.OpenFile(block, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create block:%v", err)
+	}
+	err = f.Truncate(int64(size))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to create block:%v", err)
 	}
 	switch fstype {
 	case "xfs":
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/opencontainers/runc/libcontainer/selinux"
+	"golang.org/x/sys/unix"
+)
+
+// ContainerOptions are given to the storage driver when it prepares the
+// rootfs of a container.
+type ContainerOptions struct {
+	ReadOnly bool
+	// SELinuxLabel is set on the prepared rootfs, it comes from the pod spec
+	// and is ignored when empty or when SELinux is disabled on the host.
+	SELinuxLabel string
+	// PodID and Volumes name the pod volumes the container mounts, they are
+	// kept from being removed until the container is cleaned up.
+	PodID   string
+	Volumes []string
+	// PodAnnotations are the labels of the pod, a MultiDriverStorage chooses
+	// the driver of the pod from them.
+	PodAnnotations map[string]string
+	// LowerLayers are the mount ids of the image layers of the container,
+	// top-most first, which overlay mounts as the lower dirs of a single
+	// overlay. The one lower layer of the container is used when empty.
+	LowerLayers []string
+	// MountNamespace mounts the rootfs in a new private mount namespace, so
+	// that neither the host nor the other containers find it in their
+	// /proc/mounts nor reach its files through the shared dir. The mount
+	// point left in the shared dir is empty: the hypervisor must serve the
+	// rootfs from within the namespace, whose file the driver holds until
+	// the container is cleaned up. Nothing is hidden from root on the host,
+	// which can still enter the namespace, and the drivers without
+	// Capabilities.SupportsMountNamespace ignore it.
+	MountNamespace bool
+}
+
+// SetSELinuxLabel labels the file or the mount point at path.
+func SetSELinuxLabel(path, label string) error {
+	if label == "" || !selinux.SelinuxEnabled() {
+		return nil
+	}
+	if err := unix.Setxattr(path, "security.selinux", []byte(label), 0); err != nil {
+		return fmt.Errorf("failed to set selinux label %s on %s: %v", label, path, err)
+	}
+	return nil
+}
+
+// mountFlags are the mount options the drivers let the users set, the ones
+// tuning the access times or restricting the mount further. The others, as
+// "bind", "remount" or "suid", could weaken the isolation of the containers.
+var mountFlags = map[string]uintptr{
+	"ro":          syscall.MS_RDONLY,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+}
+
+// MountFlags returns the flags of syscall.Mount for the mount options, which
+// are refused unless they are in mountFlags.
+func MountFlags(options []string) (uintptr, error) {
+	var flags uintptr
+	for _, opt := range options {
+		flag, ok := mountFlags[opt]
+		if !ok {
+			return 0, fmt.Errorf("mount option %q is not allowed", opt)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
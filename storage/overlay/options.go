@@ -0,0 +1,24 @@
+package overlay
+
+// MountOptions describe the overlay MountContainer mounts for a container.
+type MountOptions struct {
+	ContainerId string
+	// RootDir holds the dirs of the container and of its layers.
+	RootDir string
+	// SharedDir is where the container is mounted, on
+	// <SharedDir>/<ContainerId>/rootfs.
+	SharedDir  string
+	MountLabel string
+	// LowerIds are the layers of the lower dirs, top-most first. The layer
+	// named by the lower-id of the container is the lower dir when empty.
+	LowerIds []string
+	ReadOnly bool
+	// WorkRoot holds the work dir of the overlay, as <WorkRoot>/<ContainerId>,
+	// instead of next to its upper dir when set.
+	WorkRoot string
+	// Flags are the extra flags of syscall.Mount, e.g. syscall.MS_NOATIME.
+	Flags uintptr
+	// Data are the extra options of the overlay filesystem, e.g.
+	// "redirect_dir=on", put after its dirs.
+	Data []string
+}
@@ -7,17 +7,22 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 
 	"github.com/hyperhq/hyperd/utils"
 )
 
-func MountContainerToSharedDir(containerId, rootDir, sharedDir, mountLabel string, readonly bool) (string, error) {
+// MountContainer mounts the container on <SharedDir>/<ContainerId>/rootfs,
+// with the layers of LowerIds as the lower dirs of a single overlay, and
+// returns the mount point.
+func MountContainer(opts MountOptions) (string, error) {
 	var (
 		params     string
-		mountPoint = path.Join(sharedDir, containerId, "rootfs")
-		upperDir   = path.Join(rootDir, containerId, "upper")
-		workDir    = path.Join(rootDir, containerId, "work")
+		mountPoint = path.Join(opts.SharedDir, opts.ContainerId, "rootfs")
+		upperDir   = path.Join(opts.RootDir, opts.ContainerId, "upper")
+		workDir    = path.Join(opts.RootDir, opts.ContainerId, "work")
+		flags      = opts.Flags
 	)
 
 	if _, err := os.Stat(mountPoint); err != nil {
@@ -25,20 +30,72 @@ func MountContainerToSharedDir(containerId, rootDir, sharedDir, mountLabel strin
 			return "", err
 		}
 	}
-	lowerId, err := ioutil.ReadFile(path.Join(rootDir, containerId) + "/lower-id")
+	if opts.WorkRoot != "" && !opts.ReadOnly {
+		workDir = path.Join(opts.WorkRoot, opts.ContainerId)
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			return "", err
+		}
+	}
+	lowerDirs, err := LowerDirs(opts.ContainerId, opts.RootDir, opts.LowerIds)
 	if err != nil {
 		return "", err
 	}
-	lowerDir := path.Join(rootDir, string(lowerId), "root")
+	lowerDir := strings.Join(lowerDirs, ":")
 
-	if readonly {
+	if opts.ReadOnly {
 		// "upperdir=" and "workdir=" may be omitted. In that case the overlay will be read-only.
 		params = fmt.Sprintf("lowerdir=%s:%s", lowerDir, upperDir)
+		// the overlay is read-only already, the flag shows it in the mounts
+		flags |= syscall.MS_RDONLY
 	} else {
 		params = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir)
 	}
-	if err := syscall.Mount("overlay", mountPoint, "overlay", 0, utils.FormatMountLabel(params, mountLabel)); err != nil {
-		return "", fmt.Errorf("error creating overlay mount to %s: %v", mountPoint, err)
+	if len(opts.Data) > 0 {
+		params += "," + strings.Join(opts.Data, ",")
+	}
+	params = utils.FormatMountLabel(params, opts.MountLabel)
+	// the kernel takes the mount data from a single page
+	if len(params) >= syscall.Getpagesize() {
+		return "", fmt.Errorf("overlay options of %s are too long for %d lower dirs", mountPoint, len(lowerDirs))
+	}
+	if err := syscall.Mount("overlay", mountPoint, "overlay", flags, params); err != nil {
+		return "", fmt.Errorf("error creating overlay mount to %s: %w", mountPoint, err)
 	}
 	return mountPoint, nil
 }
+
+// LowerDirs returns the lower dirs of the overlay of the container, top-most
+// first: the dirs of the layers of lowerIds, or the one of the layer named by
+// the lower-id of the container when lowerIds is empty.
+func LowerDirs(containerId, rootDir string, lowerIds []string) ([]string, error) {
+	if len(lowerIds) == 0 {
+		lowerId, err := ioutil.ReadFile(path.Join(rootDir, containerId) + "/lower-id")
+		if err != nil {
+			return nil, err
+		}
+		lowerIds = []string{string(lowerId)}
+	}
+	dirs := make([]string, 0, len(lowerIds))
+	for _, id := range lowerIds {
+		dir, err := layerDir(rootDir, id)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// layerDir returns the content of a layer: the root dir of a base layer, or
+// the upper dir of the layers above it.
+func layerDir(rootDir, id string) (string, error) {
+	for _, dir := range []string{"root", "upper"} {
+		p := path.Join(rootDir, id, dir)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("layer %s has no content in %s: %w", id, rootDir, os.ErrNotExist)
+}
@@ -2,10 +2,14 @@
 
 package overlay
 
-func MountContainerToSharedDir(containerId, rootDir, sharedDir, mountLabel string, readonly bool) (string, error) {
+func MountContainer(opts MountOptions) (string, error) {
 	return "", nil
 }
 
+func LowerDirs(containerId, rootDir string, lowerIds []string) ([]string, error) {
+	return nil, nil
+}
+
 func AttachFiles(containerId, fromFile, toDir, rootDir, perm, uid, gid string) error {
 	return nil
 }
@@ -158,7 +158,7 @@ func TestMountContainerToShareDir(t *testing.T) {
 	}
 
 	t.Log("Mount the parent read-only images and container")
-	mountPoint, err := MountContainerToSharedDir(containerId, tempDir, sharedTempDir, "")
+	mountPoint, err := MountContainer(MountOptions{ContainerId: containerId, RootDir: tempDir, SharedDir: sharedTempDir})
 	if err != nil {
 		t.Fatalf("Error during mounting paths: %s\n", err.Error())
 	}
@@ -233,8 +233,8 @@ func TestAttachFiles(t *testing.T) {
 		}
 	}
 
-	t.Log("MountContainerToSharedDir do")
-	mountPoint, err := MountContainerToSharedDir(containerId, tempDir, sharedTempDir, "")
+	t.Log("MountContainer do")
+	mountPoint, err := MountContainer(MountOptions{ContainerId: containerId, RootDir: tempDir, SharedDir: sharedTempDir})
 	if err != nil {
 		t.Fatalf("Error during mounting paths: %s\n", err.Error())
 	}
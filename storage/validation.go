@@ -0,0 +1,29 @@
+package storage
+
+import "strings"
+
+// ValidationError is a problem found in a volume spec before the volume is
+// created.
+type ValidationError struct {
+	// Field is the field of the spec at fault, as "SizeBytes", empty when
+	// the spec is not at fault but the driver is, e.g. missing a tool.
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// JoinValidationErrors formats the errors as one message, "" when there are
+// none.
+func JoinValidationErrors(errs []ValidationError) string {
+	msgs := make([]string, 0, len(errs))
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
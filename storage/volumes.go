@@ -1,18 +1,30 @@
 package storage
 
 import (
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/mount"
 	"github.com/golang/glog"
 	"github.com/hyperhq/hyperd/utils"
 )
 
-func CreateVFSVolume(podId, shortName string) (string, error) {
-	volName := path.Join("/var/tmp/hyper", podId, shortName)
+// VFSVolumeRoot holds the vfs volumes of the drivers which do not keep them
+// under their own root path. The volumes are in a dir per pod under the root.
+const VFSVolumeRoot = "/var/tmp/hyper"
+
+func VFSVolumePath(root, podId, shortName string) string {
+	return path.Join(root, podId, shortName)
+}
+
+func CreateVFSVolume(root, podId, shortName string) (string, error) {
+	volName := VFSVolumePath(root, podId, shortName)
 	if _, err := os.Stat(volName); err != nil && os.IsNotExist(err) {
 		if err := os.MkdirAll(volName, os.FileMode(0777)); err != nil {
 			return "", err
@@ -21,6 +33,103 @@ func CreateVFSVolume(podId, shortName string) (string, error) {
 	return volName, nil
 }
 
+// VFSSnapshotPath is where the snapshot of a vfs volume is kept. Entries of
+// the pod directory starting with a dot are not volumes.
+func VFSSnapshotPath(root, podId, shortName, snapshot string) string {
+	return path.Join(root, podId, ".snapshots", shortName, snapshot)
+}
+
+func SnapshotVFSVolume(root, podId, shortName, snapshot string) error {
+	src := VFSVolumePath(root, podId, shortName)
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	dst := VFSSnapshotPath(root, podId, shortName, snapshot)
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("snapshot %s of volume %s already exists", snapshot, shortName)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err := archive.CopyWithTar(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return nil
+}
+
+// RollbackVFSVolume replaces the content of the volume with a copy of the
+// snapshot, the snapshot itself is kept.
+func RollbackVFSVolume(root, podId, shortName, snapshot string) error {
+	snap := VFSSnapshotPath(root, podId, shortName, snapshot)
+	if _, err := os.Stat(snap); err != nil {
+		return err
+	}
+	tmp := VFSVolumePath(root, podId, "."+shortName+".rollback")
+	os.RemoveAll(tmp)
+	if err := archive.CopyWithTar(snap, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return ReplacePath(tmp, VFSVolumePath(root, podId, shortName))
+}
+
+// CloneVFSVolume copies the volume to a new volume, which may belong to
+// another pod. The copy is made aside and renamed in place once complete.
+func CloneVFSVolume(root, srcPodId, srcName, dstPodId, dstName string) (string, error) {
+	src := VFSVolumePath(root, srcPodId, srcName)
+	if _, err := os.Stat(src); err != nil {
+		return "", err
+	}
+	dst := VFSVolumePath(root, dstPodId, dstName)
+	if _, err := os.Stat(dst); err == nil {
+		return "", fmt.Errorf("volume %s of pod %s already exists", dstName, dstPodId)
+	}
+	tmp := VFSVolumePath(root, dstPodId, "."+dstName+".clone")
+	os.RemoveAll(tmp)
+	if err := archive.CopyWithTar(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dst, nil
+}
+
+// RemoveVFSSnapshots removes all the snapshots of the volume.
+func RemoveVFSSnapshots(root, podId, shortName string) error {
+	dir := VFSSnapshotPath(root, podId, shortName, "")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	// drop the snapshots directory once the last volume having some is gone
+	os.Remove(filepath.Dir(dir))
+	return nil
+}
+
+// ReplacePath moves src over dst, which are on the same filesystem. A file is
+// replaced atomically by rename(2). A directory can not be renamed over a non
+// empty one, so dst is moved aside first and removed once src is in place,
+// dst is missing in between but never holds a partial content.
+func ReplacePath(src, dst string) error {
+	fi, err := os.Stat(dst)
+	if err != nil || !fi.IsDir() {
+		return os.Rename(src, dst)
+	}
+	old := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".old")
+	os.RemoveAll(old)
+	if err := os.Rename(dst, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
 func MountVFSVolume(src, sharedDir string) (string, error) {
 	var flags uintptr = utils.MS_BIND
 
@@ -78,3 +187,83 @@ func UmountVFSVolume(vol, sharedDir string) error {
 	os.Remove(mount)
 	return nil
 }
+
+// PathInUse reports whether p, or anything beneath it, is mounted somewhere
+// or is held open by a running process.
+func PathInUse(p string) bool {
+	p = filepath.Clean(p)
+	under := func(target string) bool {
+		return target == p || strings.HasPrefix(target, p+"/")
+	}
+
+	if mounts, err := mount.GetMounts(); err == nil {
+		for _, m := range mounts {
+			if under(m.Mountpoint) {
+				return true
+			}
+			// a bind mount of p shows p as its source
+			if m.Root != "/" {
+				if src, ok := mountSource(m, mounts); ok && under(src) {
+					return true
+				}
+			}
+		}
+	}
+
+	return PathOpened(p)
+}
+
+// mountSource resolves the dir the mount m shows. Root is relative to the
+// filesystem of m, the dir is found under a mount point of the filesystem
+// which shows a dir above Root, the one closest to the top of the filesystem.
+func mountSource(m *mount.Info, mounts []*mount.Info) (string, bool) {
+	var top *mount.Info
+	for _, b := range mounts {
+		if b == m || b.Major != m.Major || b.Minor != m.Minor {
+			continue
+		}
+		if b.Root != "/" && b.Root != m.Root && !strings.HasPrefix(m.Root, b.Root+"/") {
+			continue
+		}
+		if top == nil || len(b.Root) < len(top.Root) {
+			top = b
+		}
+	}
+	if top == nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(top.Root, m.Root)
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(top.Mountpoint, rel), true
+}
+
+// PathOpened reports whether p, or anything beneath it, is held open by a
+// running process.
+func PathOpened(p string) bool {
+	p = filepath.Clean(p)
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		if target, err := os.Readlink(fd); err == nil && (target == p || strings.HasPrefix(target, p+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceOpened reports whether a running process holds a file, or its
+// working directory, on the filesystem of the device dev. Unlike PathOpened
+// it also finds the files of a filesystem which is no longer mounted
+// anywhere, e.g. lazily unmounted.
+func DeviceOpened(dev uint64) bool {
+	links, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	cwds, _ := filepath.Glob("/proc/[0-9]*/cwd")
+	for _, link := range append(links, cwds...) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(link, &st); err == nil && uint64(st.Dev) == dev {
+			return true
+		}
+	}
+	return false
+}
@@ -3,9 +3,12 @@ package types
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Unknwon/goconfig"
+	"github.com/docker/go-units"
 	"github.com/hyperhq/hypercontainer-utils/hlog"
 	"github.com/hyperhq/hyperd/utils"
 )
@@ -17,6 +20,8 @@ type HyperConfig struct {
 	Host            string
 	GRPCHost        string
 	StorageDriver   string
+	StoragePlugins  string
+	StorageRoot     string
 	VmFactoryPolicy string
 	Driver          string
 	Kernel          string
@@ -27,6 +32,63 @@ type HyperConfig struct {
 	EnableVsock     bool
 	DefaultLog      string
 	DefaultLogOpt   map[string]string
+	StorageOpt      map[string]string
+	StorageStatsTTL time.Duration
+	// StorageUsageTTL is how long the usage report of the storage driver is
+	// cached, it walks every volume.
+	StorageUsageTTL time.Duration
+	// StorageHealthCheckInterval is the interval the health of the storage
+	// driver is checked at, 0 disables the checks.
+	StorageHealthCheckInterval time.Duration
+	// StorageFallbackDrivers are the storage drivers tried in turn when the
+	// one of StorageDriver can not be initialized.
+	StorageFallbackDrivers []string
+	// StorageAuditLog is the file the volume operations are audited to, none
+	// are when empty.
+	StorageAuditLog string
+	// StorageDriverConfig is the JSON file the options of the storage
+	// drivers not in StorageOpt are loaded from.
+	StorageDriverConfig string
+	// StorageVerifyChecksum makes the files injected into the containers
+	// read back and checked against their source.
+	StorageVerifyChecksum bool
+	// StorageReadOnly freezes the storage layer, the containers may only be
+	// prepared read-only and no volume is changed.
+	StorageReadOnly bool
+	// StorageCompactFileCount is the number of files past which the writable
+	// layer of a stopped container is compacted, 0 disables the compaction.
+	StorageCompactFileCount uint64
+	// StorageCompactInterval is the interval the writable layers are looked
+	// for compaction at.
+	StorageCompactInterval time.Duration
+	// StoragePodDriverLabel is the label of the pods naming their storage
+	// driver, the pods without it use StorageDriver.
+	StoragePodDriverLabel string
+	// StorageFsck makes the storage driver repair the filesystems of the
+	// volumes when it is initialized.
+	StorageFsck bool
+	// StorageMetrics exports the operations of the storage driver to
+	// prometheus, on the /metrics path of the API.
+	StorageMetrics bool
+	// StorageTracing traces the operations of the storage driver with the
+	// global OpenTelemetry tracer provider.
+	StorageTracing bool
+	// StorageAsyncDriverInit lets hyperd start before the storage driver is
+	// initialized, the driver then gets ready in the background.
+	StorageAsyncDriverInit bool
+	// StoragePrepareConcurrency bounds the containers prepared at once by
+	// the storage driver, 0 is twice the number of CPUs.
+	StoragePrepareConcurrency int
+	// StorageInjectBytesPerSec limits the bandwidth of the files injected
+	// into the containers, 0 is unlimited.
+	StorageInjectBytesPerSec int64
+	// StorageCircuitBreakerThreshold is the number of storage operations
+	// failing in a row, within StorageCircuitBreakerWindow, which stops
+	// hyperd from calling the driver for StorageCircuitBreakerTimeout. 0
+	// disables the circuit breaker.
+	StorageCircuitBreakerThreshold int
+	StorageCircuitBreakerWindow    time.Duration
+	StorageCircuitBreakerTimeout   time.Duration
 
 	logPrefix string
 }
@@ -41,6 +103,11 @@ func NewHyperConfig(config string) *HyperConfig {
 		ConfigFile: config,
 		Root:       "/var/lib/hyper",
 		logPrefix:  fmt.Sprintf("[%s] ", config),
+
+		StorageStatsTTL:            30 * time.Second,
+		StorageUsageTTL:            time.Minute,
+		StorageHealthCheckInterval: 30 * time.Second,
+		StorageCompactInterval:     time.Hour,
 	}
 
 	cfg, err := goconfig.LoadConfigFile(config)
@@ -55,6 +122,11 @@ func NewHyperConfig(config string) *HyperConfig {
 	}
 
 	c.StorageDriver, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageDriver")
+	c.StoragePlugins, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "StoragePlugins")
+	c.StorageRoot, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageRoot")
+	c.StorageAuditLog, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageAuditLog")
+	c.StorageDriverConfig, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageDriverConfig")
+	c.StoragePodDriverLabel, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "StoragePodDriverLabel")
 	c.Kernel, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "Kernel")
 	c.Initrd, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "Initrd")
 	c.Bridge, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "Bridge")
@@ -64,10 +136,94 @@ func NewHyperConfig(config string) *HyperConfig {
 	c.Driver = strings.ToLower(driver)
 	c.DisableIptables = cfg.MustBool(goconfig.DEFAULT_SECTION, "DisableIptables", false)
 	c.EnableVsock = cfg.MustBool(goconfig.DEFAULT_SECTION, "EnableVsock", false)
+	c.StorageVerifyChecksum = cfg.MustBool(goconfig.DEFAULT_SECTION, "StorageVerifyChecksum", false)
+	c.StorageReadOnly = cfg.MustBool(goconfig.DEFAULT_SECTION, "StorageReadOnly", false)
+	c.StorageFsck = cfg.MustBool(goconfig.DEFAULT_SECTION, "StorageFsck", false)
+	c.StorageMetrics = cfg.MustBool(goconfig.DEFAULT_SECTION, "StorageMetrics", false)
+	c.StorageTracing = cfg.MustBool(goconfig.DEFAULT_SECTION, "StorageTracing", false)
+	c.StorageAsyncDriverInit = cfg.MustBool(goconfig.DEFAULT_SECTION, "StorageAsyncDriverInit", false)
 	c.DefaultLog, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "Logger")
 	c.DefaultLogOpt, _ = cfg.GetSection("Log")
+	c.StorageOpt, _ = cfg.GetSection("Storage")
+	if fallbacks, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageFallbackDrivers"); fallbacks != "" {
+		for _, driver := range strings.Split(fallbacks, ",") {
+			if driver = strings.TrimSpace(driver); driver != "" {
+				c.StorageFallbackDrivers = append(c.StorageFallbackDrivers, driver)
+			}
+		}
+	}
 	c.VmFactoryPolicy, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "VmFactoryPolicy")
 	c.GRPCHost, _ = cfg.GetValue(goconfig.DEFAULT_SECTION, "gRPCHost")
+	if ttl, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageStatsTTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err != nil || d < 0 {
+			c.Log(hlog.WARNING, "invalid StorageStatsTTL %q, keep %v", ttl, c.StorageStatsTTL)
+		} else {
+			c.StorageStatsTTL = d
+		}
+	}
+	if ttl, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageUsageTTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err != nil || d < 0 {
+			c.Log(hlog.WARNING, "invalid StorageUsageTTL %q, keep %v", ttl, c.StorageUsageTTL)
+		} else {
+			c.StorageUsageTTL = d
+		}
+	}
+	if interval, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageHealthCheckInterval"); interval != "" {
+		if d, err := time.ParseDuration(interval); err != nil || d < 0 {
+			c.Log(hlog.WARNING, "invalid StorageHealthCheckInterval %q, keep %v", interval, c.StorageHealthCheckInterval)
+		} else {
+			c.StorageHealthCheckInterval = d
+		}
+	}
+	if count, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageCompactFileCount"); count != "" {
+		if n, err := strconv.ParseUint(count, 10, 64); err != nil {
+			c.Log(hlog.WARNING, "invalid StorageCompactFileCount %q, keep %v", count, c.StorageCompactFileCount)
+		} else {
+			c.StorageCompactFileCount = n
+		}
+	}
+	if limit, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StoragePrepareConcurrency"); limit != "" {
+		if n, err := strconv.Atoi(limit); err != nil || n < 0 {
+			c.Log(hlog.WARNING, "invalid StoragePrepareConcurrency %q, keep %v", limit, c.StoragePrepareConcurrency)
+		} else {
+			c.StoragePrepareConcurrency = n
+		}
+	}
+	if bandwidth, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageInjectBandwidth"); bandwidth != "" {
+		if n, err := units.RAMInBytes(bandwidth); err != nil || n < 0 {
+			c.Log(hlog.WARNING, "invalid StorageInjectBandwidth %q, keep %v", bandwidth, c.StorageInjectBytesPerSec)
+		} else {
+			c.StorageInjectBytesPerSec = n
+		}
+	}
+	if threshold, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageCircuitBreakerThreshold"); threshold != "" {
+		if n, err := strconv.Atoi(threshold); err != nil || n < 0 {
+			c.Log(hlog.WARNING, "invalid StorageCircuitBreakerThreshold %q, keep %v", threshold, c.StorageCircuitBreakerThreshold)
+		} else {
+			c.StorageCircuitBreakerThreshold = n
+		}
+	}
+	if window, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageCircuitBreakerWindow"); window != "" {
+		if d, err := time.ParseDuration(window); err != nil || d < 0 {
+			c.Log(hlog.WARNING, "invalid StorageCircuitBreakerWindow %q, keep %v", window, c.StorageCircuitBreakerWindow)
+		} else {
+			c.StorageCircuitBreakerWindow = d
+		}
+	}
+	if timeout, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageCircuitBreakerTimeout"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err != nil || d < 0 {
+			c.Log(hlog.WARNING, "invalid StorageCircuitBreakerTimeout %q, keep %v", timeout, c.StorageCircuitBreakerTimeout)
+		} else {
+			c.StorageCircuitBreakerTimeout = d
+		}
+	}
+	if interval, _ := cfg.GetValue(goconfig.DEFAULT_SECTION, "StorageCompactInterval"); interval != "" {
+		if d, err := time.ParseDuration(interval); err != nil || d <= 0 {
+			c.Log(hlog.WARNING, "invalid StorageCompactInterval %q, keep %v", interval, c.StorageCompactInterval)
+		} else {
+			c.StorageCompactInterval = d
+		}
+	}
 
 	c.Log(hlog.INFO, "config items: %#v", c)
 	return c
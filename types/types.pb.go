@@ -66,6 +66,7 @@ It has these top-level messages:
 	UserFile
 	UserVolumeOption
 	UserVolume
+	VolumeThrottle
 	UserInterface
 	UserServiceBackend
 	UserService
@@ -2560,11 +2561,18 @@ func (m *UserVolumeOption) GetMonitors() []string {
 }
 
 type UserVolume struct {
-	Name   string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Source string            `protobuf:"bytes,2,opt,name=source,proto3" json:"source,omitempty"`
-	Format string            `protobuf:"bytes,3,opt,name=format,proto3" json:"format,omitempty"`
-	Option *UserVolumeOption `protobuf:"bytes,4,opt,name=option" json:"option,omitempty"`
-	Fstype string            `protobuf:"bytes,5,opt,name=fstype,proto3" json:"fstype,omitempty"`
+	Name      string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Source    string            `protobuf:"bytes,2,opt,name=source,proto3" json:"source,omitempty"`
+	Format    string            `protobuf:"bytes,3,opt,name=format,proto3" json:"format,omitempty"`
+	Option    *UserVolumeOption `protobuf:"bytes,4,opt,name=option" json:"option,omitempty"`
+	Fstype    string            `protobuf:"bytes,5,opt,name=fstype,proto3" json:"fstype,omitempty"`
+	SizeBytes uint64            `protobuf:"varint,6,opt,name=sizeBytes,proto3" json:"sizeBytes,omitempty"`
+	Encrypted bool              `protobuf:"varint,7,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
+	Throttle  *VolumeThrottle   `protobuf:"bytes,8,opt,name=throttle" json:"throttle,omitempty"`
+	ExpiresAt int64             `protobuf:"varint,9,opt,name=expiresAt,proto3" json:"expiresAt,omitempty"`
+	Labels    map[string]string `protobuf:"bytes,10,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Sparse    bool              `protobuf:"varint,11,opt,name=sparse,proto3" json:"sparse,omitempty"`
+	Shared    bool              `protobuf:"varint,12,opt,name=shared,proto3" json:"shared,omitempty"`
 }
 
 func (m *UserVolume) Reset()                    { *m = UserVolume{} }
@@ -2607,6 +2615,94 @@ func (m *UserVolume) GetFstype() string {
 	return ""
 }
 
+func (m *UserVolume) GetSizeBytes() uint64 {
+	if m != nil {
+		return m.SizeBytes
+	}
+	return 0
+}
+
+func (m *UserVolume) GetEncrypted() bool {
+	if m != nil {
+		return m.Encrypted
+	}
+	return false
+}
+
+func (m *UserVolume) GetThrottle() *VolumeThrottle {
+	if m != nil {
+		return m.Throttle
+	}
+	return nil
+}
+
+func (m *UserVolume) GetExpiresAt() int64 {
+	if m != nil {
+		return m.ExpiresAt
+	}
+	return 0
+}
+
+func (m *UserVolume) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *UserVolume) GetSparse() bool {
+	if m != nil {
+		return m.Sparse
+	}
+	return false
+}
+
+func (m *UserVolume) GetShared() bool {
+	if m != nil {
+		return m.Shared
+	}
+	return false
+}
+
+type VolumeThrottle struct {
+	ReadBPS   uint64 `protobuf:"varint,1,opt,name=readBPS,proto3" json:"readBPS,omitempty"`
+	WriteBPS  uint64 `protobuf:"varint,2,opt,name=writeBPS,proto3" json:"writeBPS,omitempty"`
+	ReadIOPS  uint64 `protobuf:"varint,3,opt,name=readIOPS,proto3" json:"readIOPS,omitempty"`
+	WriteIOPS uint64 `protobuf:"varint,4,opt,name=writeIOPS,proto3" json:"writeIOPS,omitempty"`
+}
+
+func (m *VolumeThrottle) Reset()         { *m = VolumeThrottle{} }
+func (m *VolumeThrottle) String() string { return proto.CompactTextString(m) }
+func (*VolumeThrottle) ProtoMessage()    {}
+
+func (m *VolumeThrottle) GetReadBPS() uint64 {
+	if m != nil {
+		return m.ReadBPS
+	}
+	return 0
+}
+
+func (m *VolumeThrottle) GetWriteBPS() uint64 {
+	if m != nil {
+		return m.WriteBPS
+	}
+	return 0
+}
+
+func (m *VolumeThrottle) GetReadIOPS() uint64 {
+	if m != nil {
+		return m.ReadIOPS
+	}
+	return 0
+}
+
+func (m *VolumeThrottle) GetWriteIOPS() uint64 {
+	if m != nil {
+		return m.WriteIOPS
+	}
+	return 0
+}
+
 type UserInterface struct {
 	Bridge  string `protobuf:"bytes,1,opt,name=bridge,proto3" json:"bridge,omitempty"`
 	Ip      string `protobuf:"bytes,2,opt,name=ip,proto3" json:"ip,omitempty"`
@@ -2831,6 +2927,7 @@ type UserPod struct {
 	Portmappings          []*PortMapping        `protobuf:"bytes,16,rep,name=portmappings" json:"portmappings,omitempty"`
 	DnsOptions            []string              `protobuf:"bytes,17,rep,name=dnsOptions" json:"dnsOptions,omitempty"`
 	DnsSearch             []string              `protobuf:"bytes,18,rep,name=dnsSearch" json:"dnsSearch,omitempty"`
+	SelinuxLabel          string                `protobuf:"bytes,19,opt,name=selinuxLabel,proto3" json:"selinuxLabel,omitempty"`
 }
 
 func (m *UserPod) Reset()                    { *m = UserPod{} }
@@ -2964,6 +3061,13 @@ func (m *UserPod) GetDnsSearch() []string {
 	return nil
 }
 
+func (m *UserPod) GetSelinuxLabel() string {
+	if m != nil {
+		return m.SelinuxLabel
+	}
+	return ""
+}
+
 type PodCreateRequest struct {
 	PodSpec *UserPod `protobuf:"bytes,1,opt,name=podSpec" json:"podSpec,omitempty"`
 	PodID   string   `protobuf:"bytes,2,opt,name=podID,proto3" json:"podID,omitempty"`
@@ -4448,6 +4552,7 @@ func init() {
 	proto.RegisterType((*UserFile)(nil), "types.UserFile")
 	proto.RegisterType((*UserVolumeOption)(nil), "types.UserVolumeOption")
 	proto.RegisterType((*UserVolume)(nil), "types.UserVolume")
+	proto.RegisterType((*VolumeThrottle)(nil), "types.VolumeThrottle")
 	proto.RegisterType((*UserInterface)(nil), "types.UserInterface")
 	proto.RegisterType((*UserServiceBackend)(nil), "types.UserServiceBackend")
 	proto.RegisterType((*UserService)(nil), "types.UserService")